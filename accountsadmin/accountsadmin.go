@@ -0,0 +1,336 @@
+// Package accountsadmin implements the commands of the accounts-admin tool,
+// which lets operators inspect and change users and configuration values
+// without accessing the database directly.
+package accountsadmin
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrUsage is returned when the tool is called with an unknown command,
+	// the wrong number of arguments or an unknown flag.
+	ErrUsage = errors.New("invalid usage")
+)
+
+type (
+	// Admin runs the commands against the database and writes their results
+	// as JSON to its output.
+	Admin struct {
+		staticDB  *database.DB
+		staticOut io.Writer
+	}
+
+	// command describes a single command, e.g. `user set-tier <sub> <tier>`.
+	command struct {
+		name string
+		args []string
+		// withData tells us whether the command accepts the --with-data flag.
+		withData bool
+		run      func(a *Admin, ctx context.Context, args []string, opts options) (interface{}, error)
+	}
+
+	// options holds the flags of a command.
+	options struct {
+		pretty   bool
+		withData bool
+	}
+
+	// UserInfo describes a user to an operator. Unlike the user's own view of
+	// their account, it includes the admin flags and notes.
+	UserInfo struct {
+		ID               string      `json:"id"`
+		Sub              string      `json:"sub"`
+		Email            types.Email `json:"email"`
+		EmailConfirmed   bool        `json:"emailConfirmed"`
+		PendingEmail     types.Email `json:"pendingEmail,omitempty"`
+		Name             string      `json:"name,omitempty"`
+		Tier             int         `json:"tier"`
+		EffectiveTier    int         `json:"effectiveTier"`
+		CreatedAt        time.Time   `json:"createdAt"`
+		LastLoginAt      time.Time   `json:"lastLoginAt"`
+		StripeID         string      `json:"stripeCustomerId,omitempty"`
+		QuotaExceeded    bool        `json:"quotaExceeded"`
+		TwoFactorEnabled bool        `json:"twoFactorEnabled"`
+		Suspended        bool        `json:"suspended"`
+		AdminNotes       []string    `json:"adminNotes,omitempty"`
+		OrgID            string      `json:"orgId,omitempty"`
+		DeletedAt        *time.Time  `json:"deletedAt,omitempty"`
+	}
+
+	// UserDeleted describes the outcome of `user delete`. Purged tells us
+	// whether we deleted the user together with all of their data or only
+	// marked them as deleted.
+	UserDeleted struct {
+		Sub    string `json:"sub"`
+		Purged bool   `json:"purged"`
+	}
+)
+
+// commands lists all commands of the tool.
+var commands = []command{
+	{name: "user info", args: []string{"<email|sub>"}, run: (*Admin).userInfo},
+	{name: "user set-tier", args: []string{"<sub>", "<tier>"}, run: (*Admin).userSetTier},
+	{name: "user confirm-email", args: []string{"<sub>"}, run: (*Admin).userConfirmEmail},
+	{name: "user delete", args: []string{"<sub>"}, withData: true, run: (*Admin).userDelete},
+	{name: "apikeys list", args: []string{"<sub>"}, run: (*Admin).apiKeysList},
+	{name: "config get", args: []string{"<key>"}, run: (*Admin).configGet},
+	{name: "config set", args: []string{"<key>", "<value>"}, run: (*Admin).configSet},
+}
+
+// New returns a new Admin which writes its results to the given output.
+func New(db *database.DB, out io.Writer) *Admin {
+	return &Admin{
+		staticDB:  db,
+		staticOut: out,
+	}
+}
+
+// Usage writes the list of commands and flags to the given writer.
+func Usage(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		usage := c.name + " " + strings.Join(c.args, " ")
+		if c.withData {
+			usage += " [--with-data]"
+		}
+		fmt.Fprintln(w, "  "+usage)
+	}
+	fmt.Fprintln(w, "Flags:")
+	fmt.Fprintln(w, "  --pretty      indent the JSON output")
+	fmt.Fprintln(w, "  --with-data   delete the user together with all of their data instead of only marking them as deleted")
+}
+
+// Run runs the command given by args, e.g. `user info user@siasky.net`, and
+// writes its result to the output as JSON. Flags can appear anywhere among the
+// arguments.
+func (a *Admin) Run(ctx context.Context, args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("accounts-admin", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&opts.pretty, "pretty", false, "")
+	fs.BoolVar(&opts.withData, "with-data", false, "")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return errors.Compose(ErrUsage, err)
+	}
+	cmd, args, err := findCommand(args)
+	if err != nil {
+		return err
+	}
+	if opts.withData && !cmd.withData {
+		return errors.AddContext(ErrUsage, fmt.Sprintf("'%s' doesn't accept --with-data", cmd.name))
+	}
+	res, err := cmd.run(a, ctx, args, opts)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	if opts.pretty {
+		b, err = json.MarshalIndent(res, "", "  ")
+	} else {
+		b, err = json.Marshal(res)
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to serialize the result")
+	}
+	_, err = fmt.Fprintln(a.staticOut, string(b))
+	return err
+}
+
+// parseArgs parses the flags among the given arguments and returns the
+// remaining, positional arguments. Unlike fs.Parse, it doesn't stop at the
+// first positional argument, so `user delete <sub> --with-data` works.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// findCommand finds the command given by the first two arguments and returns
+// it together with its arguments.
+func findCommand(args []string) (command, []string, error) {
+	if len(args) < 2 {
+		return command{}, nil, errors.AddContext(ErrUsage, "missing command")
+	}
+	name := args[0] + " " + args[1]
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if len(args)-2 != len(c.args) {
+			return command{}, nil, errors.AddContext(ErrUsage, fmt.Sprintf("usage: %s %s", c.name, strings.Join(c.args, " ")))
+		}
+		return c, args[2:], nil
+	}
+	return command{}, nil, errors.AddContext(ErrUsage, fmt.Sprintf("unknown command '%s'", name))
+}
+
+// userInfo describes the user with the given email or sub.
+func (a *Admin) userInfo(ctx context.Context, args []string, _ options) (interface{}, error) {
+	var u *database.User
+	var err error
+	if strings.Contains(args[0], "@") {
+		var email types.Email
+		email, err = types.NormalizeEmail(args[0])
+		if err != nil {
+			return nil, err
+		}
+		u, err = a.staticDB.UserByEmail(ctx, email)
+	} else {
+		u, err = a.staticDB.UserBySub(ctx, args[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return userInfoFromUser(u), nil
+}
+
+// userSetTier sets the tier of the user with the given sub.
+func (a *Admin) userSetTier(ctx context.Context, args []string, _ options) (interface{}, error) {
+	tier, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.AddContext(err, "invalid tier")
+	}
+	u, err := a.staticDB.UserBySub(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = a.staticDB.UserSetTier(ctx, u, tier)
+	if err != nil {
+		return nil, err
+	}
+	return userInfoFromUser(u), nil
+}
+
+// userConfirmEmail confirms the email address of the user with the given sub
+// without a confirmation token.
+func (a *Admin) userConfirmEmail(ctx context.Context, args []string, _ options) (interface{}, error) {
+	u, err := a.staticDB.UserBySub(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = a.staticDB.UserSetEmailConfirmed(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return userInfoFromUser(u), nil
+}
+
+// userDelete marks the user with the given sub as deleted, so they get purged
+// once the grace period passes. With --with-data it deletes the user and all
+// of their data right away.
+func (a *Admin) userDelete(ctx context.Context, args []string, opts options) (interface{}, error) {
+	u, err := a.staticDB.UserBySub(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if opts.withData {
+		err = a.staticDB.UserDelete(ctx, u)
+	} else {
+		err = a.staticDB.UserSoftDelete(ctx, u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return UserDeleted{Sub: u.Sub, Purged: opts.withData}, nil
+}
+
+// apiKeysList lists the API keys of the user with the given sub. It doesn't
+// reveal the keys themselves.
+func (a *Admin) apiKeysList(ctx context.Context, args []string, _ options) (interface{}, error) {
+	u, err := a.staticDB.UserBySub(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return a.staticDB.APIKeyList(ctx, *u)
+}
+
+// configGet reads the given configuration value. Unset feature flags are
+// reported as false.
+func (a *Admin) configGet(ctx context.Context, args []string, _ options) (interface{}, error) {
+	key := args[0]
+	if !database.IsFeatureFlag(key) && key != database.ConfValPublicAPIKeyTiers {
+		return nil, fmt.Errorf("unknown configuration key '%s'", key)
+	}
+	val, err := a.staticDB.ReadConfigValue(ctx, key)
+	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, errors.AddContext(err, "failed to read from configuration")
+	}
+	if database.IsFeatureFlag(key) && val != database.ConfValTrue {
+		val = database.ConfValFalse
+	}
+	return database.ConfVal{Key: key, Value: val}, nil
+}
+
+// configSet sets the given configuration value. Running instances of the
+// service pick up the change once their configuration cache expires.
+func (a *Admin) configSet(ctx context.Context, args []string, _ options) (interface{}, error) {
+	key, val := args[0], args[1]
+	switch {
+	case database.IsFeatureFlag(key):
+		if val != database.ConfValTrue && val != database.ConfValFalse {
+			return nil, fmt.Errorf("invalid value '%s', expected '%s' or '%s'", val, database.ConfValTrue, database.ConfValFalse)
+		}
+	case key == database.ConfValPublicAPIKeyTiers:
+		if _, err := database.ParseTierList(val); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown configuration key '%s'", key)
+	}
+	err := a.staticDB.WriteConfigValue(ctx, key, val)
+	if err != nil {
+		return nil, err
+	}
+	return database.ConfVal{Key: key, Value: val}, nil
+}
+
+// userInfoFromUser describes the given user.
+func userInfoFromUser(u *database.User) UserInfo {
+	info := UserInfo{
+		ID:               u.ID.Hex(),
+		Sub:              u.Sub,
+		Email:            u.Email,
+		EmailConfirmed:   u.EmailConfirmationToken == "",
+		PendingEmail:     u.PendingEmail,
+		Name:             u.Name,
+		Tier:             u.Tier,
+		EffectiveTier:    u.EffectiveTier(),
+		CreatedAt:        u.CreatedAt,
+		LastLoginAt:      u.LastLoginAt,
+		StripeID:         u.StripeID,
+		QuotaExceeded:    u.QuotaExceeded,
+		TwoFactorEnabled: u.TwoFactorEnabled,
+		Suspended:        u.Suspended,
+		AdminNotes:       u.AdminNotes,
+	}
+	if u.InOrg() {
+		info.OrgID = u.OrgID.Hex()
+	}
+	if u.Deleted() {
+		info.DeletedAt = &u.DeletedAt
+	}
+	return info
+}
@@ -0,0 +1,90 @@
+package accountsadmin
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestParseArgs ensures that parseArgs finds flags anywhere among the
+// arguments.
+func TestParseArgs(t *testing.T) {
+	var pretty, withData bool
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&pretty, "pretty", false, "")
+	fs.BoolVar(&withData, "with-data", false, "")
+	args, err := parseArgs(fs, []string{"--pretty", "user", "delete", "sub", "--with-data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"user", "delete", "sub"}; !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %v, got %v", expected, args)
+	}
+	if !pretty || !withData {
+		t.Fatalf("Expected both flags to be set, got %t and %t", pretty, withData)
+	}
+	_, err = parseArgs(fs, []string{"user", "info", "--unknown"})
+	if err == nil {
+		t.Fatal("Expected an error for an unknown flag.")
+	}
+}
+
+// TestFindCommand ensures that findCommand finds all commands and checks the
+// number of their arguments.
+func TestFindCommand(t *testing.T) {
+	tests := map[string][]string{
+		"user info":          {"user", "info", "user@siasky.net"},
+		"user set-tier":      {"user", "set-tier", "sub", "2"},
+		"user confirm-email": {"user", "confirm-email", "sub"},
+		"user delete":        {"user", "delete", "sub"},
+		"apikeys list":       {"apikeys", "list", "sub"},
+		"config get":         {"config", "get", "key"},
+		"config set":         {"config", "set", "key", "value"},
+	}
+	for name, args := range tests {
+		c, cmdArgs, err := findCommand(args)
+		if err != nil {
+			t.Fatalf("Failed to find '%s': %v", name, err)
+		}
+		if c.name != name || !reflect.DeepEqual(cmdArgs, args[2:]) {
+			t.Fatalf("Expected '%s' with %v, got '%s' with %v", name, args[2:], c.name, cmdArgs)
+		}
+	}
+	if len(tests) != len(commands) {
+		t.Fatalf("Expected to test %d commands, tested %d", len(commands), len(tests))
+	}
+}
+
+// TestRunUsage ensures that Run rejects invalid invocations before it touches
+// the database.
+func TestRunUsage(t *testing.T) {
+	var out bytes.Buffer
+	a := New(nil, &out)
+	invalid := map[string][]string{
+		"no command":        {},
+		"incomplete":        {"user"},
+		"unknown command":   {"user", "frobnicate", "sub"},
+		"missing argument":  {"user", "set-tier", "sub"},
+		"extra argument":    {"user", "info", "sub", "other"},
+		"unknown flag":      {"user", "info", "sub", "--force"},
+		"misplaced flag":    {"user", "info", "sub", "--with-data"},
+		"help":              {"--help"},
+		"flag without sub":  {"--pretty"},
+		"command after all": {"sub", "user", "info"},
+	}
+	for name, args := range invalid {
+		err := a.Run(context.Background(), args)
+		if !errors.Contains(err, ErrUsage) {
+			t.Fatalf("Expected '%v' for %s, got '%v'", ErrUsage, name, err)
+		}
+	}
+	if out.Len() > 0 {
+		t.Fatalf("Expected no output, got '%s'", out.String())
+	}
+}
@@ -0,0 +1,662 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// AdminAPIKeyHeader holds the name of the header in which callers of the
+	// admin endpoints pass the admin API key.
+	AdminAPIKeyHeader = "Skynet-Admin-API-Key" // #nosec
+	// AdminNameHeader holds the name of the optional header in which callers
+	// of the admin endpoints identify themselves. We record the name with the
+	// notes they leave on user accounts.
+	AdminNameHeader = "Skynet-Admin-Name"
+
+	// defaultAdminName is the admin identity we record when the caller
+	// doesn't send the AdminNameHeader.
+	defaultAdminName = "admin"
+
+	// defaultCohortWeeks is the number of weeks covered by a cohort retention
+	// report, unless the caller requests otherwise.
+	defaultCohortWeeks = 8
+)
+
+var (
+	// AdminAPIKey is the credential callers of the admin endpoints need to
+	// present. The admin endpoints are disabled when it's empty. This value
+	// is configurable via the ACCOUNTS_ADMIN_APIKEY environment variable.
+	AdminAPIKey = ""
+
+	// AdminStatsCacheTTL defines how long we cache the portal stats served by
+	// `GET /admin/stats`. This value is configurable via the
+	// ACCOUNTS_ADMIN_STATS_CACHE_MINUTES environment variable.
+	AdminStatsCacheTTL = 10 * time.Minute
+
+	// ErrNotAdmin is returned when the caller of an admin endpoint doesn't
+	// present a valid admin API key.
+	ErrNotAdmin = errors.New("invalid admin credentials")
+)
+
+type (
+	// AdminUserTierPOST describes the body of a POST request that sets the
+	// user's tier.
+	AdminUserTierPOST struct {
+		Tier int `json:"tier"`
+	}
+	// AdminUserTrialPOST describes the body of a POST request that grants the
+	// user a trial tier until the given time.
+	AdminUserTrialPOST struct {
+		Tier  int       `json:"tier"`
+		Until time.Time `json:"until"`
+	}
+	// AdminOrgTierPOST describes the body of a POST request that sets the
+	// tier of an organization.
+	AdminOrgTierPOST struct {
+		Tier int `json:"tier"`
+	}
+	// AdminUserFlagsPUT describes the body of a PUT request that suspends or
+	// unsuspends the user and/or leaves a note on their account. Omitting
+	// Suspended leaves the flag unchanged.
+	AdminUserFlagsPUT struct {
+		Suspended *bool  `json:"suspended"`
+		AddNote   string `json:"addNote"`
+	}
+	// AdminUserFlagsGET describes the admin flags and notes of a user.
+	AdminUserFlagsGET struct {
+		Sub        string   `json:"sub"`
+		Suspended  bool     `json:"suspended"`
+		AdminNotes []string `json:"adminNotes"`
+	}
+	// AdminConfigPUT describes the body of a PUT request that sets a feature
+	// flag. The value needs to be either "true" or "false".
+	AdminConfigPUT struct {
+		Value string `json:"value"`
+	}
+	// AdminSkylinksBlockedGET describes a page of blocked skylinks.
+	AdminSkylinksBlockedGET struct {
+		Items    []database.Skylink `json:"items"`
+		Offset   int                `json:"offset"`
+		PageSize int                `json:"pageSize"`
+		Count    int64              `json:"count"`
+		HasMore  bool               `json:"hasMore"`
+	}
+	// AdminUploadsByIPGET describes a page of the uploads made from a given
+	// IP. Count is the total number of such uploads.
+	AdminUploadsByIPGET struct {
+		Items    []database.UploadByIP `json:"items"`
+		Offset   int                   `json:"offset"`
+		PageSize int                   `json:"pageSize"`
+		Count    int64                 `json:"count"`
+		HasMore  bool                  `json:"hasMore"`
+	}
+	// AdminDownloadsByIPGET describes a page of the downloads made from a
+	// given IP. Count is the total number of such downloads.
+	AdminDownloadsByIPGET struct {
+		Items    []database.DownloadByIP `json:"items"`
+		Offset   int                     `json:"offset"`
+		PageSize int                     `json:"pageSize"`
+		Count    int64                   `json:"count"`
+		HasMore  bool                    `json:"hasMore"`
+	}
+	// AdminUploadsByCountryGET describes the number of uploads per country
+	// since a given time, most active countries first.
+	AdminUploadsByCountryGET struct {
+		Since     time.Time                   `json:"since"`
+		Countries []database.UploadsByCountry `json:"countries"`
+	}
+)
+
+// adminCohortsGET returns a weekly cohort retention report for the users who
+// signed up during the last `weeks` weeks. Reports are cached for a day.
+func (api *API) adminCohortsGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	weeks := defaultCohortWeeks
+	if ws := req.FormValue("weeks"); ws != "" {
+		var err error
+		weeks, err = strconv.Atoi(ws)
+		if err != nil || weeks < 1 || weeks > database.CohortWeeksMax {
+			api.WriteError(w, errors.New("weeks must be between 1 and "+strconv.Itoa(database.CohortWeeksMax)), http.StatusBadRequest)
+			return
+		}
+	}
+	if cm, ok := api.staticCohortsCache.Get(weeks); ok {
+		api.WriteJSON(w, cm)
+		return
+	}
+	cm, err := api.staticDB.Cohorts(req.Context(), weeks)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticCohortsCache.Set(weeks, cm)
+	api.WriteJSON(w, cm)
+}
+
+// adminStatsGET returns an overview of the portal's users and their activity.
+// Building it is expensive, so we cache it for AdminStatsCacheTTL. Its
+// generatedAt field tells the caller how fresh it is.
+func (api *API) adminStatsGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if ps, ok := api.staticPortalStatsCache.Get(); ok {
+		api.WriteJSON(w, ps)
+		return
+	}
+	ps, err := api.staticDB.PortalStats(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticPortalStatsCache.Set(ps)
+	api.WriteJSON(w, ps)
+}
+
+// adminUserTierPOST sets the given user's tier, regardless of their
+// subscription status. Portal operators can use this to comp an account or to
+// fix a tier which got out of sync with Stripe.
+func (api *API) adminUserTierPOST(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body AdminUserTierPOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if body.Tier <= database.TierAnonymous || body.Tier >= database.TierMaxReserved {
+		api.WriteError(w, fmt.Errorf("invalid tier %d", body.Tier), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	u, err := api.staticDB.UserBySub(ctx, ps.ByName("sub"))
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	oldTier := u.Tier
+	err = api.staticDB.UserSetTier(ctx, u, body.Tier)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.Invalidate(u.Sub)
+	api.auditLog(req, u.ID, database.AuditActionTierChange, tierChangeMetadata(oldTier, body.Tier, "admin"))
+	api.WriteJSON(w, UserGETFromUser(u))
+}
+
+// adminUserTrialPOST grants the given user a trial tier until the given time.
+// The trial applies on top of the user's paid tier, so it never lowers their
+// limits, and it doesn't affect their subscription. Granting a new trial
+// replaces the previous one.
+func (api *API) adminUserTrialPOST(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body AdminUserTrialPOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if body.Tier <= database.TierFree || body.Tier >= database.TierMaxReserved {
+		api.WriteError(w, fmt.Errorf("invalid trial tier %d", body.Tier), http.StatusBadRequest)
+		return
+	}
+	if !body.Until.After(time.Now().UTC()) {
+		api.WriteError(w, errors.New("the trial needs to end in the future"), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	u, err := api.staticDB.UserBySub(ctx, ps.ByName("sub"))
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	oldTier := u.EffectiveTier()
+	err = api.staticDB.UserSetTrial(ctx, u, body.Tier, body.Until)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.Invalidate(u.Sub)
+	md := tierChangeMetadata(oldTier, u.EffectiveTier(), "trial")
+	md["trialUntil"] = u.TrialUntil.Format(time.RFC3339)
+	api.auditLog(req, u.ID, database.AuditActionTierChange, md)
+	api.WriteJSON(w, UserGETFromUser(u))
+}
+
+// adminUserFlagsPUT suspends or unsuspends the given user and appends a note
+// to their account. Each note is prefixed with the current time and the
+// caller's AdminNameHeader. Suspended users can't log in or use their JWTs
+// and API keys.
+func (api *API) adminUserFlagsPUT(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body AdminUserFlagsPUT
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	body.AddNote = strings.TrimSpace(body.AddNote)
+	if body.Suspended == nil && body.AddNote == "" {
+		api.WriteError(w, errors.New("nothing to update"), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	u, err := api.staticDB.UserBySub(ctx, ps.ByName("sub"))
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var note string
+	if body.AddNote != "" {
+		admin := strings.TrimSpace(req.Header.Get(AdminNameHeader))
+		if admin == "" {
+			admin = defaultAdminName
+		}
+		note = fmt.Sprintf("%s [%s] %s", time.Now().UTC().Format(time.RFC3339), admin, body.AddNote)
+	}
+	wasSuspended := u.Suspended
+	err = api.staticDB.UserSetAdminFlags(ctx, u, body.Suspended, note)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if u.Suspended != wasSuspended {
+		api.staticUserTierCache.Invalidate(u.Sub)
+	}
+	api.WriteJSON(w, AdminUserFlagsGET{
+		Sub:        u.Sub,
+		Suspended:  u.Suspended,
+		AdminNotes: u.AdminNotes,
+	})
+}
+
+// adminOrgTierPOST sets the tier of the given organization. The tier applies
+// to all of its members and their pooled usage is checked against it.
+func (api *API) adminOrgTierPOST(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body AdminOrgTierPOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if body.Tier <= database.TierAnonymous || body.Tier >= database.TierMaxReserved {
+		api.WriteError(w, fmt.Errorf("invalid tier %d", body.Tier), http.StatusBadRequest)
+		return
+	}
+	orgID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	org, err := api.staticDB.OrgByID(ctx, orgID)
+	if errors.Contains(err, database.ErrOrgNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.OrgSetTier(ctx, org, body.Tier)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var owner *database.User
+	api.managedInvalidateOrg(ctx, org, func(m *database.User) {
+		if m.ID == org.OwnerID {
+			owner = m
+		}
+	})
+	api.WriteJSON(w, org)
+	// The pooled usage might fit the new tier or not anymore.
+	// Note that this call is not affected by the request's context, so we use
+	// a separate one.
+	if owner != nil {
+		go api.checkUserQuotas(context.Background(), owner)
+	}
+}
+
+// adminLimitsPUT overrides the limits of the given tier. Only the fields
+// present in the body override the compiled-in defaults, so an empty body
+// restores them. The new limits take effect immediately on this instance and
+// within database.TierLimitsRefreshInterval on all others.
+func (api *API) adminLimitsPUT(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	tier, err := strconv.Atoi(ps.ByName("tier"))
+	if err != nil || tier < database.TierAnonymous || tier >= database.TierMaxReserved {
+		api.WriteError(w, fmt.Errorf("invalid tier '%s'", ps.ByName("tier")), http.StatusBadRequest)
+		return
+	}
+	var body database.TierLimitsOverride
+	err = parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	err = api.staticDB.TierLimitsOverrideSet(ctx, tier, body)
+	if errors.Contains(err, database.ErrInvalidTierLimits) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.RefreshTierLimits(ctx)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, tierLimitsPublicFromTier(database.LimitsForTier(tier)))
+}
+
+// adminConfigGET returns the current value of the given feature flag. Flags
+// which have never been set are reported as false.
+func (api *API) adminConfigGET(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	if !database.IsFeatureFlag(key) {
+		api.WriteError(w, fmt.Errorf("unknown configuration key '%s'", key), http.StatusNotFound)
+		return
+	}
+	val, err := api.staticDB.ReadConfigValue(req.Context(), key)
+	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
+		api.WriteError(w, errors.AddContext(err, "failed to read from configuration"), http.StatusInternalServerError)
+		return
+	}
+	if val != database.ConfValTrue {
+		val = database.ConfValFalse
+	}
+	api.WriteJSON(w, database.ConfVal{Key: key, Value: val})
+}
+
+// adminConfigPUT sets the given feature flag. The change takes effect
+// immediately on this instance and within configCacheTTL on all others.
+func (api *API) adminConfigPUT(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	if !database.IsFeatureFlag(key) {
+		api.WriteError(w, fmt.Errorf("unknown configuration key '%s'", key), http.StatusNotFound)
+		return
+	}
+	var body AdminConfigPUT
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if body.Value != database.ConfValTrue && body.Value != database.ConfValFalse {
+		api.WriteError(w, fmt.Errorf("invalid value '%s', expected '%s' or '%s'", body.Value, database.ConfValTrue, database.ConfValFalse), http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.WriteConfigValue(req.Context(), key, body.Value)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticConfigCache.Invalidate(key)
+	api.staticLogger.Infof("Set configuration value %s to %s", key, body.Value)
+	api.WriteJSON(w, database.ConfVal{Key: key, Value: body.Value})
+}
+
+// adminSkylinkBlockPOST blocks the given skylink. We refuse to track uploads
+// and downloads of blocked skylinks and they only ever get anonymous limits.
+func (api *API) adminSkylinkBlockPOST(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sl, err := api.staticDB.SkylinkBlock(req.Context(), ps.ByName("skylink"))
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticSkylinkBlockedCache.Invalidate(sl.Skylink)
+	api.staticLogger.Infof("Blocked skylink %s", sl.Skylink)
+	api.WriteJSON(w, sl)
+}
+
+// adminSkylinkBlockDELETE unblocks the given skylink.
+func (api *API) adminSkylinkBlockDELETE(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	err := api.staticDB.SkylinkUnblock(req.Context(), ps.ByName("skylink"))
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if sl, err := database.NormalizeSkylink(ps.ByName("skylink")); err == nil {
+		api.staticSkylinkBlockedCache.Invalidate(sl)
+	}
+	api.staticLogger.Infof("Unblocked skylink %s", ps.ByName("skylink"))
+	api.WriteSuccess(w)
+}
+
+// adminSkylinkDELETE purges all uploads and downloads of the given skylink,
+// e.g. following a takedown request. The skylink keeps its block state. It reports the number of
+// removed uploads and downloads. Users who uploaded the skylink get their
+// quotas rechecked, as their storage usage drops.
+func (api *API) adminSkylinkDELETE(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	res, err := api.staticDB.SkylinkPurge(req.Context(), ps.ByName("skylink"))
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticLogger.Infof("Purged skylink %s with %d uploads and %d downloads", res.Skylink, res.Uploads, res.Downloads)
+	api.WriteJSON(w, res)
+	// Note that this call is not affected by the request's context, so we use
+	// a separate one.
+	go func() {
+		ctx := context.Background()
+		for _, uID := range res.Users {
+			u, err := api.staticDB.UserByID(ctx, uID)
+			if err != nil {
+				api.staticLogger.Debugf("Failed to fetch user %s after purging a skylink: %v", uID.Hex(), err)
+				continue
+			}
+			api.checkUserQuotas(ctx, u)
+		}
+	}()
+}
+
+// adminSkylinkStatsGET returns the aggregate download stats of the given
+// skylink, including anonymous downloads.
+func (api *API) adminSkylinkStatsGET(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	stats, err := api.staticDB.SkylinkDownloadStats(req.Context(), ps.ByName("skylink"))
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, stats)
+}
+
+// adminSkylinksBlockedGET returns a page of blocked skylinks, most recently
+// blocked first.
+func (api *API) adminSkylinksBlockedGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	offset, err1 := fetchOffset(req.Form)
+	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
+	if err := errors.Compose(err1, err2); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	sls, total, err := api.staticDB.SkylinksBlocked(req.Context(), offset, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := AdminSkylinksBlockedGET{
+		Items:    sls,
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    total,
+		HasMore:  int64(offset+len(sls)) < total,
+	}
+	api.WriteJSON(w, response)
+}
+
+// adminUploadsByIPGET returns a page of the uploads made from the given IP by
+// any user, most recent first. Portal operators use it when investigating
+// abuse.
+func (api *API) adminUploadsByIPGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ip, since, err1 := fetchIPActivityFilter(req.Form)
+	offset, err2 := fetchOffset(req.Form)
+	pageSize, err3 := fetchPageSize(req.Form, DefaultPageSizeLarge)
+	if err := errors.Compose(err1, err2, err3); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ups, total, err := api.staticDB.UploadsByIP(req.Context(), ip, since, offset, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := AdminUploadsByIPGET{
+		Items:    ups,
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    total,
+		HasMore:  int64(offset+len(ups)) < total,
+	}
+	api.WriteJSON(w, response)
+}
+
+// adminDownloadsByIPGET returns a page of the downloads made from the given IP
+// by any user, most recent first.
+func (api *API) adminDownloadsByIPGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ip, since, err1 := fetchIPActivityFilter(req.Form)
+	offset, err2 := fetchOffset(req.Form)
+	pageSize, err3 := fetchPageSize(req.Form, DefaultPageSizeLarge)
+	if err := errors.Compose(err1, err2, err3); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	downs, total, err := api.staticDB.DownloadsByIP(req.Context(), ip, since, offset, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := AdminDownloadsByIPGET{
+		Items:    downs,
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    total,
+		HasMore:  int64(offset+len(downs)) < total,
+	}
+	api.WriteJSON(w, response)
+}
+
+// adminUploadsByCountryGET returns the number of uploads per country since
+// the given time. Uploads whose country we couldn't determine are counted
+// under database.UnknownCountry.
+func (api *API) adminUploadsByCountryGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	since, err := fetchSince(req.Form)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	counts, err := api.staticDB.UploadsByCountry(req.Context(), since)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := AdminUploadsByCountryGET{
+		Since:     since,
+		Countries: counts,
+	}
+	api.WriteJSON(w, response)
+}
+
+// fetchIPActivityFilter extracts the IP and the optional start time of an
+// uploads or downloads by IP query from the params.
+func fetchIPActivityFilter(form url.Values) (string, time.Time, error) {
+	ip := validateIP(form.Get("ip"))
+	if ip == "" {
+		return "", time.Time{}, database.ErrInvalidIP
+	}
+	since, err := fetchSince(form)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return ip, since, nil
+}
+
+// fetchSince extracts the optional RFC3339 `since` timestamp from the params.
+// It returns the zero time if the param is missing.
+func fetchSince(form url.Values) (time.Time, error) {
+	s := form.Get("since")
+	if s == "" {
+		return time.Time{}, nil
+	}
+	since, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.AddContext(err, "invalid 'since' timestamp")
+	}
+	return since, nil
+}
+
+// withAdmin ensures that the caller presents a valid admin API key.
+func (api *API) withAdmin(h HandlerWithUser) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		api.logRequest(req)
+		if !isAdmin(req) {
+			api.WriteError(w, ErrNotAdmin, http.StatusUnauthorized)
+			return
+		}
+		h(nil, w, req, ps)
+	}
+}
+
+// isAdmin returns true if the request presents a valid admin API key.
+func isAdmin(req *http.Request) bool {
+	key := req.Header.Get(AdminAPIKeyHeader)
+	return AdminAPIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(AdminAPIKey)) == 1
+}
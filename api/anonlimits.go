@@ -0,0 +1,282 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// anonUsageCacheMaxSize is the number of IPs we keep anonymous usage
+	// counters for. Once we exceed it, we evict the least recently used IPs.
+	anonUsageCacheMaxSize = 100000
+)
+
+const (
+	// anonUsageUpload marks an anonymous upload.
+	anonUsageUpload anonUsageKind = iota
+	// anonUsageDownload marks an anonymous download.
+	anonUsageDownload
+)
+
+var (
+	// AnonymousHourlyUploadLimit is the number of anonymous uploads we track
+	// per IP per hour. Zero disables the limit. This value is configurable
+	// via the ACCOUNTS_ANON_HOURLY_UPLOAD_LIMIT environment variable.
+	AnonymousHourlyUploadLimit = 1000
+	// AnonymousHourlyDownloadLimit is the number of anonymous downloads we
+	// track per IP per hour. Zero disables the limit. This value is
+	// configurable via the ACCOUNTS_ANON_HOURLY_DOWNLOAD_LIMIT environment
+	// variable.
+	AnonymousHourlyDownloadLimit = 10000
+
+	// ErrAnonymousLimitExceeded is returned when an IP has made too many
+	// anonymous uploads or downloads within the current hour.
+	ErrAnonymousLimitExceeded = errors.New("too many anonymous requests from this IP, please try again later")
+
+	// anonUsagePersistInterval defines how often we persist the anonymous
+	// usage counters, so they survive restarts.
+	anonUsagePersistInterval = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  500 * time.Millisecond,
+			Standard: time.Minute,
+		},
+	).(time.Duration)
+)
+
+type (
+	// anonUsageKind tells apart the different kinds of anonymous usage we
+	// limit.
+	anonUsageKind int
+
+	// anonUsageTracker counts the anonymous uploads and downloads tracked
+	// from each IP during the current hour. It's an LRU cache, so it doesn't
+	// grow indefinitely. Evicting an IP resets its counters. The counters
+	// are kept per instance and synced with the other instances via the DB
+	// on every persist, so an IP can briefly get a few more requests than
+	// the limit when it hits several instances at once.
+	anonUsageTracker struct {
+		uploadLimit   int
+		downloadLimit int
+		maxSize       int
+		entries       map[string]*list.Element
+		lru           *list.List
+		mu            sync.Mutex
+	}
+	// anonUsageEntry holds the counters of a single IP. The pending counters
+	// hold the usage we haven't persisted yet.
+	anonUsageEntry struct {
+		ip               string
+		hour             time.Time
+		uploads          int64
+		downloads        int64
+		pendingUploads   int64
+		pendingDownloads int64
+	}
+)
+
+// newAnonUsageTracker creates a new anonUsageTracker. A limit of zero or less
+// disables the respective check.
+func newAnonUsageTracker(uploadLimit, downloadLimit, maxSize int) *anonUsageTracker {
+	return &anonUsageTracker{
+		uploadLimit:   uploadLimit,
+		downloadLimit: downloadLimit,
+		maxSize:       maxSize,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+	}
+}
+
+// Allow counts an anonymous request of the given kind from the given IP. It
+// returns false without counting the request if the IP has already reached
+// its hourly limit.
+func (t *anonUsageTracker) Allow(ip string, kind anonUsageKind, now time.Time) bool {
+	limit := t.uploadLimit
+	if kind == anonUsageDownload {
+		limit = t.downloadLimit
+	}
+	if limit <= 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(ip, now.UTC().Truncate(time.Hour))
+	count, pending := &e.uploads, &e.pendingUploads
+	if kind == anonUsageDownload {
+		count, pending = &e.downloads, &e.pendingDownloads
+	}
+	if *count >= int64(limit) {
+		return false
+	}
+	*count++
+	*pending++
+	return true
+}
+
+// Load sets the counters of the given IPs to the given usage, unless we have
+// already counted more requests for them.
+func (t *anonUsageTracker) Load(usage []database.AnonUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, u := range usage {
+		e := t.entry(u.IP, u.Hour.UTC())
+		if !e.hour.Equal(u.Hour.UTC()) {
+			continue
+		}
+		if u.Uploads > e.uploads {
+			e.uploads = u.Uploads
+		}
+		if u.Downloads > e.downloads {
+			e.downloads = u.Downloads
+		}
+	}
+}
+
+// Restore adds back usage returned by Pending which we failed to persist, so
+// we retry it on the next persist. Usage from a previous hour is dropped.
+func (t *anonUsageTracker) Restore(usage []database.AnonUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, u := range usage {
+		_, exists := t.entries[u.IP]
+		e := t.entry(u.IP, u.Hour.UTC())
+		if !e.hour.Equal(u.Hour.UTC()) {
+			continue
+		}
+		if !exists {
+			e.uploads, e.downloads = u.Uploads, u.Downloads
+		}
+		e.pendingUploads += u.Uploads
+		e.pendingDownloads += u.Downloads
+	}
+}
+
+// Pending returns the usage we haven't persisted yet and resets the pending
+// counters.
+func (t *anonUsageTracker) Pending() []database.AnonUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var usage []database.AnonUsage
+	for el := t.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*anonUsageEntry)
+		if e.pendingUploads == 0 && e.pendingDownloads == 0 {
+			continue
+		}
+		usage = append(usage, database.AnonUsage{
+			IP:        e.ip,
+			Hour:      e.hour,
+			Uploads:   e.pendingUploads,
+			Downloads: e.pendingDownloads,
+		})
+		e.pendingUploads, e.pendingDownloads = 0, 0
+	}
+	return usage
+}
+
+// entry returns the entry of the given IP and marks it as most recently used.
+// The counters of an entry from a previous hour are reset. The caller needs
+// to hold the lock.
+func (t *anonUsageTracker) entry(ip string, hour time.Time) *anonUsageEntry {
+	if el, exists := t.entries[ip]; exists {
+		t.lru.MoveToFront(el)
+		e := el.Value.(*anonUsageEntry)
+		if e.hour.Before(hour) {
+			*e = anonUsageEntry{ip: ip, hour: hour}
+		}
+		return e
+	}
+	e := &anonUsageEntry{ip: ip, hour: hour}
+	t.entries[ip] = t.lru.PushFront(e)
+	for t.lru.Len() > t.maxSize {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.entries, oldest.Value.(*anonUsageEntry).ip)
+	}
+	return e
+}
+
+// StartAnonUsagePersister loads the current hour's anonymous usage counters
+// from the DB and starts a background thread which periodically persists
+// them until the given context is closed.
+func (api *API) StartAnonUsagePersister(ctx context.Context) error {
+	usage, err := api.staticDB.AnonUsageByHour(ctx, time.Now().UTC().Truncate(time.Hour))
+	if err != nil {
+		return errors.AddContext(err, "failed to load anonymous usage")
+	}
+	api.staticAnonUsage.Load(usage)
+	go api.threadedPersistAnonUsage(ctx)
+	return nil
+}
+
+// threadedPersistAnonUsage periodically persists the anonymous usage counters
+// and loads the current hour's usage back from the DB, so the counters also
+// include the usage tracked by other instances.
+func (api *API) threadedPersistAnonUsage(ctx context.Context) {
+	ticker := time.NewTicker(anonUsagePersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		api.managedPersistAnonUsage(ctx)
+	}
+}
+
+// managedPersistAnonUsage persists the pending anonymous usage and loads the
+// current hour's usage from the DB. If persisting fails, the pending usage is
+// restored and retried on the next run. A failed bulk write might have
+// persisted some of the usage already, so a retry can overcount it slightly,
+// which is the safe direction for a rate limit.
+func (api *API) managedPersistAnonUsage(ctx context.Context) {
+	pending := api.staticAnonUsage.Pending()
+	err := api.staticDB.AnonUsageIncrement(ctx, pending)
+	if err != nil {
+		api.staticAnonUsage.Restore(pending)
+		api.staticLogger.Warnln("Failed to persist anonymous usage:", err)
+		return
+	}
+	usage, err := api.staticDB.AnonUsageByHour(ctx, time.Now().UTC().Truncate(time.Hour))
+	if err != nil {
+		api.staticLogger.Warnln("Failed to load anonymous usage:", err)
+		return
+	}
+	api.staticAnonUsage.Load(usage)
+}
+
+// checkAnonUsage counts an anonymous track request of the given kind. If the
+// caller's IP has exceeded its hourly limit, it writes a 429 with a
+// Retry-After header and returns false. The IP comes from the `ip` form value,
+// which Nginx sets to the uploader's or downloader's IP, and falls back to
+// the caller's IP.
+func (api *API) checkAnonUsage(w http.ResponseWriter, req *http.Request, kind anonUsageKind) bool {
+	if api.staticDeps.Disrupt("DependencySkipRateLimiting") {
+		return true
+	}
+	ip := validateIP(req.FormValue("ip"))
+	if ip == "" {
+		ip = clientIP(req)
+	}
+	now := time.Now()
+	if api.staticAnonUsage.Allow(ip, kind, now) {
+		return true
+	}
+	nextHour := now.UTC().Truncate(time.Hour).Add(time.Hour)
+	secs := int(math.Ceil(nextHour.Sub(now).Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	api.WriteError(w, ErrAnonymousLimitExceeded, http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+)
+
+// TestAnonUsageTracker ensures that anonUsageTracker enforces the hourly
+// limits per IP and kind, resets them every hour, and evicts the least
+// recently used IPs.
+func TestAnonUsageTracker(t *testing.T) {
+	now := time.Date(2022, 3, 4, 11, 30, 0, 0, time.UTC)
+	tr := newAnonUsageTracker(2, 1, 2)
+	for i := 0; i < 2; i++ {
+		if !tr.Allow("a", anonUsageUpload, now) {
+			t.Fatalf("Expected upload %d to be allowed.", i)
+		}
+	}
+	if tr.Allow("a", anonUsageUpload, now) {
+		t.Fatal("Expected the upload to be denied.")
+	}
+	// Downloads and other IPs have their own limits.
+	if !tr.Allow("a", anonUsageDownload, now) || tr.Allow("a", anonUsageDownload, now) {
+		t.Fatal("Expected exactly one download to be allowed.")
+	}
+	if !tr.Allow("b", anonUsageUpload, now) {
+		t.Fatal("Expected an upload from another IP to be allowed.")
+	}
+	// The limits reset with the next hour.
+	if !tr.Allow("a", anonUsageUpload, now.Add(time.Hour)) {
+		t.Fatal("Expected the upload to be allowed in the next hour.")
+	}
+
+	// Only the allowed requests are pending and only once.
+	pending := tr.Pending()
+	expected := map[string]database.AnonUsage{
+		"a": {IP: "a", Hour: now.Add(time.Hour).Truncate(time.Hour), Uploads: 1},
+		"b": {IP: "b", Hour: now.Truncate(time.Hour), Uploads: 1},
+	}
+	if len(pending) != len(expected) {
+		t.Fatalf("Expected %d pending entries, got %+v", len(expected), pending)
+	}
+	for _, p := range pending {
+		if p != expected[p.IP] {
+			t.Fatalf("Expected %+v, got %+v", expected[p.IP], p)
+		}
+	}
+	if pending = tr.Pending(); len(pending) != 0 {
+		t.Fatalf("Expected no pending entries, got %+v", pending)
+	}
+
+	// Adding a third IP evicts the least recently used one, i.e. "b".
+	tr.Allow("c", anonUsageUpload, now)
+	if _, exists := tr.entries["b"]; exists {
+		t.Fatal("Expected 'b' to be evicted.")
+	}
+
+	// Loaded usage counts towards the limits.
+	tr.Load([]database.AnonUsage{{IP: "d", Hour: now.Truncate(time.Hour), Uploads: 2}})
+	if tr.Allow("d", anonUsageUpload, now) {
+		t.Fatal("Expected the upload to be denied after loading the usage.")
+	}
+
+	// Restored usage is pending again and counts towards the limits, even
+	// if the IP was evicted in the meantime. Usage from a previous hour is
+	// dropped.
+	tr = newAnonUsageTracker(3, 3, 3)
+	tr.Allow("a", anonUsageUpload, now)
+	tr.Allow("b", anonUsageDownload, now)
+	pending = tr.Pending()
+	tr.Allow("c", anonUsageUpload, now)
+	tr.Allow("a", anonUsageUpload, now)
+	tr.Allow("d", anonUsageUpload, now.Add(time.Hour))
+	pending = append(pending, database.AnonUsage{IP: "d", Hour: now.Truncate(time.Hour), Uploads: 1})
+	tr.Restore(pending)
+	expected = map[string]database.AnonUsage{
+		"a": {IP: "a", Hour: now.Truncate(time.Hour), Uploads: 2},
+		"b": {IP: "b", Hour: now.Truncate(time.Hour), Downloads: 1},
+		"d": {IP: "d", Hour: now.Add(time.Hour).Truncate(time.Hour), Uploads: 1},
+	}
+	pending = tr.Pending()
+	if len(pending) != len(expected) {
+		t.Fatalf("Expected %d pending entries, got %+v", len(expected), pending)
+	}
+	for _, p := range pending {
+		if p != expected[p.IP] {
+			t.Fatalf("Expected %+v, got %+v", expected[p.IP], p)
+		}
+	}
+	if !tr.Allow("a", anonUsageUpload, now) || tr.Allow("a", anonUsageUpload, now) {
+		t.Fatal("Expected exactly one more upload to be allowed.")
+	}
+
+	// A limit of zero disables the check.
+	tr = newAnonUsageTracker(0, 0, 2)
+	for i := 0; i < 10; i++ {
+		if !tr.Allow("a", anonUsageUpload, now) {
+			t.Fatal("Expected a disabled tracker to allow all requests.")
+		}
+	}
+}
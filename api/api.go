@@ -2,10 +2,13 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/email"
@@ -44,8 +47,40 @@ type (
 		staticRouter        *httprouter.Router
 		staticLogger        *logrus.Logger
 		staticMailer        *email.Mailer
-		staticTierLimits    []TierLimitsPublic
+		staticSender        *email.Sender
 		staticUserTierCache *userTierCache
+		staticCohortsCache  *cohortsCache
+		staticConfigCache   *configCache
+
+		staticPortalStatsCache *portalStatsCache
+
+		staticStripePricesCache *stripePricesCache
+
+		staticSessionRevocationCache *sessionRevocationCache
+		staticSkylinkBlockedCache    *skylinkBlockedCache
+
+		staticLoginLimiter        *rateLimiter
+		staticRegisterLimiter     *rateLimiter
+		staticRecoverLimiter      *rateLimiter
+		staticAvailabilityLimiter *rateLimiter
+		staticOrgInviteLimiter    *rateLimiter
+
+		staticSubscriptionRefreshLimiter *rateLimiter
+		staticTrackIPWarnLimiter         *rateLimiter
+
+		staticAnonUsage *anonUsageTracker
+
+		// staticSkylinkRechecks queues the skylinks whose uploaders need
+		// their quotas rechecked, see skylinkSizeResolved.
+		staticSkylinkRechecks chan skylinkRecheck
+
+		// staticOpenAPI describes our routes. We build it along with them.
+		staticOpenAPI openAPIDocument
+
+		// server is the HTTP server started by ListenAndServe. We keep it,
+		// so we can shut it down gracefully.
+		server *http.Server
+		mu     sync.Mutex
 	}
 
 	// Promoter defines a payment processor.
@@ -54,17 +89,20 @@ type (
 	// errorWrap is a helper type for converting an `error` struct to JSON.
 	errorWrap struct {
 		Message string `json:"message"`
+		// Code is a machine-readable identifier of the error. Errors which
+		// clients are not expected to handle get ErrCodeInternal.
+		Code string `json:"code,omitempty"`
 	}
 )
 
 // New returns a new initialised API.
-func New(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logger, mailer *email.Mailer, promoter Promoter) (*API, error) {
-	return NewCustom(db, mf, logger, mailer, promoter, &lib.ProductionDependencies{})
+func New(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logger, mailer *email.Mailer, sender *email.Sender, promoter Promoter) (*API, error) {
+	return NewCustom(db, mf, logger, mailer, sender, promoter, &lib.ProductionDependencies{})
 }
 
 // NewCustom returns a new initialised API and allows specifying custom
 // dependencies.
-func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logger, mailer *email.Mailer, promoter Promoter, deps lib.Dependencies) (*API, error) {
+func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logger, mailer *email.Mailer, sender *email.Sender, promoter Promoter, deps lib.Dependencies) (*API, error) {
 	if db == nil {
 		return nil, errors.New("no DB provided")
 	}
@@ -74,18 +112,6 @@ func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logg
 	router := httprouter.New()
 	router.RedirectTrailingSlash = true
 
-	tierLimits := make([]TierLimitsPublic, len(database.UserLimits))
-	for i, t := range database.UserLimits {
-		tierLimits[i] = TierLimitsPublic{
-			TierName:          t.TierName,
-			UploadBandwidth:   t.UploadBandwidth * 8,   // convert from bytes
-			DownloadBandwidth: t.DownloadBandwidth * 8, // convert from bytes
-			MaxUploadSize:     t.MaxUploadSize,
-			MaxNumberUploads:  t.MaxNumberUploads,
-			RegistryDelay:     t.RegistryDelay,
-			Storage:           t.Storage,
-		}
-	}
 	api := &API{
 		staticDB:            db,
 		staticDeps:          deps,
@@ -94,8 +120,34 @@ func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logg
 		staticRouter:        router,
 		staticLogger:        logger,
 		staticMailer:        mailer,
-		staticTierLimits:    tierLimits,
+		staticSender:        sender,
 		staticUserTierCache: newUserTierCache(),
+		staticCohortsCache:  newCohortsCache(),
+		staticConfigCache:   newConfigCache(configCacheTTL),
+
+		staticPortalStatsCache: newPortalStatsCache(),
+
+		staticStripePricesCache: newStripePricesCache(fetchStripePrices, stripePricesMaxAge),
+
+		staticSessionRevocationCache: newSessionRevocationCache(),
+		staticSkylinkBlockedCache:    newSkylinkBlockedCache(),
+
+		staticLoginLimiter:        newRateLimiter(LoginRateLimit, rateLimitWindow),
+		staticRegisterLimiter:     newRateLimiter(RegisterRateLimit, rateLimitWindow),
+		staticRecoverLimiter:      newRateLimiter(RecoverRateLimit, rateLimitWindow),
+		staticAvailabilityLimiter: newRateLimiter(AvailabilityRateLimit, rateLimitWindow),
+		staticOrgInviteLimiter:    newRateLimiter(OrgInviteRateLimit, rateLimitWindow),
+
+		staticSubscriptionRefreshLimiter: newRateLimiter(1, subscriptionRefreshInterval),
+		staticTrackIPWarnLimiter:         newRateLimiter(1, trackIPWarnInterval),
+
+		staticAnonUsage: newAnonUsageTracker(AnonymousHourlyUploadLimit, AnonymousHourlyDownloadLimit, anonUsageCacheMaxSize),
+
+		staticSkylinkRechecks: make(chan skylinkRecheck, skylinkRecheckQueueSize),
+	}
+	if mf != nil {
+		mf.SetSizeResolvedFunc(api.skylinkSizeResolved)
+		go api.threadedSkylinkRecheckWorker()
 	}
 	api.buildHTTPRoutes()
 	return api, nil
@@ -103,13 +155,34 @@ func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logg
 
 // ServeHTTP implements the http.Handler interface.
 func (api *API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	api.staticRouter.ServeHTTP(w, req)
+	api.withRequestID(api.withMetrics(api.withCORS(api.withTimeout(api.staticRouter)))).ServeHTTP(w, req)
 }
 
-// ListenAndServe starts the API server on the given port.
+// ListenAndServe starts the API server on the given port. It blocks until the
+// server stops. After a call to Shutdown it returns http.ErrServerClosed.
 func (api *API) ListenAndServe(port int) error {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: api,
+	}
+	api.mu.Lock()
+	api.server = srv
+	api.mu.Unlock()
 	api.staticLogger.Info(fmt.Sprintf("Listening on port %d", port))
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), api.staticRouter)
+	return srv.ListenAndServe()
+}
+
+// Shutdown gracefully shuts down the API server. It stops accepting new
+// connections and waits for the in-flight requests to complete or for the
+// given context to expire, whichever comes first.
+func (api *API) Shutdown(ctx context.Context) error {
+	api.mu.Lock()
+	srv := api.server
+	api.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
 }
 
 // WithDBSession injects a session context into the request context of the
@@ -122,7 +195,8 @@ func (api *API) WithDBSession(h httprouter.Handle) httprouter.Handle {
 		var err error
 		if req.Body != nil {
 			// Read the request's body and replace its Body io.ReadCloser with a
-			// new one based off the read data.
+			// new one based off the read data. Not all routes set a body limit,
+			// so we cap the read here as well.
 			body, err = io.ReadAll(io.LimitReader(req.Body, LimitBodySizeLarge))
 			if err != nil {
 				api.WriteError(w, errors.AddContext(err, "failed to read body"), http.StatusBadRequest)
@@ -194,12 +268,34 @@ func (api *API) WithDBSession(h httprouter.Handle) httprouter.Handle {
 	}
 }
 
-// WriteError an error to the API caller.
+// WriteError an error to the API caller, along with its machine-readable
+// error code. See errorCode for how we determine the code.
+//
+// Bodies which exceed the route's limit always get a 413, regardless of how the
+// handler read them. Requests which run past their deadline get a 504.
 func (api *API) WriteError(w http.ResponseWriter, err error, code int) {
+	if requestBodyTooLarge(err) {
+		api.WriteErrorWithCode(w, ErrRequestBodyTooLarge, http.StatusRequestEntityTooLarge, ErrCodeRequestBodyTooLarge)
+		return
+	}
+	if requestTimedOut(err) {
+		api.WriteErrorWithCode(w, ErrRequestTimeout, http.StatusGatewayTimeout, ErrCodeRequestTimeout)
+		return
+	}
+	api.WriteErrorWithCode(w, err, code, errorCode(err))
+}
+
+// WriteErrorWithCode writes an error to the API caller, along with the given
+// machine-readable error code.
+func (api *API) WriteErrorWithCode(w http.ResponseWriter, err error, code int, errCode string) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
 	api.staticLogger.Errorln(code, err)
-	encodingErr := json.NewEncoder(w).Encode(errorWrap{Message: err.Error()})
+	msg := http.StatusText(code)
+	if err != nil {
+		msg = err.Error()
+	}
+	encodingErr := json.NewEncoder(w).Encode(errorWrap{Message: msg, Code: errCode})
 	if _, isJSONErr := encodingErr.(*json.SyntaxError); isJSONErr {
 		// Marshalling should only fail in the event of a developer error.
 		// Specifically, only non-marshallable types should cause an error here.
@@ -211,9 +307,15 @@ func (api *API) WriteError(w http.ResponseWriter, err error, code int) {
 // error is written instead. The Content-Type of the response header is set
 // accordingly.
 func (api *API) WriteJSON(w http.ResponseWriter, obj interface{}) {
+	api.WriteJSONWithStatus(w, obj, http.StatusOK)
+}
+
+// WriteJSONWithStatus writes the object to the ResponseWriter with the given
+// status code. If the encoding fails, an error is written instead.
+func (api *API) WriteJSONWithStatus(w http.ResponseWriter, obj interface{}, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	api.staticLogger.Traceln(http.StatusOK)
+	w.WriteHeader(code)
+	api.staticLogger.Traceln(code)
 	err := json.NewEncoder(w).Encode(obj)
 	if err != nil {
 		api.staticLogger.Debugln(err)
@@ -225,6 +327,12 @@ func (api *API) WriteJSON(w http.ResponseWriter, obj interface{}) {
 	}
 }
 
+// setCacheControl allows CDNs and clients to cache the response for the given
+// amount of time.
+func setCacheControl(w http.ResponseWriter, maxAge time.Duration) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+}
+
 // WriteSuccess writes the HTTP header with status 204 No Content to the
 // ResponseWriter. WriteSuccess should only be used to indicate that the
 // requested action succeeded AND there is no data to return.
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 	"time"
@@ -12,6 +13,19 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+var (
+	// ErrTierNotAllowed is returned when the user's tier is not allowed to
+	// perform the requested action, e.g. create a public API key.
+	ErrTierNotAllowed = errors.New("tier_not_allowed")
+)
+
+const (
+	// RestrictionAPIKeysRequireConfirmedEmail is reported in UserGET's
+	// restrictions when the user can't create API keys until they confirm
+	// their email address.
+	RestrictionAPIKeysRequireConfirmedEmail = "api_keys_require_confirmed_email"
+)
+
 type (
 	// Revive complains about these names stuttering but we like them as they
 	// are, so we'll disable revive for a moment here.
@@ -22,16 +36,28 @@ type (
 		Name     string   `json:"name,omitempty"`
 		Public   bool     `json:"public,string,omitempty"`
 		Skylinks []string `json:"skylinks,omitempty"`
+		// Scope limits the access a private API key gives. Valid values are
+		// `read` and `full`. Defaults to `full`.
+		Scope string `json:"scope,omitempty"`
+		// ExpiresAt is the time after which the API key stops working. API
+		// keys without it never expire.
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 	}
-	// APIKeyPUT describes the request body for updating an API key
+	// APIKeyPUT describes the request body for updating an API key. It
+	// replaces both the list of covered skylinks and the expiration date, so
+	// omitting ExpiresAt makes the API key never expire.
 	APIKeyPUT struct {
-		Skylinks []string
+		Skylinks  []string
+		ExpiresAt *time.Time
 	}
 	// APIKeyPATCH describes the request body for updating an API key by
-	// providing only the requested changes
+	// providing only the requested changes. ExpiresAt sets a new expiration
+	// date, while RemoveExpiry makes the API key never expire.
 	APIKeyPATCH struct {
-		Add    []string
-		Remove []string
+		Add          []string
+		Remove       []string
+		ExpiresAt    *time.Time
+		RemoveExpiry bool
 	}
 	// APIKeyResponse is an API DTO which mirrors database.APIKey.
 	APIKeyResponse struct {
@@ -41,15 +67,42 @@ type (
 		Public    bool               `json:"public,string"`
 		Key       database.APIKey    `json:"-"`
 		Skylinks  []string           `json:"skylinks"`
+		Scope     string             `json:"scope"`
 		CreatedAt time.Time          `json:"createdAt"`
+		ExpiresAt *time.Time         `json:"expiresAt,omitempty"`
+		RotatedAt *time.Time         `json:"rotatedAt,omitempty"`
+		Expired   bool               `json:"expired"`
+		// Grandfathered marks public API keys which belong to a user whose
+		// tier is no longer allowed to create public API keys. These keys
+		// continue to work.
+		Grandfathered bool `json:"grandfathered"`
 	}
 	// APIKeyResponseWithKey is an API DTO which mirrors database.APIKey but
 	// also reveals the value of the Key field. This should only be used on key
-	// creation.
+	// creation and rotation.
 	APIKeyResponseWithKey struct {
 		APIKeyResponse
 		Key database.APIKey `json:"key"`
 	}
+	// APIKeysGET is the response of GET /user/apikeys. Limit is the maximum
+	// number of API keys the user can have and Current is the number they
+	// have, including the expired ones.
+	APIKeysGET struct {
+		Items   []*APIKeyResponse `json:"items"`
+		Limit   int               `json:"limit"`
+		Current int               `json:"current"`
+	}
+	// APIKeyLimitError is the body of the 409 response we return when the
+	// user tries to create more API keys than allowed.
+	APIKeyLimitError struct {
+		errorWrap
+		Limit   int `json:"limit"`
+		Current int `json:"current"`
+	}
+	// APIKeysGrandfatheredGET is the response of GET /apikeys/grandfathered
+	APIKeysGrandfatheredGET struct {
+		Count int64 `json:"count"`
+	}
 
 	//revive:enable
 )
@@ -59,6 +112,12 @@ func (akp APIKeyPOST) Validate() error {
 	if !akp.Public && len(akp.Skylinks) > 0 {
 		return errors.New("public API keys cannot refer to skylinks")
 	}
+	if !database.ValidAPIKeyScope(akp.Scope) {
+		return errors.AddContext(database.ErrInvalidAPIKeyScope, "valid scopes are '"+database.APIKeyScopeRead+"' and '"+database.APIKeyScopeFull+"'")
+	}
+	if akp.ExpiresAt != nil && !akp.ExpiresAt.After(time.Now().UTC()) {
+		return database.ErrInvalidAPIKeyExpiry
+	}
 	var errs []error
 	for _, s := range akp.Skylinks {
 		if !database.ValidSkylink(s) {
@@ -75,40 +134,65 @@ func (akp APIKeyPOST) Validate() error {
 
 // APIKeyResponseFromAPIKey creates a new APIKeyResponse from the given API key.
 func APIKeyResponseFromAPIKey(ak database.APIKeyRecord) *APIKeyResponse {
-	return &APIKeyResponse{
+	resp := &APIKeyResponse{
 		ID:        ak.ID,
 		UserID:    ak.UserID,
 		Name:      ak.Name,
 		Public:    ak.Public,
 		Key:       ak.Key,
 		Skylinks:  ak.Skylinks,
+		Scope:     ak.EffectiveScope(),
 		CreatedAt: ak.CreatedAt,
+		Expired:   ak.Expired(),
+	}
+	if !ak.ExpiresAt.IsZero() {
+		expiresAt := ak.ExpiresAt
+		resp.ExpiresAt = &expiresAt
 	}
+	if !ak.RotatedAt.IsZero() {
+		rotatedAt := ak.RotatedAt
+		resp.RotatedAt = &rotatedAt
+	}
+	return resp
 }
 
 // APIKeyResponseWithKeyFromAPIKey creates a new APIKeyResponseWithKey from the
 // given API key.
 func APIKeyResponseWithKeyFromAPIKey(ak database.APIKeyRecord) *APIKeyResponseWithKey {
 	return &APIKeyResponseWithKey{
-		APIKeyResponse: APIKeyResponse{
-			ID:        ak.ID,
-			UserID:    ak.UserID,
-			Name:      ak.Name,
-			Public:    ak.Public,
-			Key:       ak.Key,
-			Skylinks:  ak.Skylinks,
-			CreatedAt: ak.CreatedAt,
-		},
-		Key: ak.Key,
+		APIKeyResponse: *APIKeyResponseFromAPIKey(ak),
+		Key:            ak.Key,
+	}
+}
+
+// apiKeyCacheTTL returns the TTL of cache entries stored under the given API
+// key. We never cache an API key past its expiration date.
+func apiKeyCacheTTL(ak database.APIKeyRecord) time.Duration {
+	if ak.ExpiresAt.IsZero() {
+		return userTierCacheTTL
+	}
+	ttl := time.Until(ak.ExpiresAt)
+	if ttl > userTierCacheTTL {
+		return userTierCacheTTL
 	}
+	return ttl
 }
 
 //revive:enable
 
 // userAPIKeyPOST creates a new API key for the user.
 func (api *API) userAPIKeyPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	restricted, err := api.managedAPIKeysRestricted(req.Context(), u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if restricted {
+		api.WriteError(w, ErrEmailNotConfirmed, http.StatusForbidden)
+		return
+	}
 	var body APIKeyPOST
-	err := parseRequestBodyJSON(req.Body, LimitBodySizeLarge, &body)
+	err = parseRequestBodyJSON(req.Body, &body)
 	if err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
@@ -117,9 +201,33 @@ func (api *API) userAPIKeyPOST(u *database.User, w http.ResponseWriter, req *htt
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	ak, err := api.staticDB.APIKeyCreate(req.Context(), *u, body.Name, body.Public, body.Skylinks)
+	if body.Public {
+		allowedTiers, err := api.staticDB.PublicAPIKeyTiers(req.Context())
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !database.TierInList(allowedTiers, u.EffectiveTier()) {
+			err = errors.AddContext(ErrTierNotAllowed, "your tier is not allowed to create public API keys")
+			api.WriteError(w, err, http.StatusForbidden)
+			return
+		}
+	}
+	var expiresAt time.Time
+	if body.ExpiresAt != nil {
+		expiresAt = *body.ExpiresAt
+	}
+	ak, err := api.staticDB.APIKeyCreate(req.Context(), *u, body.Name, body.Public, body.Skylinks, body.Scope, expiresAt)
+	if errors.Contains(err, database.ErrInvalidAPIKeyExpiry) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	if errors.Contains(err, database.ErrMaxNumAPIKeysExceeded) {
-		err = errors.AddContext(err, "the maximum number of API keys a user can create is "+strconv.Itoa(database.MaxNumAPIKeysPerUser))
+		api.managedWriteAPIKeyLimitError(w, req, u)
+		return
+	}
+	if errors.Contains(err, database.ErrMaxNumSkylinksExceeded) {
+		err = errors.AddContext(err, "the maximum number of skylinks an API key can cover is "+strconv.Itoa(database.MaxNumSkylinksPerAPIKey))
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
@@ -127,9 +235,24 @@ func (api *API) userAPIKeyPOST(u *database.User, w http.ResponseWriter, req *htt
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.auditLog(req, u.ID, database.AuditActionAPIKeyCreate, map[string]string{"apiKeyId": ak.ID.Hex(), "public": strconv.FormatBool(ak.Public)})
 	api.WriteJSON(w, APIKeyResponseWithKeyFromAPIKey(*ak))
 }
 
+// managedAPIKeysRestricted checks whether the user is prevented from creating
+// API keys because the portal requires a confirmed email address for that and
+// they haven't confirmed theirs. Their existing API keys keep working.
+func (api *API) managedAPIKeysRestricted(ctx context.Context, u *database.User) (bool, error) {
+	if u.EmailConfirmationToken == "" {
+		return false, nil
+	}
+	val, err := api.configValue(ctx, database.ConfValAPIKeysRequireConfirmedEmail)
+	if err != nil {
+		return false, err
+	}
+	return val == database.ConfValTrue, nil
+}
+
 // userAPIKeyGET returns a single API key.
 func (api *API) userAPIKeyGET(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	akID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
@@ -147,7 +270,40 @@ func (api *API) userAPIKeyGET(u *database.User, w http.ResponseWriter, req *http
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.WriteJSON(w, APIKeyResponseFromAPIKey(ak))
+	allowedTiers, err := api.staticDB.PublicAPIKeyTiers(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp := APIKeyResponseFromAPIKey(ak)
+	resp.Grandfathered = ak.Public && !database.TierInList(allowedTiers, u.EffectiveTier())
+	api.WriteJSON(w, resp)
+}
+
+// userAPIKeyUsageGET reports the usage generated with the given API key during
+// the user's current billing period.
+func (api *API) userAPIKeyUsageGET(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	akID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ak, err := api.staticDB.APIKeyGet(req.Context(), akID)
+	// If there is no such API key or it doesn't exist, return a 404.
+	if errors.Contains(err, mongo.ErrNoDocuments) || (err == nil && ak.UserID != u.ID) {
+		api.WriteError(w, nil, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	usage, err := api.staticDB.APIKeyUsage(req.Context(), *u, ak.ID)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, usage)
 }
 
 // userAPIKeyLIST lists all API keys associated with the user.
@@ -157,13 +313,59 @@ func (api *API) userAPIKeyLIST(u *database.User, w http.ResponseWriter, req *htt
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	resp := make([]*APIKeyResponse, 0, len(aks))
+	allowedTiers, err := api.staticDB.PublicAPIKeyTiers(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	grandfathered := !database.TierInList(allowedTiers, u.EffectiveTier())
+	resp := APIKeysGET{
+		Items:   make([]*APIKeyResponse, 0, len(aks)),
+		Limit:   database.MaxNumAPIKeysPerUser,
+		Current: len(aks),
+	}
 	for _, ak := range aks {
-		resp = append(resp, APIKeyResponseFromAPIKey(ak))
+		akr := APIKeyResponseFromAPIKey(ak)
+		akr.Grandfathered = ak.Public && grandfathered
+		resp.Items = append(resp.Items, akr)
 	}
 	api.WriteJSON(w, resp)
 }
 
+// managedWriteAPIKeyLimitError tells the user that they can't create any more
+// API keys, together with the limit and the number of keys they have, so
+// clients can show them without another request.
+func (api *API) managedWriteAPIKeyLimitError(w http.ResponseWriter, req *http.Request, u *database.User) {
+	n, err := api.staticDB.APIKeyCount(req.Context(), *u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	msg := "the maximum number of API keys a user can create is " + strconv.Itoa(database.MaxNumAPIKeysPerUser)
+	api.staticLogger.Errorln(http.StatusConflict, msg)
+	api.WriteJSONWithStatus(w, APIKeyLimitError{
+		errorWrap: errorWrap{Message: msg, Code: ErrCodeAPIKeyLimitReached},
+		Limit:     database.MaxNumAPIKeysPerUser,
+		Current:   int(n),
+	}, http.StatusConflict)
+}
+
+// apiKeysGrandfatheredGET reports the number of public API keys which belong
+// to users whose tier is no longer allowed to create public API keys.
+func (api *API) apiKeysGrandfatheredGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	allowedTiers, err := api.staticDB.PublicAPIKeyTiers(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	n, err := api.staticDB.APIKeyCountGrandfathered(req.Context(), allowedTiers)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, APIKeysGrandfatheredGET{Count: n})
+}
+
 // userAPIKeyDELETE removes an API key.
 func (api *API) userAPIKeyDELETE(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	akID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
@@ -180,23 +382,24 @@ func (api *API) userAPIKeyDELETE(u *database.User, w http.ResponseWriter, req *h
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.auditLog(req, u.ID, database.AuditActionAPIKeyDelete, map[string]string{"apiKeyId": akID.Hex()})
 	api.WriteSuccess(w)
 }
 
-// userAPIKeyPUT updates an API key. Only possible for public API keys.
-func (api *API) userAPIKeyPUT(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+// userAPIKeyRotatePOST replaces the secret of an API key with a new one. The
+// API key keeps its ID and its covered skylinks. This is the only time the new
+// secret is revealed.
+func (api *API) userAPIKeyRotatePOST(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	akID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 	if err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	var body APIKeyPUT
-	err = parseRequestBodyJSON(req.Body, LimitBodySizeLarge, &body)
-	if err != nil {
-		api.WriteError(w, err, http.StatusBadRequest)
+	ak, ok := api.managedOwnAPIKey(u, w, req, akID)
+	if !ok {
 		return
 	}
-	err = api.staticDB.APIKeyUpdate(req.Context(), *u, akID, body.Skylinks)
+	rotated, err := api.staticDB.APIKeyRotate(req.Context(), *u, akID)
 	if errors.Contains(err, mongo.ErrNoDocuments) {
 		api.WriteError(w, err, http.StatusNotFound)
 		return
@@ -205,12 +408,76 @@ func (api *API) userAPIKeyPUT(u *database.User, w http.ResponseWriter, req *http
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	// Drop all cached limits for the old secret, so it stops working
+	// immediately.
+	api.staticUserTierCache.InvalidateByPrefix(ak.Key.String())
+	api.auditLog(req, u.ID, database.AuditActionAPIKeyRotate, map[string]string{"apiKeyId": akID.Hex()})
+	api.WriteJSON(w, APIKeyResponseWithKeyFromAPIKey(*rotated))
+}
+
+// userAPIKeyPUT updates an API key. It replaces the API key's expiration
+// date and, for public API keys, the list of covered skylinks.
+func (api *API) userAPIKeyPUT(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	akID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var body APIKeyPUT
+	err = parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ak, ok := api.managedOwnAPIKey(u, w, req, akID)
+	if !ok {
+		return
+	}
+	if !ak.Public && len(body.Skylinks) > 0 {
+		err = errors.AddContext(database.ErrInvalidAPIKeyOperation, "cannot define skylinks for a private api key")
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if ak.Public {
+		err = api.staticDB.APIKeyUpdate(req.Context(), *u, akID, body.Skylinks)
+		if errors.Contains(err, database.ErrInvalidSkylink) {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		if errors.Contains(err, database.ErrMaxNumSkylinksExceeded) {
+			err = errors.AddContext(err, "the maximum number of skylinks an API key can cover is "+strconv.Itoa(database.MaxNumSkylinksPerAPIKey))
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		if errors.Contains(err, mongo.ErrNoDocuments) {
+			api.WriteError(w, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		// Drop all cached limits for this API key, so it stops covering the
+		// skylinks which are no longer on its list immediately.
+		api.staticUserTierCache.InvalidateByPrefix(ak.Key.String())
+	}
+	var expiresAt time.Time
+	if body.ExpiresAt != nil {
+		expiresAt = *body.ExpiresAt
+	}
+	if !expiresAt.IsZero() || !ak.ExpiresAt.IsZero() {
+		if !api.managedSetAPIKeyExpiry(u, w, req, ak, expiresAt) {
+			return
+		}
+	}
 	api.WriteSuccess(w)
 }
 
 // userAPIKeyPATCH patches an API key. The difference between PUT and PATCH is
 // that PATCH only specifies the changes while PUT provides the expected list of
-// covered skylinks. Only possible for public API keys.
+// covered skylinks. Only public API keys cover skylinks. Concurrent patches
+// are merged, so callers don't overwrite each other's changes. It returns the
+// patched API key.
 func (api *API) userAPIKeyPATCH(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	akID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 	if err != nil {
@@ -218,19 +485,100 @@ func (api *API) userAPIKeyPATCH(u *database.User, w http.ResponseWriter, req *ht
 		return
 	}
 	var body APIKeyPATCH
-	err = parseRequestBodyJSON(req.Body, LimitBodySizeLarge, &body)
+	err = parseRequestBodyJSON(req.Body, &body)
 	if err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	err = api.staticDB.APIKeyPatch(req.Context(), *u, akID, body.Add, body.Remove)
+	if body.ExpiresAt != nil && body.RemoveExpiry {
+		api.WriteError(w, errors.New("cannot both set and remove the expiration date"), http.StatusBadRequest)
+		return
+	}
+	ak, ok := api.managedOwnAPIKey(u, w, req, akID)
+	if !ok {
+		return
+	}
+	if len(body.Add) > 0 || len(body.Remove) > 0 {
+		if !ak.Public {
+			err = errors.AddContext(database.ErrInvalidAPIKeyOperation, "cannot define skylinks for a private api key")
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		patched, err := api.staticDB.APIKeyPatch(req.Context(), *u, akID, body.Add, body.Remove)
+		if errors.Contains(err, database.ErrInvalidSkylink) {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		if errors.Contains(err, database.ErrMaxNumSkylinksExceeded) {
+			err = errors.AddContext(err, "the maximum number of skylinks an API key can cover is "+strconv.Itoa(database.MaxNumSkylinksPerAPIKey))
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		if errors.Contains(err, mongo.ErrNoDocuments) {
+			api.WriteError(w, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		// Drop the cached limits of the removed skylinks, so the API key
+		// stops covering them immediately.
+		for _, sl := range body.Remove {
+			api.staticUserTierCache.Delete(ak.Key.String() + sl)
+		}
+		ak = *patched
+	}
+	if body.ExpiresAt != nil {
+		if !api.managedSetAPIKeyExpiry(u, w, req, ak, *body.ExpiresAt) {
+			return
+		}
+		ak.ExpiresAt = body.ExpiresAt.UTC().Truncate(time.Millisecond)
+	}
+	if body.RemoveExpiry {
+		if !api.managedSetAPIKeyExpiry(u, w, req, ak, time.Time{}) {
+			return
+		}
+		ak.ExpiresAt = time.Time{}
+	}
+	api.WriteJSON(w, APIKeyResponseFromAPIKey(ak))
+}
+
+// managedOwnAPIKey fetches the given API key and makes sure it belongs to the
+// given user. It writes an error response and returns false if it doesn't.
+func (api *API) managedOwnAPIKey(u *database.User, w http.ResponseWriter, req *http.Request, akID primitive.ObjectID) (database.APIKeyRecord, bool) {
+	ak, err := api.staticDB.APIKeyGet(req.Context(), akID)
+	// If there is no such API key or it doesn't exist, return a 404.
+	if errors.Contains(err, mongo.ErrNoDocuments) || (err == nil && ak.UserID != u.ID) {
+		api.WriteError(w, mongo.ErrNoDocuments, http.StatusNotFound)
+		return database.APIKeyRecord{}, false
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return database.APIKeyRecord{}, false
+	}
+	return ak, true
+}
+
+// managedSetAPIKeyExpiry sets the expiration date of the given API key. A zero
+// expiresAt makes the API key never expire. It writes an error response and
+// returns false on failure.
+func (api *API) managedSetAPIKeyExpiry(u *database.User, w http.ResponseWriter, req *http.Request, ak database.APIKeyRecord, expiresAt time.Time) bool {
+	err := api.staticDB.APIKeySetExpiry(req.Context(), *u, ak.ID, expiresAt)
+	if errors.Contains(err, database.ErrInvalidAPIKeyExpiry) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return false
+	}
 	if errors.Contains(err, mongo.ErrNoDocuments) {
 		api.WriteError(w, err, http.StatusNotFound)
-		return
+		return false
 	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
-		return
+		return false
 	}
-	api.WriteSuccess(w)
+	// Drop all cached limits for this API key, so a shorter expiration date
+	// takes effect immediately.
+	api.staticUserTierCache.InvalidateByPrefix(ak.Key.String())
+	return true
 }
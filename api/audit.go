@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// auditLogTimeout is the maximum amount of time we allow for recording
+	// a single audit log entry.
+	auditLogTimeout = 10 * time.Second
+)
+
+type (
+	// AuditLogGET describes a page of the events on a user's account.
+	AuditLogGET struct {
+		Items    []database.AuditLogEntry `json:"items"`
+		Offset   int                      `json:"offset"`
+		PageSize int                      `json:"pageSize"`
+		Count    int                      `json:"count"`
+		HasMore  bool                     `json:"hasMore"`
+	}
+)
+
+// auditLog records the given event on the given user's account, along with
+// the IP and user agent of the caller. The write happens in the background,
+// so it can't slow down or fail the request.
+func (api *API) auditLog(req *http.Request, userID primitive.ObjectID, action string, metadata map[string]string) {
+	go api.threadedAuditLog(userID, action, clientIP(req), req.UserAgent(), metadata)
+}
+
+// threadedAuditLog records the given event on the given user's account. It
+// uses its own context because the request's context gets cancelled as soon
+// as the response is sent.
+func (api *API) threadedAuditLog(userID primitive.ObjectID, action, ip, userAgent string, metadata map[string]string) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditLogTimeout)
+	defer cancel()
+	_, err := api.staticDB.AuditLogCreate(ctx, userID, action, ip, userAgent, metadata)
+	if err != nil {
+		api.staticLogger.Warnf("Failed to record audit log entry '%s' for user %s: %s", action, userID.Hex(), err)
+	}
+}
+
+// tierChangeMetadata returns the audit log metadata of a tier change.
+func tierChangeMetadata(oldTier, newTier int, source string) map[string]string {
+	return map[string]string{
+		"oldTier": strconv.Itoa(oldTier),
+		"newTier": strconv.Itoa(newTier),
+		"source":  source,
+	}
+}
+
+// userAuditGET returns a page of the events on the current user's account,
+// most recent first.
+func (api *API) userAuditGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	api.writeAuditLog(u, w, req)
+}
+
+// adminUserAuditGET returns a page of the events on the given user's account,
+// most recent first.
+func (api *API) adminUserAuditGET(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	u, err := api.staticDB.UserBySub(req.Context(), ps.ByName("sub"))
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.writeAuditLog(u, w, req)
+}
+
+// writeAuditLog writes the page of the given user's audit log requested via
+// the offset and pageSize params.
+func (api *API) writeAuditLog(u *database.User, w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	offset, err1 := fetchOffset(req.Form)
+	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
+	if err := errors.Compose(err1, err2); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	entries, total, err := api.staticDB.AuditLogByUser(req.Context(), u.ID, offset, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := AuditLogGET{
+		Items:    entries,
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    total,
+		HasMore:  offset+len(entries) < total,
+	}
+	api.WriteJSON(w, response)
+}
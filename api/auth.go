@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -8,6 +9,19 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/jwt"
 	jwt2 "github.com/lestrrat-go/jwx/jwt"
 	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrAPIKeyReadOnly is returned when a read-only API key is used for a
+	// request which modifies data.
+	ErrAPIKeyReadOnly = errors.New("this api key only allows read access")
+)
+
+type (
+	// ctxValue is a helper type which makes it safe to register values in the
+	// context.
+	ctxValue string
 )
 
 // userAndTokenByRequestToken scans the request for an authentication token,
@@ -22,22 +36,41 @@ func (api *API) userAndTokenByRequestToken(req *http.Request) (*database.User, j
 	if err != nil {
 		return nil, nil, errors.AddContext(err, "error decoding token from request")
 	}
+	revoked, err := api.managedSessionRevoked(req.Context(), token.JwtID())
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "error checking the session's status")
+	}
+	if revoked {
+		return nil, nil, ErrSessionRevoked
+	}
 	u, err := api.staticDB.UserBySub(req.Context(), sub)
 	if err != nil {
 		return nil, nil, errors.AddContext(err, "error fetching user from database")
 	}
+	// Deleted users are treated as if they don't exist.
+	if u.Deleted() {
+		return nil, nil, database.ErrUserNotFound
+	}
+	if u.Suspended {
+		return nil, nil, ErrAccountSuspended
+	}
 	return u, token, nil
 }
 
 // userAndTokenByAPIKey extracts the APIKey from the request and validates it.
 // It then returns the user who owns it and a token for that user.
 // It first checks the headers and then the query.
+// The scope of the API key is attached to the request's context.
 // This method accesses the database.
 func (api *API) userAndTokenByAPIKey(req *http.Request, ak database.APIKey) (*database.User, jwt2.Token, error) {
 	akr, err := api.staticDB.APIKeyByKey(req.Context(), ak.String())
 	if err != nil {
 		return nil, nil, err
 	}
+	// Read-only private API keys can only be used with safe methods.
+	if !akr.Public && !apiKeyScopeAllows(akr.EffectiveScope(), req.Method) {
+		return nil, nil, ErrAPIKeyReadOnly
+	}
 	// If we're dealing with a public API key, we need to validate that this
 	// request is a GET for a covered skylink.
 	if akr.Public {
@@ -54,8 +87,59 @@ func (api *API) userAndTokenByAPIKey(req *http.Request, ak database.APIKey) (*da
 	if err != nil {
 		return nil, nil, err
 	}
-	t, err := jwt.TokenForUser(u.Email, u.Sub, 0)
-	return u, t, err
+	if u.Deleted() {
+		return nil, nil, database.ErrUserNotFound
+	}
+	if u.Suspended {
+		return nil, nil, ErrAccountSuspended
+	}
+	t, err := jwt.TokenForUser(u.Email, u.Sub, u.Name, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Update the request in place, so the caller gets the scope as well.
+	ctx := ContextWithAPIKeyScope(req.Context(), akr.EffectiveScope())
+	*req = *req.WithContext(ContextWithAPIKeyID(ctx, akr.ID))
+	return u, t, nil
+}
+
+// ContextWithAPIKeyScope returns a copy of the given context that contains the
+// scope of the API key used to authenticate the request.
+func ContextWithAPIKeyScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, ctxValue("apiKeyScope"), scope)
+}
+
+// APIKeyScopeFromContext returns the scope of the API key used to
+// authenticate the request. It returns an empty string if the request was not
+// authenticated with an API key.
+func APIKeyScopeFromContext(ctx context.Context) string {
+	scope, _ := ctx.Value(ctxValue("apiKeyScope")).(string)
+	return scope
+}
+
+// ContextWithAPIKeyID returns a copy of the given context that contains the ID
+// of the API key used to authenticate the request.
+func ContextWithAPIKeyID(ctx context.Context, akID primitive.ObjectID) context.Context {
+	return context.WithValue(ctx, ctxValue("apiKeyID"), akID)
+}
+
+// APIKeyIDFromContext returns the ID of the API key used to authenticate the
+// request. It returns a zero ID if the request was not authenticated with an
+// API key.
+func APIKeyIDFromContext(ctx context.Context) primitive.ObjectID {
+	akID, _ := ctx.Value(ctxValue("apiKeyID")).(primitive.ObjectID)
+	return akID
+}
+
+// apiKeyScopeAllows returns true if a private API key with the given scope can
+// be used for a request with the given method.
+func apiKeyScopeAllows(scope, method string) bool {
+	return scope != database.APIKeyScopeRead || isReadOnlyMethod(method)
+}
+
+// isReadOnlyMethod returns true for HTTP methods which don't modify data.
+func isReadOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
 }
 
 // apiKeyFromRequest extracts the API key from the request headers and returns
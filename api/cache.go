@@ -1,38 +1,130 @@
 package api
 
 import (
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/SkynetLabs/skyd/build"
 )
 
 const (
 	// userTierCacheTTL is the TTL of the entries in the userTierCache.
 	userTierCacheTTL = time.Hour
+	// cohortsCacheTTL is the TTL of the entries in the cohortsCache.
+	cohortsCacheTTL = 24 * time.Hour
+	// limitsMaxAge is how long CDNs and clients may cache the response of
+	// `GET /limits`. Tier limits rarely change.
+	limitsMaxAge = 5 * time.Minute
+	// jwksMaxAge is how long CDNs and clients may cache our JWKS. It only
+	// changes when we rotate our keys.
+	jwksMaxAge = 24 * time.Hour
+	// stripePricesMaxAge is how long CDNs and clients may cache the list of
+	// Stripe prices. We also keep the list in memory for that long.
+	stripePricesMaxAge = 5 * time.Minute
+	// sessionRevocationCacheMaxSize is the number of entries after which the
+	// sessionRevocationCache starts evicting entries.
+	sessionRevocationCacheMaxSize = 100000
+	// skylinkBlockedCacheMaxSize is the number of entries after which the
+	// skylinkBlockedCache starts evicting entries.
+	skylinkBlockedCacheMaxSize = 100000
+)
+
+var (
+	// sessionRevocationCacheTTL defines how long we trust a cached revocation
+	// status of a session. Sessions revoked via this instance are reflected
+	// immediately, so this only bounds how long a session revoked via another
+	// instance of accounts keeps working here.
+	sessionRevocationCacheTTL = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  500 * time.Millisecond,
+			Standard: time.Minute,
+		},
+	).(time.Duration)
+
+	// skylinkBlockedCacheTTL defines how long we trust a cached block status
+	// of a skylink. Skylinks blocked or unblocked via this instance are
+	// reflected immediately, so this only bounds how long a change made via
+	// another instance of accounts takes to take effect here.
+	skylinkBlockedCacheTTL = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  500 * time.Millisecond,
+			Standard: 30 * time.Second,
+		},
+	).(time.Duration)
+
+	// configCacheTTL defines how long we trust a cached configuration value.
+	// Values changed via this instance are reflected immediately, so this
+	// only bounds how long a change made via another instance of accounts, or
+	// directly in the database, takes to take effect here.
+	configCacheTTL = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  500 * time.Millisecond,
+			Standard: 30 * time.Second,
+		},
+	).(time.Duration)
+
+	// userTierCacheQuotaTTL defines how long we trust the QuotaExceeded flag of
+	// a cache entry before we refresh it from the DB. The flag is the only
+	// part of the entry which changes often and which can be changed by a
+	// different instance of accounts, so we keep it on a much shorter leash
+	// than the rest of the entry.
+	//
+	// The refresh is a single lookup on the sub_quota_exceeded index which
+	// doesn't need to fetch the user document. Each instance performs at most
+	// one such lookup per cache key per userTierCacheQuotaTTL, regardless of
+	// how many requests it serves for that key. For example, an instance
+	// with 10,000 actively used cache keys adds at most ~167 covered queries
+	// per second to the DB in production.
+	userTierCacheQuotaTTL = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  500 * time.Millisecond,
+			Standard: time.Minute,
+		},
+	).(time.Duration)
 )
 
 type (
 	// userTierCache is an in-mem cache that maps from a user's sub to their
-	// tier.
+	// tier. Entries can also be stored under custom keys, e.g. API keys, so
+	// we keep a reverse index from each sub to all keys created for that user.
+	// This allows us to drop all of a user's entries when their tier or quota
+	// changes.
 	userTierCache struct {
-		cache map[string]userTierCacheEntry
-		mu    sync.Mutex
+		cache     map[string]userTierCacheEntry
+		keysBySub map[string]map[string]struct{}
+		mu        sync.Mutex
 	}
 	// userTierCacheEntry allows us to cache some basic information about the
 	// user, so we don't need to hit the DB to fetch data that rarely changes.
 	userTierCacheEntry struct {
-		Sub           string
-		Tier          int
+		Sub  string
+		Tier int
+		// TrialTier and TrialUntil describe the user's trial, if any. We
+		// cache them, rather than the effective tier, so the trial stops
+		// applying as soon as it lapses.
+		TrialTier     int
+		TrialUntil    time.Time
 		QuotaExceeded bool
-		ExpiresAt     time.Time
+		// QuotaUsage is the usage which exceeds the user's quota. It's only
+		// set while QuotaExceeded is true.
+		QuotaUsage *database.QuotaUsage
+		// QuotaCheckedAt is the last time we read QuotaExceeded from the DB.
+		QuotaCheckedAt time.Time
+		ExpiresAt      time.Time
 	}
 )
 
 // newUserTierCache creates a new userTierCache.
 func newUserTierCache() *userTierCache {
 	return &userTierCache{
-		cache: make(map[string]userTierCacheEntry),
+		cache:     make(map[string]userTierCacheEntry),
+		keysBySub: make(map[string]map[string]struct{}),
 	}
 }
 
@@ -51,14 +143,418 @@ func (utc *userTierCache) Get(sub string) (userTierCacheEntry, bool) {
 	return ce, true
 }
 
-// Set stores the user's tier in the cache under the given key.
-func (utc *userTierCache) Set(key string, u *database.User) {
+// Set stores the user's tier in the cache under the given key. The entry
+// expires after the given TTL.
+func (utc *userTierCache) Set(key string, u *database.User, ttl time.Duration) {
 	utc.mu.Lock()
+	defer utc.mu.Unlock()
+	// The key might have belonged to a different user before, e.g. when an
+	// API key is deleted and the same value is issued to someone else.
+	if old, exists := utc.cache[key]; exists && old.Sub != u.Sub {
+		utc.unindex(old.Sub, key)
+	}
+	now := time.Now().UTC()
+	tier, trialTier, trialUntil := u.Tier, u.TrialTier, u.TrialUntil
+	// The tier of the user's organization replaces their own.
+	if u.InOrg() {
+		tier, trialTier, trialUntil = u.OrgTier, 0, time.Time{}
+	}
 	utc.cache[key] = userTierCacheEntry{
-		Sub:           u.Sub,
-		Tier:          u.Tier,
-		QuotaExceeded: u.QuotaExceeded,
-		ExpiresAt:     time.Now().UTC().Add(userTierCacheTTL).Truncate(time.Millisecond),
+		Sub:            u.Sub,
+		Tier:           tier,
+		TrialTier:      trialTier,
+		TrialUntil:     trialUntil,
+		QuotaExceeded:  u.QuotaExceeded,
+		QuotaUsage:     u.QuotaUsage,
+		QuotaCheckedAt: now,
+		ExpiresAt:      now.Add(ttl).Truncate(time.Millisecond),
 	}
-	utc.mu.Unlock()
+	keys, exists := utc.keysBySub[u.Sub]
+	if !exists {
+		keys = make(map[string]struct{})
+		utc.keysBySub[u.Sub] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// SetQuotaExceeded updates the QuotaExceeded flag and the usage of an
+// existing cache entry and marks it as freshly checked. It's a no-op if the
+// entry doesn't exist.
+func (utc *userTierCache) SetQuotaExceeded(key string, qe bool, usage *database.QuotaUsage) {
+	utc.mu.Lock()
+	defer utc.mu.Unlock()
+	ce, exists := utc.cache[key]
+	if !exists {
+		return
+	}
+	ce.QuotaExceeded = qe
+	ce.QuotaUsage = usage
+	ce.QuotaCheckedAt = time.Now().UTC()
+	utc.cache[key] = ce
+}
+
+// Invalidate removes all entries which belong to the user with the given sub,
+// including the ones cached under one of their API keys. It needs to be called
+// every time the user's tier or quota state changes.
+func (utc *userTierCache) Invalidate(sub string) {
+	utc.mu.Lock()
+	defer utc.mu.Unlock()
+	for key := range utc.keysBySub[sub] {
+		delete(utc.cache, key)
+	}
+	delete(utc.keysBySub, sub)
+}
+
+// Delete removes the entry stored under the given key.
+func (utc *userTierCache) Delete(key string) {
+	utc.mu.Lock()
+	defer utc.mu.Unlock()
+	ce, exists := utc.cache[key]
+	if !exists {
+		return
+	}
+	delete(utc.cache, key)
+	utc.unindex(ce.Sub, key)
+}
+
+// InvalidateByPrefix removes all entries whose keys start with the given
+// prefix, e.g. all entries cached under a given API key, regardless of the
+// skylink they were cached for.
+func (utc *userTierCache) InvalidateByPrefix(prefix string) {
+	utc.mu.Lock()
+	defer utc.mu.Unlock()
+	for key, ce := range utc.cache {
+		if strings.HasPrefix(key, prefix) {
+			delete(utc.cache, key)
+			utc.unindex(ce.Sub, key)
+		}
+	}
+}
+
+// unindex removes the given key from the reverse index of the given sub. The
+// caller needs to hold the lock.
+func (utc *userTierCache) unindex(sub, key string) {
+	keys, exists := utc.keysBySub[sub]
+	if !exists {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(utc.keysBySub, sub)
+	}
+}
+
+// EffectiveTier returns the tier whose limits apply to the cached user. See
+// database.User.EffectiveTier.
+func (ce userTierCacheEntry) EffectiveTier() int {
+	return database.EffectiveTier(ce.Tier, ce.TrialTier, ce.TrialUntil)
+}
+
+// QuotaStale returns true when the entry's QuotaExceeded flag is old enough to
+// require a refresh from the DB.
+func (ce userTierCacheEntry) QuotaStale() bool {
+	return time.Since(ce.QuotaCheckedAt) > userTierCacheQuotaTTL
+}
+
+type (
+	// cohortsCache is an in-mem cache for cohort retention reports. These are
+	// expensive to build and change slowly, so we keep them for a day.
+	cohortsCache struct {
+		cache map[int]cohortsCacheEntry
+		mu    sync.Mutex
+	}
+	// cohortsCacheEntry holds a cached cohort report and its expiration time.
+	cohortsCacheEntry struct {
+		Matrix    *database.CohortMatrix
+		ExpiresAt time.Time
+	}
+)
+
+// newCohortsCache creates a new cohortsCache.
+func newCohortsCache() *cohortsCache {
+	return &cohortsCache{
+		cache: make(map[int]cohortsCacheEntry),
+	}
+}
+
+// Get returns the cached report covering the given number of weeks and an OK
+// indicator which is true when the entry exists and hasn't expired, yet.
+func (cc *cohortsCache) Get(weeks int) (*database.CohortMatrix, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	ce, exists := cc.cache[weeks]
+	if !exists || ce.ExpiresAt.Before(time.Now().UTC()) {
+		return nil, false
+	}
+	return ce.Matrix, true
+}
+
+// Set stores the given report in the cache.
+func (cc *cohortsCache) Set(weeks int, cm *database.CohortMatrix) {
+	cc.mu.Lock()
+	cc.cache[weeks] = cohortsCacheEntry{
+		Matrix:    cm,
+		ExpiresAt: time.Now().UTC().Add(cohortsCacheTTL),
+	}
+	cc.mu.Unlock()
+}
+
+type (
+	// portalStatsCache is an in-mem cache for the portal stats. Building them
+	// requires scanning several large collections, so we only do it once per
+	// AdminStatsCacheTTL.
+	portalStatsCache struct {
+		stats     *database.PortalStats
+		expiresAt time.Time
+		mu        sync.Mutex
+	}
+)
+
+// newPortalStatsCache creates a new portalStatsCache.
+func newPortalStatsCache() *portalStatsCache {
+	return &portalStatsCache{}
+}
+
+// Get returns the cached stats and an OK indicator which is true when the
+// stats exist and haven't expired, yet.
+func (psc *portalStatsCache) Get() (*database.PortalStats, bool) {
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	if psc.stats == nil || psc.expiresAt.Before(time.Now().UTC()) {
+		return nil, false
+	}
+	return psc.stats, true
+}
+
+// Set stores the given stats in the cache.
+func (psc *portalStatsCache) Set(ps *database.PortalStats) {
+	psc.mu.Lock()
+	psc.stats = ps
+	psc.expiresAt = time.Now().UTC().Add(AdminStatsCacheTTL)
+	psc.mu.Unlock()
+}
+
+type (
+	// sessionRevocationCache is an in-mem cache that maps from a session's
+	// jti to its revocation status. It saves us a DB read on most
+	// authenticated requests.
+	sessionRevocationCache struct {
+		cache map[string]sessionRevocationCacheEntry
+		mu    sync.Mutex
+	}
+	// sessionRevocationCacheEntry holds a cached revocation status and its
+	// expiration time.
+	sessionRevocationCacheEntry struct {
+		Revoked   bool
+		ExpiresAt time.Time
+	}
+)
+
+// newSessionRevocationCache creates a new sessionRevocationCache.
+func newSessionRevocationCache() *sessionRevocationCache {
+	return &sessionRevocationCache{
+		cache: make(map[string]sessionRevocationCacheEntry),
+	}
+}
+
+// Get returns the cached revocation status of the session with the given jti
+// and an OK indicator which is true when the entry exists and hasn't expired,
+// yet.
+func (src *sessionRevocationCache) Get(jti string) (bool, bool) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	ce, exists := src.cache[jti]
+	if !exists || ce.ExpiresAt.Before(time.Now().UTC()) {
+		return false, false
+	}
+	return ce.Revoked, true
+}
+
+// Set stores the revocation status of the session with the given jti. Once
+// the cache is full we evict the expired entries and, if that's not enough,
+// all of them. Revocations are stored in the DB, so evicting them only costs
+// us a DB read.
+func (src *sessionRevocationCache) Set(jti string, revoked bool) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	now := time.Now().UTC()
+	if len(src.cache) >= sessionRevocationCacheMaxSize {
+		for k, ce := range src.cache {
+			if ce.ExpiresAt.Before(now) {
+				delete(src.cache, k)
+			}
+		}
+	}
+	if len(src.cache) >= sessionRevocationCacheMaxSize {
+		src.cache = make(map[string]sessionRevocationCacheEntry)
+	}
+	src.cache[jti] = sessionRevocationCacheEntry{
+		Revoked:   revoked,
+		ExpiresAt: now.Add(sessionRevocationCacheTTL),
+	}
+}
+
+type (
+	// skylinkBlockedCache is an in-mem cache that maps from a normalized
+	// skylink to its block status. It saves us a DB read on every limits
+	// lookup.
+	skylinkBlockedCache struct {
+		cache map[string]skylinkBlockedCacheEntry
+		mu    sync.Mutex
+	}
+	// skylinkBlockedCacheEntry holds a cached block status and its expiration
+	// time.
+	skylinkBlockedCacheEntry struct {
+		Blocked   bool
+		ExpiresAt time.Time
+	}
+)
+
+// newSkylinkBlockedCache creates a new skylinkBlockedCache.
+func newSkylinkBlockedCache() *skylinkBlockedCache {
+	return &skylinkBlockedCache{
+		cache: make(map[string]skylinkBlockedCacheEntry),
+	}
+}
+
+// Get returns the cached block status of the given skylink and an OK
+// indicator which is true when the entry exists and hasn't expired, yet.
+func (sbc *skylinkBlockedCache) Get(skylink string) (bool, bool) {
+	sbc.mu.Lock()
+	defer sbc.mu.Unlock()
+	ce, exists := sbc.cache[skylink]
+	if !exists || ce.ExpiresAt.Before(time.Now().UTC()) {
+		return false, false
+	}
+	return ce.Blocked, true
+}
+
+// Set stores the block status of the given skylink. Once the cache is full we
+// evict the expired entries and, if that's not enough, all of them.
+func (sbc *skylinkBlockedCache) Set(skylink string, blocked bool) {
+	sbc.mu.Lock()
+	defer sbc.mu.Unlock()
+	now := time.Now().UTC()
+	if len(sbc.cache) >= skylinkBlockedCacheMaxSize {
+		for k, ce := range sbc.cache {
+			if ce.ExpiresAt.Before(now) {
+				delete(sbc.cache, k)
+			}
+		}
+	}
+	if len(sbc.cache) >= skylinkBlockedCacheMaxSize {
+		sbc.cache = make(map[string]skylinkBlockedCacheEntry)
+	}
+	sbc.cache[skylink] = skylinkBlockedCacheEntry{
+		Blocked:   blocked,
+		ExpiresAt: now.Add(skylinkBlockedCacheTTL),
+	}
+}
+
+// Invalidate removes the entry of the given skylink, so the next read fetches
+// it from the DB.
+func (sbc *skylinkBlockedCache) Invalidate(skylink string) {
+	sbc.mu.Lock()
+	delete(sbc.cache, skylink)
+	sbc.mu.Unlock()
+}
+
+type (
+	// configCache is an in-mem cache that maps from configuration keys to
+	// their values. It saves us a DB read on every request which checks a
+	// feature flag.
+	configCache struct {
+		cache map[string]configCacheEntry
+		ttl   time.Duration
+		mu    sync.Mutex
+	}
+	// configCacheEntry holds a cached configuration value and its expiration
+	// time. Missing values are cached as empty strings.
+	configCacheEntry struct {
+		Value     string
+		ExpiresAt time.Time
+	}
+)
+
+// newConfigCache creates a new configCache whose entries expire after the
+// given TTL.
+func newConfigCache(ttl time.Duration) *configCache {
+	return &configCache{
+		cache: make(map[string]configCacheEntry),
+		ttl:   ttl,
+	}
+}
+
+// Get returns the cached value of the given key and an OK indicator which is
+// true when the entry exists and hasn't expired, yet.
+func (cc *configCache) Get(key string) (string, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	ce, exists := cc.cache[key]
+	if !exists || ce.ExpiresAt.Before(time.Now().UTC()) {
+		return "", false
+	}
+	return ce.Value, true
+}
+
+// Set stores the value of the given key.
+func (cc *configCache) Set(key, value string) {
+	cc.mu.Lock()
+	cc.cache[key] = configCacheEntry{
+		Value:     value,
+		ExpiresAt: time.Now().UTC().Add(cc.ttl),
+	}
+	cc.mu.Unlock()
+}
+
+// Invalidate removes the entry of the given key, so the next read fetches it
+// from the DB.
+func (cc *configCache) Invalidate(key string) {
+	cc.mu.Lock()
+	delete(cc.cache, key)
+	cc.mu.Unlock()
+}
+
+type (
+	// stripePricesCache is an in-mem cache for the list of active Stripe
+	// prices, so we don't need to call the Stripe API on every request. The
+	// prices are fetched via the given function, which allows us to replace
+	// Stripe in tests.
+	stripePricesCache struct {
+		prices      []StripePrice
+		expiresAt   time.Time
+		staticFetch func() ([]StripePrice, error)
+		staticTTL   time.Duration
+		mu          sync.Mutex
+	}
+)
+
+// newStripePricesCache creates a new stripePricesCache which uses the given
+// function to fetch the prices and keeps them for the given TTL.
+func newStripePricesCache(fetch func() ([]StripePrice, error), ttl time.Duration) *stripePricesCache {
+	return &stripePricesCache{
+		staticFetch: fetch,
+		staticTTL:   ttl,
+	}
+}
+
+// Prices returns the cached prices, fetching them if the cache is empty or
+// expired. We hold the lock while fetching, so concurrent requests don't
+// fetch the prices more than once. Failed fetches are not cached.
+func (pc *stripePricesCache) Prices() ([]StripePrice, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.prices != nil && time.Now().UTC().Before(pc.expiresAt) {
+		return pc.prices, nil
+	}
+	prices, err := pc.staticFetch()
+	if err != nil {
+		return nil, err
+	}
+	if prices == nil {
+		prices = []StripePrice{}
+	}
+	pc.prices = prices
+	pc.expiresAt = time.Now().UTC().Add(pc.staticTTL)
+	return prices, nil
 }
@@ -1,10 +1,12 @@
 package api
 
 import (
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // TestUserTierCache tests that working with userTierCache works as expected.
@@ -23,7 +25,7 @@ func TestUserTierCache(t *testing.T) {
 		t.Fatalf("Expected to get tier %d and %t, got %d and %t.", database.TierAnonymous, false, ce.Tier, ok)
 	}
 	// Set the user in the cache.
-	cache.Set(u.Sub, u)
+	cache.Set(u.Sub, u, userTierCacheTTL)
 	// Check again.
 	ce, ok = cache.Get(u.Sub)
 	if !ok || ce.Tier != u.Tier {
@@ -33,7 +35,7 @@ func TestUserTierCache(t *testing.T) {
 		t.Fatal("Quota exceeded flag doesn't match.")
 	}
 	u.QuotaExceeded = true
-	cache.Set(u.Sub, u)
+	cache.Set(u.Sub, u, userTierCacheTTL)
 	ce, ok = cache.Get(u.Sub)
 	if !ok || ce.Tier != u.Tier {
 		t.Fatalf("Expected to get tier %d and %t, got %d and %t.", u.Tier, true, ce.Tier, ok)
@@ -54,7 +56,7 @@ func TestUserTierCache(t *testing.T) {
 	timeToMonthRollover := 30 * time.Minute
 	u.SubscribedUntil = time.Now().UTC().Add(timeToMonthRollover).Truncate(time.Millisecond)
 	// Update the cache.
-	cache.Set(u.Sub, u)
+	cache.Set(u.Sub, u, userTierCacheTTL)
 	// Expect the cache entry's ExpiresAt to be after 30 minutes.
 	timeIn30 := time.Now().UTC().Add(time.Hour - timeToMonthRollover)
 	if ce.ExpiresAt.After(timeIn30) && ce.ExpiresAt.Before(timeIn30.Add(time.Second)) {
@@ -72,7 +74,7 @@ func TestUserTierCache(t *testing.T) {
 		t.Fatal("Did not expect to get a cache entry!")
 	}
 	// Update the cache with a custom key.
-	cache.Set(string(ak), u)
+	cache.Set(string(ak), u, userTierCacheTTL)
 	// Fetch the data for the custom key.
 	ce, ok = cache.Get(string(ak))
 	if !ok {
@@ -82,3 +84,340 @@ func TestUserTierCache(t *testing.T) {
 		t.Fatalf("Expected tier %d, got %d", u.Tier, ce.Tier)
 	}
 }
+
+// TestUserTierCacheInvalidate ensures that Invalidate removes all entries of
+// the given user and only them.
+func TestUserTierCacheInvalidate(t *testing.T) {
+	cache := newUserTierCache()
+	u := &database.User{Sub: t.Name(), Tier: database.TierPremium5}
+	u2 := &database.User{Sub: t.Name() + "2", Tier: database.TierPremium5}
+	// Cache the user under their sub and under an API key.
+	cache.Set(u.Sub, u, userTierCacheTTL)
+	cache.Set("api key", u, userTierCacheTTL)
+	cache.Set(u2.Sub, u2, userTierCacheTTL)
+	cache.Invalidate(u.Sub)
+	if _, ok := cache.Get(u.Sub); ok {
+		t.Fatal("Expected the entry under the sub to be removed.")
+	}
+	if _, ok := cache.Get("api key"); ok {
+		t.Fatal("Expected the entry under the API key to be removed.")
+	}
+	if _, ok := cache.Get(u2.Sub); !ok {
+		t.Fatal("Expected the other user's entry to remain.")
+	}
+	if _, exists := cache.keysBySub[u.Sub]; exists {
+		t.Fatal("Expected the user's reverse index to be removed.")
+	}
+	// Move a key from one user to another and make sure invalidating the
+	// first user doesn't affect it.
+	cache.Set("api key", u, userTierCacheTTL)
+	cache.Set("api key", u2, userTierCacheTTL)
+	cache.Invalidate(u.Sub)
+	ce, ok := cache.Get("api key")
+	if !ok || ce.Sub != u2.Sub {
+		t.Fatalf("Expected the entry to belong to '%s', got %+v and %t", u2.Sub, ce, ok)
+	}
+	cache.Invalidate(u2.Sub)
+	if _, ok = cache.Get("api key"); ok {
+		t.Fatal("Expected the entry under the API key to be removed.")
+	}
+	if len(cache.cache) != 0 || len(cache.keysBySub) != 0 {
+		t.Fatalf("Expected an empty cache, got %d entries and %d indexed subs.", len(cache.cache), len(cache.keysBySub))
+	}
+}
+
+// TestUserTierCacheInvalidateByPrefix ensures that InvalidateByPrefix removes
+// all entries whose keys start with the given prefix and only them.
+func TestUserTierCacheInvalidateByPrefix(t *testing.T) {
+	cache := newUserTierCache()
+	u := &database.User{Sub: t.Name(), Tier: database.TierPremium5}
+	ak := database.NewAPIKey().String()
+	ak2 := database.NewAPIKey().String()
+	sl := "AQAh2vxStoSJ_M9tWcTgqebUWerCAbpMfn9xxa9E29UOuw"
+	cache.Set(u.Sub, u, userTierCacheTTL)
+	cache.Set(ak, u, userTierCacheTTL)
+	cache.Set(ak+sl, u, userTierCacheTTL)
+	cache.Set(ak2+sl, u, userTierCacheTTL)
+	cache.InvalidateByPrefix(ak)
+	if _, ok := cache.Get(ak); ok {
+		t.Fatal("Expected the entry under the API key to be removed.")
+	}
+	if _, ok := cache.Get(ak + sl); ok {
+		t.Fatal("Expected the entry under the API key and skylink to be removed.")
+	}
+	if _, ok := cache.Get(u.Sub); !ok {
+		t.Fatal("Expected the entry under the sub to remain.")
+	}
+	if _, ok := cache.Get(ak2 + sl); !ok {
+		t.Fatal("Expected the entry under the other API key to remain.")
+	}
+	// The reverse index should only hold the remaining keys.
+	if len(cache.keysBySub[u.Sub]) != 2 {
+		t.Fatalf("Expected %d indexed keys, got %d", 2, len(cache.keysBySub[u.Sub]))
+	}
+}
+
+// TestUserTierCacheDelete ensures that Delete removes only the entry under the
+// given key.
+func TestUserTierCacheDelete(t *testing.T) {
+	cache := newUserTierCache()
+	u := &database.User{Sub: t.Name(), Tier: database.TierPremium5}
+	ak := database.NewAPIKey().String()
+	sl := "AQAh2vxStoSJ_M9tWcTgqebUWerCAbpMfn9xxa9E29UOuw"
+	cache.Set(ak, u, userTierCacheTTL)
+	cache.Set(ak+sl, u, userTierCacheTTL)
+	cache.Delete(ak + sl)
+	cache.Delete("no such key")
+	if _, ok := cache.Get(ak + sl); ok {
+		t.Fatal("Expected the entry under the API key and skylink to be removed.")
+	}
+	if _, ok := cache.Get(ak); !ok {
+		t.Fatal("Expected the entry under the API key to remain.")
+	}
+	if len(cache.keysBySub[u.Sub]) != 1 {
+		t.Fatalf("Expected %d indexed keys, got %d", 1, len(cache.keysBySub[u.Sub]))
+	}
+}
+
+// TestUserTierCacheTTL ensures that entries expire after the TTL they were
+// stored with.
+func TestUserTierCacheTTL(t *testing.T) {
+	cache := newUserTierCache()
+	u := &database.User{Sub: t.Name(), Tier: database.TierPremium5}
+	cache.Set(u.Sub, u, 100*time.Millisecond)
+	cache.Set("api key", u, userTierCacheTTL)
+	if _, ok := cache.Get(u.Sub); !ok {
+		t.Fatal("Expected the entry to exist.")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := cache.Get(u.Sub); ok {
+		t.Fatal("Expected the entry to have expired.")
+	}
+	if _, ok := cache.Get("api key"); !ok {
+		t.Fatal("Expected the entry with the longer TTL to remain.")
+	}
+}
+
+// TestUserTierCacheQuotaRefresh ensures that the cache correctly tracks the
+// staleness of the QuotaExceeded flag.
+func TestUserTierCacheQuotaRefresh(t *testing.T) {
+	cache := newUserTierCache()
+	u := &database.User{
+		Sub:  t.Name(),
+		Tier: database.TierPremium5,
+	}
+	// Updating a non-existent entry should be a no-op.
+	cache.SetQuotaExceeded(u.Sub, true, nil)
+	if _, ok := cache.Get(u.Sub); ok {
+		t.Fatal("Did not expect to get a cache entry!")
+	}
+	cache.Set(u.Sub, u, userTierCacheTTL)
+	ce, ok := cache.Get(u.Sub)
+	if !ok {
+		t.Fatal("Expected the entry to exist.")
+	}
+	if ce.QuotaStale() {
+		t.Fatal("Did not expect a fresh entry to be stale.")
+	}
+	// Make the entry stale.
+	cache.mu.Lock()
+	ce = cache.cache[u.Sub]
+	ce.QuotaCheckedAt = time.Now().UTC().Add(-2 * userTierCacheQuotaTTL)
+	cache.cache[u.Sub] = ce
+	cache.mu.Unlock()
+	ce, _ = cache.Get(u.Sub)
+	if !ce.QuotaStale() {
+		t.Fatal("Expected the entry to be stale.")
+	}
+	// Refresh the flag.
+	cache.SetQuotaExceeded(u.Sub, true, nil)
+	ce, _ = cache.Get(u.Sub)
+	if ce.QuotaStale() {
+		t.Fatal("Did not expect a refreshed entry to be stale.")
+	}
+	if !ce.QuotaExceeded || ce.Tier != u.Tier {
+		t.Fatalf("Unexpected cache entry %+v", ce)
+	}
+}
+
+// TestSessionRevocationCache ensures that sessionRevocationCache returns the
+// cached statuses until they expire.
+func TestSessionRevocationCache(t *testing.T) {
+	cache := newSessionRevocationCache()
+	// Get a status from the empty cache.
+	revoked, ok := cache.Get("jti")
+	if ok || revoked {
+		t.Fatalf("Expected %t and %t, got %t and %t.", false, false, revoked, ok)
+	}
+	cache.Set("jti", false)
+	cache.Set("revoked jti", true)
+	revoked, ok = cache.Get("jti")
+	if !ok || revoked {
+		t.Fatalf("Expected %t and %t, got %t and %t.", false, true, revoked, ok)
+	}
+	revoked, ok = cache.Get("revoked jti")
+	if !ok || !revoked {
+		t.Fatalf("Expected %t and %t, got %t and %t.", true, true, revoked, ok)
+	}
+	// Wait for the entries to expire.
+	time.Sleep(sessionRevocationCacheTTL)
+	if _, ok = cache.Get("revoked jti"); ok {
+		t.Fatal("Expected the entry to have expired.")
+	}
+}
+
+// TestSkylinkBlockedCache ensures that skylinkBlockedCache returns the cached
+// statuses until they expire or get invalidated.
+func TestSkylinkBlockedCache(t *testing.T) {
+	cache := newSkylinkBlockedCache()
+	// Get a status from the empty cache.
+	blocked, ok := cache.Get("skylink")
+	if ok || blocked {
+		t.Fatalf("Expected %t and %t, got %t and %t.", false, false, blocked, ok)
+	}
+	cache.Set("skylink", false)
+	cache.Set("blocked skylink", true)
+	blocked, ok = cache.Get("skylink")
+	if !ok || blocked {
+		t.Fatalf("Expected %t and %t, got %t and %t.", false, true, blocked, ok)
+	}
+	blocked, ok = cache.Get("blocked skylink")
+	if !ok || !blocked {
+		t.Fatalf("Expected %t and %t, got %t and %t.", true, true, blocked, ok)
+	}
+	// Invalidate an entry.
+	cache.Invalidate("blocked skylink")
+	if _, ok = cache.Get("blocked skylink"); ok {
+		t.Fatal("Expected the entry to be gone.")
+	}
+	// Wait for the entries to expire.
+	time.Sleep(skylinkBlockedCacheTTL)
+	if _, ok = cache.Get("skylink"); ok {
+		t.Fatal("Expected the entry to have expired.")
+	}
+}
+
+// TestConfigCache ensures that configCache returns the cached values until
+// they expire or get invalidated.
+func TestConfigCache(t *testing.T) {
+	ttl := 100 * time.Millisecond
+	cache := newConfigCache(ttl)
+	// Get a value from the empty cache.
+	val, ok := cache.Get("key")
+	if ok || val != "" {
+		t.Fatalf("Expected '' and %t, got '%s' and %t.", false, val, ok)
+	}
+	// Missing values are cached as empty strings.
+	cache.Set("key", "")
+	val, ok = cache.Get("key")
+	if !ok || val != "" {
+		t.Fatalf("Expected '' and %t, got '%s' and %t.", true, val, ok)
+	}
+	cache.Set("key", database.ConfValTrue)
+	val, ok = cache.Get("key")
+	if !ok || val != database.ConfValTrue {
+		t.Fatalf("Expected '%s' and %t, got '%s' and %t.", database.ConfValTrue, true, val, ok)
+	}
+	// Invalidate the entry.
+	cache.Invalidate("key")
+	if _, ok = cache.Get("key"); ok {
+		t.Fatal("Expected the entry to be gone.")
+	}
+	// Wait for an entry to expire.
+	cache.Set("key", database.ConfValTrue)
+	time.Sleep(ttl)
+	if _, ok = cache.Get("key"); ok {
+		t.Fatal("Expected the entry to have expired.")
+	}
+}
+
+// TestStripePricesCache ensures that stripePricesCache only fetches the prices
+// when it's empty or expired and that it doesn't cache failed fetches.
+func TestStripePricesCache(t *testing.T) {
+	ttl := 100 * time.Millisecond
+	var fetches int
+	var fetchErr error
+	fetch := func() ([]StripePrice, error) {
+		fetches++
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return []StripePrice{{ID: "price_1"}}, nil
+	}
+	cache := newStripePricesCache(fetch, ttl)
+	// Fetch the prices twice. Expect a single call to Stripe.
+	for i := 0; i < 2; i++ {
+		prices, err := cache.Prices()
+		if err != nil || len(prices) != 1 || prices[0].ID != "price_1" {
+			t.Fatalf("Unexpected prices %+v and error %v", prices, err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("Expected 1 fetch, got %d", fetches)
+	}
+	// Wait for the prices to expire and make the next fetch fail.
+	time.Sleep(ttl)
+	fetchErr = errors.New("stripe is down")
+	if _, err := cache.Prices(); err == nil {
+		t.Fatal("Expected an error.")
+	}
+	// Failed fetches are not cached, so we try again.
+	fetchErr = nil
+	prices, err := cache.Prices()
+	if err != nil || len(prices) != 1 {
+		t.Fatalf("Unexpected prices %+v and error %v", prices, err)
+	}
+	if fetches != 3 {
+		t.Fatalf("Expected 3 fetches, got %d", fetches)
+	}
+}
+
+// TestUserTierCacheTrial ensures that cached users get the limits of their
+// trial tier only until the trial lapses.
+func TestUserTierCacheTrial(t *testing.T) {
+	cache := newUserTierCache()
+	u := &database.User{
+		Sub:        t.Name(),
+		Tier:       database.TierFree,
+		TrialTier:  database.TierPremium5,
+		TrialUntil: time.Now().UTC().Add(100 * time.Millisecond),
+	}
+	cache.Set(u.Sub, u, userTierCacheTTL)
+	ce, ok := cache.Get(u.Sub)
+	if !ok || ce.EffectiveTier() != database.TierPremium5 {
+		t.Fatalf("Expected to get tier %d and %t, got %d and %t.", database.TierPremium5, true, ce.EffectiveTier(), ok)
+	}
+	// Wait for the trial to lapse. The entry is still cached but the user
+	// falls back to their paid tier.
+	time.Sleep(100 * time.Millisecond)
+	ce, ok = cache.Get(u.Sub)
+	if !ok || ce.EffectiveTier() != database.TierFree {
+		t.Fatalf("Expected to get tier %d and %t, got %d and %t.", database.TierFree, true, ce.EffectiveTier(), ok)
+	}
+}
+
+// TestUserTierCacheOrg ensures that cached members of an organization get the
+// limits of the organization's tier instead of their own.
+func TestUserTierCacheOrg(t *testing.T) {
+	cache := newUserTierCache()
+	u := &database.User{
+		Sub:        t.Name(),
+		Tier:       database.TierPremium20,
+		TrialTier:  database.TierPremium80,
+		TrialUntil: time.Now().UTC().Add(time.Hour),
+		OrgID:      primitive.NewObjectID(),
+		OrgTier:    database.TierPremium5,
+	}
+	cache.Set(u.Sub, u, userTierCacheTTL)
+	ce, ok := cache.Get(u.Sub)
+	if !ok || ce.EffectiveTier() != database.TierPremium5 {
+		t.Fatalf("Expected to get tier %d and %t, got %d and %t.", database.TierPremium5, true, ce.EffectiveTier(), ok)
+	}
+	// Once the user leaves the organization their own tier applies again.
+	u.OrgID = primitive.ObjectID{}
+	cache.Set(u.Sub, u, userTierCacheTTL)
+	ce, ok = cache.Get(u.Sub)
+	if !ok || ce.EffectiveTier() != database.TierPremium80 {
+		t.Fatalf("Expected to get tier %d and %t, got %d and %t.", database.TierPremium80, true, ce.EffectiveTier(), ok)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+type (
+	// UserCapabilitiesGET is the response of GET /user/capabilities. It tells
+	// the dashboard which features the caller's credential gives access to.
+	UserCapabilitiesGET struct {
+		CanManageAccount  bool `json:"canManageAccount"`
+		CanCreateAPIKeys  bool `json:"canCreateAPIKeys"`
+		CanTrack          bool `json:"canTrack"`
+		CanUseBilling     bool `json:"canUseBilling"`
+		CanChangePassword bool `json:"canChangePassword"`
+		EmailConfirmed    bool `json:"emailConfirmed"`
+	}
+)
+
+// userCapabilitiesGET returns which features the caller's credential gives
+// access to. We use the same checks as the routes of those features, so the
+// answer can't drift from what the routes actually allow. Callers we can't
+// identify, including ones with a public API key, can't use any of them.
+func (api *API) userCapabilitiesGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	u, _, err := api.userFromRequest(req, true)
+	if err != nil && authErrorStatus(err) == http.StatusInternalServerError {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		api.WriteJSON(w, UserCapabilitiesGET{})
+		return
+	}
+	ctx := req.Context()
+	// userFromRequest attaches the scope of the API key to the request, if
+	// the caller used one.
+	scope := APIKeyScopeFromContext(ctx)
+	viaAPIKey := !APIKeyIDFromContext(ctx).IsZero()
+	// allows tells whether the caller's credential is accepted by a route
+	// with the given authentication and method.
+	allows := func(auth routeAuth, method string) bool {
+		return !viaAPIKey || (authAllowsAPIKey(auth) && apiKeyScopeAllows(scope, method))
+	}
+	regEnabled, err := api.registrationsEnabled(ctx)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	akCreationDisabled, err := api.featureDisabled(ctx, database.ConfValAPIKeyCreationDisabled)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	akRestricted, err := api.managedAPIKeysRestricted(ctx, u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, UserCapabilitiesGET{
+		// PUT /user
+		CanManageAccount: allows(authUser, http.MethodPut),
+		// POST /user/apikeys
+		CanCreateAPIKeys: allows(authUserOrAPIKey, http.MethodPost) && !akCreationDisabled && !akRestricted,
+		// POST /track/registry/read and POST /track/registry/write
+		CanTrack: allows(authUserOrAPIKey, http.MethodPost),
+		// GET /stripe/billing, which counts as a write
+		CanUseBilling: allows(authUserOrAPIKey, http.MethodPost) && api.paymentsEnabled(),
+		// PUT /user with a password
+		CanChangePassword: allows(authUser, http.MethodPut) && regEnabled,
+		EmailConfirmed:    emailConfirmed(u),
+	})
+}
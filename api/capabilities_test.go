@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// TestUserCapabilitiesAnonymous ensures that anonymous callers get a 200 with
+// all capabilities set to false.
+func TestUserCapabilitiesAnonymous(t *testing.T) {
+	api := &API{staticRouter: httprouter.New(), staticLogger: logrus.New()}
+	api.buildHTTPRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/user/capabilities", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+	var caps map[string]bool
+	err := json.Unmarshal(w.Body.Bytes(), &caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps) != 6 {
+		t.Fatalf("Expected 6 capabilities, got %v", caps)
+	}
+	for name, c := range caps {
+		if c {
+			t.Fatalf("Expected %s to be false", name)
+		}
+	}
+}
+
+// TestAPIKeyScopeAllows ensures that read-only API keys can only be used with
+// safe methods.
+func TestAPIKeyScopeAllows(t *testing.T) {
+	tests := []struct {
+		scope   string
+		method  string
+		allowed bool
+	}{
+		{scope: "", method: http.MethodPost, allowed: true},
+		{scope: database.APIKeyScopeFull, method: http.MethodDelete, allowed: true},
+		{scope: database.APIKeyScopeRead, method: http.MethodGet, allowed: true},
+		{scope: database.APIKeyScopeRead, method: http.MethodHead, allowed: true},
+		{scope: database.APIKeyScopeRead, method: http.MethodPost, allowed: false},
+		{scope: database.APIKeyScopeRead, method: http.MethodPut, allowed: false},
+	}
+	for _, tt := range tests {
+		if allowed := apiKeyScopeAllows(tt.scope, tt.method); allowed != tt.allowed {
+			t.Errorf("Expected %t for scope '%s' and method %s, got %t", tt.allowed, tt.scope, tt.method, allowed)
+		}
+	}
+}
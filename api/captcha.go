@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/lib/captcha"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+var (
+	// CaptchaVerifier verifies the captcha tokens callers need to send when
+	// they register or request an account recovery. Nil disables captcha
+	// verification. It's configured via the ACCOUNTS_CAPTCHA_PROVIDER and
+	// ACCOUNTS_CAPTCHA_SECRET environment variables.
+	CaptchaVerifier captcha.Verifier
+	// CaptchaFailOpen defines whether we accept requests without verifying
+	// their captcha tokens when we fail to reach the captcha provider. When
+	// it's false we reject them. This value is configurable via the
+	// ACCOUNTS_CAPTCHA_FAIL_OPEN environment variable.
+	CaptchaFailOpen = false
+	// CaptchaTimeout defines how long we wait for the captcha provider to
+	// verify a token. The caller is waiting, so this needs to be short.
+	CaptchaTimeout = 5 * time.Second
+
+	// ErrCaptchaFailed is returned when the caller's captcha token is missing
+	// or invalid.
+	ErrCaptchaFailed = errors.New("captcha verification failed")
+)
+
+// verifyCaptcha verifies the given captcha token of the request, if captcha
+// verification is enabled. It returns ErrCaptchaFailed if the token is missing
+// or invalid, or if we fail to reach the provider and CaptchaFailOpen is
+// false.
+func (api *API) verifyCaptcha(req *http.Request, token string) error {
+	if CaptchaVerifier == nil {
+		return nil
+	}
+	if token == "" {
+		return errors.AddContext(ErrCaptchaFailed, "missing captchaToken")
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), CaptchaTimeout)
+	defer cancel()
+	err := CaptchaVerifier.Verify(ctx, token, clientIP(req))
+	if err == nil {
+		return nil
+	}
+	if errors.Contains(err, captcha.ErrInvalidToken) {
+		return ErrCaptchaFailed
+	}
+	api.staticLogger.Warnln(errors.AddContext(err, "failed to verify captcha token"))
+	if CaptchaFailOpen {
+		return nil
+	}
+	return ErrCaptchaFailed
+}
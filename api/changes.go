@@ -0,0 +1,65 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// ChangefeedSecretHeader holds the name of the header in which consumers
+	// of the changefeed pass the shared secret.
+	ChangefeedSecretHeader = "Skynet-Changefeed-Secret" // #nosec
+)
+
+var (
+	// ChangefeedSecret is the secret consumers of the changefeed need to
+	// present. The changefeed is disabled when it's empty. This value is
+	// configurable via the ACCOUNTS_CHANGEFEED_SECRET environment variable.
+	ChangefeedSecret = ""
+)
+
+type (
+	// ChangesGET is the response of GET /internal/changes
+	ChangesGET struct {
+		Events []database.ChangeEvent `json:"events"`
+		// Cursor should be passed as `since` in order to get the next batch.
+		Cursor string `json:"cursor"`
+	}
+)
+
+// changesGET returns a batch of change events which happened after the given
+// cursor. Consumers should keep calling it with the returned cursor until
+// they get an empty batch.
+func (api *API) changesGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	secret := req.Header.Get(ChangefeedSecretHeader)
+	if ChangefeedSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(ChangefeedSecret)) != 1 {
+		api.WriteError(w, errors.New("invalid changefeed secret"), http.StatusUnauthorized)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	pageSize, err := fetchPageSize(req.Form, DefaultPageSizeLarge)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	events, cursor, err := api.staticDB.ChangeEventsSince(req.Context(), req.Form.Get("since"), pageSize)
+	if errors.Contains(err, database.ErrInvalidCursor) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, ChangesGET{
+		Events: events,
+		Cursor: cursor,
+	})
+}
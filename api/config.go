@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// configValue returns the value of the given configuration key. Values are
+// cached for configCacheTTL, so we don't hit the DB on every request. Missing
+// values are returned as empty strings.
+func (api *API) configValue(ctx context.Context, key string) (string, error) {
+	if val, ok := api.staticConfigCache.Get(key); ok {
+		return val, nil
+	}
+	val, err := api.staticDB.ReadConfigValue(ctx, key)
+	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
+		return "", errors.AddContext(err, "failed to read from configuration")
+	}
+	api.staticConfigCache.Set(key, val)
+	return val, nil
+}
+
+// featureDisabled checks whether the feature flag with the given key is set.
+func (api *API) featureDisabled(ctx context.Context, key string) (bool, error) {
+	val, err := api.configValue(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return val == database.ConfValTrue, nil
+}
+
+// registrationsEnabled checks whether registrations are enabled. Disabling
+// them also disables password changes and account recovery.
+func (api *API) registrationsEnabled(ctx context.Context) (bool, error) {
+	disabled, err := api.featureDisabled(ctx, database.ConfValRegistrationsDisabled)
+	return !disabled, err
+}
+
+// withFeatureFlag ensures that the given feature is not disabled before
+// calling the handler. Disabled features get a 503 response.
+func (api *API) withFeatureFlag(key string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		disabled, err := api.featureDisabled(req.Context(), key)
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if disabled {
+			api.WriteError(w, ErrFeatureDisabled, http.StatusServiceUnavailable)
+			return
+		}
+		h(w, req, ps)
+	}
+}
+
+// ifRegistrationsEnabled ensures that registrations are not disabled before
+// calling the handler. We use it on all endpoints which register users or
+// recover their accounts. Disabled registrations get a 501 response.
+func (api *API) ifRegistrationsEnabled(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		enabled, err := api.registrationsEnabled(req.Context())
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !enabled {
+			api.WriteError(w, ErrRegistrationsDisabled, http.StatusNotImplemented)
+			return
+		}
+		h(w, req, ps)
+	}
+}
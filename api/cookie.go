@@ -30,7 +30,10 @@ const (
 )
 
 var (
-	secureCookie = func() *securecookie.SecureCookie {
+	// cookieHashKey and cookieEncKey are the keys we use for hashing and
+	// encrypting cookies. We also derive the keys which protect other
+	// secrets from them, e.g. the users' TOTP secrets.
+	cookieHashKey, cookieEncKey = func() ([]byte, []byte) {
 		_ = godotenv.Load()
 		hashKeyStr := os.Getenv(envCookieHashKey)
 		encKeyStr := os.Getenv(envCookieEncKey)
@@ -48,8 +51,10 @@ var (
 		// These keys need to be *exactly* 16 or 32 bytes long.
 		var hashKey = []byte(hashKeyStr)[:secureCookieKeySize]
 		var encKey = []byte(encKeyStr)[:secureCookieKeySize]
-		return securecookie.New(hashKey, encKey)
+		return hashKey, encKey
 	}()
+
+	secureCookie = securecookie.New(cookieHashKey, cookieEncKey)
 )
 
 // writeCookie is a helper function that writes the given JWT token as a
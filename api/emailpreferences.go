@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+type (
+	// UserPreferencesPUT describes the body of a request to change the
+	// user's email preferences. Omitted fields keep their current value.
+	UserPreferencesPUT struct {
+		Security  *bool `json:"security,omitempty"`
+		Product   *bool `json:"product,omitempty"`
+		Marketing *bool `json:"marketing,omitempty"`
+	}
+)
+
+// userPreferencesPUT changes the categories of emails the user wants to
+// receive.
+func (api *API) userPreferencesPUT(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var payload UserPreferencesPUT
+	err := parseRequestBodyJSON(req.Body, &payload)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	if payload == (UserPreferencesPUT{}) {
+		api.WriteError(w, errors.New("empty request"), http.StatusBadRequest)
+		return
+	}
+	err = api.managedUserSave(req.Context(), u, userSaveRetriesInteractive, func(u *database.User) error {
+		prefs := u.EmailPrefs()
+		if payload.Security != nil {
+			prefs.Security = *payload.Security
+		}
+		if payload.Product != nil {
+			prefs.Product = *payload.Product
+		}
+		if payload.Marketing != nil {
+			prefs.Marketing = *payload.Marketing
+		}
+		u.EmailPreferences = &prefs
+		return nil
+	})
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, UserGETFromUser(u))
+}
+
+// emailUnsubscribeGET opts a user out of a category of emails. It's the
+// target of the one-click unsubscribe links in our emails, so it doesn't
+// require the user to be logged in. The signed token identifies both the user
+// and the category.
+func (api *API) emailUnsubscribeGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	sub, category, err := email.ParseUnsubscribeToken(req.FormValue("token"))
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	u, err := api.staticDB.UserBySub(ctx, sub)
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, email.ErrInvalidUnsubscribeToken, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.managedUserSave(ctx, u, userSaveRetriesInteractive, func(u *database.User) error {
+		prefs := u.EmailPrefs()
+		prefs.Set(category, false)
+		u.EmailPreferences = &prefs
+		return nil
+	})
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, u.EmailPrefs())
+}
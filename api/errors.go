@@ -0,0 +1,258 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/lib"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// ErrCodeInternal is the error code we return for all errors which don't
+	// have a more specific code.
+	ErrCodeInternal = "internal"
+
+	// ErrCodeAccountLocked is the error code we return when the user tries to
+	// log in with a password while their account is locked.
+	ErrCodeAccountLocked = "account_locked"
+	// ErrCodeAccountSuspended is the error code we return when a suspended
+	// user tries to log in or to use their JWT or API key.
+	ErrCodeAccountSuspended = "account_suspended"
+	// ErrCodeAPIKeyLimitReached is the error code we return when the user
+	// tries to create more API keys than allowed.
+	ErrCodeAPIKeyLimitReached = "api_key_limit_reached"
+	// ErrCodeAPIKeyNotAllowed is the error code we return when the caller uses
+	// an API key with an endpoint which doesn't accept API keys.
+	ErrCodeAPIKeyNotAllowed = "api_key_not_allowed"
+	// ErrCodeAPIKeyReadOnly is the error code we return when the caller uses a
+	// read-only API key to modify data.
+	ErrCodeAPIKeyReadOnly = "api_key_read_only"
+	// ErrCodeCaptchaFailed is the error code we return when the caller's
+	// captcha token is missing or invalid.
+	ErrCodeCaptchaFailed = "captcha_failed"
+	// ErrCodeChallengeExpired is the error code we return when the caller
+	// responds to an expired challenge. Clients should request a new
+	// challenge when they receive it.
+	ErrCodeChallengeExpired = "challenge_expired"
+	// ErrCodeEmailInUse is the error code we return when the caller tries to
+	// use an email address which belongs to another user.
+	ErrCodeEmailInUse = "email_in_use"
+	// ErrCodeEmailNotConfirmed is the error code we return when the user
+	// needs to confirm their email address before they can do what they
+	// tried to do.
+	ErrCodeEmailNotConfirmed = "email_not_confirmed"
+	// ErrCodeFeatureDisabled is the error code we return when the caller
+	// tries to use a feature which the operators have disabled.
+	ErrCodeFeatureDisabled = "feature_disabled"
+	// ErrCodeInvalidAPIKey is the error code we return when the given API key
+	// is invalid.
+	ErrCodeInvalidAPIKey = "invalid_api_key"
+	// ErrCodeInvalidCredentials is the error code we return when the caller
+	// fails to log in.
+	ErrCodeInvalidCredentials = "invalid_credentials"
+	// ErrCodeInvalidSkylink is the error code we return when the given
+	// skylink is invalid.
+	ErrCodeInvalidSkylink = "invalid_skylink"
+	// ErrCodeMergeConflict is the error code we return when we can't merge
+	// two accounts automatically, e.g. because both have a subscription.
+	ErrCodeMergeConflict = "merge_conflict"
+	// ErrCodeNotOrgOwner is the error code we return when a member of an
+	// organization who isn't its owner tries to manage it.
+	ErrCodeNotOrgOwner = "not_org_owner"
+	// ErrCodeOrgInviteLimitReached is the error code we return when an
+	// organization tries to send more invites than allowed.
+	ErrCodeOrgInviteLimitReached = "org_invite_limit_reached"
+	// ErrCodeOrgNotFound is the error code we return when the requested
+	// organization doesn't exist or the caller isn't one of its members.
+	ErrCodeOrgNotFound = "org_not_found"
+	// ErrCodePasswordMatchesEmail is the error code we return when the new
+	// password is the same as the user's email address.
+	ErrCodePasswordMatchesEmail = "password_matches_email"
+	// ErrCodePasswordTooCommon is the error code we return when the new
+	// password is among the most commonly used ones.
+	ErrCodePasswordTooCommon = "password_too_common"
+	// ErrCodePasswordTooShort is the error code we return when the new
+	// password is shorter than the configured minimum.
+	ErrCodePasswordTooShort = "password_too_short"
+	// ErrCodePaymentsDisabled is the error code we return when the caller
+	// uses a payments endpoint on a portal which doesn't accept payments.
+	ErrCodePaymentsDisabled = "payments_disabled"
+	// ErrCodePubKeyLimitReached is the error code we return when the user
+	// tries to add more public keys than allowed.
+	ErrCodePubKeyLimitReached = "pubkey_limit_reached"
+	// ErrCodeQuotaExceeded is the error code we return when tracking an
+	// upload would take the user too far past their storage quota.
+	ErrCodeQuotaExceeded = "quota_exceeded"
+	// ErrCodeRateLimitExceeded is the error code we return when the caller
+	// makes too many requests.
+	ErrCodeRateLimitExceeded = "rate_limit_exceeded"
+	// ErrCodeRegistrationsDisabled is the error code we return when the
+	// caller tries to register while registrations are disabled.
+	ErrCodeRegistrationsDisabled = "registrations_disabled"
+	// ErrCodeRequestBodyTooLarge is the error code we return when the
+	// request's body exceeds the limit of its route.
+	ErrCodeRequestBodyTooLarge = "request_body_too_large"
+	// ErrCodeRequestTimeout is the error code we return when the request
+	// doesn't complete within the configured time.
+	ErrCodeRequestTimeout = "request_timeout"
+	// ErrCodeSessionRevoked is the error code we return when the caller uses
+	// a session which has been revoked.
+	ErrCodeSessionRevoked = "session_revoked"
+	// ErrCodeSkylinkBlocked is the error code we return when the given
+	// skylink is blocked.
+	ErrCodeSkylinkBlocked = "skylink_blocked"
+	// ErrCodeStripeCustomerInUse is the error code we return when the caller
+	// tries to use a Stripe customer ID which belongs to another user.
+	ErrCodeStripeCustomerInUse = "stripe_customer_in_use"
+	// ErrCodeTierNotAllowed is the error code we return when the user's tier
+	// doesn't allow the requested action.
+	ErrCodeTierNotAllowed = "tier_not_allowed"
+	// ErrCodeTwoFactorRequired is the error code we return when the caller
+	// logs in with valid credentials but needs to provide a TOTP code via
+	// POST /login/2fa before they get a session.
+	ErrCodeTwoFactorRequired = "two_factor_required"
+	// ErrCodeUserExists is the error code we return when the caller tries to
+	// register an identity which already belongs to a user.
+	ErrCodeUserExists = "user_exists"
+	// ErrCodeUserInOrg is the error code we return when a user who already
+	// belongs to an organization tries to create or join one.
+	ErrCodeUserInOrg = "user_in_org"
+	// ErrCodeUserNotFound is the error code we return when the requested user
+	// doesn't exist.
+	ErrCodeUserNotFound = "user_not_found"
+)
+
+var (
+	// ErrAccountLocked is returned when the user tries to log in with a
+	// password while their account is locked because of too many failed
+	// logins.
+	ErrAccountLocked = errors.New("this account is temporarily locked because of too many failed logins")
+	// ErrAccountSuspended is returned when a suspended user tries to log in
+	// or to use their JWT or API key.
+	ErrAccountSuspended = errors.New("this account is suspended")
+	// ErrEmailInUse is returned when the caller tries to use an email address
+	// which belongs to another user.
+	ErrEmailInUse = errors.New("this email is already in use")
+	// ErrEmailNotConfirmed is returned when a user who hasn't confirmed their
+	// email address tries to create an API key while the portal requires a
+	// confirmed email address for that.
+	ErrEmailNotConfirmed = errors.New("you need to confirm your email address before you can create API keys")
+	// ErrFeatureDisabled is returned when the caller tries to use a feature
+	// which the operators have disabled.
+	ErrFeatureDisabled = errors.New("this feature is currently disabled")
+	// ErrRegistrationsDisabled is returned when the caller tries to register
+	// while registrations are disabled.
+	ErrRegistrationsDisabled = errors.New("registrations are currently disabled")
+	// ErrRequestBodyTooLarge is returned when the request's body exceeds the
+	// limit of its route.
+	ErrRequestBodyTooLarge = errors.New("request body too large")
+
+	// errorCodes maps common errors to their codes. We check them in order,
+	// so more specific errors need to come first.
+	errorCodes = []struct {
+		err  error
+		code string
+	}{
+		{err: ErrInvalidCredentials, code: ErrCodeInvalidCredentials},
+		{err: ErrAccountLocked, code: ErrCodeAccountLocked},
+		{err: ErrAccountSuspended, code: ErrCodeAccountSuspended},
+		{err: ErrEmailInUse, code: ErrCodeEmailInUse},
+		{err: ErrEmailNotConfirmed, code: ErrCodeEmailNotConfirmed},
+		{err: ErrRegistrationsDisabled, code: ErrCodeRegistrationsDisabled},
+		{err: ErrCaptchaFailed, code: ErrCodeCaptchaFailed},
+		{err: ErrFeatureDisabled, code: ErrCodeFeatureDisabled},
+		{err: ErrStripeNotConfigured, code: ErrCodePaymentsDisabled},
+		{err: ErrRateLimitExceeded, code: ErrCodeRateLimitExceeded},
+		{err: ErrAnonymousLimitExceeded, code: ErrCodeRateLimitExceeded},
+		{err: ErrTierNotAllowed, code: ErrCodeTierNotAllowed},
+		{err: ErrAPIKeyNotAllowed, code: ErrCodeAPIKeyNotAllowed},
+		{err: ErrAPIKeyReadOnly, code: ErrCodeAPIKeyReadOnly},
+		{err: ErrSessionRevoked, code: ErrCodeSessionRevoked},
+		{err: ErrTwoFactorRequired, code: ErrCodeTwoFactorRequired},
+		{err: lib.ErrPasswordTooShort, code: ErrCodePasswordTooShort},
+		{err: lib.ErrPasswordMatchesEmail, code: ErrCodePasswordMatchesEmail},
+		{err: lib.ErrPasswordTooCommon, code: ErrCodePasswordTooCommon},
+		{err: database.ErrChallengeExpired, code: ErrCodeChallengeExpired},
+		{err: database.ErrUserNotFound, code: ErrCodeUserNotFound},
+		{err: database.ErrUserAlreadyExists, code: ErrCodeUserExists},
+		{err: database.ErrSkylinkBlocked, code: ErrCodeSkylinkBlocked},
+		{err: database.ErrInvalidSkylink, code: ErrCodeInvalidSkylink},
+		{err: database.ErrInvalidAPIKey, code: ErrCodeInvalidAPIKey},
+		{err: database.ErrMaxNumAPIKeysExceeded, code: ErrCodeAPIKeyLimitReached},
+		{err: database.ErrPubKeyLimitReached, code: ErrCodePubKeyLimitReached},
+		{err: database.ErrStorageQuotaExceeded, code: ErrCodeQuotaExceeded},
+		{err: database.ErrMergeStripeConflict, code: ErrCodeMergeConflict},
+		{err: database.ErrOrgNotFound, code: ErrCodeOrgNotFound},
+		{err: database.ErrOrgInviteLimitReached, code: ErrCodeOrgInviteLimitReached},
+		{err: database.ErrUserInOrg, code: ErrCodeUserInOrg},
+		{err: ErrNotOrgOwner, code: ErrCodeNotOrgOwner},
+	}
+)
+
+type (
+	// Error wraps an error with a stable, machine-readable code, so clients
+	// don't need to match error messages. WriteError sends the code along
+	// with the error message.
+	Error struct {
+		Code string
+		Err  error
+	}
+)
+
+// NewError wraps the given error with the given code.
+func NewError(code string, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// Error implements the error interface. It returns the message of the wrapped
+// error, so wrapping an error doesn't change what clients see.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errorCode returns the machine-readable code of the given error. Codes
+// assigned via NewError take precedence over the ones we look up in
+// errorCodes. Errors without a code get ErrCodeInternal.
+func errorCode(err error) string {
+	if code := assignedErrorCode(err); code != "" {
+		return code
+	}
+	for _, ec := range errorCodes {
+		if errors.Contains(err, ec.err) {
+			return ec.code
+		}
+	}
+	return ErrCodeInternal
+}
+
+// requestBodyTooLarge tells whether the given error was caused by reading past
+// the limit set by withBodyLimit. The standard library doesn't export that
+// error in all versions we support, so we match its message.
+func requestBodyTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Contains(err, ErrRequestBodyTooLarge) || strings.Contains(err.Error(), "http: request body too large")
+}
+
+// assignedErrorCode returns the code assigned to the given error or to any of
+// its components via NewError.
+func assignedErrorCode(err error) string {
+	switch e := err.(type) {
+	case *Error:
+		return e.Code
+	case errors.Error:
+		for _, c := range e.ErrSet {
+			if code := assignedErrorCode(c); code != "" {
+				return code
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestErrorCode ensures that errorCode returns the expected code for assigned,
+// mapped, and unknown errors.
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{name: "nil", err: nil, code: ErrCodeInternal},
+		{name: "unknown", err: errors.New("boom"), code: ErrCodeInternal},
+		{name: "mapped", err: ErrInvalidCredentials, code: ErrCodeInvalidCredentials},
+		{name: "mapped with context", err: errors.AddContext(database.ErrInvalidSkylink, "offending skylink"), code: ErrCodeInvalidSkylink},
+		{name: "composed", err: errors.Compose(errors.New("boom"), database.ErrUserNotFound), code: ErrCodeUserNotFound},
+		{name: "assigned", err: NewError("custom", errors.New("boom")), code: "custom"},
+		{name: "assigned with context", err: errors.AddContext(NewError("custom", errors.New("boom")), "context"), code: "custom"},
+		{name: "assigned over mapped", err: NewError("custom", database.ErrInvalidSkylink), code: "custom"},
+	}
+	for _, tt := range tests {
+		if code := errorCode(tt.err); code != tt.code {
+			t.Errorf("%s: expected code '%s', got '%s'", tt.name, tt.code, code)
+		}
+	}
+	// Wrapping an error doesn't change its message.
+	if err := NewError("custom", ErrEmailInUse); err.Error() != ErrEmailInUse.Error() {
+		t.Fatalf("Expected message '%s', got '%s'", ErrEmailInUse, err)
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// WriteJSONWithETag writes the object to the ResponseWriter, just like
+// WriteJSON does, and sets a weak ETag derived from the response body. If the
+// caller already has the same version of the response, i.e. they send a
+// matching If-None-Match header, we respond with 304 Not Modified and no body.
+func (api *API) WriteJSONWithETag(w http.ResponseWriter, req *http.Request, obj interface{}) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(obj)
+	if err != nil {
+		// Let WriteJSON deal with the error.
+		api.WriteJSON(w, obj)
+		return
+	}
+	etag := weakETag(buf.Bytes())
+	w.Header().Set("ETag", etag)
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		api.staticLogger.Traceln(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	api.staticLogger.Traceln(http.StatusOK)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		api.staticLogger.Debugln(err)
+	}
+}
+
+// weakETag returns a weak ETag for the given response body. The ETag is weak
+// because we don't guarantee byte-for-byte equality of the responses, only
+// that they represent the same data.
+func weakETag(body []byte) string {
+	h := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(h[:16]) + `"`
+}
+
+// etagMatches checks whether the given If-None-Match header value matches the
+// given ETag. As required by RFC 7232, it uses the weak comparison, so it
+// ignores the `W/` prefix of both values.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
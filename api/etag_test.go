@@ -0,0 +1,34 @@
+package api
+
+import (
+	"testing"
+)
+
+// TestETag ensures that weakETag and etagMatches work as expected.
+func TestETag(t *testing.T) {
+	etag := weakETag([]byte(`{"sub":"abc"}`))
+	if etag != weakETag([]byte(`{"sub":"abc"}`)) {
+		t.Fatal("Expected the same body to produce the same ETag.")
+	}
+	other := weakETag([]byte(`{"sub":"abd"}`))
+	if etag == other {
+		t.Fatal("Expected different bodies to produce different ETags.")
+	}
+	tests := []struct {
+		ifNoneMatch string
+		match       bool
+	}{
+		{ifNoneMatch: "", match: false},
+		{ifNoneMatch: etag, match: true},
+		{ifNoneMatch: etag[2:], match: true}, // strong version of the same tag
+		{ifNoneMatch: other, match: false},
+		{ifNoneMatch: other + ", " + etag, match: true},
+		{ifNoneMatch: "*", match: true},
+		{ifNoneMatch: "garbage", match: false},
+	}
+	for _, tt := range tests {
+		if m := etagMatches(tt.ifNoneMatch, etag); m != tt.match {
+			t.Fatalf("Expected '%s' to match: %t, got %t", tt.ifNoneMatch, tt.match, m)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// formatCSV is the value of the `format` parameter which requests a CSV
+	// export instead of a page of JSON.
+	formatCSV = "csv"
+	// formatJSON is the value of the `format` parameter which requests a page
+	// of JSON. This is the default.
+	formatJSON = "json"
+)
+
+var (
+	// CSVExportMaxRows is the maximum number of rows we include in a CSV
+	// export. This value is configurable via the
+	// ACCOUNTS_CSV_EXPORT_MAX_ROWS environment variable.
+	CSVExportMaxRows = 100000
+
+	// uploadsCSVHeader is the header row of the uploads CSV export.
+	uploadsCSVHeader = []string{"skylink", "name", "size", "timestamp", "unpinned"}
+	// downloadsCSVHeader is the header row of the downloads CSV export.
+	downloadsCSVHeader = []string{"skylink", "name", "bytes", "createdAt"}
+)
+
+type (
+	// csvExport streams a CSV export to the client. It only writes the
+	// response headers once we have the first row, so we can still respond
+	// with an error if the DB query fails.
+	csvExport struct {
+		w        http.ResponseWriter
+		cw       *csv.Writer
+		filename string
+		header   []string
+		started  bool
+	}
+)
+
+// newCSVExport returns a new csvExport which sends the given file to the
+// client.
+func newCSVExport(w http.ResponseWriter, filename string, header []string) *csvExport {
+	return &csvExport{
+		w:        w,
+		cw:       csv.NewWriter(w),
+		filename: filename,
+		header:   header,
+	}
+}
+
+// WriteRow writes a single row, starting the response if needed. Cells which
+// a spreadsheet would interpret as a formula are escaped, see csvEscapeCell.
+func (e *csvExport) WriteRow(row []string) error {
+	if !e.started {
+		e.start()
+	}
+	escaped := make([]string, len(row))
+	for i, cell := range row {
+		escaped[i] = csvEscapeCell(cell)
+	}
+	return e.cw.Write(escaped)
+}
+
+// Finish starts the response if needed and flushes all buffered rows.
+func (e *csvExport) Finish() error {
+	if !e.started {
+		e.start()
+	}
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+// start writes the response headers and the header row.
+func (e *csvExport) start() {
+	e.started = true
+	e.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	e.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.filename))
+	e.w.WriteHeader(http.StatusOK)
+	// An error here will also be returned by Finish.
+	_ = e.cw.Write(e.header)
+}
+
+// csvEscapeCell prefixes the given cell with a single quote if it starts with
+// a character which makes spreadsheet applications treat it as a formula. This
+// prevents CSV injection via user-controlled values, such as upload names.
+func csvEscapeCell(cell string) string {
+	if cell == "" {
+		return cell
+	}
+	switch cell[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + cell
+	}
+	return cell
+}
+
+// csvExportFilename returns the name of the file we send for the given
+// export of the given user, e.g. "uploads-<sub>-2006-01-02.csv".
+func csvExportFilename(export string, u *database.User) string {
+	return fmt.Sprintf("%s-%s-%s.csv", export, u.Sub, time.Now().UTC().Format("2006-01-02"))
+}
+
+// userUploadsCSV streams all of the user's uploads which match the given
+// filter as a CSV file, up to CSVExportMaxRows rows.
+func (api *API) userUploadsCSV(u *database.User, w http.ResponseWriter, req *http.Request, filter database.UploadsFilter, sort database.UploadsSort) {
+	e := newCSVExport(w, csvExportFilename("uploads", u), uploadsCSVHeader)
+	err := api.staticDB.UploadsByUserExport(req.Context(), *u, filter, sort, CSVExportMaxRows, func(up database.UploadExport) error {
+		return e.WriteRow([]string{
+			up.Skylink,
+			up.Name,
+			strconv.FormatInt(up.Size, 10),
+			up.Timestamp.UTC().Format(time.RFC3339),
+			strconv.FormatBool(up.Unpinned),
+		})
+	})
+	api.finishCSVExport(w, e, err)
+}
+
+// userDownloadsCSV streams all of the user's downloads as a CSV file, up to
+// CSVExportMaxRows rows.
+func (api *API) userDownloadsCSV(u *database.User, w http.ResponseWriter, req *http.Request) {
+	e := newCSVExport(w, csvExportFilename("downloads", u), downloadsCSVHeader)
+	err := api.staticDB.DownloadsByUserExport(req.Context(), *u, CSVExportMaxRows, func(d database.DownloadResponse) error {
+		return e.WriteRow([]string{
+			d.Skylink,
+			d.Name,
+			strconv.FormatUint(d.Size, 10),
+			d.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	})
+	api.finishCSVExport(w, e, err)
+}
+
+// finishCSVExport completes the given export. If the export failed before we
+// sent anything we respond with an error. Otherwise, the status is already
+// sent, so all we can do is log the error and cut the response short.
+func (api *API) finishCSVExport(w http.ResponseWriter, e *csvExport, err error) {
+	if err != nil && !e.started {
+		if errors.Contains(err, database.ErrInvalidTimePeriod) || errors.Contains(err, database.ErrInvalidSizeRange) {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		api.staticLogger.Warnf("Failed to complete CSV export: %v", err)
+		return
+	}
+	if err = e.Finish(); err != nil {
+		api.staticLogger.Debugf("Failed to write CSV export: %v", err)
+	}
+}
+
+// fetchFormat returns the response format requested via the `format` form
+// value. It defaults to JSON.
+func fetchFormat(form url.Values) (string, error) {
+	switch format := form.Get("format"); format {
+	case "", formatJSON:
+		return formatJSON, nil
+	case formatCSV:
+		return formatCSV, nil
+	default:
+		return "", errors.New("invalid format value, supported values are 'json' and 'csv'")
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestCSVEscapeCell ensures that csvEscapeCell escapes cells which a
+// spreadsheet would interpret as a formula and leaves the rest untouched.
+func TestCSVEscapeCell(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{in: "", out: ""},
+		{in: "file.txt", out: "file.txt"},
+		{in: "123", out: "123"},
+		{in: "a=b", out: "a=b"},
+		{in: "=HYPERLINK(\"x\")", out: "'=HYPERLINK(\"x\")"},
+		{in: "+1", out: "'+1"},
+		{in: "-1", out: "'-1"},
+		{in: "@SUM(A1)", out: "'@SUM(A1)"},
+		{in: "\tx", out: "'\tx"},
+		{in: "\rx", out: "'\rx"},
+	}
+	for _, tt := range tests {
+		if out := csvEscapeCell(tt.in); out != tt.out {
+			t.Errorf("Expected %q to become %q, got %q", tt.in, tt.out, out)
+		}
+	}
+}
+
+// TestCSVExportWriteRow ensures that csvExport escapes the cells of each row
+// but not the header.
+func TestCSVExportWriteRow(t *testing.T) {
+	w := httptest.NewRecorder()
+	e := newCSVExport(w, "test.csv", []string{"name", "size"})
+	if err := e.WriteRow([]string{"=cmd|' /C calc'!A0", "10"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(w.Body.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"name", "size"}, {"'=cmd|' /C calc'!A0", "10"}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Expected %v, got %v", expected, rows)
+	}
+}
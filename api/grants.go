@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/gorilla/securecookie"
+	"github.com/joho/godotenv"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// grantTTLDefault is the validity period of a skylink access grant when
+	// the caller doesn't specify one.
+	grantTTLDefault = 24 * time.Hour
+	// grantTTLMax is the longest validity period we allow for a skylink
+	// access grant.
+	grantTTLMax = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidGrant is returned when a skylink access grant is malformed,
+	// has an invalid signature, or doesn't cover the requested skylink.
+	ErrInvalidGrant = errors.New("invalid grant")
+	// ErrGrantExpired is returned when a skylink access grant has expired.
+	ErrGrantExpired = errors.New("grant expired")
+
+	// grantServerKey is the server-wide secret we use to sign skylink access
+	// grants. It is derived from the cookie hash key, so all instances of
+	// accounts share it without the need for additional configuration.
+	grantServerKey = func() []byte {
+		_ = godotenv.Load()
+		hashKeyStr := os.Getenv(envCookieHashKey)
+		if build.Release == "testing" && len(hashKeyStr) < secureCookieKeySize {
+			hashKeyStr = string(securecookie.GenerateRandomKey(secureCookieKeySize))
+		}
+		mac := hmac.New(sha256.New, []byte(hashKeyStr))
+		_, _ = mac.Write([]byte("skylink access grants"))
+		return mac.Sum(nil)
+	}()
+)
+
+type (
+	// skylinkGrant is the signed payload of a skylink access grant.
+	skylinkGrant struct {
+		Sub     string `json:"sub"`
+		Skylink string `json:"skylink"`
+		Tier    int    `json:"tier"`
+		Expires int64  `json:"exp"`
+	}
+	// UserUploadsSharePOST describes the body of a request to share a skylink.
+	UserUploadsSharePOST struct {
+		// TTL is the validity period of the grant in seconds.
+		TTL int64 `json:"ttl"`
+	}
+	// UserUploadsShareResponse is the response to a request to share a
+	// skylink.
+	UserUploadsShareResponse struct {
+		Grant     string    `json:"grant"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+)
+
+// newSkylinkGrant creates a signed grant token which gives the holder access
+// to the given skylink with the user's tier until the given expiration time.
+func newSkylinkGrant(u *database.User, skylink string, expires time.Time) (string, error) {
+	payload, err := json.Marshal(skylinkGrant{
+		Sub:     u.Sub,
+		Skylink: skylink,
+		Tier:    u.EffectiveTier(),
+		Expires: expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	sig := grantSignature(u.GrantSecret, payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseSkylinkGrant decodes the given grant token without verifying its
+// signature. Use verifySkylinkGrant once the granting user is known.
+func parseSkylinkGrant(token string) (skylinkGrant, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return skylinkGrant{}, nil, nil, ErrInvalidGrant
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return skylinkGrant{}, nil, nil, ErrInvalidGrant
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return skylinkGrant{}, nil, nil, ErrInvalidGrant
+	}
+	var g skylinkGrant
+	if err = json.Unmarshal(payload, &g); err != nil {
+		return skylinkGrant{}, nil, nil, ErrInvalidGrant
+	}
+	return g, payload, sig, nil
+}
+
+// verifySkylinkGrant verifies the signature of the given payload against the
+// user's grant secret and ensures the grant covers the skylink and hasn't
+// expired.
+func verifySkylinkGrant(g skylinkGrant, payload, sig []byte, grantSecret, skylink string) error {
+	if grantSecret == "" || !hmac.Equal(sig, grantSignature(grantSecret, payload)) {
+		return ErrInvalidGrant
+	}
+	if g.Skylink != skylink {
+		return ErrInvalidGrant
+	}
+	if time.Now().UTC().Unix() >= g.Expires {
+		return ErrGrantExpired
+	}
+	return nil
+}
+
+// grantSignature signs the given payload with a key derived from the server
+// key and the user's grant secret.
+func grantSignature(grantSecret string, payload []byte) []byte {
+	keyMAC := hmac.New(sha256.New, grantServerKey)
+	_, _ = keyMAC.Write([]byte(grantSecret))
+	mac := hmac.New(sha256.New, keyMAC.Sum(nil))
+	_, _ = mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// managedUserFromGrant validates the given grant for the given skylink and
+// returns the granting user, along with the tier granted.
+//
+// This requires a single DB read and no DB writes.
+func (api *API) managedUserFromGrant(ctx context.Context, token, skylink string) (*database.User, int, error) {
+	g, payload, sig, err := parseSkylinkGrant(token)
+	if err != nil {
+		return nil, database.TierAnonymous, err
+	}
+	u, err := api.staticDB.UserBySub(ctx, g.Sub)
+	if err != nil {
+		return nil, database.TierAnonymous, errors.Compose(err, ErrInvalidGrant)
+	}
+	if u.Deleted() {
+		return nil, database.TierAnonymous, errors.Compose(database.ErrUserNotFound, ErrInvalidGrant)
+	}
+	if u.Suspended {
+		return nil, database.TierAnonymous, errors.Compose(ErrAccountSuspended, ErrInvalidGrant)
+	}
+	err = verifySkylinkGrant(g, payload, sig, u.GrantSecret, skylink)
+	if err != nil {
+		return nil, database.TierAnonymous, err
+	}
+	// The user's tier might have changed since they issued the grant. We
+	// never give more than the user currently has.
+	tier := g.Tier
+	if ut := u.EffectiveTier(); ut < tier {
+		tier = ut
+	}
+	return u, tier, nil
+}
+
+// userUploadsSharePOST issues a time-limited grant which allows anyone who
+// holds it to download the given skylink with the user's tier limits.
+func (api *API) userUploadsSharePOST(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sl := ps.ByName("skylink")
+	if !database.ValidSkylink(sl) {
+		api.WriteError(w, database.ErrInvalidSkylink, http.StatusBadRequest)
+		return
+	}
+	var body UserUploadsSharePOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil && !errors.Contains(err, io.EOF) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ttl := grantTTLDefault
+	if body.TTL != 0 {
+		ttl = time.Duration(body.TTL) * time.Second
+	}
+	if ttl <= 0 || ttl > grantTTLMax {
+		api.WriteError(w, errors.New("ttl must be between 1 second and 7 days"), http.StatusBadRequest)
+		return
+	}
+	skylink, err := api.staticDB.Skylink(req.Context(), sl)
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	pinned, err := api.staticDB.UserHasPinned(req.Context(), *u, *skylink)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !pinned {
+		api.WriteError(w, errors.New("upload not found"), http.StatusNotFound)
+		return
+	}
+	// Users who have never shared anything don't have a grant secret, yet.
+	if u.GrantSecret == "" {
+		err = api.staticDB.UserRotateGrantSecret(req.Context(), u)
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	expires := time.Now().UTC().Add(ttl).Truncate(time.Second)
+	grant, err := newSkylinkGrant(u, sl, expires)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, UserUploadsShareResponse{
+		Grant:     grant,
+		ExpiresAt: expires,
+	})
+}
+
+// userGrantsRotatePOST rotates the user's grant secret, which invalidates all
+// skylink access grants they have issued so far.
+func (api *API) userGrantsRotatePOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	err := api.staticDB.UserRotateGrantSecret(req.Context(), u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// userFromRequestOrGrant returns the user making the request. When the request
+// carries no other credentials, it also accepts a skylink access grant passed
+// in the `grant` query parameter. This allows us to attribute the bandwidth
+// used via a grant to the user who issued it. It returns a nil user and no
+// error when the request is anonymous. Only read-only API keys, suspended users
+// and invalid grants result in an error.
+func (api *API) userFromRequestOrGrant(req *http.Request, skylink string) (*database.User, error) {
+	grant := req.URL.Query().Get("grant")
+	if grant != "" {
+		_, errToken := tokenFromRequest(req)
+		_, errAPIKey := apiKeyFromRequest(req)
+		if errToken != nil && errAPIKey != nil {
+			u, _, err := api.managedUserFromGrant(req.Context(), grant, skylink)
+			return u, err
+		}
+	}
+	u, _, err := api.userFromRequest(req, true)
+	if errors.Contains(err, ErrAPIKeyReadOnly) || errors.Contains(err, ErrAccountSuspended) {
+		return nil, err
+	}
+	return u, nil
+}
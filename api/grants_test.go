@@ -0,0 +1,85 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestSkylinkGrant ensures that skylink access grants are correctly signed and
+// verified.
+func TestSkylinkGrant(t *testing.T) {
+	u := &database.User{
+		Sub:         t.Name(),
+		Tier:        database.TierPremium5,
+		GrantSecret: "secret",
+	}
+	sl := "AQAh2vxStoSJ_M9tWcTgqebUWerCAbpMfn9xxa9E29UOuw"
+	otherSl := "AADDE7_5MJyl1DKyfbuQMY_XBOBC9bR7idiU6isp6LXxEw"
+
+	// verify is a helper which parses and verifies a grant token.
+	verify := func(token, secret, skylink string) error {
+		g, payload, sig, err := parseSkylinkGrant(token)
+		if err != nil {
+			return err
+		}
+		return verifySkylinkGrant(g, payload, sig, secret, skylink)
+	}
+
+	token, err := newSkylinkGrant(u, sl, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _, _, err := parseSkylinkGrant(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Sub != u.Sub || g.Skylink != sl || g.Tier != u.Tier {
+		t.Fatalf("Unexpected grant payload %+v", g)
+	}
+	// A valid grant.
+	if err = verify(token, u.GrantSecret, sl); err != nil {
+		t.Fatal(err)
+	}
+	// A different skylink.
+	if err = verify(token, u.GrantSecret, otherSl); !errors.Contains(err, ErrInvalidGrant) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidGrant, err)
+	}
+	// A rotated secret.
+	if err = verify(token, "rotated", sl); !errors.Contains(err, ErrInvalidGrant) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidGrant, err)
+	}
+	// An empty secret.
+	if err = verify(token, "", sl); !errors.Contains(err, ErrInvalidGrant) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidGrant, err)
+	}
+	// A tampered payload, e.g. a raised tier.
+	u2 := *u
+	u2.Tier = database.TierPremium80
+	u2.GrantSecret = "another secret"
+	token2, err := newSkylinkGrant(&u2, sl, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := token2[:strings.Index(token2, ".")] + token[strings.Index(token, "."):]
+	if err = verify(tampered, u.GrantSecret, sl); !errors.Contains(err, ErrInvalidGrant) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidGrant, err)
+	}
+	// Malformed tokens.
+	for _, tk := range []string{"", "abc", "a.b.c", "!!!.???"} {
+		if err = verify(tk, u.GrantSecret, sl); !errors.Contains(err, ErrInvalidGrant) {
+			t.Fatalf("Expected %v for token '%s', got %v", ErrInvalidGrant, tk, err)
+		}
+	}
+	// An expired grant.
+	expired, err := newSkylinkGrant(u, sl, time.Now().UTC().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(expired, u.GrantSecret, sl); !errors.Contains(err, ErrGrantExpired) {
+		t.Fatalf("Expected %v, got %v", ErrGrantExpired, err)
+	}
+}
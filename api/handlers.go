@@ -5,19 +5,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
-	"net/mail"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/email"
 	"github.com/SkynetLabs/skynet-accounts/hash"
 	"github.com/SkynetLabs/skynet-accounts/jwt"
 	"github.com/SkynetLabs/skynet-accounts/lib"
 	"github.com/SkynetLabs/skynet-accounts/metafetcher"
+	"github.com/SkynetLabs/skynet-accounts/metrics"
 	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/julienschmidt/httprouter"
@@ -28,26 +32,104 @@ import (
 )
 
 const (
-	// DefaultPageSizeSmall is the number of records we return when none is
-	// given and the objects are relatively large.
-	DefaultPageSizeSmall = 10
 	// DefaultPageSizeLarge is the number of records we return when none is
 	// given and the objects are relatively small.
 	DefaultPageSizeLarge = 1000
+	// MaxPageSize is the largest number of records a caller can request in a
+	// single page.
+	MaxPageSize = 1000
 	// LimitBodySizeSmall defines a size limit for requests that we don't expect
 	// to contain a lot of data.
 	LimitBodySizeSmall = 4 * skynet.KiB
 	// LimitBodySizeLarge defines a size limit for requests that we expect to
 	// contain a lot of data.
 	LimitBodySizeLarge = 4 * skynet.MiB
+
+	// MaxBulkDeleteSkylinks is the maximum number of skylinks a user can
+	// unpin with a single bulk delete request.
+	MaxBulkDeleteSkylinks = 1000
+
+	// MaxUserNameLength is the maximum number of characters in a user's
+	// display name.
+	MaxUserNameLength = 64
+
+	// DefaultStatsHistoryMonths is the number of months of usage history we
+	// return when none is given.
+	DefaultStatsHistoryMonths = 6
+
+	// userSaveRetriesInteractive is the number of times we retry saving a
+	// user who was modified concurrently while we handle a user's request.
+	userSaveRetriesInteractive = 1
+	// userSaveRetriesBackground is the number of times we retry saving a
+	// user who was modified concurrently in background tasks, which don't
+	// keep anyone waiting.
+	userSaveRetriesBackground = 3
+
+	// RequestIDHeader holds the name of the header in which callers can pass
+	// a unique ID of their request. We use it for detecting retried requests.
+	RequestIDHeader = "X-Request-ID"
 )
 
 var (
+	// DefaultPageSizeSmall is the number of records we return when none is
+	// given and the objects are relatively large. This value is configurable
+	// via the ACCOUNTS_DEFAULT_PAGE_SIZE environment variable.
+	DefaultPageSizeSmall = 10
+
 	// ErrInvalidCredentials is a generic user-facing error, used when the login
 	// flow fails. This error is sent instead of whatever internal error we had
 	// before in order to prevent an attacker from listing our users.
 	ErrInvalidCredentials = errors.New("invalid credentials")
 
+	// LoginLockoutThreshold is the number of consecutive failed logins with a
+	// password after which we lock the user's account. Zero disables the
+	// lockout. This value is configurable via the
+	// ACCOUNTS_LOGIN_LOCKOUT_THRESHOLD environment variable.
+	LoginLockoutThreshold = 0
+	// LoginLockoutDuration defines how long a locked account stays locked.
+	// This value is configurable via the ACCOUNTS_LOGIN_LOCKOUT_MINUTES
+	// environment variable.
+	LoginLockoutDuration = 15 * time.Minute
+
+	// AvailabilityCheckEnabled defines whether we serve
+	// GET /register/availability. This value is configurable via the
+	// ACCOUNTS_AVAILABILITY_CHECK_ENABLED environment variable.
+	AvailabilityCheckEnabled = true
+	// ErrAvailabilityCheckDisabled is returned when the caller checks the
+	// availability of an email or pubkey while we don't allow that.
+	ErrAvailabilityCheckDisabled = errors.New("availability checks are disabled")
+
+	// TrackRequireValidIP defines whether we reject tracked uploads with a
+	// missing or invalid `ip` parameter. When it's false we track them without
+	// an IP. This value is configurable via the
+	// ACCOUNTS_TRACK_REQUIRE_VALID_IP environment variable.
+	TrackRequireValidIP = false
+	// ErrInvalidTrackIP is returned when we require a valid `ip` parameter
+	// and the tracked upload doesn't have one.
+	ErrInvalidTrackIP = errors.New("missing or invalid parameter 'ip'")
+
+	// StorageQuotaTolerancePercent defines by how many percent of their
+	// storage quota users can exceed it before we refuse to track their
+	// uploads. Users who exceed their quota by less than that only get their
+	// QuotaExceeded flag set. This value is configurable via the
+	// ACCOUNTS_STORAGE_QUOTA_TOLERANCE_PERCENT environment variable.
+	StorageQuotaTolerancePercent int64 = 10
+	// UnknownSkylinkSizeEstimate is the number of bytes we count towards the
+	// user's storage for each upload whose size we don't know yet. We
+	// correct the storage usage counter once the metafetcher learns the
+	// actual size.
+	UnknownSkylinkSizeEstimate = build.Select(
+		build.Var{
+			Dev:      int64(64 * skynet.MiB),
+			Testing:  int64(skynet.MiB),
+			Standard: int64(64 * skynet.MiB),
+		},
+	).(int64)
+
+	// trackIPWarnInterval defines how often we warn about tracked uploads
+	// without a valid IP, so a misconfigured Nginx doesn't flood the logs.
+	trackIPWarnInterval = time.Minute
+
 	// MyskyAllowlist contains skylinks we need to make available in order for
 	// users to be able to use MySky on all portals, including ones that require
 	// user authentication.
@@ -64,6 +146,23 @@ type (
 	ChallengePublic struct {
 		// Challenge is a hex-encoded representation of the []byte challenge.
 		Challenge string `bson:"challenge" json:"challenge"`
+		// ExpiresAt is the time after which we no longer accept responses
+		// to this challenge.
+		ExpiresAt time.Time `bson:"-" json:"expiresAt"`
+		// TTLSeconds is the number of seconds the caller has to respond to
+		// this challenge.
+		TTLSeconds int `bson:"-" json:"ttlSeconds"`
+		// RetryAfter is the number of seconds after which the caller can get
+		// a new challenge. It's only set when we return a challenge we have
+		// already issued because the pubkey has too many outstanding ones.
+		RetryAfter int `bson:"-" json:"retryAfter,omitempty"`
+	}
+	// UserStatsGET is the response of GET /user/stats when the caller asks
+	// for the top skylinks of the current period.
+	UserStatsGET struct {
+		*database.UserStats
+		TopUploads   []database.UserStatsTopUpload   `json:"topUploads"`
+		TopDownloads []database.UserStatsTopDownload `json:"topDownloads"`
 	}
 	// DownloadsGET is the response of GET /user/downloads
 	DownloadsGET struct {
@@ -72,6 +171,38 @@ type (
 		PageSize int                         `json:"pageSize"`
 		Count    int                         `json:"count"`
 	}
+	// DownloadsDELETE is the response of DELETE /user/downloads
+	DownloadsDELETE struct {
+		Deleted int64 `json:"deleted"`
+	}
+	// RegisterAvailabilityGET is the response of GET /register/availability.
+	// Each flag is only set when the caller asked about the respective
+	// identity.
+	RegisterAvailabilityGET struct {
+		EmailAvailable  *bool `json:"emailAvailable,omitempty"`
+		PubKeyAvailable *bool `json:"pubKeyAvailable,omitempty"`
+	}
+	// RegistryReadsGET is the response of GET /user/registry/reads
+	RegistryReadsGET struct {
+		Items    []database.RegistryRead `json:"items"`
+		Offset   int                     `json:"offset"`
+		PageSize int                     `json:"pageSize"`
+		Count    int                     `json:"count"`
+	}
+	// RegistryWritesGET is the response of GET /user/registry/writes
+	RegistryWritesGET struct {
+		Items    []database.RegistryWrite `json:"items"`
+		Offset   int                      `json:"offset"`
+		PageSize int                      `json:"pageSize"`
+		Count    int                      `json:"count"`
+	}
+	// DownloadsSummaryGET is the response of GET /user/downloads?groupBy=skylink
+	DownloadsSummaryGET struct {
+		Items    []database.DownloadSummary `json:"items"`
+		Offset   int                        `json:"offset"`
+		PageSize int                        `json:"pageSize"`
+		Count    int                        `json:"count"`
+	}
 	// HealthGET is the response type of GET /health.
 	// Primary field is only populated on error.
 	HealthGET struct {
@@ -92,6 +223,28 @@ type (
 	// This is the response of GET /limits
 	LimitsGET struct {
 		UserLimits []TierLimitsPublic `json:"userLimits"`
+		// DefaultPageSize is the number of records paginated endpoints
+		// return when the caller doesn't specify a page size.
+		DefaultPageSize int `json:"defaultPageSize"`
+		// MaxPageSize is the largest page size paginated endpoints accept.
+		MaxPageSize int `json:"maxPageSize"`
+		// AnonymousHourlyUploadLimit is the number of anonymous uploads we
+		// track per IP per hour. Zero means no limit.
+		AnonymousHourlyUploadLimit int `json:"anonymousHourlyUploadLimit"`
+		// AnonymousHourlyDownloadLimit is the number of anonymous downloads
+		// we track per IP per hour. Zero means no limit.
+		AnonymousHourlyDownloadLimit int `json:"anonymousHourlyDownloadLimit"`
+		// Payments tells the dashboard whether it can offer paid tiers.
+		Payments PaymentsGET `json:"payments"`
+	}
+	// PaymentsGET describes the payment processor of the portal.
+	PaymentsGET struct {
+		Enabled bool `json:"enabled"`
+		// Provider is the payment processor we use. It's only set when
+		// payments are enabled.
+		Provider string `json:"provider,omitempty"`
+		// TestMode is true when we use the processor's test environment.
+		TestMode bool `json:"testMode"`
 	}
 	// TierLimitsPublic is a DTO specifically designed to inform the public
 	// about the different limits of each account tier.
@@ -110,13 +263,46 @@ type (
 		Offset   int                       `json:"offset"`
 		PageSize int                       `json:"pageSize"`
 		Count    int64                     `json:"count"`
+		HasMore  bool                      `json:"hasMore"`
+	}
+	// UserPubKeyGET describes one of the user's pubkeys. Timestamps are null
+	// when we don't know them, e.g. for keys added before we started keeping
+	// track of them.
+	UserPubKeyGET struct {
+		Key        string     `json:"key"`
+		AddedAt    *time.Time `json:"addedAt"`
+		LastUsedAt *time.Time `json:"lastUsedAt"`
+	}
+	// UserUploadsBulkDeleteResponse is the response of a bulk uploads
+	// delete. Invalid holds the skylinks which failed validation and NotFound
+	// holds the valid skylinks which the user has no pinned uploads of.
+	UserUploadsBulkDeleteResponse struct {
+		Unpinned int64    `json:"unpinned"`
+		Invalid  []string `json:"invalid"`
+		NotFound []string `json:"notFound"`
+	}
+	// UserFeaturesGET is the response of GET /user/features. It tells the
+	// caller which actions are currently available to the user.
+	UserFeaturesGET struct {
+		CanAddPubKey bool `json:"canAddPubKey"`
 	}
 	// UserGET defines a representation of the User struct returned by all
 	// handlers. This allows us to tweak the fields of the struct before
 	// returning it.
 	UserGET struct {
 		database.User
+		// EmailConfirmed is false for users without an email.
 		EmailConfirmed bool `json:"emailConfirmed"`
+		// HasEmail is false for users who registered with only a pubkey and
+		// haven't added an email yet.
+		HasEmail bool `json:"hasEmail"`
+		// Subscription is nil when the user doesn't have a subscription.
+		Subscription *UserSubscriptionGET `json:"subscription"`
+		// OrgID is empty for users who don't belong to an organization.
+		OrgID string `json:"orgId,omitempty"`
+		// Restrictions lists the gates which currently prevent the user from
+		// using some features, e.g. RestrictionAPIKeysRequireConfirmedEmail.
+		Restrictions []string `json:"restrictions"`
 	}
 	// UserLimitsGET is response of GET /user/limits
 	// The returned speeds might be in bits or bytes per second, depending on
@@ -131,6 +317,25 @@ type (
 		MaxNumberUploads  int    `json:"-"`
 		RegistryDelay     int    `json:"registry"` // ms delay
 		Storage           int64  `json:"-"`
+		// QuotaExceeded tells the caller that the speeds above are brought
+		// down to anonymous levels because the user exceeds their quota.
+		QuotaExceeded bool `json:"quotaExceeded"`
+		// Quota describes the usage which exceeds the quota. We only report
+		// it to the users themselves and only while they exceed their quota.
+		Quota *database.QuotaUsage `json:"quota,omitempty"`
+	}
+
+	// UserLimitsPubKeyGET is the response of GET /user/pubkeys/:pubKey/limits.
+	// It only describes the tier of the pubkey's owner, so it doesn't reveal
+	// anything about their usage. The returned speeds might be in bits or
+	// bytes per second, depending on the client's request.
+	UserLimitsPubKeyGET struct {
+		TierID            int    `json:"tierID"`
+		TierName          string `json:"tierName"`
+		UploadBandwidth   int    `json:"upload"`        // bits or bytes per second
+		DownloadBandwidth int    `json:"download"`      // bits or bytes per second
+		MaxUploadSize     int64  `json:"maxUploadSize"` // the max size of a single upload in bytes
+		RegistryDelay     int    `json:"registry"`      // ms delay
 	}
 
 	// accountRecoveryPOST defines the payload we expect when a user is trying
@@ -141,12 +346,26 @@ type (
 		ConfirmPassword string `json:"confirmPassword"`
 	}
 
+	// accountUndeletePOST defines the payload we expect when a user is trying
+	// to restore their deleted account.
+	accountUndeletePOST struct {
+		Token string `json:"token"`
+	}
+
 	// credentialsPOST defines the standard credentials package we expect.
 	credentialsPOST struct {
 		Email    types.Email `json:"email"`
 		Password string      `json:"password"`
 	}
 
+	// captchaCredentialsPOST defines the credentials we expect when a user
+	// registers or requests an account recovery. The captcha token is only
+	// required when captcha verification is enabled.
+	captchaCredentialsPOST struct {
+		credentialsPOST
+		CaptchaToken string `json:"captchaToken"`
+	}
+
 	// loginTTL defines the lifetime of the JWT issued on login.
 	loginTTL struct {
 		TTL int `json:"TTL"`
@@ -158,6 +377,12 @@ type (
 		Email    types.Email `json:"email,omitempty"`
 		Password string      `json:"password,omitempty"`
 		StripeID string      `json:"stripeCustomerId,omitempty"`
+		// Name is a pointer, so the user can clear their name by sending an
+		// empty string.
+		Name *string `json:"name,omitempty"`
+		// Locale is a pointer, so the user can go back to the default locale
+		// by sending an empty string.
+		Locale *string `json:"locale,omitempty"`
 	}
 )
 
@@ -200,9 +425,28 @@ func (api *API) healthGET(_ *database.User, w http.ResponseWriter, req *http.Req
 
 // limitsGET returns the speed limits of this portal.
 func (api *API) limitsGET(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	if api.staticDeps.Disrupt("DependencyLimitsDelay") {
+		time.Sleep(500 * time.Millisecond)
+	}
 	resp := LimitsGET{
-		UserLimits: api.staticTierLimits,
+		UserLimits:      make([]TierLimitsPublic, database.TierMaxReserved),
+		DefaultPageSize: DefaultPageSizeSmall,
+		MaxPageSize:     MaxPageSize,
+
+		AnonymousHourlyUploadLimit:   AnonymousHourlyUploadLimit,
+		AnonymousHourlyDownloadLimit: AnonymousHourlyDownloadLimit,
+	}
+	if api.paymentsEnabled() {
+		resp.Payments = PaymentsGET{
+			Enabled:  true,
+			Provider: string(PromoterStripe),
+			TestMode: StripeTestMode(),
+		}
+	}
+	for tier := range resp.UserLimits {
+		resp.UserLimits[tier] = tierLimitsPublicFromTier(database.LimitsForTier(tier))
 	}
+	setCacheControl(w, limitsMaxAge)
 	api.WriteJSON(w, resp)
 }
 
@@ -228,32 +472,24 @@ func (api *API) loginGET(_ *database.User, w http.ResponseWriter, req *http.Requ
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.WriteJSON(w, ChallengePublic{ch.Challenge})
+	api.WriteJSON(w, challengePublicFromChallenge(ch))
 }
 
 // loginPOST starts a user session by issuing a cookie
 func (api *API) loginPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	// Get the body, we might need to use it several times.
-	body, err := io.ReadAll(io.LimitReader(req.Body, LimitBodySizeSmall))
+	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to read request body"), http.StatusBadRequest)
 		return
 	}
 
 	// Use custom JWT TTL if defined in the request.
-	var jwtTTL loginTTL
-	err = json.Unmarshal(body, &jwtTTL)
+	jwtTTL, err := parseLoginTTL(body)
 	if err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	if jwtTTL.TTL > jwt.TTL {
-		api.WriteError(w, fmt.Errorf("jwt ttl value is too high. it cannot exceed %d", jwt.TTL), http.StatusBadRequest)
-		return
-	}
-	if jwtTTL.TTL <= 0 {
-		jwtTTL.TTL = jwt.TTL
-	}
 
 	// Since we don't want to have separate endpoints for logging in with
 	// credentials and token, we'll do both here.
@@ -264,7 +500,7 @@ func (api *API) loginPOST(_ *database.User, w http.ResponseWriter, req *http.Req
 	var payload credentialsPOST
 	err = json.Unmarshal(body, &payload)
 	if err == nil && payload.Email != "" && payload.Password != "" {
-		api.loginPOSTCredentials(w, req, payload.Email, payload.Password, jwtTTL.TTL)
+		api.loginPOSTCredentials(w, req, payload.Email, payload.Password, jwtTTL)
 		return
 	}
 
@@ -272,7 +508,7 @@ func (api *API) loginPOST(_ *database.User, w http.ResponseWriter, req *http.Req
 	var chr database.ChallengeResponse
 	err = chr.LoadFromBytes(body)
 	if err == nil {
-		api.loginPOSTChallengeResponse(w, req, chr, jwtTTL.TTL)
+		api.loginPOSTChallengeResponse(w, req, chr, jwtTTL)
 		return
 	}
 
@@ -281,38 +517,122 @@ func (api *API) loginPOST(_ *database.User, w http.ResponseWriter, req *http.Req
 	api.loginPOSTToken(w, req)
 }
 
+// parseLoginTTL returns the lifetime of the JWT the caller wants us to issue,
+// as passed in the `ttl` field of the request body. It defaults to jwt.TTL,
+// which is also the maximum.
+func parseLoginTTL(body []byte) (int, error) {
+	var jwtTTL loginTTL
+	err := json.Unmarshal(body, &jwtTTL)
+	if err != nil {
+		return 0, err
+	}
+	if jwtTTL.TTL > jwt.TTL {
+		return 0, fmt.Errorf("jwt ttl value is too high. it cannot exceed %d", jwt.TTL)
+	}
+	if jwtTTL.TTL <= 0 {
+		return jwt.TTL, nil
+	}
+	return jwtTTL.TTL, nil
+}
+
 // loginPOSTChallengeResponse is a helper that handles logins with a challenge.
 func (api *API) loginPOSTChallengeResponse(w http.ResponseWriter, req *http.Request, chr database.ChallengeResponse, jwtTTL int) {
 	ctx := req.Context()
 	pk, _, err := api.staticDB.ValidateChallengeResponse(ctx, chr, database.ChallengeTypeLogin)
 	if err != nil {
-		api.WriteError(w, errors.AddContext(err, "failed to validate challenge response"), http.StatusUnauthorized)
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.writeChallengeResponseError(w, err, http.StatusUnauthorized)
 		return
 	}
 	u, err := api.staticDB.UserByPubKey(ctx, pk)
-	if err != nil {
+	if err != nil || u.Deleted() {
+		metrics.Logins.Inc(metrics.LoginFailure)
 		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
 		return
 	}
-	api.loginUser(w, u, jwtTTL, false)
+	if u.Suspended {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrAccountSuspended, http.StatusForbidden)
+		return
+	}
+	api.loginUser(req, w, u, jwtTTL, false, true)
 }
 
 // loginPOSTCredentials is a helper that handles logins with credentials.
 func (api *API) loginPOSTCredentials(w http.ResponseWriter, req *http.Request, email types.Email, password string, jwtTTL int) {
+	// Normalize the email, so the user can log in regardless of how they
+	// capitalize it.
+	email, err := types.NormalizeEmail(email.String())
+	if err != nil {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
 	// Fetch the user with that email, if they exist.
 	u, err := api.staticDB.UserByEmail(req.Context(), email)
 	if err != nil {
-		api.staticLogger.Debugf("Error fetching a user with email '%s': %v\n", email, err)
+		api.loggerFromContext(req.Context()).Debugf("Error fetching a user with email '%s': %v\n", email, err)
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
+	// Deleted users can't log in until they restore their account.
+	if u.Deleted() {
+		metrics.Logins.Inc(metrics.LoginFailure)
 		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
 		return
 	}
+	// Locked users can't log in with a password, even a correct one, until
+	// the lockout expires.
+	if u.Locked() {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrAccountLocked, http.StatusLocked)
+		return
+	}
 	// Check if the password matches.
 	err = hash.Compare(password, []byte(u.PasswordHash))
 	if err != nil {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.managedLoginFailed(req.Context(), u)
 		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
 		return
 	}
-	api.loginUser(w, u, jwtTTL, false)
+	// We only tell suspended users about their suspension once they've
+	// proven they own the account.
+	if u.Suspended {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrAccountSuspended, http.StatusForbidden)
+		return
+	}
+	if err = api.staticDB.UserLoginSucceeded(req.Context(), u); err != nil {
+		api.loggerFromContext(req.Context()).Warnf("Failed to reset the failed logins of user %s: %v", u.Sub, err)
+	}
+	// Users with 2FA enabled need to provide a TOTP code before they get a
+	// session.
+	if u.TwoFactorEnabled {
+		api.writeTwoFactorRequired(w, u, jwtTTL)
+		return
+	}
+	api.loginUser(req, w, u, jwtTTL, false, true)
+}
+
+// managedLoginFailed records a failed login with a password and notifies the
+// user if this failure locked their account. Failed logins abort the
+// request's transaction, so we queue the email outside of it.
+func (api *API) managedLoginFailed(ctx context.Context, u *database.User) {
+	locked, err := api.staticDB.UserLoginFailed(ctx, u, LoginLockoutThreshold, LoginLockoutDuration)
+	if err != nil {
+		api.loggerFromContext(ctx).Warnf("Failed to record a failed login of user %s: %v", u.Sub, err)
+		return
+	}
+	if !locked {
+		return
+	}
+	api.loggerFromContext(ctx).Infof("Locked user %s until %v because of too many failed logins.", u.Sub, u.LockedUntil)
+	err = api.staticMailer.SendAccountLockedEmail(database.WithoutTransaction(ctx), u.Email, u.LockedUntil, u.Locale)
+	if err != nil {
+		api.loggerFromContext(ctx).Warnf("Failed to notify user %s of their locked account: %v", u.Sub, err)
+	}
 }
 
 // loginPOSTToken is a helper that handles logins via a token attached to the
@@ -322,13 +642,43 @@ func (api *API) loginPOSTToken(w http.ResponseWriter, req *http.Request) {
 	// is and until when their current session is going to stay valid.
 	token, err := tokenFromRequest(req)
 	if err != nil {
-		api.staticLogger.Debugln("Error fetching token from request:", err)
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.loggerFromContext(req.Context()).Debugln("Error fetching token from request:", err)
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	// Revoked sessions can't be exchanged for a cookie.
+	revoked, err := api.managedSessionRevoked(req.Context(), token.JwtID())
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to check the session's status"), http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrSessionRevoked, http.StatusUnauthorized)
+		return
+	}
+	// Make sure the token's owner hasn't deleted their account.
+	sub, _, _, err := jwt.TokenFields(token)
+	if err != nil {
+		metrics.Logins.Inc(metrics.LoginFailure)
 		api.WriteError(w, err, http.StatusUnauthorized)
 		return
 	}
+	u, err := api.staticDB.UserBySub(req.Context(), sub)
+	if err == nil && u.Deleted() {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, database.ErrUserNotFound, http.StatusUnauthorized)
+		return
+	}
+	if err == nil && u.Suspended {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrAccountSuspended, http.StatusForbidden)
+		return
+	}
 	tokenBytes, err := jwt.TokenSerialize(token)
 	if err != nil {
-		api.staticLogger.Debugln("Error serializing token:", err)
+		api.loggerFromContext(req.Context()).Debugln("Error serializing token:", err)
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
@@ -337,35 +687,88 @@ func (api *API) loginPOSTToken(w http.ResponseWriter, req *http.Request) {
 	// requesting their credentials or accessing the DB.
 	err = writeCookie(w, string(tokenBytes), token.Expiration().UTC().Unix())
 	if err != nil {
-		api.staticLogger.Debugln("Error writing cookie:", err)
+		api.loggerFromContext(req.Context()).Debugln("Error writing cookie:", err)
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	// A token passed via the Authorization header is exchanged for a cookie,
+	// which counts as a login. A token coming from the cookie is just a
+	// refresh, so we don't record it.
+	if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer") {
+		metrics.Logins.Inc(metrics.LoginSuccess)
+		api.recordTokenLogin(req.Context(), token)
+	}
 	w.Header().Set("Skynet-Token", string(tokenBytes))
 	api.WriteSuccess(w)
 }
 
+// recordTokenLogin updates the last login time of the user who owns the
+// given token. Errors are logged but not returned because they should not
+// prevent the user from logging in.
+func (api *API) recordTokenLogin(ctx context.Context, token jwt2.Token) {
+	sub, _, _, err := jwt.TokenFields(token)
+	if err != nil {
+		api.loggerFromContext(ctx).Debugln(errors.AddContext(err, "failed to decode token"))
+		return
+	}
+	u, err := api.staticDB.UserBySub(ctx, sub)
+	if err != nil {
+		api.loggerFromContext(ctx).Debugln(errors.AddContext(err, "failed to fetch user"))
+		return
+	}
+	err = api.staticDB.UserSetLastLogin(ctx, u)
+	if err != nil {
+		api.loggerFromContext(ctx).Debugln(errors.AddContext(err, "failed to record the user's last login"))
+	}
+}
+
 // loginUser is a helper method that generates a JWT for the user and writes the
-// login cookie.
-func (api *API) loginUser(w http.ResponseWriter, u *database.User, jwtTTL int, returnUser bool) {
+// login cookie. Each JWT gets its own session record, which the user can
+// revoke. When recordLogin is set the user's last login time is updated.
+// This should only happen when the user actually authenticates, e.g. with
+// credentials or a challenge response, and not when we merely issue them a new
+// cookie.
+func (api *API) loginUser(req *http.Request, w http.ResponseWriter, u *database.User, jwtTTL int, returnUser, recordLogin bool) {
+	ctx := req.Context()
+	if recordLogin {
+		metrics.Logins.Inc(metrics.LoginSuccess)
+		api.auditLog(req, u.ID, database.AuditActionLogin, nil)
+		err := api.staticDB.UserSetLastLogin(ctx, u)
+		if err != nil {
+			api.loggerFromContext(req.Context()).Debugln(errors.AddContext(err, "failed to record the user's last login"))
+		}
+	}
 	// Generate a JWT.
-	tk, err := jwt.TokenForUser(u.Email, u.Sub, jwtTTL)
+	tk, err := jwt.TokenForUser(u.Email, u.Sub, u.Name, jwtTTL)
 	if err != nil {
-		api.staticLogger.Debugf("Error creating a token for user: %v", err)
+		api.loggerFromContext(req.Context()).Debugf("Error creating a token for user: %v", err)
 		err = errors.AddContext(err, "failed to create a token for user")
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	// Record the session, so the user can see and revoke it.
+	err = api.staticDB.SessionCreate(ctx, &database.Session{
+		JTI:       tk.JwtID(),
+		Sub:       u.Sub,
+		ExpiresAt: tk.Expiration().UTC(),
+		UserAgent: req.UserAgent(),
+		IP:        clientIP(req),
+	})
+	if err != nil {
+		api.loggerFromContext(req.Context()).Debugln("Failed to record session:", err)
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
 	tkBytes, err := jwt.TokenSerialize(tk)
 	if err != nil {
-		api.staticLogger.Debugln("Failed to serialize token:", err)
+		api.loggerFromContext(req.Context()).Debugln("Failed to serialize token:", err)
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
 	// Write the JWT to an encrypted cookie.
 	err = writeCookie(w, string(tkBytes), tk.Expiration().UTC().Unix())
 	if err != nil {
-		api.staticLogger.Debugln("Error writing cookie:", err)
+		api.loggerFromContext(req.Context()).Debugln("Error writing cookie:", err)
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
@@ -378,7 +781,7 @@ func (api *API) loginUser(w http.ResponseWriter, u *database.User, jwtTTL int, r
 }
 
 // logoutPOST ends a user session by removing a cookie
-func (api *API) logoutPOST(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+func (api *API) logoutPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	// Remove the user's cookie. We achieve that by overwriting the cookie with
 	// a new one, which has its expiration time in the past. The browser will
 	// remove it for us.
@@ -388,23 +791,14 @@ func (api *API) logoutPOST(_ *database.User, w http.ResponseWriter, _ *http.Requ
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.auditLog(req, u.ID, database.AuditActionLogout, nil)
 	api.WriteSuccess(w)
 }
 
 // registerGET generates a registration challenge for the caller.
 func (api *API) registerGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	// Check if the registrations are open.
-	val, err := api.staticDB.ReadConfigValue(req.Context(), database.ConfValRegistrationsDisabled)
-	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
-		api.WriteError(w, errors.AddContext(err, "failed to read from configuration"), http.StatusInternalServerError)
-		return
-	}
-	if val == database.ConfValTrue {
-		api.WriteError(w, errors.New("registrations are currently disabled"), http.StatusNotImplemented)
-		return
-	}
 	var pk database.PubKey
-	err = pk.LoadString(req.FormValue("pubKey"))
+	err := pk.LoadString(req.FormValue("pubKey"))
 	if err != nil {
 		api.WriteError(w, database.ErrInvalidPublicKey, http.StatusBadRequest)
 		return
@@ -420,23 +814,70 @@ func (api *API) registerGET(_ *database.User, w http.ResponseWriter, req *http.R
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.WriteJSON(w, ChallengePublic{ch.Challenge})
+	api.WriteJSON(w, challengePublicFromChallenge(ch))
 }
 
-// registerPOST registers a new user based on a challenge-response.
-func (api *API) registerPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+// registerAvailabilityGET tells the caller whether the given email and pubkey
+// are still available for registration. It doesn't reveal anything else about
+// the users they belong to.
+func (api *API) registerAvailabilityGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if !AvailabilityCheckEnabled {
+		api.WriteError(w, ErrAvailabilityCheckDisabled, http.StatusNotFound)
+		return
+	}
 	// Check if the registrations are open.
-	val, err := api.staticDB.ReadConfigValue(req.Context(), database.ConfValRegistrationsDisabled)
-	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
-		api.WriteError(w, errors.AddContext(err, "failed to read from configuration"), http.StatusInternalServerError)
+	enabled, err := api.registrationsEnabled(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		api.WriteError(w, ErrRegistrationsDisabled, http.StatusNotImplemented)
 		return
 	}
-	if val == database.ConfValTrue {
-		api.WriteError(w, errors.New("registrations are currently disabled"), http.StatusNotImplemented)
+	emailStr := req.FormValue("email")
+	pkStr := req.FormValue("pubKey")
+	if emailStr == "" && pkStr == "" {
+		api.WriteError(w, errors.New("at least one of email and pubKey is required"), http.StatusBadRequest)
 		return
 	}
+	var resp RegisterAvailabilityGET
+	if emailStr != "" {
+		email, err := types.NormalizeEmail(emailStr)
+		if err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		_, err = api.staticDB.UserByEmail(req.Context(), email)
+		if err != nil && !errors.Contains(err, database.ErrUserNotFound) {
+			api.WriteError(w, errors.AddContext(err, "failed to look up email"), http.StatusInternalServerError)
+			return
+		}
+		available := errors.Contains(err, database.ErrUserNotFound)
+		resp.EmailAvailable = &available
+	}
+	if pkStr != "" {
+		var pk database.PubKey
+		err = pk.LoadString(pkStr)
+		if err != nil {
+			api.WriteError(w, database.ErrInvalidPublicKey, http.StatusBadRequest)
+			return
+		}
+		_, err = api.staticDB.UserByPubKey(req.Context(), pk)
+		if err != nil && !errors.Contains(err, database.ErrUserNotFound) {
+			api.WriteError(w, errors.AddContext(err, "failed to look up pubkey"), http.StatusInternalServerError)
+			return
+		}
+		available := errors.Contains(err, database.ErrUserNotFound)
+		resp.PubKeyAvailable = &available
+	}
+	api.WriteJSON(w, resp)
+}
+
+// registerPOST registers a new user based on a challenge-response.
+func (api *API) registerPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	// Get the body, we might need to use it several times.
-	body, err := io.ReadAll(io.LimitReader(req.Body, LimitBodySizeSmall))
+	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "empty request body"), http.StatusBadRequest)
 		return
@@ -448,23 +889,48 @@ func (api *API) registerPOST(_ *database.User, w http.ResponseWriter, req *http.
 		api.WriteError(w, errors.AddContext(err, "missing or invalid challenge response"), http.StatusBadRequest)
 		return
 	}
+	// Use custom JWT TTL if defined in the request.
+	jwtTTL, err := parseLoginTTL(body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	// Parse the request's body.
-	var payload credentialsPOST
+	var payload captchaCredentialsPOST
 	err = json.Unmarshal(body, &payload)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
 		return
 	}
-	parsed, err := mail.ParseAddress(payload.Email.String())
-	if err != nil || payload.Email.String() != parsed.Address {
-		api.WriteError(w, errors.New("invalid email provided"), http.StatusBadRequest)
+	err = api.verifyCaptcha(req, payload.CaptchaToken)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	// The email is optional, users can register with only a pubkey and add
+	// an email later. Without an email they can't have a password.
+	if payload.Email != "" {
+		payload.Email, err = types.NormalizeEmail(payload.Email.String())
+		if err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	} else if payload.Password != "" {
+		api.WriteError(w, database.ErrPasswordWithoutEmail, http.StatusBadRequest)
 		return
 	}
-	// The password is optional and that's why we do not verify it.
+	// The password is optional but if it's given, it needs to be acceptable.
+	if payload.Password != "" {
+		err = lib.ValidatePassword(payload.Password, payload.Email.String())
+		if err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
 	ctx := req.Context()
 	pk, _, err := api.staticDB.ValidateChallengeResponse(ctx, chr, database.ChallengeTypeRegister)
 	if err != nil {
-		api.WriteError(w, errors.AddContext(err, "failed to validate challenge response"), http.StatusBadRequest)
+		api.writeChallengeResponseError(w, err, http.StatusBadRequest)
 		return
 	}
 	u, err := api.staticDB.UserCreatePK(ctx, payload.Email, payload.Password, "", pk, database.TierFree)
@@ -476,20 +942,49 @@ func (api *API) registerPOST(_ *database.User, w http.ResponseWriter, req *http.
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	err = api.staticMailer.SendAddressConfirmationEmail(ctx, u.Email, u.EmailConfirmationToken)
-	if err != nil {
-		api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
+	if u.Email != "" {
+		err = api.staticMailer.SendAddressConfirmationEmail(ctx, u.Email, u.EmailConfirmationToken, u.Locale)
+		if err != nil {
+			api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
+		}
 	}
-	api.loginUser(w, u, 0, true)
+	api.loginUser(req, w, u, jwtTTL, true, false)
 }
 
 // userGET returns information about an existing user and create it if it
-// doesn't exist.
-func (api *API) userGET(u *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	api.WriteJSON(w, UserGETFromUser(u))
+// doesn't exist. It also lists the restrictions which currently apply to the
+// user, so the dashboard can explain why some features are unavailable.
+//
+// Callers can pass `refresh=true` in order to sync the user's subscription
+// with Stripe before we respond. See managedRefreshSubscription for when we
+// ignore it.
+func (api *API) userGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if req.FormValue("refresh") == "true" {
+		u = api.managedRefreshSubscription(req.Context(), u)
+	}
+	ug := UserGETFromUser(u)
+	restricted, err := api.managedAPIKeysRestricted(req.Context(), u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if restricted {
+		ug.Restrictions = append(ug.Restrictions, RestrictionAPIKeysRequireConfirmedEmail)
+	}
+	api.WriteJSONWithETag(w, req, ug)
 }
 
-// userLimitsGET returns the speed limits which apply to this user.
+// userFeaturesGET returns the set of actions currently available to the user.
+func (api *API) userFeaturesGET(u *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	api.WriteJSON(w, UserFeaturesGET{
+		CanAddPubKey: u.CanAddPubKey(),
+	})
+}
+
+// userLimitsGET returns the speed limits which apply to this user. The
+// response carries an ETag, so callers who poll this endpoint get a 304 when
+// their limits haven't changed. The ETag is derived from the response, which
+// we build from the cache, so we don't touch the DB for cached users.
 //
 // NOTE: This handler needs to use the noAuth middleware in order to be able to
 // optimise its calls to the DB and the use of caching.
@@ -498,6 +993,13 @@ func (api *API) userLimitsGET(_ *database.User, w http.ResponseWriter, req *http
 	// to be presented in bytes per second. The default behaviour is to present
 	// them in bits per second.
 	inBytes := strings.EqualFold(req.FormValue("unit"), "byte")
+	api.WriteJSONWithETag(w, req, api.managedUserLimits(req, inBytes))
+}
+
+// managedUserLimits returns the limits of the user who made the request,
+// identified by their API key or token. Callers we can't identify get the
+// anonymous limits.
+func (api *API) managedUserLimits(req *http.Request, inBytes bool) *UserLimitsGET {
 	respAnon := userLimitsGetFromTier("", database.TierAnonymous, false, inBytes)
 	// First check for an API key.
 	ak, err := apiKeyFromRequest(req)
@@ -506,44 +1008,51 @@ func (api *API) userLimitsGET(_ *database.User, w http.ResponseWriter, req *http
 		ce, ok := api.staticUserTierCache.Get(ak.String())
 		if ok {
 			api.staticLogger.Traceln("Fetching user limits from cache by API key.")
-			api.WriteJSON(w, userLimitsGetFromTier(ce.Sub, ce.Tier, ce.QuotaExceeded, inBytes))
-			return
+			ce = api.managedRefreshQuotaExceeded(req.Context(), ak.String(), ce)
+			return userLimitsGetFromTier(ce.Sub, ce.EffectiveTier(), ce.QuotaExceeded, inBytes).withQuota(ce.QuotaUsage)
 		}
 		// Get the API key.
 		akr, err := api.staticDB.APIKeyByKey(req.Context(), ak.String())
 		if err != nil {
 			api.staticLogger.Trace("API key doesn't exist in the database.")
-			api.WriteJSON(w, respAnon)
-			return
+			return respAnon
 		}
 		if akr.Public {
 			api.staticLogger.Trace("API key is public, cannot be used for general requests")
-			api.WriteJSON(w, respAnon)
-			return
+			return respAnon
 		}
 		// Get the owner of this API key from the database.
 		u, err := api.staticDB.UserByID(req.Context(), akr.UserID)
 		if err != nil {
 			api.staticLogger.Traceln("Error while fetching user by API key:", err)
-			api.WriteJSON(w, respAnon)
-			return
+			return respAnon
+		}
+		if u.Deleted() || u.Suspended {
+			api.staticLogger.Trace("API key belongs to a deleted or suspended user.")
+			return respAnon
 		}
 		// Cache the user under the API key they used.
-		api.staticUserTierCache.Set(ak.String(), u)
-		api.WriteJSON(w, userLimitsGetFromTier(u.Sub, u.Tier, u.QuotaExceeded, inBytes))
-		return
+		api.staticUserTierCache.Set(ak.String(), u, apiKeyCacheTTL(akr))
+		return userLimitsGetFromTier(u.Sub, u.EffectiveTier(), u.QuotaExceeded, inBytes).withQuota(u.QuotaUsage)
 	}
 	// Next check for a token.
 	token, err := tokenFromRequest(req)
 	if err != nil {
-		api.WriteJSON(w, respAnon)
-		return
+		return respAnon
+	}
+	revoked, err := api.managedSessionRevoked(req.Context(), token.JwtID())
+	if err != nil {
+		api.staticLogger.Debugf("Failed to check whether session '%s' is revoked: %s", token.JwtID(), err)
+		return respAnon
+	}
+	if revoked {
+		api.staticLogger.Trace("Session is revoked.")
+		return respAnon
 	}
 	s, exists := token.Get("sub")
 	if !exists {
 		api.staticLogger.Warnln("Token without a sub.")
-		api.WriteJSON(w, respAnon)
-		return
+		return respAnon
 	}
 	sub := s.(string)
 	// If the user is not cached, or they were cached too long ago we'll fetch
@@ -553,10 +1062,13 @@ func (api *API) userLimitsGET(_ *database.User, w http.ResponseWriter, req *http
 		u, err := api.staticDB.UserBySub(req.Context(), sub)
 		if err != nil {
 			api.staticLogger.Debugf("Failed to fetch user from DB for sub '%s'. Error: %s", sub, err.Error())
-			api.WriteJSON(w, respAnon)
-			return
+			return respAnon
 		}
-		api.staticUserTierCache.Set(u.Sub, u)
+		if u.Deleted() || u.Suspended {
+			api.staticLogger.Tracef("User with sub '%s' is deleted or suspended.", sub)
+			return respAnon
+		}
+		api.staticUserTierCache.Set(u.Sub, u, userTierCacheTTL)
 		// Populate the tier and qe values, while simultaneously making sure
 		// that we can read the record from the cache.
 		ce, ok = api.staticUserTierCache.Get(u.Sub)
@@ -564,7 +1076,8 @@ func (api *API) userLimitsGET(_ *database.User, w http.ResponseWriter, req *http
 			build.Critical("Failed to fetch user from UserTierCache right after setting it.")
 		}
 	}
-	api.WriteJSON(w, userLimitsGetFromTier(ce.Sub, ce.Tier, ce.QuotaExceeded, inBytes))
+	ce = api.managedRefreshQuotaExceeded(req.Context(), sub, ce)
+	return userLimitsGetFromTier(ce.Sub, ce.EffectiveTier(), ce.QuotaExceeded, inBytes).withQuota(ce.QuotaUsage)
 }
 
 // userLimitsSkylinkGET returns the speed limits which apply to a GET call to
@@ -582,14 +1095,35 @@ func (api *API) userLimitsSkylinkGET(_ *database.User, w http.ResponseWriter, re
 	skylink := ps.ByName("skylink")
 	if !database.ValidSkylink(skylink) {
 		api.staticLogger.Tracef("Invalid skylink: '%s'", skylink)
-		api.WriteJSON(w, respAnon)
+		api.WriteJSONWithETag(w, req, respAnon)
 		return
 	}
 	// For all links that belong to MySky we return the first paid tier, so
 	// anyone can access them, even on portals which require authentication or
 	// premium accounts.
 	if _, ok := MyskyAllowlist[skylink]; ok {
-		api.WriteJSON(w, userLimitsGetFromTier("", database.TierPremium5, false, inBytes))
+		api.WriteJSONWithETag(w, req, userLimitsGetFromTier("", database.TierPremium5, false, inBytes))
+		return
+	}
+	// Blocked skylinks only ever get anonymous limits, regardless of grants
+	// or API keys.
+	blocked, errBlocked := api.managedSkylinkBlocked(req.Context(), skylink)
+	if errBlocked != nil {
+		api.staticLogger.Debugf("Failed to check whether skylink '%s' is blocked: %s", skylink, errBlocked)
+	}
+	if blocked {
+		api.WriteJSONWithETag(w, req, respAnon)
+		return
+	}
+	// Skylink access grants give their holder the granting user's limits.
+	if grant := req.FormValue("grant"); grant != "" {
+		u, tier, err := api.managedUserFromGrant(req.Context(), grant, skylink)
+		if err != nil {
+			api.staticLogger.Tracef("Invalid skylink access grant: %v", err)
+			api.WriteJSONWithETag(w, req, respAnon)
+			return
+		}
+		api.WriteJSONWithETag(w, req, userLimitsGetFromTier(u.Sub, tier, u.QuotaExceeded, inBytes))
 		return
 	}
 	// Try to fetch an API attached to the request.
@@ -602,53 +1136,183 @@ func (api *API) userLimitsSkylinkGET(_ *database.User, w http.ResponseWriter, re
 	}
 	if err != nil {
 		api.staticLogger.Debugf("Error while processing API key: %s", err)
-		api.WriteJSON(w, respAnon)
+		api.WriteJSONWithETag(w, req, respAnon)
 		return
 	}
 	// Check the cache before hitting the database.
 	ce, ok := api.staticUserTierCache.Get(ak.String() + skylink)
 	if ok {
 		api.staticLogger.Traceln("Fetching user limits from cache by API key.")
-		api.WriteJSON(w, userLimitsGetFromTier(ce.Sub, ce.Tier, ce.QuotaExceeded, inBytes))
+		ce = api.managedRefreshQuotaExceeded(req.Context(), ak.String()+skylink, ce)
+		api.WriteJSONWithETag(w, req, userLimitsGetFromTier(ce.Sub, ce.EffectiveTier(), ce.QuotaExceeded, inBytes))
 		return
 	}
 	// Get the API key.
 	akr, err := api.staticDB.APIKeyByKey(req.Context(), ak.String())
 	if err != nil {
 		api.staticLogger.Trace("API key doesn't exist in the database.")
-		api.WriteJSON(w, respAnon)
+		api.WriteJSONWithETag(w, req, respAnon)
 		return
 	}
 	if !akr.CoversSkylink(skylink) {
 		api.staticLogger.Trace("API key doesn't cover this skylink.")
-		api.WriteJSON(w, respAnon)
+		api.WriteJSONWithETag(w, req, respAnon)
 		return
 	}
 	// Get the owner of this API key from the database.
 	user, err := api.staticDB.UserByID(req.Context(), akr.UserID)
 	if err != nil {
 		api.staticLogger.Tracef("Failed to get user for user ID: %v", err)
-		api.WriteJSON(w, respAnon)
+		api.WriteJSONWithETag(w, req, respAnon)
+		return
+	}
+	if user.Deleted() || user.Suspended {
+		api.staticLogger.Trace("API key belongs to a deleted or suspended user.")
+		api.WriteJSONWithETag(w, req, respAnon)
 		return
 	}
 	// Store the user in the cache with a custom key.
-	api.staticUserTierCache.Set(ak.String()+skylink, user)
-	api.WriteJSON(w, userLimitsGetFromTier(user.Sub, user.Tier, user.QuotaExceeded, inBytes))
+	api.staticUserTierCache.Set(ak.String()+skylink, user, apiKeyCacheTTL(akr))
+	api.WriteJSONWithETag(w, req, userLimitsGetFromTier(user.Sub, user.EffectiveTier(), user.QuotaExceeded, inBytes))
+}
+
+// userLimitsPubKeyGET returns the tier and speed limits of the user who owns
+// the given pubkey, so clients can show them before the user completes a
+// challenge login. We only return the tier's limits, so we never reveal the
+// user's sub or usage, and we return the anonymous limits for unknown
+// pubkeys, so the endpoint can't be used to find out which pubkeys are
+// registered.
+func (api *API) userLimitsPubKeyGET(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var pk database.PubKey
+	err := pk.LoadString(ps.ByName("pubKey"))
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	// inBytes is a flag indicating that the caller wants all bandwidth limits
+	// to be presented in bytes per second. The default behaviour is to present
+	// them in bits per second.
+	inBytes := strings.EqualFold(req.FormValue("unit"), "byte")
+	// Check the cache before hitting the database.
+	ce, ok := api.staticUserTierCache.Get(pk.String())
+	if ok {
+		api.staticLogger.Traceln("Fetching user limits from cache by pubkey.")
+		api.WriteJSONWithETag(w, req, userLimitsPubKeyGetFromTier(ce.EffectiveTier(), inBytes))
+		return
+	}
+	respAnon := userLimitsPubKeyGetFromTier(database.TierAnonymous, inBytes)
+	u, err := api.staticDB.UserByPubKey(req.Context(), pk)
+	if err != nil {
+		api.staticLogger.Tracef("Failed to get user by pubkey: %v", err)
+		api.WriteJSONWithETag(w, req, respAnon)
+		return
+	}
+	if u.Deleted() || u.Suspended {
+		api.staticLogger.Trace("Pubkey belongs to a deleted or suspended user.")
+		api.WriteJSONWithETag(w, req, respAnon)
+		return
+	}
+	api.staticUserTierCache.Set(pk.String(), u, userTierCacheTTL)
+	api.WriteJSONWithETag(w, req, userLimitsPubKeyGetFromTier(u.EffectiveTier(), inBytes))
 }
 
-// userStatsGET returns statistics about an existing user.
+// managedRefreshQuotaExceeded re-reads the user's QuotaExceeded flag from the
+// DB if the given cache entry's flag is stale. This keeps the flag consistent
+// across multiple accounts instances sharing the same DB, where another
+// instance might have changed it. When the flag has changed, we also fetch the
+// usage which was stored with it. On failure we log the error and keep using
+// the cached value.
+func (api *API) managedRefreshQuotaExceeded(ctx context.Context, key string, ce userTierCacheEntry) userTierCacheEntry {
+	if !ce.QuotaStale() {
+		return ce
+	}
+	qe, err := api.staticDB.UserQuotaExceeded(ctx, ce.Sub)
+	if err != nil {
+		api.staticLogger.Debugf("Failed to refresh quota exceeded flag for sub '%s'. Error: %s", ce.Sub, err.Error())
+		return ce
+	}
+	usage := ce.QuotaUsage
+	if qe != ce.QuotaExceeded {
+		u, err := api.staticDB.UserBySub(ctx, ce.Sub)
+		if err != nil {
+			api.staticLogger.Debugf("Failed to refresh quota usage for sub '%s'. Error: %s", ce.Sub, err.Error())
+			return ce
+		}
+		qe, usage = u.QuotaExceeded, u.QuotaUsage
+	}
+	api.staticUserTierCache.SetQuotaExceeded(key, qe, usage)
+	ce.QuotaExceeded = qe
+	ce.QuotaUsage = usage
+	return ce
+}
+
+// userStatsGET returns statistics about an existing user. When the caller
+// passes `top`, we also report the largest skylinks the user uploaded and the
+// skylinks they downloaded the most during the current period.
 func (api *API) userStatsGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var top int
+	if s := req.FormValue("top"); s != "" {
+		t, err := strconv.Atoi(s)
+		if err != nil || t < 1 {
+			api.WriteError(w, errors.New("invalid number of top skylinks"), http.StatusBadRequest)
+			return
+		}
+		top = t
+	}
+	if top > database.UserStatsTopMax {
+		top = database.UserStatsTopMax
+	}
 	us, err := api.staticDB.UserStats(req.Context(), *u)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.WriteJSON(w, us)
+	if top == 0 {
+		api.WriteJSON(w, us)
+		return
+	}
+	resp := UserStatsGET{UserStats: us}
+	resp.TopUploads, err = api.staticDB.UserStatsTopUploads(req.Context(), *u, top)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp.TopDownloads, err = api.staticDB.UserStatsTopDownloads(req.Context(), *u, top)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, resp)
+}
+
+// userStatsHistoryGET returns the user's usage during each of their last
+// billing months, starting with the oldest.
+func (api *API) userStatsHistoryGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	months := DefaultStatsHistoryMonths
+	if s := req.FormValue("months"); s != "" {
+		m, err := strconv.Atoi(s)
+		if err != nil || m < 1 {
+			api.WriteError(w, errors.New("invalid number of months"), http.StatusBadRequest)
+			return
+		}
+		months = m
+	}
+	if months > database.UserStatsHistoryMaxMonths {
+		months = database.UserStatsHistoryMaxMonths
+	}
+	hist, err := api.staticDB.UserStatsHistory(req.Context(), *u, months)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, hist)
 }
 
-// userDELETE deletes the user and all of their data.
+// userDELETE marks the user as deleted. The user and all of their data get
+// purged once database.UserDeleteGracePeriod passes. Until then the user can
+// restore their account via POST /user/undelete.
 func (api *API) userDELETE(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	err := api.staticDB.UserDelete(req.Context(), u)
+	err := api.staticDB.UserSoftDelete(req.Context(), u)
 	if errors.Contains(err, database.ErrUserNotFound) {
 		api.WriteError(w, err, http.StatusNotFound)
 		return
@@ -657,44 +1321,47 @@ func (api *API) userDELETE(u *database.User, w http.ResponseWriter, req *http.Re
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	// Make sure nobody gets the user's limits from the cache anymore.
+	api.staticUserTierCache.Invalidate(u.Sub)
+	api.auditLog(req, u.ID, database.AuditActionAccountDelete, nil)
 	api.WriteSuccess(w)
 }
 
 // userPOST creates a new user.
 func (api *API) userPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	// Check if the registrations are open.
-	val, err := api.staticDB.ReadConfigValue(req.Context(), database.ConfValRegistrationsDisabled)
-	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
-		api.WriteError(w, errors.AddContext(err, "failed to read from configuration"), http.StatusInternalServerError)
-		return
-	}
-	if val == database.ConfValTrue {
-		api.WriteError(w, errors.New("registrations are currently disabled"), http.StatusNotImplemented)
-		return
-	}
 	// Parse the request's body.
-	var payload credentialsPOST
-	err = parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &payload)
+	var payload captchaCredentialsPOST
+	err := parseRequestBodyJSON(req.Body, &payload)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
 		return
 	}
+	err = api.verifyCaptcha(req, payload.CaptchaToken)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	if payload.Email == "" {
 		api.WriteError(w, errors.New("email is required"), http.StatusBadRequest)
 		return
 	}
-	parsed, err := mail.ParseAddress(payload.Email.String())
-	if err != nil || payload.Email.String() != parsed.Address {
-		api.WriteError(w, errors.New("invalid email provided"), http.StatusBadRequest)
+	payload.Email, err = types.NormalizeEmail(payload.Email.String())
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
 	if payload.Password == "" {
 		api.WriteError(w, errors.New("password is required"), http.StatusBadRequest)
 		return
 	}
-	// We are generating the sub here and not in UserCreate because there are
-	// many reasons to call UserCreate but this handler is the only place (so
-	// far) that should be allowed to call it without a sub. The reason for that
+	err = lib.ValidatePassword(payload.Password, payload.Email.String())
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	// We are generating the sub here and not in UserCreate because there are
+	// many reasons to call UserCreate but this handler is the only place (so
+	// far) that should be allowed to call it without a sub. The reason for that
 	// is that the users created here are the only users we do not need to link
 	// to CockroachDB via their subs.
 	sub, err := lib.GenerateUUID()
@@ -711,11 +1378,11 @@ func (api *API) userPOST(_ *database.User, w http.ResponseWriter, req *http.Requ
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	err = api.staticMailer.SendAddressConfirmationEmail(req.Context(), u.Email, u.EmailConfirmationToken)
+	err = api.staticMailer.SendAddressConfirmationEmail(req.Context(), u.Email, u.EmailConfirmationToken, u.Locale)
 	if err != nil {
 		api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
 	}
-	api.loginUser(w, u, 0, true)
+	api.loginUser(req, w, u, 0, true, false)
 }
 
 // userPUT allows changing some user information.
@@ -723,7 +1390,7 @@ func (api *API) userPOST(_ *database.User, w http.ResponseWriter, req *http.Requ
 func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	// Read and parse the request body.
 	var payload userUpdatePUT
-	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &payload)
+	err := parseRequestBodyJSON(req.Body, &payload)
 	if err != nil {
 		err = errors.AddContext(err, "failed to parse request body")
 		api.WriteError(w, err, http.StatusBadRequest)
@@ -734,25 +1401,83 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 		api.WriteError(w, errors.New("empty request"), http.StatusBadRequest)
 		return
 	}
+	if payload.Email != "" {
+		payload.Email, err = types.NormalizeEmail(payload.Email.String())
+		if err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
 
 	ctx := req.Context()
+	var changedEmail bool
+	status := http.StatusInternalServerError
+	err = api.managedUserSave(ctx, u, userSaveRetriesInteractive, func(u *database.User) error {
+		var s int
+		var err error
+		changedEmail, s, err = api.applyUserPUT(ctx, u, payload)
+		if err != nil {
+			status = s
+			return err
+		}
+		if api.staticDeps.Disrupt("DependencyUserPutMongoDelay") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil {
+		api.WriteError(w, err, status)
+		return
+	}
+	// Send a confirmation email to the new address if the user requested a
+	// change. The email is queued within the same transaction as the user
+	// update, so failing here rolls back the whole update. Otherwise, the user
+	// might end up with a pending email token we never sent them.
+	if changedEmail {
+		err = api.staticMailer.SendAddressConfirmationEmail(ctx, u.PendingEmail, u.PendingEmailToken, u.Locale)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "failed to send address confirmation email"), http.StatusInternalServerError)
+			return
+		}
+		api.auditLog(req, u.ID, database.AuditActionEmailChange, map[string]string{"oldEmail": u.Email.String(), "newEmail": u.PendingEmail.String()})
+	}
+	if payload.Password != "" {
+		api.auditLog(req, u.ID, database.AuditActionPasswordChange, nil)
+	}
+	api.loginUser(req, w, u, 0, true, false)
+}
+
+// applyUserPUT validates the given userPUT payload and applies it to the user.
+// It reports whether the user requested an email change. On failure it also
+// returns the HTTP status we should respond with.
+func (api *API) applyUserPUT(ctx context.Context, u *database.User, payload userUpdatePUT) (bool, int, error) {
 	if payload.Password != "" {
 		// Check if the registrations are open. If they are not then changing
 		// passwords is also not allowed.
-		val, err := api.staticDB.ReadConfigValue(ctx, database.ConfValRegistrationsDisabled)
-		if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
-			api.WriteError(w, errors.AddContext(err, "failed to read from configuration"), http.StatusInternalServerError)
-			return
+		enabled, err := api.registrationsEnabled(ctx)
+		if err != nil {
+			return false, http.StatusInternalServerError, err
 		}
-		if val == database.ConfValTrue {
-			api.WriteError(w, errors.New("registrations are currently disabled"), http.StatusNotImplemented)
-			return
+		if !enabled {
+			return false, http.StatusNotImplemented, ErrRegistrationsDisabled
+		}
+		// Validate the new password against the email the user will have
+		// after this update.
+		email := u.Email
+		if payload.Email != "" {
+			email = payload.Email
+		}
+		if email == "" && u.PendingEmail == "" {
+			return false, http.StatusBadRequest, database.ErrPasswordWithoutEmail
+		}
+		err = lib.ValidatePassword(payload.Password, email.String())
+		if err != nil {
+			return false, http.StatusBadRequest, err
 		}
 
 		pwHash, err := hash.Generate(payload.Password)
 		if err != nil {
-			api.WriteError(w, errors.AddContext(err, "failed to hash password"), http.StatusInternalServerError)
-			return
+			return false, http.StatusInternalServerError, errors.AddContext(err, "failed to hash password")
 		}
 		u.PasswordHash = string(pwHash)
 	}
@@ -760,72 +1485,88 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 	if payload.StripeID != "" {
 		// Check if this user already has a Stripe customer ID.
 		if u.StripeID != "" {
-			err = errors.New("this user already has a Stripe customer id")
-			api.WriteError(w, err, http.StatusConflict)
-			return
+			return false, http.StatusConflict, errors.New("this user already has a Stripe customer id")
 		}
 		// Verify that no other user owns this StripeID.
 		su, err := api.staticDB.UserByStripeID(ctx, payload.StripeID)
 		if err != nil && !errors.Contains(err, database.ErrUserNotFound) {
-			api.WriteError(w, err, http.StatusInternalServerError)
-			return
+			return false, http.StatusInternalServerError, err
 		}
 		if err == nil && su.Sub != u.Sub {
-			err = errors.New("this stripe customer id belongs to another user")
-			api.WriteError(w, err, http.StatusBadRequest)
-			return
+			return false, http.StatusBadRequest, NewError(ErrCodeStripeCustomerInUse, errors.New("this stripe customer id belongs to another user"))
 		}
 		// Set the StripeID.
 		u.StripeID = payload.StripeID
 	}
 
+	if payload.Name != nil {
+		name := strings.TrimSpace(*payload.Name)
+		if utf8.RuneCountInString(name) > MaxUserNameLength || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return false, http.StatusBadRequest, fmt.Errorf("invalid name, it must be up to %d characters long and not contain control characters", MaxUserNameLength)
+		}
+		u.Name = name
+	}
+
+	if payload.Locale != nil {
+		locale := strings.ToLower(strings.TrimSpace(*payload.Locale))
+		if locale != "" && !email.ValidLocale(locale) {
+			return false, http.StatusBadRequest, errors.New("invalid locale, it must be a language code such as 'de' or 'pt-br'")
+		}
+		u.Locale = locale
+	}
+
 	var changedEmail bool
 	if payload.Email != "" {
-		parsed, err := mail.ParseAddress(payload.Email.String())
-		if err != nil || payload.Email.String() != parsed.Address {
-			api.WriteError(w, errors.New("invalid email provided"), http.StatusBadRequest)
-			return
-		}
 		// Check if another user already has this email address.
 		eu, err := api.staticDB.UserByEmail(ctx, payload.Email)
 		if err != nil && !errors.Contains(err, database.ErrUserNotFound) {
-			api.WriteError(w, err, http.StatusInternalServerError)
-			return
+			return false, http.StatusInternalServerError, err
 		}
 		if err == nil && eu.Sub != u.Sub {
-			err = errors.New("this email is already in use")
-			api.WriteError(w, err, http.StatusBadRequest)
-			return
+			return false, http.StatusBadRequest, ErrEmailInUse
 		}
-		// Set the new email and set it up for a confirmation.
-		u.Email = payload.Email
-		u.EmailConfirmationTokenExpiration = time.Now().UTC().Add(database.EmailConfirmationTokenTTL).Truncate(time.Millisecond)
-		u.EmailConfirmationToken, err = lib.GenerateUUID()
-		if err != nil {
-			api.WriteError(w, errors.AddContext(err, "failed to generate a token"), http.StatusInternalServerError)
-			return
+		if payload.Email == u.Email {
+			// The user is keeping their current address, so we drop any
+			// pending change.
+			u.PendingEmail = ""
+			u.PendingEmailToken = ""
+			u.PendingEmailTokenExpiration = time.Time{}
+		} else {
+			// Store the new email as pending until the user confirms it. We
+			// keep using the current address until then, so a typo doesn't
+			// lock the user out of account recovery. Issuing a new token
+			// invalidates the one from any previous change.
+			u.PendingEmail = payload.Email
+			u.PendingEmailTokenExpiration = time.Now().UTC().Add(database.EmailConfirmationTokenTTL).Truncate(time.Millisecond)
+			u.PendingEmailToken, err = lib.GenerateUUID()
+			if err != nil {
+				return false, http.StatusInternalServerError, errors.AddContext(err, "failed to generate a token")
+			}
+			changedEmail = true
 		}
-		changedEmail = true
-	}
-
-	if api.staticDeps.Disrupt("DependencyUserPutMongoDelay") {
-		time.Sleep(100 * time.Millisecond)
 	}
+	return changedEmail, 0, nil
+}
 
-	// Save the changes.
-	err = api.staticDB.UserSave(ctx, u)
-	if err != nil {
-		api.WriteError(w, err, http.StatusInternalServerError)
-		return
-	}
-	// Send a confirmation email if the user's email address was changed.
-	if changedEmail {
-		err = api.staticMailer.SendAddressConfirmationEmail(ctx, u.Email, u.EmailConfirmationToken)
-		if err != nil {
-			api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
+// userPubKeysGET lists all pubkeys associated with this user, along with the
+// time they were added and last used for logging in.
+func (api *API) userPubKeysGET(u *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	pks := make([]UserPubKeyGET, 0, len(u.PubKeys))
+	for _, pk := range u.PubKeys {
+		pkg := UserPubKeyGET{Key: pk.String()}
+		if meta, ok := u.PubKeyMeta(pk); ok {
+			if !meta.AddedAt.IsZero() {
+				addedAt := meta.AddedAt
+				pkg.AddedAt = &addedAt
+			}
+			if !meta.LastUsedAt.IsZero() {
+				lastUsedAt := meta.LastUsedAt
+				pkg.LastUsedAt = &lastUsedAt
+			}
 		}
+		pks = append(pks, pkg)
 	}
-	api.loginUser(w, u, 0, true)
+	api.WriteJSON(w, pks)
 }
 
 // userPubKeyDELETE removes a given pubkey from the list of pubkeys associated
@@ -853,6 +1594,9 @@ func (api *API) userPubKeyDELETE(u *database.User, w http.ResponseWriter, req *h
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	// The pubkey no longer identifies this user.
+	api.staticUserTierCache.Delete(pk.String())
+	api.auditLog(req, u.ID, database.AuditActionPubKeyRemove, map[string]string{"pubKey": pk.String()})
 	api.WriteSuccess(w)
 }
 
@@ -877,6 +1621,11 @@ func (api *API) userPubKeyRegisterGET(u *database.User, w http.ResponseWriter, r
 		api.WriteError(w, errors.New("pubkey already registered"), http.StatusBadRequest)
 		return
 	}
+	// Don't issue a challenge the user won't be able to use.
+	if !u.CanAddPubKey() {
+		api.WriteError(w, database.ErrPubKeyLimitReached, http.StatusBadRequest)
+		return
+	}
 	ch, err := api.staticDB.NewChallenge(ctx, pk, database.ChallengeTypeUpdate)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
@@ -892,7 +1641,7 @@ func (api *API) userPubKeyRegisterGET(u *database.User, w http.ResponseWriter, r
 		api.WriteError(w, errors.AddContext(err, "failed to store unconfirmed user update"), http.StatusInternalServerError)
 		return
 	}
-	api.WriteJSON(w, ChallengePublic{ch.Challenge})
+	api.WriteJSON(w, challengePublicFromChallenge(ch))
 }
 
 // userPubKeyRegisterPOST updates the user's pubKey based on a challenge-response.
@@ -900,20 +1649,20 @@ func (api *API) userPubKeyRegisterPOST(u *database.User, w http.ResponseWriter,
 	ctx := req.Context()
 	// Get the challenge response.
 	var chr database.ChallengeResponse
-	err := chr.LoadFromReader(io.LimitReader(req.Body, LimitBodySizeSmall))
+	err := chr.LoadFromReader(req.Body)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "missing or invalid challenge response"), http.StatusBadRequest)
 		return
 	}
 	pk, chID, err := api.staticDB.ValidateChallengeResponse(ctx, chr, database.ChallengeTypeUpdate)
 	if err != nil {
-		api.WriteError(w, errors.AddContext(err, "failed to validate challenge response"), http.StatusBadRequest)
+		api.writeChallengeResponseError(w, err, http.StatusBadRequest)
 		return
 	}
 	// Check if the pubkey is already associated with the current user.
 	if u.HasKey(pk) {
 		// This pubkey already belongs to the user. Log them in and return.
-		api.loginUser(w, u, 0, true)
+		api.loginUser(req, w, u, 0, true, false)
 		return
 	}
 	// Check if the pubkey from the UnconfirmedUserUpdate is already associated
@@ -939,7 +1688,13 @@ func (api *API) userPubKeyRegisterPOST(u *database.User, w http.ResponseWriter,
 		api.WriteError(w, errors.New("user's sub doesn't match update sub"), http.StatusBadRequest)
 		return
 	}
+	// The user might have added other pubkeys since they requested the
+	// challenge. UserPubKeyAdd enforces the limit atomically.
 	err = api.staticDB.UserPubKeyAdd(ctx, *u, pk)
+	if errors.Contains(err, database.ErrPubKeyLimitReached) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -954,7 +1709,8 @@ func (api *API) userPubKeyRegisterPOST(u *database.User, w http.ResponseWriter,
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.loginUser(w, updatedUser, 0, true)
+	api.auditLog(req, u.ID, database.AuditActionPubKeyAdd, map[string]string{"pubKey": pk.String()})
+	api.loginUser(req, w, updatedUser, 0, true, false)
 }
 
 // userUploadsGET returns all uploads made by the current user.
@@ -965,11 +1721,22 @@ func (api *API) userUploadsGET(u *database.User, w http.ResponseWriter, req *htt
 	}
 	offset, err1 := fetchOffset(req.Form)
 	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
-	if err := errors.Compose(err1, err2); err != nil {
+	sort, err3 := database.NewUploadsSort(req.Form.Get("orderBy"), req.Form.Get("orderDirection"))
+	filter, err4 := fetchUploadsFilter(req.Form)
+	format, err5 := fetchFormat(req.Form)
+	if err := errors.Compose(err1, err2, err3, err4, err5); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if format == formatCSV {
+		api.userUploadsCSV(u, w, req, filter, sort)
+		return
+	}
+	ups, total, err := api.staticDB.UploadsByUser(req.Context(), *u, filter, sort, offset, pageSize)
+	if errors.Contains(err, database.ErrInvalidTimePeriod) || errors.Contains(err, database.ErrInvalidSizeRange) {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	ups, total, err := api.staticDB.UploadsByUser(req.Context(), *u, offset, pageSize)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -979,6 +1746,7 @@ func (api *API) userUploadsGET(u *database.User, w http.ResponseWriter, req *htt
 		Offset:   offset,
 		PageSize: pageSize,
 		Count:    total,
+		HasMore:  int64(offset+len(ups)) < total,
 	}
 	api.WriteJSON(w, response)
 }
@@ -991,10 +1759,28 @@ func (api *API) userDownloadsGET(u *database.User, w http.ResponseWriter, req *h
 	}
 	offset, err1 := fetchOffset(req.Form)
 	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
-	if err := errors.Compose(err1, err2); err != nil {
+	format, err3 := fetchFormat(req.Form)
+	if err := errors.Compose(err1, err2, err3); err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
+	switch req.Form.Get("groupBy") {
+	case "":
+	case "skylink":
+		if format == formatCSV {
+			api.WriteError(w, errors.New("CSV exports don't support groupBy"), http.StatusBadRequest)
+			return
+		}
+		api.userDownloadsSummaryGET(u, w, req, offset, pageSize)
+		return
+	default:
+		api.WriteError(w, errors.New("invalid groupBy value, the only supported value is 'skylink'"), http.StatusBadRequest)
+		return
+	}
+	if format == formatCSV {
+		api.userDownloadsCSV(u, w, req)
+		return
+	}
 	downs, total, err := api.staticDB.DownloadsByUser(req.Context(), *u, offset, pageSize)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
@@ -1009,6 +1795,102 @@ func (api *API) userDownloadsGET(u *database.User, w http.ResponseWriter, req *h
 	api.WriteJSON(w, response)
 }
 
+// userDownloadsDELETE deletes the current user's download history. The
+// optional `before` param limits the deletion to the downloads made before the
+// given RFC3339 timestamp.
+func (api *API) userDownloadsDELETE(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var before time.Time
+	if s := req.Form.Get("before"); s != "" {
+		var err error
+		before, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid 'before' timestamp"), http.StatusBadRequest)
+			return
+		}
+	}
+	n, err := api.staticDB.DownloadsDeleteByUser(req.Context(), *u, before)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, DownloadsDELETE{Deleted: n})
+}
+
+// userDownloadsSummaryGET returns the downloads made by the current user
+// during the current billing period, grouped by skylink.
+func (api *API) userDownloadsSummaryGET(u *database.User, w http.ResponseWriter, req *http.Request, offset, pageSize int) {
+	sums, total, err := api.staticDB.DownloadsByUserGrouped(req.Context(), *u, offset, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := DownloadsSummaryGET{
+		Items:    sums,
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    total,
+	}
+	api.WriteJSON(w, response)
+}
+
+// userRegistryReadsGET returns the registry reads made by the current user,
+// most recent first.
+func (api *API) userRegistryReadsGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	offset, err1 := fetchOffset(req.Form)
+	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
+	if err := errors.Compose(err1, err2); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	reads, total, err := api.staticDB.RegistryReadsByUser(req.Context(), *u, offset, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := RegistryReadsGET{
+		Items:    reads,
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    total,
+	}
+	api.WriteJSON(w, response)
+}
+
+// userRegistryWritesGET returns the registry writes made by the current user,
+// most recent first.
+func (api *API) userRegistryWritesGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	offset, err1 := fetchOffset(req.Form)
+	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
+	if err := errors.Compose(err1, err2); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	writes, total, err := api.staticDB.RegistryWritesByUser(req.Context(), *u, offset, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := RegistryWritesGET{
+		Items:    writes,
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    total,
+	}
+	api.WriteJSON(w, response)
+}
+
 // userConfirmGET validates the given confirmation token and confirms that the
 // account under which this token was issued really owns the email address to
 // which this token was sent.
@@ -1019,29 +1901,42 @@ func (api *API) userConfirmGET(_ *database.User, w http.ResponseWriter, req *htt
 		return
 	}
 	token := req.Form.Get("token")
-	u, err := api.staticDB.UserConfirmEmail(req.Context(), token)
+	u, err := api.staticDB.UserByConfirmationToken(req.Context(), token)
+	if err == nil {
+		err = api.managedUserSave(req.Context(), u, userSaveRetriesInteractive, func(u *database.User) error {
+			return api.staticDB.UserApplyEmailConfirmation(req.Context(), u, token)
+		})
+	}
 	if errors.Contains(err, database.ErrInvalidToken) || errors.Contains(err, database.ErrUserNotFound) {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
+	if errors.Contains(err, database.ErrUserAlreadyExists) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.loginUser(w, u, 0, false)
+	api.loginUser(req, w, u, 0, false, false)
 }
 
 // userReconfirmPOST allows the user to request a new email address confirmation
 // email, in case the previous one didn't arrive for some reason.
 // The user needs to be logged in.
 func (api *API) userReconfirmPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if u.Email == "" {
+		api.WriteError(w, errors.New("this user doesn't have an email address to confirm"), http.StatusBadRequest)
+		return
+	}
 	var err error
 	tk, err := api.staticDB.UserCreateEmailConfirmation(req.Context(), u.ID)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to generate a new confirmation token"), http.StatusInternalServerError)
 		return
 	}
-	err = api.staticMailer.SendAddressConfirmationEmail(req.Context(), u.Email, tk)
+	err = api.staticMailer.SendAddressConfirmationEmail(req.Context(), u.Email, tk, u.Locale)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to send the new confirmation token"), http.StatusInternalServerError)
 		return
@@ -1054,23 +1949,11 @@ func (api *API) userReconfirmPOST(u *database.User, w http.ResponseWriter, req *
 // without logging in.
 // The user doesn't need to be logged in.
 func (api *API) userRecoverRequestPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	// Check if the registrations are open. If they are not then account
-	// recovery is also disabled.
-	val, err := api.staticDB.ReadConfigValue(req.Context(), database.ConfValRegistrationsDisabled)
-	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
-		api.WriteError(w, errors.AddContext(err, "failed to read from configuration"), http.StatusInternalServerError)
-		return
-	}
-	if val == database.ConfValTrue {
-		api.WriteError(w, errors.New("registrations are currently disabled"), http.StatusNotImplemented)
-		return
-	}
-
 	// Read and parse the request body. We do not expect a password but we want
 	// to use the same email parsing approach in all cases where we get an email
 	// address from the user.
-	var payload credentialsPOST
-	err = parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &payload)
+	var payload captchaCredentialsPOST
+	err := parseRequestBodyJSON(req.Body, &payload)
 	if err != nil {
 		err = errors.AddContext(err, "failed to parse request body")
 		api.WriteError(w, err, http.StatusBadRequest)
@@ -1080,12 +1963,22 @@ func (api *API) userRecoverRequestPOST(_ *database.User, w http.ResponseWriter,
 		api.WriteError(w, errors.New("missing required parameter 'email'"), http.StatusBadRequest)
 		return
 	}
+	err = api.verifyCaptcha(req, payload.CaptchaToken)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	payload.Email, err = types.NormalizeEmail(payload.Email.String())
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	u, err := api.staticDB.UserByEmail(req.Context(), payload.Email)
 	if errors.Contains(err, database.ErrUserNotFound) {
 		// Someone tried to recover an account with an email that's not in our
 		// database. It's possible that this is a user who forgot which email
 		// they used when they signed up. Email them, so they know.
-		errSend := api.staticMailer.SendAccountAccessAttemptedEmail(req.Context(), payload.Email)
+		errSend := api.staticMailer.SendAccountAccessAttemptedEmail(req.Context(), payload.Email, "")
 		if errSend != nil {
 			api.staticLogger.Warningln(errors.AddContext(err, "failed to send an email"))
 		}
@@ -1100,28 +1993,17 @@ func (api *API) userRecoverRequestPOST(_ *database.User, w http.ResponseWriter,
 		api.WriteError(w, errors.AddContext(err, "failed to fetch the user with this email"), http.StatusInternalServerError)
 		return
 	}
-	// Generate a new recovery token and add it to the user's account.
-	u.RecoveryToken, err = lib.GenerateUUID()
-	if err != nil {
-		api.WriteError(w, errors.AddContext(err, "failed to generate a token"), http.StatusInternalServerError)
-		return
-	}
-	err = api.staticDB.UserSave(req.Context(), u)
+	// Generate a new recovery token. The user's earlier tokens remain valid,
+	// up to a limit.
+	rt, err := api.staticDB.RecoveryTokenCreate(req.Context(), *u)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to create a token"), http.StatusInternalServerError)
 		return
 	}
-	// Send the token to the user via an email.
-	err = api.staticMailer.SendRecoverAccountEmail(req.Context(), u.Email, u.RecoveryToken)
+	// Send the token to the user via an email. The email is queued within the
+	// same transaction as the token, so failing here rolls back the token.
+	err = api.staticMailer.SendRecoverAccountEmail(req.Context(), u.Email, rt.Token, u.Locale)
 	if err != nil {
-		// The token was successfully generated and added to the user's account,
-		// but we failed to send it to the user. We will try to remove it.
-		u.RecoveryToken = ""
-		if errRem := api.staticDB.UserSave(req.Context(), u); errRem != nil {
-			api.WriteError(w, errors.AddContext(err, "failed to send recovery email. no token has been added to the account. please try again"), http.StatusInternalServerError)
-			return
-		}
-		// We failed to remove the token we added. The user needs to be notified.
 		api.WriteError(w, errors.AddContext(err, "failed to send recovery email. please try again"), http.StatusInternalServerError)
 		return
 	}
@@ -1132,21 +2014,9 @@ func (api *API) userRecoverRequestPOST(_ *database.User, w http.ResponseWriter,
 // They need to provide a valid password-reset token.
 // The user doesn't need to be logged in.
 func (api *API) userRecoverPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	// Check if the registrations are open. If they are not then account
-	// recovery is also disabled.
-	val, err := api.staticDB.ReadConfigValue(req.Context(), database.ConfValRegistrationsDisabled)
-	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
-		api.WriteError(w, errors.AddContext(err, "failed to read from configuration"), http.StatusInternalServerError)
-		return
-	}
-	if val == database.ConfValTrue {
-		api.WriteError(w, errors.New("registrations are currently disabled"), http.StatusNotImplemented)
-		return
-	}
-
 	// Parse the request's body.
 	var payload accountRecoveryPOST
-	err = parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &payload)
+	err := parseRequestBodyJSON(req.Body, &payload)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
 		return
@@ -1164,19 +2034,88 @@ func (api *API) userRecoverPOST(_ *database.User, w http.ResponseWriter, req *ht
 		api.WriteError(w, errors.New("no such user"), http.StatusBadRequest)
 		return
 	}
+	if u.Deleted() {
+		api.WriteError(w, errors.New("this account is deleted, restore it via POST /user/undelete first"), http.StatusBadRequest)
+		return
+	}
+	err = lib.ValidatePassword(payload.Password, u.Email.String())
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	passHash, err := hash.Generate(payload.Password)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to hash password"), http.StatusInternalServerError)
 		return
 	}
-	u.PasswordHash = string(passHash)
-	u.RecoveryToken = ""
-	err = api.staticDB.UserSave(req.Context(), u)
+	// Consume the token before we change the password, so it can only be
+	// used once. This also invalidates all other recovery tokens of the user.
+	err = api.staticDB.RecoveryTokenConsume(req.Context(), u, payload.Token)
+	if errors.Contains(err, database.ErrInvalidRecoveryToken) {
+		api.WriteError(w, errors.New("no such user"), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to consume recovery token"), http.StatusInternalServerError)
+		return
+	}
+	err = api.managedUserSave(req.Context(), u, userSaveRetriesInteractive, func(u *database.User) error {
+		u.PasswordHash = string(passHash)
+		return nil
+	})
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to save password"), http.StatusInternalServerError)
 		return
 	}
-	api.loginUser(w, u, 0, false)
+	api.auditLog(req, u.ID, database.AuditActionPasswordChange, map[string]string{"method": "recovery"})
+	api.loginUser(req, w, u, 0, false, false)
+}
+
+// userUndeletePOST restores a deleted account before its grace period runs
+// out. The user needs to provide a valid recovery token, which they can get
+// via POST /user/recover/request.
+// The user doesn't need to be logged in.
+func (api *API) userUndeletePOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var payload accountUndeletePOST
+	err := parseRequestBodyJSON(req.Body, &payload)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	if payload.Token == "" {
+		api.WriteError(w, errors.New("missing required parameter 'token'"), http.StatusBadRequest)
+		return
+	}
+	u, err := api.staticDB.UserByRecoveryToken(req.Context(), payload.Token)
+	if err != nil {
+		api.WriteError(w, errors.New("no such user"), http.StatusBadRequest)
+		return
+	}
+	if !u.Deleted() {
+		api.WriteError(w, errors.New("this account is not deleted"), http.StatusBadRequest)
+		return
+	}
+	if time.Since(u.DeletedAt) > database.UserDeleteGracePeriod {
+		api.WriteError(w, errors.New("the grace period for restoring this account has passed"), http.StatusGone)
+		return
+	}
+	// Consume the token before we restore the account, so it can only be
+	// used once.
+	err = api.staticDB.RecoveryTokenConsume(req.Context(), u, payload.Token)
+	if errors.Contains(err, database.ErrInvalidRecoveryToken) {
+		api.WriteError(w, errors.New("no such user"), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to consume recovery token"), http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.UserUndelete(req.Context(), u)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to restore account"), http.StatusInternalServerError)
+		return
+	}
+	api.loginUser(req, w, u, 0, false, false)
 }
 
 // trackUploadPOST registers a new upload in the system.
@@ -1186,6 +2125,10 @@ func (api *API) trackUploadPOST(_ *database.User, w http.ResponseWriter, req *ht
 		api.WriteError(w, errors.New("missing parameter 'skylink'"), http.StatusBadRequest)
 		return
 	}
+	ip, ok := api.trackedIP(w, req)
+	if !ok {
+		return
+	}
 	skylink, err := api.staticDB.Skylink(req.Context(), sl)
 	if errors.Contains(err, database.ErrInvalidSkylink) {
 		api.WriteError(w, err, http.StatusBadRequest)
@@ -1195,13 +2138,57 @@ func (api *API) trackUploadPOST(_ *database.User, w http.ResponseWriter, req *ht
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	u, _, _ := api.userFromRequest(req, true)
+	if skylink.Blocked {
+		api.WriteError(w, database.ErrSkylinkBlocked, http.StatusUnavailableForLegalReasons)
+		return
+	}
+	u, _, err := api.userFromRequest(req, true)
+	if errors.Contains(err, ErrAPIKeyReadOnly) || errors.Contains(err, ErrAccountSuspended) {
+		api.WriteError(w, err, http.StatusForbidden)
+		return
+	}
 	if u == nil {
 		// This will be tracked as an anonymous request.
+		if !api.checkAnonUsage(w, req, anonUsageUpload) {
+			return
+		}
 		u = &database.AnonUser
 	}
-	ip := validateIP(req.FormValue("ip"))
-	_, err = api.staticDB.UploadCreate(req.Context(), *u, ip, *skylink)
+	requestID := req.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = req.FormValue("requestId")
+	}
+	// QuotaExceeded only flips after checkUserQuotas runs, so we reserve the
+	// upload's storage up front. Otherwise, users could track any number of
+	// uploads before the flag catches up with them. We don't know the size of
+	// some skylinks yet, so they reserve an estimate, see storageCounterSize.
+	reserved := !u.ID.IsZero()
+	if reserved {
+		err = api.staticDB.StorageReserve(req.Context(), *u, storageCounterSize(*skylink), storageQuotaLimit(u))
+		if errors.Contains(err, database.ErrStorageQuotaExceeded) {
+			api.WriteError(w, err, http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	up, err := api.staticDB.UploadCreate(req.Context(), *u, ip, *skylink, APIKeyIDFromContext(req.Context()), requestID)
+	if reserved {
+		errDone := api.staticDB.StorageReservationDone(req.Context(), *u, storageCounterSize(*skylink), err == nil)
+		if errDone != nil {
+			api.staticLogger.Warnln(errors.AddContext(errDone, "failed to complete storage reservation"))
+		}
+	}
+	if errors.Contains(err, database.ErrDuplicateUpload) {
+		// We've already tracked this upload, so there's nothing to do. We
+		// answer with a 200 instead of the usual 204, so callers can tell
+		// that this was a duplicate. We don't send the existing upload back
+		// because it might belong to another anonymous caller.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -1209,23 +2196,24 @@ func (api *API) trackUploadPOST(_ *database.User, w http.ResponseWriter, req *ht
 	if skylink.Size == 0 {
 		// Zero size means that we haven't fetched the skyfile's size yet.
 		// Queue the skylink to have its metadata fetched and updated in the DB.
-		go func() {
-			api.staticMF.Queue <- metafetcher.Message{
-				SkylinkID: skylink.ID,
-			}
-		}()
+		api.staticMF.Enqueue(metafetcher.Message{SkylinkID: skylink.ID})
 	}
 	api.WriteSuccess(w)
 	// Now that we've returned results to the caller, we can take care of some
 	// administrative details, such as user's quotas check.
 	// Note that this call is not affected by the request's context, so we use
 	// a separate one.
+	go api.threadedTagUploadCountry(up.ID, ip)
 	if u != nil && !u.ID.IsZero() {
 		go api.checkUserQuotas(context.Background(), u)
 	}
 }
 
-// trackDownloadPOST registers a new download in the system.
+// trackDownloadPOST registers a new download in the system. Downloads by
+// callers we can't identify are tracked as anonymous.
+//
+// NOTE: This handler uses the noAuth middleware, so it can track anonymous
+// downloads. It identifies the caller itself.
 func (api *API) trackDownloadPOST(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	err := req.ParseForm()
 	if err != nil {
@@ -1235,7 +2223,7 @@ func (api *API) trackDownloadPOST(u *database.User, w http.ResponseWriter, req *
 	downloadedBytes, err := strconv.ParseInt(req.Form.Get("bytes"), 10, 64)
 	if err != nil {
 		downloadedBytes = 0
-		api.staticLogger.Traceln("Failed to parse bytes downloaded:", err)
+		api.loggerFromContext(req.Context()).Traceln("Failed to parse bytes downloaded:", err)
 	}
 	if downloadedBytes < 0 {
 		api.WriteError(w, errors.New("negative download size"), http.StatusBadRequest)
@@ -1262,7 +2250,28 @@ func (api *API) trackDownloadPOST(u *database.User, w http.ResponseWriter, req *
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	_, err = api.staticDB.DownloadCreate(req.Context(), *u, *skylink, downloadedBytes)
+	if skylink.Blocked {
+		api.WriteError(w, database.ErrSkylinkBlocked, http.StatusUnavailableForLegalReasons)
+		return
+	}
+	u, err = api.userFromRequestOrGrant(req, sl)
+	if errors.Contains(err, ErrAPIKeyReadOnly) || errors.Contains(err, ErrAccountSuspended) {
+		api.WriteError(w, err, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if u == nil {
+		// This will be tracked as an anonymous download.
+		if !api.checkAnonUsage(w, req, anonUsageDownload) {
+			return
+		}
+		u = &database.AnonUser
+	}
+	ip := validateIP(req.Form.Get("ip"))
+	_, err = api.staticDB.DownloadCreate(req.Context(), *u, ip, *skylink, downloadedBytes, APIKeyIDFromContext(req.Context()))
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -1272,11 +2281,7 @@ func (api *API) trackDownloadPOST(u *database.User, w http.ResponseWriter, req *
 		// Queue the skylink to have its metadata fetched. We do not specify a user
 		// here because this is not an upload, so nobody's used storage needs to be
 		// adjusted.
-		go func() {
-			api.staticMF.Queue <- metafetcher.Message{
-				SkylinkID: skylink.ID,
-			}
-		}()
+		api.staticMF.Enqueue(metafetcher.Message{SkylinkID: skylink.ID})
 	}
 	api.WriteSuccess(w)
 }
@@ -1309,11 +2314,14 @@ func (api *API) userUploadsDELETE(u *database.User, w http.ResponseWriter, req *
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	_, err = api.staticDB.UnpinUploads(req.Context(), *skylink, *u)
+	n, err := api.staticDB.UnpinUploads(req.Context(), *skylink, *u)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	if n > 0 {
+		api.managedStorageUsageAdd(req.Context(), u, -storageCounterSize(*skylink))
+	}
 	api.WriteSuccess(w)
 	// Now that we've returned results to the caller, we can take care of some
 	// administrative details, such as user's quotas check.
@@ -1322,24 +2330,282 @@ func (api *API) userUploadsDELETE(u *database.User, w http.ResponseWriter, req *
 	go api.checkUserQuotas(context.Background(), u)
 }
 
+// userUploadsRepinPOST pins the current user's uploads of the given skylink
+// again, undoing userUploadsDELETE. Repinning a skylink the user has never
+// uploaded, or one which has been purged since, results in a 404.
+func (api *API) userUploadsRepinPOST(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sl := ps.ByName("skylink")
+	if !database.ValidSkylink(sl) {
+		api.WriteError(w, database.ErrInvalidSkylink, http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	skylink, err := api.staticDB.SkylinkFind(ctx, sl)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		api.WriteError(w, errors.New("upload not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if skylink.Blocked {
+		api.WriteError(w, database.ErrSkylinkBlocked, http.StatusUnavailableForLegalReasons)
+		return
+	}
+	// Repinned uploads count towards the user's storage again, so we reserve
+	// it the same way trackUploadPOST does. Otherwise, users could get around
+	// their quota by unpinning and repinning files.
+	err = api.staticDB.StorageReserve(ctx, *u, storageCounterSize(*skylink), storageQuotaLimit(u))
+	if errors.Contains(err, database.ErrStorageQuotaExceeded) {
+		api.WriteError(w, err, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	n, err := api.staticDB.RepinUploads(ctx, *skylink, *u)
+	errDone := api.staticDB.StorageReservationDone(ctx, *u, storageCounterSize(*skylink), err == nil && n > 0)
+	if errDone != nil {
+		api.staticLogger.Warnln(errors.AddContext(errDone, "failed to complete storage reservation"))
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		// Repinning is idempotent, so we only fail if the user doesn't have
+		// any pinned uploads of this skylink either.
+		pinned, err := api.staticDB.UserHasPinned(ctx, *u, *skylink)
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !pinned {
+			api.WriteError(w, errors.New("upload not found"), http.StatusNotFound)
+			return
+		}
+	}
+	api.WriteSuccess(w)
+	// Repinned uploads count towards the user's storage again, so they might
+	// exceed their quota now.
+	// Note that this call is not affected by the request's context, so we use
+	// a separate one.
+	go api.checkUserQuotas(context.Background(), u)
+}
+
+// userUploadsBulkDeletePOST unpins all uploads of the given skylinks made by
+// the current user. It expects a JSON array of skylinks as the request body.
+// This is a POST because DELETE requests with a body are dropped or rejected
+// by some proxies and clients.
+func (api *API) userUploadsBulkDeletePOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var skylinks []string
+	err := parseRequestBodyJSON(req.Body, &skylinks)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(skylinks) > MaxBulkDeleteSkylinks {
+		api.WriteError(w, fmt.Errorf("too many skylinks, the maximum is %d", MaxBulkDeleteSkylinks), http.StatusBadRequest)
+		return
+	}
+	resp := UserUploadsBulkDeleteResponse{
+		Invalid:  make([]string, 0),
+		NotFound: make([]string, 0),
+	}
+	// Map the normalised skylinks to the ones the caller gave us, so we can
+	// report them back in the same format.
+	original := make(map[string]string, len(skylinks))
+	normalised := make([]string, 0, len(skylinks))
+	for _, sl := range skylinks {
+		if !database.ValidSkylink(sl) {
+			resp.Invalid = append(resp.Invalid, sl)
+			continue
+		}
+		n, err := database.NormalizeSkylink(sl)
+		if err != nil {
+			resp.Invalid = append(resp.Invalid, sl)
+			continue
+		}
+		if _, exists := original[n]; exists {
+			continue
+		}
+		original[n] = sl
+		normalised = append(normalised, n)
+	}
+	unpinned, notFound, err := api.staticDB.UnpinUploadsBulk(req.Context(), *u, normalised)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp.Unpinned = unpinned
+	for _, n := range notFound {
+		resp.NotFound = append(resp.NotFound, original[n])
+	}
+	api.WriteJSON(w, resp)
+	if unpinned == 0 {
+		return
+	}
+	// Check the user's quotas once for the whole batch. This also reconciles
+	// their storage usage counter, so we don't update it here. Note that this
+	// call is not affected by the request's context, so we use a separate one.
+	go api.checkUserQuotas(context.Background(), u)
+}
+
 // checkUserQuotas compares the resources consumed by the user to their quotas
 // and sets the QuotaExceeded flag on their account if they exceed any.
 func (api *API) checkUserQuotas(ctx context.Context, u *database.User) {
-	startOfTime := time.Time{}
-	upStats, err := api.staticDB.UserStatsUpload(ctx, u.ID, startOfTime)
+	_, err := api.recheckQuota(ctx, u)
 	if err != nil {
-		api.staticLogger.Debugln("Failed to get user's upload bandwidth used:", err)
-		return
+		api.staticLogger.Warnf("Failed to check the quotas of user %s: %s", u.Sub, err)
+	}
+}
+
+// recheckQuota recomputes the resources consumed by the user and updates
+// their QuotaExceeded flag accordingly. It returns whether the flag changed.
+// For members of an organization it updates the flag of the organization and
+// of all of its members.
+func (api *API) recheckQuota(ctx context.Context, u *database.User) (bool, error) {
+	// We take a snapshot of the storage usage counter before we compute the
+	// stats, so we can reconcile the counter with them.
+	su, err := api.staticDB.StorageUsageByUser(ctx, *u)
+	if err != nil {
+		return false, err
 	}
-	quota := database.UserLimits[u.Tier]
-	quotaExceeded := upStats.CountTotal > int64(quota.MaxNumberUploads) || upStats.SizeTotal > quota.Storage
-	if quotaExceeded != u.QuotaExceeded {
+	quotaExceeded, upStats, quota, err := api.quotaExceeded(ctx, u)
+	if err != nil {
+		return false, err
+	}
+	// The counter holds an estimate for each skylink whose size we don't know
+	// yet, see storageCounterSize.
+	storage := upStats.SizeTotal + upStats.UnknownSizeTotal*UnknownSkylinkSizeEstimate
+	_, err = api.staticDB.StorageUsageReconcile(ctx, su, storage)
+	if err != nil {
+		api.staticLogger.Warnf("Failed to reconcile the storage usage of user %s: %s", u.Sub, err)
+	}
+	if quotaExceeded == u.QuotaExceeded {
+		return false, nil
+	}
+	if u.InOrg() {
+		return true, api.managedSetOrgQuotaExceeded(ctx, u.OrgID, quotaExceeded, upStats, quota)
+	}
+	err = api.managedUserSave(ctx, u, userSaveRetriesBackground, func(u *database.User) error {
 		u.QuotaExceeded = quotaExceeded
+		u.QuotaUsage = nil
+		if quotaExceeded {
+			u.QuotaUsage = quotaUsage(upStats, quota)
+		}
+		return nil
+	})
+	// Drop all of the user's cached entries, including the ones cached under
+	// their API keys.
+	api.staticUserTierCache.Invalidate(u.Sub)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to save user")
+	}
+	api.staticDB.RecordQuotaExceededChange(ctx, u.Sub, quotaExceeded)
+	api.managedNotifyQuotaChange(ctx, u, upStats, quota)
+	return true, nil
+}
+
+// quotaExceeded returns whether the resources consumed by the user exceed
+// their quotas, together with the upload stats and the quotas it compared.
+// For members of an organization it compares the pooled uploads of all
+// members to the organization's quotas.
+func (api *API) quotaExceeded(ctx context.Context, u *database.User) (bool, database.UserStatsUpload, database.TierLimits, error) {
+	var upStats database.UserStatsUpload
+	var err error
+	if u.InOrg() {
+		upStats, err = api.managedOrgStatsUpload(ctx, u.OrgID)
+	} else {
+		upStats, err = api.staticDB.UserStatsUpload(ctx, u.ID, time.Time{})
+	}
+	if err != nil {
+		return false, database.UserStatsUpload{}, database.TierLimits{}, errors.AddContext(err, "failed to get user's upload stats")
+	}
+	quota := database.LimitsForTier(u.EffectiveTier())
+	exceeded := upStats.CountTotal > int64(quota.MaxNumberUploads) || upStats.SizeTotal > quota.Storage
+	return exceeded, upStats, quota, nil
+}
+
+// managedUserSave applies the given changes to the user and saves them. If
+// someone else saved the user since we fetched them, we fetch the user again,
+// reapply the changes and retry, up to the given number of times.
+func (api *API) managedUserSave(ctx context.Context, u *database.User, retries int, apply func(*database.User) error) error {
+	for i := 0; ; i++ {
+		err := apply(u)
+		if err != nil {
+			return err
+		}
 		err = api.staticDB.UserSave(ctx, u)
+		if !errors.Contains(err, database.ErrStaleDocument) || i >= retries {
+			return err
+		}
+		fresh, err := api.staticDB.UserByID(ctx, u.ID)
 		if err != nil {
-			api.staticLogger.Warnf("Failed to save user. User: %+v, err: %s", u, err.Error())
+			return errors.AddContext(err, "failed to refetch user")
+		}
+		*u = *fresh
+	}
+}
+
+// quotaUsage describes the given upload stats and quotas.
+func quotaUsage(upStats database.UserStatsUpload, quota database.TierLimits) *database.QuotaUsage {
+	return &database.QuotaUsage{
+		StorageUsed:  upStats.SizeTotal,
+		StorageLimit: quota.Storage,
+		UploadsCount: upStats.CountTotal,
+		UploadsLimit: int64(quota.MaxNumberUploads),
+	}
+}
+
+// managedStorageUsageAdd adds the given number of bytes to the storage usage
+// counter of the user. Failing to do so is not fatal because we reconcile the
+// counter the next time we check the user's quota.
+func (api *API) managedStorageUsageAdd(ctx context.Context, u *database.User, size int64) {
+	if size == 0 {
+		return
+	}
+	err := api.staticDB.StorageUsageAdd(ctx, *u, size)
+	if err != nil {
+		api.staticLogger.Warnf("Failed to update the storage usage of user %s: %s", u.Sub, err)
+	}
+}
+
+// storageCounterSize returns the number of bytes an upload of the given
+// skylink adds to the storage usage counter. Skylinks whose size we don't know
+// yet count as UnknownSkylinkSizeEstimate.
+func storageCounterSize(sl database.Skylink) int64 {
+	if sl.Size == 0 {
+		return UnknownSkylinkSizeEstimate
+	}
+	return sl.Size
+}
+
+// storageQuotaLimit returns the storage the user can use before we refuse to
+// track their uploads, i.e. their quota plus StorageQuotaTolerancePercent.
+func storageQuotaLimit(u *database.User) int64 {
+	storage := database.LimitsForTier(u.EffectiveTier()).Storage
+	return storage + storage*StorageQuotaTolerancePercent/100
+}
+
+// managedNotifyQuotaChange lets the portal operator and the user know that
+// the user's QuotaExceeded flag has changed. The operator gets a webhook, if
+// one is configured, and the user gets an email when they exceed their quota.
+func (api *API) managedNotifyQuotaChange(ctx context.Context, u *database.User, upStats database.UserStatsUpload, quota database.TierLimits) {
+	if QuotaWebhookURL != "" {
+		go api.threadedSendQuotaWebhook(quotaWebhookPayload(u, upStats, quota))
+	}
+	if u.QuotaExceeded && u.Email != "" {
+		err := api.staticMailer.SendQuotaExceededEmail(ctx, u.Email, u.Locale)
+		if err != nil {
+			api.staticLogger.Warnln(errors.AddContext(err, "failed to queue quota exceeded email"))
 		}
-		api.staticUserTierCache.Set(u.Sub, u)
 	}
 }
 
@@ -1352,25 +2618,35 @@ func (api *API) userFromRequest(req *http.Request, allowsAPIKey bool) (*database
 	if err == nil {
 		return u, tk, nil
 	}
+	if errors.Contains(err, ErrAccountSuspended) {
+		return nil, nil, err
+	}
 	// Check for an API key.
 	ak, err := apiKeyFromRequest(req)
 	if err != nil {
 		return nil, nil, err
 	}
+	u, tk, err = api.userAndTokenByAPIKey(req, *ak)
+	// Read-only API keys are rejected from all endpoints which modify data,
+	// regardless of whether those accept API keys or not. So are the API keys
+	// of suspended users.
+	if errors.Contains(err, ErrAPIKeyReadOnly) || errors.Contains(err, ErrAccountSuspended) {
+		return nil, nil, err
+	}
 	if !allowsAPIKey {
 		return nil, nil, ErrAPIKeyNotAllowed
 	}
-	u, tk, err = api.userAndTokenByAPIKey(req, *ak)
 	if err != nil {
 		return nil, nil, err
 	}
-	return u, tk, err
+	return u, tk, nil
 }
 
 // wellKnownJWKSGET returns our public JWKS, so people can use that to verify
 // the authenticity of the JWT tokens we issue.
 func (api *API) wellKnownJWKSGET(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	api.WriteJSON(w, jwt.AccountsPublicJWKS)
+	setCacheControl(w, jwksMaxAge)
+	api.WriteJSON(w, jwt.PublicKeySet())
 }
 
 // UserGETFromUser converts a database.User struct to a UserGET struct.
@@ -1378,10 +2654,34 @@ func UserGETFromUser(u *database.User) *UserGET {
 	if u == nil {
 		return nil
 	}
-	return &UserGET{
+	ug := &UserGET{
 		User:           *u,
-		EmailConfirmed: u.EmailConfirmationToken == "",
+		EmailConfirmed: emailConfirmed(u),
+		HasEmail:       u.Email != "",
+		Restrictions:   []string{},
+	}
+	// Report the effective preferences of users who haven't changed theirs.
+	prefs := u.EmailPrefs()
+	ug.EmailPreferences = &prefs
+	if u.InOrg() {
+		ug.OrgID = u.OrgID.Hex()
+	}
+	if u.SubscriptionStatus != "" {
+		ug.Subscription = &UserSubscriptionGET{
+			Status:            u.SubscriptionStatus,
+			TierID:            u.Tier,
+			TierName:          database.LimitsForTier(u.Tier).TierName,
+			CurrentPeriodEnd:  u.SubscribedUntil,
+			CancelAt:          u.SubscriptionCancelAt,
+			CancelAtPeriodEnd: u.SubscriptionCancelAtPeriodEnd,
+		}
 	}
+	return ug
+}
+
+// emailConfirmed returns true if the user has an email and has confirmed it.
+func emailConfirmed(u *database.User) bool {
+	return u.Email != "" && u.EmailConfirmationToken == ""
 }
 
 // fetchOffset extracts the offset from the params and validates its value.
@@ -1394,36 +2694,86 @@ func fetchOffset(form url.Values) (int, error) {
 }
 
 // fetchPageSize extracts the page size from the params and validates its value.
+// Callers can't request more than MaxPageSize records per page.
 func fetchPageSize(form url.Values, defaultPageSize int) (int, error) {
 	pageSize, _ := strconv.Atoi(form.Get("pageSize"))
 	if pageSize < 0 {
 		return 0, errors.New("Invalid page size")
 	}
+	if pageSize > MaxPageSize {
+		return 0, fmt.Errorf("Invalid page size, the maximum is %d", MaxPageSize)
+	}
 	if pageSize == 0 {
 		pageSize = defaultPageSize
 	}
 	return pageSize, nil
 }
 
-// parseRequestBodyJSON reads a limited portion of the body and decodes it into
-// the given struct v. The purpose of this is to prevent DoS attacks that rely
-// on excessively large request bodies.
-func parseRequestBodyJSON(body io.ReadCloser, maxBodySize int64, v interface{}) error {
-	return json.NewDecoder(io.LimitReader(body, maxBodySize)).Decode(&v)
+// fetchUploadsFilter extracts the uploads filter from the params and
+// validates the format of its values.
+func fetchUploadsFilter(form url.Values) (database.UploadsFilter, error) {
+	f := database.UploadsFilter{
+		Name: form.Get("name"),
+	}
+	var err error
+	if s := form.Get("from"); s != "" {
+		f.From, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return database.UploadsFilter{}, errors.AddContext(err, "invalid 'from' timestamp")
+		}
+	}
+	if s := form.Get("to"); s != "" {
+		f.To, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return database.UploadsFilter{}, errors.AddContext(err, "invalid 'to' timestamp")
+		}
+	}
+	if s := form.Get("minSize"); s != "" {
+		minSize, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return database.UploadsFilter{}, errors.AddContext(err, "invalid 'minSize'")
+		}
+		f.MinSize = &minSize
+	}
+	if s := form.Get("maxSize"); s != "" {
+		maxSize, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return database.UploadsFilter{}, errors.AddContext(err, "invalid 'maxSize'")
+		}
+		f.MaxSize = &maxSize
+	}
+	if s := form.Get("includeUnpinned"); s != "" {
+		f.IncludeUnpinned, err = strconv.ParseBool(s)
+		if err != nil {
+			return database.UploadsFilter{}, errors.AddContext(err, "invalid 'includeUnpinned' value")
+		}
+	}
+	return f, nil
+}
+
+// parseRequestBodyJSON decodes the body into the given struct v. The size of
+// the body is capped by the route's withBodyLimit, so a body which exceeds it
+// results in ErrRequestBodyTooLarge.
+func parseRequestBodyJSON(body io.Reader, v interface{}) error {
+	err := json.NewDecoder(body).Decode(&v)
+	if requestBodyTooLarge(err) {
+		return ErrRequestBodyTooLarge
+	}
+	return err
 }
 
 // userLimitsGetFromTier is a helper that lets us succinctly translate
 // from the database DTO to the API DTO. The `inBytes` parameter determines
 // whether the returned speeds will be in Bps or bps.
 func userLimitsGetFromTier(sub string, tierID int, quotaExceeded, inBytes bool) *UserLimitsGET {
-	t, ok := database.UserLimits[tierID]
-	if !ok {
+	t := database.LimitsForTier(tierID)
+	if tierID < database.TierAnonymous || tierID >= database.TierMaxReserved {
 		build.Critical("userLimitsGetFromTier was called with non-existent tierID: " + strconv.Itoa(tierID))
-		t = database.UserLimits[database.TierAnonymous]
+		t = database.LimitsForTier(database.TierAnonymous)
 	}
 	limitsTier := t
 	if quotaExceeded {
-		limitsTier = database.UserLimits[database.TierAnonymous]
+		limitsTier = database.LimitsForTier(database.TierAnonymous)
 	}
 	// If we need to return the result in bits per second, we multiply by 8,
 	// otherwise, we multiply by 1.
@@ -1443,14 +2793,119 @@ func userLimitsGetFromTier(sub string, tierID int, quotaExceeded, inBytes bool)
 		UploadBandwidth:   limitsTier.UploadBandwidth * bpsMul,
 		DownloadBandwidth: limitsTier.DownloadBandwidth * bpsMul,
 		RegistryDelay:     limitsTier.RegistryDelay,
+		QuotaExceeded:     quotaExceeded,
+	}
+}
+
+// userLimitsPubKeyGetFromTier is a helper that lets us succinctly translate
+// from a tier ID to the limits we report by pubkey.
+func userLimitsPubKeyGetFromTier(tierID int, inBytes bool) *UserLimitsPubKeyGET {
+	ul := userLimitsGetFromTier("", tierID, false, inBytes)
+	return &UserLimitsPubKeyGET{
+		TierID:            ul.TierID,
+		TierName:          ul.TierName,
+		UploadBandwidth:   ul.UploadBandwidth,
+		DownloadBandwidth: ul.DownloadBandwidth,
+		MaxUploadSize:     ul.MaxUploadSize,
+		RegistryDelay:     ul.RegistryDelay,
+	}
+}
+
+// withQuota adds the given usage to the limits of a user who exceeds their
+// quota. Users who don't exceed it get no usage.
+func (ul *UserLimitsGET) withQuota(usage *database.QuotaUsage) *UserLimitsGET {
+	if ul.QuotaExceeded {
+		ul.Quota = usage
+	}
+	return ul
+}
+
+// challengePublicFromChallenge translates the database DTO to the public API
+// DTO.
+func challengePublicFromChallenge(ch *database.Challenge) ChallengePublic {
+	ttl := int(time.Until(ch.ExpiresAt).Round(time.Second) / time.Second)
+	if ttl < 0 {
+		ttl = 0
+	}
+	cp := ChallengePublic{
+		Challenge:  ch.Challenge,
+		ExpiresAt:  ch.ExpiresAt,
+		TTLSeconds: ttl,
+	}
+	if !ch.RetryAfter.IsZero() {
+		// Round up, so the caller doesn't retry too early.
+		cp.RetryAfter = int(math.Ceil(time.Until(ch.RetryAfter).Seconds()))
+		if cp.RetryAfter < 1 {
+			cp.RetryAfter = 1
+		}
+	}
+	return cp
+}
+
+// writeChallengeResponseError writes an error returned by
+// ValidateChallengeResponse. Expired challenges are reported with 410 Gone and
+// the ErrCodeChallengeExpired code, so clients know to request a new
+// challenge. All other errors are reported with the given status code.
+func (api *API) writeChallengeResponseError(w http.ResponseWriter, err error, code int) {
+	err = errors.AddContext(err, "failed to validate challenge response")
+	if errors.Contains(err, database.ErrChallengeExpired) {
+		api.WriteErrorWithCode(w, err, http.StatusGone, ErrCodeChallengeExpired)
+		return
 	}
+	api.WriteError(w, err, code)
 }
 
-// validateIP is a simple pass-through helper that returns valid IPs as they are
-// and returns an empty string for invalid IPs.
+// tierLimitsPublicFromTier translates the database DTO to the public API DTO,
+// converting the speeds from bytes to bits per second.
+func tierLimitsPublicFromTier(t database.TierLimits) TierLimitsPublic {
+	return TierLimitsPublic{
+		TierName:          t.TierName,
+		UploadBandwidth:   t.UploadBandwidth * 8,
+		DownloadBandwidth: t.DownloadBandwidth * 8,
+		MaxUploadSize:     t.MaxUploadSize,
+		MaxNumberUploads:  t.MaxNumberUploads,
+		RegistryDelay:     t.RegistryDelay,
+		Storage:           t.Storage,
+	}
+}
+
+// validateIP returns valid IPs in their canonical form and an empty string for
+// invalid IPs. IPv4-mapped IPv6 addresses, e.g. `::ffff:1.2.3.4`, are
+// returned as plain IPv4 addresses, so we always store the same IP the same
+// way.
 func validateIP(ip string) string {
-	if parsedIP := net.ParseIP(ip); parsedIP != nil {
-		return parsedIP.String()
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return ""
 	}
-	return ""
+	if ip4 := parsedIP.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return parsedIP.String()
+}
+
+// trackedIP returns the validated `ip` parameter of a tracked upload. Nginx
+// sets it to the uploader's IP, so a missing or invalid value usually means
+// it's misconfigured. We count those and, if TrackRequireValidIP is set,
+// reject the request with a 400 and return false. Otherwise, we log a rate
+// limited warning and track the upload without an IP.
+func (api *API) trackedIP(w http.ResponseWriter, req *http.Request) (string, bool) {
+	rawIP := req.FormValue("ip")
+	ip := validateIP(rawIP)
+	if ip != "" {
+		return ip, true
+	}
+	reason := metrics.TrackIPInvalid
+	if rawIP == "" {
+		reason = metrics.TrackIPMissing
+	}
+	metrics.TrackInvalidIPs.Inc(reason)
+	if TrackRequireValidIP {
+		api.WriteError(w, ErrInvalidTrackIP, http.StatusBadRequest)
+		return "", false
+	}
+	if ok, _ := api.staticTrackIPWarnLimiter.Allow(""); ok {
+		api.loggerFromContext(req.Context()).Warnf("Tracking an upload without an IP because its 'ip' parameter is %s: '%s'. Please check the Nginx configuration.", reason, rawIP)
+	}
+	return "", true
 }
@@ -3,8 +3,13 @@ package api
 import (
 	"fmt"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"gitlab.com/NebulousLabs/errors"
@@ -23,14 +28,25 @@ func TestUserGETFromUser(t *testing.T) {
 	}
 
 	u = &database.User{}
+	// Call with a user without an email. Expect their email to not be
+	// confirmed.
+	uGET = UserGETFromUser(u)
+	if uGET == nil {
+		t.Fatal("Unexpected nil.")
+	}
+	if uGET.EmailConfirmed || uGET.HasEmail {
+		t.Fatal("Expected EmailConfirmed and HasEmail to be false.")
+	}
+
 	// Call with a user without a confirmation token.
+	u.Email = "user@siasky.net"
 	u.EmailConfirmationToken = ""
 	uGET = UserGETFromUser(u)
 	if uGET == nil {
 		t.Fatal("Unexpected nil.")
 	}
-	if !uGET.EmailConfirmed {
-		t.Fatal("Expected EmailConfirmed to be true.")
+	if !uGET.EmailConfirmed || !uGET.HasEmail {
+		t.Fatal("Expected EmailConfirmed and HasEmail to be true.")
 	}
 
 	// Call with a user with a confirmation token.
@@ -42,6 +58,26 @@ func TestUserGETFromUser(t *testing.T) {
 	if uGET.EmailConfirmed {
 		t.Fatal("Expected EmailConfirmed to be false.")
 	}
+	if uGET.Subscription != nil {
+		t.Fatalf("Expected no subscription, got %+v", uGET.Subscription)
+	}
+
+	// Call with a user with a subscription.
+	u.Tier = database.TierPremium20
+	u.SubscriptionStatus = "active"
+	u.SubscribedUntil = time.Now().UTC().Add(time.Hour).Truncate(time.Millisecond)
+	u.SubscriptionCancelAtPeriodEnd = true
+	uGET = UserGETFromUser(u)
+	sub := uGET.Subscription
+	if sub == nil {
+		t.Fatal("Expected a subscription.")
+	}
+	if sub.Status != u.SubscriptionStatus || sub.TierID != u.Tier || sub.TierName != database.LimitsForTier(u.Tier).TierName {
+		t.Fatalf("Unexpected subscription %+v", sub)
+	}
+	if !sub.CurrentPeriodEnd.Equal(u.SubscribedUntil) || !sub.CancelAtPeriodEnd {
+		t.Fatalf("Unexpected subscription %+v", sub)
+	}
 }
 
 // TestUserLimitsGetFromTier ensures the proper functioning of
@@ -139,3 +175,78 @@ func TestUserLimitsGetFromTier(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestFetchPageSize ensures that fetchPageSize applies the default page size
+// and rejects page sizes outside of the allowed range.
+func TestFetchPageSize(t *testing.T) {
+	tests := []struct {
+		pageSize string
+		expected int
+		valid    bool
+	}{
+		{pageSize: "", expected: DefaultPageSizeSmall, valid: true},
+		{pageSize: "0", expected: DefaultPageSizeSmall, valid: true},
+		{pageSize: "1", expected: 1, valid: true},
+		{pageSize: strconv.Itoa(MaxPageSize), expected: MaxPageSize, valid: true},
+		{pageSize: strconv.Itoa(MaxPageSize + 1), valid: false},
+		{pageSize: "-1", valid: false},
+	}
+	for _, tt := range tests {
+		pageSize, err := fetchPageSize(url.Values{"pageSize": {tt.pageSize}}, DefaultPageSizeSmall)
+		if tt.valid && (err != nil || pageSize != tt.expected) {
+			t.Errorf("Expected page size %d for '%s', got %d and %v", tt.expected, tt.pageSize, pageSize, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Expected an error for '%s', got page size %d", tt.pageSize, pageSize)
+		}
+	}
+}
+
+// TestValidateIP ensures that validateIP returns valid IPs in their canonical
+// form and rejects invalid ones.
+func TestValidateIP(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":              "1.2.3.4",
+		"::ffff:1.2.3.4":       "1.2.3.4",
+		"::FFFF:10.0.0.1":      "10.0.0.1",
+		"2001:DB8:0:0:0:0:0:1": "2001:db8::1",
+		"::1":                  "::1",
+		"":                     "",
+		"1.2.3":                "",
+		"1.2.3.4:80":           "",
+		"not an ip":            "",
+	}
+	for in, expected := range tests {
+		if ip := validateIP(in); ip != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, in, ip)
+		}
+	}
+}
+
+// TestParseRequestBodyJSON ensures that parseRequestBodyJSON reports bodies
+// which exceed the limit set by withBodyLimit as ErrRequestBodyTooLarge.
+func TestParseRequestBodyJSON(t *testing.T) {
+	body := `{"email":"` + strings.Repeat("a", 100) + `@siasky.net"}`
+	var payload struct {
+		Email string `json:"email"`
+	}
+	// A body within the limit.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	err := parseRequestBodyJSON(http.MaxBytesReader(w, req.Body, int64(len(body))), &payload)
+	if err != nil || !strings.HasSuffix(payload.Email, "@siasky.net") {
+		t.Fatalf("Unexpected result '%s' and %v", payload.Email, err)
+	}
+	// A body over the limit.
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	err = parseRequestBodyJSON(http.MaxBytesReader(w, req.Body, int64(len(body)-1)), &payload)
+	if !errors.Contains(err, ErrRequestBodyTooLarge) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrRequestBodyTooLarge, err)
+	}
+	// Invalid JSON remains a regular error.
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not json"))
+	err = parseRequestBodyJSON(http.MaxBytesReader(w, req.Body, LimitBodySizeSmall), &payload)
+	if err == nil || requestBodyTooLarge(err) {
+		t.Fatalf("Expected a decoding error, got '%v'", err)
+	}
+}
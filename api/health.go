@@ -0,0 +1,139 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	// StripeModeAbsent is the Stripe mode we report when no Stripe key is
+	// configured.
+	StripeModeAbsent = "absent"
+	// StripeModeLive is the Stripe mode we report when we use a live key.
+	StripeModeLive = "live"
+	// StripeModeTest is the Stripe mode we report when we use a test key.
+	StripeModeTest = "test"
+
+	// emailSenderSlack is the extra time we give the email sender on top of
+	// its scan interval before we consider it stuck. Sending a batch of emails
+	// can take a while with slow SMTP servers.
+	emailSenderSlack = time.Minute
+)
+
+type (
+	// HealthComponent describes the health of a single component of the
+	// service.
+	HealthComponent struct {
+		Healthy bool   `json:"healthy"`
+		Details string `json:"details"`
+	}
+	// HealthFullGET is the response of GET /health/full
+	HealthFullGET struct {
+		// Healthy is false when any of the critical components (currently
+		// only the DB) is unhealthy.
+		Healthy     bool            `json:"healthy"`
+		DB          HealthComponent `json:"db"`
+		EmailSender HealthComponent `json:"emailSender"`
+		MetaFetcher HealthComponent `json:"metaFetcher"`
+		Schema      HealthComponent `json:"schema"`
+		Stripe      HealthComponent `json:"stripe"`
+	}
+)
+
+// healthFullGET returns the health of each of the service's components. It
+// responds with 503 when a critical component is unhealthy.
+func (api *API) healthFullGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	resp := HealthFullGET{
+		DB:          api.dbHealth(req),
+		EmailSender: api.emailSenderHealth(),
+		MetaFetcher: api.metaFetcherHealth(),
+		Schema:      api.schemaHealth(req),
+		Stripe:      HealthComponent{Healthy: true, Details: StripeMode()},
+	}
+	resp.Healthy = resp.DB.Healthy
+	status := http.StatusOK
+	if !resp.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	api.WriteJSONWithStatus(w, resp, status)
+}
+
+// dbHealth pings the DB and reports the latency.
+func (api *API) dbHealth(req *http.Request) HealthComponent {
+	start := time.Now()
+	err := api.staticDB.Ping(req.Context())
+	if err != nil {
+		return HealthComponent{Details: err.Error()}
+	}
+	return HealthComponent{
+		Healthy: true,
+		Details: fmt.Sprintf("ping took %dms", time.Since(start).Milliseconds()),
+	}
+}
+
+// emailSenderHealth reports whether the email sender has scanned the DB within
+// its last cycle.
+func (api *API) emailSenderHealth() HealthComponent {
+	if api.staticSender == nil {
+		return HealthComponent{Details: "not running"}
+	}
+	lastScan := api.staticSender.LastScan()
+	if lastScan.IsZero() {
+		return HealthComponent{Details: "has not scanned for emails yet"}
+	}
+	details := fmt.Sprintf("last scanned for emails at %s", lastScan.Format(time.RFC3339))
+	maxAge := 2*api.staticSender.ScanInterval() + emailSenderSlack
+	return HealthComponent{
+		Healthy: time.Since(lastScan) <= maxAge,
+		Details: details,
+	}
+}
+
+// metaFetcherHealth reports whether the metafetcher is processing its queue
+// and how many messages are waiting in it.
+func (api *API) metaFetcherHealth() HealthComponent {
+	if api.staticMF == nil {
+		return HealthComponent{Details: "not running"}
+	}
+	return HealthComponent{
+		Healthy: api.staticMF.Running(),
+		Details: fmt.Sprintf("%d messages in queue", api.staticMF.QueueLen()),
+	}
+}
+
+// schemaHealth reports whether the DB indexes match the declared schema and
+// lists the collections whose indexes don't.
+func (api *API) schemaHealth(req *http.Request) HealthComponent {
+	divs, err := api.staticDB.SchemaDivergences(req.Context())
+	if err != nil {
+		return HealthComponent{Details: err.Error()}
+	}
+	if len(divs) == 0 {
+		return HealthComponent{Healthy: true, Details: "indexes match the schema"}
+	}
+	colls := make([]string, 0, len(divs))
+	for collName, div := range divs {
+		colls = append(colls, fmt.Sprintf("%s (missing: %v, extra: %v)", collName, div.Missing, div.Extra))
+	}
+	sort.Strings(colls)
+	return HealthComponent{Details: "indexes differ from the schema: " + strings.Join(colls, ", ")}
+}
+
+// StripeMode returns the mode of the configured Stripe key, i.e. one of
+// StripeModeAbsent, StripeModeTest, or StripeModeLive.
+func StripeMode() string {
+	if stripe.Key == "" {
+		return StripeModeAbsent
+	}
+	if StripeTestMode() {
+		return StripeModeTest
+	}
+	return StripeModeLive
+}
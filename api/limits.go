@@ -0,0 +1,210 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// MaxBatchLimitsSkylinks is the maximum number of skylinks a caller can
+	// request the limits of with a single batch request.
+	MaxBatchLimitsSkylinks = 100
+)
+
+type (
+	// UserLimitsBatchPOST maps each of the requested skylinks to the limits
+	// which apply to a GET call to it.
+	UserLimitsBatchPOST map[string]UserLimitsBatchItem
+	// UserLimitsBatchItem holds either the limits which apply to a skylink or
+	// the reason we couldn't determine them.
+	UserLimitsBatchItem struct {
+		*UserLimitsGET
+		Error string `json:"error,omitempty"`
+	}
+)
+
+// userLimitsBatchPOST returns the speed limits which apply to GET calls to
+// each of the given skylinks. It's the batch version of userLimitsSkylinkGET
+// and it caches its results the same way. It fetches the caller's API key and
+// its owner at most once, regardless of the number of skylinks. Invalid
+// skylinks get an error entry instead of failing the whole batch.
+//
+// NOTE: This handler needs to use the noAuth middleware in order to be able to
+// optimise its calls to the DB and the use of caching.
+func (api *API) userLimitsBatchPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	// We read the body before touching the form, so the form parsing doesn't
+	// consume it.
+	var skylinks []string
+	err := parseRequestBodyJSON(req.Body, &skylinks)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(skylinks) > MaxBatchLimitsSkylinks {
+		api.WriteError(w, fmt.Errorf("too many skylinks, the maximum is %d", MaxBatchLimitsSkylinks), http.StatusBadRequest)
+		return
+	}
+	// inBytes is a flag indicating that the caller wants all bandwidth limits
+	// to be presented in bytes per second. The default behaviour is to present
+	// them in bits per second.
+	inBytes := strings.EqualFold(req.FormValue("unit"), "byte")
+	ctx := req.Context()
+	respAnon := userLimitsGetFromTier("", database.TierAnonymous, false, inBytes)
+	ak, akErr := apiKeyFromRequest(req)
+	if akErr != nil && !errors.Contains(akErr, ErrNoAPIKey) {
+		api.staticLogger.Debugf("Error while processing API key: %s", akErr)
+	}
+	// general holds the caller's limits when they don't use an API key.
+	var general *UserLimitsGET
+	// We fetch the API key and its owner only on the first cache miss.
+	var akr database.APIKeyRecord
+	var owner *database.User
+	var fetched bool
+
+	blocked := api.managedSkylinksBlocked(ctx, skylinks)
+
+	resp := make(UserLimitsBatchPOST, len(skylinks))
+	for _, skylink := range skylinks {
+		if _, exists := resp[skylink]; exists {
+			continue
+		}
+		if !database.ValidSkylink(skylink) {
+			resp[skylink] = UserLimitsBatchItem{Error: database.ErrInvalidSkylink.Error()}
+			continue
+		}
+		// MySky links get the first paid tier, see userLimitsSkylinkGET.
+		if _, ok := MyskyAllowlist[skylink]; ok {
+			resp[skylink] = UserLimitsBatchItem{UserLimitsGET: userLimitsGetFromTier("", database.TierPremium5, false, inBytes)}
+			continue
+		}
+		if _, ok := blocked[skylink]; ok {
+			resp[skylink] = UserLimitsBatchItem{UserLimitsGET: respAnon}
+			continue
+		}
+		// Without an API key the caller gets their general limits.
+		if errors.Contains(akErr, ErrNoAPIKey) {
+			if general == nil {
+				general = api.managedUserLimits(req, inBytes)
+			}
+			resp[skylink] = UserLimitsBatchItem{UserLimitsGET: general}
+			continue
+		}
+		if akErr != nil {
+			resp[skylink] = UserLimitsBatchItem{UserLimitsGET: respAnon}
+			continue
+		}
+		// Check the cache before hitting the database.
+		key := ak.String() + skylink
+		ce, ok := api.staticUserTierCache.Get(key)
+		if ok {
+			ce = api.managedRefreshQuotaExceeded(ctx, key, ce)
+			resp[skylink] = UserLimitsBatchItem{UserLimitsGET: userLimitsGetFromTier(ce.Sub, ce.EffectiveTier(), ce.QuotaExceeded, inBytes)}
+			continue
+		}
+		if !fetched {
+			fetched = true
+			akr, owner = api.managedAPIKeyOwner(ctx, ak)
+		}
+		if owner == nil || !akr.CoversSkylink(skylink) {
+			resp[skylink] = UserLimitsBatchItem{UserLimitsGET: respAnon}
+			continue
+		}
+		// Store the user in the cache with a custom key.
+		api.staticUserTierCache.Set(key, owner, apiKeyCacheTTL(akr))
+		resp[skylink] = UserLimitsBatchItem{UserLimitsGET: userLimitsGetFromTier(owner.Sub, owner.EffectiveTier(), owner.QuotaExceeded, inBytes)}
+	}
+	api.WriteJSON(w, resp)
+}
+
+// managedSkylinkBlocked reports whether the given skylink is blocked. It caches
+// the block status, so the limits endpoints don't hit the DB on every call.
+// Invalid skylinks are not blocked.
+func (api *API) managedSkylinkBlocked(ctx context.Context, skylink string) (bool, error) {
+	sl, err := database.NormalizeSkylink(skylink)
+	if err != nil {
+		return false, nil
+	}
+	if blocked, ok := api.staticSkylinkBlockedCache.Get(sl); ok {
+		return blocked, nil
+	}
+	blocked, err := api.staticDB.SkylinkBlocked(ctx, sl)
+	if err != nil {
+		return false, err
+	}
+	api.staticSkylinkBlockedCache.Set(sl, blocked)
+	return blocked, nil
+}
+
+// managedSkylinksBlocked returns the blocked skylinks among the given ones,
+// keyed as given. It serves the skylinks it can from the cache and fetches the
+// block status of the rest with a single query. If that query fails we treat
+// the remaining skylinks as not blocked, like userLimitsSkylinkGET does.
+func (api *API) managedSkylinksBlocked(ctx context.Context, skylinks []string) map[string]struct{} {
+	blocked := make(map[string]struct{})
+	// missing maps the normalized skylinks which aren't cached to the forms
+	// the caller gave us.
+	missing := make(map[string][]string)
+	for _, skylink := range skylinks {
+		sl, err := database.NormalizeSkylink(skylink)
+		if err != nil {
+			continue
+		}
+		b, ok := api.staticSkylinkBlockedCache.Get(sl)
+		if !ok {
+			missing[sl] = append(missing[sl], skylink)
+			continue
+		}
+		if b {
+			blocked[skylink] = struct{}{}
+		}
+	}
+	if len(missing) == 0 {
+		return blocked
+	}
+	query := make([]string, 0, len(missing))
+	for sl := range missing {
+		query = append(query, sl)
+	}
+	found, err := api.staticDB.SkylinksBlockedAmong(ctx, query)
+	if err != nil {
+		api.staticLogger.Debugf("Failed to check whether %d skylinks are blocked: %s", len(query), err)
+		return blocked
+	}
+	for sl, forms := range missing {
+		_, b := found[sl]
+		api.staticSkylinkBlockedCache.Set(sl, b)
+		if !b {
+			continue
+		}
+		for _, skylink := range forms {
+			blocked[skylink] = struct{}{}
+		}
+	}
+	return blocked
+}
+
+// managedAPIKeyOwner fetches the given API key and the user it belongs to. It
+// returns a nil user if either doesn't exist or the user is deleted.
+func (api *API) managedAPIKeyOwner(ctx context.Context, ak *database.APIKey) (database.APIKeyRecord, *database.User) {
+	akr, err := api.staticDB.APIKeyByKey(ctx, ak.String())
+	if err != nil {
+		api.staticLogger.Trace("API key doesn't exist in the database.")
+		return database.APIKeyRecord{}, nil
+	}
+	u, err := api.staticDB.UserByID(ctx, akr.UserID)
+	if err != nil {
+		api.staticLogger.Tracef("Failed to get user for user ID: %v", err)
+		return akr, nil
+	}
+	if u.Deleted() || u.Suspended {
+		api.staticLogger.Trace("API key belongs to a deleted or suspended user.")
+		return akr, nil
+	}
+	return akr, u
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/metrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// routeUnmatched is the route label we use for requests which don't
+	// match any of our routes. We don't use the request's path, so random
+	// requests can't blow up the number of series we track.
+	routeUnmatched = "unmatched"
+)
+
+type (
+	// statusWriter is an http.ResponseWriter which remembers the status code
+	// written by the handler.
+	statusWriter struct {
+		http.ResponseWriter
+		status int
+	}
+)
+
+// WriteHeader implements http.ResponseWriter.
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// metricsGET returns the service's metrics in the Prometheus text format.
+// The endpoint doesn't require authentication, so it only exposes aggregate
+// data.
+func (api *API) metricsGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	// Refresh the metrics we sample instead of tracking continuously. Failed
+	// pings are reported by the health endpoint, here we only care about
+	// their latency.
+	_ = api.staticDB.Ping(req.Context())
+	if api.staticMF != nil {
+		metrics.MetafetcherQueueDepth.Set(float64(api.staticMF.QueueLen()))
+	}
+	// Render the metrics into a buffer first, so a slow client can't hold
+	// the metrics' locks.
+	var buf bytes.Buffer
+	err := metrics.DefaultRegistry.WriteText(&buf)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		api.staticLogger.Debugln("Failed to write metrics:", err)
+	}
+}
+
+// recordRequestMetrics records the status and duration of a served request.
+func recordRequestMetrics(route, method string, status int, duration time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	metrics.HTTPRequests.Inc(route, method, strconv.Itoa(status))
+	metrics.HTTPRequestDuration.Observe(duration.Seconds(), route, method)
+}
+
+// routePattern returns the pattern of the route which matches the given
+// request, e.g. `/user/uploads/:skylink`, or routeUnmatched if there is none.
+func (api *API) routePattern(req *http.Request) string {
+	h, ps, _ := api.staticRouter.Lookup(req.Method, req.URL.Path)
+	if h == nil {
+		return routeUnmatched
+	}
+	// Replace the values of the parameters with their names. We go backwards,
+	// so a parameter value which matches an earlier static segment doesn't
+	// get replaced in the wrong place.
+	segments := strings.Split(req.URL.Path, "/")
+	i := len(segments) - 1
+	for j := len(ps) - 1; j >= 0; j-- {
+		for ; i >= 0; i-- {
+			if segments[i] == ps[j].Value {
+				segments[i] = ":" + ps[j].Key
+				i--
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestRoutePattern ensures that we report the pattern of the matched route
+// instead of the request's path.
+func TestRoutePattern(t *testing.T) {
+	noop := func(http.ResponseWriter, *http.Request, httprouter.Params) {}
+	api := &API{staticRouter: httprouter.New()}
+	api.staticRouter.GET("/user", noop)
+	api.staticRouter.GET("/user/uploads/:skylink", noop)
+	api.staticRouter.POST("/user/uploads/:skylink/share", noop)
+	api.staticRouter.DELETE("/user/pubkey/:pubKey", noop)
+
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{method: http.MethodGet, path: "/user", expected: "/user"},
+		{method: http.MethodGet, path: "/user/uploads/abc", expected: "/user/uploads/:skylink"},
+		{method: http.MethodPost, path: "/user/uploads/abc/share", expected: "/user/uploads/:skylink/share"},
+		// A parameter value which matches a static segment.
+		{method: http.MethodDelete, path: "/user/pubkey/user", expected: "/user/pubkey/:pubKey"},
+		// Unknown paths and methods.
+		{method: http.MethodGet, path: "/random/path", expected: routeUnmatched},
+		{method: http.MethodPut, path: "/user", expected: routeUnmatched},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if p := api.routePattern(req); p != tt.expected {
+			t.Errorf("Expected pattern '%s' for %s %s, got '%s'", tt.expected, tt.method, tt.path, p)
+		}
+	}
+}
+
+// TestStatusWriter ensures that statusWriter remembers the first status code
+// written to it.
+func TestStatusWriter(t *testing.T) {
+	sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	_, _ = sw.Write([]byte("ok"))
+	sw.WriteHeader(http.StatusNotFound)
+	if sw.status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, sw.status)
+	}
+	sw = &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	sw.WriteHeader(http.StatusTeapot)
+	if sw.status != http.StatusTeapot {
+		t.Fatalf("Expected status %d, got %d", http.StatusTeapot, sw.status)
+	}
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	accountsbuild "github.com/SkynetLabs/skynet-accounts/build"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// openAPIVersion is the version of the OpenAPI specification our
+	// document follows.
+	openAPIVersion = "3.0.3"
+)
+
+var (
+	// typeTime, typeJSONMarshaler and typeTextMarshaler are the types we need
+	// to recognise when we reflect the schemas of request and response types.
+	typeTime          = reflect.TypeOf(time.Time{})
+	typeJSONMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+type (
+	// openAPIDocument is an OpenAPI 3 document which describes our routes.
+	openAPIDocument struct {
+		OpenAPI    string                                 `json:"openapi"`
+		Info       openAPIInfo                            `json:"info"`
+		Paths      map[string]map[string]openAPIOperation `json:"paths"`
+		Components openAPIComponents                      `json:"components"`
+	}
+
+	// openAPIInfo describes the API.
+	openAPIInfo struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	}
+
+	// openAPIComponents holds the schemas of our request and response types
+	// and the ways callers can authenticate.
+	openAPIComponents struct {
+		Schemas         map[string]*openAPISchema        `json:"schemas"`
+		SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+	}
+
+	// openAPIOperation describes a single method of a path.
+	openAPIOperation struct {
+		Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+		RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+		Responses   map[string]openAPIResponse `json:"responses"`
+		Security    []map[string][]string      `json:"security,omitempty"`
+	}
+
+	// openAPIParameter describes a path parameter.
+	openAPIParameter struct {
+		Name     string         `json:"name"`
+		In       string         `json:"in"`
+		Required bool           `json:"required"`
+		Schema   *openAPISchema `json:"schema"`
+	}
+
+	// openAPIRequestBody describes a JSON request body.
+	openAPIRequestBody struct {
+		Required bool                        `json:"required"`
+		Content  map[string]openAPIMediaType `json:"content"`
+	}
+
+	// openAPIResponse describes a response.
+	openAPIResponse struct {
+		Description string                      `json:"description"`
+		Content     map[string]openAPIMediaType `json:"content,omitempty"`
+	}
+
+	// openAPIMediaType holds the schema of a request or response body.
+	openAPIMediaType struct {
+		Schema *openAPISchema `json:"schema"`
+	}
+
+	// openAPISchema is the subset of a JSON schema we can reflect from Go
+	// types.
+	openAPISchema struct {
+		Ref                  string                    `json:"$ref,omitempty"`
+		Type                 string                    `json:"type,omitempty"`
+		Format               string                    `json:"format,omitempty"`
+		Items                *openAPISchema            `json:"items,omitempty"`
+		Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+		AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+		OneOf                []*openAPISchema          `json:"oneOf,omitempty"`
+	}
+
+	// openAPISecurityScheme describes a way to authenticate.
+	openAPISecurityScheme struct {
+		Type         string `json:"type"`
+		Scheme       string `json:"scheme,omitempty"`
+		BearerFormat string `json:"bearerFormat,omitempty"`
+		In           string `json:"in,omitempty"`
+		Name         string `json:"name,omitempty"`
+	}
+
+	// openAPISchemas reflects the schemas of Go types and collects the ones
+	// of named structs, so we can refer to them.
+	openAPISchemas struct {
+		schemas map[string]*openAPISchema
+		names   map[reflect.Type]string
+	}
+)
+
+// openAPIGET returns the OpenAPI document which describes our routes.
+func (api *API) openAPIGET(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	api.WriteJSON(w, api.staticOpenAPI)
+}
+
+// openAPIFromRoutes builds the OpenAPI document which describes the given
+// routes, skipping the internal ones.
+func openAPIFromRoutes(routes []route) openAPIDocument {
+	version := accountsbuild.GitRevision
+	if version == "" {
+		version = "dev"
+	}
+	doc := openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:   "Skynet Accounts API",
+			Version: version,
+		},
+		Paths: make(map[string]map[string]openAPIOperation),
+		Components: openAPIComponents{
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"cookie":   {Type: "apiKey", In: "cookie", Name: CookieName},
+				"bearer":   {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+				"apiKey":   {Type: "apiKey", In: "header", Name: APIKeyHeader},
+				"adminKey": {Type: "apiKey", In: "header", Name: AdminAPIKeyHeader},
+			},
+		},
+	}
+	schemas := &openAPISchemas{
+		schemas: make(map[string]*openAPISchema),
+		names:   make(map[reflect.Type]string),
+	}
+	errSchema := schemas.schemaOf(reflect.TypeOf(errorWrap{}))
+	for _, r := range routes {
+		if r.internal {
+			continue
+		}
+		p, params := openAPIPath(r.path)
+		op := openAPIOperation{
+			Parameters: params,
+			Responses: map[string]openAPIResponse{
+				"default": {
+					Description: "Error",
+					Content:     map[string]openAPIMediaType{"application/json": {Schema: errSchema}},
+				},
+			},
+			Security: openAPISecurity(r.auth),
+		}
+		if r.request != nil {
+			op.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{"application/json": {Schema: schemas.requestSchema(r.request)}},
+			}
+		}
+		switch r.response.(type) {
+		case nil:
+			op.Responses["2XX"] = openAPIResponse{Description: "Success"}
+		case noContent:
+			op.Responses["204"] = openAPIResponse{Description: "No Content"}
+		default:
+			op.Responses["200"] = openAPIResponse{
+				Description: "OK",
+				Content:     map[string]openAPIMediaType{"application/json": {Schema: schemas.schemaOf(reflect.TypeOf(r.response))}},
+			}
+		}
+		if doc.Paths[p] == nil {
+			doc.Paths[p] = make(map[string]openAPIOperation)
+		}
+		doc.Paths[p][strings.ToLower(r.method)] = op
+	}
+	doc.Components.Schemas = schemas.schemas
+	return doc
+}
+
+// openAPIPath converts an httprouter path, e.g. `/user/apikeys/:id`, into an
+// OpenAPI one, e.g. `/user/apikeys/{id}`, and returns its parameters.
+func openAPIPath(routerPath string) (string, []openAPIParameter) {
+	var params []openAPIParameter
+	parts := strings.Split(routerPath, "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, ":") && !strings.HasPrefix(part, "*") {
+			continue
+		}
+		name := part[1:]
+		parts[i] = "{" + name + "}"
+		params = append(params, openAPIParameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   &openAPISchema{Type: "string"},
+		})
+	}
+	return strings.Join(parts, "/"), params
+}
+
+// openAPISecurity returns the ways a caller can authenticate with a route
+// which requires the given authentication.
+func openAPISecurity(auth routeAuth) []map[string][]string {
+	switch auth {
+	case authNone:
+		return nil
+	case authUser:
+		return []map[string][]string{{"cookie": {}}, {"bearer": {}}}
+	case authUserOrAPIKey:
+		return []map[string][]string{{"cookie": {}}, {"bearer": {}}, {"apiKey": {}}}
+	case authAdmin:
+		return []map[string][]string{{"adminKey": {}}}
+	}
+	return nil
+}
+
+// requestSchema returns the schema of the given request body. A list of
+// bodies results in a schema which accepts any of them.
+func (s *openAPISchemas) requestSchema(req interface{}) *openAPISchema {
+	alternatives, ok := req.([]interface{})
+	if !ok {
+		return s.schemaOf(reflect.TypeOf(req))
+	}
+	schema := &openAPISchema{}
+	for _, alt := range alternatives {
+		schema.OneOf = append(schema.OneOf, s.schemaOf(reflect.TypeOf(alt)))
+	}
+	return schema
+}
+
+// schemaOf reflects the JSON schema of the given type. Named structs get a
+// reference to their schema in the document's components.
+func (s *openAPISchemas) schemaOf(t reflect.Type) *openAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == typeTime:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case t.Implements(typeTextMarshaler) || reflect.PtrTo(t).Implements(typeTextMarshaler):
+		return &openAPISchema{Type: "string"}
+	case t.Implements(typeJSONMarshaler) || reflect.PtrTo(t).Implements(typeJSONMarshaler):
+		// We can't tell what the custom encoding looks like, unless it's
+		// a string type.
+		if t.Kind() == reflect.String {
+			return &openAPISchema{Type: "string"}
+		}
+		return &openAPISchema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Byte slices are encoded as strings.
+			return &openAPISchema{Type: "string"}
+		}
+		return &openAPISchema{Type: "array", Items: s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		name, exists := s.names[t]
+		if !exists {
+			name = s.schemaName(t)
+			s.names[t] = name
+			// Register the name before we reflect the fields, so recursive
+			// types refer to themselves.
+			s.schemas[name] = &openAPISchema{}
+			*s.schemas[name] = *s.structSchema(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	default:
+		return &openAPISchema{}
+	}
+}
+
+// schemaName returns a unique name for the schema of the given named type. We
+// prefix it with its package's name if another type has the same name.
+func (s *openAPISchemas) schemaName(t reflect.Type) string {
+	name := t.Name()
+	if _, taken := s.schemas[name]; taken {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+	return name
+}
+
+// structSchema reflects the schema of the given struct type. It follows the
+// rules of encoding/json, so fields of embedded structs are promoted and
+// fields tagged with `json:"-"` are skipped.
+func (s *openAPISchemas) structSchema(t reflect.Type) *openAPISchema {
+	schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			embedded := s.structSchema(ft)
+			for k, v := range embedded.Properties {
+				if _, exists := schema.Properties[k]; !exists {
+					schema.Properties[k] = v
+				}
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		schema.Properties[name] = s.schemaOf(f.Type)
+	}
+	return schema
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestOpenAPI ensures that GET /openapi.json serves a valid JSON document
+// which describes our main routes with their methods, authentication, and
+// request and response types.
+func TestOpenAPI(t *testing.T) {
+	api := &API{staticRouter: httprouter.New(), staticLogger: logrus.New()}
+	api.buildHTTPRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+	var doc struct {
+		OpenAPI string                                       `json:"openapi"`
+		Paths   map[string]map[string]map[string]interface{} `json:"paths"`
+		Comps   struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatal("Invalid JSON:", err)
+	}
+	if doc.OpenAPI != openAPIVersion {
+		t.Fatalf("Expected OpenAPI version %s, got '%s'", openAPIVersion, doc.OpenAPI)
+	}
+
+	expected := map[string][]string{
+		"/user":                     {"get", "post", "put", "delete"},
+		"/user/limits":              {"get"},
+		"/user/uploads":             {"get"},
+		"/user/uploads-bulk-delete": {"post"},
+		"/user/uploads/{skylink}":   {"delete"},
+		"/login":                    {"get", "post"},
+		"/login/2fa":                {"post"},
+		"/register":                 {"get", "post"},
+		"/register/availability":    {"get"},
+		"/track/upload/{skylink}":   {"post"},
+		"/track/download/{skylink}": {"post"},
+		"/track/registry/read":      {"post"},
+		"/track/registry/write":     {"post"},
+		"/user/apikeys":             {"get", "post"},
+		"/user/apikeys/{id}":        {"get", "put", "patch", "delete"},
+		"/user/apikeys/{id}/usage":  {"get"},
+		"/user/apikeys/{id}/rotate": {"post"},
+	}
+	for p, methods := range expected {
+		ops, exists := doc.Paths[p]
+		if !exists {
+			t.Fatalf("Expected path %s", p)
+		}
+		if len(ops) != len(methods) {
+			t.Fatalf("Expected methods %v for %s, got %v", methods, p, ops)
+		}
+		for _, m := range methods {
+			if _, exists = ops[m]; !exists {
+				t.Fatalf("Expected method %s for %s", m, p)
+			}
+		}
+	}
+	// Internal routes are not part of the document.
+	if _, exists := doc.Paths["/internal/changes"]; exists {
+		t.Fatal("Expected no internal routes")
+	}
+
+	// Authenticated routes list their security requirements and the ones
+	// with typed bodies refer to their schemas.
+	if _, exists := doc.Paths["/user"]["get"]["security"]; !exists {
+		t.Fatal("Expected GET /user to require authentication")
+	}
+	if _, exists := doc.Paths["/login"]["get"]["security"]; exists {
+		t.Fatal("Expected GET /login to not require authentication")
+	}
+	for _, name := range []string{"UserGET", "UploadsGET", "UserLimitsGET", "APIKeyResponse", "APIKeyPOST"} {
+		if _, exists := doc.Comps.Schemas[name]; !exists {
+			t.Fatalf("Expected schema %s", name)
+		}
+	}
+	b, err := json.Marshal(doc.Paths["/user/apikeys"]["post"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var op struct {
+		RequestBody struct {
+			Content map[string]struct {
+				Schema openAPISchema `json:"schema"`
+			} `json:"content"`
+		} `json:"requestBody"`
+	}
+	err = json.Unmarshal(b, &op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := op.RequestBody.Content["application/json"].Schema.Ref; ref != "#/components/schemas/APIKeyPOST" {
+		t.Fatalf("Unexpected request schema '%s'", ref)
+	}
+}
+
+// TestOpenAPISchema ensures that we reflect the JSON schemas of our types the
+// way encoding/json encodes them.
+func TestOpenAPISchema(t *testing.T) {
+	type inner struct {
+		Count int `json:"count"`
+	}
+	type outer struct {
+		*inner
+		Name    string            `json:"name"`
+		Skipped string            `json:"-"`
+		Tags    []string          `json:"tags,omitempty"`
+		Raw     []byte            `json:"raw"`
+		Meta    map[string]uint64 `json:"meta"`
+		Self    *outer            `json:"self"`
+		hidden  string
+	}
+	s := &openAPISchemas{
+		schemas: make(map[string]*openAPISchema),
+		names:   make(map[reflect.Type]string),
+	}
+	ref := s.schemaOf(reflect.TypeOf(&outer{hidden: "unused"}))
+	if ref.Ref != "#/components/schemas/outer" {
+		t.Fatalf("Expected a reference to outer, got %+v", ref)
+	}
+	schema := s.schemas["outer"]
+	if schema == nil || schema.Type != "object" {
+		t.Fatalf("Unexpected schema %+v", schema)
+	}
+	expected := map[string]openAPISchema{
+		"count": {Type: "integer"},
+		"name":  {Type: "string"},
+		"tags":  {Type: "array", Items: &openAPISchema{Type: "string"}},
+		"raw":   {Type: "string"},
+		"meta":  {Type: "object", AdditionalProperties: &openAPISchema{Type: "integer", Format: "int64"}},
+		"self":  {Ref: "#/components/schemas/outer"},
+	}
+	if len(schema.Properties) != len(expected) {
+		t.Fatalf("Expected properties %v, got %v", expected, schema.Properties)
+	}
+	for name, exp := range expected {
+		if p := schema.Properties[name]; p == nil || !reflect.DeepEqual(*p, exp) {
+			t.Fatalf("Expected property %s to be %+v, got %+v", name, exp, p)
+		}
+	}
+	// Times and types with a text encoding are strings.
+	if ts := s.schemaOf(reflect.TypeOf(time.Time{})); ts.Type != "string" || ts.Format != "date-time" {
+		t.Fatalf("Unexpected schema of time.Time %+v", ts)
+	}
+	if id := s.schemaOf(reflect.TypeOf(primitive.ObjectID{})); id.Type != "string" {
+		t.Fatalf("Unexpected schema of an ObjectID %+v", id)
+	}
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxOrgNameLength is the longest organization name we accept, in
+	// characters.
+	maxOrgNameLength = 100
+)
+
+var (
+	// ErrNotOrgOwner is returned when a member of an organization who isn't
+	// its owner tries to manage it.
+	ErrNotOrgOwner = errors.New("only the owner of the organization can do this")
+)
+
+type (
+	// OrgPOST describes the body of a POST /org request.
+	OrgPOST struct {
+		Name string `json:"name"`
+	}
+	// OrgInvitePOST describes the body of a POST /org/:id/invites request.
+	OrgInvitePOST struct {
+		Email types.Email `json:"email"`
+	}
+	// OrgGET describes an organization and its members.
+	OrgGET struct {
+		database.Organization
+		Members []OrgMemberGET `json:"members"`
+	}
+	// OrgMemberGET describes a member of an organization.
+	OrgMemberGET struct {
+		Sub   string      `json:"sub"`
+		Email types.Email `json:"email"`
+		Owner bool        `json:"owner"`
+	}
+	// OrgUsageGET describes the pooled usage of an organization and the
+	// usage of each of its members. Skylinks uploaded by several members
+	// count once towards the pooled usage but once per member towards the
+	// members' usage.
+	OrgUsageGET struct {
+		TierID           int                 `json:"tierID"`
+		TierName         string              `json:"tierName"`
+		QuotaExceeded    bool                `json:"quotaExceeded"`
+		NumUploads       int64               `json:"numUploads"`
+		UploadsSize      int64               `json:"uploadsSize"`
+		MaxNumberUploads int                 `json:"maxNumberUploads"`
+		Storage          int64               `json:"storage"`
+		Members          []OrgMemberUsageGET `json:"members"`
+	}
+	// OrgMemberUsageGET describes the usage of a member of an organization.
+	OrgMemberUsageGET struct {
+		Sub         string      `json:"sub"`
+		Email       types.Email `json:"email"`
+		NumUploads  int64       `json:"numUploads"`
+		UploadsSize int64       `json:"uploadsSize"`
+	}
+)
+
+// orgPOST creates a new organization owned by the current user. The user
+// becomes its first member. New organizations are on the free tier until an
+// admin assigns them another one.
+func (api *API) orgPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body OrgPOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxOrgNameLength {
+		api.WriteError(w, fmt.Errorf("the name needs to be between 1 and %d characters long", maxOrgNameLength), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	org, err := api.staticDB.OrgCreate(ctx, u, name)
+	if errors.Contains(err, database.ErrUserInOrg) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.Invalidate(u.Sub)
+	api.WriteJSON(w, OrgGET{Organization: *org, Members: []OrgMemberGET{orgMemberGET(org, u)}})
+	// The user's uploads now count against the organization's quota.
+	// Note that this call is not affected by the request's context, so we use
+	// a separate one.
+	go api.checkUserQuotas(context.Background(), u)
+}
+
+// orgGET returns the given organization and its members. Only its members
+// can see it.
+func (api *API) orgGET(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	org, ok := api.managedOrgOfUser(u, w, req, ps, false)
+	if !ok {
+		return
+	}
+	members, err := api.staticDB.OrgMembers(req.Context(), org.ID)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp := OrgGET{Organization: *org, Members: make([]OrgMemberGET, 0, len(members))}
+	for _, m := range members {
+		resp.Members = append(resp.Members, orgMemberGET(org, m))
+	}
+	api.WriteJSON(w, resp)
+}
+
+// orgInvitesPOST invites the given email address to join the organization.
+// Only the owner can invite new members. Inviting the same address again
+// replaces the previous invite.
+func (api *API) orgInvitesPOST(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	org, ok := api.managedOrgOfUser(u, w, req, ps, true)
+	if !ok {
+		return
+	}
+	var body OrgInvitePOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	email, err := types.NormalizeEmail(body.Email.String())
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	token, err := api.staticDB.OrgInviteCreate(ctx, org, email)
+	if errors.Contains(err, database.ErrOrgInviteLimitReached) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticMailer.SendOrgInviteEmail(ctx, email, token, u.Locale)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to send the invite"), http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// orgInvitesAcceptGET adds the user the invite with the given token was sent
+// to to the organization which sent it. Like the email confirmation link, the
+// token proves that the caller owns the invited email address, so the caller
+// doesn't need to be logged in.
+func (api *API) orgInvitesAcceptGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	org, u, err := api.staticDB.OrgInviteAccept(ctx, req.Form.Get("token"))
+	if errors.Contains(err, database.ErrInvalidToken) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, errors.AddContext(err, "please create an account with the invited email address first"), http.StatusNotFound)
+		return
+	}
+	if errors.Contains(err, database.ErrUserInOrg) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.Invalidate(u.Sub)
+	api.WriteJSON(w, OrgGET{Organization: *org, Members: []OrgMemberGET{orgMemberGET(org, u)}})
+	// The user's uploads now count against the organization's quota.
+	// Note that this call is not affected by the request's context, so we use
+	// a separate one.
+	go api.checkUserQuotas(context.Background(), u)
+}
+
+// orgMemberDELETE removes the given member from the organization. Only the
+// owner can remove members and they can't remove themselves.
+func (api *API) orgMemberDELETE(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	org, ok := api.managedOrgOfUser(u, w, req, ps, true)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	m, err := api.staticDB.UserBySub(ctx, ps.ByName("sub"))
+	if errors.Contains(err, database.ErrUserNotFound) || (err == nil && m.OrgID != org.ID) {
+		api.WriteError(w, errors.New("member not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if m.ID == org.OwnerID {
+		api.WriteError(w, errors.New("the owner can't leave the organization"), http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.OrgMemberRemove(ctx, org, m)
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, errors.New("member not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.Invalidate(m.Sub)
+	api.WriteSuccess(w)
+	// The former member's own quota applies to them again and the
+	// organization's pooled usage dropped.
+	// Note that these calls are not affected by the request's context, so we
+	// use a separate one.
+	go func() {
+		ctx := context.Background()
+		api.checkUserQuotas(ctx, m)
+		api.checkUserQuotas(ctx, u)
+	}()
+}
+
+// orgUsageGET returns the pooled usage of the organization and the usage of
+// each of its members. Only its members can see it.
+func (api *API) orgUsageGET(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	org, ok := api.managedOrgOfUser(u, w, req, ps, false)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	members, err := api.staticDB.OrgMembers(ctx, org.ID)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	quota := database.LimitsForTier(org.Tier)
+	resp := OrgUsageGET{
+		TierID:           org.Tier,
+		TierName:         quota.TierName,
+		QuotaExceeded:    org.QuotaExceeded,
+		MaxNumberUploads: quota.MaxNumberUploads,
+		Storage:          quota.Storage,
+		Members:          make([]OrgMemberUsageGET, 0, len(members)),
+	}
+	memberIDs := make([]primitive.ObjectID, 0, len(members))
+	for _, m := range members {
+		stats, err := api.staticDB.UserStatsUpload(ctx, m.ID, time.Time{})
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		resp.Members = append(resp.Members, OrgMemberUsageGET{
+			Sub:         m.Sub,
+			Email:       m.Email,
+			NumUploads:  stats.CountTotal,
+			UploadsSize: stats.SizeTotal,
+		})
+		memberIDs = append(memberIDs, m.ID)
+	}
+	stats, err := api.staticDB.OrgStatsUpload(ctx, memberIDs, time.Time{})
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp.NumUploads = stats.CountTotal
+	resp.UploadsSize = stats.SizeTotal
+	api.WriteJSON(w, resp)
+}
+
+// managedOrgOfUser fetches the organization with the ID given in the request
+// and makes sure the user is a member or, if ownerOnly is set, its owner. We
+// don't reveal the existence of organizations to users who aren't members.
+// It writes an error response and returns false on failure.
+func (api *API) managedOrgOfUser(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params, ownerOnly bool) (*database.Organization, bool) {
+	orgID, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+	if u.OrgID != orgID {
+		api.WriteError(w, database.ErrOrgNotFound, http.StatusNotFound)
+		return nil, false
+	}
+	org, err := api.staticDB.OrgByID(req.Context(), orgID)
+	if errors.Contains(err, database.ErrOrgNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	if ownerOnly && org.OwnerID != u.ID {
+		api.WriteError(w, ErrNotOrgOwner, http.StatusForbidden)
+		return nil, false
+	}
+	return org, true
+}
+
+// managedOrgStatsUpload reports on the pooled uploads of all members of the
+// given organization.
+func (api *API) managedOrgStatsUpload(ctx context.Context, orgID primitive.ObjectID) (database.UserStatsUpload, error) {
+	members, err := api.staticDB.OrgMembers(ctx, orgID)
+	if err != nil {
+		return database.UserStatsUpload{}, errors.AddContext(err, "failed to fetch the organization's members")
+	}
+	memberIDs := make([]primitive.ObjectID, 0, len(members))
+	for _, m := range members {
+		memberIDs = append(memberIDs, m.ID)
+	}
+	return api.staticDB.OrgStatsUpload(ctx, memberIDs, time.Time{})
+}
+
+// managedSetOrgQuotaExceeded sets the QuotaExceeded flag of the given
+// organization and of its members and drops their cache entries. We only
+// notify the owner about the change.
+func (api *API) managedSetOrgQuotaExceeded(ctx context.Context, orgID primitive.ObjectID, quotaExceeded bool, upStats database.UserStatsUpload, quota database.TierLimits) error {
+	org, err := api.staticDB.OrgByID(ctx, orgID)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch organization")
+	}
+	err = api.staticDB.OrgSetQuotaExceeded(ctx, org, quotaExceeded, quotaUsage(upStats, quota))
+	if err != nil {
+		return err
+	}
+	api.managedInvalidateOrg(ctx, org, func(m *database.User) {
+		api.staticDB.RecordQuotaExceededChange(ctx, m.Sub, quotaExceeded)
+		if m.ID == org.OwnerID {
+			m.QuotaExceeded = quotaExceeded
+			api.managedNotifyQuotaChange(ctx, m, upStats, quota)
+		}
+	})
+	return nil
+}
+
+// managedInvalidateOrg drops the cache entries of all members of the given
+// organization and calls the given function, if any, for each of them.
+func (api *API) managedInvalidateOrg(ctx context.Context, org *database.Organization, fn func(*database.User)) {
+	members, err := api.staticDB.OrgMembers(ctx, org.ID)
+	if err != nil {
+		api.staticLogger.Warnf("Failed to fetch the members of organization %s: %s", org.ID.Hex(), err)
+		return
+	}
+	for _, m := range members {
+		api.staticUserTierCache.Invalidate(m.Sub)
+		if fn != nil {
+			fn(m)
+		}
+	}
+}
+
+// orgMemberGET describes the given member of the given organization.
+func orgMemberGET(org *database.Organization, m *database.User) OrgMemberGET {
+	return OrgMemberGET{
+		Sub:   m.Sub,
+		Email: m.Email,
+		Owner: m.ID == org.OwnerID,
+	}
+}
@@ -21,7 +21,7 @@ type (
 func (api *API) promoterSetTierPOST(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	sub := ps.ByName("sub")
 	var body PromoterSetTierPOST
-	err := parseRequestBodyJSON(req.Body, LimitBodySizeLarge, &body)
+	err := parseRequestBodyJSON(req.Body, &body)
 	if err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
@@ -36,10 +36,13 @@ func (api *API) promoterSetTierPOST(_ *database.User, w http.ResponseWriter, req
 		api.WriteError(w, err, http.StatusNotFound)
 		return
 	}
+	oldTier := u.Tier
 	err = api.staticDB.UserSetTier(ctx, u, body.Tier)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.staticUserTierCache.Invalidate(u.Sub)
+	api.auditLog(req, u.ID, database.AuditActionTierChange, tierChangeMetadata(oldTier, body.Tier, "promoter"))
 	api.WriteSuccess(w)
 }
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// quotaSweepLockName is the name of the lock which makes sure that only
+	// one accounts instance sweeps the quotas at a time.
+	quotaSweepLockName = "quota_sweep"
+	// quotaSweepLockTTL defines how long the lock lasts unless extended. We
+	// extend it each time we report progress, so it only expires when the
+	// instance holding it dies mid-sweep.
+	quotaSweepLockTTL = 15 * time.Minute
+	// quotaSweepProgressInterval is the number of users we check between two
+	// progress reports.
+	quotaSweepProgressInterval = 1000
+	// quotaSweepBatchSize is the number of users over quota we load at a time
+	// during a sweep.
+	quotaSweepBatchSize = 100
+	// skylinkRecheckBatchSize is the number of users we load at a time when
+	// we recheck the quotas of everyone who pinned a skylink.
+	skylinkRecheckBatchSize = 100
+	// skylinkRecheckQueueSize is the number of resolved skylinks whose
+	// uploaders can wait for a recheck. We drop the rest and leave them to
+	// the quota sweep.
+	skylinkRecheckQueueSize = 1000
+)
+
+var (
+	// QuotaSweepInterval defines how often we sweep the users whose quota is
+	// exceeded and recheck it. This catches the users whose usage dropped
+	// without them uploading or unpinning anything, e.g. because an admin
+	// purged their files. Sweeping is disabled when it's zero. This value is
+	// configurable via the ACCOUNTS_QUOTA_SWEEP_MINUTES environment variable.
+	QuotaSweepInterval = build.Select(
+		build.Var{
+			Dev:      10 * time.Minute,
+			Testing:  time.Minute,
+			Standard: time.Hour,
+		},
+	).(time.Duration)
+	// QuotaSweepDryRun makes the quota sweeps log the changes they would make
+	// instead of making them. This value is configurable via the
+	// ACCOUNTS_QUOTA_SWEEP_DRY_RUN environment variable.
+	QuotaSweepDryRun = false
+)
+
+type (
+	// skylinkRecheck describes a skylink whose uploaders need their quotas
+	// rechecked because we learned its size.
+	skylinkRecheck struct {
+		ctx       context.Context
+		skylinkID primitive.ObjectID
+		size      int64
+	}
+)
+
+// StartQuotaSweeper periodically sweeps the users whose quota is exceeded and
+// rechecks it, until the given context is closed. The lockID identifies this
+// instance of accounts, so only one instance sweeps at a time.
+func (api *API) StartQuotaSweeper(ctx context.Context, lockID string) {
+	if QuotaSweepInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(QuotaSweepInterval):
+			}
+			_, _, err := api.SweepQuotas(ctx, lockID, QuotaSweepDryRun)
+			if err != nil {
+				api.staticLogger.Warningln(errors.AddContext(err, "failed to sweep exceeded quotas"))
+			}
+		}
+	}()
+}
+
+// SweepQuotas rechecks the quota of all users whose QuotaExceeded flag is set
+// and clears the flag of those who no longer exceed it. In dry-run mode it
+// only logs the changes it would make. It does nothing when another instance
+// of accounts holds the sweep lock. It returns the number of checked users and
+// the number of users whose flag changed or would change.
+func (api *API) SweepQuotas(ctx context.Context, lockID string, dryRun bool) (int, int, error) {
+	ok, err := api.staticDB.LockAcquire(ctx, quotaSweepLockName, lockID, quotaSweepLockTTL)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		api.staticLogger.Debugln("Skipping the quota sweep, another instance holds the lock.")
+		return 0, 0, nil
+	}
+	defer func() {
+		err := api.staticDB.LockRelease(context.Background(), quotaSweepLockName, lockID)
+		if err != nil {
+			api.staticLogger.Warningln(err)
+		}
+	}()
+	api.staticLogger.Infof("Sweeping the quotas of the users over quota (dry run: %t).", dryRun)
+	var checked, changed int
+	var errs []error
+	// We page through the users by ID, so clearing the flag of the users we
+	// have already checked doesn't shift the pages.
+	var after primitive.ObjectID
+	for {
+		users, err := api.staticDB.UsersWithQuotaExceeded(ctx, after, quotaSweepBatchSize)
+		if err != nil {
+			return checked, changed, errors.Compose(append(errs, errors.AddContext(err, "failed to fetch the users over quota"))...)
+		}
+		for _, u := range users {
+			if ctx.Err() != nil {
+				return checked, changed, ctx.Err()
+			}
+			var c bool
+			if dryRun {
+				var exceeded bool
+				exceeded, _, _, err = api.quotaExceeded(ctx, u)
+				c = err == nil && exceeded != u.QuotaExceeded
+				if c {
+					api.staticLogger.Infof("Quota sweep dry run: would set QuotaExceeded of user %s to %t.", u.Sub, exceeded)
+				}
+			} else {
+				c, err = api.recheckQuota(ctx, u)
+			}
+			if err != nil {
+				errs = append(errs, errors.AddContext(err, "failed to recheck the quota of user "+u.Sub))
+			}
+			checked++
+			if c {
+				changed++
+			}
+			if checked%quotaSweepProgressInterval == 0 {
+				api.staticLogger.Infof("Quota sweep: checked %d users, %d changed.", checked, changed)
+				// Extend the lock, so it doesn't expire during long sweeps.
+				ok, err = api.staticDB.LockAcquire(ctx, quotaSweepLockName, lockID, quotaSweepLockTTL)
+				if err != nil || !ok {
+					return checked, changed, errors.Compose(append(errs, errors.New("lost the quota sweep lock"), err)...)
+				}
+			}
+		}
+		if len(users) < quotaSweepBatchSize {
+			break
+		}
+		after = users[len(users)-1].ID
+	}
+	api.staticLogger.Infof("Quota sweep done: checked %d users, %d changed.", checked, changed)
+	return checked, changed, errors.Compose(errs...)
+}
+
+// skylinkSizeResolved is called by the metafetcher after it learns the size of
+// a skylink. The users who uploaded the skylink before we knew its size still
+// have stale storage numbers, so we queue a recheck of their quotas. It
+// doesn't block. If the queue is full, we skip the recheck and rely on the
+// quota sweep and the reconciliation in checkUserQuotas instead.
+func (api *API) skylinkSizeResolved(ctx context.Context, skylinkID primitive.ObjectID, size int64) {
+	select {
+	case api.staticSkylinkRechecks <- skylinkRecheck{ctx: ctx, skylinkID: skylinkID, size: size}:
+	default:
+		api.staticLogger.Warnf("Skylink recheck queue is full, skipping the uploaders of skylink %s.", skylinkID.Hex())
+	}
+}
+
+// threadedSkylinkRecheckWorker processes the queued skylink rechecks one at a
+// time, so a burst of resolved skylinks doesn't flood the DB.
+func (api *API) threadedSkylinkRecheckWorker() {
+	for r := range api.staticSkylinkRechecks {
+		api.managedRecheckSkylinkUploaders(r.ctx, r.skylinkID, r.size)
+	}
+}
+
+// managedRecheckSkylinkUploaders replaces the estimate we counted towards the
+// storage of all users who have pinned the given skylink with its actual size
+// and rechecks their quotas. Popular skylinks might have been pinned by many
+// users, so we page through them in batches.
+func (api *API) managedRecheckSkylinkUploaders(ctx context.Context, skylinkID primitive.ObjectID, size int64) {
+	var after primitive.ObjectID
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		ids, err := api.staticDB.UsersWithPinnedSkylink(ctx, skylinkID, after, skylinkRecheckBatchSize)
+		if err != nil {
+			api.staticLogger.Warningln(errors.AddContext(err, "failed to fetch the users who pinned skylink "+skylinkID.Hex()))
+			return
+		}
+		if len(ids) == 0 {
+			return
+		}
+		after = ids[len(ids)-1]
+		users, err := api.staticDB.UsersByIDs(ctx, ids)
+		if err != nil {
+			api.staticLogger.Warningln(errors.AddContext(err, "failed to fetch the users who pinned skylink "+skylinkID.Hex()))
+			return
+		}
+		for _, u := range users {
+			if ctx.Err() != nil {
+				return
+			}
+			// Users who pinned the skylink more than once are only corrected
+			// once here. Reconciling the counter in checkUserQuotas takes
+			// care of the rest.
+			api.managedStorageUsageAdd(ctx, u, size-UnknownSkylinkSizeEstimate)
+			api.checkUserQuotas(ctx, u)
+		}
+		if len(ids) < skylinkRecheckBatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+var (
+	// LoginRateLimit is the number of login attempts we allow per IP and per
+	// email address within rateLimitWindow. This value is configurable via
+	// the ACCOUNTS_LOGIN_RATE_LIMIT environment variable.
+	LoginRateLimit = 10
+	// RegisterRateLimit is the number of registration attempts we allow per
+	// IP within rateLimitWindow. This value is configurable via the
+	// ACCOUNTS_REGISTER_RATE_LIMIT environment variable.
+	RegisterRateLimit = 10
+	// RecoverRateLimit is the number of account recovery requests we allow
+	// per IP within rateLimitWindow. This value is configurable via the
+	// ACCOUNTS_RECOVER_RATE_LIMIT environment variable.
+	RecoverRateLimit = 5
+	// AvailabilityRateLimit is the number of email and pubkey availability
+	// checks we allow per IP within rateLimitWindow. This value is
+	// configurable via the ACCOUNTS_AVAILABILITY_RATE_LIMIT environment
+	// variable.
+	AvailabilityRateLimit = 30
+	// OrgInviteRateLimit is the number of organization invites we allow per
+	// IP and per user within rateLimitWindow. This value is configurable via
+	// the ACCOUNTS_ORG_INVITE_RATE_LIMIT environment variable.
+	OrgInviteRateLimit = 5
+
+	// ErrRateLimitExceeded is returned when the caller has made too many
+	// requests to a rate limited endpoint.
+	ErrRateLimitExceeded = errors.New("too many requests, please try again later")
+
+	// rateLimitWindow is the period within which we allow the configured
+	// number of requests. Buckets are refilled gradually over this period.
+	rateLimitWindow = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  2 * time.Second,
+			Standard: time.Minute,
+		},
+	).(time.Duration)
+)
+
+type (
+	// rateLimiter is an in-memory token bucket rate limiter. Each key gets its
+	// own bucket which holds up to `limit` tokens and is refilled at a rate of
+	// `limit` tokens per `window`. A limit of zero or less disables the
+	// limiter.
+	rateLimiter struct {
+		limit     int
+		window    time.Duration
+		buckets   map[string]*tokenBucket
+		lastPrune time.Time
+		mu        sync.Mutex
+	}
+	// tokenBucket holds the number of tokens available to a single key as of
+	// the time of its last update.
+	tokenBucket struct {
+		tokens  float64
+		updated time.Time
+	}
+	// rateLimitKeyFunc returns the keys by which we should rate limit the
+	// given request. The request is denied if any of its keys is over the
+	// limit.
+	rateLimitKeyFunc func(req *http.Request) []string
+)
+
+// newRateLimiter creates a new rateLimiter.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		window:    window,
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the given key. If there are no
+// tokens left it returns false, along with the time until the next token
+// becomes available.
+func (rl *rateLimiter) Allow(key string) (bool, time.Duration) {
+	if rl.limit <= 0 {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.prune(now)
+	refillRate := float64(rl.limit) / float64(rl.window)
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: float64(rl.limit), updated: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rl.limit), b.tokens+float64(now.Sub(b.updated))*refillRate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / refillRate)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune removes the buckets which have been refilled completely, so
+// the limiter doesn't grow indefinitely. It runs at most once per window.
+// The caller needs to hold the lock.
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < rl.window {
+		return
+	}
+	for key, b := range rl.buckets {
+		if now.Sub(b.updated) >= rl.window {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastPrune = now
+}
+
+// withRateLimit denies requests which exceed the limits of the given rate
+// limiter with a 429 and a Retry-After header.
+func (api *API) withRateLimit(rl *rateLimiter, keys rateLimitKeyFunc, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if api.staticDeps.Disrupt("DependencySkipRateLimiting") {
+			h(w, req, ps)
+			return
+		}
+		allowed := true
+		var retryAfter time.Duration
+		for _, key := range keys(req) {
+			ok, ra := rl.Allow(key)
+			if !ok {
+				allowed = false
+				if ra > retryAfter {
+					retryAfter = ra
+				}
+			}
+		}
+		if !allowed {
+			secs := int(math.Ceil(retryAfter.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			api.WriteError(w, ErrRateLimitExceeded, http.StatusTooManyRequests)
+			return
+		}
+		h(w, req, ps)
+	}
+}
+
+// rateLimitKeysIP rate limits requests by the caller's IP.
+func rateLimitKeysIP(req *http.Request) []string {
+	return []string{"ip:" + clientIP(req)}
+}
+
+// rateLimitKeysTwoFactor rate limits attempts to provide a TOTP code by the
+// caller's IP. These attempts have their own budget, separate from the one of
+// the password attempts.
+func rateLimitKeysTwoFactor(req *http.Request) []string {
+	return []string{"2fa:" + clientIP(req)}
+}
+
+// rateLimitKeysLogin rate limits login requests by the caller's IP and by
+// the email address they are trying to log in with, so an attacker can't get
+// around the limit by using many IPs against the same account.
+func rateLimitKeysLogin(req *http.Request) []string {
+	keys := rateLimitKeysIP(req)
+	if req.Body == nil {
+		return keys
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return keys
+	}
+	// Restore the body, so the handler can read it.
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Email != "" {
+		keys = append(keys, "email:"+strings.ToLower(strings.TrimSpace(payload.Email)))
+	}
+	return keys
+}
+
+// rateLimitKeysUser rate limits requests by the caller's IP and by the user
+// their token belongs to, so a user can't get around the limit by using many
+// IPs. We can't tell the user of requests without a valid token, those are
+// only rate limited by IP and fail authentication anyway.
+func rateLimitKeysUser(req *http.Request) []string {
+	keys := rateLimitKeysIP(req)
+	token, err := tokenFromRequest(req)
+	if err != nil {
+		return keys
+	}
+	sub, _, _, err := jwt.TokenFields(token)
+	if err != nil {
+		return keys
+	}
+	return append(keys, "sub:"+sub)
+}
+
+// clientIP returns the IP of the caller. Accounts runs behind Nginx, which
+// passes the caller's IP in the X-Real-IP header. We fall back to the remote
+// address of the connection when the header is missing or invalid.
+func clientIP(req *http.Request) string {
+	if ip := validateIP(req.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestRateLimiter ensures that rateLimiter allows up to its limit of requests
+// per key and refills its buckets over time.
+func TestRateLimiter(t *testing.T) {
+	window := 100 * time.Millisecond
+	rl := newRateLimiter(3, window)
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("a"); !ok {
+			t.Fatalf("Expected request %d to be allowed.", i)
+		}
+	}
+	ok, retryAfter := rl.Allow("a")
+	if ok {
+		t.Fatal("Expected the request to be denied.")
+	}
+	if retryAfter <= 0 || retryAfter > window {
+		t.Fatalf("Expected a retry after between 0 and %v, got %v", window, retryAfter)
+	}
+	// Other keys are not affected.
+	if ok, _ = rl.Allow("b"); !ok {
+		t.Fatal("Expected a request with a different key to be allowed.")
+	}
+	// Wait for a token to become available.
+	time.Sleep(retryAfter + 10*time.Millisecond)
+	if ok, _ = rl.Allow("a"); !ok {
+		t.Fatal("Expected the request to be allowed after the bucket refilled.")
+	}
+	// A limit of zero disables the limiter.
+	rl = newRateLimiter(0, window)
+	for i := 0; i < 10; i++ {
+		if ok, _ = rl.Allow("a"); !ok {
+			t.Fatal("Expected a disabled limiter to allow all requests.")
+		}
+	}
+}
+
+// TestClientIP ensures that clientIP prefers the X-Real-IP header and falls
+// back to the remote address.
+func TestClientIP(t *testing.T) {
+	req := &http.Request{Header: http.Header{}, RemoteAddr: "10.0.0.1:1234"}
+	if ip := clientIP(req); ip != "10.0.0.1" {
+		t.Fatalf("Expected '10.0.0.1', got '%s'", ip)
+	}
+	req.Header.Set("X-Real-IP", "not an ip")
+	if ip := clientIP(req); ip != "10.0.0.1" {
+		t.Fatalf("Expected '10.0.0.1', got '%s'", ip)
+	}
+	req.Header.Set("X-Real-IP", "192.168.0.1")
+	if ip := clientIP(req); ip != "192.168.0.1" {
+		t.Fatalf("Expected '192.168.0.1', got '%s'", ip)
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/lib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRequestIDLen is the longest request ID we accept from callers. We
+	// generate a new one for requests which pass a longer one.
+	maxRequestIDLen = 128
+)
+
+// withRequestID makes sure each request has an ID, so we can correlate our
+// log lines with the ones of the services in front of us. We use the ID passed
+// in the X-Request-ID header or generate a new one if there is none. We echo
+// the ID in the response headers, including on error responses.
+func (api *API) withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			// GenerateUUID never fails.
+			id, _ = lib.GenerateUUID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, req.WithContext(ContextWithRequestID(req.Context(), id)))
+	})
+}
+
+// validRequestID checks whether we can use the given request ID. We only
+// accept printable ASCII, so callers can't inject anything into our logs or
+// response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// ContextWithRequestID returns a copy of the given context that contains the
+// ID of the request.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxValue("requestID"), id)
+}
+
+// RequestIDFromContext returns the ID of the request. It returns an empty
+// string if the context doesn't belong to a request.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxValue("requestID")).(string)
+	return id
+}
+
+// loggerFromContext returns a logger which adds the ID of the request to all
+// of its log lines.
+func (api *API) loggerFromContext(ctx context.Context) *logrus.Entry {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		return logrus.NewEntry(api.staticLogger)
+	}
+	return api.staticLogger.WithField("request_id", id)
+}
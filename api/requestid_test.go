@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// TestRequestID ensures that we echo the caller's request ID in the response
+// headers, that we generate one when the caller doesn't pass a valid one, and
+// that the contextual logger includes it in its log lines.
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	api := &API{staticRouter: httprouter.New(), staticLogger: logger}
+	api.staticRouter.GET("/ok", func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		api.loggerFromContext(req.Context()).Info("handling request")
+		api.WriteSuccess(w)
+	})
+	api.staticRouter.GET("/fail", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		api.WriteError(w, errors.New("failure"), http.StatusBadRequest)
+	})
+
+	// The caller's request ID round-trips, including on errors.
+	for _, path := range []string{"/ok", "/fail"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(RequestIDHeader, "nginx-request-1")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if id := w.Header().Get(RequestIDHeader); id != "nginx-request-1" {
+			t.Fatalf("Expected request ID '%s' for %s, got '%s'", "nginx-request-1", path, id)
+		}
+	}
+	// The log line of the first request carries its ID.
+	line, err := logs.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	err = json.Unmarshal(line, &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["request_id"] != "nginx-request-1" || entry["msg"] != "handling request" {
+		t.Fatalf("Unexpected log line %s", string(line))
+	}
+
+	// We generate an ID for requests without a valid one.
+	for _, id := range []string{"", "has spaces", strings.Repeat("a", maxRequestIDLen+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/ok", nil)
+		req.Header.Set(RequestIDHeader, id)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		newID := w.Header().Get(RequestIDHeader)
+		if newID == "" || newID == id || !validRequestID(newID) {
+			t.Fatalf("Expected a new request ID instead of '%s', got '%s'", id, newID)
+		}
+	}
+}
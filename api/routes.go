@@ -2,7 +2,9 @@ package api
 
 import (
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/jwt"
@@ -23,6 +25,25 @@ var (
 	// ErrNoToken is returned when we expected a JWT token to be provided but it
 	// was not.
 	ErrNoToken = errors.New("no authorisation token found")
+
+	// CORSAllowedOrigins lists the origins from which browsers can call the
+	// API. Entries are either full origins, e.g. `https://app.siasky.net`,
+	// wildcards which match all subdomains of a domain, e.g.
+	// `*.siasky.net` or `https://*.siasky.net`, or `*`, which matches all
+	// origins but doesn't allow credentials.
+	CORSAllowedOrigins []string
+
+	// corsAllowedHeaders lists the request headers browsers can send to the
+	// API.
+	corsAllowedHeaders = []string{"Authorization", "Content-Type", APIKeyHeader, RequestIDHeader}
+	// corsMethods lists the methods we check when answering OPTIONS requests.
+	corsMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+)
+
+const (
+	// corsMaxAge defines for how many seconds browsers can cache the response
+	// to a preflight request.
+	corsMaxAge = "600"
 )
 
 type (
@@ -30,71 +51,349 @@ type (
 	// a user parameter. This allows us to fetch the user making the request
 	// just once, during validation.
 	HandlerWithUser func(*database.User, http.ResponseWriter, *http.Request, httprouter.Params)
+
+	// middleware wraps a handler with additional checks or request handling,
+	// e.g. withBodyLimit.
+	middleware func(httprouter.Handle) httprouter.Handle
+
+	// routeAuth defines the authentication a route requires.
+	routeAuth int
+
+	// route describes an HTTP route. We register the handler wrapped with the
+	// authentication the route requires and with its middleware. The first
+	// middleware is the outermost one. The request and response fields hold
+	// values of the types of the route's JSON request and response bodies,
+	// which we use for the OpenAPI document. A request of type []interface{}
+	// lists alternative bodies. A response of type noContent stands for an
+	// empty 204 response. Internal routes are not part of the OpenAPI
+	// document.
+	route struct {
+		method     string
+		path       string
+		auth       routeAuth
+		handler    HandlerWithUser
+		middleware []middleware
+		request    interface{}
+		response   interface{}
+		internal   bool
+	}
+
+	// noContent is the response type of routes which respond with 204.
+	noContent struct{}
 )
 
-// buildHTTPRoutes registers all HTTP routes and their handlers.
+const (
+	// authNone marks routes which don't require authentication.
+	authNone routeAuth = iota
+	// authUser marks routes which require a logged in user.
+	authUser
+	// authUserOrAPIKey marks routes which require a logged in user or one of
+	// their API keys.
+	authUserOrAPIKey
+	// authAdmin marks routes which require the admin API key.
+	authAdmin
+)
+
+// buildHTTPRoutes registers all HTTP routes and their handlers and builds the
+// OpenAPI document which describes them.
 func (api *API) buildHTTPRoutes() {
-	api.staticRouter.GET("/health", api.noAuth(api.healthGET))
-	api.staticRouter.GET("/limits", api.noAuth(api.limitsGET))
-
-	api.staticRouter.GET("/login", api.WithDBSession(api.noAuth(api.loginGET)))
-	api.staticRouter.POST("/login", api.WithDBSession(api.noAuth(api.loginPOST)))
-	api.staticRouter.POST("/logout", api.withAuth(api.logoutPOST, false))
-	api.staticRouter.GET("/register", api.noAuth(api.registerGET))
-	api.staticRouter.POST("/register", api.WithDBSession(api.noAuth(api.registerPOST)))
-
-	// Endpoints at which Nginx reports portal usage.
-	api.staticRouter.POST("/track/upload/:skylink", api.noAuth(api.trackUploadPOST))
-	api.staticRouter.POST("/track/download/:skylink", api.withAuth(api.trackDownloadPOST, true))
-	api.staticRouter.POST("/track/registry/read", api.withAuth(api.trackRegistryReadPOST, true))
-	api.staticRouter.POST("/track/registry/write", api.withAuth(api.trackRegistryWritePOST, true))
-
-	api.staticRouter.POST("/user", api.noAuth(api.userPOST)) // This will be removed in the future.
-	api.staticRouter.GET("/user", api.withAuth(api.userGET, false))
-	api.staticRouter.PUT("/user", api.WithDBSession(api.withAuth(api.userPUT, false)))
-	api.staticRouter.DELETE("/user", api.withAuth(api.userDELETE, false))
-	api.staticRouter.GET("/user/limits", api.noAuth(api.userLimitsGET))
-	api.staticRouter.GET("/user/limits/:skylink", api.noAuth(api.userLimitsSkylinkGET))
-	api.staticRouter.GET("/user/stats", api.withAuth(api.userStatsGET, false))
-	api.staticRouter.DELETE("/user/pubkey/:pubKey", api.WithDBSession(api.withAuth(api.userPubKeyDELETE, false)))
-	api.staticRouter.GET("/user/pubkey/register", api.WithDBSession(api.withAuth(api.userPubKeyRegisterGET, false)))
-	api.staticRouter.POST("/user/pubkey/register", api.WithDBSession(api.withAuth(api.userPubKeyRegisterPOST, false)))
-	api.staticRouter.GET("/user/uploads", api.withAuth(api.userUploadsGET, false))
-	api.staticRouter.DELETE("/user/uploads/:skylink", api.withAuth(api.userUploadsDELETE, false))
-	api.staticRouter.GET("/user/downloads", api.withAuth(api.userDownloadsGET, false))
-
-	// Endpoints for user API keys.
-	api.staticRouter.POST("/user/apikeys", api.WithDBSession(api.withAuth(api.userAPIKeyPOST, true)))
-	api.staticRouter.GET("/user/apikeys", api.withAuth(api.userAPIKeyLIST, true))
-	api.staticRouter.GET("/user/apikeys/:id", api.withAuth(api.userAPIKeyGET, true))
-	api.staticRouter.PUT("/user/apikeys/:id", api.WithDBSession(api.withAuth(api.userAPIKeyPUT, true)))
-	api.staticRouter.PATCH("/user/apikeys/:id", api.WithDBSession(api.withAuth(api.userAPIKeyPATCH, true)))
-	api.staticRouter.DELETE("/user/apikeys/:id", api.withAuth(api.userAPIKeyDELETE, true))
-
-	// Endpoints for email communication with the user.
-	api.staticRouter.GET("/user/confirm", api.WithDBSession(api.noAuth(api.userConfirmGET))) // TODO POST
-	api.staticRouter.POST("/user/reconfirm", api.WithDBSession(api.withAuth(api.userReconfirmPOST, false)))
-	api.staticRouter.POST("/user/recover/request", api.WithDBSession(api.noAuth(api.userRecoverRequestPOST)))
-	api.staticRouter.POST("/user/recover", api.WithDBSession(api.noAuth(api.userRecoverPOST)))
+	routes := api.routes()
+	for _, r := range routes {
+		api.staticRouter.Handle(r.method, r.path, api.routeHandle(r))
+	}
+	api.staticOpenAPI = openAPIFromRoutes(routes)
+}
+
+// routes returns the descriptors of all HTTP routes. Both the router and the
+// OpenAPI document are built from them. Routes without request and response
+// types are still registered, they're just not fully described in the
+// OpenAPI document, yet.
+func (api *API) routes() []route {
+	challengeOrCredentials := []interface{}{credentialsPOST{}, database.ChallengeResponse{}}
+	challengeOrCaptchaCredentials := []interface{}{captchaCredentialsPOST{}, database.ChallengeResponse{}}
+	routes := []route{
+		{method: http.MethodGet, path: "/health", handler: api.healthGET, response: HealthGET{}},
+		{method: http.MethodGet, path: "/health/full", handler: api.healthFullGET, response: HealthFullGET{}},
+		{method: http.MethodGet, path: "/metrics", handler: api.metricsGET},
+		{method: http.MethodGet, path: "/limits", handler: api.limitsGET, response: LimitsGET{}},
+		{method: http.MethodHead, path: "/limits", handler: api.limitsGET},
+		{method: http.MethodGet, path: "/openapi.json", handler: api.openAPIGET},
+
+		{method: http.MethodGet, path: "/login", handler: api.loginGET, middleware: []middleware{api.WithDBSession}, response: ChallengePublic{}},
+		{method: http.MethodPost, path: "/login", handler: api.loginPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.rateLimit(api.staticLoginLimiter, rateLimitKeysLogin), api.WithDBSession}, request: challengeOrCredentials, response: noContent{}},
+		{method: http.MethodPost, path: "/login/2fa", handler: api.loginTwoFactorPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.rateLimit(api.staticLoginLimiter, rateLimitKeysTwoFactor), api.WithDBSession}, request: LoginTwoFactorPOST{}, response: noContent{}},
+		{method: http.MethodPost, path: "/logout", auth: authUser, handler: api.logoutPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodPost, path: "/token/refresh", handler: api.tokenRefreshPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodGet, path: "/register", handler: api.registerGET, middleware: []middleware{api.ifRegistrationsEnabled}, response: ChallengePublic{}},
+		{method: http.MethodPost, path: "/register", handler: api.registerPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.rateLimit(api.staticRegisterLimiter, rateLimitKeysIP), api.WithDBSession, api.ifRegistrationsEnabled}, request: challengeOrCaptchaCredentials, response: UserGET{}},
+		{method: http.MethodGet, path: "/register/availability", handler: api.registerAvailabilityGET, middleware: []middleware{api.rateLimit(api.staticAvailabilityLimiter, rateLimitKeysIP)}, response: RegisterAvailabilityGET{}},
+
+		// Endpoints at which Nginx reports portal usage.
+		{method: http.MethodPost, path: "/track/upload/:skylink", handler: api.trackUploadPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.featureFlag(database.ConfValUploadsTrackingDisabled)}, response: noContent{}},
+		{method: http.MethodPost, path: "/track/download/:skylink", handler: api.trackDownloadPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.featureFlag(database.ConfValDownloadsTrackingDisabled)}, response: noContent{}},
+		{method: http.MethodPost, path: "/track/registry/read", auth: authUserOrAPIKey, handler: api.trackRegistryReadPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodPost, path: "/track/registry/write", auth: authUserOrAPIKey, handler: api.trackRegistryWritePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+
+		{method: http.MethodPost, path: "/user", handler: api.userPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.ifRegistrationsEnabled}, request: captchaCredentialsPOST{}, response: UserGET{}}, // This will be removed in the future.
+		{method: http.MethodGet, path: "/user", auth: authUser, handler: api.userGET, response: UserGET{}},
+		{method: http.MethodPut, path: "/user", auth: authUser, handler: api.userPUT, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.WithDBSession}, request: userUpdatePUT{}, response: UserGET{}},
+		{method: http.MethodDelete, path: "/user", auth: authUser, handler: api.userDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodPost, path: "/user/merge", auth: authUser, handler: api.userMergePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.rateLimit(api.staticLoginLimiter, rateLimitKeysLogin)}, request: challengeOrCredentials, response: UserGET{}},
+		{method: http.MethodPut, path: "/user/preferences", auth: authUser, handler: api.userPreferencesPUT, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, request: UserPreferencesPUT{}, response: UserGET{}},
+		{method: http.MethodGet, path: "/user/features", auth: authUser, handler: api.userFeaturesGET, response: UserFeaturesGET{}},
+		{method: http.MethodGet, path: "/user/capabilities", handler: api.userCapabilitiesGET, response: UserCapabilitiesGET{}},
+		{method: http.MethodGet, path: "/user/limits", handler: api.userLimitsGET, response: UserLimitsGET{}},
+		{method: http.MethodGet, path: "/user/limits/:skylink", handler: api.userLimitsSkylinkGET, response: UserLimitsGET{}},
+		{method: http.MethodPost, path: "/user/limits/batch", handler: api.userLimitsBatchPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeLarge)}, request: []string{}, response: UserLimitsBatchPOST{}},
+		{method: http.MethodGet, path: "/user/stats", auth: authUser, handler: api.userStatsGET, response: UserStatsGET{}},
+		{method: http.MethodGet, path: "/user/stats/history", auth: authUser, handler: api.userStatsHistoryGET, response: []database.UserStatsMonth{}},
+		{method: http.MethodGet, path: "/user/pubkeys", auth: authUser, handler: api.userPubKeysGET, middleware: []middleware{api.WithDBSession}, response: []UserPubKeyGET{}},
+		{method: http.MethodGet, path: "/user/pubkeys/:pubKey/limits", handler: api.userLimitsPubKeyGET, response: UserLimitsPubKeyGET{}},
+		{method: http.MethodDelete, path: "/user/pubkey/:pubKey", auth: authUser, handler: api.userPubKeyDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.WithDBSession}, response: noContent{}},
+		{method: http.MethodGet, path: "/user/pubkey/register", auth: authUser, handler: api.userPubKeyRegisterGET, middleware: []middleware{api.WithDBSession}, response: ChallengePublic{}},
+		{method: http.MethodPost, path: "/user/pubkey/register", auth: authUser, handler: api.userPubKeyRegisterPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.WithDBSession}, request: database.ChallengeResponse{}, response: UserGET{}},
+		{method: http.MethodGet, path: "/user/uploads", auth: authUserOrAPIKey, handler: api.userUploadsGET, response: UploadsGET{}},
+		{method: http.MethodPost, path: "/user/uploads-bulk-delete", auth: authUser, handler: api.userUploadsBulkDeletePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeLarge)}, request: []string{}, response: UserUploadsBulkDeleteResponse{}},
+		{method: http.MethodDelete, path: "/user/uploads/:skylink", auth: authUser, handler: api.userUploadsDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodPost, path: "/user/uploads/:skylink/repin", auth: authUser, handler: api.userUploadsRepinPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodPost, path: "/user/uploads/:skylink/share", auth: authUser, handler: api.userUploadsSharePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, request: UserUploadsSharePOST{}, response: UserUploadsShareResponse{}},
+		{method: http.MethodPost, path: "/user/grants/rotate", auth: authUser, handler: api.userGrantsRotatePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodGet, path: "/user/downloads", auth: authUser, handler: api.userDownloadsGET, response: DownloadsGET{}},
+		{method: http.MethodDelete, path: "/user/downloads", auth: authUser, handler: api.userDownloadsDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.WithDBSession}, response: DownloadsDELETE{}},
+		{method: http.MethodGet, path: "/user/registry/reads", auth: authUser, handler: api.userRegistryReadsGET, response: RegistryReadsGET{}},
+		{method: http.MethodGet, path: "/user/registry/writes", auth: authUser, handler: api.userRegistryWritesGET, response: RegistryWritesGET{}},
+		{method: http.MethodGet, path: "/user/audit", auth: authUser, handler: api.userAuditGET, response: AuditLogGET{}},
+		{method: http.MethodPost, path: "/user/2fa/setup", auth: authUser, handler: api.userTwoFactorSetupPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: TwoFactorSetupPOST{}},
+		{method: http.MethodPost, path: "/user/2fa/enable", auth: authUser, handler: api.userTwoFactorEnablePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, request: TwoFactorCodePOST{}, response: TwoFactorEnablePOST{}},
+		{method: http.MethodPost, path: "/user/2fa/disable", auth: authUser, handler: api.userTwoFactorDisablePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.rateLimit(api.staticLoginLimiter, rateLimitKeysTwoFactor)}, request: TwoFactorCodePOST{}, response: noContent{}},
+		{method: http.MethodGet, path: "/user/sessions", auth: authUser, handler: api.userSessionsGET, response: []SessionGET{}},
+		{method: http.MethodDelete, path: "/user/sessions", auth: authUser, handler: api.userSessionsDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+		{method: http.MethodDelete, path: "/user/sessions/:jti", auth: authUser, handler: api.userSessionDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+
+		// Endpoints for user API keys.
+		{method: http.MethodPost, path: "/user/apikeys", auth: authUserOrAPIKey, handler: api.userAPIKeyPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeLarge), api.featureFlag(database.ConfValAPIKeyCreationDisabled), api.WithDBSession}, request: APIKeyPOST{}, response: APIKeyResponseWithKey{}},
+		{method: http.MethodGet, path: "/user/apikeys", auth: authUserOrAPIKey, handler: api.userAPIKeyLIST, response: APIKeysGET{}},
+		{method: http.MethodGet, path: "/user/apikeys/:id", auth: authUserOrAPIKey, handler: api.userAPIKeyGET, response: APIKeyResponse{}},
+		{method: http.MethodGet, path: "/user/apikeys/:id/usage", auth: authUserOrAPIKey, handler: api.userAPIKeyUsageGET, response: database.APIKeyUsage{}},
+		{method: http.MethodPut, path: "/user/apikeys/:id", auth: authUserOrAPIKey, handler: api.userAPIKeyPUT, middleware: []middleware{api.bodyLimit(LimitBodySizeLarge), api.WithDBSession}, request: APIKeyPUT{}, response: noContent{}},
+		{method: http.MethodPatch, path: "/user/apikeys/:id", auth: authUserOrAPIKey, handler: api.userAPIKeyPATCH, middleware: []middleware{api.bodyLimit(LimitBodySizeLarge), api.WithDBSession}, request: APIKeyPATCH{}, response: APIKeyResponse{}},
+		{method: http.MethodPost, path: "/user/apikeys/:id/rotate", auth: authUserOrAPIKey, handler: api.userAPIKeyRotatePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: APIKeyResponseWithKey{}},
+		{method: http.MethodDelete, path: "/user/apikeys/:id", auth: authUserOrAPIKey, handler: api.userAPIKeyDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}, response: noContent{}},
+
+		// Endpoints for organizations.
+		{method: http.MethodPost, path: "/org", auth: authUser, handler: api.orgPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodGet, path: "/org-invites/accept", handler: api.orgInvitesAcceptGET},
+		{method: http.MethodGet, path: "/org/:id", auth: authUserOrAPIKey, handler: api.orgGET},
+		{method: http.MethodGet, path: "/org/:id/usage", auth: authUserOrAPIKey, handler: api.orgUsageGET},
+		{method: http.MethodPost, path: "/org/:id/invites", auth: authUser, handler: api.orgInvitesPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.rateLimit(api.staticOrgInviteLimiter, rateLimitKeysUser)}},
+		{method: http.MethodDelete, path: "/org/:id/members/:sub", auth: authUser, handler: api.orgMemberDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+
+		// Endpoints for email communication with the user.
+		{method: http.MethodGet, path: "/user/confirm", handler: api.userConfirmGET, middleware: []middleware{api.WithDBSession}, response: noContent{}}, // TODO POST
+		{method: http.MethodPost, path: "/user/reconfirm", auth: authUser, handler: api.userReconfirmPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.WithDBSession}, response: noContent{}},
+		{method: http.MethodPost, path: "/user/recover/request", handler: api.userRecoverRequestPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.rateLimit(api.staticRecoverLimiter, rateLimitKeysIP), api.WithDBSession, api.ifRegistrationsEnabled}, request: captchaCredentialsPOST{}, response: noContent{}},
+		{method: http.MethodPost, path: "/user/recover", handler: api.userRecoverPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.WithDBSession, api.ifRegistrationsEnabled}, request: accountRecoveryPOST{}, response: noContent{}},
+		{method: http.MethodPost, path: "/user/undelete", handler: api.userUndeletePOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.WithDBSession}, request: accountUndeletePOST{}, response: noContent{}},
+		{method: http.MethodGet, path: "/email/unsubscribe", handler: api.emailUnsubscribeGET},
+	}
 
 	if api.staticPromoter == PromoterStripe {
-		api.staticRouter.GET("/stripe/billing", api.WithDBSession(api.withAuth(api.stripeBillingHANDLER, false)))
-		// `POST /stripe/billing` is deprecated. Please use `GET /stripe/billing`.
-		api.staticRouter.POST("/stripe/billing", api.WithDBSession(api.withAuth(api.stripeBillingHANDLER, false)))
-		api.staticRouter.POST("/stripe/checkout", api.WithDBSession(api.withAuth(api.stripeCheckoutPOST, false)))
-		api.staticRouter.GET("/stripe/checkout/:checkout_id", api.WithDBSession(api.withAuth(api.stripeCheckoutIDGET, false)))
-		api.staticRouter.GET("/stripe/prices", api.noAuth(api.stripePricesGET))
-		api.staticRouter.POST("/stripe/webhook", api.WithDBSession(api.noAuth(api.stripeWebhookPOST)))
+		routes = append(routes, []route{
+			{method: http.MethodGet, path: "/stripe/billing", auth: authUserOrAPIKey, handler: api.stripeBillingHANDLER, middleware: []middleware{api.ifPaymentsEnabled, api.WithDBSession}},
+			// `POST /stripe/billing` is deprecated. Please use `GET /stripe/billing`.
+			{method: http.MethodPost, path: "/stripe/billing", auth: authUserOrAPIKey, handler: api.stripeBillingHANDLER, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.ifPaymentsEnabled, api.WithDBSession}},
+			{method: http.MethodPost, path: "/stripe/checkout", auth: authUserOrAPIKey, handler: api.stripeCheckoutPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall), api.ifPaymentsEnabled, api.featureFlag(database.ConfValStripeCheckoutDisabled), api.WithDBSession}},
+			{method: http.MethodGet, path: "/stripe/checkout/:checkout_id", auth: authUser, handler: api.stripeCheckoutIDGET, middleware: []middleware{api.ifPaymentsEnabled, api.WithDBSession}},
+			{method: http.MethodGet, path: "/stripe/prices", handler: api.stripePricesGET, middleware: []middleware{api.ifPaymentsEnabled}},
+			{method: http.MethodHead, path: "/stripe/prices", handler: api.stripePricesGET, middleware: []middleware{api.ifPaymentsEnabled}},
+			{method: http.MethodPost, path: "/stripe/webhook", handler: api.stripeWebhookPOST, middleware: []middleware{api.bodyLimit(MaxBodyBytes), api.ifPaymentsEnabled, api.WithDBSession}},
+		}...)
 	}
 
-	api.staticRouter.GET("/.well-known/jwks.json", api.noAuth(api.wellKnownJWKSGET))
+	routes = append(routes, []route{
+		{method: http.MethodGet, path: "/.well-known/jwks.json", handler: api.wellKnownJWKSGET},
+		{method: http.MethodHead, path: "/.well-known/jwks.json", handler: api.wellKnownJWKSGET},
+
+		// Internal endpoints. Never expose these!
+		{method: http.MethodGet, path: "/uploadinfo/:skylink", handler: api.uploadInfoGET, internal: true},
+		{method: http.MethodGet, path: "/uploadedskylinks", handler: api.uploadedSkylinksGET, internal: true},
+		{method: http.MethodGet, path: "/apikeys/grandfathered", handler: api.apiKeysGrandfatheredGET, internal: true},
+		{method: http.MethodGet, path: "/admin/cohorts", handler: api.adminCohortsGET, internal: true},
+		{method: http.MethodGet, path: "/internal/changes", handler: api.changesGET, internal: true},
 
-	// Internal endpoints. Never expose these!
-	api.staticRouter.GET("/uploadinfo/:skylink", api.noAuth(api.uploadInfoGET))
-	api.staticRouter.GET("/uploadedskylinks", api.noAuth(api.uploadedSkylinksGET))
+		// Admin endpoints. These require the admin API key.
+		{method: http.MethodPost, path: "/admin/user/:sub/tier", auth: authAdmin, handler: api.adminUserTierPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodPost, path: "/admin/user/:sub/trial", auth: authAdmin, handler: api.adminUserTrialPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodPost, path: "/admin/org/:id/tier", auth: authAdmin, handler: api.adminOrgTierPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodPut, path: "/admin/user/:sub/flags", auth: authAdmin, handler: api.adminUserFlagsPUT, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodGet, path: "/admin/user/:sub/audit", auth: authAdmin, handler: api.adminUserAuditGET},
+		{method: http.MethodGet, path: "/admin/stats", auth: authAdmin, handler: api.adminStatsGET},
+		{method: http.MethodGet, path: "/admin/stats/uploads-by-country", auth: authAdmin, handler: api.adminUploadsByCountryGET},
+		{method: http.MethodPut, path: "/admin/limits/:tier", auth: authAdmin, handler: api.adminLimitsPUT, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodPost, path: "/admin/skylink/:skylink/block", auth: authAdmin, handler: api.adminSkylinkBlockPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodDelete, path: "/admin/skylink/:skylink/block", auth: authAdmin, handler: api.adminSkylinkBlockDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodDelete, path: "/admin/skylink/:skylink", auth: authAdmin, handler: api.adminSkylinkDELETE, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+		{method: http.MethodGet, path: "/admin/skylink/:skylink/stats", auth: authAdmin, handler: api.adminSkylinkStatsGET},
+		{method: http.MethodGet, path: "/admin/skylinks/blocked", auth: authAdmin, handler: api.adminSkylinksBlockedGET},
+		{method: http.MethodGet, path: "/admin/uploads/by-ip", auth: authAdmin, handler: api.adminUploadsByIPGET},
+		{method: http.MethodGet, path: "/admin/downloads/by-ip", auth: authAdmin, handler: api.adminDownloadsByIPGET},
+		{method: http.MethodGet, path: "/admin/config/:key", auth: authAdmin, handler: api.adminConfigGET},
+		{method: http.MethodPut, path: "/admin/config/:key", auth: authAdmin, handler: api.adminConfigPUT, middleware: []middleware{api.bodyLimit(LimitBodySizeSmall)}},
+	}...)
 
 	if api.staticPromoter == PromoterPromoter {
-		api.staticRouter.POST("/promoter/settier/:sub", api.noAuth(api.promoterSetTierPOST))
+		routes = append(routes, route{method: http.MethodPost, path: "/promoter/settier/:sub", handler: api.promoterSetTierPOST, middleware: []middleware{api.bodyLimit(LimitBodySizeLarge)}})
+	}
+	return routes
+}
+
+// routeHandle wraps the route's handler with the authentication it requires
+// and with its middleware.
+func (api *API) routeHandle(r route) httprouter.Handle {
+	var h httprouter.Handle
+	switch r.auth {
+	case authUser, authUserOrAPIKey:
+		h = api.withAuth(r.handler, authAllowsAPIKey(r.auth))
+	case authAdmin:
+		h = api.withAdmin(r.handler)
+	default:
+		h = api.noAuth(r.handler)
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h
+}
+
+// authAllowsAPIKey returns true if routes with the given authentication accept
+// API keys.
+func authAllowsAPIKey(auth routeAuth) bool {
+	return auth == authUserOrAPIKey
+}
+
+// bodyLimit returns a middleware which applies withBodyLimit.
+func (api *API) bodyLimit(limit int64) middleware {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return api.withBodyLimit(limit, h)
+	}
+}
+
+// rateLimit returns a middleware which applies withRateLimit.
+func (api *API) rateLimit(rl *rateLimiter, keys rateLimitKeyFunc) middleware {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return api.withRateLimit(rl, keys, h)
+	}
+}
+
+// featureFlag returns a middleware which applies withFeatureFlag.
+func (api *API) featureFlag(key string) middleware {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return api.withFeatureFlag(key, h)
+	}
+}
+
+// withMetrics records the route, status, and duration of each request served
+// by the given handler.
+func (api *API) withMetrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, req)
+		recordRequestMetrics(api.routePattern(req), req.Method, sw.status, time.Since(start))
+	})
+}
+
+// withCORS emits the CORS headers for requests from allowed origins and
+// answers OPTIONS requests, including CORS preflights, for every registered
+// route. Requests from other origins get no CORS headers, so browsers block
+// them, but we serve them as usual.
+func (api *API) withCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin != "" && len(CORSAllowedOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+			if allowed, credentials := corsOriginAllowed(origin); allowed {
+				if credentials {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				} else {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				}
+				w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader)
+			}
+		}
+		if req.Method != http.MethodOptions {
+			h.ServeHTTP(w, req)
+			return
+		}
+		var methods []string
+		for _, m := range corsMethods {
+			if handle, _, _ := api.staticRouter.Lookup(m, req.URL.Path); handle != nil {
+				methods = append(methods, m)
+			}
+		}
+		if len(methods) == 0 {
+			// Let the router respond to unknown routes.
+			h.ServeHTTP(w, req)
+			return
+		}
+		methods = append(methods, http.MethodOptions)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// corsOriginAllowed tells whether the given origin matches CORSAllowedOrigins
+// and whether it matched an explicit entry, as opposed to `*`. Only explicit
+// matches can make requests with credentials.
+func corsOriginAllowed(origin string) (allowed bool, credentials bool) {
+	o, err := url.Parse(origin)
+	if err != nil || o.Scheme == "" || o.Host == "" {
+		return false, false
+	}
+	wildcard := false
+	for _, entry := range CORSAllowedOrigins {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "/"))
+		if entry == "*" {
+			wildcard = true
+			continue
+		}
+		scheme := ""
+		if i := strings.Index(entry, "://"); i >= 0 {
+			scheme, entry = entry[:i], entry[i+3:]
+		}
+		if scheme != "" && scheme != strings.ToLower(o.Scheme) {
+			continue
+		}
+		host := strings.ToLower(o.Host)
+		if strings.HasPrefix(entry, "*.") {
+			if strings.HasSuffix(host, entry[1:]) {
+				return true, true
+			}
+			continue
+		}
+		if host == entry {
+			return true, true
+		}
+	}
+	return wildcard, false
+}
+
+// withBodyLimit caps the size of the request's body at the given number of
+// bytes. Reading past the limit fails with an error which WriteError turns
+// into a 413 response. It needs to be the outermost wrapper of the route, so
+// no other middleware reads the body before it's capped.
+func (api *API) withBodyLimit(limit int64, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if req.Body != nil {
+			req.Body = http.MaxBytesReader(w, req.Body, limit)
+		}
+		h(w, req, ps)
 	}
 }
 
@@ -112,12 +411,8 @@ func (api *API) withAuth(h HandlerWithUser, allowsAPIKey bool) httprouter.Handle
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		api.logRequest(req)
 		u, token, err := api.userFromRequest(req, allowsAPIKey)
-		if errors.Contains(err, ErrNoAPIKey) || errors.Contains(err, database.ErrInvalidAPIKey) || errors.Contains(err, database.ErrUserNotFound) || errors.Contains(err, ErrAPIKeyNotAllowed) {
-			api.WriteError(w, err, http.StatusUnauthorized)
-			return
-		}
 		if err != nil {
-			api.WriteError(w, err, http.StatusInternalServerError)
+			api.WriteError(w, err, authErrorStatus(err))
 			return
 		}
 		// Embed the verified token in the context of the request.
@@ -126,12 +421,24 @@ func (api *API) withAuth(h HandlerWithUser, allowsAPIKey bool) httprouter.Handle
 	}
 }
 
+// authErrorStatus returns the HTTP status with which we reject a request for
+// which userFromRequest returned the given error.
+func authErrorStatus(err error) int {
+	if errors.Contains(err, ErrNoAPIKey) || errors.Contains(err, database.ErrInvalidAPIKey) || errors.Contains(err, database.ErrUserNotFound) || errors.Contains(err, ErrAPIKeyNotAllowed) {
+		return http.StatusUnauthorized
+	}
+	if errors.Contains(err, ErrAPIKeyReadOnly) || errors.Contains(err, ErrAccountSuspended) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
 // logRequest logs information about the current request.
 func (api *API) logRequest(r *http.Request) {
 	hasAuth := strings.HasPrefix(r.Header.Get("Authorization"), "Bearer")
 	hasAPIKey := r.Header.Get(APIKeyHeader) != ""
 	c, err := r.Cookie(CookieName)
 	hasCookie := err == nil && c != nil
-	api.staticLogger.Tracef("Processing request: %v %v, Auth: %v, API Key: %v, Cookie: %v, Referer: %v, Host: %v, RemoreAddr: %v",
+	api.loggerFromContext(r.Context()).Tracef("Processing request: %v %v, Auth: %v, API Key: %v, Cookie: %v, Referer: %v, Host: %v, RemoreAddr: %v",
 		r.Method, r.URL, hasAuth, hasAPIKey, hasCookie, r.Referer(), r.Host, r.RemoteAddr)
 }
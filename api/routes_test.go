@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// TestCORS ensures that we answer preflight requests from allowed origins
+// with the right CORS headers, that other origins get no CORS headers, and
+// that we only allow credentials for explicitly allowed origins.
+func TestCORS(t *testing.T) {
+	defer func(old []string) { CORSAllowedOrigins = old }(CORSAllowedOrigins)
+	CORSAllowedOrigins = []string{"https://app.siasky.net", "*.skynetfree.net"}
+
+	api := &API{staticRouter: httprouter.New(), staticLogger: logrus.New()}
+	h := func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		api.WriteSuccess(w)
+	}
+	api.staticRouter.GET("/user", h)
+	api.staticRouter.PUT("/user", h)
+
+	preflight := func(path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// Allowed origins get the CORS headers, including the credentials flag.
+	for _, origin := range []string{"https://app.siasky.net", "https://dev.skynetfree.net", "http://a.b.skynetfree.net"} {
+		w := preflight("/user", origin)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected %d for origin %s, got %d", http.StatusNoContent, origin, w.Code)
+		}
+		if o := w.Header().Get("Access-Control-Allow-Origin"); o != origin {
+			t.Fatalf("Expected allowed origin %s, got '%s'", origin, o)
+		}
+		if c := w.Header().Get("Access-Control-Allow-Credentials"); c != "true" {
+			t.Fatalf("Expected credentials to be allowed for origin %s, got '%s'", origin, c)
+		}
+		methods := w.Header().Get("Access-Control-Allow-Methods")
+		if !strings.Contains(methods, http.MethodGet) || !strings.Contains(methods, http.MethodPut) || strings.Contains(methods, http.MethodPost) {
+			t.Fatalf("Unexpected allowed methods '%s'", methods)
+		}
+		headers := w.Header().Get("Access-Control-Allow-Headers")
+		if !strings.Contains(headers, APIKeyHeader) || !strings.Contains(headers, "Authorization") {
+			t.Fatalf("Unexpected allowed headers '%s'", headers)
+		}
+	}
+
+	// Other origins get no CORS headers.
+	for _, origin := range []string{"https://evil.com", "http://app.siasky.net", "https://skynetfree.net", "https://evilskynetfree.net", "null"} {
+		w := preflight("/user", origin)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected %d for origin %s, got %d", http.StatusNoContent, origin, w.Code)
+		}
+		for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Allow-Methods"} {
+			if v := w.Header().Get(header); v != "" {
+				t.Fatalf("Expected no %s header for origin %s, got '%s'", header, origin, v)
+			}
+		}
+	}
+
+	// Unknown routes are still not found.
+	w := preflight("/unknown", "https://app.siasky.net")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Regular requests get the CORS headers as well.
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.Header.Set("Origin", "https://app.siasky.net")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.siasky.net" {
+		t.Fatalf("Unexpected response %d with headers %v", w.Code, w.Header())
+	}
+
+	// Any origin matches `*` but without credentials. Explicit entries still
+	// get credentials.
+	CORSAllowedOrigins = []string{"*", "https://app.siasky.net"}
+	w = preflight("/user", "https://evil.com")
+	if o := w.Header().Get("Access-Control-Allow-Origin"); o != "*" {
+		t.Fatalf("Expected allowed origin '*', got '%s'", o)
+	}
+	if c := w.Header().Get("Access-Control-Allow-Credentials"); c != "" {
+		t.Fatalf("Expected no credentials flag, got '%s'", c)
+	}
+	w = preflight("/user", "https://app.siasky.net")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.siasky.net" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("Unexpected headers %v", w.Header())
+	}
+
+	// Without allowed origins we emit no CORS headers at all.
+	CORSAllowedOrigins = nil
+	w = preflight("/user", "https://app.siasky.net")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Unexpected response %d with headers %v", w.Code, w.Header())
+	}
+}
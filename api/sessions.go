@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+var (
+	// ErrSessionRevoked is returned when the JWT attached to the request
+	// belongs to a session which the user has revoked.
+	ErrSessionRevoked = errors.New("this session has been revoked")
+)
+
+type (
+	// SessionGET describes a single session of the user.
+	SessionGET struct {
+		database.Session
+		// Current is true for the session used for making this request.
+		Current bool `json:"current"`
+	}
+)
+
+// userSessionsGET lists the user's active sessions.
+func (api *API) userSessionsGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	sessions, err := api.staticDB.SessionsBySub(req.Context(), u.Sub)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var currentJTI string
+	if tk, err := tokenFromRequest(req); err == nil {
+		currentJTI = tk.JwtID()
+	}
+	resp := make([]SessionGET, 0, len(sessions))
+	for _, s := range sessions {
+		resp = append(resp, SessionGET{
+			Session: s,
+			Current: s.JTI == currentJTI,
+		})
+	}
+	api.WriteJSON(w, resp)
+}
+
+// userSessionDELETE revokes one of the user's sessions. The JWT of that
+// session stops working immediately.
+func (api *API) userSessionDELETE(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	jti := ps.ByName("jti")
+	err := api.staticDB.SessionRevoke(req.Context(), u.Sub, jti)
+	if errors.Contains(err, database.ErrSessionNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticSessionRevocationCache.Set(jti, true)
+	api.WriteSuccess(w)
+}
+
+// userSessionsDELETE revokes all of the user's sessions, including the one
+// used for making this request.
+func (api *API) userSessionsDELETE(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	jtis, err := api.staticDB.SessionRevokeAll(req.Context(), u.Sub)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	for _, jti := range jtis {
+		api.staticSessionRevocationCache.Set(jti, true)
+	}
+	api.WriteSuccess(w)
+}
+
+// tokenRefreshPOST issues a new token for the session of the caller's current
+// token, which can come either from the cookie or from the Authorization
+// header. The new token keeps the session's jti and TTL, but it can't outlive
+// jwt.MaxSessionAge after the session's original login. Expired and revoked
+// tokens can't be refreshed.
+//
+// NOTE: This handler uses the noAuth middleware because it needs the token
+// itself and not just its owner. It authenticates the caller itself.
+func (api *API) tokenRefreshPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	u, tk, err := api.userAndTokenByRequestToken(req)
+	if errors.Contains(err, ErrAccountSuspended) {
+		api.WriteError(w, err, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	ntk, err := jwt.TokenRefresh(tk, u.Email, u.Name)
+	if errors.Contains(err, jwt.ErrSessionTooOld) {
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to refresh token"), http.StatusInternalServerError)
+		return
+	}
+	// Keep the session record around for as long as the new token lives.
+	err = api.staticDB.SessionExtend(req.Context(), u.Sub, ntk.JwtID(), ntk.Expiration())
+	if errors.Contains(err, database.ErrSessionNotFound) {
+		api.WriteError(w, ErrSessionRevoked, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	tkBytes, err := jwt.TokenSerialize(ntk)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to serialize token"), http.StatusInternalServerError)
+		return
+	}
+	err = writeCookie(w, string(tkBytes), ntk.Expiration().UTC().Unix())
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to write cookie"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Skynet-Token", string(tkBytes))
+	api.WriteSuccess(w)
+}
+
+// managedSessionRevoked returns true if the session with the given jti has
+// been revoked. It consults the revocation cache first and falls back to the
+// DB on a miss. Tokens without a jti predate session tracking and are never
+// considered revoked.
+func (api *API) managedSessionRevoked(ctx context.Context, jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	revoked, ok := api.staticSessionRevocationCache.Get(jti)
+	if ok {
+		return revoked, nil
+	}
+	revoked, err := api.staticDB.SessionRevoked(ctx, jti)
+	if err != nil {
+		return false, err
+	}
+	api.staticSessionRevocationCache.Set(jti, revoked)
+	return revoked, nil
+}
@@ -26,6 +26,13 @@ import (
 const (
 	// MaxBodyBytes defines the maximum length of a webhook call's request body.
 	MaxBodyBytes = int64(65536)
+
+	// stripeEventInvoicePaymentFailed is the type of the event Stripe sends
+	// when it fails to charge a customer.
+	stripeEventInvoicePaymentFailed = "invoice.payment_failed"
+	// stripeEventInvoicePaymentSucceeded is the type of the event Stripe sends
+	// when it successfully charges a customer.
+	stripeEventInvoicePaymentSucceeded = "invoice.payment_succeeded"
 )
 
 var (
@@ -54,6 +61,16 @@ var (
 	// price, so we cannot determine the user's tier based on it.
 	ErrSubWithoutPrice = errors.New("subscription does not have a price")
 
+	// MaxPaymentFailures is the number of consecutive failed payments after
+	// which we downgrade the user to the free tier. Zero disables the
+	// downgrade. This value is configurable via the
+	// ACCOUNTS_MAX_PAYMENT_FAILURES environment variable.
+	MaxPaymentFailures = 3
+
+	// subscriptionRefreshInterval is how often a user can ask us to sync
+	// their subscription with Stripe via `GET /user?refresh=true`.
+	subscriptionRefreshInterval = time.Minute
+
 	// stripePageSize defines the number of records we are going to request from
 	// endpoints that support pagination.
 	stripePageSize = int64(1)
@@ -91,6 +108,17 @@ type (
 		ProductID   string  `json:"productId"`
 		LiveMode    bool    `json:"livemode"`
 	}
+	// UserSubscriptionGET describes the user's subscription, as we know it
+	// from our own records. It's a trimmed down version of SubscriptionGET,
+	// which doesn't require a call to Stripe.
+	UserSubscriptionGET struct {
+		Status            string    `json:"status"`
+		TierID            int       `json:"tierID"`
+		TierName          string    `json:"tierName"`
+		CurrentPeriodEnd  time.Time `json:"currentPeriodEnd"`
+		CancelAt          time.Time `json:"cancelAt"`
+		CancelAtPeriodEnd bool      `json:"cancelAtPeriodEnd"`
+	}
 	// SubscriptionGET describes a Stripe subscription for our front end needs.
 	SubscriptionGET struct {
 		Created            int64                    `json:"created"`
@@ -132,21 +160,27 @@ type (
 // processStripeSub reads the information about the user's subscription and
 // adjusts the user's record accordingly.
 func (api *API) processStripeSub(ctx context.Context, s *stripe.Subscription) error {
-	api.staticLogger.Traceln("Processing subscription:", s.ID)
-	u, err := api.staticDB.UserByStripeID(ctx, s.Customer.ID)
+	api.loggerFromContext(ctx).Traceln("Processing subscription:", s.ID)
+	return api.processStripeCustomer(ctx, s.Customer.ID)
+}
+
+// processStripeCustomer fetches the active subscriptions of the given Stripe
+// customer and adjusts the record of the user they belong to accordingly.
+func (api *API) processStripeCustomer(ctx context.Context, customerID string) error {
+	u, err := api.staticDB.UserByStripeID(ctx, customerID)
 	if err != nil {
-		errMsg := fmt.Sprintf("failed to fetch user from DB for customer id %s", s.Customer.ID)
+		errMsg := fmt.Sprintf("failed to fetch user from DB for customer id %s", customerID)
 		return errors.AddContext(err, errMsg)
 	}
 	// Get all active subscriptions for this customer. There should be only one
 	// (or none) but we'd better check.
 	it := sub.List(&stripe.SubscriptionListParams{
-		Customer: s.Customer.ID,
+		Customer: customerID,
 		Status:   string(stripe.SubscriptionStatusActive),
 	})
 	subs := it.SubscriptionList().Data
 	if len(subs) > 1 {
-		api.staticLogger.Tracef("More than one active subscription detected: %+v", subs)
+		api.loggerFromContext(ctx).Tracef("More than one active subscription detected: %+v", subs)
 	}
 	// Pick the latest active plan and set the user's tier based on that.
 	var mostRecentSub *stripe.Subscription
@@ -155,22 +189,6 @@ func (api *API) processStripeSub(ctx context.Context, s *stripe.Subscription) er
 			mostRecentSub = subsc
 		}
 	}
-	if mostRecentSub == nil {
-		// No active sub, set the default values.
-		u.Tier = database.TierFree
-		u.SubscribedUntil = time.Time{}
-		u.SubscriptionStatus = ""
-		u.SubscriptionCancelAt = time.Time{}
-		u.SubscriptionCancelAtPeriodEnd = false
-	} else {
-		// It seems weird that the Plan.ID is actually a price id but this
-		// is what we get from Stripe.
-		u.Tier = StripePrices()[mostRecentSub.Plan.ID]
-		u.SubscribedUntil = time.Unix(mostRecentSub.CurrentPeriodEnd, 0).UTC().Truncate(time.Millisecond)
-		u.SubscriptionStatus = string(mostRecentSub.Status)
-		u.SubscriptionCancelAt = time.Unix(mostRecentSub.CancelAt, 0).UTC().Truncate(time.Millisecond)
-		u.SubscriptionCancelAtPeriodEnd = mostRecentSub.CancelAtPeriodEnd
-	}
 	// Cancel all subs aside from the latest one.
 	p := stripe.SubscriptionCancelParams{
 		InvoiceNow: stripe.Bool(true),
@@ -181,32 +199,104 @@ func (api *API) processStripeSub(ctx context.Context, s *stripe.Subscription) er
 			continue
 		}
 		if subsc.ID == "" {
-			api.staticLogger.Warnf("Empty subscription ID! User ID '%s', Stripe ID '%s', subscription object '%+v'", u.ID.Hex(), u.StripeID, subs)
+			api.loggerFromContext(ctx).Warnf("Empty subscription ID! User ID '%s', Stripe ID '%s', subscription object '%+v'", u.ID.Hex(), u.StripeID, subs)
 			continue
 		}
 		cs, err := sub.Cancel(subsc.ID, &p)
 		if err != nil {
-			api.staticLogger.Warnf("Failed to cancel sub with id '%s' for user '%s' with Stripe customer id '%s'. Error: '%s'", subsc.ID, u.ID.Hex(), s.Customer.ID, err.Error())
-			api.staticLogger.Tracef("Sub information returned by Stripe: %+v", cs)
+			api.loggerFromContext(ctx).Warnf("Failed to cancel sub with id '%s' for user '%s' with Stripe customer id '%s'. Error: '%s'", subsc.ID, u.ID.Hex(), customerID, err.Error())
+			api.loggerFromContext(ctx).Tracef("Sub information returned by Stripe: %+v", cs)
 		} else {
-			api.staticLogger.Tracef("Successfully cancelled sub with id '%s' for user '%s' with Stripe customer id '%s'.", subsc.ID, u.ID.Hex(), s.Customer.ID)
+			api.loggerFromContext(ctx).Tracef("Successfully cancelled sub with id '%s' for user '%s' with Stripe customer id '%s'.", subsc.ID, u.ID.Hex(), customerID)
 		}
 	}
-	err = api.staticDB.UserSave(ctx, u)
+	// Someone might have modified the user while we talked to Stripe, so we
+	// retry with fresh data if our copy is stale.
+	var oldTier int
+	err = api.managedUserSave(ctx, u, userSaveRetriesBackground, func(u *database.User) error {
+		oldTier = u.Tier
+		if mostRecentSub == nil {
+			// No active sub, set the default values.
+			u.Tier = database.TierFree
+			u.SubscribedUntil = time.Time{}
+			u.SubscriptionStatus = ""
+			u.SubscriptionCancelAt = time.Time{}
+			u.SubscriptionCancelAtPeriodEnd = false
+		} else {
+			// It seems weird that the Plan.ID is actually a price id but this
+			// is what we get from Stripe.
+			u.Tier = StripePrices()[mostRecentSub.Plan.ID]
+			u.SubscribedUntil = time.Unix(mostRecentSub.CurrentPeriodEnd, 0).UTC().Truncate(time.Millisecond)
+			u.SubscriptionStatus = string(mostRecentSub.Status)
+			u.SubscriptionCancelAt = time.Unix(mostRecentSub.CancelAt, 0).UTC().Truncate(time.Millisecond)
+			u.SubscriptionCancelAtPeriodEnd = mostRecentSub.CancelAtPeriodEnd
+		}
+		return nil
+	})
 	if err == nil {
-		api.staticLogger.Tracef("Subscribed user id '%s', tier %d, until %s.", u.ID, u.Tier, u.SubscribedUntil.String())
+		api.loggerFromContext(ctx).Tracef("Subscribed user id '%s', tier %d, until %s.", u.ID, u.Tier, u.SubscribedUntil.String())
+		if u.Tier != oldTier {
+			api.staticDB.RecordTierChange(ctx, u.Sub, u.Tier)
+			go api.threadedAuditLog(u.ID, database.AuditActionTierChange, "", "", tierChangeMetadata(oldTier, u.Tier, "stripe"))
+		}
 	}
-	// Re-set the tier cache for this user, in case their tier changed.
-	api.staticUserTierCache.Set(u.Sub, u)
+	// Drop the user's cached tier, in case it changed.
+	api.staticUserTierCache.Invalidate(u.Sub)
 	return err
 }
 
+// managedRefreshSubscription syncs the user's subscription with Stripe and
+// returns the updated user. It returns the given user if Stripe is not
+// configured, the user is not a Stripe customer, they have already refreshed
+// their subscription within subscriptionRefreshInterval, or the sync fails.
+func (api *API) managedRefreshSubscription(ctx context.Context, u *database.User) *database.User {
+	if stripe.Key == "" || u.StripeID == "" {
+		return u
+	}
+	if ok, _ := api.staticSubscriptionRefreshLimiter.Allow(u.Sub); !ok {
+		return u
+	}
+	err := api.processStripeCustomer(ctx, u.StripeID)
+	if err != nil {
+		api.loggerFromContext(ctx).Debugf("Failed to refresh the subscription of user '%s': %s", u.Sub, err)
+		return u
+	}
+	ru, err := api.staticDB.UserByID(ctx, u.ID)
+	if err != nil {
+		api.loggerFromContext(ctx).Debugf("Failed to fetch user '%s' after refreshing their subscription: %s", u.Sub, err)
+		return u
+	}
+	return ru
+}
+
+// paymentsEnabled returns true if this portal accepts payments, i.e. it uses
+// Stripe as its payment processor and has a Stripe key.
+func (api *API) paymentsEnabled() bool {
+	return api.staticPromoter == PromoterStripe && stripe.Key != ""
+}
+
+// ifPaymentsEnabled ensures that payments are enabled before calling the
+// handler. We use it on all Stripe endpoints, so callers get a clear error
+// instead of an authentication error from Stripe. Disabled payments get a 501
+// response.
+func (api *API) ifPaymentsEnabled(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !api.paymentsEnabled() {
+			api.WriteError(w, ErrStripeNotConfigured, http.StatusNotImplemented)
+			return
+		}
+		h(w, req, ps)
+	}
+}
+
 // stripeBillingHANDLER creates a new billing session for the user and redirects
 // them to it. If the user does not yet have a Stripe customer, one is
 // registered for them.
 func (api *API) stripeBillingHANDLER(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	if stripe.Key == "" {
-		api.WriteError(w, ErrStripeNotConfigured, http.StatusBadRequest)
+	// The billing portal allows the user to change their subscription, so
+	// we don't let read-only API keys open it, even via GET.
+	if !apiKeyScopeAllows(APIKeyScopeFromContext(req.Context()), http.MethodPost) {
+		api.WriteError(w, ErrAPIKeyReadOnly, http.StatusForbidden)
 		return
 	}
 	if u.StripeID == "" {
@@ -234,14 +324,10 @@ func (api *API) stripeBillingHANDLER(u *database.User, w http.ResponseWriter, re
 // stripeCheckoutPOST creates a checkout session with the price specified in the
 // POST parameter with the same name. It returns the ID of the created session.
 func (api *API) stripeCheckoutPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	if stripe.Key == "" {
-		api.WriteError(w, ErrStripeNotConfigured, http.StatusBadRequest)
-		return
-	}
 	body := struct {
 		Price string `json:"price"`
 	}{}
-	err := json.NewDecoder(io.LimitReader(req.Body, LimitBodySizeSmall)).Decode(&body)
+	err := parseRequestBodyJSON(req.Body, &body)
 	if err != nil {
 		api.WriteError(w, errors.New("missing parameter 'price'"), http.StatusBadRequest)
 		return
@@ -291,10 +377,6 @@ func (api *API) stripeCheckoutPOST(u *database.User, w http.ResponseWriter, req
 // is successful and results in a higher tier sub than the current one, we
 // upgrade the user to the new tier.
 func (api *API) stripeCheckoutIDGET(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if stripe.Key == "" {
-		api.WriteError(w, ErrStripeNotConfigured, http.StatusBadRequest)
-		return
-	}
 	checkoutSessionID := ps.ByName("checkout_id")
 	subStr := "subscription"
 	subDiscountStr := "subscription.discount"
@@ -341,11 +423,14 @@ func (api *API) stripeCheckoutIDGET(u *database.User, w http.ResponseWriter, req
 	}
 	// Promote the user, if needed.
 	if tier > u.Tier {
+		oldTier := u.Tier
 		err = api.staticDB.UserSetTier(req.Context(), u, tier)
 		if err != nil {
 			api.WriteError(w, errors.AddContext(err, "failed to promote user"), http.StatusInternalServerError)
 			return
 		}
+		api.staticUserTierCache.Invalidate(u.Sub)
+		api.auditLog(req, u.ID, database.AuditActionTierChange, tierChangeMetadata(oldTier, tier, "stripe_checkout"))
 	}
 	// Build the response DTO.
 	var discountInfo *SubscriptionDiscountGET
@@ -429,10 +514,17 @@ func (api *API) stripeCreateCustomer(ctx context.Context, u *database.User) (str
 
 // stripePricesGET returns a list of plans and prices.
 func (api *API) stripePricesGET(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	if stripe.Key == "" {
-		api.WriteError(w, ErrStripeNotConfigured, http.StatusBadRequest)
+	sPrices, err := api.staticStripePricesCache.Prices()
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to fetch prices from Stripe"), http.StatusInternalServerError)
 		return
 	}
+	setCacheControl(w, stripePricesMaxAge)
+	api.WriteJSON(w, sPrices)
+}
+
+// fetchStripePrices fetches the list of active prices from Stripe.
+func fetchStripePrices() ([]StripePrice, error) {
 	var sPrices []StripePrice
 	params := &stripe.PriceListParams{
 		Active: stripe.Bool(true),
@@ -462,23 +554,22 @@ func (api *API) stripePricesGET(_ *database.User, w http.ResponseWriter, _ *http
 		}
 		sPrices = append(sPrices, sp)
 	}
-	api.WriteJSON(w, sPrices)
+	if err := i.Err(); err != nil {
+		return nil, err
+	}
+	return sPrices, nil
 }
 
 // stripeWebhookPOST handles various events issued by Stripe.
 // See https://stripe.com/docs/api/events/types
 func (api *API) stripeWebhookPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	if stripe.Key == "" {
-		api.WriteError(w, ErrStripeNotConfigured, http.StatusBadRequest)
-		return
-	}
-	api.staticLogger.Tracef("Webhook request: %+v", req)
-	event, code, err := readStripeEvent(w, req)
+	api.loggerFromContext(req.Context()).Tracef("Webhook request: %+v", req)
+	event, code, err := readStripeEvent(req)
 	if err != nil {
 		api.WriteError(w, err, code)
 		return
 	}
-	api.staticLogger.Tracef("Webhook event: %+v", event)
+	api.loggerFromContext(req.Context()).Tracef("Webhook event: %+v", event)
 
 	// Here we handle the entire class of subscription events.
 	// https://stripe.com/docs/billing/subscriptions/overview#build-your-own-handling-for-recurring-charge-failures
@@ -487,13 +578,13 @@ func (api *API) stripeWebhookPOST(_ *database.User, w http.ResponseWriter, req *
 		var s stripe.Subscription
 		err = json.Unmarshal(event.Data.Raw, &s)
 		if err != nil {
-			api.staticLogger.Warningln("Webhook: Failed to parse event. Error: ", err, "\nEvent: ", string(event.Data.Raw))
+			api.loggerFromContext(req.Context()).Warningln("Webhook: Failed to parse event. Error: ", err, "\nEvent: ", string(event.Data.Raw))
 			api.WriteError(w, err, http.StatusBadRequest)
 			return
 		}
 		err = api.processStripeSub(req.Context(), &s)
 		if err != nil {
-			api.staticLogger.Debugln("Webhook: Failed to process sub:", err)
+			api.loggerFromContext(req.Context()).Debugln("Webhook: Failed to process sub:", err)
 			api.WriteError(w, err, http.StatusInternalServerError)
 			return
 		}
@@ -509,12 +600,12 @@ func (api *API) stripeWebhookPOST(_ *database.User, w http.ResponseWriter, req *
 		}
 		err = json.Unmarshal(event.Data.Raw, &hasSub)
 		if err != nil {
-			api.staticLogger.Warningln("Webhook: Failed to parse event. Error: ", err, "\nEvent: ", string(event.Data.Raw))
+			api.loggerFromContext(req.Context()).Warningln("Webhook: Failed to parse event. Error: ", err, "\nEvent: ", string(event.Data.Raw))
 			api.WriteError(w, err, http.StatusBadRequest)
 			return
 		}
 		if hasSub.Sub == "" {
-			api.staticLogger.Debugln("Webhook: Event doesn't refer to a subscription.")
+			api.loggerFromContext(req.Context()).Debugln("Webhook: Event doesn't refer to a subscription.")
 			api.WriteSuccess(w)
 			return
 		}
@@ -522,13 +613,32 @@ func (api *API) stripeWebhookPOST(_ *database.User, w http.ResponseWriter, req *
 		var s *stripe.Subscription
 		s, err = sub.Get(hasSub.Sub, nil)
 		if err != nil {
-			api.staticLogger.Debugln("Webhook: Failed to fetch sub:", err)
+			api.loggerFromContext(req.Context()).Debugln("Webhook: Failed to fetch sub:", err)
 			api.WriteError(w, err, http.StatusInternalServerError)
 			return
 		}
 		err = api.processStripeSub(req.Context(), s)
 		if err != nil {
-			api.staticLogger.Debugln("Webhook: Failed to process sub:", err)
+			api.loggerFromContext(req.Context()).Debugln("Webhook: Failed to process sub:", err)
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Here we handle failed and successful payments, so we can warn users
+	// whose card is declined before their subscription lapses.
+	// See https://stripe.com/docs/api/invoices/object
+	if event.Type == stripeEventInvoicePaymentFailed || event.Type == stripeEventInvoicePaymentSucceeded {
+		var inv stripe.Invoice
+		err = json.Unmarshal(event.Data.Raw, &inv)
+		if err != nil {
+			api.loggerFromContext(req.Context()).Warningln("Webhook: Failed to parse event. Error: ", err, "\nEvent: ", string(event.Data.Raw))
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		err = api.processStripeInvoice(req.Context(), event.ID, event.Type, &inv)
+		if err != nil {
+			api.loggerFromContext(req.Context()).Debugln("Webhook: Failed to process invoice:", err)
 			api.WriteError(w, err, http.StatusInternalServerError)
 			return
 		}
@@ -537,10 +647,63 @@ func (api *API) stripeWebhookPOST(_ *database.User, w http.ResponseWriter, req *
 	api.WriteSuccess(w)
 }
 
+// processStripeInvoice keeps track of the consecutive failed payments of the
+// invoice's customer. On each failure we email the user, asking them to update
+// their payment details, and once they reach MaxPaymentFailures we downgrade
+// them to the free tier. A successful payment resets the count. Stripe might
+// deliver the same event more than once, so we skip the failures we've
+// already recorded.
+func (api *API) processStripeInvoice(ctx context.Context, eventID, eventType string, inv *stripe.Invoice) error {
+	if inv.Customer == nil || inv.Customer.ID == "" {
+		api.loggerFromContext(ctx).Debugln("Webhook: Invoice doesn't refer to a customer.")
+		return nil
+	}
+	u, err := api.staticDB.UserByStripeID(ctx, inv.Customer.ID)
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.loggerFromContext(ctx).Debugf("Webhook: No user found for customer id %s.", inv.Customer.ID)
+		return nil
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to fetch user from DB for customer id %s", inv.Customer.ID)
+		return errors.AddContext(err, errMsg)
+	}
+	if eventType == stripeEventInvoicePaymentSucceeded {
+		if u.PaymentFailures == 0 {
+			return nil
+		}
+		return api.staticDB.UserResetPaymentFailures(ctx, u)
+	}
+	err = api.staticDB.UserRecordPaymentFailure(ctx, u, eventID)
+	if errors.Contains(err, database.ErrPaymentFailureRecorded) {
+		api.loggerFromContext(ctx).Debugf("Webhook: Already recorded the payment failure of event %s.", eventID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if u.Email != "" {
+		err = api.staticMailer.SendPaymentFailedEmail(ctx, u.Email, u.Locale)
+		if err != nil {
+			api.loggerFromContext(ctx).Warnf("Failed to send payment failed email to user '%s': %s", u.ID.Hex(), err)
+		}
+	}
+	if MaxPaymentFailures == 0 || u.PaymentFailures < MaxPaymentFailures || u.Tier == database.TierFree {
+		return nil
+	}
+	api.loggerFromContext(ctx).Tracef("Downgrading user '%s' after %d failed payments.", u.ID.Hex(), u.PaymentFailures)
+	oldTier := u.Tier
+	err = api.staticDB.UserSetTier(ctx, u, database.TierFree)
+	if err != nil {
+		return errors.AddContext(err, "failed to downgrade user")
+	}
+	api.staticUserTierCache.Invalidate(u.Sub)
+	go api.threadedAuditLog(u.ID, database.AuditActionTierChange, "", "", tierChangeMetadata(oldTier, database.TierFree, "payment_failures"))
+	return nil
+}
+
 // readStripeEvent reads the event from the request body and verifies its
 // signature.
-func readStripeEvent(w http.ResponseWriter, req *http.Request) (*stripe.Event, int, error) {
-	req.Body = http.MaxBytesReader(w, req.Body, MaxBodyBytes)
+func readStripeEvent(req *http.Request) (*stripe.Event, int, error) {
 	payload, err := io.ReadAll(req.Body)
 	if err != nil {
 		err = errors.AddContext(err, "error reading request body")
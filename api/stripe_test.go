@@ -38,3 +38,21 @@ func TestStripeTestMode(t *testing.T) {
 		t.Fatal("Expected test mode, got live mode.")
 	}
 }
+
+// TestPaymentsEnabled ensures that we only accept payments when we use Stripe
+// as payment processor and have a Stripe key.
+func TestPaymentsEnabled(t *testing.T) {
+	api := &API{staticPromoter: PromoterStripe}
+	stripe.Key = ""
+	if api.paymentsEnabled() {
+		t.Fatal("Expected payments to be disabled without a Stripe key.")
+	}
+	stripe.Key = "sk_test_FAKE_TEST_KEY"
+	if !api.paymentsEnabled() {
+		t.Fatal("Expected payments to be enabled.")
+	}
+	api.staticPromoter = PromoterPromoter
+	if api.paymentsEnabled() {
+		t.Fatal("Expected payments to be disabled with a different promoter.")
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// mongoErrCodeMaxTimeMSExpired is the code of the error Mongo returns
+	// when a query runs past its maxTimeMS.
+	mongoErrCodeMaxTimeMSExpired = 50
+)
+
+var (
+	// RequestTimeout defines how long we let a request run before we cancel
+	// its context and respond with a 504. The DB passes the remaining time on
+	// to Mongo, so it stops working on the request's queries as well.
+	RequestTimeout = 30 * time.Second
+
+	// ErrRequestTimeout is returned when the request doesn't complete within
+	// RequestTimeout.
+	ErrRequestTimeout = errors.New("the request timed out")
+)
+
+// withTimeout sets a deadline of RequestTimeout on the request's context. The
+// handlers which keep working after they respond, e.g. the track endpoints,
+// need to use a detached context for that work.
+func (api *API) withTimeout(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if RequestTimeout <= 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), RequestTimeout)
+		defer cancel()
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// requestTimedOut tells whether the given error was caused by the request
+// running past its deadline, either on our side or on Mongo's.
+func requestTimedOut(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case errors.Error:
+		for _, c := range e.ErrSet {
+			if requestTimedOut(c) {
+				return true
+			}
+		}
+		return false
+	case mongo.ServerError:
+		if e.HasErrorCode(mongoErrCodeMaxTimeMSExpired) {
+			return true
+		}
+	}
+	return mongo.IsTimeout(err)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestRequestTimeout ensures that handlers get a context with a deadline of
+// RequestTimeout and that running past it results in a 504.
+func TestRequestTimeout(t *testing.T) {
+	defer func(old time.Duration) { RequestTimeout = old }(RequestTimeout)
+	RequestTimeout = 50 * time.Millisecond
+
+	api := &API{staticRouter: httprouter.New(), staticLogger: logrus.New()}
+	api.staticRouter.GET("/slow", func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		<-req.Context().Done()
+		api.WriteError(w, errors.AddContext(req.Context().Err(), "DB query failed"), http.StatusInternalServerError)
+	})
+	start := time.Now()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected %d, got %d", http.StatusGatewayTimeout, w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the request to time out after %v, it took %v", RequestTimeout, elapsed)
+	}
+	var ew errorWrap
+	err := json.NewDecoder(w.Body).Decode(&ew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ew.Code != ErrCodeRequestTimeout {
+		t.Fatalf("Expected code '%s', got '%s'", ErrCodeRequestTimeout, ew.Code)
+	}
+}
+
+// TestRequestTimedOut ensures that requestTimedOut recognises our own and
+// Mongo's timeouts.
+func TestRequestTimedOut(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		timedOut bool
+	}{
+		{name: "nil", err: nil, timedOut: false},
+		{name: "unknown", err: errors.New("boom"), timedOut: false},
+		{name: "canceled", err: context.Canceled, timedOut: false},
+		{name: "deadline", err: context.DeadlineExceeded, timedOut: true},
+		{name: "deadline with context", err: errors.AddContext(context.DeadlineExceeded, "DB query failed"), timedOut: true},
+		{name: "max time expired", err: mongo.CommandError{Code: mongoErrCodeMaxTimeMSExpired, Name: "MaxTimeMSExpired"}, timedOut: true},
+		{name: "wrapped deadline", err: mongo.CommandError{Code: 1, Wrapped: context.DeadlineExceeded}, timedOut: true},
+		{name: "other command error", err: mongo.CommandError{Code: 11000}, timedOut: false},
+	}
+	for _, tt := range tests {
+		if timedOut := requestTimedOut(tt.err); timedOut != tt.timedOut {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.timedOut, timedOut)
+		}
+	}
+}
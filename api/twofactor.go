@@ -0,0 +1,313 @@
+package api
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/SkynetLabs/skynet-accounts/metrics"
+	"github.com/SkynetLabs/skynet-accounts/totp"
+	"github.com/gorilla/securecookie"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+const (
+	// TwoFactorLoginTokenTTL is how long the user has to provide their TOTP
+	// code after successfully providing their credentials.
+	TwoFactorLoginTokenTTL = 5 * time.Minute
+
+	// twoFactorLoginTokenName is the name under which we sign two-factor login
+	// tokens. It ensures these tokens can't be confused with cookies.
+	twoFactorLoginTokenName = "two-factor-login"
+)
+
+var (
+	// ErrInvalidTwoFactorCode is returned when the user provides an invalid
+	// TOTP or recovery code.
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor authentication code")
+	// ErrInvalidTwoFactorToken is returned when the user tries to complete a
+	// two-factor login with an invalid or expired token.
+	ErrInvalidTwoFactorToken = errors.New("invalid or expired two-factor login token")
+	// ErrTwoFactorRequired is returned when the user logs in with valid
+	// credentials but still needs to provide a TOTP code.
+	ErrTwoFactorRequired = errors.New("two-factor authentication required")
+
+	// twoFactorTokenCodec signs, encrypts and expires two-factor login tokens.
+	twoFactorTokenCodec = securecookie.New(cookieHashKey, cookieEncKey).MaxAge(int(TwoFactorLoginTokenTTL.Seconds()))
+	// twoFactorSecretKey is the key we use for encrypting the users' TOTP
+	// secrets before storing them in the DB.
+	twoFactorSecretKey = sha256.Sum256(append([]byte("two-factor secret:"), cookieEncKey...))
+)
+
+type (
+	// TwoFactorCodePOST is the body of the requests which confirm an action
+	// with a TOTP code. Where noted, a recovery code is also accepted.
+	TwoFactorCodePOST struct {
+		Code string `json:"code"`
+	}
+	// TwoFactorSetupPOST is the response of POST /user/2fa/setup.
+	TwoFactorSetupPOST struct {
+		// Secret is the base32-encoded TOTP secret.
+		Secret string `json:"secret"`
+		// URL is the otpauth URL of the secret, usually shown as a QR code.
+		URL string `json:"url"`
+	}
+	// TwoFactorEnablePOST is the response of POST /user/2fa/enable.
+	TwoFactorEnablePOST struct {
+		// RecoveryCodes are single-use codes which the user can use instead
+		// of a TOTP code. We only store them hashed, so the user needs to
+		// save them now.
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	// LoginTwoFactorRequired is the response of POST /login when the user
+	// provides valid credentials but has 2FA enabled. The user needs to POST
+	// the token, along with a TOTP code, to /login/2fa in order to log in.
+	LoginTwoFactorRequired struct {
+		Message string `json:"message"`
+		Code    string `json:"code"`
+		Token   string `json:"token"`
+	}
+	// LoginTwoFactorPOST is the body of POST /login/2fa.
+	LoginTwoFactorPOST struct {
+		Token string `json:"token"`
+		// Code is either a TOTP code or a recovery code.
+		Code string `json:"code"`
+	}
+
+	// twoFactorLoginToken is the content of a two-factor login token.
+	twoFactorLoginToken struct {
+		Sub string
+		TTL int
+	}
+)
+
+// userTwoFactorSetupPOST generates a new TOTP secret for the user. 2FA only
+// gets enabled once the user proves they can generate valid codes with it via
+// POST /user/2fa/enable.
+func (api *API) userTwoFactorSetupPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if u.TwoFactorEnabled {
+		api.WriteError(w, database.ErrTwoFactorEnabled, http.StatusBadRequest)
+		return
+	}
+	secret := totp.GenerateSecret()
+	encSecret, err := encryptTwoFactorSecret(secret)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.UserTwoFactorSetSecret(req.Context(), u, encSecret)
+	if errors.Contains(err, database.ErrTwoFactorEnabled) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	issuer := strings.TrimPrefix(jwt.PortalName, "https://")
+	api.WriteJSON(w, TwoFactorSetupPOST{
+		Secret: secret,
+		URL:    totp.URL(issuer, u.Email.String(), secret),
+	})
+}
+
+// userTwoFactorEnablePOST verifies the given TOTP code against the secret
+// generated by POST /user/2fa/setup and enables 2FA for the user.
+func (api *API) userTwoFactorEnablePOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body TwoFactorCodePOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if u.TwoFactorEnabled {
+		api.WriteError(w, database.ErrTwoFactorEnabled, http.StatusBadRequest)
+		return
+	}
+	if u.TwoFactorSecret == "" {
+		api.WriteError(w, database.ErrTwoFactorNotSetUp, http.StatusBadRequest)
+		return
+	}
+	secret, err := decryptTwoFactorSecret(u.TwoFactorSecret)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	step, ok := totp.Validate(secret, body.Code, time.Now())
+	if !ok {
+		api.WriteError(w, ErrInvalidTwoFactorCode, http.StatusBadRequest)
+		return
+	}
+	codes, err := api.staticDB.UserTwoFactorEnable(req.Context(), u, step)
+	if errors.Contains(err, database.ErrTwoFactorNotSetUp) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, TwoFactorEnablePOST{RecoveryCodes: codes})
+}
+
+// userTwoFactorDisablePOST disables 2FA for the user. It requires a valid TOTP
+// code or recovery code.
+func (api *API) userTwoFactorDisablePOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body TwoFactorCodePOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !u.TwoFactorEnabled {
+		api.WriteError(w, database.ErrTwoFactorNotEnabled, http.StatusBadRequest)
+		return
+	}
+	err = api.managedVerifyTwoFactorCode(req.Context(), u, body.Code)
+	if errors.Contains(err, ErrInvalidTwoFactorCode) || errors.Contains(err, database.ErrTwoFactorCodeUsed) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.UserTwoFactorDisable(req.Context(), u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// loginTwoFactorPOST completes the login of a user with 2FA enabled. It
+// expects the token returned by POST /login after a successful credentials
+// check, along with a valid TOTP code or recovery code.
+func (api *API) loginTwoFactorPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body LoginTwoFactorPOST
+	err := parseRequestBodyJSON(req.Body, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var tk twoFactorLoginToken
+	err = twoFactorTokenCodec.Decode(twoFactorLoginTokenName, body.Token, &tk)
+	if err != nil {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrInvalidTwoFactorToken, http.StatusUnauthorized)
+		return
+	}
+	ctx := req.Context()
+	u, err := api.staticDB.UserBySub(ctx, tk.Sub)
+	if err != nil || u.Deleted() {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
+	if u.Suspended {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		api.WriteError(w, ErrAccountSuspended, http.StatusForbidden)
+		return
+	}
+	// The user might have disabled 2FA since they got the token. They have
+	// already provided valid credentials, so we let them in.
+	if u.TwoFactorEnabled {
+		err = api.managedVerifyTwoFactorCode(ctx, u, body.Code)
+		if errors.Contains(err, ErrInvalidTwoFactorCode) || errors.Contains(err, database.ErrTwoFactorCodeUsed) {
+			metrics.Logins.Inc(metrics.LoginFailure)
+			api.WriteError(w, err, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	api.loginUser(req, w, u, tk.TTL, false, true)
+}
+
+// writeTwoFactorRequired responds to a credentials login of a user with 2FA
+// enabled. The response holds a short-lived token which the user can exchange
+// for a session, along with a TOTP code, via POST /login/2fa.
+func (api *API) writeTwoFactorRequired(w http.ResponseWriter, u *database.User, jwtTTL int) {
+	token, err := twoFactorTokenCodec.Encode(twoFactorLoginTokenName, twoFactorLoginToken{Sub: u.Sub, TTL: jwtTTL})
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to create a two-factor login token"), http.StatusInternalServerError)
+		return
+	}
+	resp := LoginTwoFactorRequired{
+		Message: ErrTwoFactorRequired.Error(),
+		Code:    ErrCodeTwoFactorRequired,
+		Token:   token,
+	}
+	api.WriteJSONWithStatus(w, resp, http.StatusConflict)
+}
+
+// managedVerifyTwoFactorCode verifies the given TOTP code or recovery code and
+// marks it as used.
+func (api *API) managedVerifyTwoFactorCode(ctx context.Context, u *database.User, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) != totp.Digits {
+		err := api.staticDB.UserTwoFactorUseRecoveryCode(ctx, u, code)
+		if errors.Contains(err, database.ErrInvalidRecoveryCode) {
+			return ErrInvalidTwoFactorCode
+		}
+		return err
+	}
+	secret, err := decryptTwoFactorSecret(u.TwoFactorSecret)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+	return api.staticDB.UserTwoFactorUseStep(ctx, u, step)
+}
+
+// encryptTwoFactorSecret encrypts the given TOTP secret for storage in the DB.
+func encryptTwoFactorSecret(secret string) (string, error) {
+	aead, err := twoFactorAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := fastrand.Bytes(aead.NonceSize())
+	ct := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.RawStdEncoding.EncodeToString(ct), nil
+}
+
+// decryptTwoFactorSecret decrypts a TOTP secret encrypted with
+// encryptTwoFactorSecret.
+func decryptTwoFactorSecret(encSecret string) (string, error) {
+	aead, err := twoFactorAEAD()
+	if err != nil {
+		return "", err
+	}
+	ct, err := base64.RawStdEncoding.DecodeString(encSecret)
+	if err != nil || len(ct) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted two-factor secret")
+	}
+	secret, err := aead.Open(nil, ct[:aead.NonceSize()], ct[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.AddContext(err, "failed to decrypt two-factor secret")
+	}
+	return string(secret), nil
+}
+
+// twoFactorAEAD returns the cipher we use for encrypting TOTP secrets.
+func twoFactorAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(twoFactorSecretKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/totp"
+)
+
+// TestTwoFactorSecretEncryption ensures that we can decrypt the TOTP secrets
+// we encrypt and that tampered ciphertexts are rejected.
+func TestTwoFactorSecretEncryption(t *testing.T) {
+	secret := totp.GenerateSecret()
+	enc, err := encryptTwoFactorSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc == secret {
+		t.Fatal("Expected the secret to be encrypted.")
+	}
+	// Each encryption uses a new nonce.
+	enc2, err := encryptTwoFactorSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc == enc2 {
+		t.Fatal("Expected different ciphertexts for the same secret.")
+	}
+	dec, err := decryptTwoFactorSecret(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec != secret {
+		t.Fatalf("Expected '%s', got '%s'", secret, dec)
+	}
+	// Tamper with the ciphertext.
+	b := []byte(enc)
+	if b[len(b)-1] == 'A' {
+		b[len(b)-1] = 'B'
+	} else {
+		b[len(b)-1] = 'A'
+	}
+	_, err = decryptTwoFactorSecret(string(b))
+	if err == nil {
+		t.Fatal("Expected a tampered ciphertext to be rejected.")
+	}
+	_, err = decryptTwoFactorSecret("")
+	if err == nil {
+		t.Fatal("Expected an empty ciphertext to be rejected.")
+	}
+}
+
+// TestTwoFactorLoginToken ensures that two-factor login tokens round-trip and
+// can't be confused with cookies.
+func TestTwoFactorLoginToken(t *testing.T) {
+	tk := twoFactorLoginToken{Sub: "sub", TTL: 123}
+	encoded, err := twoFactorTokenCodec.Encode(twoFactorLoginTokenName, tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded twoFactorLoginToken
+	err = twoFactorTokenCodec.Decode(twoFactorLoginTokenName, encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != tk {
+		t.Fatalf("Expected %+v, got %+v", tk, decoded)
+	}
+	// A token can't be used as a cookie, nor the other way around.
+	var s string
+	if err = secureCookie.Decode(CookieName, encoded, &s); err == nil {
+		t.Fatal("Expected a two-factor login token to be rejected as a cookie.")
+	}
+	cookie, err := secureCookie.Encode(CookieName, "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = twoFactorTokenCodec.Decode(twoFactorLoginTokenName, cookie, &decoded); err == nil {
+		t.Fatal("Expected a cookie to be rejected as a two-factor login token.")
+	}
+}
@@ -1,39 +1,59 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
-	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/SkynetLabs/skynet-accounts/lib"
 	"github.com/julienschmidt/httprouter"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	// uploadCountryTimeout is the maximum amount of time we allow for tagging
+	// an upload with its country.
+	uploadCountryTimeout = 10 * time.Second
+)
+
 var (
 	// ErrTimePeriodTooLong is returned when the user requests unacceptably long
 	// time period.
 	ErrTimePeriodTooLong = errors.New("given time period is too long")
+
+	// GeoResolver tells us which country an upload came from. It doesn't know
+	// any countries by default. This value is configurable via the
+	// ACCOUNTS_GEOIP_DB environment variable.
+	GeoResolver lib.GeoResolver = lib.NoGeoResolver{}
 )
 
 type (
-	// UploaderInfo gives information about a user who created an upload.
+	// UploaderInfo gives information about a user who created an upload. We
+	// don't include any personal data, such as the user's email, because
+	// anyone can request it.
 	UploaderInfo struct {
-		UserID   primitive.ObjectID
-		Email    types.Email
-		Sub      string
-		StripeID string
+		UserID primitive.ObjectID
+		Sub    string
 	}
-	// UploadInfo gives information about a given upload.
+	// UploadInfo gives information about a given upload. UploaderIP is only
+	// included for callers who present the admin API key.
 	UploadInfo struct {
 		Skylink    string
-		UploaderIP string
+		UploaderIP string `json:",omitempty"`
 		UploadedAt time.Time
+		Unpinned   bool
 		UploaderInfo
 	}
+	// UploadInfoGET is the response of GET /uploadinfo/:skylink
+	UploadInfoGET struct {
+		Items   []UploadInfo               `json:"items"`
+		Summary database.UploadInfoSummary `json:"summary"`
+	}
 	// SkylinksList represents a list of skylinks.
 	SkylinksList struct {
 		Skylinks   []string `json:"skylinks"`
@@ -42,13 +62,24 @@ type (
 )
 
 // uploadInfoGET returns detailed information about all uploads of a given
-// skylink.
+// skylink, along with a summary of them. The summary always covers all
+// uploads, while unpinned uploads can be left out of the list of items with
+// `includeUnpinned=false`.
 func (api *API) uploadInfoGET(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	skylink := ps.ByName("skylink")
 	if !database.ValidSkylink(skylink) {
 		api.WriteError(w, database.ErrInvalidSkylink, http.StatusBadRequest)
 		return
 	}
+	includeUnpinned := true
+	if s := req.FormValue("includeUnpinned"); s != "" {
+		var err error
+		includeUnpinned, err = strconv.ParseBool(s)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid 'includeUnpinned' value"), http.StatusBadRequest)
+			return
+		}
+	}
 
 	ctx := req.Context()
 	sl, err := api.staticDB.Skylink(ctx, skylink)
@@ -62,6 +93,20 @@ func (api *API) uploadInfoGET(_ *database.User, w http.ResponseWriter, req *http
 		api.WriteError(w, errors.AddContext(err, "failed to get uploads"), http.StatusInternalServerError)
 		return
 	}
+	summary, err := api.staticDB.UploadInfoSummary(ctx, sl.ID)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to summarize uploads"), http.StatusInternalServerError)
+		return
+	}
+	if !includeUnpinned {
+		pinned := ups[:0]
+		for _, up := range ups {
+			if !up.Unpinned {
+				pinned = append(pinned, up)
+			}
+		}
+		ups = pinned
+	}
 	// Get the user data of all uploaders.
 	uploaders := make(map[primitive.ObjectID]database.User)
 	for _, up := range ups {
@@ -78,23 +123,26 @@ func (api *API) uploadInfoGET(_ *database.User, w http.ResponseWriter, req *http
 		}
 		uploaders[u.ID] = *u
 	}
-	// Create the final list of hydrated uploads.
+	// Create the final list of hydrated uploads. Anyone who can reach this
+	// endpoint can call it, so we only reveal the uploaders' IPs to admins.
+	admin := isAdmin(req)
 	upInfos := make([]UploadInfo, len(ups))
 	for i, up := range ups {
 		u := uploaders[up.UserID]
 		upInfos[i] = UploadInfo{
 			Skylink:    skylink,
-			UploaderIP: up.UploaderIP,
 			UploadedAt: up.Timestamp,
+			Unpinned:   up.Unpinned,
 			UploaderInfo: UploaderInfo{
-				UserID:   u.ID,
-				Email:    u.Email,
-				Sub:      u.Sub,
-				StripeID: u.StripeID,
+				UserID: u.ID,
+				Sub:    u.Sub,
 			},
 		}
+		if admin {
+			upInfos[i].UploaderIP = up.UploaderIP
+		}
 	}
-	api.WriteJSON(w, upInfos)
+	api.WriteJSON(w, UploadInfoGET{Items: upInfos, Summary: summary})
 }
 
 // uploadedSkylinksGET lists all uploads from the given time range.
@@ -181,3 +229,26 @@ func parseInt64Param(req *http.Request, name string) (int64, error) {
 	}
 	return val, nil
 }
+
+// threadedTagUploadCountry tags the given upload with the country of the IP it
+// came from. IPs we can't resolve, including missing ones, are tagged with
+// database.UnknownCountry. It uses its own context because the request's
+// context gets cancelled as soon as the response is sent.
+func (api *API) threadedTagUploadCountry(uploadID primitive.ObjectID, ip string) {
+	country := database.UnknownCountry
+	if parsed := net.ParseIP(ip); parsed != nil {
+		c, err := GeoResolver.Country(parsed)
+		if err != nil {
+			api.staticLogger.Debugf("Failed to resolve the country of IP '%s': %s", ip, err)
+		}
+		if err == nil && c != "" {
+			country = c
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadCountryTimeout)
+	defer cancel()
+	err := api.staticDB.UploadSetCountry(ctx, uploadID, country)
+	if err != nil {
+		api.staticLogger.Warnf("Failed to set the country of upload %s: %s", uploadID.Hex(), err)
+	}
+}
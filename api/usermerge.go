@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/hash"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// userMergePOST merges another account of the user into the current one. The
+// caller proves that they control the other account either with its email and
+// password or with a response to a login challenge for one of its pubkeys,
+// see GET /login. The other account is deleted and all of its data moves to
+// the current one.
+func (api *API) userMergePOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to read request body"), http.StatusBadRequest)
+		return
+	}
+	var src *database.User
+	var payload credentialsPOST
+	var chr database.ChallengeResponse
+	if err = json.Unmarshal(body, &payload); err == nil && payload.Email != "" && payload.Password != "" {
+		src, err = api.mergeSourceByCredentials(w, req, payload.Email, payload.Password)
+	} else if err = chr.LoadFromBytes(body); err == nil {
+		src, err = api.mergeSourceByChallengeResponse(w, req, chr)
+	} else {
+		api.WriteError(w, errors.New("either email and password or a challenge response are required"), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// The helpers have already responded.
+		return
+	}
+	if src.ID == u.ID {
+		api.WriteError(w, database.ErrMergeSameUser, http.StatusBadRequest)
+		return
+	}
+	// Remember the API keys of the merged account, so we can evict them from
+	// the cache once they belong to the current user.
+	aks, err := api.staticDB.APIKeyList(req.Context(), *src)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.UserMerge(req.Context(), u, src)
+	if errors.Contains(err, database.ErrMergeStripeConflict) {
+		api.WriteErrorWithCode(w, err, http.StatusConflict, ErrCodeMergeConflict)
+		return
+	}
+	if errors.Contains(err, database.ErrUserInOrg) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
+	if errors.Contains(err, database.ErrUserAlreadyExists) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to merge accounts"), http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.Invalidate(u.Sub)
+	api.staticUserTierCache.Invalidate(src.Sub)
+	for _, ak := range aks {
+		api.staticUserTierCache.InvalidateByPrefix(ak.Key.String())
+	}
+	api.auditLog(req, u.ID, database.AuditActionAccountMerge, map[string]string{"mergedSub": src.Sub})
+	// The merged account's uploads now count towards the current user's quota.
+	go api.checkUserQuotas(context.Background(), u)
+	api.WriteJSON(w, UserGETFromUser(u))
+}
+
+// mergeSourceByCredentials returns the user with the given email and password.
+// It responds to the caller and returns an error if there is no such user or
+// the password doesn't match. Failed attempts count towards the user's login
+// lockout, same as failed logins.
+func (api *API) mergeSourceByCredentials(w http.ResponseWriter, req *http.Request, email types.Email, password string) (*database.User, error) {
+	email, err := types.NormalizeEmail(email.String())
+	if err != nil {
+		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
+		return nil, err
+	}
+	src, err := api.staticDB.UserByEmail(req.Context(), email)
+	if err != nil || src.Deleted() {
+		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
+		return nil, ErrInvalidCredentials
+	}
+	if src.Locked() {
+		api.WriteError(w, ErrAccountLocked, http.StatusLocked)
+		return nil, ErrAccountLocked
+	}
+	err = hash.Compare(password, []byte(src.PasswordHash))
+	if err != nil {
+		api.managedLoginFailed(req.Context(), src)
+		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
+		return nil, ErrInvalidCredentials
+	}
+	if src.Suspended {
+		api.WriteError(w, ErrAccountSuspended, http.StatusForbidden)
+		return nil, ErrAccountSuspended
+	}
+	// A password isn't enough to take over an account with 2FA.
+	if src.TwoFactorEnabled {
+		err = errors.AddContext(ErrTwoFactorRequired, "disable two-factor authentication on the other account before merging it")
+		api.WriteError(w, err, http.StatusForbidden)
+		return nil, err
+	}
+	return src, nil
+}
+
+// mergeSourceByChallengeResponse returns the user who owns the pubkey which
+// signed the given response to a login challenge. It responds to the caller
+// and returns an error if the response is invalid or there is no such user.
+func (api *API) mergeSourceByChallengeResponse(w http.ResponseWriter, req *http.Request, chr database.ChallengeResponse) (*database.User, error) {
+	pk, _, err := api.staticDB.ValidateChallengeResponse(req.Context(), chr, database.ChallengeTypeLogin)
+	if err != nil {
+		api.writeChallengeResponseError(w, err, http.StatusUnauthorized)
+		return nil, err
+	}
+	src, err := api.staticDB.UserByPubKey(req.Context(), pk)
+	if err != nil || src.Deleted() {
+		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
+		return nil, ErrInvalidCredentials
+	}
+	if src.Suspended {
+		api.WriteError(w, ErrAccountSuspended, http.StatusForbidden)
+		return nil, ErrAccountSuspended
+	}
+	return src, nil
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// QuotaWebhookSignatureHeader holds the name of the header in which we
+	// send the hex-encoded HMAC-SHA256 signature of the webhook's body.
+	QuotaWebhookSignatureHeader = "Skynet-Signature"
+
+	// QuotaDirectionExceeded is the direction of a quota webhook sent when a
+	// user exceeds their quota.
+	QuotaDirectionExceeded = "exceeded"
+	// QuotaDirectionRestored is the direction of a quota webhook sent when a
+	// user goes back under their quota.
+	QuotaDirectionRestored = "restored"
+
+	// quotaWebhookMaxAttempts is the number of times we try to deliver a
+	// quota webhook before giving up.
+	quotaWebhookMaxAttempts = 3
+	// quotaWebhookTimeout is the timeout of a single delivery attempt.
+	quotaWebhookTimeout = 10 * time.Second
+)
+
+var (
+	// QuotaWebhookURL is the URL to which we POST a notification whenever a
+	// user's QuotaExceeded flag changes. The webhook is disabled when it's
+	// empty. This value is configurable via the ACCOUNTS_QUOTA_WEBHOOK_URL
+	// environment variable.
+	QuotaWebhookURL = ""
+	// QuotaWebhookSecret is the shared secret we use for signing the quota
+	// webhooks. This value is configurable via the
+	// ACCOUNTS_QUOTA_WEBHOOK_SECRET environment variable.
+	QuotaWebhookSecret = ""
+
+	// quotaWebhookBackoff is how long we wait before retrying a failed
+	// delivery. It doubles with each attempt.
+	quotaWebhookBackoff = build.Select(
+		build.Var{
+			Dev:      time.Second,
+			Testing:  10 * time.Millisecond,
+			Standard: 2 * time.Second,
+		},
+	).(time.Duration)
+)
+
+type (
+	// QuotaWebhookPayload is the body of the webhook we send when a user's
+	// QuotaExceeded flag changes.
+	QuotaWebhookPayload struct {
+		Sub           string    `json:"sub"`
+		Tier          int       `json:"tier"`
+		StorageUsed   int64     `json:"storageUsed"`
+		StorageLimit  int64     `json:"storageLimit"`
+		NumUploads    int64     `json:"numUploads"`
+		MaxNumUploads int       `json:"maxNumUploads"`
+		Timestamp     time.Time `json:"timestamp"`
+		// Direction is either QuotaDirectionExceeded or
+		// QuotaDirectionRestored.
+		Direction string `json:"direction"`
+	}
+)
+
+// QuotaWebhookSignature returns the hex-encoded HMAC-SHA256 signature of the
+// given webhook body. Receivers should compute it over the raw body and
+// compare it to the value of the QuotaWebhookSignatureHeader header.
+func QuotaWebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// quotaWebhookPayload builds the webhook payload for the given user.
+func quotaWebhookPayload(u *database.User, upStats database.UserStatsUpload, quota database.TierLimits) QuotaWebhookPayload {
+	direction := QuotaDirectionRestored
+	if u.QuotaExceeded {
+		direction = QuotaDirectionExceeded
+	}
+	return QuotaWebhookPayload{
+		Sub:           u.Sub,
+		Tier:          u.EffectiveTier(),
+		StorageUsed:   upStats.SizeTotal,
+		StorageLimit:  quota.Storage,
+		NumUploads:    upStats.CountTotal,
+		MaxNumUploads: quota.MaxNumberUploads,
+		Timestamp:     time.Now().UTC().Truncate(time.Second),
+		Direction:     direction,
+	}
+}
+
+// threadedSendQuotaWebhook delivers the given payload to QuotaWebhookURL. It
+// is meant to run in its own goroutine, so failures are only logged.
+func (api *API) threadedSendQuotaWebhook(p QuotaWebhookPayload) {
+	err := sendQuotaWebhook(QuotaWebhookURL, QuotaWebhookSecret, p)
+	if err != nil {
+		api.staticLogger.Warnf("Failed to deliver quota webhook for sub '%s': %s", p.Sub, err)
+	}
+}
+
+// sendQuotaWebhook POSTs the given payload to the given URL, retrying with an
+// exponential backoff until it succeeds or runs out of attempts.
+func sendQuotaWebhook(url, secret string, p QuotaWebhookPayload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return errors.AddContext(err, "failed to serialise webhook payload")
+	}
+	sig := QuotaWebhookSignature(secret, body)
+	client := http.Client{Timeout: quotaWebhookTimeout}
+	backoff := quotaWebhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = postQuotaWebhook(&client, url, sig, body)
+		if err == nil || attempt >= quotaWebhookMaxAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postQuotaWebhook performs a single delivery attempt.
+func postQuotaWebhook(client *http.Client, url, sig string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.AddContext(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(QuotaWebhookSignatureHeader, sig)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
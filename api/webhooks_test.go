@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+)
+
+// TestSendQuotaWebhook ensures that sendQuotaWebhook signs its payload and
+// retries failed deliveries.
+func TestSendQuotaWebhook(t *testing.T) {
+	secret := "webhook secret"
+	u := &database.User{Sub: "some sub", Tier: database.TierFree, QuotaExceeded: true}
+	upStats := database.UserStatsUpload{CountTotal: 12, SizeTotal: 1 << 20}
+	quota := database.LimitsForTier(database.TierFree)
+	p := quotaWebhookPayload(u, upStats, quota)
+
+	// The server fails the first request and accepts the second.
+	var calls int32
+	var received QuotaWebhookPayload
+	var sigOK bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sigOK = req.Header.Get(QuotaWebhookSignatureHeader) == QuotaWebhookSignature(secret, body)
+		if err = json.Unmarshal(body, &received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	err := sendQuotaWebhook(srv.URL, secret, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Fatalf("Expected 2 calls, got %d", c)
+	}
+	if !sigOK {
+		t.Fatal("Invalid signature.")
+	}
+	if received.Sub != u.Sub || received.Tier != u.Tier || received.Direction != QuotaDirectionExceeded {
+		t.Fatalf("Unexpected payload %+v", received)
+	}
+	if received.StorageUsed != upStats.SizeTotal || received.StorageLimit != quota.Storage {
+		t.Fatalf("Expected storage %d/%d, got %d/%d", upStats.SizeTotal, quota.Storage, received.StorageUsed, received.StorageLimit)
+	}
+	if received.NumUploads != upStats.CountTotal || received.MaxNumUploads != quota.MaxNumberUploads {
+		t.Fatalf("Expected uploads %d/%d, got %d/%d", upStats.CountTotal, quota.MaxNumberUploads, received.NumUploads, received.MaxNumUploads)
+	}
+	if time.Since(received.Timestamp) > time.Minute {
+		t.Fatalf("Unexpected timestamp %v", received.Timestamp)
+	}
+
+	// A user going back under their quota is reported as restored.
+	u.QuotaExceeded = false
+	if p = quotaWebhookPayload(u, upStats, quota); p.Direction != QuotaDirectionRestored {
+		t.Fatalf("Expected direction '%s', got '%s'", QuotaDirectionRestored, p.Direction)
+	}
+
+	// Deliveries which keep failing give up after quotaWebhookMaxAttempts.
+	atomic.StoreInt32(&calls, 0)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	err = sendQuotaWebhook(failing.URL, secret, p)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	if c := atomic.LoadInt32(&calls); c != quotaWebhookMaxAttempts {
+		t.Fatalf("Expected %d calls, got %d", quotaWebhookMaxAttempts, c)
+	}
+}
@@ -0,0 +1,89 @@
+// accounts-admin runs common operator tasks against the accounts database,
+// e.g.
+//
+//	accounts-admin user info user@siasky.net
+//	accounts-admin user set-tier <sub> 2
+//	accounts-admin --pretty apikeys list <sub>
+//
+// It writes the result of each command to stdout as JSON. It uses the same DB
+// environment variables as the service.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/SkynetLabs/skynet-accounts/accountsadmin"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// envDBHost holds the name of the environment variable for DB host.
+	envDBHost = "SKYNET_DB_HOST"
+	// envDBPort holds the name of the environment variable for DB port.
+	envDBPort = "SKYNET_DB_PORT"
+	// envDBUser holds the name of the environment variable for DB username.
+	envDBUser = "SKYNET_DB_USER"
+	// envDBPass holds the name of the environment variable for DB password.
+	envDBPass = "SKYNET_DB_PASS" // #nosec G101: Potential hardcoded credentials
+)
+
+// loadDBCredentials creates a new DB connection based on credentials found in
+// the environment variables.
+func loadDBCredentials() (database.DBCredentials, error) {
+	var cds database.DBCredentials
+	var ok bool
+	if cds.User, ok = os.LookupEnv(envDBUser); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBUser)
+	}
+	if cds.Password, ok = os.LookupEnv(envDBPass); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBPass)
+	}
+	if cds.Host, ok = os.LookupEnv(envDBHost); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBHost)
+	}
+	if cds.Port, ok = os.LookupEnv(envDBPort); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBPort)
+	}
+	return cds, nil
+}
+
+// usage prints the usage of the tool to stderr.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [--pretty] <command> [arguments]\n", os.Args[0])
+	accountsadmin.Usage(os.Stderr)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	// We log to stderr, so the result is the only thing on stdout.
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(logrus.WarnLevel)
+	creds, err := loadDBCredentials()
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to load the DB credentials"))
+	}
+
+	ctx := context.Background()
+	db, err := database.New(ctx, creds, logger)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to connect to the DB"))
+	}
+	err = accountsadmin.New(db, os.Stdout).Run(ctx, os.Args[1:])
+	if errors.Contains(err, accountsadmin.ErrUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,99 @@
+// user_import imports users from another authentication system. It reads a
+// newline-delimited JSON file with one user per line, e.g.
+//
+//	{"email":"user@siasky.net","passwordHash":"$argon2id$v=19$...","passwordHashAlgorithm":"argon2id","sub":"...","tier":1,"createdAt":"2021-06-01T10:00:00Z","stripeCustomerId":"cus_..."}
+//
+// and creates or updates the users in the database. It writes a summary of the
+// import to stdout as JSON. It uses the same DB environment variables as the
+// service.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/userimport"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// envDBHost holds the name of the environment variable for DB host.
+	envDBHost = "SKYNET_DB_HOST"
+	// envDBPort holds the name of the environment variable for DB port.
+	envDBPort = "SKYNET_DB_PORT"
+	// envDBUser holds the name of the environment variable for DB username.
+	envDBUser = "SKYNET_DB_USER"
+	// envDBPass holds the name of the environment variable for DB password.
+	envDBPass = "SKYNET_DB_PASS" // #nosec G101: Potential hardcoded credentials
+)
+
+// loadDBCredentials creates a new DB connection based on credentials found in
+// the environment variables.
+func loadDBCredentials() (database.DBCredentials, error) {
+	var cds database.DBCredentials
+	var ok bool
+	if cds.User, ok = os.LookupEnv(envDBUser); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBUser)
+	}
+	if cds.Password, ok = os.LookupEnv(envDBPass); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBPass)
+	}
+	if cds.Host, ok = os.LookupEnv(envDBHost); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBHost)
+	}
+	if cds.Port, ok = os.LookupEnv(envDBPort); !ok {
+		return database.DBCredentials{}, errors.New("missing env var " + envDBPort)
+	}
+	return cds, nil
+}
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "validate the file and report what would be imported without writing to the database")
+	chunkSize := flag.Int("chunk-size", userimport.DefaultChunkSize, "number of lines to process between two progress reports")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <users.jsonl>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// We log to stderr, so the report is the only thing on stdout.
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	creds, err := loadDBCredentials()
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to load the DB credentials"))
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to open the import file"))
+	}
+
+	ctx := context.Background()
+	db, err := database.New(ctx, creds, logger)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to connect to the DB"))
+	}
+	report, importErr := userimport.New(db, logger, *dryRun, *chunkSize).Import(ctx, f)
+	_ = f.Close()
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to serialize the report"))
+	}
+	fmt.Println(string(b))
+	if importErr != nil {
+		log.Fatal(importErr)
+	}
+	if report.Errors > 0 {
+		os.Exit(1)
+	}
+}
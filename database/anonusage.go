@@ -0,0 +1,60 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// AnonUsageRetention defines how long we keep the hourly anonymous usage
+	// counters around. We only ever need the current hour's.
+	AnonUsageRetention = 2 * time.Hour
+)
+
+// AnonUsage holds the number of anonymous uploads and downloads tracked from
+// a single IP during a single hour.
+type AnonUsage struct {
+	IP        string    `bson:"ip"`
+	Hour      time.Time `bson:"hour"`
+	Uploads   int64     `bson:"uploads"`
+	Downloads int64     `bson:"downloads"`
+}
+
+// AnonUsageByHour returns the anonymous usage of all IPs during the hour
+// starting at the given time.
+func (db *DB) AnonUsageByHour(ctx context.Context, hour time.Time) ([]AnonUsage, error) {
+	c, err := db.staticAnonUsage.Find(ctx, bson.M{"hour": hour.UTC()})
+	if err != nil {
+		return nil, errors.AddContext(err, "DB query failed")
+	}
+	var usage []AnonUsage
+	if err = c.All(ctx, &usage); err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	return usage, nil
+}
+
+// AnonUsageIncrement adds the given numbers of uploads and downloads to the
+// stored anonymous usage of the respective IPs and hours. Several instances
+// of accounts can increment the same counters.
+func (db *DB) AnonUsageIncrement(ctx context.Context, usage []AnonUsage) error {
+	if len(usage) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(usage))
+	for _, u := range usage {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"ip": u.IP, "hour": u.Hour.UTC()}).
+			SetUpdate(bson.M{"$inc": bson.M{"uploads": u.Uploads, "downloads": u.Downloads}}).
+			SetUpsert(true))
+	}
+	_, err := db.staticAnonUsage.BulkWrite(ctx, models)
+	if err != nil {
+		return errors.AddContext(err, "failed to update anonymous usage")
+	}
+	return nil
+}
@@ -12,12 +12,13 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 /**
-API keys are authentication tokens generated by users. They do not expire, thus
-allowing users to use them for a long time and to embed them in apps and on
-machines. API keys can be revoked when they are no longer needed or if they get
+API keys are authentication tokens generated by users. They do not expire by
+default, thus allowing users to use them for a long time and to embed them in
+apps and on machines. API keys can be revoked when they are no longer needed or if they get
 compromised or are no longer needed. This is done by deleting them from this
 service.
 
@@ -30,8 +31,23 @@ token, either via an authorization header or a cookie.
 Public API keys can only be use for downloading skylinks. The list of skylinks
 that can be downloaded by a given public API key is stored under the `skylinks`
 array within the API key record.
+
+Private API keys can additionally be limited to read-only access by setting
+their `scope` to `read`. Such keys can only be used for GET requests. Keys
+without a scope predate this feature and are treated as having full access.
+
+Both kinds of API keys can optionally have an expiration date. Expired API keys
+behave exactly like nonexistent ones. They are eventually removed from the
+database but we don't rely on that for enforcing the expiration.
 */
 
+const (
+	// APIKeyScopeRead marks API keys which can only be used for reading data.
+	APIKeyScopeRead = "read"
+	// APIKeyScopeFull marks API keys which give full API access.
+	APIKeyScopeFull = "full"
+)
+
 var (
 	// MaxNumAPIKeysPerUser sets the limit for number of API keys a single user
 	// can create. If a user reaches that limit they can always delete some API
@@ -41,6 +57,13 @@ var (
 	// ErrMaxNumAPIKeysExceeded is returned when a user tries to create a new
 	// API key after already having the maximum allowed number.
 	ErrMaxNumAPIKeysExceeded = errors.New("maximum number of api keys exceeded")
+	// MaxNumSkylinksPerAPIKey sets the limit for the number of skylinks a
+	// single public API key can cover. This value is configurable via the
+	// ACCOUNTS_MAX_NUM_SKYLINKS_PER_API_KEY environment variable.
+	MaxNumSkylinksPerAPIKey = 1000
+	// ErrMaxNumSkylinksExceeded is returned when a public API key would cover
+	// more than the maximum allowed number of skylinks.
+	ErrMaxNumSkylinksExceeded = errors.New("maximum number of skylinks per api key exceeded")
 	// ErrInvalidAPIKey is an error returned when the given API key is invalid.
 	ErrInvalidAPIKey = errors.New("invalid api key")
 	// ErrInvalidAPIKeyOperation covers a range of invalid operations on API
@@ -48,15 +71,27 @@ var (
 	// API key, editing a private API key. This error should be used with
 	// additional context, specifying the exact operation that failed.
 	ErrInvalidAPIKeyOperation = errors.New("invalid api key operation")
+	// ErrInvalidAPIKeyScope is returned when the given API key scope is not
+	// one of the supported scopes.
+	ErrInvalidAPIKeyScope = errors.New("invalid api key scope")
+	// ErrInvalidAPIKeyExpiry is returned when the given API key expiration
+	// date is not in the future.
+	ErrInvalidAPIKeyExpiry = errors.New("api key expiration date must be in the future")
+
+	// APIKeyExpiredRetention defines how long we keep expired API keys before
+	// we remove them from the database. Keeping them around for a while
+	// allows their owners to see which of their keys have expired.
+	APIKeyExpiredRetention = 30 * 24 * time.Hour
 )
 
 type (
 	// APIKey is the hex representation of a base32-encoded random 32-byte slice
 	// length PubKeySize
 	APIKey string
-	// APIKeyRecord is a non-expiring authentication token generated on user
-	// demand. Public API keys allow downloading a given set of skylinks, while
-	// private API keys give full API access.
+	// APIKeyRecord is an authentication token generated on user demand.
+	// Public API keys allow downloading a given set of skylinks, while
+	// private API keys give full API access. API keys without an expiration
+	// date never expire.
 	APIKeyRecord struct {
 		ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 		UserID    primitive.ObjectID `bson:"user_id" json:"-"`
@@ -64,7 +99,10 @@ type (
 		Public    bool               `bson:"public,string" json:"public,string"`
 		Key       APIKey             `bson:"key" json:"-"`
 		Skylinks  []string           `bson:"skylinks" json:"skylinks"`
+		Scope     string             `bson:"scope,omitempty" json:"scope"`
 		CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+		ExpiresAt time.Time          `bson:"expires_at,omitempty" json:"expiresAt,omitempty"`
+		RotatedAt time.Time          `bson:"rotated_at,omitempty" json:"rotatedAt,omitempty"`
 	}
 )
 
@@ -134,29 +172,80 @@ func (akr APIKeyRecord) CoversSkylink(sl string) bool {
 	return false
 }
 
-// APIKeyCreate creates a new API key.
-func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public bool, skylinks []string) (*APIKeyRecord, error) {
+// Expired tells us whether the API key has expired.
+func (akr APIKeyRecord) Expired() bool {
+	return !akr.ExpiresAt.IsZero() && !akr.ExpiresAt.After(time.Now().UTC())
+}
+
+// ValidAPIKeyScope checks whether the given string is a valid API key scope.
+// An empty scope is valid and defaults to APIKeyScopeFull.
+func ValidAPIKeyScope(scope string) bool {
+	return scope == "" || scope == APIKeyScopeRead || scope == APIKeyScopeFull
+}
+
+// EffectiveScope returns the scope of the API key. Keys created before we
+// introduced scopes don't have one, so they get full access. Public API keys
+// are always read-only.
+func (akr APIKeyRecord) EffectiveScope() string {
+	if akr.Public || akr.Scope == APIKeyScopeRead {
+		return APIKeyScopeRead
+	}
+	return APIKeyScopeFull
+}
+
+// APIKeyCreate creates a new API key. An empty scope defaults to
+// APIKeyScopeFull for private API keys. Public API keys are always read-only.
+// A zero expiresAt creates an API key which never expires.
+func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public bool, skylinks []string, scope string, expiresAt time.Time) (*APIKeyRecord, error) {
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
-	n, err := db.staticAPIKeys.CountDocuments(ctx, bson.M{"user_id": user.ID})
+	// Touch the user's record before counting their API keys. When we run in
+	// a transaction, e.g. under api.WithDBSession, this makes concurrent
+	// creations for the same user conflict on that record, so only one of
+	// them gets to count and insert at a time and the others are retried.
+	// Without it, they could all pass the count check.
+	_, err := db.staticUsers.UpdateOne(ctx, bson.M{"_id": user.ID}, withVersionBump(bson.M{"$currentDate": bson.M{"api_keys_changed_at": true}}))
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to lock the user's API keys")
+	}
+	n, err := db.APIKeyCount(ctx, user)
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to ensure user can create a new API key")
 	}
-	if n > int64(MaxNumAPIKeysPerUser) {
+	if n >= int64(MaxNumAPIKeysPerUser) {
 		return nil, ErrMaxNumAPIKeysExceeded
 	}
 	if !public && len(skylinks) > 0 {
 		return nil, errors.AddContext(ErrInvalidAPIKeyOperation, "cannot define skylinks for a private api key")
 	}
+	if len(skylinks) > MaxNumSkylinksPerAPIKey {
+		return nil, ErrMaxNumSkylinksExceeded
+	}
+	if !ValidAPIKeyScope(scope) {
+		return nil, ErrInvalidAPIKeyScope
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now().UTC()) {
+		return nil, ErrInvalidAPIKeyExpiry
+	}
+	if public {
+		scope = APIKeyScopeRead
+	}
+	if scope == "" {
+		scope = APIKeyScopeFull
+	}
 	akr := APIKeyRecord{
 		UserID:    user.ID,
 		Name:      name,
 		Public:    public,
 		Key:       NewAPIKey(),
 		Skylinks:  skylinks,
+		Scope:     scope,
 		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
 	}
+	if !expiresAt.IsZero() {
+		akr.ExpiresAt = expiresAt.UTC().Truncate(time.Millisecond)
+	}
 	ior, err := db.staticAPIKeys.InsertOne(ctx, akr)
 	if err != nil {
 		return nil, err
@@ -165,6 +254,12 @@ func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public b
 	return &akr, nil
 }
 
+// APIKeyCount returns the number of API keys the user has, including the
+// expired ones. They all count towards MaxNumAPIKeysPerUser.
+func (db *DB) APIKeyCount(ctx context.Context, user User) (int64, error) {
+	return db.staticAPIKeys.CountDocuments(ctx, bson.M{"user_id": user.ID})
+}
+
 // APIKeyDelete deletes an API key.
 func (db *DB) APIKeyDelete(ctx context.Context, user User, akID primitive.ObjectID) error {
 	if user.ID.IsZero() {
@@ -181,12 +276,54 @@ func (db *DB) APIKeyDelete(ctx context.Context, user User, akID primitive.Object
 	if dr.DeletedCount == 0 {
 		return mongo.ErrNoDocuments
 	}
+	db.managedRecordChangeEvent(ctx, ChangeEvent{
+		Type:     ChangeEventAPIKeyRevoked,
+		Sub:      user.Sub,
+		APIKeyID: akID.Hex(),
+	})
 	return nil
 }
 
-// APIKeyByKey returns a specific API key.
+// APIKeyRotate replaces the secret of an existing API key with a new one. The
+// API key keeps its ID, its kind, and its covered skylinks, while its old
+// secret stops working. It returns the updated API key.
+func (db *DB) APIKeyRotate(ctx context.Context, user User, akID primitive.ObjectID) (*APIKeyRecord, error) {
+	if user.ID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	filter := bson.M{
+		"_id":     akID,
+		"user_id": user.ID,
+	}
+	update := bson.M{"$set": bson.M{
+		"key":        NewAPIKey(),
+		"rotated_at": time.Now().UTC().Truncate(time.Millisecond),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var akr APIKeyRecord
+	err := db.staticAPIKeys.FindOneAndUpdate(ctx, filter, update, opts).Decode(&akr)
+	if err != nil {
+		return nil, err
+	}
+	db.managedRecordChangeEvent(ctx, ChangeEvent{
+		Type:     ChangeEventAPIKeyRotated,
+		Sub:      user.Sub,
+		APIKeyID: akID.Hex(),
+	})
+	return &akr, nil
+}
+
+// APIKeyByKey returns a specific API key. Expired API keys are treated as if
+// they don't exist.
 func (db *DB) APIKeyByKey(ctx context.Context, key string) (APIKeyRecord, error) {
-	sr := db.staticAPIKeys.FindOne(ctx, bson.M{"key": key})
+	filter := bson.M{
+		"key": key,
+		"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$exists": false}},
+			bson.M{"expires_at": bson.M{"$gt": time.Now().UTC()}},
+		},
+	}
+	sr := db.staticAPIKeys.FindOne(ctx, filter)
 	if sr.Err() != nil {
 		return APIKeyRecord{}, sr.Err()
 	}
@@ -243,6 +380,9 @@ func (db *DB) APIKeyUpdate(ctx context.Context, user User, akID primitive.Object
 			return errors.AddContext(ErrInvalidSkylink, "offending skylink: "+s)
 		}
 	}
+	if len(skylinks) > MaxNumSkylinksPerAPIKey {
+		return ErrMaxNumSkylinksExceeded
+	}
 	filter := bson.M{
 		"_id":     akID,
 		"public":  true,
@@ -259,48 +399,175 @@ func (db *DB) APIKeyUpdate(ctx context.Context, user User, akID primitive.Object
 	return nil
 }
 
-// APIKeyPatch updates an existing API key. This works by adding and removing
-// skylinks to its record. Only valid for public API keys.
-func (db *DB) APIKeyPatch(ctx context.Context, user User, akID primitive.ObjectID, addSkylinks, removeSkylinks []string) error {
+// APIKeySetExpiry sets the expiration date of an existing API key. A zero
+// expiresAt removes the expiration date, so the API key never expires.
+func (db *DB) APIKeySetExpiry(ctx context.Context, user User, akID primitive.ObjectID, expiresAt time.Time) error {
 	if user.ID.IsZero() {
 		return errors.New("invalid user")
 	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now().UTC()) {
+		return ErrInvalidAPIKeyExpiry
+	}
+	filter := bson.M{
+		"_id":     akID,
+		"user_id": user.ID,
+	}
+	update := bson.M{"$unset": bson.M{"expires_at": ""}}
+	if !expiresAt.IsZero() {
+		update = bson.M{"$set": bson.M{"expires_at": expiresAt.UTC().Truncate(time.Millisecond)}}
+	}
+	ur, err := db.staticAPIKeys.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// APIKeyPatch updates an existing API key by adding and removing skylinks to
+// its record and returns the updated record. Only valid for public API keys.
+// Skylinks which are both added and removed end up removed. It returns
+// ErrMaxNumSkylinksExceeded if the resulting list would be longer than
+// MaxNumSkylinksPerAPIKey.
+//
+// We apply both changes and check the limit in a single update, so concurrent
+// patches merge instead of overwriting each other. Mongo doesn't allow
+// $addToSet and $pull on the same field within one update, so we compute the
+// new list with an update pipeline instead.
+func (db *DB) APIKeyPatch(ctx context.Context, user User, akID primitive.ObjectID, addSkylinks, removeSkylinks []string) (*APIKeyRecord, error) {
+	if user.ID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
 	// Validate all given skylinks.
 	for _, s := range append(addSkylinks, removeSkylinks...) {
 		if !ValidSkylink(s) {
-			return errors.AddContext(ErrInvalidSkylink, "offending skylink: "+s)
+			return nil, errors.AddContext(ErrInvalidSkylink, "offending skylink: "+s)
 		}
 	}
-	filter := bson.M{
-		"_id":    akID,
-		"public": true,
-	}
-	var update bson.M
-	// First, all new skylinks to the record.
-	if len(addSkylinks) > 0 {
-		update = bson.M{
-			"$addToSet": bson.M{"skylinks": bson.M{"$each": addSkylinks}},
+	remove := make(map[string]struct{}, len(removeSkylinks))
+	toRemove := make([]string, 0, len(removeSkylinks))
+	for _, s := range removeSkylinks {
+		if _, exists := remove[s]; !exists {
+			remove[s] = struct{}{}
+			toRemove = append(toRemove, s)
 		}
-		ur, err := db.staticAPIKeys.UpdateOne(ctx, filter, update)
-		if err != nil {
-			return err
-		}
-		if ur.ModifiedCount == 0 {
-			return mongo.ErrNoDocuments
+	}
+	added := make(map[string]struct{}, len(addSkylinks))
+	toAdd := make([]string, 0, len(addSkylinks))
+	for _, s := range addSkylinks {
+		_, removed := remove[s]
+		_, exists := added[s]
+		if !removed && !exists {
+			added[s] = struct{}{}
+			toAdd = append(toAdd, s)
 		}
 	}
-	// Then, remove all skylinks that need to be removed.
-	if len(removeSkylinks) > 0 {
-		update = bson.M{
-			"$pull": bson.M{"skylinks": bson.M{"$in": removeSkylinks}},
+	// The new list keeps the order of the existing skylinks and appends the
+	// ones which are not in it, yet.
+	current := bson.M{"$ifNull": bson.A{"$skylinks", bson.A{}}}
+	kept := bson.M{"$filter": bson.M{
+		"input": current,
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", toRemove}}}},
+	}}
+	appended := bson.M{"$filter": bson.M{
+		"input": toAdd,
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", current}}}},
+	}}
+	skylinks := bson.M{"$concatArrays": bson.A{kept, appended}}
+
+	filter := bson.M{
+		"_id":     akID,
+		"public":  true,
+		"user_id": user.ID,
+		"$expr":   bson.M{"$lte": bson.A{bson.M{"$size": skylinks}, MaxNumSkylinksPerAPIKey}},
+	}
+	update := bson.A{bson.M{"$set": bson.M{"skylinks": skylinks}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	sr := db.staticAPIKeys.FindOneAndUpdate(ctx, filter, update, opts)
+	var akr APIKeyRecord
+	err := sr.Decode(&akr)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		// Find out whether the key doesn't exist or the limit stopped us.
+		delete(filter, "$expr")
+		n, errCount := db.staticAPIKeys.CountDocuments(ctx, filter)
+		if errCount != nil {
+			return nil, errCount
 		}
-		ur, err := db.staticAPIKeys.UpdateOne(ctx, filter, update)
-		if err != nil {
-			return err
+		if n > 0 {
+			return nil, ErrMaxNumSkylinksExceeded
 		}
-		if ur.ModifiedCount == 0 {
-			return errors.New("public API key not found, no keys updated")
+		return nil, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &akr, nil
+}
+
+// APIKeyCountGrandfathered returns the number of public API keys which are
+// owned by users whose tier is no longer allowed to create public API keys.
+// These keys continue to work. A nil list of allowed tiers means that all tiers
+// are allowed, so there are no grandfathered keys.
+func (db *DB) APIKeyCountGrandfathered(ctx context.Context, allowedTiers []int) (int64, error) {
+	if allowedTiers == nil {
+		return 0, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"public", true}}}},
+		{{"$lookup", bson.D{
+			{"from", collUsers},
+			{"localField", "user_id"},
+			{"foreignField", "_id"},
+			{"as", "owner"},
+		}}},
+		{{"$unwind", "$owner"}},
+		// Mirror User.EffectiveTier: organization members get their
+		// organization's tier, everybody else gets the higher of their paid
+		// tier and their trial tier, while the trial lasts.
+		{{"$addFields", bson.D{{"effective_tier", bson.D{{"$cond", bson.A{
+			bson.D{{"$gt", bson.A{bson.D{{"$ifNull", bson.A{"$owner.org_id", nil}}}, nil}}},
+			"$owner.org_tier",
+			bson.D{{"$cond", bson.A{
+				bson.D{{"$and", bson.A{
+					bson.D{{"$gt", bson.A{"$owner.trial_tier", "$owner.tier"}}},
+					bson.D{{"$gt", bson.A{"$owner.trial_until", time.Now().UTC()}}},
+				}}},
+				"$owner.trial_tier",
+				"$owner.tier",
+			}}},
+		}}}}}}},
+		{{"$match", bson.D{{"effective_tier", bson.D{{"$nin", allowedTiers}}}}}},
+		{{"$count", "count"}},
+	}
+	c, err := aggregate(ctx, db.staticAPIKeys, pipeline)
+	if err != nil {
+		return 0, errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Debugln("Error on closing DB cursor.", errDef)
 		}
+	}()
+	if ok := c.Next(ctx); !ok {
+		return 0, nil
+	}
+	// We need this struct, so we can safely decode both int32 and int64.
+	result := struct {
+		Count int64 `bson:"count"`
+	}{}
+	if err = c.Decode(&result); err != nil {
+		return 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	return result.Count, nil
+}
+
+// apiKeyIDFilter returns a filter value which matches records created with
+// the given API key or, if the ID is zero, records created without one.
+func apiKeyIDFilter(akID primitive.ObjectID) interface{} {
+	if akID.IsZero() {
+		return bson.M{"$exists": false}
 	}
-	return nil
+	return akID
 }
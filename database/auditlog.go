@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+The audit_log collection holds a record of each security-relevant event on a
+user's account, such as logins, password and email changes, and changes to the
+user's keys. Support can use it to answer questions like "who changed this
+account's email and when?".
+*/
+
+const (
+	// AuditActionLogin is recorded when the user logs in.
+	AuditActionLogin = "login"
+	// AuditActionLogout is recorded when the user logs out.
+	AuditActionLogout = "logout"
+	// AuditActionPasswordChange is recorded when the user changes their
+	// password, including via account recovery.
+	AuditActionPasswordChange = "password_change"
+	// AuditActionEmailChange is recorded when the user requests a change of
+	// their email address.
+	AuditActionEmailChange = "email_change"
+	// AuditActionPubKeyAdd is recorded when the user adds a public key.
+	AuditActionPubKeyAdd = "pubkey_add"
+	// AuditActionPubKeyRemove is recorded when the user removes a public key.
+	AuditActionPubKeyRemove = "pubkey_remove"
+	// AuditActionAPIKeyCreate is recorded when the user creates an API key.
+	AuditActionAPIKeyCreate = "api_key_create"
+	// AuditActionAPIKeyDelete is recorded when the user deletes an API key.
+	AuditActionAPIKeyDelete = "api_key_delete"
+	// AuditActionAPIKeyRotate is recorded when the user rotates an API key.
+	AuditActionAPIKeyRotate = "api_key_rotate"
+	// AuditActionTierChange is recorded when the user's tier changes.
+	AuditActionTierChange = "tier_change"
+	// AuditActionAccountDelete is recorded when the user deletes their
+	// account.
+	AuditActionAccountDelete = "account_delete"
+	// AuditActionAccountMerge is recorded when the user merges another one
+	// of their accounts into this one.
+	AuditActionAccountMerge = "account_merge"
+)
+
+type (
+	// AuditLogEntry describes a single security-relevant event on a user's
+	// account.
+	AuditLogEntry struct {
+		ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+		UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+		Action    string             `bson:"action" json:"action"`
+		IP        string             `bson:"ip,omitempty" json:"ip,omitempty"`
+		UserAgent string             `bson:"user_agent,omitempty" json:"userAgent,omitempty"`
+		Metadata  map[string]string  `bson:"metadata,omitempty" json:"metadata,omitempty"`
+		CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+	}
+)
+
+// AuditLogCreate records a new event on the given user's account. The IP and
+// user agent are those of the caller who triggered the event, if any.
+func (db *DB) AuditLogCreate(ctx context.Context, userID primitive.ObjectID, action, ip, userAgent string, metadata map[string]string) (*AuditLogEntry, error) {
+	if userID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	if action == "" {
+		return nil, errors.New("missing action")
+	}
+	e := AuditLogEntry{
+		UserID:    userID,
+		Action:    action,
+		IP:        ip,
+		UserAgent: userAgent,
+		Metadata:  metadata,
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	ior, err := db.staticAuditLog.InsertOne(ctx, e)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to insert audit log entry")
+	}
+	e.ID = ior.InsertedID.(primitive.ObjectID)
+	return &e, nil
+}
+
+// AuditLogByUser fetches a page of the events on the given user's account,
+// most recent first. It also reports the total number of such events.
+func (db *DB) AuditLogByUser(ctx context.Context, userID primitive.ObjectID, offset, pageSize int) ([]AuditLogEntry, int, error) {
+	if userID.IsZero() {
+		return nil, 0, errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(offset, pageSize); err != nil {
+		return nil, 0, err
+	}
+	filter := bson.M{"user_id": userID}
+	cnt, err := db.staticAuditLog.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "failed to count audit log entries")
+	}
+	entries := make([]AuditLogEntry, 0, pageSize)
+	if cnt == 0 {
+		return entries, 0, nil
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"created_at", -1}, {"_id", -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(pageSize))
+	c, err := db.staticAuditLog.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "failed to find audit log entries")
+	}
+	err = c.All(ctx, &entries)
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "failed to decode audit log entries")
+	}
+	return entries, int(cnt), nil
+}
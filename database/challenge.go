@@ -15,6 +15,7 @@ import (
 	"gitlab.com/NebulousLabs/fastrand"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -37,9 +38,23 @@ const (
 
 	// challengeTTL defines how long we accept responses to this challenge.
 	challengeTTL = 10 * time.Minute
+	// expiredChallengeRetention defines how long we keep expired challenges
+	// around, so we can tell callers that their challenge has expired instead
+	// of reporting it as not found.
+	expiredChallengeRetention = challengeTTL
+	// maxOutstandingChallenges defines how many unexpired challenges of each
+	// type we keep for a single pubkey. This prevents clients from creating
+	// an unbounded number of challenges by polling.
+	maxOutstandingChallenges = 5
 )
 
 var (
+	// ErrChallengeExpired is returned when the caller responds to a
+	// challenge after its expiration.
+	ErrChallengeExpired = errors.New("challenge expired")
+	// ErrChallengeNotFound is returned when the caller responds to a
+	// challenge we don't know about.
+	ErrChallengeNotFound = errors.New("challenge not found")
 	// ErrInvalidChallengeResponse is returned when the received challenge
 	// response object is not valid, i.e. it's either missing one of its
 	// required fields or those do not follow the expected format.
@@ -62,6 +77,10 @@ type (
 		Type      string    `bson:"type" json:"-"`
 		PubKey    PubKey    `bson:"pub_key" json:"-"`
 		ExpiresAt time.Time `bson:"expires_at" json:"-"`
+		// RetryAfter is only set when we hand out an existing challenge
+		// because the pubkey has too many outstanding ones. It's the time
+		// at which the oldest of those expires, so we can issue a new one.
+		RetryAfter time.Time `bson:"-" json:"-"`
 	}
 
 	// ChallengeResponse defines the format of a fully parsed and validated
@@ -92,10 +111,51 @@ type (
 )
 
 // NewChallenge creates a new challenge with the given type and pubKey.
+//
+// A pubkey can have at most maxOutstandingChallenges unexpired challenges of
+// each type. Once it reaches that limit, we return the newest of its login and
+// registration challenges instead of creating a new one. We can't share update
+// challenges because each one is tied to the unconfirmed update of a specific
+// user, so we delete the oldest ones instead. Concurrent calls can push the
+// number of challenges slightly over the limit.
 func (db *DB) NewChallenge(ctx context.Context, pubKey PubKey, cType string) (*Challenge, error) {
 	if cType != ChallengeTypeLogin && cType != ChallengeTypeRegister && cType != ChallengeTypeUpdate {
 		return nil, fmt.Errorf("invalid challenge type '%s'", cType)
 	}
+	filter := bson.M{
+		"pub_key":    pubKey,
+		"type":       cType,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"expires_at", -1}, {"_id", -1}}).
+		SetLimit(maxOutstandingChallenges)
+	c, err := db.staticChallenges.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch outstanding challenges")
+	}
+	var outstanding []Challenge
+	err = c.All(ctx, &outstanding)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode outstanding challenges")
+	}
+	if len(outstanding) >= maxOutstandingChallenges {
+		if cType != ChallengeTypeUpdate {
+			ch := outstanding[0]
+			ch.RetryAfter = outstanding[len(outstanding)-1].ExpiresAt
+			return &ch, nil
+		}
+		// Make room for the new challenge.
+		keep := make([]primitive.ObjectID, 0, maxOutstandingChallenges-1)
+		for _, ch := range outstanding[:maxOutstandingChallenges-1] {
+			keep = append(keep, ch.ID)
+		}
+		filter["_id"] = bson.M{"$nin": keep}
+		_, err = db.staticChallenges.DeleteMany(ctx, filter)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to delete old challenges")
+		}
+	}
 	ch := &Challenge{
 		Challenge: hex.EncodeToString(fastrand.Bytes(ChallengeSize)),
 		Type:      cType,
@@ -158,29 +218,64 @@ func (db *DB) ValidateChallengeResponse(ctx context.Context, chr ChallengeRespon
 	var ch Challenge
 	err = sr.Decode(&ch)
 	if err != nil {
-		return nil, primitive.ObjectID{}, errors.AddContext(err, "challenge not found")
+		return nil, primitive.ObjectID{}, errors.Compose(ErrChallengeNotFound, err)
 	}
 	if ch.ExpiresAt.Before(time.Now().UTC()) {
-		return nil, primitive.ObjectID{}, errors.New("challenge expired")
+		return nil, primitive.ObjectID{}, ErrChallengeExpired
 	}
 	if !verifySignature(ch.PubKey, resp, chr.Signature) {
 		return nil, primitive.ObjectID{}, errors.New("invalid signature")
 	}
 	// Now that the challenge has been used, we delete it from the DB. If this
 	// errors out we'll log the error but we will still return success to the
-	// caller.
-	_, err = db.staticChallenges.DeleteOne(ctx, bson.M{"_id": ch.ID})
+	// caller. If the challenge is already gone, it expired and got pruned
+	// since we fetched it, or it was used by a concurrent request.
+	dr, err := db.staticChallenges.DeleteOne(ctx, bson.M{"_id": ch.ID})
 	if err != nil {
 		db.staticLogger.Debugln("Failed to delete challenge from DB:", err)
+	} else if dr.DeletedCount == 0 {
+		return nil, primitive.ObjectID{}, ErrChallengeExpired
 	}
 	// Clean up all expired challenges as well.
-	_, err = db.staticChallenges.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": time.Now().UTC()}})
+	cutoff := time.Now().UTC().Add(-expiredChallengeRetention)
+	_, err = db.staticChallenges.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": cutoff}})
 	if err != nil {
 		db.staticLogger.Debugln("Failed to delete expired challenges from DB:", err)
 	}
+	// Keep track of when each pubkey was last used for logging in.
+	if cType == ChallengeTypeLogin {
+		err = db.managedPubKeyTouch(ctx, ch.PubKey)
+		if err != nil {
+			db.staticLogger.Debugln("Failed to update the pubkey's last used time:", err)
+		}
+	}
 	return ch.PubKey, ch.ID, nil
 }
 
+// ChallengeSetExpiration is a helper method for testing purposes. It sets the
+// expiration time of the given challenge.
+func (db *DB) ChallengeSetExpiration(ctx context.Context, challenge string, expiresAt time.Time) error {
+	ur, err := db.staticChallenges.UpdateOne(ctx, bson.M{"challenge": challenge}, bson.M{"$set": bson.M{"expires_at": expiresAt}})
+	if err != nil {
+		return err
+	}
+	if ur.MatchedCount == 0 {
+		return ErrChallengeNotFound
+	}
+	return nil
+}
+
+// ChallengeCount is a helper method for testing purposes. It returns the
+// number of unexpired challenges of the given type for the given pubkey.
+func (db *DB) ChallengeCount(ctx context.Context, pubKey PubKey, cType string) (int64, error) {
+	filter := bson.M{
+		"pub_key":    pubKey,
+		"type":       cType,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	return db.staticChallenges.CountDocuments(ctx, filter)
+}
+
 // StoreUnconfirmedUserUpdate stores an UnconfirmedUserUpdate in the DB.
 func (db *DB) StoreUnconfirmedUserUpdate(ctx context.Context, uu *UnconfirmedUserUpdate) error {
 	_, err := db.staticUnconfirmedUserUpdates.InsertOne(ctx, uu)
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+The change_events collection is an append-only log of changes to users which
+external services (e.g. the pinning service) care about. They consume it via an
+opaque cursor, which is the sequence number of the last event they have seen.
+Events are kept for ChangeEventsRetention and are automatically removed by a
+TTL index after that.
+
+Events are written after the mutation they describe has been applied, so a
+consumer might see an event more than once (e.g. when a Stripe webhook is
+retried) but should never miss one which happened within the retention window.
+
+Each event gets its sequence number from a counter in the DB before it's
+written, so the numbers are ordered regardless of the clocks of the accounts
+instances. An instance might still write its event after another instance
+has written one with a higher number, so the cursor never moves past a missing
+number until changeEventsGapTimeout has passed.
+*/
+
+const (
+	// ChangeEventTierChanged is the type of event we record when a user's
+	// tier changes.
+	ChangeEventTierChanged = "tier_changed"
+	// ChangeEventUserDeleted is the type of event we record when a user is
+	// deleted.
+	ChangeEventUserDeleted = "user_deleted"
+	// ChangeEventQuotaExceededChanged is the type of event we record when a
+	// user's QuotaExceeded flag flips.
+	ChangeEventQuotaExceededChanged = "quota_exceeded_changed"
+	// ChangeEventAPIKeyRevoked is the type of event we record when a user
+	// deletes one of their API keys.
+	ChangeEventAPIKeyRevoked = "api_key_revoked"
+	// ChangeEventAPIKeyRotated is the type of event we record when a user
+	// rotates one of their API keys, i.e. its old secret stops working.
+	ChangeEventAPIKeyRotated = "api_key_rotated"
+
+	// ChangeEventsRetention defines how long we keep change events around.
+	ChangeEventsRetention = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidCursor is returned when a change events cursor is malformed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// changeEventsGapTimeout defines how long we wait for the event with a
+	// missing sequence number to be written before we let the cursor move
+	// past it. Numbers go missing for good when the instance which got one
+	// fails to write its event.
+	changeEventsGapTimeout = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  time.Second,
+			Standard: 2 * time.Minute,
+		},
+	).(time.Duration)
+)
+
+type (
+	// ChangeEvent describes a single change to a user. It only carries the
+	// user's sub and the changed values, never any personal data.
+	ChangeEvent struct {
+		ID            primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+		Seq           int64              `bson:"seq" json:"-"`
+		Type          string             `bson:"type" json:"type"`
+		Sub           string             `bson:"sub" json:"sub"`
+		Tier          *int               `bson:"tier,omitempty" json:"tier,omitempty"`
+		QuotaExceeded *bool              `bson:"quota_exceeded,omitempty" json:"quotaExceeded,omitempty"`
+		APIKeyID      string             `bson:"api_key_id,omitempty" json:"apiKeyId,omitempty"`
+		CreatedAt     time.Time          `bson:"created_at" json:"createdAt"`
+	}
+)
+
+// ChangeEventCreate appends the given event to the change events log. If the
+// event doesn't have a creation time, it's set to the current time.
+func (db *DB) ChangeEventCreate(ctx context.Context, ev *ChangeEvent) error {
+	if ev.Type == "" || ev.Sub == "" {
+		return errors.New("invalid change event")
+	}
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	}
+	seq, err := db.managedNextChangeEventSeq(ctx)
+	if err != nil {
+		return err
+	}
+	ev.Seq = seq
+	ior, err := db.staticChangeEvents.InsertOne(ctx, ev)
+	if err != nil {
+		return err
+	}
+	ev.ID = ior.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ChangeEventsSince returns up to `limit` events which happened after the
+// event identified by the given cursor, in the order in which they happened,
+// as well as the cursor to use for fetching the next batch. An empty cursor
+// starts from the oldest event within the retention window. The batch ends
+// before the first missing sequence number which might still be written, so
+// the cursor doesn't skip any events.
+func (db *DB) ChangeEventsSince(ctx context.Context, cursor string, limit int) ([]ChangeEvent, string, error) {
+	if limit <= 0 {
+		return nil, "", errors.New("invalid limit")
+	}
+	var last int64
+	if cursor != "" {
+		var err error
+		last, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || last < 0 {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	// We don't filter out the expired events which the TTL index hasn't
+	// removed yet, because we need their sequence numbers.
+	filter := bson.M{"seq": bson.M{"$gt": last}}
+	opts := options.Find().SetSort(bson.M{"seq": 1}).SetLimit(int64(limit))
+	c, err := db.staticChangeEvents.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", errors.AddContext(err, "failed to fetch change events")
+	}
+	found := make([]ChangeEvent, 0)
+	if err = c.All(ctx, &found); err != nil {
+		return nil, "", errors.AddContext(err, "failed to decode change events")
+	}
+	if cursor == "" && len(found) > 0 {
+		// The events before the oldest one have been removed.
+		last = found[0].Seq - 1
+	}
+	events := make([]ChangeEvent, 0, len(found))
+	for _, ev := range found {
+		if ev.Seq != last+1 && time.Since(ev.CreatedAt) < changeEventsGapTimeout {
+			break
+		}
+		last = ev.Seq
+		if time.Since(ev.CreatedAt) < ChangeEventsRetention {
+			events = append(events, ev)
+		}
+	}
+	if last > 0 {
+		cursor = strconv.FormatInt(last, 10)
+	}
+	return events, cursor, nil
+}
+
+// managedNextChangeEventSeq returns the next sequence number of the change
+// events log. The counter is not part of the caller's transaction, so
+// concurrent transactions don't conflict on it.
+func (db *DB) managedNextChangeEventSeq(ctx context.Context) (int64, error) {
+	filter := bson.M{"_id": collChangeEvents}
+	update := bson.M{"$inc": bson.M{"seq": int64(1)}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := db.staticCounters.FindOneAndUpdate(WithoutTransaction(ctx), filter, update, opts).Decode(&counter)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent call created the counter, so we can increment it now.
+		err = db.staticCounters.FindOneAndUpdate(WithoutTransaction(ctx), filter, update, opts).Decode(&counter)
+	}
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to get the next change event sequence number")
+	}
+	return counter.Seq, nil
+}
+
+// managedRecordChangeEvent records the given change event. The change it
+// describes has already been applied, so we don't want to fail the calling
+// operation if we fail to record it. Instead, we log the error.
+func (db *DB) managedRecordChangeEvent(ctx context.Context, ev ChangeEvent) {
+	err := db.ChangeEventCreate(ctx, &ev)
+	if err != nil {
+		db.staticLogger.Warnf("Failed to record change event %+v: %v", ev, err)
+	}
+}
+
+// RecordTierChange records a change of the user's tier.
+func (db *DB) RecordTierChange(ctx context.Context, sub string, tier int) {
+	db.managedRecordChangeEvent(ctx, ChangeEvent{
+		Type: ChangeEventTierChanged,
+		Sub:  sub,
+		Tier: &tier,
+	})
+}
+
+// RecordQuotaExceededChange records a change of the user's QuotaExceeded
+// flag.
+func (db *DB) RecordQuotaExceededChange(ctx context.Context, sub string, quotaExceeded bool) {
+	db.managedRecordChangeEvent(ctx, ChangeEvent{
+		Type:          ChangeEventQuotaExceededChanged,
+		Sub:           sub,
+		QuotaExceeded: &quotaExceeded,
+	})
+}
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// CohortPrivacyThreshold is the minimum number of users a cohort needs to
+	// have in order for us to report its size and retention. Smaller cohorts
+	// are suppressed, so individual users can't be singled out.
+	CohortPrivacyThreshold = 5
+	// CohortWeeksMax is the maximum number of weeks we allow a cohort report
+	// to cover.
+	CohortWeeksMax = 52
+
+	// week is the length of a cohort week.
+	week = 7 * 24 * time.Hour
+)
+
+type (
+	// Cohort describes the retention of the users who signed up during a
+	// given week. Retention[i] holds the fraction of the cohort's users which
+	// had any tracked activity (upload, download, registry read or write)
+	// during the (i+1)-th week after the signup week. Weeks which haven't
+	// happened yet are reported as nil.
+	Cohort struct {
+		WeekStart  time.Time  `json:"weekStart"`
+		Size       int        `json:"size"`
+		Suppressed bool       `json:"suppressed"`
+		Retention  []*float64 `json:"retention"`
+	}
+	// CohortMatrix is a cohort retention report. Its cohorts are ordered from
+	// oldest to newest, which makes it directly usable as a heatmap.
+	CohortMatrix struct {
+		Weeks       int       `json:"weeks"`
+		GeneratedAt time.Time `json:"generatedAt"`
+		Cohorts     []Cohort  `json:"cohorts"`
+	}
+)
+
+// Cohorts builds a weekly cohort retention report for the users who signed
+// up during the last `weeks` weeks, including the current one. Each cohort
+// reports its retention for the `weeks` weeks following its signup week.
+// Cohorts with fewer than CohortPrivacyThreshold users are suppressed.
+func (db *DB) Cohorts(ctx context.Context, weeks int) (*CohortMatrix, error) {
+	if weeks < 1 || weeks > CohortWeeksMax {
+		return nil, errors.New("invalid number of weeks")
+	}
+	now := time.Now().UTC()
+	currentWeek := weekStart(now)
+	start := currentWeek.Add(-time.Duration(weeks-1) * week)
+
+	// Assign each user who signed up after the start to a cohort.
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "created_at": 1})
+	c, err := db.staticUsers.Find(ctx, bson.M{"created_at": bson.M{"$gte": start}}, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch users")
+	}
+	var users []struct {
+		ID        primitive.ObjectID `bson:"_id"`
+		CreatedAt time.Time          `bson:"created_at"`
+	}
+	if err = c.All(ctx, &users); err != nil {
+		return nil, errors.AddContext(err, "failed to decode users")
+	}
+	cohortOf := make(map[primitive.ObjectID]int, len(users))
+	sizes := make([]int, weeks)
+	ids := make([]primitive.ObjectID, 0, len(users))
+	for _, u := range users {
+		idx := weekIndex(start, u.CreatedAt)
+		if idx < 0 || idx >= weeks {
+			continue
+		}
+		cohortOf[u.ID] = idx
+		sizes[idx]++
+		ids = append(ids, u.ID)
+	}
+
+	// active counts the users of each cohort which were active during a given
+	// week, indexed by the cohort index and the absolute week index.
+	active := make([]map[int]int, weeks)
+	for i := range active {
+		active[i] = make(map[int]int)
+	}
+	if len(ids) > 0 {
+		activity, err := db.managedActiveWeeks(ctx, ids, start)
+		if err != nil {
+			return nil, err
+		}
+		for uid, userWeeks := range activity {
+			cIdx, ok := cohortOf[uid]
+			if !ok {
+				continue
+			}
+			for w := range userWeeks {
+				active[cIdx][w]++
+			}
+		}
+	}
+
+	cm := &CohortMatrix{
+		Weeks:       weeks,
+		GeneratedAt: now.Truncate(time.Millisecond),
+		Cohorts:     make([]Cohort, 0, weeks),
+	}
+	for i := 0; i < weeks; i++ {
+		cohort := Cohort{
+			WeekStart: start.Add(time.Duration(i) * week),
+		}
+		if sizes[i] < CohortPrivacyThreshold {
+			cohort.Suppressed = true
+			cm.Cohorts = append(cm.Cohorts, cohort)
+			continue
+		}
+		cohort.Size = sizes[i]
+		cohort.Retention = make([]*float64, weeks)
+		for k := 1; k <= weeks; k++ {
+			// Skip the weeks which haven't started yet.
+			if i+k >= weeks {
+				continue
+			}
+			r := float64(active[i][i+k]) / float64(sizes[i])
+			cohort.Retention[k-1] = &r
+		}
+		cm.Cohorts = append(cm.Cohorts, cohort)
+	}
+	return cm, nil
+}
+
+// managedActiveWeeks returns the set of week indices, relative to start,
+// during which each of the given users had any tracked activity.
+func (db *DB) managedActiveWeeks(ctx context.Context, ids []primitive.ObjectID, start time.Time) (map[primitive.ObjectID]map[int]struct{}, error) {
+	sources := []struct {
+		coll    *mongo.Collection
+		tsField string
+	}{
+		{db.staticUploads, "timestamp"},
+		{db.staticDownloads, "created_at"},
+		{db.staticRegistryReads, "timestamp"},
+		{db.staticRegistryWrites, "timestamp"},
+	}
+	activity := make(map[primitive.ObjectID]map[int]struct{})
+	for _, src := range sources {
+		pipeline := mongo.Pipeline{
+			{{"$match", bson.D{
+				{"user_id", bson.D{{"$in", ids}}},
+				{src.tsField, bson.D{{"$gte", start}}},
+			}}},
+			{{"$project", bson.D{
+				{"user_id", 1},
+				{"week", bson.D{{"$toLong", bson.D{{"$floor", bson.D{{"$divide", bson.A{
+					bson.D{{"$subtract", bson.A{"$" + src.tsField, start}}},
+					week.Milliseconds(),
+				}}}}}}}},
+			}}},
+			{{"$group", bson.D{
+				{"_id", bson.D{{"user_id", "$user_id"}, {"week", "$week"}}},
+			}}},
+		}
+		c, err := aggregate(ctx, src.coll, pipeline)
+		if err != nil {
+			return nil, errors.AddContext(err, "DB query failed")
+		}
+		var results []struct {
+			ID struct {
+				UserID primitive.ObjectID `bson:"user_id"`
+				Week   int64              `bson:"week"`
+			} `bson:"_id"`
+		}
+		if err = c.All(ctx, &results); err != nil {
+			return nil, errors.AddContext(err, "failed to decode DB data")
+		}
+		for _, r := range results {
+			if _, exists := activity[r.ID.UserID]; !exists {
+				activity[r.ID.UserID] = make(map[int]struct{})
+			}
+			activity[r.ID.UserID][int(r.ID.Week)] = struct{}{}
+		}
+	}
+	return activity, nil
+}
+
+// weekStart returns the beginning of the week (Monday, 00:00 UTC) to which
+// the given time belongs.
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+// weekIndex returns the number of whole weeks between start and t.
+func weekIndex(start, t time.Time) int {
+	d := t.Sub(start)
+	if d < 0 {
+		return -1
+	}
+	return int(d / week)
+}
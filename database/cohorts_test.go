@@ -0,0 +1,50 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWeekStart ensures that weekStart returns the Monday starting the week
+// of the given time.
+func TestWeekStart(t *testing.T) {
+	monday := time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC)
+	tests := []time.Time{
+		monday,
+		monday.Add(13 * time.Hour),
+		time.Date(2022, 3, 10, 23, 59, 59, 0, time.UTC),
+		time.Date(2022, 3, 13, 23, 59, 59, 0, time.UTC),
+		// 01:00 on Monday in UTC+2 is still Sunday in UTC.
+		time.Date(2022, 3, 14, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*3600)),
+	}
+	for _, tt := range tests {
+		if ws := weekStart(tt); !ws.Equal(monday) {
+			t.Errorf("Expected week start of %v to be %v, got %v", tt, monday, ws)
+		}
+	}
+	next := time.Date(2022, 3, 14, 0, 0, 0, 0, time.UTC)
+	if ws := weekStart(next); !ws.Equal(next) {
+		t.Fatalf("Expected week start of %v to be itself, got %v", next, ws)
+	}
+}
+
+// TestWeekIndex ensures that weekIndex correctly counts the whole weeks
+// between two points in time.
+func TestWeekIndex(t *testing.T) {
+	start := time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t        time.Time
+		expected int
+	}{
+		{t: start.Add(-time.Second), expected: -1},
+		{t: start, expected: 0},
+		{t: start.Add(week - time.Second), expected: 0},
+		{t: start.Add(week), expected: 1},
+		{t: start.Add(8*week + time.Hour), expected: 8},
+	}
+	for _, tt := range tests {
+		if idx := weekIndex(start, tt.t); idx != tt.expected {
+			t.Errorf("Expected week index of %v to be %d, got %d", tt.t, tt.expected, idx)
+		}
+	}
+}
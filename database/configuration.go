@@ -3,9 +3,12 @@ package database
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -19,6 +22,43 @@ var (
 	// ConfValRegistrationsDisabled is the configuration value that disables
 	// new registration on the service.
 	ConfValRegistrationsDisabled = "registrations_disabled"
+	// ConfValPublicAPIKeyTiers is the configuration value that lists the tiers
+	// which are allowed to create public API keys. The value is a
+	// comma-separated list of tier IDs, e.g. "2,3,4". A missing or empty value
+	// means that all tiers are allowed to create public API keys.
+	ConfValPublicAPIKeyTiers = "public_api_key_tiers"
+	// ConfValTierLimitsPrefix is the prefix of the configuration values which
+	// override the compiled-in limits of a tier. The full key is the prefix
+	// followed by the tier ID, e.g. "tier_limits_2", and the value is a JSON
+	// TierLimitsOverride.
+	ConfValTierLimitsPrefix = "tier_limits_"
+	// ConfValUploadsTrackingDisabled is the configuration value that disables
+	// the tracking of uploads.
+	ConfValUploadsTrackingDisabled = "uploads_tracking_disabled"
+	// ConfValDownloadsTrackingDisabled is the configuration value that
+	// disables the tracking of downloads.
+	ConfValDownloadsTrackingDisabled = "downloads_tracking_disabled"
+	// ConfValAPIKeyCreationDisabled is the configuration value that disables
+	// the creation of new API keys.
+	ConfValAPIKeyCreationDisabled = "api_key_creation_disabled"
+	// ConfValStripeCheckoutDisabled is the configuration value that disables
+	// new Stripe checkout sessions.
+	ConfValStripeCheckoutDisabled = "stripe_checkout_disabled"
+	// ConfValAPIKeysRequireConfirmedEmail is the configuration value that
+	// prevents users who haven't confirmed their email address from creating
+	// API keys.
+	ConfValAPIKeysRequireConfirmedEmail = "api_keys_require_confirmed_email"
+
+	// FeatureFlags lists the flag-like configuration values which disable or
+	// restrict a feature of the service when they are set to ConfValTrue.
+	FeatureFlags = []string{
+		ConfValRegistrationsDisabled,
+		ConfValUploadsTrackingDisabled,
+		ConfValDownloadsTrackingDisabled,
+		ConfValAPIKeyCreationDisabled,
+		ConfValStripeCheckoutDisabled,
+		ConfValAPIKeysRequireConfirmedEmail,
+	}
 
 	// ConfValTrue represents the truthy value for flag-like configuration
 	// options.
@@ -59,8 +99,68 @@ func (db *DB) WriteConfigValue(ctx context.Context, key, value string) error {
 	if err != nil {
 		return err
 	}
-	if ur.ModifiedCount+ur.UpsertedCount != 1 {
-		return errors.AddContext(ErrUnexpectedNumberOfModifications, fmt.Sprintf("updated %d entries", ur.ModifiedCount))
+	// Writing the current value again matches the entry without modifying
+	// it, so we count matches rather than modifications.
+	if ur.MatchedCount+ur.UpsertedCount != 1 {
+		return errors.AddContext(ErrUnexpectedNumberOfModifications, fmt.Sprintf("matched %d entries", ur.MatchedCount))
 	}
 	return nil
 }
+
+// PublicAPIKeyTiers returns the list of tiers which are allowed to create
+// public API keys. A nil list means that all tiers are allowed.
+func (db *DB) PublicAPIKeyTiers(ctx context.Context) ([]int, error) {
+	val, err := db.ReadConfigValue(ctx, ConfValPublicAPIKeyTiers)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to read from configuration")
+	}
+	return ParseTierList(val)
+}
+
+// ParseTierList parses a comma-separated list of tier IDs. An empty string
+// results in a nil list.
+func ParseTierList(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var tiers []int
+	for _, ts := range strings.Split(s, ",") {
+		t, err := strconv.Atoi(strings.TrimSpace(ts))
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("invalid tier value '%s'", ts))
+		}
+		if t <= TierAnonymous || t >= TierMaxReserved {
+			return nil, fmt.Errorf("invalid tier value '%d'", t)
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, nil
+}
+
+// IsFeatureFlag checks whether the given configuration key is one of the
+// FeatureFlags.
+func IsFeatureFlag(key string) bool {
+	for _, f := range FeatureFlags {
+		if f == key {
+			return true
+		}
+	}
+	return false
+}
+
+// TierInList checks whether the given tier is in the given list of tiers. A nil
+// list contains all tiers.
+func TierInList(tiers []int, tier int) bool {
+	if tiers == nil {
+		return true
+	}
+	for _, t := range tiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
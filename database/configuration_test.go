@@ -0,0 +1,58 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseTierList ensures that ParseTierList correctly parses lists of tiers
+// and rejects invalid ones.
+func TestParseTierList(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		expected []int
+		valid    bool
+	}{
+		{name: "empty", in: "", expected: nil, valid: true},
+		{name: "whitespace", in: "  ", expected: nil, valid: true},
+		{name: "single", in: "2", expected: []int{TierPremium5}, valid: true},
+		{name: "multiple with spaces", in: "2, 3 ,4", expected: []int{TierPremium5, TierPremium20, TierPremium80}, valid: true},
+		{name: "anonymous", in: "0", valid: false},
+		{name: "out of range", in: "1,99", valid: false},
+		{name: "not a number", in: "1,free", valid: false},
+	}
+	for _, tt := range tests {
+		tiers, err := ParseTierList(tt.in)
+		if tt.valid && err != nil {
+			t.Errorf("Test '%s': unexpected error %v", tt.name, err)
+			continue
+		}
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("Test '%s': expected an error, got %v", tt.name, tiers)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(tiers, tt.expected) {
+			t.Errorf("Test '%s': expected %v, got %v", tt.name, tt.expected, tiers)
+		}
+	}
+}
+
+// TestTierInList ensures that TierInList treats a nil list as containing all
+// tiers.
+func TestTierInList(t *testing.T) {
+	if !TierInList(nil, TierFree) {
+		t.Fatal("Expected a nil list to contain all tiers.")
+	}
+	if !TierInList([]int{TierFree, TierPremium5}, TierPremium5) {
+		t.Fatal("Expected the list to contain the tier.")
+	}
+	if TierInList([]int{TierPremium5}, TierFree) {
+		t.Fatal("Did not expect the list to contain the tier.")
+	}
+	if TierInList([]int{}, TierFree) {
+		t.Fatal("Did not expect an empty list to contain the tier.")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 
 	"github.com/SkynetLabs/skynet-accounts/lib"
+	"github.com/SkynetLabs/skynet-accounts/metrics"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
@@ -53,6 +54,33 @@ var (
 	collConfiguration = "configuration"
 	// collAPIKeys defines the name of the db table with API keys for users.
 	collAPIKeys = "api_keys"
+	// collChangeEvents defines the name of the db table which holds the log
+	// of user changes external services can sync from.
+	collChangeEvents = "change_events"
+	// collSessions defines the name of the db table which holds the login
+	// sessions of all users.
+	collSessions = "sessions"
+	// collAuditLog defines the name of the db table which holds the audit log
+	// of security-relevant events on the users' accounts.
+	collAuditLog = "audit_log"
+	// collAnonUsage defines the name of the db table which holds the hourly
+	// number of anonymous uploads and downloads tracked from each IP.
+	collAnonUsage = "anon_usage"
+	// collLocks defines the name of the db table which holds the locks that
+	// make sure only one accounts instance runs a given background task.
+	collLocks = "locks"
+	// collOrganizations defines the name of the db table which holds the
+	// organizations users can share a tier and a quota with.
+	collOrganizations = "organizations"
+	// collStorageUsage defines the name of the db table which holds the
+	// running counters of the storage used by users and organizations.
+	collStorageUsage = "storage_usage"
+	// collRecoveryTokens defines the name of the db table which holds the
+	// account recovery tokens we have emailed to users.
+	collRecoveryTokens = "recovery_tokens"
+	// collCounters defines the name of the db table which holds the counters
+	// we use for numbering records, e.g. the change events.
+	collCounters = "counters"
 
 	// DefaultPageSize defines the default number of records to return.
 	DefaultPageSize = 10
@@ -80,9 +108,18 @@ var (
 	// ErrUserAlreadyExists is returned when we try to use a sub to create a
 	// user and a user already exists with this identity.
 	ErrUserAlreadyExists = errors.New("identity already belongs to an existing user")
+	// ErrPasswordWithoutEmail is returned when we try to create a user with a
+	// password but without an email they could log in with.
+	ErrPasswordWithoutEmail = errors.New("a password requires an email address")
 	// ErrInvalidSkylink is returned when the given string is not a valid
 	// skylink.
 	ErrInvalidSkylink = errors.New("invalid skylink")
+	// ErrSkylinkBlocked is returned when the given skylink has been blocked
+	// by the portal operators.
+	ErrSkylinkBlocked = errors.New("skylink is blocked")
+	// ErrInvalidIP is returned when the given string is not a valid IP
+	// address.
+	ErrInvalidIP = errors.New("invalid ip")
 )
 
 type (
@@ -100,6 +137,15 @@ type (
 		staticUnconfirmedUserUpdates *mongo.Collection
 		staticConfiguration          *mongo.Collection
 		staticAPIKeys                *mongo.Collection
+		staticChangeEvents           *mongo.Collection
+		staticSessions               *mongo.Collection
+		staticAuditLog               *mongo.Collection
+		staticAnonUsage              *mongo.Collection
+		staticLocks                  *mongo.Collection
+		staticOrganizations          *mongo.Collection
+		staticStorageUsage           *mongo.Collection
+		staticRecoveryTokens         *mongo.Collection
+		staticCounters               *mongo.Collection
 		staticDeps                   lib.Dependencies
 		staticLogger                 *logrus.Logger
 	}
@@ -167,6 +213,15 @@ func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger
 		staticUnconfirmedUserUpdates: db.Collection(collUnconfirmedUserUpdates),
 		staticConfiguration:          db.Collection(collConfiguration),
 		staticAPIKeys:                db.Collection(collAPIKeys),
+		staticChangeEvents:           db.Collection(collChangeEvents),
+		staticSessions:               db.Collection(collSessions),
+		staticAuditLog:               db.Collection(collAuditLog),
+		staticAnonUsage:              db.Collection(collAnonUsage),
+		staticLocks:                  db.Collection(collLocks),
+		staticOrganizations:          db.Collection(collOrganizations),
+		staticStorageUsage:           db.Collection(collStorageUsage),
+		staticRecoveryTokens:         db.Collection(collRecoveryTokens),
+		staticCounters:               db.Collection(collCounters),
 		staticDeps:                   deps,
 		staticLogger:                 logger,
 	}, nil
@@ -196,6 +251,27 @@ func (db *DB) NewSession() (mongo.Session, error) {
 	return db.staticDB.Client().StartSession()
 }
 
+// WithoutTransaction returns a context which keeps the cancellation and the
+// deadline of the given context but not its Mongo session. DB operations which
+// use it are not part of the caller's transaction, so they persist even if
+// that transaction gets aborted.
+func WithoutTransaction(ctx context.Context) context.Context {
+	return withoutValues{ctx}
+}
+
+type (
+	// withoutValues is a context which hides all values of its parent, among
+	// which is its Mongo session.
+	withoutValues struct {
+		context.Context
+	}
+)
+
+// Value implements context.Context.
+func (withoutValues) Value(interface{}) interface{} {
+	return nil
+}
+
 // NumberSessionsInProgress returns the number of sessions that have been
 // started for this client but have not been closed (i.e. EndSession has not
 // been called).
@@ -208,7 +284,10 @@ func (db *DB) NumberSessionsInProgress() int {
 func (db *DB) Ping(ctx context.Context) error {
 	ctx2, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	return db.staticDB.Client().Ping(ctx2, readpref.Primary())
+	start := time.Now()
+	err := db.staticDB.Client().Ping(ctx2, readpref.Primary())
+	metrics.MongoPingDuration.Observe(time.Since(start).Seconds())
+	return err
 }
 
 // connectionString is a helper that returns a valid MongoDB connection string
@@ -246,38 +325,172 @@ func ensureDBSchema(ctx context.Context, db *mongo.Database, schema map[string][
 	if err != nil {
 		return err
 	}
-	// Drop indexes we no longer need.
-	_, err = db.Collection(collUsers).Indexes().DropOne(ctx, "email_unique")
-	// We want to ignore IndexNotFound errors - we'll have that each time we run
-	// this code after the initial run on which we drop the index.
-	// We also want to ignore NamespaceNotFound errors - we'll have that on the
-	// very first run of the service when users collection doesn't exist, yet.
-	// We don't want to worry new portal operators and waste their time.
-	// All other errors we want to log for informational purposes but we don't
-	// want to return an error and prevent the service from running - if there
-	// is any issue with the database that would affect the operation of the
-	// service, it will surface during the next step where we ensure collections
-	// indexes exist.
-	if err != nil && !strings.Contains(err.Error(), "IndexNotFound") && !strings.Contains(err.Error(), "NamespaceNotFound") {
-		log.Debugf("Error while dropping index '%s': %v", "email_unique", err)
-	}
-	// Ensure current schema.
+	// Ensure current schema. We create the missing indexes before we drop the
+	// obsolete ones, so the collections are never left without a uniqueness
+	// or lookup index while Mongo builds the replacement. The exception are
+	// replacements with the same keys as an obsolete index, e.g. TTL indexes,
+	// because Mongo refuses to create those while the old index exists. We
+	// create those after dropping the obsolete indexes.
+	deferred := make(map[string][]mongo.IndexModel)
+	keepLegacyEmailIndex := false
 	for collName, models := range schema {
 		coll, err := ensureCollection(ctx, db, collName)
 		if err != nil {
 			return err
 		}
-		iv := coll.Indexes()
-		var names []string
-		names, err = iv.CreateMany(ctx, models)
+		// We skip the indexes which already exist, even if under a different
+		// name, because Mongo refuses to create an index with the same keys
+		// under a new name. This allows us to run alongside indexes created
+		// by operators or by older versions of the service.
+		existing, err := existingIndexes(ctx, coll)
 		if err != nil {
-			return errors.AddContext(err, "failed to create indexes")
+			return errors.AddContext(err, "failed to list indexes")
+		}
+		var missing []mongo.IndexModel
+		for _, m := range models {
+			keys, err := modelID(m)
+			if err != nil {
+				return err
+			}
+			name, exists := existing[keys]
+			if exists && isObsoleteIndex(collName, name) {
+				deferred[collName] = append(deferred[collName], m)
+				continue
+			}
+			if exists {
+				continue
+			}
+			// Existing users whose emails only differ in case prevent us
+			// from creating the case-insensitive email index. We don't want
+			// to prevent the service from running over that, so we keep the
+			// legacy index until the operators resolve the conflicts.
+			if collName == collUsers && indexName(m, keys) == emailIndexName {
+				if !ensureEmailIndex(ctx, coll, m, log) {
+					keepLegacyEmailIndex = true
+				}
+				continue
+			}
+			missing = append(missing, m)
+		}
+		err = createIndexes(ctx, coll, missing, log)
+		if err != nil {
+			return err
 		}
-		log.Debugf("Ensured index exists: %v", names)
 	}
+	// Drop indexes we no longer need.
+	for collName, names := range obsoleteIndexes {
+		for _, name := range names {
+			if keepLegacyEmailIndex && collName == collUsers && name == legacyEmailIndexName {
+				continue
+			}
+			_, err = db.Collection(collName).Indexes().DropOne(ctx, name)
+			// We want to ignore IndexNotFound errors - we'll have that each
+			// time we run this code after the initial run on which we drop
+			// the index.
+			// We also want to ignore NamespaceNotFound errors - we'll have that
+			// on the very first run of the service when the collection doesn't
+			// exist, yet. We don't want to worry new portal operators and waste
+			// their time.
+			// All other errors we want to log for informational purposes but
+			// we don't want to return an error and prevent the service from
+			// running.
+			if err != nil && !strings.Contains(err.Error(), "IndexNotFound") && !strings.Contains(err.Error(), "NamespaceNotFound") {
+				log.Debugf("Error while dropping index '%s': %v", name, err)
+			}
+		}
+	}
+	// Create the indexes which replace obsolete indexes with the same keys.
+	for collName, models := range deferred {
+		err = createIndexes(ctx, db.Collection(collName), models, log)
+		if err != nil {
+			return err
+		}
+	}
+	// Warn the operators about indexes which differ from the schema, e.g.
+	// indexes created manually.
+	divs, err := schemaDivergences(ctx, db, schema)
+	if err != nil {
+		log.Warnf("Failed to verify the DB indexes: %v", err)
+	}
+	for collName, div := range divs {
+		log.Warnf("The indexes of collection '%s' differ from the schema. Missing: %v, extra: %v", collName, div.Missing, div.Extra)
+	}
+	return nil
+}
+
+// createIndexes creates the given indexes on the given collection.
+func createIndexes(ctx context.Context, coll *mongo.Collection, models []mongo.IndexModel, log *logrus.Logger) error {
+	if len(models) == 0 {
+		return nil
+	}
+	names, err := coll.Indexes().CreateMany(ctx, models)
+	if err != nil {
+		return errors.AddContext(err, "failed to create indexes")
+	}
+	log.Debugf("Ensured index exists: %v", names)
 	return nil
 }
 
+// isObsoleteIndex reports whether the given index of the given collection is
+// one we no longer need.
+func isObsoleteIndex(collName, name string) bool {
+	for _, n := range obsoleteIndexes[collName] {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureEmailIndex creates the case-insensitive unique index on the users'
+// emails. It logs the users whose emails only differ in case, as they prevent
+// us from creating the index. It reports whether the index exists.
+func ensureEmailIndex(ctx context.Context, coll *mongo.Collection, m mongo.IndexModel, log *logrus.Logger) bool {
+	dups, err := caseDuplicateEmails(ctx, coll)
+	if err != nil {
+		log.Warnf("Failed to check for users whose emails only differ in case: %v", err)
+		return false
+	}
+	if len(dups) > 0 {
+		for _, d := range dups {
+			log.Warnf("Users %v have emails which only differ in case from '%s'.", d.Users, d.Email)
+		}
+		log.Warnf("Index '%s' not created because %d emails belong to more than one user. Resolve the conflicts and restart the service.", emailIndexName, len(dups))
+		return false
+	}
+	name, err := coll.Indexes().CreateOne(ctx, m)
+	if err != nil {
+		log.Warnf("Failed to create index '%s': %v", emailIndexName, err)
+		return false
+	}
+	log.Debugf("Ensured index exists: %v", name)
+	return true
+}
+
+// caseDuplicateEmails returns the emails which belong to more than one user
+// when compared case-insensitively, together with the IDs of those users.
+func caseDuplicateEmails(ctx context.Context, coll *mongo.Collection) ([]emailDuplicate, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.M{"email": bson.M{"$gt": ""}}}},
+		{{"$group", bson.M{
+			"_id":   bson.M{"$toLower": "$email"},
+			"users": bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{"$match", bson.M{"count": bson.M{"$gt": 1}}}},
+	}
+	c, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var dups []emailDuplicate
+	err = c.All(ctx, &dups)
+	if err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
 // ensureCollection gets the given collection from the
 // database and creates it if it doesn't exist.
 func ensureCollection(ctx context.Context, db *mongo.Database, collName string) (*mongo.Collection, error) {
@@ -320,10 +533,34 @@ func ensureCollection(ctx context.Context, db *mongo.Database, collName string)
 // and then fetch $limit of them, allowing us to paginate. It will then
 // join with the `skylinks` collection in order to fetch some additional
 // data about each download.
-func generateUploadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pipeline {
-	sortStage := bson.D{{"$sort", bson.D{{"timestamp", -1}}}}
+//
+// When sorting by a field which comes from the `skylinks` collection, e.g.
+// `size` or `name`, we need to join before sorting, which means that we join
+// all matching uploads and not only the requested page. The same applies when
+// we filter by such fields via the optional skylinkMatchStage.
+func generateUploadsPipeline(matchStage, skylinkMatchStage bson.D, sort UploadsSort, offset, pageSize int) mongo.Pipeline {
+	dir := -1
+	if sort.Ascending {
+		dir = 1
+	}
+	// We add the _id as a tie-breaker, so pagination is stable.
+	sortStage := bson.D{{"$sort", bson.D{{sort.Field, dir}, {"_id", dir}}}}
 	skipStage := bson.D{{"$skip", offset}}
 	limitStage := bson.D{{"$limit", pageSize}}
+	if sort.Field == UploadsOrderByTimestamp && skylinkMatchStage == nil {
+		pipeline := mongo.Pipeline{matchStage, sortStage, skipStage, limitStage}
+		return append(pipeline, skylinksJoinStages()...)
+	}
+	pipeline := append(mongo.Pipeline{matchStage}, skylinksJoinStages()...)
+	if skylinkMatchStage != nil {
+		pipeline = append(pipeline, skylinkMatchStage)
+	}
+	return append(pipeline, sortStage, skipStage, limitStage)
+}
+
+// skylinksJoinStages returns the pipeline stages which join each upload with
+// its skylink and merge the skylink's fields into the upload.
+func skylinksJoinStages() mongo.Pipeline {
 	lookupStage := bson.D{
 		{"$lookup", bson.D{
 			{"from", "skylinks"},
@@ -342,7 +579,53 @@ func generateUploadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pipe
 		}},
 	}
 	projectStage := bson.D{{"$project", bson.D{{"fromSkylinks", 0}}}}
-	return mongo.Pipeline{matchStage, sortStage, skipStage, limitStage, lookupStage, replaceStage, projectStage}
+	return mongo.Pipeline{lookupStage, replaceStage, projectStage}
+}
+
+// generateByIPPipeline generates a pipeline that returns a page of the uploads
+// or downloads which match the given match stage, most recent first. Each
+// record is joined with its skylink and its user, so we can report who made it
+// and what they uploaded or downloaded. The timeField is the field which holds
+// the time of the upload or download.
+func generateByIPPipeline(matchStage bson.D, timeField string, offset, pageSize int) mongo.Pipeline {
+	sortStage := bson.D{{"$sort", bson.D{{timeField, -1}, {"_id", -1}}}}
+	skipStage := bson.D{{"$skip", offset}}
+	limitStage := bson.D{{"$limit", pageSize}}
+	skylinkLookupStage := bson.D{
+		{"$lookup", bson.D{
+			{"from", "skylinks"},
+			{"localField", "skylink_id"},
+			{"foreignField", "_id"},
+			{"as", "fromSkylinks"},
+		}},
+	}
+	userLookupStage := bson.D{
+		{"$lookup", bson.D{
+			{"from", "users"},
+			{"localField", "user_id"},
+			{"foreignField", "_id"},
+			{"as", "fromUsers"},
+		}},
+	}
+	// Anonymous records have no user, so their sub is missing.
+	projectStage := bson.D{{"$project", bson.D{
+		{"_id", 0},
+		{"skylink", bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.skylink", 0}}}},
+		{"sub", bson.D{{"$ifNull", bson.A{bson.D{{"$arrayElemAt", bson.A{"$fromUsers.sub", 0}}}, ""}}}},
+		{"bytes", 1},
+		{timeField, 1},
+	}}}
+	return mongo.Pipeline{matchStage, sortStage, skipStage, limitStage, skylinkLookupStage, userLookupStage, projectStage}
+}
+
+// generateRegistryEventsPipeline generates a pipeline that returns a page of
+// the registry events which match the given match stage, most recent first.
+// Unlike generateUploadsPipeline it doesn't need to look up any skylinks.
+func generateRegistryEventsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pipeline {
+	sortStage := bson.D{{"$sort", bson.D{{"timestamp", -1}, {"_id", -1}}}}
+	skipStage := bson.D{{"$skip", offset}}
+	limitStage := bson.D{{"$limit", pageSize}}
+	return mongo.Pipeline{matchStage, sortStage, skipStage, limitStage}
 }
 
 // generateDownloadsPipeline is similar to generateUploadsPipeline. The only
@@ -389,11 +672,75 @@ func generateDownloadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pi
 	return mongo.Pipeline{matchStage, sortStage, skipStage, limitStage, lookupStage, replaceStage, projectStage}
 }
 
+// generateDownloadsSummaryPipeline generates a mongo pipeline which groups the
+// downloads matching the given matchStage by skylink. Like
+// generateDownloadsPipeline, it counts partial downloads by their `bytes` and
+// full downloads by the skylink's size. We only join with the `skylinks`
+// collection after paginating, so we only join the requested page.
+func generateDownloadsSummaryPipeline(matchStage bson.D, offset, pageSize int) mongo.Pipeline {
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", "$skylink_id"},
+		{"downloads", bson.D{{"$sum", 1}}},
+		{"partial_bytes", bson.D{{"$sum", "$bytes"}}},
+		{"full_downloads", bson.D{{"$sum", bson.D{
+			{"$cond", bson.A{bson.D{{"$gt", bson.A{"$bytes", 0}}}, 0, 1}},
+		}}}},
+		{"last_downloaded_at", bson.D{{"$max", "$created_at"}}},
+	}}}
+	sortStage := bson.D{{"$sort", bson.D{{"downloads", -1}, {"last_downloaded_at", -1}, {"_id", 1}}}}
+	skipStage := bson.D{{"$skip", offset}}
+	limitStage := bson.D{{"$limit", pageSize}}
+	lookupStage := bson.D{
+		{"$lookup", bson.D{
+			{"from", "skylinks"},
+			{"localField", "_id"},   // the skylink_id we grouped by
+			{"foreignField", "_id"}, // field in the skylinks collection
+			{"as", "fromSkylinks"},
+		}},
+	}
+	unwindStage := bson.D{{"$unwind", "$fromSkylinks"}}
+	projectStage := bson.D{{"$project", bson.D{
+		{"_id", 0},
+		{"skylink", "$fromSkylinks.skylink"},
+		{"name", "$fromSkylinks.name"},
+		{"size", "$fromSkylinks.size"},
+		{"downloads", 1},
+		{"last_downloaded_at", 1},
+		{"bytes_served", bson.D{{"$add", bson.A{
+			"$partial_bytes",
+			bson.D{{"$multiply", bson.A{"$full_downloads", bson.D{{"$ifNull", bson.A{"$fromSkylinks.size", 0}}}}}},
+		}}}},
+	}}}
+	return mongo.Pipeline{matchStage, groupStage, sortStage, skipStage, limitStage, lookupStage, unwindStage, projectStage}
+}
+
 // count returns the number of documents in the given collection that match the
 // given matchStage.
 func (db *DB) count(ctx context.Context, coll *mongo.Collection, matchStage bson.D) (int64, error) {
-	pipeline := mongo.Pipeline{matchStage, bson.D{{"$count", "count"}}}
-	c, err := coll.Aggregate(ctx, pipeline)
+	return db.countPipeline(ctx, coll, mongo.Pipeline{matchStage})
+}
+
+// forEach calls fn with the cursor positioned at each of its documents in
+// turn and closes the cursor when done. It stops at the first error.
+func (db *DB) forEach(ctx context.Context, c *mongo.Cursor, fn func(*mongo.Cursor) error) error {
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Debugln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	for c.Next(ctx) {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// countPipeline returns the number of documents which come out of the given
+// pipeline.
+func (db *DB) countPipeline(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline) (int64, error) {
+	pipeline = append(pipeline, bson.D{{"$count", "count"}})
+	c, err := aggregate(ctx, coll, pipeline)
 	if err != nil {
 		return 0, errors.AddContext(err, "DB query failed")
 	}
@@ -416,3 +763,19 @@ func (db *DB) count(ctx context.Context, coll *mongo.Collection, matchStage bson
 	}
 	return result.Count, nil
 }
+
+// aggregate runs the given pipeline against the given collection. If the
+// context has a deadline, we pass the remaining time to Mongo as maxTimeMS, so
+// the server stops working on the query once nobody is waiting for its result
+// anymore.
+func aggregate(ctx context.Context, coll *mongo.Collection, pipeline interface{}) (*mongo.Cursor, error) {
+	opts := options.Aggregate()
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		opts.SetMaxTime(remaining)
+	}
+	return coll.Aggregate(ctx, pipeline, opts)
+}
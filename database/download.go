@@ -5,26 +5,43 @@ import (
 	"time"
 
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const (
+var (
 	// DownloadUpdateWindow defines a time window during which instead of
 	// creating a new download record for the given skylink, we'll update the
-	// previous one, as long as it has been updated within the window.
-	DownloadUpdateWindow = 10 * time.Minute
+	// previous one, as long as it has been updated within the window. This
+	// way the many ranged requests browsers make, e.g. for videos, count as a
+	// single download. Zero disables it, so each download gets its own
+	// record. We disable it during testing, so tests can create separate
+	// download records without waiting. This value is configurable via the
+	// ACCOUNTS_DOWNLOAD_WINDOW_MINUTES environment variable.
+	DownloadUpdateWindow = build.Select(
+		build.Var{
+			Dev:      10 * time.Minute,
+			Testing:  time.Duration(0),
+			Standard: 10 * time.Minute,
+		},
+	).(time.Duration)
 )
 
 // Download describes a single download of a skylink by a user.
 type Download struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
-	SkylinkID primitive.ObjectID `bson:"skylink_id,omitempty" json:"skylinkId"`
-	Bytes     int64              `bson:"bytes" json:"bytes"`
-	CreatedAt time.Time          `bson:"created_at" json:"timestamp"`
-	UpdatedAt time.Time          `bson:"updated_at" json:"-"`
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID       primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
+	SkylinkID    primitive.ObjectID `bson:"skylink_id,omitempty" json:"skylinkId"`
+	DownloaderIP string             `bson:"downloader_ip" json:"downloaderIP"`
+	Bytes        int64              `bson:"bytes" json:"bytes"`
+	CreatedAt    time.Time          `bson:"created_at" json:"timestamp"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"-"`
+	// APIKeyID is the ID of the API key used to authenticate the download, if
+	// any.
+	APIKeyID primitive.ObjectID `bson:"api_key_id,omitempty" json:"-"`
 }
 
 // DownloadResponse  is the representation of a download we send as response
@@ -37,6 +54,36 @@ type DownloadResponse struct {
 	CreatedAt time.Time `bson:"created_at" json:"downloadedOn"`
 }
 
+// DownloadByIP describes a download made from a given IP. Anonymous
+// downloads have an empty Sub.
+type DownloadByIP struct {
+	Sub       string    `bson:"sub" json:"sub"`
+	Skylink   string    `bson:"skylink" json:"skylink"`
+	Bytes     int64     `bson:"bytes" json:"bytes"`
+	Timestamp time.Time `bson:"created_at" json:"timestamp"`
+}
+
+// DownloadSummary aggregates all downloads of a single skylink.
+type DownloadSummary struct {
+	Skylink          string    `bson:"skylink" json:"skylink"`
+	Name             string    `bson:"name" json:"name"`
+	Size             int64     `bson:"size" json:"size"`
+	Downloads        int64     `bson:"downloads" json:"downloads"`
+	BytesServed      int64     `bson:"bytes_served" json:"bytesServed"`
+	LastDownloadedAt time.Time `bson:"last_downloaded_at" json:"lastDownloadedOn"`
+}
+
+// SkylinkStats aggregates all downloads of a single skylink, including the
+// anonymous ones. The Anon fields cover only the anonymous downloads.
+type SkylinkStats struct {
+	Skylink          string    `bson:"-" json:"skylink"`
+	Downloads        int64     `bson:"downloads" json:"downloads"`
+	BytesServed      int64     `bson:"bytes_served" json:"bytesServed"`
+	AnonDownloads    int64     `bson:"anon_downloads" json:"anonDownloads"`
+	AnonBytesServed  int64     `bson:"anon_bytes_served" json:"anonBytesServed"`
+	LastDownloadedAt time.Time `bson:"last_downloaded_at" json:"lastDownloadedOn"`
+}
+
 // DownloadByID fetches a single download from the DB.
 func (db *DB) DownloadByID(ctx context.Context, id primitive.ObjectID) (*Download, error) {
 	var d Download
@@ -49,28 +96,50 @@ func (db *DB) DownloadByID(ctx context.Context, id primitive.ObjectID) (*Downloa
 }
 
 // DownloadCreate registers a new download. Marks partial downloads by supplying
-// the `bytes` param. If `bytes` is 0 we assume a full download.
-func (db *DB) DownloadCreate(ctx context.Context, user User, skylink Skylink, bytes int64) (*Download, error) {
+// the `bytes` param. If `bytes` is 0 we assume a full download. If the same
+// user downloaded the same skylink from the same IP within the
+// DownloadUpdateWindow, it adds the bytes to that download instead and returns
+// the updated download.
+func (db *DB) DownloadCreate(ctx context.Context, user User, ip string, skylink Skylink, bytes int64, apiKeyID primitive.ObjectID) (*Download, error) {
 	if skylink.ID.IsZero() {
 		return nil, ErrInvalidSkylink
 	}
 
-	// Check if there exists a download of this skylink by this user, updated
-	// within the DownloadUpdateWindow and keep updating that, if so.
-	down, err := db.DownloadRecent(ctx, user.ID, skylink.ID)
-	if err == nil {
-		// We found a recent download of this skylink. Let's update it.
-		return nil, db.DownloadIncrement(ctx, down, bytes)
+	// Check if there exists a download of this skylink by this user from this
+	// IP, updated within the DownloadUpdateWindow and keep updating that, if
+	// so. We find and update it in one go, so concurrent ranged requests
+	// don't miss each other's bytes.
+	if DownloadUpdateWindow > 0 {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		filter := downloadRecentFilter(user.ID, ip, skylink.ID, apiKeyID)
+		update := bson.M{
+			"$inc": bson.M{"bytes": bytes},
+			"$set": bson.M{"updated_at": now},
+		}
+		opts := options.FindOneAndUpdate().
+			SetSort(bson.M{"updated_at": -1}).
+			SetReturnDocument(options.After)
+		var down Download
+		err := db.staticDownloads.FindOneAndUpdate(ctx, filter, update, opts).Decode(&down)
+		if err == nil {
+			return &down, nil
+		}
+		if !errors.Contains(err, mongo.ErrNoDocuments) {
+			return nil, errors.AddContext(err, "failed to update download record")
+		}
 	}
 
 	// We couldn't find a recent download of this skylink, updated within
 	// the DownloadUpdateWindow. We will create a new one.
-	down = &Download{
-		UserID:    user.ID,
-		SkylinkID: skylink.ID,
-		Bytes:     bytes,
-		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
-		UpdatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	down := &Download{
+		UserID:       user.ID,
+		SkylinkID:    skylink.ID,
+		DownloaderIP: ip,
+		Bytes:        bytes,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		APIKeyID:     apiKeyID,
 	}
 	ior, err := db.staticDownloads.InsertOne(ctx, down)
 	if err != nil {
@@ -93,6 +162,80 @@ func (db *DB) DownloadsBySkylink(ctx context.Context, skylink Skylink, offset, p
 	return db.downloadsBy(ctx, matchStage, offset, pageSize)
 }
 
+// DownloadsByIP fetches a page of the downloads made from the given IP since
+// the given time, most recent first, and the total number of such downloads.
+// It covers the downloads of all users.
+func (db *DB) DownloadsByIP(ctx context.Context, ip string, since time.Time, offset, pageSize int) ([]DownloadByIP, int64, error) {
+	if ip == "" {
+		return nil, 0, ErrInvalidIP
+	}
+	if err := validateOffsetPageSize(offset, pageSize); err != nil {
+		return nil, 0, err
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"downloader_ip", ip},
+		{"created_at", bson.D{{"$gte", since}}},
+	}}}
+	cnt, err := db.count(ctx, db.staticDownloads, matchStage)
+	if err != nil || cnt == 0 {
+		return []DownloadByIP{}, 0, err
+	}
+	c, err := aggregate(ctx, db.staticDownloads, generateByIPPipeline(matchStage, "created_at", offset, pageSize))
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "DB query failed")
+	}
+	downloads := make([]DownloadByIP, 0, pageSize)
+	if err = c.All(ctx, &downloads); err != nil {
+		return nil, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	return downloads, cnt, nil
+}
+
+// SkylinkDownloadStats aggregates all downloads of the given skylink, both by
+// users and by anonymous visitors. Skylinks which we've never seen have no
+// downloads.
+func (db *DB) SkylinkDownloadStats(ctx context.Context, skylink string) (SkylinkStats, error) {
+	skylinkStr, err := NormalizeSkylink(skylink)
+	if err != nil {
+		return SkylinkStats{}, err
+	}
+	stats := SkylinkStats{Skylink: skylinkStr}
+	var sl Skylink
+	err = db.staticSkylinks.FindOne(ctx, bson.M{"skylink": skylinkStr}).Decode(&sl)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return stats, nil
+	}
+	if err != nil {
+		return SkylinkStats{}, errors.AddContext(err, "failed to fetch skylink")
+	}
+	// Anonymous downloads don't have a user_id.
+	isAnon := bson.D{{"$eq", bson.A{bson.D{{"$ifNull", bson.A{"$user_id", nil}}}, nil}}}
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"skylink_id", sl.ID}}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"downloads", bson.D{{"$sum", 1}}},
+			{"bytes_served", bson.D{{"$sum", "$bytes"}}},
+			{"anon_downloads", bson.D{{"$sum", bson.D{{"$cond", bson.A{isAnon, 1, 0}}}}}},
+			{"anon_bytes_served", bson.D{{"$sum", bson.D{{"$cond", bson.A{isAnon, "$bytes", 0}}}}}},
+			{"last_downloaded_at", bson.D{{"$max", "$updated_at"}}},
+		}}},
+	}
+	c, err := aggregate(ctx, db.staticDownloads, pipeline)
+	if err != nil {
+		return SkylinkStats{}, errors.AddContext(err, "DB query failed")
+	}
+	var results []SkylinkStats
+	if err = c.All(ctx, &results); err != nil {
+		return SkylinkStats{}, errors.AddContext(err, "failed to decode DB data")
+	}
+	if len(results) > 0 {
+		results[0].Skylink = skylinkStr
+		stats = results[0]
+	}
+	return stats, nil
+}
+
 // DownloadsByUser fetches a page of downloads by this user and the total number
 // of such downloads.
 func (db *DB) DownloadsByUser(ctx context.Context, user User, offset, pageSize int) ([]DownloadResponse, int, error) {
@@ -106,6 +249,93 @@ func (db *DB) DownloadsByUser(ctx context.Context, user User, offset, pageSize i
 	return db.downloadsBy(ctx, matchStage, offset, pageSize)
 }
 
+// DownloadsDeleteByUser deletes the user's downloads. If before is not zero,
+// it only deletes the downloads created before that time. It returns the number
+// of deleted downloads.
+func (db *DB) DownloadsDeleteByUser(ctx context.Context, user User, before time.Time) (int64, error) {
+	if user.ID.IsZero() {
+		return 0, errors.New("invalid user")
+	}
+	filter := bson.M{"user_id": user.ID}
+	if !before.IsZero() {
+		filter["created_at"] = bson.M{"$lt": before.UTC()}
+	}
+	dr, err := db.staticDownloads.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to delete downloads")
+	}
+	return dr.DeletedCount, nil
+}
+
+// DownloadsByUserExport calls fn with each of the user's downloads, most
+// recent first, up to limit downloads. Unlike DownloadsByUser it doesn't load
+// all downloads in memory, so it's suitable for exports. It stops at the first
+// error returned by fn.
+func (db *DB) DownloadsByUserExport(ctx context.Context, user User, limit int, fn func(DownloadResponse) error) error {
+	if user.ID.IsZero() {
+		return errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(0, limit); err != nil {
+		return err
+	}
+	matchStage := bson.D{{"$match", bson.D{{"user_id", user.ID}}}}
+	c, err := aggregate(ctx, db.staticDownloads, generateDownloadsPipeline(matchStage, 0, limit))
+	if err != nil {
+		return errors.AddContext(err, "DB query failed")
+	}
+	return db.forEach(ctx, c, func(c *mongo.Cursor) error {
+		var d DownloadResponse
+		if err := c.Decode(&d); err != nil {
+			return errors.AddContext(err, "failed to decode DB data")
+		}
+		return fn(d)
+	})
+}
+
+// DownloadsByUserGrouped fetches a page of the user's downloads during the
+// current billing period, grouped by skylink, and the total number of
+// skylinks downloaded. The most downloaded skylinks come first.
+func (db *DB) DownloadsByUserGrouped(ctx context.Context, user User, offset, pageSize int) ([]DownloadSummary, int, error) {
+	if user.ID.IsZero() {
+		return nil, 0, errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(offset, pageSize); err != nil {
+		return nil, 0, err
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", user.ID},
+		{"created_at", bson.D{{"$gte", monthStart(user.SubscribedUntil)}}},
+	}}}
+	// Count the distinct skylinks.
+	countPipeline := mongo.Pipeline{
+		matchStage,
+		{{"$group", bson.D{{"_id", "$skylink_id"}}}},
+		{{"$count", "count"}},
+	}
+	c, err := aggregate(ctx, db.staticDownloads, countPipeline)
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "DB query failed")
+	}
+	var counts []struct {
+		Count int `bson:"count"`
+	}
+	if err = c.All(ctx, &counts); err != nil {
+		return nil, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	if len(counts) == 0 || counts[0].Count == 0 {
+		return []DownloadSummary{}, 0, nil
+	}
+	c, err = aggregate(ctx, db.staticDownloads, generateDownloadsSummaryPipeline(matchStage, offset, pageSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	summaries := make([]DownloadSummary, 0, pageSize)
+	if err = c.All(ctx, &summaries); err != nil {
+		return nil, 0, err
+	}
+	return summaries, counts[0].Count, nil
+}
+
 // downloadsBy fetches a page of downloads, filtered by an arbitrary match
 // criteria. It also reports the total number of records in the list.
 func (db *DB) downloadsBy(ctx context.Context, matchStage bson.D, offset, pageSize int) ([]DownloadResponse, int, error) {
@@ -113,7 +343,7 @@ func (db *DB) downloadsBy(ctx context.Context, matchStage bson.D, offset, pageSi
 	if err != nil || cnt == 0 {
 		return []DownloadResponse{}, 0, err
 	}
-	c, err := db.staticDownloads.Aggregate(ctx, generateDownloadsPipeline(matchStage, offset, pageSize))
+	c, err := aggregate(ctx, db.staticDownloads, generateDownloadsPipeline(matchStage, offset, pageSize))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -125,36 +355,20 @@ func (db *DB) downloadsBy(ctx context.Context, matchStage bson.D, offset, pageSi
 	return downloads, int(cnt), nil
 }
 
-// DownloadRecent returns the most recent download of the given skylink.
-func (db *DB) DownloadRecent(ctx context.Context, uID primitive.ObjectID, skylinkID primitive.ObjectID) (*Download, error) {
-	updatedAtThreshold := time.Now().UTC().Add(-1 * DownloadUpdateWindow)
-	filter := bson.M{
-		"user_id":    uID,
-		"skylink_id": skylinkID,
-		"updated_at": bson.M{"$gt": updatedAtThreshold},
-	}
-	opts := options.FindOneOptions{
-		Sort: bson.M{"updated_at": -1},
+// downloadRecentFilter matches the downloads of the given skylink by the given
+// user from the given IP, updated within the DownloadUpdateWindow. A zero user
+// ID stands for anonymous downloads.
+func downloadRecentFilter(uID primitive.ObjectID, ip string, skylinkID primitive.ObjectID, apiKeyID primitive.ObjectID) bson.M {
+	// Anonymous downloads don't have a user_id.
+	var userFilter interface{} = uID
+	if uID.IsZero() {
+		userFilter = bson.M{"$exists": false}
 	}
-	sr := db.staticDownloads.FindOne(ctx, filter, &opts)
-	var d Download
-	if err := sr.Decode(&d); err != nil {
-		// This includes the "no documents found" case.
-		return nil, errors.AddContext(err, "failed to parse value from DB")
-	}
-	return &d, nil
-}
-
-// DownloadIncrement increments the size of the download by additionalBytes.
-func (db *DB) DownloadIncrement(ctx context.Context, d *Download, additionalBytes int64) error {
-	filter := bson.M{"_id": d.ID}
-	update := bson.M{
-		"$inc": bson.M{"bytes": additionalBytes},
-		"$set": bson.M{"updated_at": time.Now().UTC()},
-	}
-	_, err := db.staticDownloads.UpdateOne(ctx, filter, update)
-	if err != nil {
-		return errors.AddContext(err, "failed to update download record")
+	return bson.M{
+		"user_id":       userFilter,
+		"downloader_ip": ip,
+		"skylink_id":    skylinkID,
+		"updated_at":    bson.M{"$gt": time.Now().UTC().Add(-1 * DownloadUpdateWindow)},
+		"api_key_id":    apiKeyIDFilter(apiKeyID),
 	}
-	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/SkynetLabs/skynet-accounts/test/dependencies"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -30,6 +31,18 @@ const (
 	emailLockTTL = 5 * time.Minute
 )
 
+var (
+	// emailRetryBackoff defines how long we wait before we retry an email
+	// which failed to send. The wait doubles with each failed attempt.
+	emailRetryBackoff = build.Select(
+		build.Var{
+			Dev:      5 * time.Second,
+			Testing:  time.Millisecond,
+			Standard: time.Minute,
+		},
+	).(time.Duration)
+)
+
 type (
 	// EmailMessage represents an email message waiting to be sent
 	EmailMessage struct {
@@ -43,11 +56,20 @@ type (
 		LockedAt       time.Time          `bson:"locked_at,omitempty"`
 		SentAt         time.Time          `bson:"sent_at,omitempty"`
 		FailedAttempts int                `bson:"failed_attempts"`
+		NextAttemptAt  time.Time          `bson:"next_attempt_at,omitempty"`
+		Category       EmailCategory      `bson:"category,omitempty"`
+		// Suppressed is set on the messages we didn't send because their
+		// recipient opted out of their category. We keep them for
+		// auditability.
+		Suppressed bool `bson:"suppressed,omitempty"`
 	}
 )
 
 // EmailCreate creates an email message in the DB which is waiting to be sent.
 func (db *DB) EmailCreate(ctx context.Context, m EmailMessage) error {
+	if db.staticDeps.Disrupt("DependencyEmailCreateWriteConflictN") {
+		return errors.New(dependencies.DependencyMongoWriteConflictNMessage)
+	}
 	_, err := db.staticEmails.InsertOne(ctx, m)
 	if err != nil {
 		return errors.AddContext(err, "failed to Insert")
@@ -65,6 +87,7 @@ func (db *DB) EmailLockAndFetch(ctx context.Context, lockID string, batchSize in
 		"locked_by":       lockID,
 		"failed_attempts": bson.M{"$lt": EmailMaxSendAttempts},
 		"sent_at":         nil,
+		"suppressed":      bson.M{"$ne": true},
 	}
 	count, err := db.staticEmails.CountDocuments(ctx, filter)
 	if err != nil {
@@ -74,13 +97,22 @@ func (db *DB) EmailLockAndFetch(ctx context.Context, lockID string, batchSize in
 	// We select entries which:
 	//  - haven't failed more times than the limit
 	//  - aren't sent, yet
+	//  - aren't suppressed
 	//  - are either unlocked or their lock has expired
+	//  - aren't waiting for a retry after a failed attempt
 	filterLock := bson.M{
 		"failed_attempts": bson.M{"$lt": EmailMaxSendAttempts},
 		"sent_at":         nil,
-		"$or": bson.A{
-			bson.M{"locked_by": ""},
-			bson.M{"locked_at": bson.M{"$lt": time.Now().UTC().Add(-emailLockTTL)}},
+		"suppressed":      bson.M{"$ne": true},
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"locked_by": ""},
+				bson.M{"locked_at": bson.M{"$lt": time.Now().UTC().Add(-emailLockTTL)}},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"next_attempt_at": nil},
+				bson.M{"next_attempt_at": bson.M{"$lte": time.Now().UTC()}},
+			}},
 		},
 	}
 	updateLock := bson.M{"$set": bson.M{
@@ -152,26 +184,27 @@ func (db *DB) MarkAsSent(ctx context.Context, ids []primitive.ObjectID) error {
 }
 
 // MarkAsFailed increments the FailedAttempts counter on each message and
-// marks the message as Failed if that counter exceeds the maxAttemptsToSend.
-// It also unlocks all given messages.
+// schedules its next attempt with an exponential backoff. We stop retrying a
+// message once that counter reaches EmailMaxSendAttempts. It also unlocks all
+// given messages.
 func (db *DB) MarkAsFailed(ctx context.Context, msgs []*EmailMessage) error {
-	if len(msgs) == 0 {
-		return nil
-	}
-	var ids []primitive.ObjectID
+	var errs []error
+	now := time.Now().UTC()
 	for _, m := range msgs {
-		ids = append(ids, m.ID)
-	}
-	filter := bson.M{"_id": bson.M{"$in": ids}}
-	update := bson.M{
-		"$inc": bson.M{"failed_attempts": 1},
-		"$set": bson.M{
-			"locked_by": "",
-			"locked_at": time.Time{},
-		},
+		update := bson.M{
+			"$inc": bson.M{"failed_attempts": 1},
+			"$set": bson.M{
+				"locked_by":       "",
+				"locked_at":       time.Time{},
+				"next_attempt_at": now.Add(emailRetryDelay(m.FailedAttempts + 1)),
+			},
+		}
+		_, err := db.staticEmails.UpdateOne(ctx, bson.M{"_id": m.ID}, update)
+		if err != nil {
+			errs = append(errs, errors.AddContext(err, "failed to mark email "+m.ID.Hex()+" as failed"))
+		}
 	}
-	_, err := db.staticEmails.UpdateMany(ctx, filter, update)
-	return err
+	return errors.Compose(errs...)
 }
 
 // PurgeEmailCollection is a helper method for testing purposes. It removes all
@@ -186,3 +219,12 @@ func (db *DB) PurgeEmailCollection(ctx context.Context) (int64, error) {
 	}
 	return dr.DeletedCount, nil
 }
+
+// emailRetryDelay returns how long we wait before we retry an email which has
+// failed the given number of times.
+func emailRetryDelay(failedAttempts int) time.Duration {
+	if failedAttempts < 1 {
+		return 0
+	}
+	return emailRetryBackoff << (failedAttempts - 1)
+}
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEmailRetryDelay ensures that the delay before retrying a failed email
+// doubles with each failed attempt.
+func TestEmailRetryDelay(t *testing.T) {
+	tests := []struct {
+		failedAttempts int
+		delay          int64
+	}{
+		{failedAttempts: 0, delay: 0},
+		{failedAttempts: 1, delay: 1},
+		{failedAttempts: 2, delay: 2},
+		{failedAttempts: 3, delay: 4},
+		{failedAttempts: 5, delay: 16},
+	}
+	for _, tt := range tests {
+		d := emailRetryDelay(tt.failedAttempts)
+		if d != emailRetryBackoff*time.Duration(tt.delay) {
+			t.Errorf("Expected %v after %d failed attempts, got %v", emailRetryBackoff*time.Duration(tt.delay), tt.failedAttempts, d)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package database
+
+const (
+	// EmailCategoryTransactional covers the emails which users need in order
+	// to use their account, such as address confirmations and account
+	// recovery. We always send them.
+	EmailCategoryTransactional EmailCategory = "transactional"
+	// EmailCategorySecurity covers the notifications about the security of
+	// the user's account, such as locked accounts.
+	EmailCategorySecurity EmailCategory = "security"
+	// EmailCategoryProduct covers the notifications about the user's usage
+	// of the service, such as exceeded quotas.
+	EmailCategoryProduct EmailCategory = "product"
+	// EmailCategoryMarketing covers announcements and promotions.
+	EmailCategoryMarketing EmailCategory = "marketing"
+)
+
+var (
+	// DefaultEmailPreferences are the preferences of users who haven't
+	// changed theirs. Marketing emails are opt-in.
+	DefaultEmailPreferences = EmailPreferences{
+		Security:  true,
+		Product:   true,
+		Marketing: false,
+	}
+)
+
+type (
+	// EmailCategory describes the kind of an email message. Users can opt
+	// out of all categories but EmailCategoryTransactional.
+	EmailCategory string
+
+	// EmailPreferences describes which categories of emails the user wants
+	// to receive.
+	EmailPreferences struct {
+		Security  bool `bson:"security" json:"security"`
+		Product   bool `bson:"product" json:"product"`
+		Marketing bool `bson:"marketing" json:"marketing"`
+	}
+)
+
+// Optional checks whether users can opt out of this category.
+func (c EmailCategory) Optional() bool {
+	switch c {
+	case EmailCategorySecurity, EmailCategoryProduct, EmailCategoryMarketing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Allows checks whether the preferences allow emails of the given category.
+// Transactional emails are always allowed.
+func (p EmailPreferences) Allows(c EmailCategory) bool {
+	switch c {
+	case EmailCategorySecurity:
+		return p.Security
+	case EmailCategoryProduct:
+		return p.Product
+	case EmailCategoryMarketing:
+		return p.Marketing
+	default:
+		return true
+	}
+}
+
+// Set changes the preference for the given category. It returns false if the
+// category is not one users can opt out of.
+func (p *EmailPreferences) Set(c EmailCategory, enabled bool) bool {
+	switch c {
+	case EmailCategorySecurity:
+		p.Security = enabled
+	case EmailCategoryProduct:
+		p.Product = enabled
+	case EmailCategoryMarketing:
+		p.Marketing = enabled
+	default:
+		return false
+	}
+	return true
+}
+
+// EmailPrefs returns the user's email preferences, falling back to the
+// DefaultEmailPreferences if they haven't changed them.
+func (u User) EmailPrefs() EmailPreferences {
+	if u.EmailPreferences == nil {
+		return DefaultEmailPreferences
+	}
+	return *u.EmailPreferences
+}
@@ -0,0 +1,29 @@
+package database
+
+import "testing"
+
+// TestEmailPreferences ensures that users can opt out of all categories of
+// emails but the transactional ones and that users who haven't changed their
+// preferences get the defaults.
+func TestEmailPreferences(t *testing.T) {
+	u := User{}
+	if u.EmailPrefs() != DefaultEmailPreferences {
+		t.Fatalf("Expected the default preferences, got %+v", u.EmailPrefs())
+	}
+	var p EmailPreferences
+	for _, c := range []EmailCategory{EmailCategorySecurity, EmailCategoryProduct, EmailCategoryMarketing} {
+		if p.Allows(c) {
+			t.Fatalf("Expected '%s' to not be allowed", c)
+		}
+		if !p.Set(c, true) || !p.Allows(c) {
+			t.Fatalf("Expected '%s' to be allowed", c)
+		}
+	}
+	if p.Set(EmailCategoryTransactional, false) || !p.Allows(EmailCategoryTransactional) {
+		t.Fatal("Expected transactional emails to always be allowed.")
+	}
+	u.EmailPreferences = &p
+	if u.EmailPrefs() != p {
+		t.Fatalf("Expected %+v, got %+v", p, u.EmailPrefs())
+	}
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LockAcquire tries to acquire the lock with the given name on behalf of the
+// server with the given lockID. The lock expires after the given TTL, so a
+// server which dies while holding it doesn't block the others forever. A
+// server which already holds the lock extends it. It returns false, without
+// an error, when another server holds the lock.
+func (db *DB) LockAcquire(ctx context.Context, name, lockID string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"name": name,
+		"$or": bson.A{
+			bson.M{"locked_by": lockID},
+			bson.M{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"locked_by":  lockID,
+		"expires_at": now.Add(ttl),
+	}}
+	// When another server holds the lock the filter doesn't match and the
+	// upsert collides with the existing lock on the unique name index.
+	_, err := db.staticLocks.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.AddContext(err, "failed to acquire lock "+name)
+	}
+	return true, nil
+}
+
+// LockRelease releases the lock with the given name, if the server with the
+// given lockID holds it.
+func (db *DB) LockRelease(ctx context.Context, name, lockID string) error {
+	_, err := db.staticLocks.DeleteOne(ctx, bson.M{"name": name, "locked_by": lockID})
+	if err != nil {
+		return errors.AddContext(err, "failed to release lock "+name)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// MaintenanceInterval defines how often we prune the expired challenges
+	// and unconfirmed user updates. The TTL indexes on these collections
+	// prune them as well but Mongo only runs its TTL monitor once a minute
+	// and it might lag behind under load.
+	MaintenanceInterval = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  time.Minute,
+			Standard: 5 * time.Minute,
+		},
+	).(time.Duration)
+)
+
+// StartMaintenance starts a background thread which periodically prunes the
+// expired challenges and unconfirmed user updates until the given context is
+// closed.
+func (db *DB) StartMaintenance(ctx context.Context) {
+	go db.threadedMaintenance(ctx)
+}
+
+// threadedMaintenance periodically prunes the expired challenges and
+// unconfirmed user updates.
+func (db *DB) threadedMaintenance(ctx context.Context) {
+	ticker := time.NewTicker(MaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		challenges, updates, err := db.PruneExpired(ctx)
+		if err != nil {
+			db.staticLogger.Warnln("Failed to prune expired challenges and user updates:", err)
+			continue
+		}
+		if challenges > 0 || updates > 0 {
+			db.staticLogger.Infof("Pruned %d expired challenges and %d expired unconfirmed user updates", challenges, updates)
+		}
+	}
+}
+
+// PruneExpired deletes the challenges which expired more than
+// expiredChallengeRetention ago and the expired unconfirmed user updates. It
+// returns the number of deleted challenges and updates.
+func (db *DB) PruneExpired(ctx context.Context) (int64, int64, error) {
+	now := time.Now().UTC()
+	cutoff := now.Add(-expiredChallengeRetention)
+	dr, err := db.staticChallenges.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to delete expired challenges")
+	}
+	challenges := dr.DeletedCount
+	dr, err = db.staticUnconfirmedUserUpdates.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": now}})
+	if err != nil {
+		return challenges, 0, errors.AddContext(err, "failed to delete expired unconfirmed user updates")
+	}
+	return challenges, dr.DeletedCount, nil
+}
@@ -0,0 +1,345 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/lib"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// OrgInviteTTL defines how long an invite to join an organization stays
+	// valid.
+	OrgInviteTTL = 7 * 24 * time.Hour
+	// MaxOrgInvites is the maximum number of outstanding invites an
+	// organization can have. Expired invites don't count towards it.
+	MaxOrgInvites = 50
+
+	// ErrOrgNotFound is returned when the requested organization doesn't
+	// exist.
+	ErrOrgNotFound = errors.New("organization not found")
+	// ErrOrgInviteLimitReached is returned when an organization tries to send
+	// an invite while it already has MaxOrgInvites outstanding invites.
+	ErrOrgInviteLimitReached = errors.New("organization has too many outstanding invites")
+	// ErrUserInOrg is returned when a user who already belongs to an
+	// organization tries to create or join one.
+	ErrUserInOrg = errors.New("user already belongs to an organization")
+)
+
+type (
+	// Organization allows a team of users to share a tier and a pooled
+	// storage quota. The owner creates it and invites the other members. Its
+	// tier is assigned by an admin. We mirror its tier and QuotaExceeded
+	// flag on its members, see User.OrgID.
+	Organization struct {
+		ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+		Name          string             `bson:"name" json:"name"`
+		OwnerID       primitive.ObjectID `bson:"owner_id" json:"-"`
+		Tier          int                `bson:"tier" json:"tier"`
+		QuotaExceeded bool               `bson:"quota_exceeded" json:"quotaExceeded"`
+		CreatedAt     time.Time          `bson:"created_at" json:"createdAt"`
+		Invites       []OrgInvite        `bson:"invites,omitempty" json:"-"`
+		// QuotaUsage is the pooled usage we computed when we found that the
+		// organization exceeds its quota. It's only set while QuotaExceeded
+		// is true.
+		QuotaUsage *QuotaUsage `bson:"quota_usage,omitempty" json:"-"`
+	}
+	// OrgInvite is an invite to join an organization, sent to the given
+	// email address. The recipient accepts it with its token.
+	OrgInvite struct {
+		Email     types.Email `bson:"email"`
+		Token     string      `bson:"token"`
+		ExpiresAt time.Time   `bson:"expires_at"`
+	}
+)
+
+// OrgCreate creates a new organization with the given name and the given user
+// as its owner and first member. New organizations are on the free tier until
+// an admin assigns them another one.
+func (db *DB) OrgCreate(ctx context.Context, owner *User, name string) (*Organization, error) {
+	if !owner.OrgID.IsZero() {
+		return nil, ErrUserInOrg
+	}
+	org := &Organization{
+		Name:      name,
+		OwnerID:   owner.ID,
+		Tier:      TierFree,
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	ir, err := db.staticOrganizations.InsertOne(ctx, org)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrUserInOrg
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to insert organization")
+	}
+	org.ID = ir.InsertedID.(primitive.ObjectID)
+	err = db.orgAddMember(ctx, org, owner)
+	if err != nil {
+		_, errDel := db.staticOrganizations.DeleteOne(ctx, bson.M{"_id": org.ID})
+		return nil, errors.Compose(err, errDel)
+	}
+	return org, nil
+}
+
+// OrgByID returns the organization with the given ID.
+func (db *DB) OrgByID(ctx context.Context, id primitive.ObjectID) (*Organization, error) {
+	sr := db.staticOrganizations.FindOne(ctx, bson.M{"_id": id})
+	if errors.Contains(sr.Err(), mongo.ErrNoDocuments) {
+		return nil, ErrOrgNotFound
+	}
+	if sr.Err() != nil {
+		return nil, sr.Err()
+	}
+	var org Organization
+	err := sr.Decode(&org)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode organization")
+	}
+	return &org, nil
+}
+
+// OrgMembers returns the members of the given organization, including its
+// owner.
+func (db *DB) OrgMembers(ctx context.Context, orgID primitive.ObjectID) ([]*User, error) {
+	users, err := db.managedUsersByField(ctx, "org_id", orgID)
+	if errors.Contains(err, ErrUserNotFound) {
+		return nil, nil
+	}
+	return users, err
+}
+
+// OrgInviteCreate creates an invite to join the given organization for the
+// given email address and returns its token. It replaces any earlier invite
+// for the same address and drops the expired ones. It returns
+// ErrOrgInviteLimitReached if the organization already has MaxOrgInvites
+// outstanding invites. The limit is checked as part of the update, so
+// concurrent invites can't push the organization over it.
+func (db *DB) OrgInviteCreate(ctx context.Context, org *Organization, email types.Email) (string, error) {
+	tk, err := lib.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{"_id": org.ID}
+	pull := bson.M{"$pull": bson.M{"invites": bson.M{"$or": bson.A{
+		bson.M{"email": email},
+		bson.M{"expires_at": bson.M{"$lte": now}},
+	}}}}
+	_, err = db.staticOrganizations.UpdateOne(ctx, filter, pull)
+	if err != nil {
+		return "", errors.AddContext(err, "failed to remove earlier invites")
+	}
+	invite := OrgInvite{
+		Email:     email,
+		Token:     tk,
+		ExpiresAt: now.Add(OrgInviteTTL),
+	}
+	filterLimit := bson.M{
+		"_id": org.ID,
+		"$expr": bson.M{
+			"$lt": bson.A{
+				bson.M{"$size": bson.M{"$ifNull": bson.A{"$invites", bson.A{}}}},
+				MaxOrgInvites,
+			},
+		},
+	}
+	ur, err := db.staticOrganizations.UpdateOne(ctx, filterLimit, bson.M{"$push": bson.M{"invites": invite}})
+	if err != nil {
+		return "", errors.AddContext(err, "failed to store the invite")
+	}
+	if ur.MatchedCount == 0 {
+		n, err := db.staticOrganizations.CountDocuments(ctx, filter)
+		if err != nil {
+			return "", errors.AddContext(err, "failed to fetch organization")
+		}
+		if n == 0 {
+			return "", ErrOrgNotFound
+		}
+		return "", ErrOrgInviteLimitReached
+	}
+	return tk, nil
+}
+
+// OrgInviteAccept adds the user with the email address the invite with the
+// given token was sent to to the organization which sent it. It fails with
+// ErrInvalidToken if there is no such invite or it has expired, with
+// ErrUserNotFound if there is no user with that address and with ErrUserInOrg
+// if the user already belongs to an organization.
+func (db *DB) OrgInviteAccept(ctx context.Context, token string) (*Organization, *User, error) {
+	if token == "" {
+		return nil, nil, errors.AddContext(ErrInvalidToken, "token cannot be empty")
+	}
+	sr := db.staticOrganizations.FindOne(ctx, bson.M{"invites.token": token})
+	if errors.Contains(sr.Err(), mongo.ErrNoDocuments) {
+		return nil, nil, errors.AddContext(ErrInvalidToken, "no invite has this token")
+	}
+	if sr.Err() != nil {
+		return nil, nil, sr.Err()
+	}
+	var org Organization
+	err := sr.Decode(&org)
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "failed to decode organization")
+	}
+	var invite OrgInvite
+	for _, inv := range org.Invites {
+		if inv.Token == token {
+			invite = inv
+		}
+	}
+	if invite.ExpiresAt.Before(time.Now().UTC()) {
+		return nil, nil, errors.AddContext(ErrInvalidToken, "token expired")
+	}
+	u, err := db.UserByEmail(ctx, invite.Email)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.orgAddMember(ctx, &org, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = db.staticOrganizations.UpdateOne(ctx, bson.M{"_id": org.ID}, bson.M{"$pull": bson.M{"invites": bson.M{"token": token}}})
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "failed to remove the accepted invite")
+	}
+	return &org, u, nil
+}
+
+// OrgMemberRemove removes the given user from the given organization. From
+// then on, the user's own tier and quota apply to them again.
+func (db *DB) OrgMemberRemove(ctx context.Context, org *Organization, u *User) error {
+	filter := bson.M{"_id": u.ID, "org_id": org.ID}
+	update := bson.M{"$unset": bson.M{"org_id": "", "org_tier": ""}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to remove member")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.OrgID = primitive.ObjectID{}
+	u.OrgTier = 0
+	u.Version++
+	return nil
+}
+
+// OrgSetTier sets the tier of the given organization and of its members.
+func (db *DB) OrgSetTier(ctx context.Context, org *Organization, tier int) error {
+	ur, err := db.staticOrganizations.UpdateOne(ctx, bson.M{"_id": org.ID}, bson.M{"$set": bson.M{"tier": tier}})
+	if err != nil {
+		return errors.AddContext(err, "failed to update organization")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrOrgNotFound
+	}
+	_, err = db.staticUsers.UpdateMany(ctx, bson.M{"org_id": org.ID}, withVersionBump(bson.M{"$set": bson.M{"org_tier": tier}}))
+	if err != nil {
+		return errors.AddContext(err, "failed to update the organization's members")
+	}
+	org.Tier = tier
+	return nil
+}
+
+// OrgSetQuotaExceeded sets the QuotaExceeded flag of the given organization
+// and of its members, together with the usage which exceeds the quota. The
+// usage is cleared when the flag is not set.
+func (db *DB) OrgSetQuotaExceeded(ctx context.Context, org *Organization, quotaExceeded bool, usage *QuotaUsage) error {
+	if !quotaExceeded {
+		usage = nil
+	}
+	_, err := db.staticOrganizations.UpdateOne(ctx, bson.M{"_id": org.ID}, quotaExceededUpdate(quotaExceeded, usage))
+	if err != nil {
+		return errors.AddContext(err, "failed to update organization")
+	}
+	_, err = db.staticUsers.UpdateMany(ctx, bson.M{"org_id": org.ID}, withVersionBump(quotaExceededUpdate(quotaExceeded, usage)))
+	if err != nil {
+		return errors.AddContext(err, "failed to update the organization's members")
+	}
+	org.QuotaExceeded = quotaExceeded
+	org.QuotaUsage = usage
+	return nil
+}
+
+// quotaExceededUpdate returns the update which sets the given QuotaExceeded
+// flag and usage.
+func quotaExceededUpdate(quotaExceeded bool, usage *QuotaUsage) bson.M {
+	if usage == nil {
+		return bson.M{
+			"$set":   bson.M{"quota_exceeded": quotaExceeded},
+			"$unset": bson.M{"quota_usage": ""},
+		}
+	}
+	return bson.M{"$set": bson.M{"quota_exceeded": quotaExceeded, "quota_usage": usage}}
+}
+
+// OrgStatsUpload reports on the pooled uploads of the given users, usually
+// the members of an organization. Skylinks uploaded by several members only
+// count once towards the pooled storage.
+func (db *DB) OrgStatsUpload(ctx context.Context, memberIDs []primitive.ObjectID, since time.Time) (UserStatsUpload, error) {
+	return db.uploadStats(ctx, bson.M{"user_id": bson.M{"$in": memberIDs}}, since)
+}
+
+// orgAddMember makes the given user a member of the given organization. The
+// member takes on the organization's tier, QuotaExceeded flag and usage.
+func (db *DB) orgAddMember(ctx context.Context, org *Organization, u *User) error {
+	filter := bson.M{"_id": u.ID, "org_id": bson.M{"$exists": false}}
+	set := bson.M{
+		"org_id":         org.ID,
+		"org_tier":       org.Tier,
+		"quota_exceeded": org.QuotaExceeded,
+	}
+	update := bson.M{"$set": set, "$unset": bson.M{"quota_usage": ""}}
+	if org.QuotaUsage != nil {
+		set["quota_usage"] = org.QuotaUsage
+		update = bson.M{"$set": set}
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to add member")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserInOrg
+	}
+	u.OrgID = org.ID
+	u.OrgTier = org.Tier
+	u.QuotaExceeded = org.QuotaExceeded
+	u.QuotaUsage = org.QuotaUsage
+	u.Version++
+	return nil
+}
+
+// orgDeleteByOwner deletes the organization owned by the given user, if any.
+// Its members keep their accounts but leave the organization.
+func (db *DB) orgDeleteByOwner(ctx context.Context, ownerID primitive.ObjectID) error {
+	sr := db.staticOrganizations.FindOne(ctx, bson.M{"owner_id": ownerID})
+	if errors.Contains(sr.Err(), mongo.ErrNoDocuments) {
+		return nil
+	}
+	if sr.Err() != nil {
+		return sr.Err()
+	}
+	var org Organization
+	err := sr.Decode(&org)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode organization")
+	}
+	_, err = db.staticUsers.UpdateMany(ctx, bson.M{"org_id": org.ID}, withVersionBump(bson.M{"$unset": bson.M{"org_id": "", "org_tier": ""}}))
+	if err != nil {
+		return errors.AddContext(err, "failed to remove the organization's members")
+	}
+	_, err = db.staticStorageUsage.DeleteOne(ctx, bson.M{"_id": org.ID})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete the organization's storage usage")
+	}
+	_, err = db.staticOrganizations.DeleteOne(ctx, bson.M{"_id": org.ID})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete organization")
+	}
+	return nil
+}
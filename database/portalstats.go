@@ -0,0 +1,188 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	// PortalStats is an overview of the portal's users and their activity.
+	// UsersByTier maps each tier to the number of users on it. NewUsers24h,
+	// NewUsers7d and NewUsers30d hold the number of users who signed up during
+	// the respective period. UploadsSize is the combined size of the skyfiles
+	// of all uploads and DownloadsSize is the number of bytes served by all
+	// downloads.
+	PortalStats struct {
+		Users              int64         `json:"users"`
+		UsersByTier        map[int]int64 `json:"usersByTier"`
+		NewUsers24h        int64         `json:"newUsers24h"`
+		NewUsers7d         int64         `json:"newUsers7d"`
+		NewUsers30d        int64         `json:"newUsers30d"`
+		QuotaExceededUsers int64         `json:"quotaExceededUsers"`
+		Uploads            int64         `json:"uploads"`
+		UploadsSize        int64         `json:"uploadsSize"`
+		Downloads          int64         `json:"downloads"`
+		DownloadsSize      int64         `json:"downloadsSize"`
+		GeneratedAt        time.Time     `json:"generatedAt"`
+	}
+)
+
+// PortalStats builds an overview of the portal's users, uploads and downloads.
+// It scans entire collections, so callers should cache its result.
+func (db *DB) PortalStats(ctx context.Context) (*PortalStats, error) {
+	now := time.Now().UTC()
+	ps := &PortalStats{
+		UsersByTier: make(map[int]int64),
+		GeneratedAt: now.Truncate(time.Millisecond),
+	}
+	err := db.portalUserStats(ctx, ps, now)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get user stats")
+	}
+	err = db.portalUploadStats(ctx, ps)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get upload stats")
+	}
+	err = db.portalDownloadStats(ctx, ps)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get download stats")
+	}
+	return ps, nil
+}
+
+// portalUserStats fills in the user counts of the given stats. Users who have
+// deleted their accounts aren't counted.
+func (db *DB) portalUserStats(ctx context.Context, ps *PortalStats, now time.Time) error {
+	notDeleted := bson.M{"deleted_at": bson.M{"$exists": false}}
+	pipeline := mongo.Pipeline{
+		{{"$match", notDeleted}},
+		{{"$group", bson.D{
+			{"_id", "$tier"},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+	}
+	var tiers []struct {
+		Tier  int   `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	err := aggregateAll(ctx, db.staticUsers, pipeline, &tiers)
+	if err != nil {
+		return err
+	}
+	for _, t := range tiers {
+		ps.UsersByTier[t.Tier] = t.Count
+		ps.Users += t.Count
+	}
+
+	// Count the new users for all periods in a single pass over the users
+	// who signed up during the longest one.
+	since24h := now.Add(-24 * time.Hour)
+	since7d := now.Add(-7 * 24 * time.Hour)
+	since30d := now.Add(-30 * 24 * time.Hour)
+	countSince := func(t time.Time) bson.D {
+		return bson.D{{"$sum", bson.D{{"$cond", bson.A{bson.D{{"$gte", bson.A{"$created_at", t}}}, 1, 0}}}}}
+	}
+	pipeline = mongo.Pipeline{
+		{{"$match", bson.M{"created_at": bson.M{"$gte": since30d}, "deleted_at": bson.M{"$exists": false}}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"new_24h", countSince(since24h)},
+			{"new_7d", countSince(since7d)},
+			{"new_30d", bson.D{{"$sum", 1}}},
+		}}},
+	}
+	var newUsers []struct {
+		New24h int64 `bson:"new_24h"`
+		New7d  int64 `bson:"new_7d"`
+		New30d int64 `bson:"new_30d"`
+	}
+	err = aggregateAll(ctx, db.staticUsers, pipeline, &newUsers)
+	if err != nil {
+		return err
+	}
+	if len(newUsers) > 0 {
+		ps.NewUsers24h = newUsers[0].New24h
+		ps.NewUsers7d = newUsers[0].New7d
+		ps.NewUsers30d = newUsers[0].New30d
+	}
+
+	ps.QuotaExceededUsers, err = db.staticUsers.CountDocuments(ctx, bson.M{"quota_exceeded": true, "deleted_at": bson.M{"$exists": false}})
+	return err
+}
+
+// portalUploadStats fills in the upload counts of the given stats. We group
+// the uploads by skylink before looking up the skylinks' sizes, so we only
+// look up each skylink once.
+func (db *DB) portalUploadStats(ctx context.Context, ps *PortalStats) error {
+	pipeline := mongo.Pipeline{
+		{{"$group", bson.D{
+			{"_id", "$skylink_id"},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+		{{"$lookup", bson.D{
+			{"from", collSkylinks},
+			{"localField", "_id"},
+			{"foreignField", "_id"},
+			{"as", "skylink_data"},
+		}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"count", bson.D{{"$sum", "$count"}}},
+			{"size", bson.D{{"$sum", bson.D{{"$multiply", bson.A{
+				"$count",
+				bson.D{{"$ifNull", bson.A{bson.D{{"$arrayElemAt", bson.A{"$skylink_data.size", 0}}}, 0}}},
+			}}}}}},
+		}}},
+	}
+	var uploads []struct {
+		Count int64 `bson:"count"`
+		Size  int64 `bson:"size"`
+	}
+	err := aggregateAll(ctx, db.staticUploads, pipeline, &uploads)
+	if err != nil {
+		return err
+	}
+	if len(uploads) > 0 {
+		ps.Uploads = uploads[0].Count
+		ps.UploadsSize = uploads[0].Size
+	}
+	return nil
+}
+
+// portalDownloadStats fills in the download counts of the given stats.
+func (db *DB) portalDownloadStats(ctx context.Context, ps *PortalStats) error {
+	pipeline := mongo.Pipeline{
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"count", bson.D{{"$sum", 1}}},
+			{"size", bson.D{{"$sum", "$bytes"}}},
+		}}},
+	}
+	var downloads []struct {
+		Count int64 `bson:"count"`
+		Size  int64 `bson:"size"`
+	}
+	err := aggregateAll(ctx, db.staticDownloads, pipeline, &downloads)
+	if err != nil {
+		return err
+	}
+	if len(downloads) > 0 {
+		ps.Downloads = downloads[0].Count
+		ps.DownloadsSize = downloads[0].Size
+	}
+	return nil
+}
+
+// aggregateAll runs the given pipeline against the given collection and
+// decodes all resulting documents into results.
+func aggregateAll(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, results interface{}) error {
+	c, err := aggregate(ctx, coll, pipeline)
+	if err != nil {
+		return errors.AddContext(err, "DB query failed")
+	}
+	return c.All(ctx, results)
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/lib"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+The recovery_tokens collection holds the tokens we email to users who request
+an account recovery. Each token allows its holder to set a new password or to
+restore a deleted account without logging in.
+
+A user can have several outstanding tokens, e.g. because they requested a
+recovery twice and the first email arrived late. Using any of them invalidates
+all of them. Expired tokens behave exactly like nonexistent ones and are
+eventually removed by a TTL index.
+
+Tokens issued before this collection existed are stored in the users'
+`recovery_token` field. We still accept those until they are used.
+*/
+
+var (
+	// ErrInvalidRecoveryToken is returned when a recovery token doesn't exist,
+	// has expired or has already been used.
+	ErrInvalidRecoveryToken = errors.New("invalid recovery token")
+	// MaxRecoveryTokensPerUser sets the limit for the number of outstanding
+	// recovery tokens a single user can have. Requesting a new token beyond
+	// that limit invalidates the oldest one. This value is configurable via
+	// the ACCOUNTS_MAX_RECOVERY_TOKENS environment variable.
+	MaxRecoveryTokensPerUser = 3
+	// RecoveryTokenTTL defines how long a recovery token remains valid.
+	RecoveryTokenTTL = 24 * time.Hour
+)
+
+type (
+	// RecoveryToken is a single-use token which allows a user to recover
+	// their account.
+	RecoveryToken struct {
+		ID        primitive.ObjectID `bson:"_id,omitempty"`
+		UserID    primitive.ObjectID `bson:"user_id"`
+		Token     string             `bson:"token"`
+		CreatedAt time.Time          `bson:"created_at"`
+		ExpiresAt time.Time          `bson:"expires_at"`
+	}
+)
+
+// RecoveryTokenCreate generates a new recovery token for the given user. If
+// the user ends up with more than MaxRecoveryTokensPerUser outstanding tokens,
+// their oldest ones are deleted.
+func (db *DB) RecoveryTokenCreate(ctx context.Context, u User) (*RecoveryToken, error) {
+	if u.ID.IsZero() {
+		return nil, errors.AddContext(ErrUserNotFound, "user struct not fully initialised")
+	}
+	token, err := lib.GenerateUUID()
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to generate a token")
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	rt := &RecoveryToken{
+		UserID:    u.ID,
+		Token:     token,
+		CreatedAt: now,
+		ExpiresAt: now.Add(RecoveryTokenTTL),
+	}
+	ior, err := db.staticRecoveryTokens.InsertOne(ctx, rt)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to insert recovery token")
+	}
+	rt.ID = ior.InsertedID.(primitive.ObjectID)
+	// Find the tokens beyond the limit and delete them.
+	opts := options.Find().
+		SetSort(bson.D{{"created_at", -1}, {"_id", -1}}).
+		SetSkip(int64(MaxRecoveryTokensPerUser)).
+		SetProjection(bson.M{"_id": 1})
+	c, err := db.staticRecoveryTokens.Find(ctx, bson.M{"user_id": u.ID}, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find old recovery tokens")
+	}
+	var old []RecoveryToken
+	err = c.All(ctx, &old)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode old recovery tokens")
+	}
+	if len(old) == 0 {
+		return rt, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(old))
+	for _, o := range old {
+		ids = append(ids, o.ID)
+	}
+	_, err = db.staticRecoveryTokens.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to delete old recovery tokens")
+	}
+	return rt, nil
+}
+
+// RecoveryTokensByUser returns the given user's valid recovery tokens, newest
+// first.
+func (db *DB) RecoveryTokensByUser(ctx context.Context, u User) ([]RecoveryToken, error) {
+	filter := bson.M{
+		"user_id":    u.ID,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	opts := options.Find().SetSort(bson.D{{"created_at", -1}, {"_id", -1}})
+	c, err := db.staticRecoveryTokens.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find recovery tokens")
+	}
+	tokens := make([]RecoveryToken, 0)
+	err = c.All(ctx, &tokens)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode recovery tokens")
+	}
+	return tokens, nil
+}
+
+// RecoveryTokenConsume uses up the given recovery token of the given user and
+// invalidates all of the user's other recovery tokens. It returns
+// ErrInvalidRecoveryToken if the token is not a valid token of that user,
+// which means that only one of several concurrent callers can consume it.
+func (db *DB) RecoveryTokenConsume(ctx context.Context, u *User, token string) error {
+	if u.ID.IsZero() {
+		return errors.AddContext(ErrUserNotFound, "user struct not fully initialised")
+	}
+	filter := bson.M{
+		"user_id":    u.ID,
+		"token":      token,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	dr, err := db.staticRecoveryTokens.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.AddContext(err, "failed to consume recovery token")
+	}
+	if dr.DeletedCount == 0 {
+		// Fall back to the token stored on the user record.
+		filter = bson.M{"_id": u.ID, "recovery_token": token}
+		ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(bson.M{"$unset": bson.M{"recovery_token": ""}}))
+		if err != nil {
+			return errors.AddContext(err, "failed to consume recovery token")
+		}
+		if ur.ModifiedCount == 0 {
+			return ErrInvalidRecoveryToken
+		}
+		u.Version++
+	}
+	return db.RecoveryTokensDelete(ctx, u)
+}
+
+// RecoveryTokensDelete deletes all recovery tokens of the given user.
+func (db *DB) RecoveryTokensDelete(ctx context.Context, u *User) error {
+	if u.ID.IsZero() {
+		return errors.AddContext(ErrUserNotFound, "user struct not fully initialised")
+	}
+	_, err := db.staticRecoveryTokens.DeleteMany(ctx, bson.M{"user_id": u.ID})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete recovery tokens")
+	}
+	_, err = db.staticUsers.UpdateOne(ctx, bson.M{"_id": u.ID}, withVersionBump(bson.M{"$unset": bson.M{"recovery_token": ""}}))
+	if err != nil {
+		return errors.AddContext(err, "failed to delete legacy recovery token")
+	}
+	u.RecoveryToken = ""
+	u.Version++
+	return nil
+}
+
+// userIDByRecoveryToken returns the ID of the user who owns the given valid
+// recovery token.
+func (db *DB) userIDByRecoveryToken(ctx context.Context, token string) (primitive.ObjectID, error) {
+	filter := bson.M{
+		"token":      token,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	var rt RecoveryToken
+	err := db.staticRecoveryTokens.FindOne(ctx, filter).Decode(&rt)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return primitive.ObjectID{}, ErrInvalidRecoveryToken
+	}
+	if err != nil {
+		return primitive.ObjectID{}, errors.AddContext(err, "failed to find recovery token")
+	}
+	return rt.UserID, nil
+}
@@ -5,7 +5,9 @@ import (
 	"time"
 
 	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // RegistryRead describes a single registry read by a user.
@@ -13,6 +15,7 @@ type RegistryRead struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	APIKeyID  primitive.ObjectID `bson:"api_key_id,omitempty" json:"-"`
 }
 
 // RegistryWrite describes a single registry write by a user.
@@ -20,16 +23,18 @@ type RegistryWrite struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	APIKeyID  primitive.ObjectID `bson:"api_key_id,omitempty" json:"-"`
 }
 
 // RegistryReadCreate registers a new registry read.
-func (db *DB) RegistryReadCreate(ctx context.Context, user User) (*RegistryRead, error) {
+func (db *DB) RegistryReadCreate(ctx context.Context, user User, apiKeyID primitive.ObjectID) (*RegistryRead, error) {
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
 	rr := RegistryRead{
 		UserID:    user.ID,
 		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
+		APIKeyID:  apiKeyID,
 	}
 	ior, err := db.staticRegistryReads.InsertOne(ctx, rr)
 	if err != nil {
@@ -40,13 +45,14 @@ func (db *DB) RegistryReadCreate(ctx context.Context, user User) (*RegistryRead,
 }
 
 // RegistryWriteCreate registers a new registry write.
-func (db *DB) RegistryWriteCreate(ctx context.Context, user User) (*RegistryWrite, error) {
+func (db *DB) RegistryWriteCreate(ctx context.Context, user User, apiKeyID primitive.ObjectID) (*RegistryWrite, error) {
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
 	rw := RegistryWrite{
 		UserID:    user.ID,
 		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
+		APIKeyID:  apiKeyID,
 	}
 	ior, err := db.staticRegistryWrites.InsertOne(ctx, rw)
 	if err != nil {
@@ -55,3 +61,52 @@ func (db *DB) RegistryWriteCreate(ctx context.Context, user User) (*RegistryWrit
 	rw.ID = ior.InsertedID.(primitive.ObjectID)
 	return &rw, nil
 }
+
+// RegistryReadsByUser fetches a page of the user's registry reads, most recent
+// first. It also reports the total number of registry reads by the user.
+func (db *DB) RegistryReadsByUser(ctx context.Context, user User, offset, pageSize int) ([]RegistryRead, int, error) {
+	reads := make([]RegistryRead, 0, pageSize)
+	cnt, err := db.registryEventsByUser(ctx, db.staticRegistryReads, user, offset, pageSize, &reads)
+	if err != nil || cnt == 0 {
+		return []RegistryRead{}, 0, err
+	}
+	return reads, cnt, nil
+}
+
+// RegistryWritesByUser fetches a page of the user's registry writes, most
+// recent first. It also reports the total number of registry writes by the
+// user.
+func (db *DB) RegistryWritesByUser(ctx context.Context, user User, offset, pageSize int) ([]RegistryWrite, int, error) {
+	writes := make([]RegistryWrite, 0, pageSize)
+	cnt, err := db.registryEventsByUser(ctx, db.staticRegistryWrites, user, offset, pageSize, &writes)
+	if err != nil || cnt == 0 {
+		return []RegistryWrite{}, 0, err
+	}
+	return writes, cnt, nil
+}
+
+// registryEventsByUser fetches a page of the user's registry events from the
+// given collection and decodes them into results. It returns the total number
+// of the user's events in the collection.
+func (db *DB) registryEventsByUser(ctx context.Context, coll *mongo.Collection, user User, offset, pageSize int, results interface{}) (int, error) {
+	if user.ID.IsZero() {
+		return 0, errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(offset, pageSize); err != nil {
+		return 0, err
+	}
+	matchStage := bson.D{{"$match", bson.D{{"user_id", user.ID}}}}
+	cnt, err := db.count(ctx, coll, matchStage)
+	if err != nil || cnt == 0 {
+		return 0, err
+	}
+	c, err := aggregate(ctx, coll, generateRegistryEventsPipeline(matchStage, offset, pageSize))
+	if err != nil {
+		return 0, err
+	}
+	err = c.All(ctx, results)
+	if err != nil {
+		return 0, err
+	}
+	return int(cnt), nil
+}
@@ -1,12 +1,34 @@
 package database
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const (
+	// emailIndexName is the name of the case-insensitive unique index on the
+	// users' emails.
+	emailIndexName = "email_unique_ci"
+	// legacyEmailIndexName is the name of the case-sensitive unique index on
+	// the users' emails which emailIndexName replaces.
+	legacyEmailIndexName = "email_unique"
+)
+
 var (
+	// emailCollation makes comparisons of emails case-insensitive. Queries by
+	// email need to use it, so they can use the unique index on the users'
+	// emails and can't miss a user because of the capitalization.
+	emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
 	// Schema defines a mapping between a collection name and the indexes that
 	// must exist for that collection.
 	Schema = map[string][]mongo.IndexModel{
@@ -15,32 +37,125 @@ var (
 				Keys:    bson.M{"sub": 1},
 				Options: options.Index().SetName("sub_unique").SetUnique(true),
 			},
+			{
+				Keys:    bson.D{{"sub", 1}, {"quota_exceeded", 1}},
+				Options: options.Index().SetName("sub_quota_exceeded"),
+			},
+			{
+				// Users who sign up with a pubkey might not have an email,
+				// so we only require non-empty emails to be unique.
+				Keys: bson.M{"email": 1},
+				Options: options.Index().
+					SetName(emailIndexName).
+					SetUnique(true).
+					SetCollation(emailCollation).
+					SetPartialFilterExpression(bson.M{"email": bson.M{"$gt": ""}}),
+			},
+			{
+				Keys:    bson.M{"deleted_at": 1},
+				Options: options.Index().SetName("deleted_at").SetSparse(true),
+			},
+			{
+				Keys:    bson.M{"created_at": 1},
+				Options: options.Index().SetName("created_at"),
+			},
+			{
+				Keys: bson.M{"quota_exceeded": 1},
+				Options: options.Index().
+					SetName("quota_exceeded").
+					SetPartialFilterExpression(bson.M{"quota_exceeded": true}),
+			},
+			{
+				Keys:    bson.M{"org_id": 1},
+				Options: options.Index().SetName("org_id").SetSparse(true),
+			},
 		},
 		collSkylinks: {
 			{
 				Keys:    bson.M{"skylink": 1},
 				Options: options.Index().SetName("skylink_unique").SetUnique(true),
 			},
+			{
+				Keys: bson.D{{"blocked", 1}, {"blocked_at", -1}},
+				Options: options.Index().
+					SetName("blocked_blocked_at").
+					SetPartialFilterExpression(bson.M{"blocked": true}),
+			},
+			{
+				Keys:    bson.D{{"size", 1}, {"meta_next_attempt", 1}},
+				Options: options.Index().SetName("size_meta_next_attempt"),
+			},
 		},
 		collUploads: {
 			{
-				Keys:    bson.M{"user_id": 1},
-				Options: options.Index().SetName("user_id"),
+				Keys:    bson.D{{"user_id", 1}, {"timestamp", -1}},
+				Options: options.Index().SetName("user_id_timestamp"),
 			},
 			{
 				Keys:    bson.M{"skylink_id": 1},
 				Options: options.Index().SetName("skylink_id"),
 			},
+			{
+				Keys:    bson.M{"api_key_id": 1},
+				Options: options.Index().SetName("api_key_id").SetSparse(true),
+			},
+			{
+				Keys:    bson.D{{"uploader_ip", 1}, {"timestamp", -1}},
+				Options: options.Index().SetName("uploader_ip_timestamp"),
+			},
+			{
+				Keys:    bson.M{"timestamp": 1},
+				Options: options.Index().SetName("timestamp"),
+			},
+			{
+				// We use a partial index rather than a sparse one because
+				// a compound sparse index would still index all anonymous
+				// uploads without a request ID as duplicates of each other.
+				Keys: bson.D{{"user_id", 1}, {"request_id", 1}},
+				Options: options.Index().
+					SetName("user_id_request_id_unique").
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"request_id": bson.M{"$exists": true}}),
+			},
+			{
+				// Only the uploads we deduplicate by skylink have a
+				// dedup_bucket, see uploadCreateDedupSkylink.
+				Keys: bson.D{{"user_id", 1}, {"skylink_id", 1}, {"dedup_bucket", 1}},
+				Options: options.Index().
+					SetName("user_id_skylink_id_dedup_bucket_unique").
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"dedup_bucket": bson.M{"$exists": true}}),
+			},
 		},
 		collDownloads: {
 			{
-				Keys:    bson.M{"user_id": 1},
-				Options: options.Index().SetName("user_id"),
+				Keys:    bson.D{{"user_id", 1}, {"created_at", -1}},
+				Options: options.Index().SetName("user_id_created_at"),
 			},
 			{
 				Keys:    bson.M{"skylink_id": 1},
 				Options: options.Index().SetName("skylink_id"),
 			},
+			{
+				Keys:    bson.M{"api_key_id": 1},
+				Options: options.Index().SetName("api_key_id").SetSparse(true),
+			},
+			{
+				Keys:    bson.D{{"downloader_ip", 1}, {"created_at", -1}},
+				Options: options.Index().SetName("downloader_ip_created_at"),
+			},
+		},
+		collRegistryReads: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"timestamp", -1}},
+				Options: options.Index().SetName("user_id_timestamp"),
+			},
+		},
+		collRegistryWrites: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"timestamp", -1}},
+				Options: options.Index().SetName("user_id_timestamp"),
+			},
 		},
 		collEmails: {
 			{
@@ -51,6 +166,10 @@ var (
 				Keys:    bson.M{"locked_by": 1},
 				Options: options.Index().SetName("locked_by"),
 			},
+			{
+				Keys:    bson.M{"next_attempt_at": 1},
+				Options: options.Index().SetName("next_attempt_at"),
+			},
 			{
 				Keys:    bson.M{"sent_at": 1},
 				Options: options.Index().SetName("sent_at"),
@@ -62,16 +181,20 @@ var (
 		},
 		collChallenges: {
 			{
-				Keys:    bson.M{"challenge": 1},
-				Options: options.Index().SetName("challenge"),
+				Keys:    bson.D{{"challenge", 1}, {"type", 1}},
+				Options: options.Index().SetName("challenge_type"),
 			},
 			{
 				Keys:    bson.M{"type": 1},
 				Options: options.Index().SetName("type"),
 			},
+			{
+				Keys:    bson.D{{"pub_key", 1}, {"type", 1}, {"expires_at", 1}},
+				Options: options.Index().SetName("pub_key_type_expires_at"),
+			},
 			{
 				Keys:    bson.M{"expires_at": 1},
-				Options: options.Index().SetName("expires_at"),
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(int32(expiredChallengeRetention.Seconds())),
 			},
 		},
 		collUnconfirmedUserUpdates: {
@@ -81,7 +204,7 @@ var (
 			},
 			{
 				Keys:    bson.M{"expires_at": 1},
-				Options: options.Index().SetName("expires_at"),
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
 			},
 		},
 		collConfiguration: {
@@ -99,6 +222,256 @@ var (
 				Keys:    bson.M{"user_id": 1},
 				Options: options.Index().SetName("user_id"),
 			},
+			{
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(int32(APIKeyExpiredRetention.Seconds())),
+			},
+		},
+		collChangeEvents: {
+			{
+				Keys:    bson.M{"created_at": 1},
+				Options: options.Index().SetName("created_at_ttl").SetExpireAfterSeconds(int32(ChangeEventsRetention.Seconds())),
+			},
+			{
+				Keys: bson.M{"seq": 1},
+				Options: options.Index().SetName("seq_unique").SetUnique(true).
+					SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}}),
+			},
+		},
+		collSessions: {
+			{
+				Keys:    bson.M{"jti": 1},
+				Options: options.Index().SetName("jti_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"sub": 1},
+				Options: options.Index().SetName("sub"),
+			},
+			{
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			},
+		},
+		collAuditLog: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"created_at", -1}},
+				Options: options.Index().SetName("user_id_created_at"),
+			},
+		},
+		collAnonUsage: {
+			{
+				Keys:    bson.D{{"ip", 1}, {"hour", 1}},
+				Options: options.Index().SetName("ip_hour_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"hour": 1},
+				Options: options.Index().SetName("hour_ttl").SetExpireAfterSeconds(int32(AnonUsageRetention.Seconds())),
+			},
+		},
+		collLocks: {
+			{
+				Keys:    bson.M{"name": 1},
+				Options: options.Index().SetName("name_unique").SetUnique(true),
+			},
+		},
+		collOrganizations: {
+			{
+				Keys:    bson.M{"owner_id": 1},
+				Options: options.Index().SetName("owner_id_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"invites.token": 1},
+				Options: options.Index().SetName("invites_token").SetSparse(true),
+			},
+		},
+		collRecoveryTokens: {
+			{
+				Keys:    bson.M{"token": 1},
+				Options: options.Index().SetName("token_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{"user_id", 1}, {"created_at", -1}},
+				Options: options.Index().SetName("user_id_created_at"),
+			},
+			{
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			},
 		},
 	}
+
+	// obsoleteIndexes lists the indexes we no longer need, by collection.
+	// Most of them are covered by compound indexes in the Schema. The old
+	// `email_unique` index was case-sensitive, `email_unique_ci` replaces it.
+	// The `expires_at` indexes are replaced by TTL indexes on the same keys.
+	obsoleteIndexes = map[string][]string{
+		collUsers:                  {legacyEmailIndexName},
+		collUploads:                {"user_id"},
+		collDownloads:              {"user_id"},
+		collChallenges:             {"challenge", "expires_at"},
+		collUnconfirmedUserUpdates: {"expires_at"},
+	}
 )
+
+type (
+	// indexSpec is the part of an index's specification we compare against
+	// the schema.
+	indexSpec struct {
+		Name      string          `bson:"name"`
+		Keys      bson.Raw        `bson:"key"`
+		Collation *indexCollation `bson:"collation"`
+	}
+	// indexCollation is the part of an index's collation we compare against
+	// the schema.
+	indexCollation struct {
+		Locale   string `bson:"locale"`
+		Strength int    `bson:"strength"`
+	}
+
+	// emailDuplicate is an email which belongs to more than one user when
+	// compared case-insensitively.
+	emailDuplicate struct {
+		Email string               `bson:"_id"`
+		Users []primitive.ObjectID `bson:"users"`
+	}
+
+	// IndexDivergence lists the indexes of a collection which differ from the
+	// ones declared in the Schema. We compare indexes by their keys and
+	// collation, so an index which only differs by name is not a divergence.
+	IndexDivergence struct {
+		Missing []string `json:"missing,omitempty"`
+		Extra   []string `json:"extra,omitempty"`
+	}
+)
+
+// SchemaDivergences returns the collections whose actual indexes differ from
+// the ones declared in the Schema. Missing indexes are listed by their
+// declared name and extra indexes by their actual name.
+func (db *DB) SchemaDivergences(ctx context.Context) (map[string]IndexDivergence, error) {
+	return schemaDivergences(ctx, db.staticDB, Schema)
+}
+
+// schemaDivergences returns the collections whose actual indexes differ from
+// the ones declared in the given schema.
+func schemaDivergences(ctx context.Context, db *mongo.Database, schema map[string][]mongo.IndexModel) (map[string]IndexDivergence, error) {
+	divs := make(map[string]IndexDivergence)
+	for collName, models := range schema {
+		existing, err := existingIndexes(ctx, db.Collection(collName))
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to list indexes of "+collName)
+		}
+		var div IndexDivergence
+		declared := make(map[string]struct{}, len(models))
+		for _, m := range models {
+			keys, err := modelID(m)
+			if err != nil {
+				return nil, err
+			}
+			declared[keys] = struct{}{}
+			if _, exists := existing[keys]; !exists {
+				div.Missing = append(div.Missing, indexName(m, keys))
+			}
+		}
+		for keys, name := range existing {
+			if _, ok := declared[keys]; !ok && name != "_id_" {
+				div.Extra = append(div.Extra, name)
+			}
+		}
+		if len(div.Missing) > 0 || len(div.Extra) > 0 {
+			sort.Strings(div.Missing)
+			sort.Strings(div.Extra)
+			divs[collName] = div
+		}
+	}
+	return divs, nil
+}
+
+// existingIndexes returns the names of the indexes of the given collection,
+// keyed by their keys and collation. A collection which doesn't exist has no
+// indexes.
+func existingIndexes(ctx context.Context, coll *mongo.Collection) (map[string]string, error) {
+	c, err := coll.Indexes().List(ctx)
+	if err != nil && strings.Contains(err.Error(), "NamespaceNotFound") {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var specs []indexSpec
+	err = c.All(ctx, &specs)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		keys, err := indexID(spec.Keys, spec.Collation)
+		if err != nil {
+			return nil, err
+		}
+		indexes[keys] = spec.Name
+	}
+	return indexes, nil
+}
+
+// indexID returns a canonical representation of an index with the given keys
+// and collation. Mongo allows indexes with the same keys as long as their
+// collations differ, so we tell them apart.
+func indexID(keys interface{}, collation *indexCollation) (string, error) {
+	id, err := indexKeys(keys)
+	if err != nil {
+		return "", err
+	}
+	if collation != nil && collation.Locale != "" && collation.Locale != "simple" {
+		id += fmt.Sprintf("_collation_%s_%d", collation.Locale, collation.Strength)
+	}
+	return id, nil
+}
+
+// modelID returns the canonical representation of the given index model.
+func modelID(m mongo.IndexModel) (string, error) {
+	var collation *indexCollation
+	if m.Options != nil && m.Options.Collation != nil {
+		collation = &indexCollation{Locale: m.Options.Collation.Locale, Strength: m.Options.Collation.Strength}
+	}
+	return indexID(m.Keys, collation)
+}
+
+// indexKeys returns a canonical representation of the given index keys, e.g.
+// `user_id_1_timestamp_-1`, which is also the name Mongo gives to unnamed
+// indexes. The keys can be any document type, such as bson.D or bson.Raw.
+func indexKeys(keys interface{}) (string, error) {
+	raw, ok := keys.(bson.Raw)
+	if !ok {
+		b, err := bson.Marshal(keys)
+		if err != nil {
+			return "", errors.AddContext(err, "invalid index keys")
+		}
+		raw = b
+	}
+	elems, err := raw.Elements()
+	if err != nil {
+		return "", errors.AddContext(err, "invalid index keys")
+	}
+	parts := make([]string, 0, 2*len(elems))
+	for _, e := range elems {
+		v := e.Value()
+		// Legacy indexes might declare their direction as a double.
+		if i, ok := v.AsInt64OK(); ok {
+			parts = append(parts, e.Key(), strconv.FormatInt(i, 10))
+		} else if str, ok := v.StringValueOK(); ok {
+			parts = append(parts, e.Key(), str)
+		} else {
+			parts = append(parts, e.Key(), v.String())
+		}
+	}
+	return strings.Join(parts, "_"), nil
+}
+
+// indexName returns the name of the given index model, defaulting to the name
+// Mongo would give it.
+func indexName(m mongo.IndexModel, keys string) string {
+	if m.Options != nil && m.Options.Name != nil {
+		return *m.Options.Name
+	}
+	return keys
+}
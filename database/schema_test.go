@@ -0,0 +1,64 @@
+package database
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestIndexKeys ensures that indexKeys gives the same representation to index
+// keys regardless of the document type and the numeric type of the directions.
+func TestIndexKeys(t *testing.T) {
+	legacy, err := bson.Marshal(bson.D{{"user_id", 1.0}, {"timestamp", int64(-1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		keys interface{}
+		out  string
+	}{
+		{keys: bson.M{"sub": 1}, out: "sub_1"},
+		{keys: bson.D{{"user_id", 1}, {"timestamp", -1}}, out: "user_id_1_timestamp_-1"},
+		{keys: bson.Raw(legacy), out: "user_id_1_timestamp_-1"},
+		{keys: bson.D{{"location", "2dsphere"}}, out: "location_2dsphere"},
+	}
+	for _, tt := range tests {
+		out, err := indexKeys(tt.keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.out {
+			t.Fatalf("Expected '%s', got '%s'", tt.out, out)
+		}
+	}
+	// Index keys need to be a document.
+	_, err = indexKeys("sub")
+	if err == nil {
+		t.Fatal("Expected an error for invalid keys.")
+	}
+}
+
+// TestModelID ensures that modelID tells apart indexes with the same keys but
+// different collations and ignores the simple collation.
+func TestModelID(t *testing.T) {
+	plain, err := modelID(mongo.IndexModel{Keys: bson.M{"email": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err := modelID(mongo.IndexModel{Keys: bson.M{"email": 1}, Options: options.Index().SetCollation(emailCollation)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != "email_1" || ci != "email_1_collation_en_2" {
+		t.Fatalf("Unexpected IDs '%s' and '%s'", plain, ci)
+	}
+	simple, err := indexID(bson.M{"email": 1}, &indexCollation{Locale: "simple"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if simple != plain {
+		t.Fatalf("Expected '%s', got '%s'", plain, simple)
+	}
+}
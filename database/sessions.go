@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+The sessions collection holds a record for each JWT we issue on login, keyed by
+the token's jti. Users can list their sessions and revoke them, which marks the
+record as revoked. Tokens with a revoked jti are rejected by the auth path.
+
+Records are removed by a TTL index once their token expires, since an expired
+token is rejected regardless of its revocation status.
+*/
+
+var (
+	// ErrSessionNotFound is returned when the session in question doesn't
+	// exist, belongs to another user, or has already been revoked.
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+type (
+	// Session describes a single login session, i.e. a single JWT we have
+	// issued to a user.
+	Session struct {
+		ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+		JTI       string             `bson:"jti" json:"jti"`
+		Sub       string             `bson:"sub" json:"-"`
+		CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+		ExpiresAt time.Time          `bson:"expires_at" json:"expiresAt"`
+		UserAgent string             `bson:"user_agent" json:"userAgent"`
+		IP        string             `bson:"ip" json:"ip"`
+		RevokedAt time.Time          `bson:"revoked_at,omitempty" json:"-"`
+	}
+)
+
+// SessionCreate records a new session.
+func (db *DB) SessionCreate(ctx context.Context, s *Session) error {
+	if s.JTI == "" || s.Sub == "" {
+		return errors.New("invalid session")
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	}
+	ior, err := db.staticSessions.InsertOne(ctx, s)
+	if err != nil {
+		return errors.AddContext(err, "failed to insert session")
+	}
+	s.ID = ior.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// SessionsBySub returns all active sessions of the given user, newest first.
+func (db *DB) SessionsBySub(ctx context.Context, sub string) ([]Session, error) {
+	filter := bson.M{
+		"sub":        sub,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+		"revoked_at": bson.M{"$exists": false},
+	}
+	opts := options.Find().SetSort(bson.D{{"created_at", -1}})
+	c, err := db.staticSessions.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find sessions")
+	}
+	sessions := make([]Session, 0)
+	err = c.All(ctx, &sessions)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode sessions")
+	}
+	return sessions, nil
+}
+
+// SessionRevoke revokes the given user's session with the given jti.
+func (db *DB) SessionRevoke(ctx context.Context, sub, jti string) error {
+	filter := bson.M{
+		"sub":        sub,
+		"jti":        jti,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}}
+	ur, err := db.staticSessions.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to revoke session")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// SessionExtend moves the expiration of the given user's active session with
+// the given jti, so its record lives as long as its refreshed token.
+func (db *DB) SessionExtend(ctx context.Context, sub, jti string, expiresAt time.Time) error {
+	filter := bson.M{
+		"sub":        sub,
+		"jti":        jti,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"expires_at": expiresAt.UTC()}}
+	ur, err := db.staticSessions.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to extend session")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// SessionRevokeAll revokes all active sessions of the given user. It returns
+// the jtis of the revoked sessions.
+func (db *DB) SessionRevokeAll(ctx context.Context, sub string) ([]string, error) {
+	sessions, err := db.SessionsBySub(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+	jtis := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		jtis = append(jtis, s.JTI)
+	}
+	filter := bson.M{
+		"sub":        sub,
+		"jti":        bson.M{"$in": jtis},
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}}
+	_, err = db.staticSessions.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to revoke sessions")
+	}
+	return jtis, nil
+}
+
+// SessionRevoked returns true if the session with the given jti has been
+// revoked. Sessions we don't know about are not considered revoked, so tokens
+// issued before we started tracking sessions keep working until they expire.
+func (db *DB) SessionRevoked(ctx context.Context, jti string) (bool, error) {
+	filter := bson.M{
+		"jti":        jti,
+		"revoked_at": bson.M{"$exists": true},
+	}
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	sr := db.staticSessions.FindOne(ctx, filter, opts)
+	if errors.Contains(sr.Err(), mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if sr.Err() != nil {
+		return false, sr.Err()
+	}
+	return true, nil
+}
@@ -3,11 +3,13 @@ package database
 import (
 	"context"
 	"regexp"
+	"time"
 
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -26,23 +28,33 @@ type Skylink struct {
 	ID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
 	Skylink string             `bson:"skylink" json:"skylink"`
 	Size    int64              `bson:"size" json:"size"`
+	// Blocked is set by portal operators on skylinks reported for abuse. We
+	// refuse to track uploads and downloads of blocked skylinks.
+	Blocked   bool      `bson:"blocked,omitempty" json:"blocked"`
+	BlockedAt time.Time `bson:"blocked_at,omitempty" json:"blockedAt,omitempty"`
+	// MetaAttempts is the number of failed attempts to fetch the skylink's
+	// metadata. MetaNextAttempt is the earliest time at which we'll try again.
+	MetaAttempts    int       `bson:"meta_attempts,omitempty" json:"-"`
+	MetaNextAttempt time.Time `bson:"meta_next_attempt,omitempty" json:"-"`
+	// SizeResolvedAt is the time at which we learned the skylink's size.
+	SizeResolvedAt time.Time `bson:"size_resolved_at,omitempty" json:"sizeResolvedAt,omitempty"`
+}
+
+// SkylinkPurgeResult describes what we removed when purging a skylink.
+type SkylinkPurgeResult struct {
+	Skylink   string               `json:"skylink"`
+	Uploads   int64                `json:"uploads"`
+	Downloads int64                `json:"downloads"`
+	Users     []primitive.ObjectID `json:"-"`
 }
 
 // Skylink gets the DB object for the given skylink.
 // If it doesn't exist it creates it.
 func (db *DB) Skylink(ctx context.Context, skylink string) (*Skylink, error) {
-	skylinkStr, err := ExtractSkylink(skylink)
-	if err != nil {
-		return nil, ErrInvalidSkylink
-	}
-	// Normalise the skylink. We want skylinks to appear in the same format in
-	// the DB, regardless of them being passed as base32 or base64.
-	var sl skymodules.Skylink
-	err = sl.LoadString(skylinkStr)
+	skylinkStr, err := NormalizeSkylink(skylink)
 	if err != nil {
-		return nil, ErrInvalidSkylink
+		return nil, err
 	}
-	skylinkStr = sl.String()
 	// Provisional skylink object.
 	skylinkRec := Skylink{
 		Skylink: skylinkStr,
@@ -59,6 +71,22 @@ func (db *DB) Skylink(ctx context.Context, skylink string) (*Skylink, error) {
 	return &skylinkRec, nil
 }
 
+// SkylinkFind gets the DB object for the given skylink. Unlike Skylink it
+// doesn't create it, so it returns mongo.ErrNoDocuments for skylinks we don't
+// know, e.g. because they were purged.
+func (db *DB) SkylinkFind(ctx context.Context, skylink string) (*Skylink, error) {
+	skylinkStr, err := NormalizeSkylink(skylink)
+	if err != nil {
+		return nil, err
+	}
+	var sl Skylink
+	err = db.staticSkylinks.FindOne(ctx, bson.M{"skylink": skylinkStr}).Decode(&sl)
+	if err != nil {
+		return nil, err
+	}
+	return &sl, nil
+}
+
 // SkylinkByID finds a skylink by its ID.
 func (db *DB) SkylinkByID(ctx context.Context, id primitive.ObjectID) (*Skylink, error) {
 	sr := db.staticSkylinks.FindOne(ctx, bson.M{"_id": id})
@@ -71,7 +99,8 @@ func (db *DB) SkylinkByID(ctx context.Context, id primitive.ObjectID) (*Skylink,
 }
 
 // SkylinkUpdate updates the metadata about the given skylink. If any of the
-// parameters is empty they won't be used in the update operation.
+// parameters is empty they won't be used in the update operation. Setting the
+// size also records when we learned it.
 func (db *DB) SkylinkUpdate(ctx context.Context, id primitive.ObjectID, name string, size int64) error {
 	filter := bson.M{"_id": id}
 	updates := bson.M{}
@@ -80,6 +109,7 @@ func (db *DB) SkylinkUpdate(ctx context.Context, id primitive.ObjectID, name str
 	}
 	if size > 0 {
 		updates["size"] = size
+		updates["size_resolved_at"] = time.Now().UTC()
 	}
 	_, err := db.staticSkylinks.UpdateOne(ctx, filter, bson.M{"$set": updates})
 	if err != nil {
@@ -88,6 +118,236 @@ func (db *DB) SkylinkUpdate(ctx context.Context, id primitive.ObjectID, name str
 	return nil
 }
 
+// SkylinkBlock marks the given skylink as blocked. It creates the skylink if
+// it doesn't exist yet, so operators can block skylinks before anyone tracks
+// them. Blocking an already blocked skylink keeps its original block time.
+func (db *DB) SkylinkBlock(ctx context.Context, skylink string) (*Skylink, error) {
+	skylinkStr, err := NormalizeSkylink(skylink)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"skylink": skylinkStr}
+	update := bson.M{
+		"$set":         bson.M{"blocked": true},
+		"$setOnInsert": bson.M{"skylink": skylinkStr},
+		"$min":         bson.M{"blocked_at": time.Now().UTC().Truncate(time.Millisecond)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var sl Skylink
+	err = db.staticSkylinks.FindOneAndUpdate(ctx, filter, update, opts).Decode(&sl)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to block skylink")
+	}
+	return &sl, nil
+}
+
+// SkylinkPurge removes all uploads and downloads of the given skylink and
+// resets the metadata we hold about it. It does that in a single transaction,
+// so we either purge all of them or none. The skylink document itself stays, so
+// a blocked skylink remains blocked. It returns the number of removed records
+// and the IDs of the users who uploaded or downloaded the skylink.
+func (db *DB) SkylinkPurge(ctx context.Context, skylink string) (*SkylinkPurgeResult, error) {
+	skylinkStr, err := NormalizeSkylink(skylink)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := db.NewSession()
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to start a new mongo session")
+	}
+	defer sess.EndSession(ctx)
+	res, err := sess.WithTransaction(ctx, func(sctx mongo.SessionContext) (interface{}, error) {
+		var sl Skylink
+		err := db.staticSkylinks.FindOne(sctx, bson.M{"skylink": skylinkStr}).Decode(&sl)
+		if err != nil {
+			return nil, err
+		}
+		filter := bson.M{"skylink_id": sl.ID}
+		// Anonymous uploads and downloads don't have a user_id, so Distinct
+		// skips them.
+		var users []interface{}
+		for _, coll := range []*mongo.Collection{db.staticUploads, db.staticDownloads} {
+			ids, err := coll.Distinct(sctx, "user_id", filter)
+			if err != nil {
+				return nil, errors.AddContext(err, "failed to fetch affected users")
+			}
+			users = append(users, ids...)
+		}
+		ups, err := db.staticUploads.DeleteMany(sctx, filter)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to delete uploads")
+		}
+		downs, err := db.staticDownloads.DeleteMany(sctx, filter)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to delete downloads")
+		}
+		update := bson.M{
+			"$set":   bson.M{"size": 0},
+			"$unset": bson.M{"name": "", "size_resolved_at": "", "meta_attempts": "", "meta_next_attempt": ""},
+		}
+		_, err = db.staticSkylinks.UpdateOne(sctx, bson.M{"_id": sl.ID}, update)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to reset skylink")
+		}
+		result := &SkylinkPurgeResult{
+			Skylink:   skylinkStr,
+			Uploads:   ups.DeletedCount,
+			Downloads: downs.DeletedCount,
+		}
+		seen := make(map[primitive.ObjectID]struct{})
+		for _, id := range users {
+			uID, ok := id.(primitive.ObjectID)
+			if !ok || uID.IsZero() {
+				continue
+			}
+			if _, exists := seen[uID]; exists {
+				continue
+			}
+			seen[uID] = struct{}{}
+			result.Users = append(result.Users, uID)
+		}
+		return result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*SkylinkPurgeResult), nil
+}
+
+// SkylinkUnblock removes the block from the given skylink. Unblocking a
+// skylink which isn't blocked is a no-op.
+func (db *DB) SkylinkUnblock(ctx context.Context, skylink string) error {
+	skylinkStr, err := NormalizeSkylink(skylink)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"skylink": skylinkStr}
+	update := bson.M{"$unset": bson.M{"blocked": "", "blocked_at": ""}}
+	_, err = db.staticSkylinks.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to unblock skylink")
+	}
+	return nil
+}
+
+// SkylinkBlocked reports whether the given skylink is blocked. Unknown and
+// invalid skylinks are not blocked.
+func (db *DB) SkylinkBlocked(ctx context.Context, skylink string) (bool, error) {
+	skylinkStr, err := NormalizeSkylink(skylink)
+	if err != nil {
+		return false, nil
+	}
+	filter := bson.M{"skylink": skylinkStr, "blocked": true}
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	err = db.staticSkylinks.FindOne(ctx, filter, opts).Err()
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SkylinksBlockedAmong returns the blocked skylinks among the given ones, in
+// their normalized form. It needs a single query, regardless of the number of
+// skylinks. Invalid skylinks are not blocked.
+func (db *DB) SkylinksBlockedAmong(ctx context.Context, skylinks []string) (map[string]struct{}, error) {
+	blocked := make(map[string]struct{})
+	normalized := make([]string, 0, len(skylinks))
+	for _, skylink := range skylinks {
+		if sl, err := NormalizeSkylink(skylink); err == nil {
+			normalized = append(normalized, sl)
+		}
+	}
+	if len(normalized) == 0 {
+		return blocked, nil
+	}
+	filter := bson.M{"skylink": bson.M{"$in": normalized}, "blocked": true}
+	opts := options.Find().SetProjection(bson.M{"skylink": 1})
+	c, err := db.staticSkylinks.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var sls []Skylink
+	err = c.All(ctx, &sls)
+	if err != nil {
+		return nil, err
+	}
+	for _, sl := range sls {
+		blocked[sl.Skylink] = struct{}{}
+	}
+	return blocked, nil
+}
+
+// SkylinksBlocked returns a page of blocked skylinks, most recently blocked
+// first. It also reports the total number of blocked skylinks.
+func (db *DB) SkylinksBlocked(ctx context.Context, offset, pageSize int) ([]Skylink, int64, error) {
+	if err := validateOffsetPageSize(offset, pageSize); err != nil {
+		return nil, 0, err
+	}
+	filter := bson.D{{"blocked", true}}
+	cnt, err := db.count(ctx, db.staticSkylinks, bson.D{{"$match", filter}})
+	if err != nil || cnt == 0 {
+		return []Skylink{}, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"blocked_at", -1}, {"_id", -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(pageSize))
+	c, err := db.staticSkylinks.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	sls := make([]Skylink, 0, pageSize)
+	err = c.All(ctx, &sls)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sls, cnt, nil
+}
+
+// SkylinksMissingSize returns up to limit skylinks whose size we don't know
+// yet, which were created before the given time and which are due for another
+// attempt to fetch their metadata. The ones due the longest come first.
+func (db *DB) SkylinksMissingSize(ctx context.Context, createdBefore time.Time, limit int) ([]Skylink, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":               bson.M{"$lt": primitive.NewObjectIDFromTimestamp(createdBefore)},
+		"size":              bson.M{"$in": bson.A{0, nil}},
+		"blocked":           bson.M{"$ne": true},
+		"meta_next_attempt": bson.M{"$not": bson.M{"$gt": now}},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"meta_next_attempt", 1}, {"_id", 1}}).
+		SetLimit(int64(limit))
+	c, err := db.staticSkylinks.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find skylinks")
+	}
+	sls := make([]Skylink, 0, limit)
+	err = c.All(ctx, &sls)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode skylinks")
+	}
+	return sls, nil
+}
+
+// SkylinkMetaFetchFailed records a failed attempt to fetch the metadata of the
+// given skylink and schedules the next attempt for the given time.
+func (db *DB) SkylinkMetaFetchFailed(ctx context.Context, id primitive.ObjectID, nextAttempt time.Time) error {
+	filter := bson.M{"_id": id}
+	update := bson.M{
+		"$inc": bson.M{"meta_attempts": 1},
+		"$set": bson.M{"meta_next_attempt": nextAttempt.UTC().Truncate(time.Millisecond)},
+	}
+	_, err := db.staticSkylinks.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	return nil
+}
+
 // SkylinkDownloadsUpdate changes the size of the full downloads of this
 // skylink. Those should have zero `bytes` in the DB. This method should be
 // called from the fetcher.
@@ -115,6 +375,23 @@ func ExtractSkylink(skylink string) (string, error) {
 	return m[2], nil
 }
 
+// NormalizeSkylink extracts the skylink from the given string and returns it
+// in the format in which we store it in the DB. We want skylinks to appear in
+// the same format in the DB, regardless of them being passed as base32 or
+// base64.
+func NormalizeSkylink(skylink string) (string, error) {
+	skylinkStr, err := ExtractSkylink(skylink)
+	if err != nil {
+		return "", ErrInvalidSkylink
+	}
+	var sl skymodules.Skylink
+	err = sl.LoadString(skylinkStr)
+	if err != nil {
+		return "", ErrInvalidSkylink
+	}
+	return sl.String(), nil
+}
+
 // ValidSkylink returns true if the given string is a valid skylink.
 func ValidSkylink(skylink string) bool {
 	var sl skymodules.Skylink
@@ -139,3 +139,28 @@ func TestValidSkylink(t *testing.T) {
 		}
 	}
 }
+
+// TestNormalizeSkylink ensures that NormalizeSkylink returns the same skylink
+// regardless of its encoding.
+func TestNormalizeSkylink(t *testing.T) {
+	b32 := "vg7f80v8jf7fr5l2sudtnsnemhccpasppfqrd9ger89cb1tas9r317g"
+	b64, err := NormalizeSkylink(b32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b64 == b32 || !ValidSkylink(b64) {
+		t.Fatalf("Expected a valid base64 skylink, got '%s'", b64)
+	}
+	// Normalising should be idempotent.
+	n, err := NormalizeSkylink("https://siasky.net/" + b64 + "/some/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != b64 {
+		t.Fatalf("Expected '%s', got '%s'", b64, n)
+	}
+	_, err = NormalizeSkylink("not a skylink")
+	if err != ErrInvalidSkylink {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidSkylink, err)
+	}
+}
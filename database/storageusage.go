@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// storageReservationTimeout defines how long a reservation can stay in
+	// flight before we consider it abandoned, e.g. because the instance which
+	// made it crashed, and reconcile the counter anyway.
+	storageReservationTimeout = time.Minute
+)
+
+var (
+	// ErrStorageQuotaExceeded is returned when tracking an upload would take
+	// the user's storage past their quota.
+	ErrStorageQuotaExceeded = errors.New("this upload would exceed your storage quota")
+)
+
+// StorageUsage is a running counter of the storage used by a user, or by an
+// organization and its members. Unlike UserStatsUpload it's cheap to read, so
+// we can check it before we track each upload. We increment it with each
+// upload and decrement it with each unpin. It doesn't account for duplicate
+// skylinks and for uploads whose size we learn later, so we reconcile it with
+// the full stats each time we recheck the user's quota.
+//
+// Pending is the number of uploads which have reserved storage but haven't
+// been tracked yet, ReservedAt is the time of the latest reservation. Seq
+// changes with each update which isn't a reconciliation, so reconciliations
+// can detect concurrent changes.
+type StorageUsage struct {
+	ID           primitive.ObjectID `bson:"_id"`
+	Storage      int64              `bson:"storage"`
+	Pending      int64              `bson:"pending"`
+	Seq          int64              `bson:"seq"`
+	ReservedAt   time.Time          `bson:"reserved_at,omitempty"`
+	ReconciledAt time.Time          `bson:"reconciled_at,omitempty"`
+}
+
+// StorageUsageByUser returns the storage usage counter which covers the given
+// user. Users without a counter get a zero one.
+func (db *DB) StorageUsageByUser(ctx context.Context, u User) (StorageUsage, error) {
+	id := storageUsageID(u)
+	var su StorageUsage
+	err := db.staticStorageUsage.FindOne(ctx, bson.M{"_id": id}).Decode(&su)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return StorageUsage{ID: id}, nil
+	}
+	if err != nil {
+		return StorageUsage{}, errors.AddContext(err, "failed to fetch storage usage")
+	}
+	return su, nil
+}
+
+// StorageReserve reserves the given number of bytes on the user's storage
+// usage counter unless that would take it past the given limit, in which case
+// it fails with ErrStorageQuotaExceeded. The check and the increment happen
+// atomically, so concurrent uploads can't overshoot the limit. Each successful
+// reservation needs to be followed by a call to StorageReservationDone.
+func (db *DB) StorageReserve(ctx context.Context, u User, size, limit int64) error {
+	if size > limit {
+		return ErrStorageQuotaExceeded
+	}
+	filter := bson.M{
+		"_id":     storageUsageID(u),
+		"storage": bson.M{"$lte": limit - size},
+	}
+	update := bson.M{
+		"$inc": bson.M{"storage": size, "pending": 1, "seq": 1},
+		"$set": bson.M{"reserved_at": time.Now().UTC().Truncate(time.Millisecond)},
+	}
+	_, err := db.staticStorageUsage.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The counter exists but it's too close to the limit, so we tried to
+		// insert a new one.
+		return ErrStorageQuotaExceeded
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to reserve storage")
+	}
+	return nil
+}
+
+// StorageReservationDone completes a reservation made with StorageReserve. If
+// we didn't track the upload after all, e.g. because it was a duplicate, we
+// release the reserved bytes.
+func (db *DB) StorageReservationDone(ctx context.Context, u User, size int64, tracked bool) error {
+	inc := bson.M{"pending": -1}
+	if !tracked {
+		inc["storage"] = -size
+		inc["seq"] = 1
+	}
+	_, err := db.staticStorageUsage.UpdateOne(ctx, bson.M{"_id": storageUsageID(u)}, bson.M{"$inc": inc})
+	if err != nil {
+		return errors.AddContext(err, "failed to complete storage reservation")
+	}
+	return nil
+}
+
+// StorageUsageAdd adds the given number of bytes to the user's storage usage
+// counter. We use it with negative values when the user unpins uploads.
+func (db *DB) StorageUsageAdd(ctx context.Context, u User, size int64) error {
+	update := bson.M{"$inc": bson.M{"storage": size, "seq": 1}}
+	_, err := db.staticStorageUsage.UpdateOne(ctx, bson.M{"_id": storageUsageID(u)}, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update storage usage")
+	}
+	return nil
+}
+
+// StorageUsageReconcile sets the storage usage counter to the given value,
+// which we computed from the full upload stats after reading the given
+// snapshot of the counter. We skip the update if there were reservations in
+// flight when we took the snapshot or if the counter has changed since,
+// because the stats might not reflect those changes. The next reconciliation
+// catches up. Reservations which have been in flight for longer than
+// storageReservationTimeout are considered abandoned and reset. It returns
+// whether it updated the counter.
+func (db *DB) StorageUsageReconcile(ctx context.Context, snapshot StorageUsage, storage int64) (bool, error) {
+	if snapshot.Pending > 0 && time.Since(snapshot.ReservedAt) < storageReservationTimeout {
+		return false, nil
+	}
+	filter := bson.M{
+		"_id":     snapshot.ID,
+		"seq":     snapshot.Seq,
+		"pending": snapshot.Pending,
+	}
+	update := bson.M{"$set": bson.M{
+		"storage":       storage,
+		"pending":       0,
+		"reconciled_at": time.Now().UTC().Truncate(time.Millisecond),
+	}}
+	ur, err := db.staticStorageUsage.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The counter has changed since the snapshot.
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.AddContext(err, "failed to reconcile storage usage")
+	}
+	return ur.ModifiedCount > 0 || ur.UpsertedCount > 0, nil
+}
+
+// storageUsageID returns the ID of the storage usage counter which covers the
+// given user. Members of an organization share the organization's counter, in
+// line with its pooled quota.
+func storageUsageID(u User) primitive.ObjectID {
+	if u.InOrg() {
+		return u.OrgID
+	}
+	return u.ID
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// TierLimitsRefreshInterval defines how often we reload the tier limits
+	// overrides from the database.
+	TierLimitsRefreshInterval = 5 * time.Minute
+
+	// ErrInvalidTierLimits is returned when a tier limits override contains
+	// invalid values.
+	ErrInvalidTierLimits = errors.New("invalid tier limits")
+
+	// tierLimits holds the current limits of all tiers, i.e. the compiled-in
+	// UserLimits with any overrides from the database applied on top.
+	tierLimits   = copyTierLimits(UserLimits)
+	tierLimitsMu sync.RWMutex
+)
+
+type (
+	// TierLimitsOverride describes the values by which a tier's limits differ
+	// from the compiled-in defaults. Only the fields which are set override
+	// the defaults.
+	TierLimitsOverride struct {
+		TierName          *string `json:"tierName,omitempty"`
+		UploadBandwidth   *int    `json:"upload,omitempty"`        // bytes per second
+		DownloadBandwidth *int    `json:"download,omitempty"`      // bytes per second
+		MaxUploadSize     *int64  `json:"maxUploadSize,omitempty"` // bytes
+		MaxNumberUploads  *int    `json:"maxNumberUploads,omitempty"`
+		RegistryDelay     *int    `json:"registry,omitempty"` // ms delay
+		Storage           *int64  `json:"storage,omitempty"`  // bytes
+	}
+)
+
+// LimitsForTier returns the current limits of the given tier. These are the
+// compiled-in UserLimits, unless they have been overridden in the database.
+func LimitsForTier(tier int) TierLimits {
+	tierLimitsMu.RLock()
+	defer tierLimitsMu.RUnlock()
+	return tierLimits[tier]
+}
+
+// Apply returns a copy of the given limits with the override applied.
+func (o TierLimitsOverride) Apply(t TierLimits) TierLimits {
+	if o.TierName != nil {
+		t.TierName = *o.TierName
+	}
+	if o.UploadBandwidth != nil {
+		t.UploadBandwidth = *o.UploadBandwidth
+	}
+	if o.DownloadBandwidth != nil {
+		t.DownloadBandwidth = *o.DownloadBandwidth
+	}
+	if o.MaxUploadSize != nil {
+		t.MaxUploadSize = *o.MaxUploadSize
+	}
+	if o.MaxNumberUploads != nil {
+		t.MaxNumberUploads = *o.MaxNumberUploads
+	}
+	if o.RegistryDelay != nil {
+		t.RegistryDelay = *o.RegistryDelay
+	}
+	if o.Storage != nil {
+		t.Storage = *o.Storage
+	}
+	return t
+}
+
+// Validate ensures that the override doesn't contain any invalid values.
+func (o TierLimitsOverride) Validate() error {
+	if o.TierName != nil && strings.TrimSpace(*o.TierName) == "" {
+		return errors.AddContext(ErrInvalidTierLimits, "tier name cannot be empty")
+	}
+	ints := map[string]*int{
+		"upload":           o.UploadBandwidth,
+		"download":         o.DownloadBandwidth,
+		"maxNumberUploads": o.MaxNumberUploads,
+		"registry":         o.RegistryDelay,
+	}
+	for name, v := range ints {
+		if v != nil && *v < 0 {
+			return errors.AddContext(ErrInvalidTierLimits, name+" cannot be negative")
+		}
+	}
+	if o.MaxUploadSize != nil && *o.MaxUploadSize < 0 {
+		return errors.AddContext(ErrInvalidTierLimits, "maxUploadSize cannot be negative")
+	}
+	if o.Storage != nil && *o.Storage < 0 {
+		return errors.AddContext(ErrInvalidTierLimits, "storage cannot be negative")
+	}
+	return nil
+}
+
+// TierLimitsOverrideSet stores the given override for the given tier. It
+// replaces any previous override of that tier, so an empty override restores
+// the compiled-in defaults. The change takes effect on the next refresh.
+func (db *DB) TierLimitsOverrideSet(ctx context.Context, tier int, o TierLimitsOverride) error {
+	if tier < TierAnonymous || tier >= TierMaxReserved {
+		return fmt.Errorf("invalid tier %d", tier)
+	}
+	err := o.Validate()
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(o)
+	if err != nil {
+		return errors.AddContext(err, "failed to serialise tier limits override")
+	}
+	return db.WriteConfigValue(ctx, ConfValTierLimitsPrefix+strconv.Itoa(tier), string(val))
+}
+
+// RefreshTierLimits reloads the tier limits overrides from the database and
+// makes them available via LimitsForTier.
+func (db *DB) RefreshTierLimits(ctx context.Context) error {
+	filter := bson.M{"key": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(ConfValTierLimitsPrefix)}}
+	c, err := db.staticConfiguration.Find(ctx, filter)
+	if err != nil {
+		return errors.AddContext(err, "failed to read tier limits overrides")
+	}
+	var confVals []ConfVal
+	err = c.All(ctx, &confVals)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode tier limits overrides")
+	}
+	limits := copyTierLimits(UserLimits)
+	for _, cv := range confVals {
+		tier, err := strconv.Atoi(strings.TrimPrefix(cv.Key, ConfValTierLimitsPrefix))
+		if err != nil || tier < TierAnonymous || tier >= TierMaxReserved {
+			db.staticLogger.Warnf("Ignoring tier limits override with invalid key '%s'.", cv.Key)
+			continue
+		}
+		var o TierLimitsOverride
+		err = json.Unmarshal([]byte(cv.Value), &o)
+		if err == nil {
+			err = o.Validate()
+		}
+		if err != nil {
+			db.staticLogger.Warnf("Ignoring invalid tier limits override for tier %d: %s", tier, err)
+			continue
+		}
+		limits[tier] = o.Apply(limits[tier])
+	}
+	tierLimitsMu.Lock()
+	tierLimits = limits
+	tierLimitsMu.Unlock()
+	return nil
+}
+
+// StartTierLimitsRefresher loads the tier limits overrides from the database
+// and keeps reloading them every TierLimitsRefreshInterval until the context
+// is cancelled.
+func (db *DB) StartTierLimitsRefresher(ctx context.Context) error {
+	err := db.RefreshTierLimits(ctx)
+	if err != nil {
+		return err
+	}
+	go db.threadedRefreshTierLimits(ctx)
+	return nil
+}
+
+// threadedRefreshTierLimits periodically reloads the tier limits overrides.
+func (db *DB) threadedRefreshTierLimits(ctx context.Context) {
+	ticker := time.NewTicker(TierLimitsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := db.RefreshTierLimits(ctx)
+		if err != nil {
+			db.staticLogger.Warnln("Failed to refresh tier limits:", err)
+		}
+	}
+}
+
+// copyTierLimits returns a shallow copy of the given tier limits map.
+func copyTierLimits(limits map[int]TierLimits) map[int]TierLimits {
+	c := make(map[int]TierLimits, len(limits))
+	for k, v := range limits {
+		c[k] = v
+	}
+	return c
+}
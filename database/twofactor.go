@@ -0,0 +1,184 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// TwoFactorRecoveryCodeCount is the number of recovery codes we generate
+	// when the user enables 2FA.
+	TwoFactorRecoveryCodeCount = 10
+)
+
+var (
+	// ErrTwoFactorEnabled is returned when the user tries to set up 2FA while
+	// they already have it enabled.
+	ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrTwoFactorNotEnabled is returned when the user tries to use 2FA
+	// without having it enabled.
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrTwoFactorNotSetUp is returned when the user tries to enable 2FA
+	// without setting it up first.
+	ErrTwoFactorNotSetUp = errors.New("two-factor authentication is not set up")
+	// ErrTwoFactorCodeUsed is returned when the user provides a TOTP code
+	// which has already been used.
+	ErrTwoFactorCodeUsed = errors.New("this code has already been used")
+	// ErrInvalidRecoveryCode is returned when the given recovery code doesn't
+	// match any of the user's unused recovery codes.
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+)
+
+// UserTwoFactorSetSecret stores the given encrypted TOTP secret on the user,
+// replacing any previous one. It doesn't enable 2FA, the user needs to confirm
+// they can generate valid codes first.
+func (db *DB) UserTwoFactorSetSecret(ctx context.Context, u *User, secret string) error {
+	filter := bson.M{
+		"_id":                u.ID,
+		"two_factor_enabled": bson.M{"$ne": true},
+	}
+	update := bson.M{"$set": bson.M{"two_factor_secret": secret}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrTwoFactorEnabled
+	}
+	u.TwoFactorSecret = secret
+	u.Version++
+	return nil
+}
+
+// UserTwoFactorEnable enables 2FA for the user, records the given TOTP step as
+// used and generates a new set of recovery codes. It returns the recovery
+// codes, which we only store hashed, so the user needs to save them now.
+func (db *DB) UserTwoFactorEnable(ctx context.Context, u *User, step int64) ([]string, error) {
+	if u.TwoFactorSecret == "" {
+		return nil, ErrTwoFactorNotSetUp
+	}
+	codes := make([]string, TwoFactorRecoveryCodeCount)
+	hashes := make([]string, TwoFactorRecoveryCodeCount)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	// Make sure the secret hasn't changed since the user generated the code.
+	filter := bson.M{
+		"_id":                u.ID,
+		"two_factor_enabled": bson.M{"$ne": true},
+		"two_factor_secret":  u.TwoFactorSecret,
+	}
+	update := bson.M{"$set": bson.M{
+		"two_factor_enabled":        true,
+		"two_factor_last_step":      step,
+		"two_factor_recovery_codes": hashes,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return nil, ErrTwoFactorNotSetUp
+	}
+	u.TwoFactorEnabled = true
+	u.TwoFactorLastStep = step
+	u.TwoFactorRecoveryCodes = hashes
+	u.Version++
+	return codes, nil
+}
+
+// UserTwoFactorDisable disables 2FA for the user and removes their TOTP
+// secret and recovery codes.
+func (db *DB) UserTwoFactorDisable(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{
+		"two_factor_enabled":        "",
+		"two_factor_secret":         "",
+		"two_factor_last_step":      "",
+		"two_factor_recovery_codes": "",
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.TwoFactorEnabled = false
+	u.TwoFactorSecret = ""
+	u.TwoFactorLastStep = 0
+	u.TwoFactorRecoveryCodes = nil
+	u.Version++
+	return nil
+}
+
+// UserTwoFactorUseStep records the given TOTP step as used. It fails with
+// ErrTwoFactorCodeUsed if the user has already used a code from this step or
+// a later one, which prevents replaying intercepted codes.
+func (db *DB) UserTwoFactorUseStep(ctx context.Context, u *User, step int64) error {
+	filter := bson.M{
+		"_id":                  u.ID,
+		"two_factor_last_step": bson.M{"$not": bson.M{"$gte": step}},
+	}
+	update := bson.M{"$set": bson.M{"two_factor_last_step": step}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrTwoFactorCodeUsed
+	}
+	u.TwoFactorLastStep = step
+	u.Version++
+	return nil
+}
+
+// UserTwoFactorUseRecoveryCode removes the given recovery code from the user's
+// unused recovery codes. It fails with ErrInvalidRecoveryCode if the code
+// doesn't match any of them.
+func (db *DB) UserTwoFactorUseRecoveryCode(ctx context.Context, u *User, code string) error {
+	h := hashRecoveryCode(code)
+	filter := bson.M{
+		"_id":                       u.ID,
+		"two_factor_recovery_codes": h,
+	}
+	update := bson.M{"$pull": bson.M{"two_factor_recovery_codes": h}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrInvalidRecoveryCode
+	}
+	for i, rc := range u.TwoFactorRecoveryCodes {
+		if rc == h {
+			u.TwoFactorRecoveryCodes = append(u.TwoFactorRecoveryCodes[:i], u.TwoFactorRecoveryCodes[i+1:]...)
+			break
+		}
+	}
+	u.Version++
+	return nil
+}
+
+// newRecoveryCode generates a random recovery code in the form of two groups
+// of five hex characters, e.g. `1a2b3-c4d5e`.
+func newRecoveryCode() string {
+	s := hex.EncodeToString(fastrand.Bytes(5))
+	return s[:5] + "-" + s[5:]
+}
+
+// hashRecoveryCode returns the hash under which we store the given recovery
+// code. Recovery codes are random, so a plain hash is enough to protect them.
+// We ignore case, whitespace and dashes, so users can type the codes loosely.
+func hashRecoveryCode(code string) string {
+	c := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	h := sha256.Sum256([]byte(c))
+	return hex.EncodeToString(h[:])
+}
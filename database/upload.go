@@ -2,18 +2,75 @@ package database
 
 import (
 	"context"
+	"regexp"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
 	// ErrInvalidTimePeriod is returned when the user provides an invalid time
 	// period, i.e. the start is after the end.
 	ErrInvalidTimePeriod = errors.New("invalid time period")
+	// ErrInvalidSizeRange is returned when the user provides an invalid size
+	// range, i.e. a negative size or a minimum above the maximum.
+	ErrInvalidSizeRange = errors.New("invalid size range")
+	// ErrInvalidSortField is returned when the user asks us to sort by a
+	// field we don't support.
+	ErrInvalidSortField = errors.New("invalid sort field")
+	// ErrInvalidSortDirection is returned when the user provides a sort
+	// direction other than SortDirectionAsc or SortDirectionDesc.
+	ErrInvalidSortDirection = errors.New("invalid sort direction")
+
+	// DefaultUploadsSort sorts uploads from newest to oldest.
+	DefaultUploadsSort = UploadsSort{Field: UploadsOrderByTimestamp}
+)
+
+const (
+	// UploadsOrderBySize sorts uploads by the size of the uploaded file.
+	UploadsOrderBySize = "size"
+	// UploadsOrderByTimestamp sorts uploads by the time of upload.
+	UploadsOrderByTimestamp = "timestamp"
+	// UploadsOrderByName sorts uploads by the name of the uploaded file.
+	UploadsOrderByName = "name"
+
+	// SortDirectionAsc sorts in ascending order.
+	SortDirectionAsc = "asc"
+	// SortDirectionDesc sorts in descending order.
+	SortDirectionDesc = "desc"
+
+	// UnknownCountry is the country code of uploads whose country we
+	// couldn't determine.
+	UnknownCountry = "--"
+)
+
+var (
+	// ErrDuplicateUpload is returned when we detect that an upload has
+	// already been tracked, e.g. because the caller retried the request.
+	ErrDuplicateUpload = errors.New("upload already tracked")
+
+	// UploadRequestIDWindow is the time window during which we consider an
+	// upload with the same request ID as a previous one by the same user to be
+	// a duplicate. This value is configurable via the
+	// ACCOUNTS_UPLOAD_REQUEST_ID_WINDOW_HOURS environment variable.
+	UploadRequestIDWindow = 24 * time.Hour
+	// UploadSkylinkDedupWindow is the time window during which we consider an
+	// upload of the same skylink by the same user to be a duplicate, if the
+	// upload doesn't carry a request ID. We disable it during testing, so
+	// tests can create separate upload records without waiting.
+	UploadSkylinkDedupWindow = build.Select(
+		build.Var{
+			Dev:      5 * time.Second,
+			Testing:  time.Duration(0),
+			Standard: 5 * time.Second,
+		},
+	).(time.Duration)
 )
 
 // Upload ...
@@ -24,6 +81,123 @@ type Upload struct {
 	SkylinkID  primitive.ObjectID `bson:"skylink_id,omitempty" json:"skylinkId"`
 	Timestamp  time.Time          `bson:"timestamp" json:"timestamp"`
 	Unpinned   bool               `bson:"unpinned" json:"-"`
+	// UnpinnedAt is the time at which the user unpinned the upload. It's
+	// only set while the upload is unpinned.
+	UnpinnedAt *time.Time `bson:"unpinned_at,omitempty" json:"-"`
+	// APIKeyID is the ID of the API key used to authenticate the upload, if
+	// any.
+	APIKeyID primitive.ObjectID `bson:"api_key_id,omitempty" json:"-"`
+	// RequestID is the caller-supplied ID of the request which tracked this
+	// upload. We use it for detecting retried requests.
+	RequestID string `bson:"request_id,omitempty" json:"-"`
+	// DedupBucket is the UploadSkylinkDedupWindow-sized time slot the upload
+	// falls in. The unique index on (user_id, skylink_id, dedup_bucket) keeps
+	// concurrent duplicates from both being tracked. It's only set on the
+	// uploads we deduplicate by skylink.
+	DedupBucket int64 `bson:"dedup_bucket,omitempty" json:"-"`
+	// Country is the ISO code of the country the upload came from, or
+	// UnknownCountry if we couldn't tell. It's set asynchronously after the
+	// upload is tracked, so it might be missing on recent uploads.
+	Country string `bson:"country,omitempty" json:"-"`
+}
+
+// UploadsFilter narrows down a list of uploads. Zero values don't filter.
+type UploadsFilter struct {
+	// Name matches uploads whose name contains the given string, ignoring
+	// case.
+	Name string
+	From time.Time
+	To   time.Time
+	// MinSize and MaxSize are pointers, so we can tell a size of zero from
+	// a missing bound.
+	MinSize *int64
+	MaxSize *int64
+	// IncludeUnpinned makes UploadsByUser include the uploads the user has
+	// unpinned. The exports always include them.
+	IncludeUnpinned bool
+}
+
+// Validate returns an error if the filter can't match anything.
+func (f UploadsFilter) Validate() error {
+	if !f.From.IsZero() && !f.To.IsZero() && f.From.After(f.To) {
+		return ErrInvalidTimePeriod
+	}
+	if (f.MinSize != nil && *f.MinSize < 0) || (f.MaxSize != nil && *f.MaxSize < 0) {
+		return ErrInvalidSizeRange
+	}
+	if f.MinSize != nil && f.MaxSize != nil && *f.MinSize > *f.MaxSize {
+		return ErrInvalidSizeRange
+	}
+	return nil
+}
+
+// uploadFields returns the conditions of the filter which apply to fields of
+// the uploads collection.
+func (f UploadsFilter) uploadFields() bson.D {
+	var timestamp bson.D
+	if !f.From.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$gte", Value: f.From})
+	}
+	if !f.To.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$lte", Value: f.To})
+	}
+	if len(timestamp) == 0 {
+		return nil
+	}
+	return bson.D{{"timestamp", timestamp}}
+}
+
+// skylinkMatchStage returns a match stage with the conditions of the filter
+// which apply to fields of the skylinks collection. It needs to come after
+// the skylinks are joined. It returns nil if there are no such conditions.
+func (f UploadsFilter) skylinkMatchStage() bson.D {
+	var conds, size bson.D
+	if f.Name != "" {
+		re := primitive.Regex{Pattern: regexp.QuoteMeta(f.Name), Options: "i"}
+		conds = append(conds, bson.E{Key: "name", Value: re})
+	}
+	if f.MinSize != nil {
+		size = append(size, bson.E{Key: "$gte", Value: *f.MinSize})
+	}
+	if f.MaxSize != nil {
+		size = append(size, bson.E{Key: "$lte", Value: *f.MaxSize})
+	}
+	if len(size) > 0 {
+		conds = append(conds, bson.E{Key: "size", Value: size})
+	}
+	if len(conds) == 0 {
+		return nil
+	}
+	return bson.D{{"$match", conds}}
+}
+
+// UploadsSort describes how a list of uploads should be sorted.
+type UploadsSort struct {
+	Field     string
+	Ascending bool
+}
+
+// NewUploadsSort validates the given sort field and direction and returns an
+// UploadsSort. Empty values fall back to the values of DefaultUploadsSort.
+func NewUploadsSort(field, direction string) (UploadsSort, error) {
+	sort := DefaultUploadsSort
+	switch field {
+	case "":
+	case UploadsOrderBySize, UploadsOrderByTimestamp, UploadsOrderByName:
+		sort.Field = field
+	default:
+		return UploadsSort{}, ErrInvalidSortField
+	}
+	switch direction {
+	case "":
+	case SortDirectionAsc:
+		sort.Ascending = true
+	case SortDirectionDesc:
+		sort.Ascending = false
+	default:
+		return UploadsSort{}, ErrInvalidSortDirection
+	}
+	return sort, nil
 }
 
 // UploadResponse is the representation of an upload we send as response to
@@ -35,6 +209,34 @@ type UploadResponse struct {
 	Size       int64     `bson:"size" json:"size"`
 	RawStorage int64     `bson:"raw_storage" json:"rawStorage"`
 	Timestamp  time.Time `bson:"timestamp" json:"uploadedOn"`
+	// Unpinned and UnpinnedAt are only set on unpinned uploads, which we
+	// only return when the caller asks for them.
+	Unpinned   bool       `bson:"unpinned" json:"unpinned,omitempty"`
+	UnpinnedAt *time.Time `bson:"unpinned_at,omitempty" json:"unpinnedAt,omitempty"`
+}
+
+// UploadExport is the representation of an upload we use for exports. Unlike
+// UploadResponse it also covers unpinned uploads.
+type UploadExport struct {
+	Skylink   string    `bson:"skylink"`
+	Name      string    `bson:"name"`
+	Size      int64     `bson:"size"`
+	Timestamp time.Time `bson:"timestamp"`
+	Unpinned  bool      `bson:"unpinned"`
+}
+
+// UploadByIP describes an upload made from a given IP. Anonymous uploads have
+// an empty Sub.
+type UploadByIP struct {
+	Sub       string    `bson:"sub" json:"sub"`
+	Skylink   string    `bson:"skylink" json:"skylink"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// UploadsByCountry is the number of uploads made from a given country.
+type UploadsByCountry struct {
+	Country string `bson:"country" json:"country"`
+	Count   int64  `bson:"count" json:"count"`
 }
 
 // UploadByID fetches a single upload from the DB.
@@ -50,7 +252,13 @@ func (db *DB) UploadByID(ctx context.Context, id primitive.ObjectID) (*Upload, e
 
 // UploadCreate registers a new upload and counts it towards the user's used
 // storage.
-func (db *DB) UploadCreate(ctx context.Context, user User, ip string, skylink Skylink) (*Upload, error) {
+//
+// If the upload duplicates one we've already tracked, the existing upload is
+// returned together with ErrDuplicateUpload. An upload is a duplicate if it
+// carries the same request ID as an upload by the same user within the
+// UploadRequestIDWindow or, when no request ID is given, if the same user
+// uploaded the same skylink within the UploadSkylinkDedupWindow.
+func (db *DB) UploadCreate(ctx context.Context, user User, ip string, skylink Skylink, apiKeyID primitive.ObjectID, requestID string) (*Upload, error) {
 	if skylink.ID.IsZero() {
 		return nil, errors.New("skylink doesn't exist")
 	}
@@ -59,8 +267,58 @@ func (db *DB) UploadCreate(ctx context.Context, user User, ip string, skylink Sk
 		UploaderIP: ip,
 		SkylinkID:  skylink.ID,
 		Timestamp:  time.Now().UTC().Truncate(time.Millisecond),
+		APIKeyID:   apiKeyID,
+		RequestID:  requestID,
+	}
+	if requestID != "" {
+		return db.uploadCreateWithRequestID(ctx, up)
+	}
+	if !user.ID.IsZero() && UploadSkylinkDedupWindow > 0 {
+		return db.uploadCreateDedupSkylink(ctx, up)
+	}
+	ior, err := db.staticUploads.InsertOne(ctx, up)
+	if err != nil {
+		return nil, err
+	}
+	up.ID = ior.InsertedID.(primitive.ObjectID)
+	return &up, nil
+}
+
+// uploadCreateWithRequestID inserts the given upload unless the same user has
+// already tracked an upload with the same request ID within the
+// UploadRequestIDWindow. The unique index on (user_id, request_id) guarantees
+// that concurrent retries can't both succeed.
+func (db *DB) uploadCreateWithRequestID(ctx context.Context, up Upload) (*Upload, error) {
+	filter := bson.M{
+		"user_id":    userIDFilter(up.UserID),
+		"request_id": up.RequestID,
+	}
+	var existing Upload
+	err := db.staticUploads.FindOne(ctx, filter).Decode(&existing)
+	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, errors.AddContext(err, "failed to look up upload by request id")
+	}
+	if err == nil {
+		if existing.Timestamp.After(time.Now().UTC().Add(-UploadRequestIDWindow)) {
+			return &existing, ErrDuplicateUpload
+		}
+		// The previous upload with this request ID is outside of the window,
+		// so we release the request ID and track this upload as a new one.
+		update := bson.M{"$unset": bson.M{"request_id": ""}}
+		_, err = db.staticUploads.UpdateOne(ctx, bson.M{"_id": existing.ID}, update)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to release request id")
+		}
 	}
 	ior, err := db.staticUploads.InsertOne(ctx, up)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent request with the same request ID beat us to it.
+		err = db.staticUploads.FindOne(ctx, filter).Decode(&existing)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to fetch duplicate upload")
+		}
+		return &existing, ErrDuplicateUpload
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -68,6 +326,57 @@ func (db *DB) UploadCreate(ctx context.Context, user User, ip string, skylink Sk
 	return &up, nil
 }
 
+// uploadCreateDedupSkylink inserts the given upload unless the same user has
+// already uploaded the same skylink within the UploadSkylinkDedupWindow. We
+// catch sequential retries by looking for a recent upload. Concurrent ones
+// can both miss it, so the unique index on (user_id, skylink_id, dedup_bucket)
+// makes sure only one of them gets inserted. Only requests which straddle the
+// boundary between two buckets can still both get through.
+func (db *DB) uploadCreateDedupSkylink(ctx context.Context, up Upload) (*Upload, error) {
+	filter := bson.M{
+		"user_id":    up.UserID,
+		"skylink_id": up.SkylinkID,
+		"timestamp":  bson.M{"$gt": up.Timestamp.Add(-UploadSkylinkDedupWindow)},
+	}
+	var existing Upload
+	err := db.staticUploads.FindOne(ctx, filter).Decode(&existing)
+	if err == nil {
+		return &existing, ErrDuplicateUpload
+	}
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, errors.AddContext(err, "failed to look up recent uploads")
+	}
+	up.DedupBucket = up.Timestamp.UnixNano() / int64(UploadSkylinkDedupWindow)
+	ior, err := db.staticUploads.InsertOne(ctx, up)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent request for the same skylink beat us to it.
+		filter = bson.M{
+			"user_id":      up.UserID,
+			"skylink_id":   up.SkylinkID,
+			"dedup_bucket": up.DedupBucket,
+		}
+		err = db.staticUploads.FindOne(ctx, filter).Decode(&existing)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to fetch duplicate upload")
+		}
+		return &existing, ErrDuplicateUpload
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create upload")
+	}
+	up.ID = ior.InsertedID.(primitive.ObjectID)
+	return &up, nil
+}
+
+// userIDFilter returns a filter value which matches records created by the
+// given user or, if the ID is zero, anonymous records.
+func userIDFilter(uID primitive.ObjectID) interface{} {
+	if uID.IsZero() {
+		return bson.M{"$exists": false}
+	}
+	return uID
+}
+
 // UploadsBySkylink fetches a page of uploads of this skylink and the total
 // number of such uploads.
 func (db *DB) UploadsBySkylink(ctx context.Context, skylink Skylink, offset, pageSize int) ([]UploadResponse, int64, error) {
@@ -81,7 +390,7 @@ func (db *DB) UploadsBySkylink(ctx context.Context, skylink Skylink, offset, pag
 		{"skylink_id", skylink.ID},
 		{"unpinned", false},
 	}}}
-	return db.uploadsBy(ctx, matchStage, offset, pageSize)
+	return db.uploadsBy(ctx, matchStage, nil, DefaultUploadsSort, offset, pageSize)
 }
 
 // UploadsBySkylinkID returns all uploads of the given skylink.
@@ -101,6 +410,99 @@ func (db *DB) UploadsBySkylinkID(ctx context.Context, slID primitive.ObjectID) (
 	return uploads, nil
 }
 
+// UploadInfoSummary summarizes all uploads of a skylink. DistinctUploaders
+// and StillPinnedCount count users, so they don't include anonymous uploads.
+// StillPinnedCount is the number of users who haven't unpinned all of their
+// uploads of the skylink.
+type UploadInfoSummary struct {
+	DistinctUploaders int64      `bson:"distinct_uploaders" json:"distinctUploaders"`
+	FirstUploadedAt   *time.Time `bson:"first_uploaded_at" json:"firstUploadedAt"`
+	LastUploadedAt    *time.Time `bson:"last_uploaded_at" json:"lastUploadedAt"`
+	TotalUploads      int64      `bson:"total_uploads" json:"totalUploads"`
+	StillPinnedCount  int64      `bson:"still_pinned_count" json:"stillPinnedCount"`
+}
+
+// UploadInfoSummary summarizes all uploads of the given skylink, including the
+// unpinned ones.
+func (db *DB) UploadInfoSummary(ctx context.Context, slID primitive.ObjectID) (UploadInfoSummary, error) {
+	if slID.IsZero() {
+		return UploadInfoSummary{}, ErrInvalidSkylink
+	}
+	// Anonymous uploads don't have a user_id, so they add null to the sets
+	// of uploaders, which we then remove.
+	userID := bson.D{{"$ifNull", bson.A{"$user_id", nil}}}
+	pinnedUserID := bson.D{{"$cond", bson.A{bson.D{{"$eq", bson.A{"$unpinned", false}}}, userID, nil}}}
+	withoutNull := func(set string) bson.D {
+		return bson.D{{"$size", bson.D{{"$setDifference", bson.A{set, bson.A{nil}}}}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"skylink_id", slID}}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"uploaders", bson.D{{"$addToSet", userID}}},
+			{"pinned_uploaders", bson.D{{"$addToSet", pinnedUserID}}},
+			{"first_uploaded_at", bson.D{{"$min", "$timestamp"}}},
+			{"last_uploaded_at", bson.D{{"$max", "$timestamp"}}},
+			{"total_uploads", bson.D{{"$sum", 1}}},
+		}}},
+		{{"$project", bson.D{
+			{"distinct_uploaders", withoutNull("$uploaders")},
+			{"first_uploaded_at", 1},
+			{"last_uploaded_at", 1},
+			{"total_uploads", 1},
+			{"still_pinned_count", withoutNull("$pinned_uploaders")},
+		}}},
+	}
+	c, err := aggregate(ctx, db.staticUploads, pipeline)
+	if err != nil {
+		return UploadInfoSummary{}, errors.AddContext(err, "DB query failed")
+	}
+	var results []UploadInfoSummary
+	if err = c.All(ctx, &results); err != nil {
+		return UploadInfoSummary{}, errors.AddContext(err, "failed to decode DB data")
+	}
+	if len(results) == 0 {
+		return UploadInfoSummary{}, nil
+	}
+	return results[0], nil
+}
+
+// UsersWithPinnedSkylink returns the IDs of up to limit users who have a
+// pinned upload of the given skylink, in ascending order. Only users whose IDs
+// are greater than after are included, so callers can page through popular
+// skylinks by passing the last ID of the previous page.
+func (db *DB) UsersWithPinnedSkylink(ctx context.Context, skylinkID, after primitive.ObjectID, limit int) ([]primitive.ObjectID, error) {
+	if skylinkID.IsZero() {
+		return nil, ErrInvalidSkylink
+	}
+	if limit <= 0 {
+		return nil, errors.New("invalid limit")
+	}
+	// Anonymous uploads don't have a user_id, so the range skips them.
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{
+			{"skylink_id", skylinkID},
+			{"unpinned", false},
+			{"user_id", bson.D{{"$gt", after}}},
+		}}},
+		{{"$group", bson.D{{"_id", "$user_id"}}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+		{{"$limit", limit}},
+	}
+	var results []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err := aggregateAll(ctx, db.staticUploads, pipeline, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch users")
+	}
+	userIDs := make([]primitive.ObjectID, 0, len(results))
+	for _, r := range results {
+		userIDs = append(userIDs, r.ID)
+	}
+	return userIDs, nil
+}
+
 // UnpinUploads unpins all uploads of this skylink by this user. Returns
 // the number of unpinned uploads.
 func (db *DB) UnpinUploads(ctx context.Context, skylink Skylink, user User) (int64, error) {
@@ -115,7 +517,7 @@ func (db *DB) UnpinUploads(ctx context.Context, skylink Skylink, user User) (int
 		"user_id":    user.ID,
 		"unpinned":   false,
 	}
-	update := bson.M{"$set": bson.M{"unpinned": true}}
+	update := bson.M{"$set": bson.M{"unpinned": true, "unpinned_at": time.Now().UTC()}}
 	ur, err := db.staticUploads.UpdateMany(ctx, filter, update)
 	if err != nil {
 		return 0, err
@@ -123,6 +525,118 @@ func (db *DB) UnpinUploads(ctx context.Context, skylink Skylink, user User) (int
 	return ur.ModifiedCount, nil
 }
 
+// RepinUploads pins all uploads of this skylink by this user again, undoing
+// UnpinUploads. Returns the number of repinned uploads.
+func (db *DB) RepinUploads(ctx context.Context, skylink Skylink, user User) (int64, error) {
+	if skylink.ID.IsZero() {
+		return 0, ErrInvalidSkylink
+	}
+	if user.ID.IsZero() {
+		return 0, errors.New("invalid user")
+	}
+	filter := bson.M{
+		"skylink_id": skylink.ID,
+		"user_id":    user.ID,
+		"unpinned":   true,
+	}
+	update := bson.M{
+		"$set":   bson.M{"unpinned": false},
+		"$unset": bson.M{"unpinned_at": ""},
+	}
+	ur, err := db.staticUploads.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return ur.ModifiedCount, nil
+}
+
+// UnpinUploadsBulk unpins all uploads of the given skylinks by this user.
+// The skylinks need to be normalised, e.g. via NormalizeSkylink. Returns the
+// number of unpinned uploads and the skylinks of which the user has no pinned
+// uploads.
+func (db *DB) UnpinUploadsBulk(ctx context.Context, user User, skylinks []string) (int64, []string, error) {
+	if user.ID.IsZero() {
+		return 0, nil, errors.New("invalid user")
+	}
+	if len(skylinks) == 0 {
+		return 0, []string{}, nil
+	}
+	// We don't want to create skylink records for skylinks we don't know, so
+	// we don't use db.Skylink here.
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "skylink": 1})
+	c, err := db.staticSkylinks.Find(ctx, bson.M{"skylink": bson.M{"$in": skylinks}}, opts)
+	if err != nil {
+		return 0, nil, errors.AddContext(err, "failed to fetch skylinks")
+	}
+	var sls []Skylink
+	if err = c.All(ctx, &sls); err != nil {
+		return 0, nil, errors.AddContext(err, "failed to decode skylinks")
+	}
+	ids := make([]primitive.ObjectID, 0, len(sls))
+	for _, sl := range sls {
+		ids = append(ids, sl.ID)
+	}
+	filter := bson.M{
+		"skylink_id": bson.M{"$in": ids},
+		"user_id":    user.ID,
+		"unpinned":   false,
+	}
+	// Find out which of the skylinks the user has pinned, so we can report
+	// the rest as not found.
+	pinnedIDs, err := db.staticUploads.Distinct(ctx, "skylink_id", filter)
+	if err != nil {
+		return 0, nil, errors.AddContext(err, "failed to fetch pinned skylinks")
+	}
+	pinned := make(map[primitive.ObjectID]struct{}, len(pinnedIDs))
+	for _, id := range pinnedIDs {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			pinned[oid] = struct{}{}
+		}
+	}
+	pinnedSkylinks := make(map[string]struct{}, len(pinned))
+	for _, sl := range sls {
+		if _, ok := pinned[sl.ID]; ok {
+			pinnedSkylinks[sl.Skylink] = struct{}{}
+		}
+	}
+	notFound := make([]string, 0)
+	for _, sl := range skylinks {
+		if _, ok := pinnedSkylinks[sl]; !ok {
+			notFound = append(notFound, sl)
+		}
+	}
+	if len(pinned) == 0 {
+		return 0, notFound, nil
+	}
+	update := bson.M{"$set": bson.M{"unpinned": true, "unpinned_at": time.Now().UTC()}}
+	ur, err := db.staticUploads.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, nil, err
+	}
+	return ur.ModifiedCount, notFound, nil
+}
+
+// UserHasPinned returns true if the given user has at least one pinned upload
+// of the given skylink.
+func (db *DB) UserHasPinned(ctx context.Context, user User, skylink Skylink) (bool, error) {
+	if skylink.ID.IsZero() {
+		return false, ErrInvalidSkylink
+	}
+	if user.ID.IsZero() {
+		return false, errors.New("invalid user")
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"skylink_id", skylink.ID},
+		{"user_id", user.ID},
+		{"unpinned", false},
+	}}}
+	n, err := db.count(ctx, db.staticUploads, matchStage)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 // UpdateUpload modifies the given upload according to the given update.
 func (db *DB) UpdateUpload(ctx context.Context, id primitive.ObjectID, update bson.M) (int64, error) {
 	ur, err := db.staticUploads.UpdateByID(ctx, id, update)
@@ -132,20 +646,116 @@ func (db *DB) UpdateUpload(ctx context.Context, id primitive.ObjectID, update bs
 	return ur.ModifiedCount, nil
 }
 
-// UploadsByUser fetches a page of uploads by this user and the total number of
-// such uploads.
-func (db *DB) UploadsByUser(ctx context.Context, user User, offset, pageSize int) ([]UploadResponse, int64, error) {
+// UploadSetCountry sets the country of the given upload.
+func (db *DB) UploadSetCountry(ctx context.Context, id primitive.ObjectID, country string) error {
+	_, err := db.staticUploads.UpdateByID(ctx, id, bson.M{"$set": bson.M{"country": country}})
+	if err != nil {
+		return errors.AddContext(err, "failed to set upload country")
+	}
+	return nil
+}
+
+// UploadsByCountry counts the uploads made since the given time per country,
+// most active countries first. Uploads which haven't been tagged with a
+// country yet are counted towards UnknownCountry.
+func (db *DB) UploadsByCountry(ctx context.Context, since time.Time) ([]UploadsByCountry, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"timestamp", bson.D{{"$gte", since}}}}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"$ifNull", bson.A{"$country", UnknownCountry}}}},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+		{{"$project", bson.D{
+			{"_id", 0},
+			{"country", "$_id"},
+			{"count", 1},
+		}}},
+		{{"$sort", bson.D{{"count", -1}, {"country", 1}}}},
+	}
+	counts := make([]UploadsByCountry, 0)
+	err := aggregateAll(ctx, db.staticUploads, pipeline, &counts)
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// UploadsByUser fetches a page of uploads by this user, which match the given
+// filter, and the total number of such uploads.
+func (db *DB) UploadsByUser(ctx context.Context, user User, filter UploadsFilter, sort UploadsSort, offset, pageSize int) ([]UploadResponse, int64, error) {
 	if user.ID.IsZero() {
 		return nil, 0, errors.New("invalid user")
 	}
 	if err := validateOffsetPageSize(offset, pageSize); err != nil {
 		return nil, 0, err
 	}
+	if err := filter.Validate(); err != nil {
+		return nil, 0, err
+	}
+	conds := bson.D{{"user_id", user.ID}}
+	if !filter.IncludeUnpinned {
+		conds = append(conds, bson.E{Key: "unpinned", Value: false})
+	}
+	matchStage := bson.D{{"$match", append(conds, filter.uploadFields()...)}}
+	return db.uploadsBy(ctx, matchStage, filter.skylinkMatchStage(), sort, offset, pageSize)
+}
+
+// UploadsByUserExport calls fn with each of the user's uploads which match the
+// given filter, in the given order, up to limit uploads. Unlike UploadsByUser
+// it includes unpinned uploads and it doesn't load all uploads in memory, so
+// it's suitable for exports. It stops at the first error returned by fn.
+func (db *DB) UploadsByUserExport(ctx context.Context, user User, filter UploadsFilter, sort UploadsSort, limit int, fn func(UploadExport) error) error {
+	if user.ID.IsZero() {
+		return errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(0, limit); err != nil {
+		return err
+	}
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+	conds := bson.D{{"user_id", user.ID}}
+	matchStage := bson.D{{"$match", append(conds, filter.uploadFields()...)}}
+	c, err := aggregate(ctx, db.staticUploads, generateUploadsPipeline(matchStage, filter.skylinkMatchStage(), sort, 0, limit))
+	if err != nil {
+		return errors.AddContext(err, "DB query failed")
+	}
+	return db.forEach(ctx, c, func(c *mongo.Cursor) error {
+		var up UploadExport
+		if err := c.Decode(&up); err != nil {
+			return errors.AddContext(err, "failed to decode DB data")
+		}
+		return fn(up)
+	})
+}
+
+// UploadsByIP fetches a page of the uploads made from the given IP since the
+// given time, most recent first, and the total number of such uploads. Unlike
+// UploadsByUser it covers the uploads of all users, including unpinned ones.
+func (db *DB) UploadsByIP(ctx context.Context, ip string, since time.Time, offset, pageSize int) ([]UploadByIP, int64, error) {
+	if ip == "" {
+		return nil, 0, ErrInvalidIP
+	}
+	if err := validateOffsetPageSize(offset, pageSize); err != nil {
+		return nil, 0, err
+	}
 	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", user.ID},
-		{"unpinned", false},
+		{"uploader_ip", ip},
+		{"timestamp", bson.D{{"$gte", since}}},
 	}}}
-	return db.uploadsBy(ctx, matchStage, offset, pageSize)
+	cnt, err := db.count(ctx, db.staticUploads, matchStage)
+	if err != nil || cnt == 0 {
+		return []UploadByIP{}, 0, err
+	}
+	c, err := aggregate(ctx, db.staticUploads, generateByIPPipeline(matchStage, "timestamp", offset, pageSize))
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "DB query failed")
+	}
+	uploads := make([]UploadByIP, 0, pageSize)
+	if err = c.All(ctx, &uploads); err != nil {
+		return nil, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	return uploads, cnt, nil
 }
 
 // UploadsByPeriod fetches a page of uploads created during the given time range.
@@ -160,20 +770,35 @@ func (db *DB) UploadsByPeriod(ctx context.Context, from, to time.Time, offset, p
 		{"timestamp", bson.D{{"$gte", from}}},
 		{"timestamp", bson.D{{"$lte", to}}},
 	}}}
-	return db.uploadsBy(ctx, matchStage, offset, pageSize)
+	return db.uploadsBy(ctx, matchStage, nil, DefaultUploadsSort, offset, pageSize)
 }
 
 // uploadsBy fetches a page of uploads, filtered by an arbitrary match criteria.
-// It also reports the total number of records in the list.
-func (db *DB) uploadsBy(ctx context.Context, matchStage bson.D, offset, pageSize int) ([]UploadResponse, int64, error) {
+// It also reports the total number of records in the list. The optional
+// skylinkMatchStage filters the uploads by the fields of their skylinks.
+func (db *DB) uploadsBy(ctx context.Context, matchStage, skylinkMatchStage bson.D, sort UploadsSort, offset, pageSize int) ([]UploadResponse, int64, error) {
 	if err := validateOffsetPageSize(offset, pageSize); err != nil {
 		return nil, 0, err
 	}
-	cnt, err := db.count(ctx, db.staticUploads, matchStage)
+	if db.staticDeps.Disrupt("DependencyUploadsAggregationDelay") {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Minute):
+		}
+	}
+	var cnt int64
+	var err error
+	if skylinkMatchStage == nil {
+		cnt, err = db.count(ctx, db.staticUploads, matchStage)
+	} else {
+		pipeline := append(mongo.Pipeline{matchStage}, skylinksJoinStages()...)
+		pipeline = append(pipeline, skylinkMatchStage)
+		cnt, err = db.countPipeline(ctx, db.staticUploads, pipeline)
+	}
 	if err != nil || cnt == 0 {
 		return []UploadResponse{}, 0, err
 	}
-	c, err := db.staticUploads.Aggregate(ctx, generateUploadsPipeline(matchStage, offset, pageSize))
+	c, err := aggregate(ctx, db.staticUploads, generateUploadsPipeline(matchStage, skylinkMatchStage, sort, offset, pageSize))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestNewUploadsSort ensures NewUploadsSort validates its input and falls back
+// to the default sort.
+func TestNewUploadsSort(t *testing.T) {
+	tests := []struct {
+		field     string
+		direction string
+		expected  UploadsSort
+		err       error
+	}{
+		{"", "", DefaultUploadsSort, nil},
+		{UploadsOrderBySize, SortDirectionAsc, UploadsSort{Field: UploadsOrderBySize, Ascending: true}, nil},
+		{UploadsOrderByName, SortDirectionDesc, UploadsSort{Field: UploadsOrderByName}, nil},
+		{"", SortDirectionAsc, UploadsSort{Field: UploadsOrderByTimestamp, Ascending: true}, nil},
+		{"skylink", "", UploadsSort{}, ErrInvalidSortField},
+		{UploadsOrderBySize, "up", UploadsSort{}, ErrInvalidSortDirection},
+	}
+	for _, tt := range tests {
+		s, err := NewUploadsSort(tt.field, tt.direction)
+		if err != tt.err {
+			t.Fatalf("Expected error '%v', got '%v'", tt.err, err)
+		}
+		if s != tt.expected {
+			t.Fatalf("Expected %+v, got %+v", tt.expected, s)
+		}
+	}
+}
+
+// TestUploadsFilter ensures UploadsFilter validates its values and that the
+// uploads pipeline joins the skylinks before filtering by their fields.
+func TestUploadsFilter(t *testing.T) {
+	now := time.Now().UTC()
+	zero, ten, twenty, negative := int64(0), int64(10), int64(20), int64(-1)
+	tests := []struct {
+		filter UploadsFilter
+		err    error
+	}{
+		{UploadsFilter{}, nil},
+		{UploadsFilter{From: now.Add(-time.Hour), To: now}, nil},
+		{UploadsFilter{From: now, To: now.Add(-time.Hour)}, ErrInvalidTimePeriod},
+		{UploadsFilter{MinSize: &ten, MaxSize: &twenty}, nil},
+		{UploadsFilter{MinSize: &ten}, nil},
+		{UploadsFilter{MinSize: &zero, MaxSize: &zero}, nil},
+		{UploadsFilter{MinSize: &twenty, MaxSize: &ten}, ErrInvalidSizeRange},
+		{UploadsFilter{MinSize: &ten, MaxSize: &zero}, ErrInvalidSizeRange},
+		{UploadsFilter{MaxSize: &negative}, ErrInvalidSizeRange},
+	}
+	for _, tt := range tests {
+		if err := tt.filter.Validate(); err != tt.err {
+			t.Fatalf("Expected error '%v' for %+v, got '%v'", tt.err, tt.filter, err)
+		}
+	}
+
+	// Filters which only apply to uploads don't need a skylink match stage.
+	if s := (UploadsFilter{From: now}).skylinkMatchStage(); s != nil {
+		t.Fatalf("Expected no skylink match stage, got %v", s)
+	}
+	// A size bound of zero filters.
+	if s := (UploadsFilter{MaxSize: &zero}).skylinkMatchStage(); s == nil {
+		t.Fatal("Expected a skylink match stage for a zero max size.")
+	}
+	matchStage := bson.D{{"$match", bson.D{{"user_id", 1}}}}
+	// Without a skylink filter and with the default sort we only join the
+	// requested page.
+	p := generateUploadsPipeline(matchStage, nil, DefaultUploadsSort, 0, 10)
+	if len(p) != 7 || p[len(p)-3][0].Key != "$lookup" {
+		t.Fatalf("Expected the join at the end, got %v", p)
+	}
+	// With a skylink filter we need to join before filtering and paging.
+	slMatch := UploadsFilter{Name: "a.b"}.skylinkMatchStage()
+	p = generateUploadsPipeline(matchStage, slMatch, DefaultUploadsSort, 0, 10)
+	if len(p) != 8 || p[1][0].Key != "$lookup" || p[4][0].Key != "$match" || p[5][0].Key != "$sort" {
+		t.Fatalf("Expected the join before the skylink match, got %v", p)
+	}
+}
@@ -3,8 +3,8 @@ package database
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
-	"net/mail"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/hash"
@@ -13,6 +13,7 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/test/dependencies"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
 	"gitlab.com/SkynetLabs/skyd/build"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -43,13 +44,32 @@ const (
 	// mbpsToBytesPerSecond is a multiplier to get from mebibits per second to
 	// bytes per second.
 	mbpsToBytesPerSecond = 1024 * 1024 / 8
+
+	// maxPaymentFailureEvents is the number of Stripe event IDs we keep in
+	// User.PaymentFailureEvents.
+	maxPaymentFailureEvents = 10
 )
 
 var (
+	// MaxNumPubKeysPerUser sets the limit for number of pubkeys a single user
+	// can attach to their account. Users who already have more pubkeys than
+	// that keep them but can't add new ones. This value is configurable via
+	// the ACCOUNTS_MAX_NUM_PUBKEYS_PER_USER environment variable.
+	MaxNumPubKeysPerUser = 20
+	// ErrPubKeyLimitReached is returned when a user tries to add a pubkey
+	// after already having the maximum allowed number.
+	ErrPubKeyLimitReached = errors.New("pubkey_limit_reached")
+	// UserDeleteGracePeriod is how long a deleted user can restore their
+	// account before we purge it. This value is configurable via the
+	// ACCOUNTS_USER_DELETE_GRACE_HOURS environment variable.
+	UserDeleteGracePeriod = 72 * time.Hour
+
 	// AnonUser is a helper struct that we can use when we don't have a relevant
 	// user, e.g. when an upload is made by an anonymous user.
 	AnonUser = User{}
-	// UserLimits defines the speed limits for each tier.
+	// UserLimits defines the default speed limits for each tier. These can be
+	// overridden via the configuration collection, so callers should use
+	// LimitsForTier instead of reading this map directly.
 	// RegistryDelay delay is in ms.
 	UserLimits = map[int]TierLimits{
 		TierAnonymous: {
@@ -102,6 +122,12 @@ var (
 	// ErrInvalidToken is returned when the token is found to be invalid for any
 	// reason, including expiration.
 	ErrInvalidToken = errors.New("invalid token")
+	// ErrPaymentFailureRecorded is returned when we've already recorded the
+	// payment failure of the given Stripe event.
+	ErrPaymentFailureRecorded = errors.New("payment failure already recorded")
+	// ErrStaleDocument is returned when we try to save a user whose document
+	// has been saved by someone else since we fetched it.
+	ErrStaleDocument = errors.New("the user has been modified in the meantime")
 )
 
 type (
@@ -111,6 +137,7 @@ type (
 		// its ID.Hex() form.
 		ID                               primitive.ObjectID `bson:"_id,omitempty" json:"-"`
 		Email                            types.Email        `bson:"email" json:"email"`
+		Name                             string             `bson:"name,omitempty" json:"name"`
 		EmailConfirmationToken           string             `bson:"email_confirmation_token,omitempty" json:"-"`
 		EmailConfirmationTokenExpiration time.Time          `bson:"email_confirmation_token_expiration,omitempty" json:"-"`
 		PasswordHash                     string             `bson:"password_hash" json:"-"`
@@ -118,6 +145,7 @@ type (
 		Sub                              string             `bson:"sub" json:"sub"`
 		Tier                             int                `bson:"tier" json:"tier"`
 		CreatedAt                        time.Time          `bson:"created_at" json:"createdAt"`
+		LastLoginAt                      time.Time          `bson:"last_login_at" json:"lastLoginAt"`
 		MigratedAt                       time.Time          `bson:"migrated_at" json:"migratedAt"`
 		SubscribedUntil                  time.Time          `bson:"subscribed_until" json:"subscribedUntil"`
 		SubscriptionStatus               string             `bson:"subscription_status" json:"subscriptionStatus"`
@@ -126,6 +154,99 @@ type (
 		StripeID                         string             `bson:"stripe_id" json:"stripeCustomerId"`
 		QuotaExceeded                    bool               `bson:"quota_exceeded" json:"quotaExceeded"`
 		PubKeys                          []PubKey           `bson:"pub_keys" json:"-"`
+		// QuotaUsage is the usage we computed when we found that the user
+		// exceeds their quota. It's only set while QuotaExceeded is true.
+		QuotaUsage *QuotaUsage `bson:"quota_usage,omitempty" json:"quota,omitempty"`
+		// PubKeysMeta holds metadata about the keys in PubKeys. Keys added
+		// before we started tracking metadata might not have an entry here.
+		PubKeysMeta []PubKeyMeta `bson:"pub_keys_meta,omitempty" json:"-"`
+		// GrantSecret is mixed into the signature of all skylink access grants
+		// issued by this user. Rotating it invalidates all outstanding grants.
+		GrantSecret string `bson:"grant_secret,omitempty" json:"-"`
+		// PendingEmail is the address the user wants to change their email to.
+		// It replaces Email once the user confirms it with PendingEmailToken.
+		// Until then, the user keeps logging in and recovering their account
+		// with their current address.
+		PendingEmail                types.Email `bson:"pending_email,omitempty" json:"pendingEmail"`
+		PendingEmailToken           string      `bson:"pending_email_token,omitempty" json:"-"`
+		PendingEmailTokenExpiration time.Time   `bson:"pending_email_token_expiration,omitempty" json:"-"`
+		// DeletedAt is set when the user deletes their account. The account
+		// is purged once UserDeleteGracePeriod has passed since then. Until
+		// that happens the user can restore it.
+		DeletedAt time.Time `bson:"deleted_at,omitempty" json:"-"`
+		// PaymentFailures counts the consecutive failed payments of the
+		// user's subscription. It's reset by the next successful payment.
+		PaymentFailures      int       `bson:"payment_failures,omitempty" json:"-"`
+		LastPaymentFailureAt time.Time `bson:"last_payment_failure_at,omitempty" json:"-"`
+		// PaymentFailureEvents holds the IDs of the Stripe events of the
+		// latest payment failures, so we don't count the same failure twice
+		// when Stripe delivers its event again.
+		PaymentFailureEvents []string `bson:"payment_failure_events,omitempty" json:"-"`
+		// TwoFactorEnabled tells us whether the user needs to provide a TOTP
+		// code when logging in with credentials.
+		TwoFactorEnabled bool `bson:"two_factor_enabled,omitempty" json:"twoFactorEnabled"`
+		// TwoFactorSecret holds the user's encrypted TOTP secret. It's set
+		// during the setup, before 2FA gets enabled.
+		TwoFactorSecret string `bson:"two_factor_secret,omitempty" json:"-"`
+		// TwoFactorLastStep is the TOTP time step of the last code the user
+		// used. We don't accept codes from it or from earlier steps, so each
+		// code can only be used once.
+		TwoFactorLastStep int64 `bson:"two_factor_last_step,omitempty" json:"-"`
+		// TwoFactorRecoveryCodes holds the hashes of the user's unused
+		// recovery codes. Each one can be used once instead of a TOTP code.
+		TwoFactorRecoveryCodes []string `bson:"two_factor_recovery_codes,omitempty" json:"-"`
+		// LoginFailures counts the user's consecutive failed logins with a
+		// password. It's reset by a successful login and when the account
+		// gets locked.
+		LoginFailures int `bson:"login_failures,omitempty" json:"-"`
+		// LockedUntil is set when the user fails to log in too many times in
+		// a row. They can't log in with a password until then.
+		LockedUntil time.Time `bson:"locked_until,omitempty" json:"-"`
+		// TrialTier is a tier granted to the user for a limited time, e.g. as
+		// part of a promotion. It applies on top of their paid Tier until
+		// TrialUntil, see EffectiveTier.
+		TrialTier  int       `bson:"trial_tier,omitempty" json:"trialTier"`
+		TrialUntil time.Time `bson:"trial_until,omitempty" json:"trialUntil"`
+		// Locale selects the language of the emails we send to the user, e.g.
+		// `de`. We send emails in English if it's empty or if we don't have a
+		// translation for it.
+		Locale string `bson:"locale,omitempty" json:"locale,omitempty"`
+		// EmailPreferences describes which categories of emails the user
+		// wants to receive. It's nil for users who haven't changed their
+		// preferences, see EmailPrefs.
+		EmailPreferences *EmailPreferences `bson:"email_preferences,omitempty" json:"emailPreferences"`
+		// Suspended users can't log in or use their JWTs and API keys. Only
+		// admins can suspend users.
+		Suspended bool `bson:"suspended,omitempty" json:"-"`
+		// AdminNotes holds the notes the admins left on the user's account,
+		// oldest first. Users never see them.
+		AdminNotes []string `bson:"admin_notes,omitempty" json:"-"`
+		// OrgID is the organization the user belongs to, if any. While they
+		// are a member, the organization's tier applies to them instead of
+		// their own and their uploads count against its pooled quota. We
+		// mirror the organization's tier in OrgTier, so we don't need to
+		// fetch the organization whenever we check the user's limits.
+		OrgID   primitive.ObjectID `bson:"org_id,omitempty" json:"-"`
+		OrgTier int                `bson:"org_tier,omitempty" json:"-"`
+		// Version is incremented each time the user is saved via UserSave,
+		// so UserSave can detect that it's about to overwrite changes it
+		// hasn't seen. Documents saved before we started versioning them
+		// don't have a version, which counts as version 0.
+		Version int `bson:"version" json:"-"`
+	}
+	// PubKeyMeta holds metadata about one of the user's pubkeys.
+	PubKeyMeta struct {
+		Key        PubKey    `bson:"key"`
+		AddedAt    time.Time `bson:"added_at,omitempty"`
+		LastUsedAt time.Time `bson:"last_used_at,omitempty"`
+	}
+	// QuotaUsage describes the resources a user consumed and the quotas we
+	// compared them to.
+	QuotaUsage struct {
+		StorageUsed  int64 `bson:"storage_used" json:"storageUsed"`
+		StorageLimit int64 `bson:"storage_limit" json:"storageLimit"`
+		UploadsCount int64 `bson:"uploads_count" json:"uploadsCount"`
+		UploadsLimit int64 `bson:"uploads_limit" json:"uploadsLimit"`
 	}
 	// TierLimits defines the speed limits imposed on the user based on their
 	// tier.
@@ -140,13 +261,27 @@ type (
 	}
 )
 
-// UserByEmail returns the user with the given username.
+// UserByEmail returns the user with the given email. The lookup is
+// case-insensitive, so it matches the unique index on the users' emails.
+// Users without an email can't be found by it.
 func (db *DB) UserByEmail(ctx context.Context, email types.Email) (*User, error) {
-	users, err := db.managedUsersByField(ctx, "email", email.String())
+	if email == "" {
+		return nil, ErrUserNotFound
+	}
+	opts := options.FindOne().SetCollation(emailCollation)
+	sr := db.staticUsers.FindOne(ctx, bson.M{"email": email.String()}, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if sr.Err() != nil {
+		return nil, errors.AddContext(sr.Err(), "failed to find user")
+	}
+	var u User
+	err := sr.Decode(&u)
 	if err != nil {
-		return nil, err
+		return nil, errors.AddContext(err, "failed to parse value from DB")
 	}
-	return users[0], nil
+	return &u, nil
 }
 
 // UserByID finds a user by their ID.
@@ -187,8 +322,20 @@ func (db *DB) UserByPubKey(ctx context.Context, pk PubKey) (*User, error) {
 	return &u, nil
 }
 
-// UserByRecoveryToken returns the user with the given recovery token.
+// UserByRecoveryToken returns the user with the given valid recovery token.
+// It doesn't consume the token, see RecoveryTokenConsume.
 func (db *DB) UserByRecoveryToken(ctx context.Context, token string) (*User, error) {
+	if token == "" {
+		return nil, ErrUserNotFound
+	}
+	id, err := db.userIDByRecoveryToken(ctx, token)
+	if err == nil {
+		return db.UserByID(ctx, id)
+	}
+	if !errors.Contains(err, ErrInvalidRecoveryToken) {
+		return nil, err
+	}
+	// Fall back to the tokens issued before we had a separate collection.
 	users, err := db.managedUsersByField(ctx, "recovery_token", token)
 	if err != nil {
 		return nil, err
@@ -228,34 +375,163 @@ func (db *DB) UserBySub(ctx context.Context, sub string) (*User, error) {
 	return db.managedUserBySub(ctx, sub)
 }
 
-// UserConfirmEmail confirms that the email to which the passed confirmation
-// token belongs actually belongs to its user.
-func (db *DB) UserConfirmEmail(ctx context.Context, token string) (*User, error) {
+// UserQuotaExceeded returns the value of the QuotaExceeded flag of the user
+// with the given sub. The query is covered by the sub_quota_exceeded index, so
+// it never needs to fetch the user document itself, which makes it cheap
+// enough to be used for frequent cache refreshes.
+func (db *DB) UserQuotaExceeded(ctx context.Context, sub string) (bool, error) {
+	opts := options.FindOne().SetProjection(bson.M{"_id": 0, "sub": 1, "quota_exceeded": 1})
+	sr := db.staticUsers.FindOne(ctx, bson.M{"sub": sub}, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		return false, ErrUserNotFound
+	}
+	if sr.Err() != nil {
+		return false, sr.Err()
+	}
+	var res struct {
+		QuotaExceeded bool `bson:"quota_exceeded"`
+	}
+	err := sr.Decode(&res)
+	if err != nil {
+		return false, err
+	}
+	return res.QuotaExceeded, nil
+}
+
+// UsersByIDs returns the users with the given IDs. Users which don't exist
+// are skipped.
+func (db *DB) UsersByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	users, err := db.managedUsersByField(ctx, "_id", bson.M{"$in": ids})
+	if errors.Contains(err, ErrUserNotFound) {
+		return nil, nil
+	}
+	return users, err
+}
+
+// UsersWithQuotaExceeded returns up to limit users whose QuotaExceeded flag
+// is set, in ascending order of their IDs. Only users whose IDs are greater
+// than after are included, so callers can page through all of them by passing
+// the last ID of the previous page.
+func (db *DB) UsersWithQuotaExceeded(ctx context.Context, after primitive.ObjectID, limit int) ([]*User, error) {
+	if limit <= 0 {
+		return nil, errors.New("invalid limit")
+	}
+	filter := bson.D{
+		{"quota_exceeded", true},
+		{"_id", bson.D{{"$gt", after}}},
+	}
+	opts := options.Find().SetSort(bson.D{{"_id", 1}}).SetLimit(int64(limit))
+	c, err := db.staticUsers.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find users")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Debugln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	users := make([]*User, 0, limit)
+	for c.Next(ctx) {
+		var u User
+		if err = c.Decode(&u); err != nil {
+			return nil, errors.AddContext(err, "failed to parse value from DB")
+		}
+		users = append(users, &u)
+	}
+	return users, c.Err()
+}
+
+// UserByConfirmationToken returns the user to whom the given email
+// confirmation token belongs. The token either confirms the user's email
+// address or a pending change of it. See UserApplyEmailConfirmation.
+func (db *DB) UserByConfirmationToken(ctx context.Context, token string) (*User, error) {
 	if token == "" {
 		return nil, errors.AddContext(ErrInvalidToken, "token cannot be empty")
 	}
 	users, err := db.managedUsersByField(ctx, "email_confirmation_token", token)
-	if err != nil {
-		return nil, errors.AddContext(err, "failed to read users from DB")
+	if errors.Contains(err, ErrUserNotFound) {
+		users, err = db.managedUsersByField(ctx, "pending_email_token", token)
 	}
-	if len(users) == 0 {
+	if errors.Contains(err, ErrUserNotFound) {
 		return nil, errors.AddContext(ErrInvalidToken, "no user has this token")
 	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to read users from DB")
+	}
 	if len(users) > 1 {
 		build.Critical("multiple users found for the same confirmation token", token)
 		return nil, errors.AddContext(ErrInvalidToken, "please request a new token")
 	}
-	u := users[0]
-	// Check if the token has expired.
-	if u.EmailConfirmationTokenExpiration.Before(time.Now().UTC()) {
-		return nil, errors.AddContext(ErrInvalidToken, "token expired")
+	return users[0], nil
+}
+
+// UserApplyEmailConfirmation confirms the email address of the given user
+// with the given token. If the token confirms a pending email change, the
+// pending address becomes the user's email address. It only changes u, so
+// the caller needs to save it. It fails with ErrInvalidToken if the token
+// doesn't belong to the user or has expired and with ErrUserAlreadyExists if
+// another user has claimed the pending address in the meantime.
+func (db *DB) UserApplyEmailConfirmation(ctx context.Context, u *User, token string) error {
+	if token == "" {
+		return errors.AddContext(ErrInvalidToken, "token cannot be empty")
+	}
+	if u.EmailConfirmationToken == token {
+		if u.EmailConfirmationTokenExpiration.Before(time.Now().UTC()) {
+			return errors.AddContext(ErrInvalidToken, "token expired")
+		}
+		u.EmailConfirmationToken = ""
+		return nil
 	}
+	if u.PendingEmailToken != token {
+		return errors.AddContext(ErrInvalidToken, "the user doesn't have this token")
+	}
+	if u.PendingEmailTokenExpiration.Before(time.Now().UTC()) {
+		return errors.AddContext(ErrInvalidToken, "token expired")
+	}
+	// Make sure nobody took this address since the user requested the change.
+	eu, err := db.UserByEmail(ctx, u.PendingEmail)
+	if err != nil && !errors.Contains(err, ErrUserNotFound) {
+		return errors.AddContext(err, "failed to check for existing users")
+	}
+	if err == nil && eu.ID != u.ID {
+		return errors.AddContext(ErrUserAlreadyExists, "this email is already in use")
+	}
+	// The user just proved they own the new address, so it's confirmed.
+	u.Email = u.PendingEmail
 	u.EmailConfirmationToken = ""
-	err = db.UserSave(ctx, u)
+	u.EmailConfirmationTokenExpiration = time.Time{}
+	u.PendingEmail = ""
+	u.PendingEmailToken = ""
+	u.PendingEmailTokenExpiration = time.Time{}
+	return nil
+}
+
+// UserSetEmailConfirmed confirms the user's email address without a
+// confirmation token, e.g. for users who can't receive our emails. It leaves
+// any pending email change untouched.
+func (db *DB) UserSetEmailConfirmed(ctx context.Context, u *User) error {
+	if u.ID.IsZero() {
+		return errors.AddContext(ErrUserNotFound, "user struct not fully initialised")
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{
+		"email_confirmation_token":            "",
+		"email_confirmation_token_expiration": "",
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
 	if err != nil {
-		return nil, errors.AddContext(err, "failed to update user")
+		return errors.AddContext(err, "failed to update")
 	}
-	return u, nil
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.EmailConfirmationToken = ""
+	u.EmailConfirmationTokenExpiration = time.Time{}
+	u.Version++
+	return nil
 }
 
 // UserCreate creates a new user in the DB.
@@ -267,11 +543,11 @@ func (db *DB) UserConfirmEmail(ctx context.Context, token string) (*User, error)
 func (db *DB) UserCreate(ctx context.Context, emailAddr types.Email, pass, sub string, tier int) (*User, error) {
 	// Ensure the email is valid if it's passed. We allow empty emails.
 	if emailAddr != "" {
-		addr, err := mail.ParseAddress(emailAddr.String())
+		var err error
+		emailAddr, err = types.NormalizeEmail(emailAddr.String())
 		if err != nil {
 			return nil, errors.AddContext(err, "invalid email address")
 		}
-		emailAddr = types.NewEmail(addr.Address)
 	}
 	if sub == "" {
 		return nil, errors.New("empty sub is not allowed")
@@ -302,15 +578,20 @@ func (db *DB) UserCreate(ctx context.Context, emailAddr types.Email, pass, sub s
 			return nil, errors.AddContext(ErrGeneralInternalFailure, "failed to hash password")
 		}
 	}
-	emailConfToken, err := lib.GenerateUUID()
-	if err != nil {
-		return nil, errors.AddContext(err, "failed to generate an email confirmation token")
+	var emailConfToken string
+	var emailConfTokenExp time.Time
+	if emailAddr != "" {
+		emailConfToken, err = lib.GenerateUUID()
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to generate an email confirmation token")
+		}
+		emailConfTokenExp = time.Now().UTC().Add(EmailConfirmationTokenTTL).Truncate(time.Millisecond)
 	}
 	u := &User{
 		ID:                               primitive.ObjectID{},
 		Email:                            emailAddr,
 		EmailConfirmationToken:           emailConfToken,
-		EmailConfirmationTokenExpiration: time.Now().UTC().Add(EmailConfirmationTokenTTL).Truncate(time.Millisecond),
+		EmailConfirmationTokenExpiration: emailConfTokenExp,
 		PasswordHash:                     string(passHash),
 		RecoveryToken:                    "",
 		Sub:                              sub,
@@ -325,13 +606,19 @@ func (db *DB) UserCreate(ctx context.Context, emailAddr types.Email, pass, sub s
 		QuotaExceeded:                    false,
 		PubKeys:                          make([]PubKey, 0),
 	}
-	// TODO This part can race and create multiple accounts with the same email, unless we add DB-level uniqueness restriction.
+	// The unique indexes on the users' subs and emails make sure that two
+	// concurrent requests can't create the same user twice.
 	// Insert the user.
 	fields, err := bson.Marshal(u)
 	if err != nil {
 		return nil, err
 	}
 	ir, err := db.staticUsers.InsertOne(ctx, fields)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another user with the same email or sub got created in the
+		// meantime.
+		return nil, ErrUserAlreadyExists
+	}
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to Insert")
 	}
@@ -354,7 +641,7 @@ func (db *DB) UserCreateEmailConfirmation(ctx context.Context, uID primitive.Obj
 			"email_confirmation_token_expiration": exp,
 		},
 	}
-	_, err = db.staticUsers.UpdateOne(ctx, filter, update)
+	_, err = db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
 	if err != nil {
 		return "", err
 	}
@@ -363,23 +650,30 @@ func (db *DB) UserCreateEmailConfirmation(ctx context.Context, uID primitive.Obj
 
 // UserCreatePK creates a new user with a pubkey in the DB.
 //
-// The `pass` and `sub` fields are optional.
+// The `emailAddr`, `pass` and `sub` fields are optional. A user without an
+// email can't have a password because they couldn't log in with it.
 //
 // The new user is created as "unconfirmed" and a confirmation email is sent to
-// the address they provided.
+// the address they provided. Users without an email have nothing to confirm
+// until they add one.
 func (db *DB) UserCreatePK(ctx context.Context, emailAddr types.Email, pass, sub string, pk PubKey, tier int) (*User, error) {
-	// Validate the email.
-	parsed, err := mail.ParseAddress(emailAddr.String())
-	if err != nil || parsed.Address != emailAddr.String() {
-		return nil, errors.AddContext(err, "invalid email address")
-	}
-	// Check for an existing user with this email.
-	users, err := db.managedUsersByField(ctx, "email", emailAddr.String())
-	if err != nil && !errors.Contains(err, ErrUserNotFound) {
-		return nil, errors.AddContext(err, "failed to query DB")
-	}
-	if len(users) > 0 {
-		return nil, ErrUserAlreadyExists
+	var err error
+	if emailAddr != "" {
+		// Validate the email.
+		emailAddr, err = types.NormalizeEmail(emailAddr.String())
+		if err != nil {
+			return nil, errors.AddContext(err, "invalid email address")
+		}
+		// Check for an existing user with this email.
+		_, err = db.UserByEmail(ctx, emailAddr)
+		if err != nil && !errors.Contains(err, ErrUserNotFound) {
+			return nil, errors.AddContext(err, "failed to query DB")
+		}
+		if err == nil {
+			return nil, ErrUserAlreadyExists
+		}
+	} else if pass != "" {
+		return nil, ErrPasswordWithoutEmail
 	}
 	if sub == "" {
 		sub, err = lib.GenerateUUID()
@@ -427,12 +721,18 @@ func (db *DB) UserCreatePK(ctx context.Context, emailAddr types.Email, pass, sub
 		QuotaExceeded:                    false,
 		PubKeys:                          []PubKey{pk},
 	}
+	u.PubKeysMeta = []PubKeyMeta{{Key: pk, AddedAt: u.CreatedAt}}
 	// Insert the user.
 	fields, err := bson.Marshal(u)
 	if err != nil {
 		return nil, err
 	}
 	ir, err := db.staticUsers.InsertOne(ctx, fields)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another user with the same email or sub got created in the
+		// meantime.
+		return nil, ErrUserAlreadyExists
+	}
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to Insert")
 	}
@@ -471,6 +771,26 @@ func (db *DB) UserDelete(ctx context.Context, u *User) error {
 	if err != nil {
 		return errors.AddContext(err, "failed to delete user unconfirmed updates")
 	}
+	_, err = db.staticSessions.DeleteMany(ctx, bson.M{"sub": u.Sub})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user sessions")
+	}
+	_, err = db.staticRecoveryTokens.DeleteMany(ctx, filter)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user recovery tokens")
+	}
+	_, err = db.staticAuditLog.DeleteMany(ctx, bson.M{"user_id": u.ID})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user audit log")
+	}
+	_, err = db.staticStorageUsage.DeleteOne(ctx, bson.M{"_id": u.ID})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user storage usage")
+	}
+	err = db.orgDeleteByOwner(ctx, u.ID)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user's organization")
+	}
 	// Delete the actual user.
 	filter = bson.M{"_id": u.ID}
 	dr, err := db.staticUsers.DeleteOne(ctx, filter)
@@ -480,31 +800,161 @@ func (db *DB) UserDelete(ctx context.Context, u *User) error {
 	if dr.DeletedCount == 0 {
 		return ErrUserNotFound
 	}
+	db.managedRecordChangeEvent(ctx, ChangeEvent{
+		Type: ChangeEventUserDeleted,
+		Sub:  u.Sub,
+	})
 	return nil
 }
 
-// UserSave saves the user to the DB.
+// UserSoftDelete marks the user as deleted. The user can no longer log in or
+// use their API keys but they can restore their account until
+// UserDeleteGracePeriod passes. After that the account gets purged.
+func (db *DB) UserSoftDelete(ctx context.Context, u *User) error {
+	if u.ID.IsZero() {
+		return errors.AddContext(ErrUserNotFound, "user struct not fully initialised")
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{"deleted_at": now}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.DeletedAt = now
+	u.Version++
+	return nil
+}
+
+// UserUndelete restores a soft-deleted user. It also clears the user's
+// recovery tokens because they are used for authorising the restoration.
+func (db *DB) UserUndelete(ctx context.Context, u *User) error {
+	if u.ID.IsZero() {
+		return errors.AddContext(ErrUserNotFound, "user struct not fully initialised")
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{"deleted_at": ""}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.DeletedAt = time.Time{}
+	u.Version++
+	return db.RecoveryTokensDelete(ctx, u)
+}
+
+// UserPurgeDeleted permanently deletes all users who were soft-deleted before
+// the given time, together with all of their data. It returns the number of
+// purged users.
+func (db *DB) UserPurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	filter := bson.M{"deleted_at": bson.M{"$lt": deletedBefore.UTC()}}
+	c, err := db.staticUsers.Find(ctx, filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to find deleted users")
+	}
+	var users []User
+	err = c.All(ctx, &users)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to decode deleted users")
+	}
+	var n int
+	var errs []error
+	for i := range users {
+		err = db.UserDelete(ctx, &users[i])
+		if err != nil {
+			errs = append(errs, errors.AddContext(err, "failed to purge user "+users[i].Sub))
+			continue
+		}
+		n++
+	}
+	return n, errors.Compose(errs...)
+}
+
+// UserSave saves the user to the DB. It only overwrites the user's document if
+// nobody else has saved it since we fetched it, i.e. if its version still
+// matches u.Version. Otherwise, it returns ErrStaleDocument and the caller
+// needs to fetch the user again and reapply their changes. Users without an
+// ID are inserted.
 func (db *DB) UserSave(ctx context.Context, u *User) error {
 	if db.staticDeps.Disrupt("DependencyMongoWriteConflictN") {
 		return errors.New(dependencies.DependencyMongoWriteConflictNMessage)
 	}
-	filter := bson.M{"_id": u.ID}
-	opts := options.Replace().SetUpsert(true)
-	_, err := db.staticUsers.ReplaceOne(ctx, filter, u, opts)
+	saved := *u
+	saved.Version++
+	var err error
+	if u.ID.IsZero() {
+		opts := options.Replace().SetUpsert(true)
+		_, err = db.staticUsers.ReplaceOne(ctx, bson.M{"_id": u.ID}, saved, opts)
+	} else {
+		var ur *mongo.UpdateResult
+		ur, err = db.staticUsers.ReplaceOne(ctx, userVersionFilter(u.ID, u.Version), saved)
+		if err == nil && ur.MatchedCount == 0 {
+			return ErrStaleDocument
+		}
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return errors.AddContext(ErrUserAlreadyExists, "another user has the same email")
+	}
 	if err != nil {
 		return errors.AddContext(err, "failed to update")
 	}
+	u.Version = saved.Version
 	return nil
 }
 
-// UserPubKeyAdd adds a new PubKey to the given user's set.
+// userVersionFilter matches the user with the given ID, as long as their
+// document has the given version. Documents without a version match version
+// 0.
+func userVersionFilter(id primitive.ObjectID, version int) bson.M {
+	if version == 0 {
+		return bson.M{"_id": id, "version": bson.M{"$in": bson.A{0, nil}}}
+	}
+	return bson.M{"_id": id, "version": version}
+}
+
+// withVersionBump adds an increment of the user's version to the given update.
+// Every targeted update of a user document needs one, so that UserSave calls
+// with a copy of the user fetched before the update fail with
+// ErrStaleDocument instead of overwriting it.
+func withVersionBump(update bson.M) bson.M {
+	inc, ok := update["$inc"].(bson.M)
+	if !ok {
+		inc = bson.M{}
+	}
+	inc["version"] = 1
+	update["$inc"] = inc
+	return update
+}
+
+// UserPubKeyAdd adds a new PubKey to the given user's set. It returns
+// ErrPubKeyLimitReached if the user already has MaxNumPubKeysPerUser pubkeys.
+// The limit is checked as part of the update, so concurrent additions can't
+// push the user over it.
 func (db *DB) UserPubKeyAdd(ctx context.Context, u User, pk PubKey) (err error) {
-	filter := bson.M{"_id": u.ID}
+	filter := bson.M{
+		"_id": u.ID,
+		"$expr": bson.M{
+			"$lt": bson.A{
+				bson.M{"$size": bson.M{"$ifNull": bson.A{"$pub_keys", bson.A{}}}},
+				MaxNumPubKeysPerUser,
+			},
+		},
+	}
 	// This update is so complicated because we can't use mutation operations
 	// like $push, $addToSet and so on if the target field is null. That's why
 	// here we check if the field is an array and then merge the key in. If the
 	// field is not an array (i.e. it's null) we set it to an empty array before
 	// performing the merge.
+	// We only add metadata for keys which are not already in the set. Note
+	// that all expressions within the same $set stage see the document as it
+	// was before the update.
+	meta := bson.M{"key": pk, "added_at": time.Now().UTC().Truncate(time.Millisecond)}
 	update := bson.A{
 		bson.M{
 			"$set": bson.M{
@@ -514,11 +964,26 @@ func (db *DB) UserPubKeyAdd(ctx context.Context, u User, pk PubKey) (err error)
 						bson.M{"$setUnion": bson.A{"$pub_keys", bson.A{pk}}},
 						bson.A{pk},
 					}},
+				"pub_keys_meta": bson.M{
+					"$cond": bson.A{
+						bson.M{"$in": bson.A{pk, bson.M{"$ifNull": bson.A{"$pub_keys", bson.A{}}}}},
+						bson.M{"$ifNull": bson.A{"$pub_keys_meta", bson.A{}}},
+						bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$pub_keys_meta", bson.A{}}}, bson.A{meta}}},
+					}},
+				// Pipeline updates can't use $inc, so we bump the version by
+				// hand. See withVersionBump.
+				"version": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
 			},
 		},
 	}
-	_, err = db.staticUsers.UpdateOne(ctx, filter, update)
-	return err
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if ur.MatchedCount == 0 {
+		return ErrPubKeyLimitReached
+	}
+	return nil
 }
 
 // UserPubKeyRemove removes a PubKey from the given user's set.
@@ -528,24 +993,85 @@ func (db *DB) UserPubKeyRemove(ctx context.Context, u User, pk PubKey) error {
 		"pub_keys": bson.M{"$ne": nil},
 	}
 	update := bson.M{
-		"$pull": bson.M{"pub_keys": pk},
+		"$pull": bson.M{
+			"pub_keys":      pk,
+			"pub_keys_meta": bson.M{"key": pk},
+		},
 	}
-	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
 	if err == nil && ur.ModifiedCount == 0 {
 		err = mongo.ErrNoDocuments
 	}
 	return err
 }
 
+// managedPubKeyTouch sets the time at which the given pubkey was last used to
+// the current time. Keys added before we started tracking metadata get a new
+// metadata entry without an AddedAt value.
+func (db *DB) managedPubKeyTouch(ctx context.Context, pk PubKey) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{"pub_keys": pk, "pub_keys_meta.key": pk}
+	update := bson.M{"$set": bson.M{"pub_keys_meta.$.last_used_at": now}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return err
+	}
+	if ur.MatchedCount > 0 {
+		return nil
+	}
+	filter = bson.M{"pub_keys": pk}
+	update = bson.M{"$push": bson.M{"pub_keys_meta": PubKeyMeta{Key: pk, LastUsedAt: now}}}
+	_, err = db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	return err
+}
+
 // UserSetStripeID changes the user's stripe id in the DB.
 func (db *DB) UserSetStripeID(ctx context.Context, u *User, stripeID string) error {
 	filter := bson.M{"_id": u.ID}
 	update := bson.M{"$set": bson.M{"stripe_id": stripeID}}
 	opts := options.Update().SetUpsert(true)
-	_, err := db.staticUsers.UpdateOne(ctx, filter, update, opts)
+	_, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update), opts)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	u.StripeID = stripeID
+	u.Version++
+	return nil
+}
+
+// UserSetLastLogin records the current time as the user's last login. We only
+// set the one field, so we don't clobber any concurrent changes to the user.
+func (db *DB) UserSetLastLogin(ctx context.Context, u *User) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{"last_login_at": now}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
 	if err != nil {
 		return errors.AddContext(err, "failed to update")
 	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	u.LastLoginAt = now
+	u.Version++
+	return nil
+}
+
+// UserRotateGrantSecret sets a new random grant secret for the given user,
+// invalidating all skylink access grants they have issued so far.
+func (db *DB) UserRotateGrantSecret(ctx context.Context, u *User) error {
+	secret := hex.EncodeToString(fastrand.Bytes(32))
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{"grant_secret": secret}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	u.GrantSecret = secret
+	u.Version++
 	return nil
 }
 
@@ -556,20 +1082,208 @@ func (db *DB) UserSetTier(ctx context.Context, u *User, t int) error {
 	}
 	filter := bson.M{"_id": u.ID}
 	update := bson.M{"$set": bson.M{"tier": t}}
-	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
 	if err != nil {
 		return errors.AddContext(err, "failed to update")
 	}
 	if ur.MatchedCount == 0 {
 		return mongo.ErrNoDocuments
 	}
+	if ur.ModifiedCount > 0 {
+		db.RecordTierChange(ctx, u.Sub, t)
+	}
 	u.Tier = t
+	u.Version++
+	return nil
+}
+
+// UserSetTrial grants the user the given trial tier until the given time. We
+// only set the trial fields, so processing the user's subscription never
+// affects their trial and vice versa.
+func (db *DB) UserSetTrial(ctx context.Context, u *User, tier int, until time.Time) error {
+	if tier <= TierFree || tier >= TierMaxReserved {
+		return errors.New("invalid trial tier value")
+	}
+	until = until.UTC().Truncate(time.Millisecond)
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{
+		"trial_tier":  tier,
+		"trial_until": until,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	oldTier := u.EffectiveTier()
+	u.TrialTier = tier
+	u.TrialUntil = until
+	u.Version++
+	if newTier := u.EffectiveTier(); newTier != oldTier {
+		db.RecordTierChange(ctx, u.Sub, newTier)
+	}
+	return nil
+}
+
+// UserSetAdminFlags suspends or unsuspends the user, unless suspended is nil,
+// and appends the given note, unless it's empty, to their admin notes.
+func (db *DB) UserSetAdminFlags(ctx context.Context, u *User, suspended *bool, note string) error {
+	update := bson.M{}
+	if suspended != nil {
+		update["$set"] = bson.M{"suspended": *suspended}
+	}
+	if note != "" {
+		update["$push"] = bson.M{"admin_notes": note}
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, bson.M{"_id": u.ID}, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	if suspended != nil {
+		u.Suspended = *suspended
+	}
+	if note != "" {
+		u.AdminNotes = append(u.AdminNotes, note)
+	}
+	u.Version++
+	return nil
+}
+
+// UserRecordPaymentFailure increments the user's count of consecutive failed
+// payments and records the time of the failure. The eventID identifies the
+// Stripe event which reported the failure. If we've already recorded it, we
+// return ErrPaymentFailureRecorded and leave the user unchanged.
+func (db *DB) UserRecordPaymentFailure(ctx context.Context, u *User, eventID string) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{
+		"_id":                    u.ID,
+		"payment_failure_events": bson.M{"$ne": eventID},
+	}
+	update := bson.M{
+		"$inc": bson.M{"payment_failures": 1},
+		"$set": bson.M{"last_payment_failure_at": now},
+		"$push": bson.M{"payment_failure_events": bson.M{
+			"$each":  bson.A{eventID},
+			"$slice": -maxPaymentFailureEvents,
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated User
+	err := db.staticUsers.FindOneAndUpdate(ctx, filter, withVersionBump(update), opts).Decode(&updated)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return ErrPaymentFailureRecorded
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to record payment failure")
+	}
+	u.PaymentFailures = updated.PaymentFailures
+	u.LastPaymentFailureAt = updated.LastPaymentFailureAt
+	u.PaymentFailureEvents = updated.PaymentFailureEvents
+	u.Version++
+	return nil
+}
+
+// UserLoginFailed records a failed login with a password. When the user
+// reaches the given number of consecutive failures we lock them out for the
+// given duration and reset their count. It returns true if this failure
+// locked the user out. A non-positive threshold disables locking.
+//
+// Failed logins abort the caller's transaction, so we record them outside of
+// it.
+func (db *DB) UserLoginFailed(ctx context.Context, u *User, threshold int, lockout time.Duration) (bool, error) {
+	ctx = WithoutTransaction(ctx)
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$inc": bson.M{"login_failures": 1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated User
+	err := db.staticUsers.FindOneAndUpdate(ctx, filter, withVersionBump(update), opts).Decode(&updated)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to record login failure")
+	}
+	u.LoginFailures = updated.LoginFailures
+	u.Version++
+	if threshold <= 0 || updated.LoginFailures < threshold {
+		return false, nil
+	}
+	// Only one of several concurrent failures gets to lock the user out, so
+	// we only notify them once.
+	lockedUntil := time.Now().UTC().Add(lockout).Truncate(time.Millisecond)
+	filter = bson.M{
+		"_id":            u.ID,
+		"login_failures": bson.M{"$gte": threshold},
+	}
+	update = bson.M{
+		"$set":   bson.M{"locked_until": lockedUntil},
+		"$unset": bson.M{"login_failures": ""},
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return false, errors.AddContext(err, "failed to lock user")
+	}
+	if ur.ModifiedCount == 0 {
+		return false, nil
+	}
+	u.LoginFailures = 0
+	u.LockedUntil = lockedUntil
+	u.Version++
+	return true, nil
+}
+
+// UserLoginSucceeded resets the user's count of consecutive failed logins and
+// lifts any expired lockout. Just like UserLoginFailed, it works outside of
+// the caller's transaction because logins which require a second factor
+// abort it.
+func (db *DB) UserLoginSucceeded(ctx context.Context, u *User) error {
+	if u.LoginFailures == 0 && u.LockedUntil.IsZero() {
+		return nil
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{
+		"login_failures": "",
+		"locked_until":   "",
+	}}
+	_, err := db.staticUsers.UpdateOne(WithoutTransaction(ctx), filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to reset login failures")
+	}
+	u.LoginFailures = 0
+	u.LockedUntil = time.Time{}
+	u.Version++
+	return nil
+}
+
+// UserResetPaymentFailures resets the user's count of consecutive failed
+// payments.
+func (db *DB) UserResetPaymentFailures(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{
+		"payment_failures":        "",
+		"last_payment_failure_at": "",
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, withVersionBump(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to reset payment failures")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	u.PaymentFailures = 0
+	u.LastPaymentFailureAt = time.Time{}
+	u.Version++
 	return nil
 }
 
 // managedUsersByField finds all users that have a given field value.
 // The calling method is responsible for the validation of the value.
-func (db *DB) managedUsersByField(ctx context.Context, fieldName, fieldValue string) ([]*User, error) {
+func (db *DB) managedUsersByField(ctx context.Context, fieldName string, fieldValue interface{}) ([]*User, error) {
 	c, err := db.staticUsers.Find(ctx, bson.M{fieldName: fieldValue})
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to find user")
@@ -612,6 +1326,60 @@ func (db *DB) managedUserBySub(ctx context.Context, sub string) (*User, error) {
 	return &u, nil
 }
 
+// PubKeyMeta returns the metadata of the given pubkey and true, or false if we
+// don't have any metadata for it.
+func (u User) PubKeyMeta(pk PubKey) (PubKeyMeta, bool) {
+	for _, m := range u.PubKeysMeta {
+		if bytes.Equal(m.Key, pk) {
+			return m, true
+		}
+	}
+	return PubKeyMeta{}, false
+}
+
+// Deleted returns true if the user has deleted their account and it's
+// waiting to be purged.
+func (u User) Deleted() bool {
+	return !u.DeletedAt.IsZero()
+}
+
+// Locked tells us whether the user is locked out of logging in with a
+// password.
+func (u User) Locked() bool {
+	return u.LockedUntil.After(time.Now().UTC())
+}
+
+// EffectiveTier returns the tier whose limits apply to the user. That's their
+// organization's tier, if they belong to one. Otherwise, it's the higher of
+// their paid tier and their trial tier, while the trial lasts.
+func (u User) EffectiveTier() int {
+	if u.InOrg() {
+		return u.OrgTier
+	}
+	return EffectiveTier(u.Tier, u.TrialTier, u.TrialUntil)
+}
+
+// InOrg returns true if the user belongs to an organization.
+func (u User) InOrg() bool {
+	return !u.OrgID.IsZero()
+}
+
+// EffectiveTier returns the higher of the given paid tier and trial tier, if
+// the trial lasts until after the current moment. Otherwise, it returns the
+// paid tier.
+func EffectiveTier(tier, trialTier int, trialUntil time.Time) int {
+	if trialTier > tier && trialUntil.After(time.Now().UTC()) {
+		return trialTier
+	}
+	return tier
+}
+
+// CanAddPubKey returns true if the user hasn't reached the maximum number of
+// pubkeys, yet.
+func (u User) CanAddPubKey() bool {
+	return len(u.PubKeys) < MaxNumPubKeysPerUser
+}
+
 // HasKey checks if the given pubkey is among the pubkeys registered for the
 // user.
 func (u User) HasKey(pk PubKey) bool {
@@ -662,10 +1430,13 @@ func monthStartWithTime(subscribedUntil time.Time, current time.Time) time.Time
 // Example:
 // In February normalizeDayOfMonth(31) will return 28 or 29.
 func normalizeDayOfMonth(year int, month time.Month, day int) int {
-	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
-	if t.Month() > month {
+	// Normalize the month first, so month 0 becomes December of the previous
+	// year.
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	t := time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, time.UTC)
+	if t.Month() != first.Month() {
 		// This month doesn't have this day. Return the last day of the month.
-		t = time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+		t = time.Date(first.Year(), first.Month()+1, 0, 0, 0, 0, 0, time.UTC)
 	}
 	return t.Day()
 }
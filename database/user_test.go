@@ -3,6 +3,9 @@ package database
 import (
 	"testing"
 	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // TestMonthStart ensures we calculate the start of the subscription month
@@ -50,6 +53,13 @@ func TestMonthStart(t *testing.T) {
 			checkedOn:    time.Date(2022, 1, 1, 2, 3, 4, 5, time.UTC),
 			startOfMonth: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
 		},
+		{
+			// The reset day is in the previous year.
+			// We expect the start of month to be the same day in December.
+			subUntil:     time.Date(2020, 1, 15, 3, 4, 5, 6, time.UTC),
+			checkedOn:    time.Date(2022, 1, 10, 2, 3, 4, 5, time.UTC),
+			startOfMonth: time.Date(2021, 12, 15, 0, 0, 0, 0, time.UTC),
+		},
 	}
 
 	df := "2006-01-02"
@@ -61,3 +71,73 @@ func TestMonthStart(t *testing.T) {
 		}
 	}
 }
+
+// TestUserEffectiveTier ensures that the trial tier only applies while the
+// trial lasts and only when it's higher than the paid tier.
+func TestUserEffectiveTier(t *testing.T) {
+	future := time.Now().UTC().Add(time.Hour)
+	past := time.Now().UTC().Add(-time.Hour)
+	tests := []struct {
+		u    User
+		tier int
+	}{
+		{u: User{Tier: TierFree}, tier: TierFree},
+		{u: User{Tier: TierFree, TrialTier: TierPremium5, TrialUntil: future}, tier: TierPremium5},
+		{u: User{Tier: TierFree, TrialTier: TierPremium5, TrialUntil: past}, tier: TierFree},
+		{u: User{Tier: TierPremium20, TrialTier: TierPremium5, TrialUntil: future}, tier: TierPremium20},
+		{u: User{Tier: TierPremium5, TrialTier: TierPremium80, TrialUntil: future}, tier: TierPremium80},
+	}
+	for _, tt := range tests {
+		if tier := tt.u.EffectiveTier(); tier != tt.tier {
+			t.Errorf("Expected tier %d for %+v, got %d", tt.tier, tt.u, tier)
+		}
+	}
+}
+
+// TestMergeUsers ensures that merging users keeps the higher tier, the earlier
+// creation time and all pubkeys, and that it only takes the other user's email
+// and Stripe customer when the surviving user doesn't have their own.
+func TestMergeUsers(t *testing.T) {
+	earlier := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	later := earlier.Add(time.Minute)
+	pk1, pk2 := PubKey("key1"), PubKey("key2")
+	dst := User{Email: "dst@siasky.net", PasswordHash: "dst", Tier: TierFree, CreatedAt: later, PubKeys: []PubKey{pk1}}
+	src := User{Tier: TierPremium20, CreatedAt: earlier, StripeID: "cus_src", SubscriptionStatus: "active", PubKeys: []PubKey{pk1, pk2}}
+	m, err := mergeUsers(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Tier != TierPremium20 || !m.CreatedAt.Equal(earlier) {
+		t.Fatalf("Expected the higher tier and the earlier creation time, got %d and %v", m.Tier, m.CreatedAt)
+	}
+	if m.Email != dst.Email || m.PasswordHash != dst.PasswordHash {
+		t.Fatalf("Expected to keep the email and password, got %s and %s", m.Email, m.PasswordHash)
+	}
+	if m.StripeID != src.StripeID || m.SubscriptionStatus != src.SubscriptionStatus {
+		t.Fatalf("Expected the other user's subscription, got %s and %s", m.StripeID, m.SubscriptionStatus)
+	}
+	if len(m.PubKeys) != 2 || !m.HasKey(pk1) || !m.HasKey(pk2) {
+		t.Fatalf("Expected both pubkeys once, got %v", m.PubKeys)
+	}
+
+	// A pubkey-only user takes the email and password of the other user.
+	m, err = mergeUsers(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Email != dst.Email || m.PasswordHash != dst.PasswordHash || m.StripeID != src.StripeID {
+		t.Fatalf("Unexpected merged user %+v", m)
+	}
+
+	// We can't merge two Stripe customers or members of organizations.
+	dst.StripeID = "cus_dst"
+	_, err = mergeUsers(dst, src)
+	if !errors.Contains(err, ErrMergeStripeConflict) {
+		t.Fatalf("Expected '%v', got '%v'", ErrMergeStripeConflict, err)
+	}
+	src = User{OrgID: primitive.NewObjectID()}
+	_, err = mergeUsers(dst, src)
+	if !errors.Contains(err, ErrUserInOrg) {
+		t.Fatalf("Expected '%v', got '%v'", ErrUserInOrg, err)
+	}
+}
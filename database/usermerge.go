@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrMergeSameUser is returned when the user tries to merge their account
+	// into itself.
+	ErrMergeSameUser = errors.New("cannot merge an account into itself")
+	// ErrMergeStripeConflict is returned when both accounts we're asked to
+	// merge have a Stripe customer. We can't merge their subscriptions
+	// automatically.
+	ErrMergeStripeConflict = errors.New("both accounts have a payment profile, please contact support to merge them")
+)
+
+// UserMerge moves all data of the src user to the dst user and deletes src.
+// That includes their uploads, downloads, registry reads and writes, API keys,
+// pubkeys and audit log. The merged user keeps the higher of the two tiers and
+// the earlier creation time. If dst doesn't have an email address or a Stripe
+// customer, it takes src's. It all happens in a single transaction, so we
+// either merge everything or nothing. It fails with ErrMergeStripeConflict if
+// both users have a Stripe customer and with ErrUserInOrg if src belongs to an
+// organization.
+func (db *DB) UserMerge(ctx context.Context, dst, src *User) error {
+	if dst.ID.IsZero() || src.ID.IsZero() {
+		return errors.AddContext(ErrUserNotFound, "user struct not fully initialised")
+	}
+	if dst.ID == src.ID {
+		return ErrMergeSameUser
+	}
+	sess, err := db.NewSession()
+	if err != nil {
+		return errors.AddContext(err, "failed to start a new mongo session")
+	}
+	defer sess.EndSession(ctx)
+	var merged User
+	var oldTier int
+	_, err = sess.WithTransaction(ctx, func(sctx mongo.SessionContext) (interface{}, error) {
+		// Work with fresh copies of the users, so we don't lose any changes
+		// made since the caller fetched them.
+		var d, s User
+		err := db.staticUsers.FindOne(sctx, bson.M{"_id": dst.ID}).Decode(&d)
+		if err == nil {
+			err = db.staticUsers.FindOne(sctx, bson.M{"_id": src.ID}).Decode(&s)
+		}
+		if errors.Contains(err, mongo.ErrNoDocuments) {
+			return nil, ErrUserNotFound
+		}
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to fetch users")
+		}
+		oldTier = d.Tier
+		merged, err = mergeUsers(d, s)
+		if err != nil {
+			return nil, err
+		}
+		filter := bson.M{"user_id": src.ID}
+		update := bson.M{"$set": bson.M{"user_id": dst.ID}}
+		for _, coll := range []*mongo.Collection{db.staticUploads, db.staticDownloads, db.staticRegistryReads, db.staticRegistryWrites, db.staticAPIKeys, db.staticAuditLog} {
+			_, err := coll.UpdateMany(sctx, filter, update)
+			if err != nil {
+				return nil, errors.AddContext(err, "failed to reassign "+coll.Name())
+			}
+		}
+		_, err = db.staticUnconfirmedUserUpdates.DeleteMany(sctx, bson.M{"sub": src.Sub})
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to delete unconfirmed updates")
+		}
+		_, err = db.staticSessions.DeleteMany(sctx, bson.M{"sub": src.Sub})
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to delete sessions")
+		}
+		_, err = db.staticStorageUsage.DeleteOne(sctx, bson.M{"_id": src.ID})
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to delete storage usage")
+		}
+		// Delete src before we update dst, so its email and pubkeys are free
+		// to take.
+		dr, err := db.staticUsers.DeleteOne(sctx, bson.M{"_id": src.ID})
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to delete merged user")
+		}
+		if dr.DeletedCount == 0 {
+			return nil, ErrUserNotFound
+		}
+		// Replacing the user is a change like any other, so stale copies
+		// of it mustn't overwrite the merge.
+		merged.Version++
+		ur, err := db.staticUsers.ReplaceOne(sctx, bson.M{"_id": dst.ID}, merged)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, errors.AddContext(ErrUserAlreadyExists, "another user has the same email")
+		}
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to update user")
+		}
+		if ur.MatchedCount == 0 {
+			return nil, ErrUserNotFound
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	db.managedRecordChangeEvent(ctx, ChangeEvent{
+		Type: ChangeEventUserDeleted,
+		Sub:  src.Sub,
+	})
+	if merged.Tier != oldTier {
+		db.RecordTierChange(ctx, dst.Sub, merged.Tier)
+	}
+	*dst = merged
+	return nil
+}
+
+// mergeUsers returns dst with the tier, creation time, email, Stripe customer
+// and pubkeys of src merged in.
+func mergeUsers(dst, src User) (User, error) {
+	if dst.StripeID != "" && src.StripeID != "" {
+		return User{}, ErrMergeStripeConflict
+	}
+	if src.InOrg() {
+		return User{}, errors.AddContext(ErrUserInOrg, "the merged account needs to leave its organization first")
+	}
+	if src.Tier > dst.Tier {
+		dst.Tier = src.Tier
+	}
+	if !src.CreatedAt.IsZero() && (dst.CreatedAt.IsZero() || src.CreatedAt.Before(dst.CreatedAt)) {
+		dst.CreatedAt = src.CreatedAt
+	}
+	if dst.Email == "" && src.Email != "" {
+		dst.Email = src.Email
+		dst.PasswordHash = src.PasswordHash
+		dst.EmailConfirmationToken = src.EmailConfirmationToken
+		dst.EmailConfirmationTokenExpiration = src.EmailConfirmationTokenExpiration
+	}
+	if dst.StripeID == "" && src.StripeID != "" {
+		dst.StripeID = src.StripeID
+		dst.SubscribedUntil = src.SubscribedUntil
+		dst.SubscriptionStatus = src.SubscriptionStatus
+		dst.SubscriptionCancelAt = src.SubscriptionCancelAt
+		dst.SubscriptionCancelAtPeriodEnd = src.SubscriptionCancelAtPeriodEnd
+	}
+	for _, pk := range src.PubKeys {
+		if dst.HasKey(pk) {
+			continue
+		}
+		dst.PubKeys = append(dst.PubKeys, pk)
+		if meta, ok := src.PubKeyMeta(pk); ok {
+			dst.PubKeysMeta = append(dst.PubKeysMeta, meta)
+		}
+	}
+	return dst, nil
+}
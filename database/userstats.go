@@ -12,6 +12,12 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+const (
+	// UserStatsTopMax is the maximum number of skylinks we report in the
+	// top uploads and downloads of a user.
+	UserStatsTopMax = 50
+)
+
 type (
 	// UserStats contains statistical information about the user.
 	// "Total" is a prefix in JSON form because of backwards compatibility.
@@ -56,6 +62,9 @@ type (
 		RawStorageUsedTotal int64
 		Bandwidth           int64
 		BandwidthTotal      int64
+		// UnknownSizeTotal is the number of pinned skylinks whose size we
+		// don't know yet. They don't contribute to SizeTotal.
+		UnknownSizeTotal int64
 	}
 	// UserStatsDownload reports the download stats of a given user. It holds
 	// the stats for the current period, as well as the total stats.
@@ -83,6 +92,36 @@ type (
 		Bandwidth      int64
 		BandwidthTotal int64
 	}
+	// UserStatsTopUpload describes one of the largest skylinks the user
+	// uploaded during the current period.
+	UserStatsTopUpload struct {
+		Skylink    string `bson:"skylink" json:"skylink"`
+		Name       string `bson:"name" json:"name"`
+		Size       int64  `bson:"size" json:"size"`
+		RawStorage int64  `bson:"-" json:"rawStorage"`
+	}
+	// UserStatsTopDownload describes one of the skylinks the user downloaded
+	// the most bytes of during the current period.
+	UserStatsTopDownload struct {
+		Skylink string `bson:"skylink" json:"skylink"`
+		Count   int64  `bson:"count" json:"count"`
+		Bytes   int64  `bson:"bytes" json:"bytes"`
+	}
+	// APIKeyUsage reports the usage generated with a single API key during
+	// the user's current billing period.
+	APIKeyUsage struct {
+		PeriodStart    time.Time        `json:"periodStart"`
+		Uploads        APIKeyUsageStats `json:"uploads"`
+		Downloads      APIKeyUsageStats `json:"downloads"`
+		RegistryReads  APIKeyUsageStats `json:"registryReads"`
+		RegistryWrites APIKeyUsageStats `json:"registryWrites"`
+	}
+	// APIKeyUsageStats holds the number of operations of a given type and the
+	// bandwidth they used.
+	APIKeyUsageStats struct {
+		Count     int64 `json:"count"`
+		Bandwidth int64 `json:"bandwidth"`
+	}
 )
 
 // UserStats returns statistical information about the user.
@@ -179,7 +218,12 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 // UserStatsUpload reports on the user's uploads - count, total size and total
 // bandwidth used. It uses the total size of the uploaded skyfiles as basis.
 func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since time.Time) (stats UserStatsUpload, err error) {
-	matchStage := bson.D{{"$match", bson.M{"user_id": id}}}
+	return db.uploadStats(ctx, bson.M{"user_id": id}, since)
+}
+
+// uploadStats reports on the uploads which match the given filter.
+func (db *DB) uploadStats(ctx context.Context, filter bson.M, since time.Time) (stats UserStatsUpload, err error) {
+	matchStage := bson.D{{"$match", filter}}
 	lookupStage := bson.D{
 		{"$lookup", bson.D{
 			{"from", "skylinks"},
@@ -207,7 +251,7 @@ func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since
 	}}}
 
 	pipeline := mongo.Pipeline{matchStage, lookupStage, replaceStage, projectStage}
-	c, err := db.staticUploads.Aggregate(ctx, pipeline)
+	c, err := aggregate(ctx, db.staticUploads, pipeline)
 	if err != nil {
 		return
 	}
@@ -245,6 +289,9 @@ func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since
 		if !processedSkylinks[result.Skylink] {
 			stats.SizeTotal += result.Size
 			stats.RawStorageUsedTotal += skynet.RawStorageUsed(result.Size)
+			if result.Size == 0 {
+				stats.UnknownSizeTotal++
+			}
 		}
 		// Check against the time threshold before continuing with the period
 		// counts.
@@ -263,9 +310,12 @@ func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since
 // userDownloadStats reports on the user's downloads - count, total size and
 // total bandwidth used. It uses the actual bandwidth used, as reported by nginx.
 func (db *DB) userDownloadStats(ctx context.Context, id primitive.ObjectID, since time.Time) (stats UserStatsDownload, err error) {
-	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", id},
-	}}}
+	return db.downloadStats(ctx, bson.M{"user_id": id}, since)
+}
+
+// downloadStats reports on the downloads which match the given filter.
+func (db *DB) downloadStats(ctx context.Context, filter bson.M, since time.Time) (stats UserStatsDownload, err error) {
+	matchStage := bson.D{{"$match", filter}}
 	lookupStage := bson.D{
 		{"$lookup", bson.D{
 			{"from", "skylinks"},
@@ -298,7 +348,7 @@ func (db *DB) userDownloadStats(ctx context.Context, id primitive.ObjectID, sinc
 	}}}
 
 	pipeline := mongo.Pipeline{matchStage, lookupStage, replaceStage, projectStage}
-	c, err := db.staticDownloads.Aggregate(ctx, pipeline)
+	c, err := aggregate(ctx, db.staticDownloads, pipeline)
 	if err != nil {
 		err = errors.AddContext(err, "DB query failed")
 		return
@@ -334,17 +384,18 @@ func (db *DB) userDownloadStats(ctx context.Context, id primitive.ObjectID, sinc
 // userRegistryWriteStats reports the number of registry writes by the user and
 // the bandwidth used.
 func (db *DB) userRegistryWriteStats(ctx context.Context, userID primitive.ObjectID, since time.Time) (stats UserStatsRegWrites, err error) {
-	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", userID},
-		{"timestamp", bson.D{{"$gt", since}}},
-	}}}
+	return db.registryWriteStats(ctx, bson.M{"user_id": userID}, since)
+}
+
+// registryWriteStats reports the number of registry writes which match the
+// given filter and the bandwidth used.
+func (db *DB) registryWriteStats(ctx context.Context, filter bson.M, since time.Time) (stats UserStatsRegWrites, err error) {
+	matchStage := bson.D{{"$match", filterSince(filter, "timestamp", since)}}
 	writes, err := db.count(ctx, db.staticRegistryWrites, matchStage)
 	if err != nil {
 		return stats, errors.AddContext(err, "failed to fetch registry write bandwidth")
 	}
-	matchStage = bson.D{{"$match", bson.D{
-		{"user_id", userID},
-	}}}
+	matchStage = bson.D{{"$match", filter}}
 	writesTotal, err := db.count(ctx, db.staticRegistryWrites, matchStage)
 	if err != nil {
 		return stats, errors.AddContext(err, "failed to fetch registry write bandwidth")
@@ -359,17 +410,18 @@ func (db *DB) userRegistryWriteStats(ctx context.Context, userID primitive.Objec
 // userRegistryReadsStats reports the number of registry reads by the user and
 // the bandwidth used.
 func (db *DB) userRegistryReadStats(ctx context.Context, userID primitive.ObjectID, monthStart time.Time) (stats UserStatsRegReads, err error) {
-	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", userID},
-		{"timestamp", bson.D{{"$gt", monthStart}}},
-	}}}
+	return db.registryReadStats(ctx, bson.M{"user_id": userID}, monthStart)
+}
+
+// registryReadStats reports the number of registry reads which match the
+// given filter and the bandwidth used.
+func (db *DB) registryReadStats(ctx context.Context, filter bson.M, since time.Time) (stats UserStatsRegReads, err error) {
+	matchStage := bson.D{{"$match", filterSince(filter, "timestamp", since)}}
 	reads, err := db.count(ctx, db.staticRegistryReads, matchStage)
 	if err != nil {
 		return stats, errors.AddContext(err, "failed to fetch registry read bandwidth")
 	}
-	matchStage = bson.D{{"$match", bson.D{
-		{"user_id", userID},
-	}}}
+	matchStage = bson.D{{"$match", filter}}
 	readsTotal, err := db.count(ctx, db.staticRegistryReads, matchStage)
 	if err != nil {
 		return stats, errors.AddContext(err, "failed to fetch registry read bandwidth")
@@ -380,3 +432,151 @@ func (db *DB) userRegistryReadStats(ctx context.Context, userID primitive.Object
 	stats.BandwidthTotal = readsTotal * skynet.CostBandwidthRegistryRead
 	return stats, nil
 }
+
+// APIKeyUsage reports the usage generated with the given API key during the
+// user's current billing period. Operations which were not authenticated
+// with an API key, including all operations from before we started recording
+// API keys, are not attributed to any key.
+func (db *DB) APIKeyUsage(ctx context.Context, user User, akID primitive.ObjectID) (*APIKeyUsage, error) {
+	if akID.IsZero() {
+		return nil, ErrInvalidAPIKey
+	}
+	filter := bson.M{"user_id": user.ID, "api_key_id": akID}
+	usage := APIKeyUsage{
+		PeriodStart: monthStart(user.SubscribedUntil),
+	}
+	upStats, err := db.uploadStats(ctx, filter, usage.PeriodStart)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get upload stats")
+	}
+	usage.Uploads = APIKeyUsageStats{Count: upStats.Count, Bandwidth: upStats.Bandwidth}
+	downStats, err := db.downloadStats(ctx, filter, usage.PeriodStart)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get download stats")
+	}
+	usage.Downloads = APIKeyUsageStats{Count: downStats.Count, Bandwidth: downStats.Bandwidth}
+	rrStats, err := db.registryReadStats(ctx, filter, usage.PeriodStart)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get registry read stats")
+	}
+	usage.RegistryReads = APIKeyUsageStats{Count: rrStats.Count, Bandwidth: rrStats.Bandwidth}
+	rwStats, err := db.registryWriteStats(ctx, filter, usage.PeriodStart)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get registry write stats")
+	}
+	usage.RegistryWrites = APIKeyUsageStats{Count: rwStats.Count, Bandwidth: rwStats.Bandwidth}
+	return &usage, nil
+}
+
+// UserStatsTopUploads returns the n largest skylinks the user uploaded during
+// the current period and hasn't unpinned, largest first. Skylinks the user
+// uploaded several times only appear once. The sizes only live in the
+// skylinks collection, so we only fetch the sizes before sorting and limiting
+// and fetch the rest of the skylinks' data for the top n only.
+func (db *DB) UserStatsTopUploads(ctx context.Context, user User, n int) ([]UserStatsTopUpload, error) {
+	if n < 1 || n > UserStatsTopMax {
+		return nil, errors.New("invalid number of skylinks")
+	}
+	filter := filterSince(bson.M{"user_id": user.ID, "unpinned": bson.M{"$ne": true}}, "timestamp", monthStart(user.SubscribedUntil))
+	pipeline := mongo.Pipeline{
+		{{"$match", filter}},
+		{{"$group", bson.D{{"_id", "$skylink_id"}}}},
+		{{"$lookup", bson.D{
+			{"from", collSkylinks},
+			{"let", bson.D{{"skylink_id", "$_id"}}},
+			{"pipeline", mongo.Pipeline{
+				{{"$match", bson.D{{"$expr", bson.D{{"$eq", bson.A{"$_id", "$$skylink_id"}}}}}}},
+				{{"$project", bson.D{{"_id", 0}, {"size", 1}}}},
+			}},
+			{"as", "size_data"},
+		}}},
+		{{"$unwind", "$size_data"}},
+		{{"$sort", bson.D{{"size_data.size", -1}, {"_id", 1}}}},
+		{{"$limit", n}},
+		{{"$lookup", bson.D{
+			{"from", collSkylinks},
+			{"localField", "_id"},
+			{"foreignField", "_id"},
+			{"as", "skylink_data"},
+		}}},
+		{{"$unwind", "$skylink_data"}},
+		{{"$project", bson.D{
+			{"_id", 0},
+			{"skylink", "$skylink_data.skylink"},
+			{"name", "$skylink_data.name"},
+			{"size", "$skylink_data.size"},
+		}}},
+	}
+	c, err := aggregate(ctx, db.staticUploads, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "DB query failed")
+	}
+	top := make([]UserStatsTopUpload, 0, n)
+	if err = c.All(ctx, &top); err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	for i := range top {
+		top[i].RawStorage = skynet.RawStorageUsed(top[i].Size)
+	}
+	return top, nil
+}
+
+// UserStatsTopDownloads returns the n skylinks the user downloaded the most
+// bytes of during the current period, along with the number of downloads of
+// each. Same as in the download stats, downloads which don't report their
+// bytes count with the full size of the skylink. We group the downloads by
+// skylink before looking up the skylinks, so we look up each skylink once.
+func (db *DB) UserStatsTopDownloads(ctx context.Context, user User, n int) ([]UserStatsTopDownload, error) {
+	if n < 1 || n > UserStatsTopMax {
+		return nil, errors.New("invalid number of skylinks")
+	}
+	filter := filterSince(bson.M{"user_id": user.ID}, "created_at", monthStart(user.SubscribedUntil))
+	reported := bson.D{{"$gt", bson.A{"$bytes", 0}}}
+	pipeline := mongo.Pipeline{
+		{{"$match", filter}},
+		{{"$group", bson.D{
+			{"_id", "$skylink_id"},
+			{"count", bson.D{{"$sum", 1}}},
+			{"bytes", bson.D{{"$sum", bson.D{{"$cond", bson.A{reported, "$bytes", 0}}}}}},
+			{"unreported", bson.D{{"$sum", bson.D{{"$cond", bson.A{reported, 0, 1}}}}}},
+		}}},
+		{{"$lookup", bson.D{
+			{"from", collSkylinks},
+			{"localField", "_id"},
+			{"foreignField", "_id"},
+			{"as", "skylink_data"},
+		}}},
+		{{"$unwind", "$skylink_data"}},
+		{{"$project", bson.D{
+			{"_id", 0},
+			{"skylink", "$skylink_data.skylink"},
+			{"count", 1},
+			{"bytes", bson.D{{"$add", bson.A{
+				"$bytes",
+				bson.D{{"$multiply", bson.A{"$unreported", "$skylink_data.size"}}},
+			}}}},
+		}}},
+		{{"$sort", bson.D{{"bytes", -1}, {"count", -1}, {"skylink", 1}}}},
+		{{"$limit", n}},
+	}
+	c, err := aggregate(ctx, db.staticDownloads, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "DB query failed")
+	}
+	top := make([]UserStatsTopDownload, 0, n)
+	if err = c.All(ctx, &top); err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	return top, nil
+}
+
+// filterSince returns a copy of the given filter which additionally requires
+// the given time field to be after `since`.
+func filterSince(filter bson.M, field string, since time.Time) bson.M {
+	f := make(bson.M, len(filter)+1)
+	for k, v := range filter {
+		f[k] = v
+	}
+	f[field] = bson.M{"$gt": since}
+	return f
+}
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// UserStatsHistoryMaxMonths is the maximum number of months of usage
+	// history we report.
+	UserStatsHistoryMaxMonths = 24
+)
+
+type (
+	// UserStatsMonth holds the user's usage during a single billing month.
+	// The months follow the user's subscription, just like the periods of
+	// UserStats do.
+	UserStatsMonth struct {
+		PeriodStart time.Time `json:"periodStart"`
+		PeriodEnd   time.Time `json:"periodEnd"`
+
+		NumUploads   int64 `json:"numUploads"`
+		NumDownloads int64 `json:"numDownloads"`
+		NumRegReads  int64 `json:"numRegReads"`
+		NumRegWrites int64 `json:"numRegWrites"`
+
+		BandwidthUploads   int64 `json:"bwUploads"`
+		BandwidthDownloads int64 `json:"bwDownloads"`
+		BandwidthRegReads  int64 `json:"bwRegReads"`
+		BandwidthRegWrites int64 `json:"bwRegWrites"`
+
+		// RawStorageUsed is the storage used by the user's uploads at the end
+		// of the month. It only takes into account uploads which are still
+		// pinned.
+		RawStorageUsed int64 `json:"rawStorageUsed"`
+	}
+
+	// monthlyBucket holds the number of documents which fall within a given
+	// period and the sum of an arbitrary expression over them.
+	monthlyBucket struct {
+		ID    interface{} `bson:"_id"`
+		Count int64       `bson:"count"`
+		Sum   int64       `bson:"sum"`
+	}
+)
+
+// UserStatsHistory reports the user's usage during each of their last `months`
+// billing months, including the current one. The months are ordered from the
+// oldest to the current one.
+func (db *DB) UserStatsHistory(ctx context.Context, user User, months int) ([]UserStatsMonth, error) {
+	if months < 1 || months > UserStatsHistoryMaxMonths {
+		return nil, errors.New("invalid number of months")
+	}
+	hist := billingMonths(user.SubscribedUntil, time.Now().UTC(), months)
+	err := db.UserStatsUploadHistory(ctx, user.ID, hist)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get upload history")
+	}
+	err = db.UserStatsDownloadHistory(ctx, user.ID, hist)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get download history")
+	}
+	err = db.UserStatsRegistryHistory(ctx, user.ID, hist)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to get registry history")
+	}
+	return hist, nil
+}
+
+// UserStatsUploadHistory fills in the upload stats of the given months.
+func (db *DB) UserStatsUploadHistory(ctx context.Context, userID primitive.ObjectID, hist []UserStatsMonth) error {
+	boundaries := historyBoundaries(hist)
+	// All uploads count towards bandwidth, regardless of their pinned status.
+	pipeline := append(mongo.Pipeline{bson.D{{"$match", bson.M{"user_id": userID}}}}, skylinksJoinStages()...)
+	buckets, err := db.monthlyBuckets(ctx, db.staticUploads, pipeline, "timestamp", chunksExpr("$size"), boundaries)
+	if err != nil {
+		return err
+	}
+	for i, b := range buckets {
+		hist[i].BandwidthUploads = b.Count*skynet.CostBandwidthUploadBase + b.Sum*skynet.CostBandwidthUploadIncrement
+	}
+	// Only uploads which are still pinned count towards the number of
+	// uploads.
+	pipeline = mongo.Pipeline{bson.D{{"$match", bson.M{"user_id": userID, "unpinned": false}}}}
+	buckets, err = db.monthlyBuckets(ctx, db.staticUploads, pipeline, "timestamp", 0, boundaries)
+	if err != nil {
+		return err
+	}
+	for i, b := range buckets {
+		hist[i].NumUploads = b.Count
+	}
+	// Each pinned skylink counts towards storage once, from the month in
+	// which the user first uploaded it. We add a bucket at the start, so we
+	// can include the uploads from before the oldest month.
+	pipeline = mongo.Pipeline{
+		bson.D{{"$match", bson.M{"user_id": userID, "unpinned": false}}},
+		bson.D{{"$group", bson.D{
+			{"_id", "$skylink_id"},
+			{"timestamp", bson.D{{"$min", "$timestamp"}}},
+		}}},
+		bson.D{{"$project", bson.D{
+			{"skylink_id", "$_id"},
+			{"timestamp", 1},
+		}}},
+	}
+	pipeline = append(pipeline, skylinksJoinStages()...)
+	boundaries = append([]time.Time{time.Unix(0, 0).UTC()}, boundaries...)
+	buckets, err = db.monthlyBuckets(ctx, db.staticUploads, pipeline, "timestamp", chunksExpr("$size"), boundaries)
+	if err != nil {
+		return err
+	}
+	var storage int64
+	for i, b := range buckets {
+		storage += b.Count*skynet.CostStorageUploadBase*skynet.RedundancyBaseSector +
+			b.Sum*skynet.CostStorageUploadIncrement*skynet.RedundancyChunk
+		if i > 0 {
+			hist[i-1].RawStorageUsed = storage
+		}
+	}
+	return nil
+}
+
+// UserStatsDownloadHistory fills in the download stats of the given months.
+func (db *DB) UserStatsDownloadHistory(ctx context.Context, userID primitive.ObjectID, hist []UserStatsMonth) error {
+	pipeline := append(mongo.Pipeline{bson.D{{"$match", bson.M{"user_id": userID}}}}, skylinksJoinStages()...)
+	// Partial downloads are counted by their `bytes`, just like in
+	// downloadStats. The download cost is charged per 64 bytes.
+	size := bson.D{{"$cond", bson.A{
+		bson.D{{"$gt", bson.A{"$bytes", 0}}},
+		"$bytes",
+		"$size",
+	}}}
+	increments := bson.D{{"$ceil", bson.D{{"$divide", bson.A{size, 64}}}}}
+	buckets, err := db.monthlyBuckets(ctx, db.staticDownloads, pipeline, "created_at", increments, historyBoundaries(hist))
+	if err != nil {
+		return err
+	}
+	for i, b := range buckets {
+		hist[i].NumDownloads = b.Count
+		hist[i].BandwidthDownloads = b.Count*skynet.CostBandwidthDownloadBase + b.Sum*skynet.CostBandwidthDownloadIncrement
+	}
+	return nil
+}
+
+// UserStatsRegistryHistory fills in the registry read and write stats of the
+// given months.
+func (db *DB) UserStatsRegistryHistory(ctx context.Context, userID primitive.ObjectID, hist []UserStatsMonth) error {
+	boundaries := historyBoundaries(hist)
+	pipeline := mongo.Pipeline{bson.D{{"$match", bson.M{"user_id": userID}}}}
+	buckets, err := db.monthlyBuckets(ctx, db.staticRegistryReads, pipeline, "timestamp", 0, boundaries)
+	if err != nil {
+		return err
+	}
+	for i, b := range buckets {
+		hist[i].NumRegReads = b.Count
+		hist[i].BandwidthRegReads = b.Count * skynet.CostBandwidthRegistryRead
+	}
+	buckets, err = db.monthlyBuckets(ctx, db.staticRegistryWrites, pipeline, "timestamp", 0, boundaries)
+	if err != nil {
+		return err
+	}
+	for i, b := range buckets {
+		hist[i].NumRegWrites = b.Count
+		hist[i].BandwidthRegWrites = b.Count * skynet.CostBandwidthRegistryWrite
+	}
+	return nil
+}
+
+// monthlyBuckets groups the documents coming out of the given pipeline by the
+// period between the given boundaries in which their time field falls. For
+// each period it returns the number of documents and the sum of the given
+// expression over them. Documents outside of the boundaries are ignored.
+func (db *DB) monthlyBuckets(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, field string, sumExpr interface{}, boundaries []time.Time) ([]monthlyBucket, error) {
+	bounds := make(bson.A, 0, len(boundaries))
+	for _, b := range boundaries {
+		bounds = append(bounds, b)
+	}
+	bucketStage := bson.D{{"$bucket", bson.D{
+		{"groupBy", "$" + field},
+		{"boundaries", bounds},
+		{"default", "other"},
+		{"output", bson.D{
+			{"count", bson.D{{"$sum", 1}}},
+			{"sum", bson.D{{"$sum", sumExpr}}},
+		}},
+	}}}
+	p := append(mongo.Pipeline{}, pipeline...)
+	c, err := aggregate(ctx, coll, append(p, bucketStage))
+	if err != nil {
+		return nil, errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	// Map each bucket to the period it belongs to by its lower boundary.
+	idx := make(map[int64]int, len(boundaries))
+	for i, b := range boundaries {
+		idx[b.UnixMilli()] = i
+	}
+	buckets := make([]monthlyBucket, len(boundaries)-1)
+	for c.Next(ctx) {
+		var b monthlyBucket
+		if err = c.Decode(&b); err != nil {
+			return nil, errors.AddContext(err, "failed to decode DB data")
+		}
+		start, ok := b.ID.(primitive.DateTime)
+		if !ok {
+			// This is the default bucket.
+			continue
+		}
+		i, ok := idx[start.Time().UnixMilli()]
+		if !ok || i >= len(buckets) {
+			continue
+		}
+		buckets[i] = b
+	}
+	return buckets, nil
+}
+
+// billingMonths returns the last `months` billing months of a user with the
+// given subscription expiration, ordered from the oldest to the one which
+// contains `now`. The current month ends at `now`.
+func billingMonths(subscribedUntil, now time.Time, months int) []UserStatsMonth {
+	hist := make([]UserStatsMonth, months)
+	end := now
+	for i := months - 1; i >= 0; i-- {
+		start := monthStartWithTime(subscribedUntil, end.Add(-time.Nanosecond))
+		hist[i] = UserStatsMonth{PeriodStart: start, PeriodEnd: end}
+		end = start
+	}
+	return hist
+}
+
+// historyBoundaries returns the starts of all given months, followed by the
+// end of the last one.
+func historyBoundaries(hist []UserStatsMonth) []time.Time {
+	boundaries := make([]time.Time, 0, len(hist)+1)
+	for _, m := range hist {
+		boundaries = append(boundaries, m.PeriodStart)
+	}
+	return append(boundaries, hist[len(hist)-1].PeriodEnd)
+}
+
+// chunksExpr returns an aggregation expression which calculates the number of
+// chunks an upload of the given size uses beyond its base sector, the same way
+// the skynet package does it when calculating bandwidth and storage costs.
+func chunksExpr(size interface{}) bson.D {
+	return bson.D{{"$cond", bson.A{
+		bson.D{{"$lte", bson.A{size, skynet.SizeBaseSector}}},
+		0,
+		bson.D{{"$ceil", bson.D{{"$divide", bson.A{
+			bson.D{{"$subtract", bson.A{size, skynet.SizeBaseSector}}},
+			skynet.SizeChunk,
+		}}}}},
+	}}}
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBillingMonths ensures billingMonths returns consecutive months which
+// follow the user's subscription.
+func TestBillingMonths(t *testing.T) {
+	subUntil := time.Date(2020, 1, 31, 3, 4, 5, 6, time.UTC)
+	now := time.Date(2022, 3, 10, 12, 13, 14, 15, time.UTC)
+	hist := billingMonths(subUntil, now, 4)
+	expected := []time.Time{
+		time.Date(2021, 11, 30, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC),
+	}
+	if len(hist) != len(expected) {
+		t.Fatalf("Expected %d months, got %d", len(expected), len(hist))
+	}
+	for i, m := range hist {
+		if !m.PeriodStart.Equal(expected[i]) {
+			t.Fatalf("Expected month %d to start on %s, got %s", i, expected[i], m.PeriodStart)
+		}
+		end := now
+		if i < len(hist)-1 {
+			end = expected[i+1]
+		}
+		if !m.PeriodEnd.Equal(end) {
+			t.Fatalf("Expected month %d to end on %s, got %s", i, end, m.PeriodEnd)
+		}
+	}
+	// The current month is the one monthStart reports.
+	if s := monthStartWithTime(subUntil, now); !hist[len(hist)-1].PeriodStart.Equal(s) {
+		t.Fatalf("Expected the current month to start on %s, got %s", s, hist[len(hist)-1].PeriodStart)
+	}
+	boundaries := historyBoundaries(hist)
+	if len(boundaries) != len(hist)+1 || !boundaries[len(hist)].Equal(now) {
+		t.Fatalf("Unexpected boundaries %v", boundaries)
+	}
+}
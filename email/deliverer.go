@@ -0,0 +1,35 @@
+package email
+
+import (
+	"context"
+	"strings"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+)
+
+type (
+	// Deliverer hands email messages over to an external service which
+	// delivers them to their recipients. The Sender uses it for the actual
+	// sending, so the retries of failed messages work the same way regardless
+	// of the service we use.
+	Deliverer interface {
+		// Deliver sends the given message. It returns an error if the message
+		// was not accepted for delivery.
+		Deliver(ctx context.Context, msg database.EmailMessage) error
+	}
+)
+
+// NewDeliverer returns a Deliverer which matches the scheme of the given email
+// connection URI. We use SMTP for `smtp://` and `smtps://` URIs and an HTTP
+// API for `https://` URIs.
+func NewDeliverer(connURI string) (Deliverer, error) {
+	uri := strings.ToLower(connURI)
+	switch {
+	case strings.HasPrefix(uri, "smtp://"), strings.HasPrefix(uri, "smtps://"):
+		return newSMTPDeliverer(connURI)
+	case strings.HasPrefix(uri, "https://"):
+		return NewHTTPDeliverer(connURI, nil)
+	default:
+		return nil, ErrInvalidEmailConfiguration
+	}
+}
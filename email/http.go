@@ -0,0 +1,109 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// httpDeliveryTimeout is the longest we wait for the email API to accept
+	// a message.
+	httpDeliveryTimeout = 30 * time.Second
+	// httpErrorBodyLen is the longest part of an error response we include in
+	// the error we return.
+	httpErrorBodyLen = 512
+)
+
+type (
+	// httpDeliverer delivers email messages by POSTing them as JSON to an
+	// email API, in the style of SendGrid and similar services.
+	httpDeliverer struct {
+		staticAPIKey       string
+		staticAPIKeyHeader string
+		staticClient       *http.Client
+		staticEndpoint     string
+	}
+
+	// httpMessage is the body of the request we send to the email API.
+	httpMessage struct {
+		From     string `json:"from"`
+		To       string `json:"to"`
+		Subject  string `json:"subject"`
+		Body     string `json:"body"`
+		BodyMime string `json:"bodyMime"`
+	}
+)
+
+// NewHTTPDeliverer returns a Deliverer which POSTs messages to the email API
+// described by the given connection URI. The URI has the form
+// `https://<api key>@<host>/<path>`. We send the API key as a bearer token in
+// the `Authorization` header, unless the URI names a different header with the
+// `api_key_header` query parameter. A nil client means we use a client with
+// the default timeout.
+func NewHTTPDeliverer(connURI string, client *http.Client) (Deliverer, error) {
+	u, err := url.Parse(connURI)
+	if err != nil || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, ErrInvalidEmailConfiguration
+	}
+	apiKey := u.User.Username()
+	q := u.Query()
+	header := q.Get("api_key_header")
+	q.Del("api_key_header")
+	u.User = nil
+	u.RawQuery = q.Encode()
+	if client == nil {
+		client = &http.Client{Timeout: httpDeliveryTimeout}
+	}
+	return &httpDeliverer{
+		staticAPIKey:       apiKey,
+		staticAPIKeyHeader: header,
+		staticClient:       client,
+		staticEndpoint:     u.String(),
+	}, nil
+}
+
+// Deliver POSTs the given message to the email API. Any response outside of
+// the 2xx range means the message was not accepted.
+func (d *httpDeliverer) Deliver(ctx context.Context, msg database.EmailMessage) error {
+	b, err := json.Marshal(httpMessage{
+		From:     msg.From,
+		To:       msg.To,
+		Subject:  msg.Subject,
+		Body:     msg.Body,
+		BodyMime: msg.BodyMime,
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to encode email message")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.staticEndpoint, bytes.NewReader(b))
+	if err != nil {
+		return errors.AddContext(err, "failed to create email API request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.staticAPIKeyHeader != "" {
+		req.Header.Set(d.staticAPIKeyHeader, d.staticAPIKey)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+d.staticAPIKey)
+	}
+	resp, err := d.staticClient.Do(req)
+	if err != nil {
+		return errors.AddContext(err, "failed to reach the email API")
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, httpErrorBodyLen))
+		return fmt.Errorf("email API responded with status %d: %s", resp.StatusCode, string(body))
+	}
+	// Drain the body, so the client can reuse the connection.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
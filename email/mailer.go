@@ -2,9 +2,12 @@ package email
 
 import (
 	"context"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/metrics"
 	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
 )
 
 /**
@@ -20,40 +23,172 @@ messages waiting there.
 
 // Mailer prepares messages for sending by adding them to the email queue.
 type Mailer struct {
-	staticDB *database.DB
+	staticDB        *database.DB
+	staticTemplates templateSet
 }
 
-// NewMailer creates a new instance of Mailer.
+// NewMailer creates a new instance of Mailer which uses the compiled-in email
+// templates.
 func NewMailer(db *database.DB) *Mailer {
-	return &Mailer{db}
+	return &Mailer{
+		staticDB:        db,
+		staticTemplates: defaultTemplates,
+	}
 }
 
-// Send queues an email message for sending. The message will be sent by Sender
-// with the next batch of emails.
-func (em Mailer) Send(ctx context.Context, m database.EmailMessage) error {
-	return em.staticDB.EmailCreate(ctx, m)
+// NewCustomMailer creates a new instance of Mailer which prefers the email
+// templates in the given directory over the compiled-in ones. The directory
+// doesn't need to exist but all templates in it need to be valid.
+func NewCustomMailer(db *database.DB, templatesDir string) (*Mailer, error) {
+	ts, err := loadTemplates(templatesDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Mailer{
+		staticDB:        db,
+		staticTemplates: ts,
+	}, nil
+}
+
+// Send queues an email message of the given category for sending. The message
+// will be sent by Sender with the next batch of emails. If the recipient is a
+// user who opted out of the category, we store the message as suppressed
+// instead, so we can tell what we didn't send.
+func (em Mailer) Send(ctx context.Context, m database.EmailMessage, category database.EmailCategory) error {
+	u, err := em.managedRecipient(ctx, types.NewEmail(m.To), category)
+	if err != nil {
+		return err
+	}
+	return em.queue(ctx, m, category, u)
+}
+
+// managedRecipient returns the user the given address belongs to, if the
+// category of the email is one users can opt out of. Otherwise, or if there
+// is no such user, it returns nil.
+func (em Mailer) managedRecipient(ctx context.Context, email types.Email, category database.EmailCategory) (*database.User, error) {
+	if !category.Optional() {
+		return nil, nil
+	}
+	u, err := em.staticDB.UserByEmail(ctx, email)
+	if errors.Contains(err, database.ErrUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch the recipient")
+	}
+	return u, nil
+}
+
+// queue stores the given message of the given category in the email queue,
+// suppressing it if the given recipient opted out of the category. The
+// recipient is nil when the address doesn't belong to a user.
+func (em Mailer) queue(ctx context.Context, m database.EmailMessage, category database.EmailCategory, u *database.User) error {
+	m.Category = category
+	m.Suppressed = u != nil && !u.EmailPrefs().Allows(category)
+	err := em.staticDB.EmailCreate(ctx, m)
+	if err != nil {
+		return err
+	}
+	if !m.Suppressed {
+		metrics.EmailsQueued.Inc()
+	}
+	return nil
 }
 
 // SendAddressConfirmationEmail sends a new email to the given email address
-// with a link to confirm the ownership of the address.
-func (em Mailer) SendAddressConfirmationEmail(ctx context.Context, email types.Email, token string) error {
-	m := confirmEmailEmail(email.String(), token)
-	return em.Send(ctx, *m)
+// with a link to confirm the ownership of the address. The email is in the
+// given locale, if we have a translation for it.
+func (em Mailer) SendAddressConfirmationEmail(ctx context.Context, email types.Email, token, locale string) error {
+	m, err := em.staticTemplates.confirmEmailEmail(email.String(), token, locale)
+	if err != nil {
+		return err
+	}
+	return em.queue(ctx, *m, database.EmailCategoryTransactional, nil)
 }
 
 // SendRecoverAccountEmail sends a new email to the given email address
 // with a link to recover the account.
-func (em Mailer) SendRecoverAccountEmail(ctx context.Context, email types.Email, token string) error {
-	m := recoverAccountEmail(email.String(), token)
-	return em.Send(ctx, *m)
+func (em Mailer) SendRecoverAccountEmail(ctx context.Context, email types.Email, token, locale string) error {
+	m, err := em.staticTemplates.recoverAccountEmail(email.String(), token, locale)
+	if err != nil {
+		return err
+	}
+	return em.queue(ctx, *m, database.EmailCategoryTransactional, nil)
+}
+
+// SendQuotaExceededEmail sends a new email to the given email address that
+// notifies the user that they have exceeded their storage quota. It's a
+// product email.
+func (em Mailer) SendQuotaExceededEmail(ctx context.Context, email types.Email, locale string) error {
+	return em.sendOptional(ctx, email, database.EmailCategoryProduct, func(token string) (*database.EmailMessage, error) {
+		return em.staticTemplates.quotaExceededEmail(email.String(), token, locale)
+	})
+}
+
+// SendPaymentFailedEmail sends a new email to the given email address that
+// notifies the user that their subscription payment failed and asks them to
+// update their payment details.
+func (em Mailer) SendPaymentFailedEmail(ctx context.Context, email types.Email, locale string) error {
+	m, err := em.staticTemplates.paymentFailedEmail(email.String(), locale)
+	if err != nil {
+		return err
+	}
+	return em.queue(ctx, *m, database.EmailCategoryTransactional, nil)
+}
+
+// SendOrgInviteEmail sends a new email to the given email address with a link
+// to join an organization. We don't know whether the recipient is a user, so
+// the caller needs to choose the locale.
+func (em Mailer) SendOrgInviteEmail(ctx context.Context, email types.Email, token, locale string) error {
+	m, err := em.staticTemplates.orgInviteEmail(email.String(), token, locale)
+	if err != nil {
+		return err
+	}
+	return em.queue(ctx, *m, database.EmailCategoryTransactional, nil)
+}
+
+// SendAccountLockedEmail sends a new email to the given email address that
+// notifies the user that their account is locked until the given time because
+// of too many failed logins. It's a security email.
+func (em Mailer) SendAccountLockedEmail(ctx context.Context, email types.Email, lockedUntil time.Time, locale string) error {
+	return em.sendOptional(ctx, email, database.EmailCategorySecurity, func(token string) (*database.EmailMessage, error) {
+		return em.staticTemplates.accountLockedEmail(email.String(), lockedUntil, token, locale)
+	})
 }
 
 // SendAccountAccessAttemptedEmail sends a new email to the given email address
 // that notifies the user that someone used their email address in an attempt to
 // recover a Skynet account but their email is not in our system. The main
 // reason to do that is because the user might have forgotten which email they
-// used for signing up.
-func (em Mailer) SendAccountAccessAttemptedEmail(ctx context.Context, email types.Email) error {
-	m := accountAccessAttemptedEmail(email.String())
-	return em.Send(ctx, *m)
+// used for signing up. We don't know the user, so we can't know their locale
+// either, unless the caller does. It's a security email but there is no user
+// who could opt out of it.
+func (em Mailer) SendAccountAccessAttemptedEmail(ctx context.Context, email types.Email, locale string) error {
+	m, err := em.staticTemplates.accountAccessAttemptedEmail(email.String(), locale)
+	if err != nil {
+		return err
+	}
+	return em.queue(ctx, *m, database.EmailCategorySecurity, nil)
+}
+
+// sendOptional queues an email of a category users can opt out of. It renders
+// the email via the given function, which receives the token for the
+// email's unsubscribe link.
+func (em Mailer) sendOptional(ctx context.Context, email types.Email, category database.EmailCategory, render func(token string) (*database.EmailMessage, error)) error {
+	u, err := em.managedRecipient(ctx, email, category)
+	if err != nil {
+		return err
+	}
+	var token string
+	if u != nil {
+		token, err = UnsubscribeToken(u.Sub, category)
+		if err != nil {
+			return errors.AddContext(err, "failed to create an unsubscribe token")
+		}
+	}
+	m, err := render(token)
+	if err != nil {
+		return err
+	}
+	return em.queue(ctx, *m, category, u)
 }
@@ -2,29 +2,31 @@ package email
 
 import (
 	"context"
-	"crypto/tls"
-	"net/url"
-	"regexp"
-	"strconv"
+	"io"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/metrics"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/build"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"gopkg.in/mail.v2"
-)
-
-const (
-	// batchSize defines the largest batch of emails we will try to send.
-	batchSize = 10
 )
 
 var (
+	// BatchSize defines the largest batch of emails we will try to send in a
+	// single scan of the DB. It's controlled by ACCOUNTS_EMAIL_BATCH_SIZE.
+	BatchSize int64 = 10
+	// MaxPerMinute defines the largest number of emails a Sender tries to send
+	// per minute. Zero means no limit. It's controlled by
+	// ACCOUNTS_EMAIL_MAX_PER_MINUTE. Messages beyond this limit stay in the DB
+	// for a later scan.
+	MaxPerMinute = 0
+
 	// ErrInvalidEmailConfiguration is returned when  the email URI given in the
 	// environment (ACCOUNTS_EMAIL_URI) is either empty or otherwise invalid.
 	ErrInvalidEmailConfiguration = errors.New("missing or invalid email configuration field ACCOUNTS_EMAIL_URI")
@@ -56,10 +58,6 @@ var (
 		},
 	).(string)
 
-	// matchPattern extracts all relevant configuration values from an email
-	// connection URI
-	matchPattern = regexp.MustCompile("smtps://(?P<user>.*):(?P<password>.*)@(?P<server>.*):(?P<port>\\d*)(/\\??skip_ssl_verify=(?P<skip_ssl_verify>\\w*))?")
-
 	// sleepBetweenScans defines how long the sender should sleep between its
 	// sweeps of the DB.
 	sleepBetweenScans = build.Select(
@@ -75,43 +73,75 @@ type (
 	// Sender is a daemon that periodically checks the DB for emails waiting to
 	// be sent and sends them.
 	Sender struct {
-		staticConfig emailConfig
-		staticCtx    context.Context
-		staticDB     *database.DB
-		staticDeps   skymodules.SkydDependencies
-		staticLogger *logrus.Logger
-	}
-
-	// emailConfig contains all configuration options we need in order to send
-	// an email
-	emailConfig struct {
-		User               string
-		Pass               string
-		Server             string
-		Port               int
-		InsecureSkipVerify bool
+		staticCtx       context.Context
+		staticDB        *database.DB
+		staticDeliverer Deliverer
+		staticDeps      skymodules.SkydDependencies
+		staticLogger    *logrus.Logger
+		// staticBatchSize and staticMaxPerMinute hold the values of BatchSize
+		// and MaxPerMinute at the time we created the Sender.
+		staticBatchSize    int64
+		staticMaxPerMinute int
+		// staticStatus is shared by all copies of the Sender, so the scan
+		// loop can report its progress.
+		staticStatus *senderStatus
+	}
+
+	// senderStatus holds the time of the Sender's last scan of the DB. It
+	// also tracks the batch being sent, so we can wait for it on shutdown, and
+	// the times of the recent delivery attempts, so we can keep under
+	// MaxPerMinute.
+	senderStatus struct {
+		lastScan time.Time
+		attempts []time.Time
+		stopped  bool
+		wg       sync.WaitGroup
+		mu       sync.Mutex
 	}
 )
 
-// NewSender returns a new Sender instance.
+// NewSender returns a new Sender instance which delivers messages using the
+// backend selected by the scheme of the given email connection URI.
 func NewSender(ctx context.Context, db *database.DB, logger *logrus.Logger, deps skymodules.SkydDependencies, emailConnURI string) (Sender, error) {
-	c, err := config(emailConnURI)
+	d, err := NewDeliverer(emailConnURI)
 	if err != nil {
 		return Sender{}, errors.AddContext(err, "failed to parse email config")
 	}
+	return NewSenderWithDeliverer(ctx, db, logger, deps, d)
+}
+
+// NewSenderWithDeliverer returns a new Sender instance which delivers messages
+// using the given Deliverer.
+func NewSenderWithDeliverer(ctx context.Context, db *database.DB, logger *logrus.Logger, deps skymodules.SkydDependencies, d Deliverer) (Sender, error) {
 	sess, err := db.NewSession()
 	if err != nil {
 		return Sender{}, err
 	}
 	return Sender{
-		staticConfig: c,
-		staticCtx:    mongo.NewSessionContext(ctx, sess),
-		staticDB:     db,
-		staticDeps:   deps,
-		staticLogger: logger,
+		staticCtx:          mongo.NewSessionContext(ctx, sess),
+		staticDB:           db,
+		staticDeliverer:    d,
+		staticDeps:         deps,
+		staticLogger:       logger,
+		staticBatchSize:    BatchSize,
+		staticMaxPerMinute: MaxPerMinute,
+		staticStatus:       &senderStatus{},
 	}, nil
 }
 
+// LastScan returns the time when the Sender last scanned the DB for emails
+// waiting to be sent. It's zero if the Sender hasn't scanned the DB, yet.
+func (s Sender) LastScan() time.Time {
+	s.staticStatus.mu.Lock()
+	defer s.staticStatus.mu.Unlock()
+	return s.staticStatus.lastScan
+}
+
+// ScanInterval returns the time the Sender sleeps between its scans of the DB.
+func (s Sender) ScanInterval() time.Duration {
+	return sleepBetweenScans
+}
+
 // Start periodically scans the database for email messages waiting to be
 // sent and sending them.
 func (s Sender) Start() {
@@ -128,13 +158,56 @@ func (s Sender) Start() {
 	}()
 }
 
+// Stop prevents the Sender from starting any new batches and waits for the
+// current one to finish or for the given context to expire. Messages which
+// remain unsent stay in the DB for the next instance to send. Once the batch
+// is done, we close the Deliverer's connections, if it holds any.
+func (s Sender) Stop(ctx context.Context) error {
+	s.staticStatus.mu.Lock()
+	s.staticStatus.stopped = true
+	s.staticStatus.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.staticStatus.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.AddContext(ctx.Err(), "failed to wait for the current email batch")
+	}
+	if c, ok := s.staticDeliverer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // ScanAndSend scans the database for email messages waiting to be sent and
-// sends them.
+// sends them. It does nothing once the Sender is stopped.
 //
 // We lock the messages before sending them and update their SentAt field after
-// sending them. We also don't lock more than batchSize messages.
+// sending them. We also don't lock more than BatchSize messages or more than
+// we can send without exceeding MaxPerMinute. Messages which fail to send are
+// retried with an exponential backoff.
 func (s Sender) ScanAndSend(lockID string) (int, int) {
-	msgs, err := s.staticDB.EmailLockAndFetch(s.staticCtx, lockID, batchSize)
+	s.staticStatus.mu.Lock()
+	if s.staticStatus.stopped {
+		s.staticStatus.mu.Unlock()
+		return 0, 0
+	}
+	s.staticStatus.wg.Add(1)
+	s.staticStatus.mu.Unlock()
+	defer s.staticStatus.wg.Done()
+	defer func() {
+		s.staticStatus.mu.Lock()
+		s.staticStatus.lastScan = time.Now().UTC()
+		s.staticStatus.mu.Unlock()
+	}()
+	limit := s.managedBudget()
+	if limit == 0 {
+		return 0, 0
+	}
+	msgs, err := s.staticDB.EmailLockAndFetch(s.staticCtx, lockID, limit)
 	if err != nil {
 		s.staticLogger.Warningln(errors.AddContext(err, "failed to send email batch"))
 		return 0, 0
@@ -146,7 +219,7 @@ func (s Sender) ScanAndSend(lockID string) (int, int) {
 	var failed []*database.EmailMessage
 	var errs []error
 	for i, m := range msgs {
-		err = s.send(m.From, m.To, m.Subject, m.Body, m.BodyMime)
+		err = s.deliver(m)
 		if err != nil {
 			errs = append(errs, err)
 			failed = append(failed, &msgs[i])
@@ -154,6 +227,9 @@ func (s Sender) ScanAndSend(lockID string) (int, int) {
 		}
 		sent = append(sent, m.ID)
 	}
+	s.managedRecordAttempts(len(msgs))
+	metrics.EmailsSent.Add(float64(len(sent)), metrics.EmailSent)
+	metrics.EmailsSent.Add(float64(len(failed)), metrics.EmailFailed)
 	if len(errs) > 0 {
 		err = errors.Compose(errs...)
 		err = errors.AddContext(err, "failed to send some emails")
@@ -174,75 +250,49 @@ func (s Sender) ScanAndSend(lockID string) (int, int) {
 	return len(sent), len(failed)
 }
 
-// send an email message.
-//
-// This function will not be called by Mailer but rather by Sender.
-//
-// bodyMime should be either "text/plain" or "text/html"
-func (s Sender) send(from, to, subject, body, bodyMime string) error {
-	m := mail.NewMessage()
-	m.SetHeader("From", from)
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", subject)
-	m.SetBody(bodyMime, body)
-
-	return s.sendMultiple(m)
-}
-
-// sendMultiple one or more email messages.
-//
-// This function will not be called by Mailer but rather by Sender.
-func (s Sender) sendMultiple(m ...*mail.Message) error {
-	d := mail.NewDialer(s.staticConfig.Server, s.staticConfig.Port, s.staticConfig.User, s.staticConfig.Pass)
-	// This is only needed when SSL/TLS certificate is not valid on server.
-	// In production this should be set to false.
-	/* #nosec */
-	d.TLSConfig = &tls.Config{
-		InsecureSkipVerify: s.staticConfig.InsecureSkipVerify,
-		ServerName:         s.staticConfig.Server,
+// managedBudget returns the number of messages we can send right now. That's
+// BatchSize unless we're close to MaxPerMinute.
+func (s Sender) managedBudget() int64 {
+	if s.staticMaxPerMinute <= 0 {
+		return s.staticBatchSize
 	}
-	if s.staticDeps.Disrupt("SkipSendingEmails") {
-		return nil
+	s.staticStatus.mu.Lock()
+	defer s.staticStatus.mu.Unlock()
+	// Forget the attempts which are more than a minute old.
+	cutoff := time.Now().Add(-time.Minute)
+	i := 0
+	for i < len(s.staticStatus.attempts) && !s.staticStatus.attempts[i].After(cutoff) {
+		i++
 	}
-	return d.DialAndSend(m...)
+	s.staticStatus.attempts = s.staticStatus.attempts[i:]
+	budget := int64(s.staticMaxPerMinute - len(s.staticStatus.attempts))
+	if budget < 0 {
+		budget = 0
+	}
+	if budget > s.staticBatchSize {
+		budget = s.staticBatchSize
+	}
+	return budget
 }
 
-// config parses the DefaultConnectionURI variable and extracts the configuration
-// values from it.
-func config(connURI string) (emailConfig, error) {
-	match := matchPattern.FindStringSubmatch(connURI)
-	if len(match) == 0 {
-		return emailConfig{}, ErrInvalidEmailConfiguration
-	}
-	result := make(map[string]string)
-	for i, name := range matchPattern.SubexpNames() {
-		if i != 0 && name != "" {
-			result[name] = match[i]
-		}
+// managedRecordAttempts records the given number of delivery attempts, so
+// they count towards MaxPerMinute.
+func (s Sender) managedRecordAttempts(n int) {
+	if s.staticMaxPerMinute <= 0 || n == 0 {
+		return
 	}
-	server, e1 := result["server"]
-	portStr, e2 := result["port"]
-	user, e3 := result["user"]
-	password, e4 := result["password"]
+	s.staticStatus.mu.Lock()
+	defer s.staticStatus.mu.Unlock()
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		s.staticStatus.attempts = append(s.staticStatus.attempts, now)
+	}
+}
 
-	// These fields are obligatory, so we return an error if any of them are
-	// missing.
-	if !(e1 && e2 && e3 && e4) {
-		return emailConfig{}, ErrInvalidEmailConfiguration
+// deliver hands the given message over to the Deliverer.
+func (s Sender) deliver(m database.EmailMessage) error {
+	if s.staticDeps.Disrupt("SkipSendingEmails") {
+		return nil
 	}
-	user, err1 := url.QueryUnescape(user)
-	password, err2 := url.QueryUnescape(password)
-	port, err3 := strconv.Atoi(portStr)
-	err := errors.Compose(err1, err2, err3)
-	if err != nil {
-		return emailConfig{}, errors.Compose(err, ErrInvalidEmailConfiguration)
-	}
-	skip := result["skip_ssl_verify"]
-	return emailConfig{
-		User:               user,
-		Pass:               password,
-		Server:             server,
-		Port:               port,
-		InsecureSkipVerify: skip == "true",
-	}, nil
+	return s.staticDeliverer.Deliver(s.staticCtx, m)
 }
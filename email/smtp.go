@@ -0,0 +1,166 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+	"gopkg.in/mail.v2"
+)
+
+const (
+	// smtpIdleTimeout defines how long we keep an unused SMTP connection open.
+	// Servers drop idle connections after a while, so we'd rather close them
+	// ourselves than find out when we try to use them.
+	smtpIdleTimeout = 30 * time.Second
+)
+
+var (
+	// matchPattern extracts all relevant configuration values from an email
+	// connection URI
+	matchPattern = regexp.MustCompile("smtps?://(?P<user>.*):(?P<password>.*)@(?P<server>.*):(?P<port>\\d*)(/\\??skip_ssl_verify=(?P<skip_ssl_verify>\\w*))?")
+)
+
+type (
+	// smtpDeliverer delivers email messages via an SMTP server. It keeps its
+	// connection open between messages and batches, so we don't need to go
+	// through the handshake and authentication for every one of them.
+	smtpDeliverer struct {
+		staticDialer *mail.Dialer
+
+		conn     mail.SendCloser
+		lastUsed time.Time
+		mu       sync.Mutex
+	}
+
+	// emailConfig contains all configuration options we need in order to send
+	// an email
+	emailConfig struct {
+		User               string
+		Pass               string
+		Server             string
+		Port               int
+		InsecureSkipVerify bool
+	}
+)
+
+// newSMTPDeliverer returns a new smtpDeliverer for the given connection URI.
+func newSMTPDeliverer(connURI string) (*smtpDeliverer, error) {
+	c, err := config(connURI)
+	if err != nil {
+		return nil, err
+	}
+	d := mail.NewDialer(c.Server, c.Port, c.User, c.Pass)
+	// This is only needed when SSL/TLS certificate is not valid on server.
+	// In production this should be set to false.
+	/* #nosec */
+	d.TLSConfig = &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.Server,
+	}
+	return &smtpDeliverer{staticDialer: d}, nil
+}
+
+// Deliver sends the given message over the open connection, opening a new one
+// if needed. If the server dropped the open connection, we retry once over a
+// new one.
+func (d *smtpDeliverer) Deliver(ctx context.Context, msg database.EmailMessage) error {
+	m := mail.NewMessage()
+	m.SetHeader("From", msg.From)
+	m.SetHeader("To", msg.To)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody(msg.BodyMime, msg.Body)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && time.Since(d.lastUsed) > smtpIdleTimeout {
+		d.closeConn()
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reused := d.conn != nil
+		if !reused {
+			conn, err := d.staticDialer.Dial()
+			if err != nil {
+				return errors.AddContext(err, "failed to connect to the SMTP server")
+			}
+			d.conn = conn
+		}
+		err := mail.Send(d.conn, m)
+		if err == nil {
+			d.lastUsed = time.Now()
+			return nil
+		}
+		d.closeConn()
+		if !reused {
+			return err
+		}
+	}
+}
+
+// Close closes the open connection, if any.
+func (d *smtpDeliverer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closeConn()
+	return nil
+}
+
+// closeConn closes the open connection, if any. The caller needs to hold the
+// lock.
+func (d *smtpDeliverer) closeConn() {
+	if d.conn == nil {
+		return
+	}
+	// We don't care about errors here, we won't use the connection again.
+	_ = d.conn.Close()
+	d.conn = nil
+}
+
+// config parses the DefaultConnectionURI variable and extracts the configuration
+// values from it.
+func config(connURI string) (emailConfig, error) {
+	match := matchPattern.FindStringSubmatch(connURI)
+	if len(match) == 0 {
+		return emailConfig{}, ErrInvalidEmailConfiguration
+	}
+	result := make(map[string]string)
+	for i, name := range matchPattern.SubexpNames() {
+		if i != 0 && name != "" {
+			result[name] = match[i]
+		}
+	}
+	server, e1 := result["server"]
+	portStr, e2 := result["port"]
+	user, e3 := result["user"]
+	password, e4 := result["password"]
+
+	// These fields are obligatory, so we return an error if any of them are
+	// missing.
+	if !(e1 && e2 && e3 && e4) {
+		return emailConfig{}, ErrInvalidEmailConfiguration
+	}
+	user, err1 := url.QueryUnescape(user)
+	password, err2 := url.QueryUnescape(password)
+	port, err3 := strconv.Atoi(portStr)
+	err := errors.Compose(err1, err2, err3)
+	if err != nil {
+		return emailConfig{}, errors.Compose(err, ErrInvalidEmailConfiguration)
+	}
+	skip := result["skip_ssl_verify"]
+	return emailConfig{
+		User:               user,
+		Pass:               password,
+		Server:             server,
+		Port:               port,
+		InsecureSkipVerify: skip == "true",
+	}, nil
+}
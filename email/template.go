@@ -1,136 +1,303 @@
 package email
 
 import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
 )
 
 const (
-	confirmEmailSubject = "Please verify your email address"
-	confirmEmailMime    = "multipart/alternative; boundary=e31b4aa4706e10c57d31a44da59281c216fb10992b0e5b512edea805408a"
-	confirmEmailTempl   = `
---e31b4aa4706e10c57d31a44da59281c216fb10992b0e5b512edea805408a
-Content-Transfer-Encoding: quoted-printable
-Content-Type: text/plain; charset=UTF-8
-
-Hi, please verify your account by clicking the following link:
-
-<a href="{{.ConfirmEndpoint}}?token={{.Token}}">{{.ConfirmEndpoint}}?token={{.Token}}</a>
-
---e31b4aa4706e10c57d31a44da59281c216fb10992b0e5b512edea805408a
-Content-Transfer-Encoding: quoted-printable
-Content-Type: text/html; charset=UTF-8
-
-Hi, please verify your account by clicking the following link:
-
-<a href="{{.ConfirmEndpoint}}?token={{.Token}}">{{.ConfirmEndpoint}}?token={{.Token}}</a>
-
---e31b4aa4706e10c57d31a44da59281c216fb10992b0e5b512edea805408a--
-`
-
-	recoverAccountSubject = "Recover access to your account"
-	recoverAccountMime    = "multipart/alternative; boundary=9f0f6cc6978acbf34b218925c8b6be77292fcc0ec91a086b04045aafa8ca"
-	recoverAccountTempl   = `
---9f0f6cc6978acbf34b218925c8b6be77292fcc0ec91a086b04045aafa8ca
-Content-Transfer-Encoding: quoted-printable
-Content-Type: text/plain; charset=UTF-8
-
-Hi,
-
-please recover access to your account by clicking the following link:
-
-<a href="{{.RecoverEndpoint}}?token={{.Token}}">{{.RecoverEndpoint}}?token={{.Token}}</a>
-
---9f0f6cc6978acbf34b218925c8b6be77292fcc0ec91a086b04045aafa8ca
-Content-Transfer-Encoding: quoted-printable
-Content-Type: text/html; charset=UTF-8
-
-Hi,
-
-please recover access to your account by clicking the following link:
-
-<a href="{{.RecoverEndpoint}}?token={{.Token}}">{{.RecoverEndpoint}}?token={{.Token}}</a>
-
---9f0f6cc6978acbf34b218925c8b6be77292fcc0ec91a086b04045aafa8ca--
-`
-
-	accountAccessAttemptedSubject = "Account access attempted"
-	accountAccessAttemptedMime    = "multipart/alternative; boundary=f096ee1beed49f6757a41b4bf22d1ddc10cc9480a4df9376ebac4fe4f405"
-	accountAccessAttemptedTempl   = `
---f096ee1beed49f6757a41b4bf22d1ddc10cc9480a4df9376ebac4fe4f405
-Content-Transfer-Encoding: quoted-printable
-Content-Type: text/plain; charset=UTF-8
-
-Hi,
-
-you (or someone else) entered this email address when trying to recover acc=
-ess to an account.
-
-However, this email address is not on our database of registered users and =
-therefore the attempt has failed.
-
-If this was you, check if you signed up using a different address.
+	// emailBoundary separates the plain text and the HTML parts of our
+	// multipart emails.
+	emailBoundary = "e31b4aa4706e10c57d31a44da59281c216fb10992b0e5b512edea805408a"
+	// emailMime is the MIME type of all emails we send.
+	emailMime = "multipart/alternative; boundary=" + emailBoundary
+
+	// templateSubject is the name of the template which holds the subject of
+	// an email. Each email template file needs to define it.
+	templateSubject = "subject"
+
+	// The names of our email templates. Each of them is loaded from a file
+	// with the same name and an `.html` extension. Translated versions of the
+	// templates are named after the template and the locale, e.g.
+	// `confirm_email.de.html`.
+	templateConfirmEmail           = "confirm_email"
+	templateRecoverAccount         = "recover_account"
+	templateAccountAccessAttempted = "account_access_attempted"
+	templateQuotaExceeded          = "quota_exceeded"
+	templatePaymentFailed          = "payment_failed"
+	templateAccountLocked          = "account_locked"
+	templateOrgInvite              = "org_invite"
+)
 
-If this was not you, please ignore this email.
+var (
+	// defaultTemplatesFS holds the compiled-in versions of our email templates.
+	//go:embed templates/*.html
+	defaultTemplatesFS embed.FS
+
+	// defaultTemplates are the parsed compiled-in email templates. We use them
+	// whenever there is no custom template.
+	defaultTemplates = mustParseDefaultTemplates()
+
+	// templateNames lists the names of all email templates we know about.
+	templateNames = map[string]struct{}{
+		templateConfirmEmail:           {},
+		templateRecoverAccount:         {},
+		templateAccountAccessAttempted: {},
+		templateQuotaExceeded:          {},
+		templatePaymentFailed:          {},
+		templateAccountLocked:          {},
+		templateOrgInvite:              {},
+	}
 
---f096ee1beed49f6757a41b4bf22d1ddc10cc9480a4df9376ebac4fe4f405
-Content-Transfer-Encoding: quoted-printable
-Content-Type: text/html; charset=UTF-8
+	// localeRE matches the locales we support, e.g. `de` or `pt-br`.
+	localeRE = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+)
 
-Hi,
+type (
+	// templateSet holds parsed email templates keyed by their name and,
+	// optionally, their locale, e.g. `confirm_email` or `confirm_email.de`.
+	templateSet map[string]*template.Template
+
+	// templateData holds the values our email templates can use.
+	templateData struct {
+		Boundary          string
+		BillingEndpoint   string
+		ConfirmEndpoint   string
+		DashboardEndpoint string
+		InviteEndpoint    string
+		LockedUntil       string
+		RecoverEndpoint   string
+		Token             string
+		// UnsubscribeEndpoint and UnsubscribeToken make up the one-click
+		// unsubscribe link of the emails users can opt out of. The token is
+		// empty when the recipient isn't a user.
+		UnsubscribeEndpoint string
+		UnsubscribeToken    string
+	}
+)
 
-you (or someone else) entered this email address when trying to recover acc=
-ess to an account.
+// ValidLocale checks whether the given locale has a format we support, e.g.
+// `de` or `pt-br`. Locales are case-insensitive.
+func ValidLocale(locale string) bool {
+	return localeRE.MatchString(strings.ToLower(locale))
+}
 
-However, this email address is not on our database of registered users and =
-therefore the attempt has failed.
+// loadTemplates returns our email templates, overriding the compiled-in ones
+// with the ones found in the given directory. A missing directory is not an
+// error, we just use the compiled-in templates.
+func loadTemplates(dir string) (templateSet, error) {
+	ts := make(templateSet, len(defaultTemplates))
+	for key, t := range defaultTemplates {
+		ts[key] = t
+	}
+	if dir == "" {
+		return ts, nil
+	}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to access email templates dir")
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("email templates dir %s is not a directory", dir)
+	}
+	custom, err := parseTemplates(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	for key, t := range custom {
+		ts[key] = t
+	}
+	return ts, nil
+}
 
-If this was you, check if you signed up using a different address.
+// mustParseDefaultTemplates parses the compiled-in email templates. It panics
+// on failure because that means we shipped a broken template.
+func mustParseDefaultTemplates() templateSet {
+	fsys, err := fs.Sub(defaultTemplatesFS, "templates")
+	if err != nil {
+		panic(err)
+	}
+	ts, err := parseTemplates(fsys)
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
 
-If this was not you, please ignore this email.
+// parseTemplates parses all email templates in the root of the given file
+// system. It fails on templates we don't know about, on templates without a
+// subject and on templates which fail to render.
+func parseTemplates(fsys fs.FS) (templateSet, error) {
+	files, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	ts := make(templateSet, len(files))
+	for _, f := range files {
+		key := strings.ToLower(strings.TrimSuffix(f, ".html"))
+		name, locale := key, ""
+		if i := strings.Index(key, "."); i >= 0 {
+			name, locale = key[:i], key[i+1:]
+		}
+		if _, exists := templateNames[name]; !exists {
+			return nil, fmt.Errorf("unknown email template %s", f)
+		}
+		if locale != "" && !ValidLocale(locale) {
+			return nil, fmt.Errorf("invalid locale of email template %s", f)
+		}
+		b, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to read email template "+f)
+		}
+		t, err := template.New(key).Parse(string(b))
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse email template "+f)
+		}
+		if t.Lookup(templateSubject) == nil {
+			return nil, fmt.Errorf("email template %s doesn't define a subject", f)
+		}
+		// Render the template once, so we catch errors, such as references to
+		// unknown fields, now rather than when we try to send an email.
+		err = t.Execute(io.Discard, templateData{})
+		if err == nil {
+			err = t.ExecuteTemplate(io.Discard, templateSubject, templateData{})
+		}
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to render email template "+f)
+		}
+		ts[key] = t
+	}
+	return ts, nil
+}
 
---f096ee1beed49f6757a41b4bf22d1ddc10cc9480a4df9376ebac4fe4f405--
-`
-)
+// lookup returns the template with the given name, translated to the given
+// locale. If there is no translation for the locale we try its base language,
+// e.g. `pt` for `pt-br`, and then fall back to English.
+func (ts templateSet) lookup(name, locale string) (*template.Template, error) {
+	locale = strings.ToLower(locale)
+	if locale != "" {
+		if t, exists := ts[name+"."+locale]; exists {
+			return t, nil
+		}
+		if i := strings.Index(locale, "-"); i > 0 {
+			if t, exists := ts[name+"."+locale[:i]]; exists {
+				return t, nil
+			}
+		}
+	}
+	t, exists := ts[name]
+	if !exists {
+		return nil, fmt.Errorf("missing email template %s", name)
+	}
+	return t, nil
+}
 
-// confirmEmailEmail generates an email for confirming that the user owns the
-// given email address.
-func confirmEmailEmail(to string, token string) *database.EmailMessage {
-	body := strings.ReplaceAll(confirmEmailTempl, "{{.ConfirmEndpoint}}", PortalAddressAccounts+"/user/confirm")
-	body = strings.ReplaceAll(body, "{{.Token}}", token)
+// message renders the given template in the given locale and returns an
+// email message with the result, addressed to the given recipient.
+func (ts templateSet) message(name, locale, to string, data templateData) (*database.EmailMessage, error) {
+	t, err := ts.lookup(name, locale)
+	if err != nil {
+		return nil, err
+	}
+	data.Boundary = emailBoundary
+	var subject, body bytes.Buffer
+	err = t.ExecuteTemplate(&subject, templateSubject, data)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to render the subject of email template "+t.Name())
+	}
+	err = t.Execute(&body, data)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to render email template "+t.Name())
+	}
 	return &database.EmailMessage{
 		From:     From,
 		To:       to,
-		Subject:  confirmEmailSubject,
-		Body:     body,
-		BodyMime: confirmEmailMime,
+		Subject:  strings.TrimSpace(subject.String()),
+		Body:     body.String(),
+		BodyMime: emailMime,
+	}, nil
+}
+
+// confirmEmailEmail generates an email for confirming that the user owns the
+// given email address.
+func (ts templateSet) confirmEmailEmail(to, token, locale string) (*database.EmailMessage, error) {
+	data := templateData{
+		ConfirmEndpoint: PortalAddressAccounts + "/user/confirm",
+		Token:           token,
 	}
+	return ts.message(templateConfirmEmail, locale, to, data)
 }
 
 // recoverAccountEmail generates an email for recovering an account.
-func recoverAccountEmail(to string, token string) *database.EmailMessage {
-	body := strings.ReplaceAll(recoverAccountTempl, "{{.RecoverEndpoint}}", PortalAddressAccounts+"/user/recover")
-	body = strings.ReplaceAll(body, "{{.Token}}", token)
-	return &database.EmailMessage{
-		From:     From,
-		To:       to,
-		Subject:  recoverAccountSubject,
-		Body:     body,
-		BodyMime: recoverAccountMime,
+func (ts templateSet) recoverAccountEmail(to, token, locale string) (*database.EmailMessage, error) {
+	data := templateData{
+		RecoverEndpoint: PortalAddressAccounts + "/user/recover",
+		Token:           token,
 	}
+	return ts.message(templateRecoverAccount, locale, to, data)
 }
 
 // accountAccessAttemptedEmail generates an email for notifying a user that
 // someone tried to use their email for recovering a Skynet account but their
 // email is not in our system. The main reason to do that is because the user
 // might have forgotten which email they used for signing up.
-func accountAccessAttemptedEmail(to string) *database.EmailMessage {
-	return &database.EmailMessage{
-		From:     From,
-		To:       to,
-		Subject:  accountAccessAttemptedSubject,
-		Body:     accountAccessAttemptedTempl,
-		BodyMime: accountAccessAttemptedMime,
+func (ts templateSet) accountAccessAttemptedEmail(to, locale string) (*database.EmailMessage, error) {
+	return ts.message(templateAccountAccessAttempted, locale, to, templateData{})
+}
+
+// paymentFailedEmail generates an email for notifying a user that we failed to
+// charge them for their subscription.
+func (ts templateSet) paymentFailedEmail(to, locale string) (*database.EmailMessage, error) {
+	data := templateData{
+		BillingEndpoint: PortalAddressAccounts + "/stripe/billing",
+	}
+	return ts.message(templatePaymentFailed, locale, to, data)
+}
+
+// accountLockedEmail generates an email for notifying a user that we locked
+// their account after too many failed logins. The unsubscribe token is
+// optional.
+func (ts templateSet) accountLockedEmail(to string, lockedUntil time.Time, unsubscribeToken, locale string) (*database.EmailMessage, error) {
+	data := templateData{
+		LockedUntil:         lockedUntil.UTC().Format(time.RFC1123),
+		RecoverEndpoint:     PortalAddressAccounts + "/user/recover",
+		UnsubscribeEndpoint: PortalAddressAccounts + "/email/unsubscribe",
+		UnsubscribeToken:    unsubscribeToken,
+	}
+	return ts.message(templateAccountLocked, locale, to, data)
+}
+
+// orgInviteEmail generates an email which invites the recipient to join an
+// organization.
+func (ts templateSet) orgInviteEmail(to, token, locale string) (*database.EmailMessage, error) {
+	data := templateData{
+		InviteEndpoint: PortalAddressAccounts + "/org-invites/accept",
+		Token:          token,
+	}
+	return ts.message(templateOrgInvite, locale, to, data)
+}
+
+// quotaExceededEmail generates an email for notifying a user that they have
+// exceeded their storage quota. The unsubscribe token is optional.
+func (ts templateSet) quotaExceededEmail(to, unsubscribeToken, locale string) (*database.EmailMessage, error) {
+	data := templateData{
+		DashboardEndpoint:   PortalAddressAccounts,
+		UnsubscribeEndpoint: PortalAddressAccounts + "/email/unsubscribe",
+		UnsubscribeToken:    unsubscribeToken,
 	}
+	return ts.message(templateQuotaExceeded, locale, to, data)
 }
@@ -1,8 +1,11 @@
 package email
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/lib"
 )
@@ -15,13 +18,19 @@ func TestConfirmEmailEmail(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	em := confirmEmailEmail(to, token)
+	em, err := defaultTemplates.confirmEmailEmail(to, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if em.To != to {
 		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
 	}
 	if em.From != From {
 		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
 	}
+	if em.BodyMime != emailMime {
+		t.Fatalf("Expected MIME type %s, got %s", emailMime, em.BodyMime)
+	}
 	if !strings.Contains(em.Body, "https://account.siasky.net/user/confirm?token="+token) {
 		t.Fatal("Invalid confirmation link.")
 	}
@@ -35,7 +44,10 @@ func TestRecoverAccountEmail(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	em := recoverAccountEmail(to, token)
+	em, err := defaultTemplates.recoverAccountEmail(to, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if em.To != to {
 		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
 	}
@@ -51,11 +63,190 @@ func TestRecoverAccountEmail(t *testing.T) {
 // is going to the correct email.
 func TestAccountAccessAttemptedEmail(t *testing.T) {
 	to := "user@siasky.net"
-	em := accountAccessAttemptedEmail(to)
+	em, err := defaultTemplates.accountAccessAttemptedEmail(to, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if em.From != From {
+		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
+	}
+}
+
+// TestQuotaExceededEmail ensures that the email we send to the user is going
+// to the correct email and links to the dashboard.
+func TestQuotaExceededEmail(t *testing.T) {
+	to := "user@siasky.net"
+	em, err := defaultTemplates.quotaExceededEmail(to, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if em.From != From {
+		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
+	}
+	if !strings.Contains(em.Body, "<a href=\"https://account.siasky.net\">") {
+		t.Fatal("Invalid dashboard link.")
+	}
+	if strings.Contains(em.Body, "/email/unsubscribe") {
+		t.Fatal("Expected no unsubscribe link without a token.")
+	}
+	// With a token the email links to the unsubscribe endpoint.
+	em, err = defaultTemplates.quotaExceededEmail(to, "tkn", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(em.Body, "<a href=\"https://account.siasky.net/email/unsubscribe?token=tkn\">") {
+		t.Fatal("Invalid unsubscribe link.")
+	}
+}
+
+// TestPaymentFailedEmail ensures that the email we send to the user is going
+// to the correct email and links to the billing portal.
+func TestPaymentFailedEmail(t *testing.T) {
+	to := "user@siasky.net"
+	em, err := defaultTemplates.paymentFailedEmail(to, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if em.From != From {
+		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
+	}
+	if !strings.Contains(em.Body, "<a href=\"https://account.siasky.net/stripe/billing\">") {
+		t.Fatal("Invalid billing link.")
+	}
+}
+
+// TestAccountLockedEmail ensures that the email we send to the user is going
+// to the correct email and tells them until when their account is locked.
+func TestAccountLockedEmail(t *testing.T) {
+	to := "user@siasky.net"
+	lockedUntil := time.Date(2022, 3, 4, 11, 11, 46, 0, time.UTC)
+	em, err := defaultTemplates.accountLockedEmail(to, lockedUntil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if em.To != to {
 		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
 	}
 	if em.From != From {
 		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
 	}
+	if !strings.Contains(em.Body, lockedUntil.Format(time.RFC1123)) {
+		t.Fatal("Missing lockout time.")
+	}
+	if !strings.Contains(em.Body, "<a href=\"https://account.siasky.net/user/recover\">") {
+		t.Fatal("Invalid recovery link.")
+	}
+}
+
+// TestOrgInviteEmail ensures that the invite email contains the correct link
+// for accepting the invite.
+func TestOrgInviteEmail(t *testing.T) {
+	to := "user@siasky.net"
+	token := "token"
+	em, err := defaultTemplates.orgInviteEmail(to, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if !strings.Contains(em.Body, "https://account.siasky.net/org-invites/accept?token="+token) {
+		t.Fatal("Invalid invite link.")
+	}
+}
+
+// TestLoadTemplates ensures that custom email templates override the
+// compiled-in ones, that we pick translations based on the locale and fall
+// back to English, and that we reject invalid templates.
+func TestLoadTemplates(t *testing.T) {
+	// A missing directory is fine.
+	ts, err := loadTemplates(filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != len(defaultTemplates) {
+		t.Fatalf("Expected %d templates, got %d", len(defaultTemplates), len(ts))
+	}
+
+	dir := t.TempDir()
+	custom := map[string]string{
+		"confirm_email.html":     `{{define "subject"}}Confirm{{end}}custom {{.Token}}`,
+		"confirm_email.DE.html":  `{{define "subject"}}Bestätigen{{end}}Deutsch {{.Token}}`,
+		"quota_exceeded.pt.html": `{{define "subject"}}Quota{{end}}português`,
+	}
+	for name, content := range custom {
+		err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err = loadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		locale  string
+		subject string
+		body    string
+	}{
+		{name: templateConfirmEmail, locale: "", subject: "Confirm", body: "custom tkn"},
+		{name: templateConfirmEmail, locale: "de", subject: "Bestätigen", body: "Deutsch tkn"},
+		{name: templateConfirmEmail, locale: "de-AT", subject: "Bestätigen", body: "Deutsch tkn"},
+		{name: templateConfirmEmail, locale: "fr", subject: "Confirm", body: "custom tkn"},
+		{name: templateQuotaExceeded, locale: "pt-br", subject: "Quota", body: "português"},
+		{name: templateQuotaExceeded, locale: "", subject: "You have exceeded your storage quota", body: emailBoundary},
+	}
+	for _, tt := range tests {
+		em, err := ts.message(tt.name, tt.locale, "user@siasky.net", templateData{Token: "tkn"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if em.Subject != tt.subject || !strings.Contains(em.Body, tt.body) {
+			t.Fatalf("Unexpected %s email for locale '%s': %+v", tt.name, tt.locale, em)
+		}
+	}
+
+	// Invalid templates are errors.
+	invalid := map[string]string{
+		"confirm_email.html":    `{{define "subject"}}Confirm{{end}}{{.Token`,
+		"recover_account.html":  `no subject`,
+		"quota_exceeded.html":   `{{define "subject"}}Quota{{end}}{{.Unknown}}`,
+		"unknown_email.html":    `{{define "subject"}}Unknown{{end}}`,
+		"payment_failed.x.html": `{{define "subject"}}Payment{{end}}`,
+	}
+	for name, content := range invalid {
+		dir = t.TempDir()
+		err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadTemplates(dir)
+		if err == nil {
+			t.Fatalf("Expected an error for template %s", name)
+		}
+	}
+}
+
+// TestValidLocale ensures that ValidLocale accepts the locales we support.
+func TestValidLocale(t *testing.T) {
+	for _, l := range []string{"de", "DE", "fil", "pt-br", "zh-hant"} {
+		if !ValidLocale(l) {
+			t.Fatalf("Expected locale '%s' to be valid", l)
+		}
+	}
+	for _, l := range []string{"", "d", "german", "de_DE", "de-", "../de"} {
+		if ValidLocale(l) {
+			t.Fatalf("Expected locale '%s' to be invalid", l)
+		}
+	}
 }
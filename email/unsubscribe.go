@@ -0,0 +1,91 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/gorilla/securecookie"
+	"github.com/joho/godotenv"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// envCookieHashKey holds the name of the env var which holds the key the
+	// api package uses to hash cookies. We derive our unsubscribe key from
+	// it, so all instances of accounts share it without the need for
+	// additional configuration.
+	envCookieHashKey = "COOKIE_HASH_KEY"
+	// unsubscribeKeySize is the minimal size of the key we derive the
+	// unsubscribe key from.
+	unsubscribeKeySize = 32
+)
+
+var (
+	// ErrInvalidUnsubscribeToken is returned when an unsubscribe token is
+	// malformed, has an invalid signature or refers to a category users
+	// can't opt out of.
+	ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+
+	// unsubscribeKey is the server-wide secret we use to sign unsubscribe
+	// tokens.
+	unsubscribeKey = func() []byte {
+		_ = godotenv.Load()
+		hashKeyStr := os.Getenv(envCookieHashKey)
+		if build.Release == "testing" && len(hashKeyStr) < unsubscribeKeySize {
+			hashKeyStr = string(securecookie.GenerateRandomKey(unsubscribeKeySize))
+		}
+		mac := hmac.New(sha256.New, []byte(hashKeyStr))
+		_, _ = mac.Write([]byte("email unsubscribe"))
+		return mac.Sum(nil)
+	}()
+)
+
+// unsubscribePayload is the signed payload of an unsubscribe token.
+type unsubscribePayload struct {
+	Sub      string                 `json:"sub"`
+	Category database.EmailCategory `json:"cat"`
+}
+
+// UnsubscribeToken returns a signed token which allows the holder to opt the
+// user with the given sub out of the given category of emails. The token
+// doesn't expire, so the links in old emails keep working.
+func UnsubscribeToken(sub string, c database.EmailCategory) (string, error) {
+	payload, err := json.Marshal(unsubscribePayload{Sub: sub, Category: c})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(unsubscribeSignature(payload)), nil
+}
+
+// ParseUnsubscribeToken verifies the given unsubscribe token and returns the
+// sub of the user and the category of emails it opts them out of.
+func ParseUnsubscribeToken(token string) (string, database.EmailCategory, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	payload, err1 := base64.RawURLEncoding.DecodeString(parts[0])
+	sig, err2 := base64.RawURLEncoding.DecodeString(parts[1])
+	if err1 != nil || err2 != nil || !hmac.Equal(sig, unsubscribeSignature(payload)) {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	var p unsubscribePayload
+	err := json.Unmarshal(payload, &p)
+	if err != nil || p.Sub == "" || !p.Category.Optional() {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	return p.Sub, p.Category, nil
+}
+
+// unsubscribeSignature signs the given payload with the unsubscribe key.
+func unsubscribeSignature(payload []byte) []byte {
+	mac := hmac.New(sha256.New, unsubscribeKey)
+	_, _ = mac.Write(payload)
+	return mac.Sum(nil)
+}
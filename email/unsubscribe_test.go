@@ -0,0 +1,44 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+)
+
+// TestUnsubscribeToken ensures that we only accept unsubscribe tokens we
+// signed for categories users can opt out of.
+func TestUnsubscribeToken(t *testing.T) {
+	token, err := UnsubscribeToken("sub", database.EmailCategoryProduct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, c, err := ParseUnsubscribeToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub != "sub" || c != database.EmailCategoryProduct {
+		t.Fatalf("Expected 'sub' and '%s', got '%s' and '%s'", database.EmailCategoryProduct, sub, c)
+	}
+
+	other, err := UnsubscribeToken("other", database.EmailCategoryProduct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactional, err := UnsubscribeToken("sub", database.EmailCategoryTransactional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]string{
+		"empty":         "",
+		"no signature":  token[:len(token)/2],
+		"swapped":       strings.Split(other, ".")[0] + "." + strings.Split(token, ".")[1],
+		"transactional": transactional,
+	}
+	for name, tk := range invalid {
+		if _, _, err = ParseUnsubscribeToken(tk); err != ErrInvalidUnsubscribeToken {
+			t.Fatalf("Expected '%v' for the %s token, got '%v'", ErrInvalidUnsubscribeToken, name, err)
+		}
+	}
+}
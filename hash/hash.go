@@ -100,6 +100,16 @@ func Compare(password string, hash Argon2HashRecord) error {
 	return ErrMismatchedHashAndPassword
 }
 
+// Validate checks whether the given hash record is a well-formed argon2id
+// record, created with the version of argon2 we use.
+func Validate(hash Argon2HashRecord) error {
+	if !bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		return ErrInvalidHash
+	}
+	_, _, _, err := decodeHash(hash)
+	return err
+}
+
 // decodeHash is a helper method which extracts the configuration from the
 // encoded hash record and returns its parts.
 //
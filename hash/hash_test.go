@@ -72,3 +72,26 @@ func TestGenerateCompare(t *testing.T) {
 		t.Fatal("Password and hash don't match")
 	}
 }
+
+// TestValidate ensures that Validate only accepts well-formed argon2id hash
+// records.
+func TestValidate(t *testing.T) {
+	h, err := Generate("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Validate(h); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	invalid := []string{
+		"",
+		"$argon2i$v=19$m=131072,t=2,p=1$dwr95pEjaa7emZOu9bDAWw$eDQwOMoSyRmzyvpD/wwGBg",
+		"$argon2id$v=55$m=131072,t=2,p=1$dwr95pEjaa7emZOu9bDAWw$eDQwOMoSyRmzyvpD/wwGBg",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+	}
+	for _, h := range invalid {
+		if Validate(Argon2HashRecord(h)) == nil {
+			t.Fatalf("Expected an error for hash '%s'", h)
+		}
+	}
+}
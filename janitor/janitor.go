@@ -0,0 +1,77 @@
+package janitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+var (
+	// sleepBetweenScans defines how long the janitor should sleep between its
+	// sweeps of the DB.
+	sleepBetweenScans = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  100 * time.Millisecond,
+			Standard: time.Hour,
+		},
+	).(time.Duration)
+)
+
+type (
+	// Janitor is a daemon that periodically checks the DB for users whose
+	// deletion grace period has passed and purges them together with all of
+	// their data.
+	Janitor struct {
+		staticCtx    context.Context
+		staticDB     *database.DB
+		staticLogger *logrus.Logger
+	}
+)
+
+// NewJanitor returns a new Janitor instance.
+func NewJanitor(ctx context.Context, db *database.DB, logger *logrus.Logger) Janitor {
+	return Janitor{
+		staticCtx:    ctx,
+		staticDB:     db,
+		staticLogger: logger,
+	}
+}
+
+// Start periodically scans the database for deleted users whose grace period
+// has passed and purges them.
+func (j Janitor) Start() {
+	go func() {
+		j.managedPurge()
+		for {
+			select {
+			case <-j.staticCtx.Done():
+				return
+			case <-time.After(sleepBetweenScans):
+				j.managedPurge()
+			}
+		}
+	}()
+}
+
+// PurgeDeletedUsers purges all users who were deleted more than
+// database.UserDeleteGracePeriod ago. It returns the number of purged users.
+func (j Janitor) PurgeDeletedUsers() (int, error) {
+	cutoff := time.Now().UTC().Add(-database.UserDeleteGracePeriod)
+	return j.staticDB.UserPurgeDeleted(j.staticCtx, cutoff)
+}
+
+// managedPurge runs a single purge and logs the outcome.
+func (j Janitor) managedPurge() {
+	n, err := j.PurgeDeletedUsers()
+	if err != nil {
+		j.staticLogger.Warningln(errors.AddContext(err, "failed to purge deleted users"))
+	}
+	if n > 0 {
+		j.staticLogger.Debugf("Purged %d deleted users.", n)
+	}
+}
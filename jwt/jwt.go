@@ -2,8 +2,11 @@ package jwt
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/types"
@@ -12,17 +15,28 @@ import (
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
 	"gitlab.com/SkynetLabs/skyd/build"
 )
 
 var (
 	// AccountsJWKS is the public RS key set used by accounts for JWT signing.
+	// It might be swapped by ReloadAccountsKeySet at any time, so access it
+	// while holding keySetMu.
 	AccountsJWKS jwk.Set
 
 	// AccountsPublicJWKS is a verification-only version of the JWKS.
-	// We cannot use the full version of the JWKS for verification.
+	// We cannot use the full version of the JWKS for verification. Use
+	// PublicKeySet to access it.
 	AccountsPublicJWKS jwk.Set
 
+	// SigningKeyID is the kid of the key in the JWKS we sign new tokens with.
+	// We sign with the first key when it's empty. We validate tokens against
+	// all keys in the set, so rotating the signing key doesn't invalidate
+	// the tokens signed with the previous one. Can be overridden by the
+	// ACCOUNTS_JWT_SIGNING_KID environment variable.
+	SigningKeyID = ""
+
 	// AccountsJWKSFile defines where to look for the JWKS file.
 	// Can be overridden by the ACCOUNTS_JWKS_FILE environment variable.
 	AccountsJWKSFile = build.Select(
@@ -44,6 +58,19 @@ var (
 	// TTL defines the lifetime of the JWT token in seconds.'
 	// Can be overridden by the ACCOUNTS_JWT_TTL environment variable.
 	TTL = 720 * 3600
+
+	// MaxSessionAge defines the longest time in seconds a session can be kept
+	// alive by refreshing its token. It's counted from the session's original
+	// login. Can be overridden by the ACCOUNTS_JWT_MAX_SESSION_AGE
+	// environment variable.
+	MaxSessionAge = 720 * 3600
+
+	// ErrSessionTooOld is returned when a token can't be refreshed because its
+	// session has reached MaxSessionAge.
+	ErrSessionTooOld = errors.New("session has reached its maximum age, please log in again")
+
+	// keySetMu guards AccountsJWKS and AccountsPublicJWKS.
+	keySetMu sync.RWMutex
 )
 
 type (
@@ -63,6 +90,10 @@ type (
 	}
 	tokenTraits struct {
 		Email string `json:"email"`
+		// Name is the user's display name. It's missing from tokens issued
+		// before we started including it and from those of users without a
+		// name.
+		Name string `json:"name,omitempty"`
 	}
 )
 
@@ -71,16 +102,17 @@ func ContextWithToken(ctx context.Context, token jwt.Token) context.Context {
 	return context.WithValue(ctx, ctxValue("token"), token)
 }
 
-// TokenForUser creates a serialized JWT token for the given user.
+// TokenForUser creates a serialized JWT token for the given user. The name is
+// optional.
 //
 // The tokens generated by this function are a slimmed down version of the ones
 // described in ValidateToken's docstring.
-func TokenForUser(email types.Email, sub string, jwtTTL int) (jwt.Token, error) {
+func TokenForUser(email types.Email, sub, name string, jwtTTL int) (jwt.Token, error) {
 	sigAlgo, key, err := signatureAlgoAndKey()
 	if err != nil {
 		return nil, err
 	}
-	t, err := tokenForUser(email, sub, jwtTTL)
+	t, err := tokenForUser(email, sub, name, jwtTTL)
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to build token")
 	}
@@ -95,6 +127,54 @@ func TokenForUser(email types.Email, sub string, jwtTTL int) (jwt.Token, error)
 	return tk, nil
 }
 
+// TokenRefresh creates a new signed token for the session of the given token.
+// The new token has the same jti and TTL as the given one but its expiration
+// is capped at MaxSessionAge after the session's original login. The email
+// and the name are taken from the caller, so the new token reflects changes
+// made since the original login.
+func TokenRefresh(t jwt.Token, email types.Email, name string) (jwt.Token, error) {
+	sigAlgo, key, err := signatureAlgoAndKey()
+	if err != nil {
+		return nil, err
+	}
+	sub, _, _, err := TokenFields(t)
+	if err != nil {
+		return nil, err
+	}
+	// Tokens issued before we started recording the original login time
+	// start their session at their own issue time.
+	origIAT := t.IssuedAt().UTC()
+	if v, ok := t.Get("orig_iat"); ok {
+		// Parsed tokens hold numeric claims as float64.
+		if f, ok := v.(float64); ok {
+			origIAT = time.Unix(int64(f), 0).UTC()
+		}
+	}
+	now := time.Now().UTC()
+	ttl := t.Expiration().Sub(t.IssuedAt())
+	maxExp := origIAT.Add(time.Duration(MaxSessionAge) * time.Second)
+	if now.Add(ttl).After(maxExp) {
+		ttl = maxExp.Sub(now)
+	}
+	if ttl < time.Second {
+		return nil, ErrSessionTooOld
+	}
+	nt, err := tokenForUser(email, sub, name, int(ttl.Seconds()))
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to build token")
+	}
+	err1 := nt.Set("jti", t.JwtID())
+	err2 := nt.Set("orig_iat", origIAT.Unix())
+	if err = errors.Compose(err1, err2); err != nil {
+		return nil, errors.AddContext(err, "failed to build token")
+	}
+	bytes, err := jwt.Sign(nt, sigAlgo, key)
+	if err != nil {
+		return nil, errors.New("failed to sign token")
+	}
+	return jwt.Parse(bytes)
+}
+
 // TokenFields extracts and returns some fields of interest from the JWT token.
 func TokenFields(t jwt.Token) (sub string, email string, token jwt.Token, err error) {
 	s, ok := t.Get("sub")
@@ -118,6 +198,22 @@ func TokenFields(t jwt.Token) (sub string, email string, token jwt.Token, err er
 	return
 }
 
+// TokenName extracts the user's display name from the JWT token. It returns an
+// empty string if the token doesn't carry a name, e.g. because it was issued
+// before we started including it. Legacy tokens might carry a structured name
+// as well, which we ignore.
+func TokenName(t jwt.Token) string {
+	sess, ok := t.Get("session")
+	if !ok {
+		return ""
+	}
+	session, _ := sess.(map[string]interface{})
+	identity, _ := session["identity"].(map[string]interface{})
+	traits, _ := identity["traits"].(map[string]interface{})
+	name, _ := traits["name"].(string)
+	return name
+}
+
 // TokenSerialize is a helper method that allows us to serialize a token.
 func TokenSerialize(t jwt.Token) ([]byte, error) {
 	sigAlgo, key, err := signatureAlgoAndKey()
@@ -187,7 +283,9 @@ func TokenSerialize(t jwt.Token) ([]byte, error) {
 //	 },
 //	}
 func ValidateToken(t string) (jwt.Token, error) {
-	token, err := jwt.Parse([]byte(t), jwt.WithKeySet(AccountsPublicJWKS))
+	// We look up the key by the token's kid. Tokens without a kid are only
+	// accepted while the set holds a single key.
+	token, err := jwt.Parse([]byte(t), jwt.WithKeySet(PublicKeySet()), jwt.UseDefaultKey(true))
 	if err != nil {
 		return nil, err
 	}
@@ -206,37 +304,90 @@ func ValidateToken(t string) (jwt.Token, error) {
 // See http://self-issued.info/docs/draft-ietf-oauth-json-web-token.html
 // Encoding RSA pub key: https://play.golang.org/p/mLpOxS-5Fy
 func LoadAccountsKeySet(logger *logrus.Logger) error {
-	b, err := ioutil.ReadFile(AccountsJWKSFile)
+	err := ReloadAccountsKeySet()
 	if err != nil {
-		logger.Warningln("ERROR while reading accounts JWKS", err)
+		logger.Warningln("ERROR while loading accounts JWKS", err)
 		return err
 	}
+	return nil
+}
+
+// ReloadAccountsKeySet reads the JWKS from AccountsJWKSFile and replaces the
+// cached key sets with it. The set can hold multiple keys, as long as each of
+// them has a unique kid, and it needs to hold the SigningKeyID key, if one is
+// configured. If the file is invalid, we keep using the current key sets.
+func ReloadAccountsKeySet() error {
+	b, err := ioutil.ReadFile(AccountsJWKSFile)
+	if err != nil {
+		return errors.AddContext(err, "failed to read JWKS file")
+	}
 	set := jwk.NewSet()
 	err = json.Unmarshal(b, set)
 	if err != nil {
-		logger.Warningln("ERROR while parsing accounts JWKS", err)
-		logger.Warningln("JWKS string:", string(b))
+		return errors.AddContext(err, "failed to parse JWKS")
+	}
+	if set.Len() == 0 {
+		return errors.New("JWKS is empty")
+	}
+	if set.Len() > 1 {
+		kids := make(map[string]struct{}, set.Len())
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Get(i)
+			kid := key.KeyID()
+			if kid == "" {
+				return errors.New("each key in a multi-key JWKS needs a kid")
+			}
+			if _, exists := kids[kid]; exists {
+				return fmt.Errorf("duplicate kid '%s' in JWKS", kid)
+			}
+			kids[kid] = struct{}{}
+		}
+	}
+	if _, _, err = signingAlgoAndKeyFromSet(set); err != nil {
 		return err
 	}
-	// Cache the key set.
-	AccountsJWKS = set
-	// Cache a public version of the key set.
-	AccountsPublicJWKS, err = jwk.PublicSetOf(AccountsJWKS)
+	publicSet, err := jwk.PublicSetOf(set)
 	if err != nil {
-		logger.Warningln("ERROR while fetching accounts public JWKS", err)
-		AccountsJWKS = nil
-		AccountsPublicJWKS = nil
-		return err
+		return errors.AddContext(err, "failed to build public JWKS")
 	}
+	keySetMu.Lock()
+	AccountsJWKS = set
+	AccountsPublicJWKS = publicSet
+	keySetMu.Unlock()
 	return nil
 }
 
-// signatureAlgoAndKey is a helper which returns the algorithm and key defined
-// by the current JWKS.
+// PublicKeySet returns the verification-only version of the current JWKS.
+func PublicKeySet() jwk.Set {
+	keySetMu.RLock()
+	defer keySetMu.RUnlock()
+	return AccountsPublicJWKS
+}
+
+// signatureAlgoAndKey is a helper which returns the algorithm and key we sign
+// new tokens with.
 func signatureAlgoAndKey() (jwa.SignatureAlgorithm, jwk.Key, error) {
-	key, found := AccountsJWKS.Get(0)
+	keySetMu.RLock()
+	set := AccountsJWKS
+	keySetMu.RUnlock()
+	if set == nil {
+		return "", nil, errors.New("JWKS is not loaded")
+	}
+	return signingAlgoAndKeyFromSet(set)
+}
+
+// signingAlgoAndKeyFromSet returns the SigningKeyID key of the given set,
+// or its first key if SigningKeyID is empty, along with its algorithm.
+func signingAlgoAndKeyFromSet(set jwk.Set) (jwa.SignatureAlgorithm, jwk.Key, error) {
+	var key jwk.Key
+	var found bool
+	if SigningKeyID == "" {
+		key, found = set.Get(0)
+	} else {
+		key, found = set.LookupKeyID(SigningKeyID)
+	}
 	if !found {
-		return "", nil, errors.New("JWKS is empty")
+		return "", nil, fmt.Errorf("JWKS doesn't have a signing key with kid '%s'", SigningKeyID)
 	}
 	var sigAlgo jwa.SignatureAlgorithm
 	for _, sa := range jwa.SignatureAlgorithms() {
@@ -252,10 +403,11 @@ func signatureAlgoAndKey() (jwa.SignatureAlgorithm, jwk.Key, error) {
 }
 
 // tokenForUser is a helper method that puts together an unsigned token based
-// on the provided values.
-func tokenForUser(emailAddr types.Email, sub string, jwtTTL int) (jwt.Token, error) {
-	if emailAddr == "" || sub == "" {
-		return nil, errors.New("email and sub cannot be empty")
+// on the provided values. The email is empty for users who registered with
+// only a pubkey.
+func tokenForUser(emailAddr types.Email, sub, name string, jwtTTL int) (jwt.Token, error) {
+	if sub == "" {
+		return nil, errors.New("sub cannot be empty")
 	}
 	if jwtTTL <= 0 {
 		jwtTTL = TTL
@@ -265,6 +417,7 @@ func tokenForUser(emailAddr types.Email, sub string, jwtTTL int) (jwt.Token, err
 		Identity: tokenIdentity{
 			Traits: tokenTraits{
 				Email: emailAddr.String(),
+				Name:  name,
 			},
 		},
 	}
@@ -275,7 +428,13 @@ func tokenForUser(emailAddr types.Email, sub string, jwtTTL int) (jwt.Token, err
 	err3 := t.Set("iss", PortalName)
 	err4 := t.Set("sub", sub)
 	err5 := t.Set("session", session)
-	err := errors.Compose(err1, err2, err3, err4, err5)
+	// The jti uniquely identifies the token, so we can track and revoke the
+	// session it belongs to.
+	err6 := t.Set("jti", hex.EncodeToString(fastrand.Bytes(16)))
+	// The orig_iat marks the start of the session. Refreshed tokens keep it,
+	// so we can limit how long a session can be kept alive.
+	err7 := t.Set("orig_iat", now.Unix())
+	err := errors.Compose(err1, err2, err3, err4, err5, err6, err7)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,8 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
 	"strings"
 	"testing"
@@ -8,6 +10,8 @@ import (
 
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
@@ -23,7 +27,7 @@ func TestJWT(t *testing.T) {
 	email := types.NewEmail(t.Name() + "@siasky.net")
 	sub := "this is a sub"
 	fakeSub := "fake sub"
-	tk, err := TokenForUser(email, sub, 0)
+	tk, err := TokenForUser(email, sub, "", 0)
 	if err != nil {
 		t.Fatal("failed to generate token:", err)
 	}
@@ -33,10 +37,18 @@ func TestJWT(t *testing.T) {
 	}
 
 	// Happy case.
-	_, err = ValidateToken(string(tkBytes))
+	vtk, err := ValidateToken(string(tkBytes))
 	if err != nil {
 		t.Fatal("failed to validate token:", err)
 	}
+	// Each token gets its own jti.
+	tk2, err := TokenForUser(email, sub, "", 0)
+	if err != nil {
+		t.Fatal("failed to generate token:", err)
+	}
+	if vtk.JwtID() == "" || vtk.JwtID() != tk.JwtID() || tk2.JwtID() == tk.JwtID() {
+		t.Fatalf("Unexpected jtis '%s', '%s' and '%s'", vtk.JwtID(), tk.JwtID(), tk2.JwtID())
+	}
 
 	// Change the data and ensure the validation will fail.
 	parts := strings.Split(string(tkBytes), ".")
@@ -106,3 +118,239 @@ func TestValidateToken_Expired(t *testing.T) {
 		t.Fatalf("Expected an ErrTokenExpired, got %v", err)
 	}
 }
+
+// TestTokenName ensures that we include the user's name in their tokens and
+// that tokens without a name, or with the legacy structured one, still
+// validate.
+func TestTokenName(t *testing.T) {
+	err := LoadAccountsKeySet(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	sub := "this is a sub"
+	name := "Jane Doe"
+	tk, err := TokenForUser(email, sub, name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkBytes, err := TokenSerialize(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vtk, err := ValidateToken(string(tkBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := TokenName(vtk); n != name {
+		t.Fatalf("Expected name '%s', got '%s'", name, n)
+	}
+	// Users without a name get no name trait.
+	tk, err = TokenForUser(email, sub, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkBytes, err = TokenSerialize(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(tkBytes), "name") {
+		t.Fatal("Expected no name trait.")
+	}
+
+	// Craft a legacy token, which carries a structured name.
+	legacy := jwt.New()
+	session := map[string]interface{}{
+		"active": true,
+		"identity": map[string]interface{}{
+			"traits": map[string]interface{}{
+				"email": email.String(),
+				"name":  map[string]string{"first": "Jane", "last": "Doe"},
+			},
+		},
+	}
+	err1 := legacy.Set("exp", time.Now().UTC().Unix()+60)
+	err2 := legacy.Set("sub", sub)
+	err3 := legacy.Set("session", session)
+	if err = errors.Compose(err1, err2, err3); err != nil {
+		t.Fatal(err)
+	}
+	tkBytes, err = TokenSerialize(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vtk, err = ValidateToken(string(tkBytes))
+	if err != nil {
+		t.Fatal("Failed to validate legacy token:", err)
+	}
+	s, e, _, err := TokenFields(vtk)
+	if err != nil || s != sub || e != email.String() {
+		t.Fatalf("Unexpected fields '%s', '%s' and %v", s, e, err)
+	}
+	if n := TokenName(vtk); n != "" {
+		t.Fatalf("Expected no name, got '%s'", n)
+	}
+}
+
+// TestTokenRefresh ensures that refreshed tokens keep their session's jti,
+// TTL and original login time, and that they can't outlive MaxSessionAge.
+func TestTokenRefresh(t *testing.T) {
+	err := LoadAccountsKeySet(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldMaxSessionAge := MaxSessionAge
+	defer func() { MaxSessionAge = oldMaxSessionAge }()
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	sub := "this is a sub"
+	tk, err := TokenForUser(email, sub, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origIAT, ok := tk.Get("orig_iat")
+	if !ok {
+		t.Fatal("Expected an orig_iat claim.")
+	}
+
+	// The refreshed token keeps the jti, the TTL and the orig_iat.
+	MaxSessionAge = 3600
+	rtk, err := TokenRefresh(tk, email, "Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtk.JwtID() != tk.JwtID() {
+		t.Fatalf("Expected jti '%s', got '%s'", tk.JwtID(), rtk.JwtID())
+	}
+	if ttl := rtk.Expiration().Sub(rtk.IssuedAt()); ttl != 100*time.Second {
+		t.Fatalf("Expected a TTL of 100s, got %v", ttl)
+	}
+	if v, _ := rtk.Get("orig_iat"); v != origIAT {
+		t.Fatalf("Expected orig_iat %v, got %v", origIAT, v)
+	}
+	if n := TokenName(rtk); n != "Jane Doe" {
+		t.Fatalf("Expected name 'Jane Doe', got '%s'", n)
+	}
+
+	// The expiration is capped at MaxSessionAge after the original login.
+	MaxSessionAge = 50
+	rtk, err = TokenRefresh(rtk, email, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxExp := time.Unix(int64(origIAT.(float64)), 0).Add(50 * time.Second)
+	if rtk.Expiration().After(maxExp) {
+		t.Fatalf("Expected the expiration to be capped at %v, got %v", maxExp, rtk.Expiration())
+	}
+
+	// Sessions older than MaxSessionAge can't be refreshed.
+	old := jwt.New()
+	now := time.Now().UTC()
+	err1 := old.Set("exp", now.Unix()+100)
+	err2 := old.Set("iat", now.Unix())
+	err3 := old.Set("sub", sub)
+	err4 := old.Set("orig_iat", now.Unix()-60)
+	err5 := old.Set("session", tokenSession{Identity: tokenIdentity{Traits: tokenTraits{Email: email.String()}}})
+	if err = errors.Compose(err1, err2, err3, err4, err5); err != nil {
+		t.Fatal(err)
+	}
+	tkBytes, err := TokenSerialize(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err = ValidateToken(string(tkBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = TokenRefresh(old, email, "")
+	if !errors.Contains(err, ErrSessionTooOld) {
+		t.Fatalf("Expected %v, got %v", ErrSessionTooOld, err)
+	}
+}
+
+// TestKeyRotation ensures that we sign new tokens with the SigningKeyID key
+// and that we accept tokens signed with any key in the JWKS but no others.
+func TestKeyRotation(t *testing.T) {
+	oldFile, oldKID := AccountsJWKSFile, SigningKeyID
+	defer func() {
+		AccountsJWKSFile, SigningKeyID = oldFile, oldKID
+		if err := ReloadAccountsKeySet(); err != nil {
+			t.Error(err)
+		}
+	}()
+	kidA := "private:5c4f0e0a-7f54-4d1b-9a0e-3f1f2b8e6c11"
+	kidB := "private:9b2d7c3e-1a6f-4e8b-b5d2-6e0c4a7f8d22"
+	AccountsJWKSFile = "fixtures/jwks_rotation.json"
+	SigningKeyID = kidA
+	err := ReloadAccountsKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	// issue returns a serialized token signed with the current signing key.
+	issue := func() string {
+		tk, err := TokenForUser(email, "this is a sub", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := TokenSerialize(tk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	// kidOf returns the kid in the header of the given token.
+	kidOf := func(tk string) string {
+		msg, err := jws.Parse([]byte(tk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Signatures()[0].ProtectedHeaders().KeyID()
+	}
+	tkA := issue()
+	SigningKeyID = kidB
+	tkB := issue()
+	if kidOf(tkA) != kidA || kidOf(tkB) != kidB {
+		t.Fatalf("Expected kids '%s' and '%s', got '%s' and '%s'", kidA, kidB, kidOf(tkA), kidOf(tkB))
+	}
+	for _, tk := range []string{tkA, tkB} {
+		if _, err = ValidateToken(tk); err != nil {
+			t.Fatal("Failed to validate token:", err)
+		}
+	}
+
+	// Tokens signed with a key which isn't in the set are rejected, whether
+	// they carry a kid from the set or not.
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kid := range []string{"private:unknown", kidA} {
+		key, err := jwk.New(rk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = key.Set(jwk.KeyIDKey, kid); err != nil {
+			t.Fatal(err)
+		}
+		tk, err := tokenForUser(email, "this is a sub", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := jwt.Sign(tk, jwa.RS256, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ValidateToken(string(b)); err == nil {
+			t.Fatalf("Expected a token signed by a foreign key with kid '%s' to be rejected", kid)
+		}
+	}
+
+	// An unknown signing kid fails the reload and we keep the current set.
+	SigningKeyID = "private:unknown"
+	if err = ReloadAccountsKeySet(); err == nil {
+		t.Fatal("Expected the reload to fail.")
+	}
+	if _, err = ValidateToken(tkA); err != nil {
+		t.Fatal("Failed to validate token:", err)
+	}
+}
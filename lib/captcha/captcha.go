@@ -0,0 +1,117 @@
+// Package captcha verifies the captcha tokens our users get when they solve an
+// hCaptcha or Cloudflare Turnstile challenge on the portal's website.
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// ProviderHCaptcha is the name of the hCaptcha provider.
+	ProviderHCaptcha = "hcaptcha"
+	// ProviderTurnstile is the name of the Cloudflare Turnstile provider.
+	ProviderTurnstile = "turnstile"
+
+	// maxResponseSize limits how much of the provider's response we read.
+	maxResponseSize = 64 * 1024
+)
+
+var (
+	// ErrInvalidToken is returned when the provider rejects a token, e.g.
+	// because it's malformed, expired or has already been used.
+	ErrInvalidToken = errors.New("invalid captcha token")
+	// ErrUnknownProvider is returned when we don't know the given provider.
+	ErrUnknownProvider = errors.New("unknown captcha provider")
+
+	// siteverifyURLs maps the providers we support to their siteverify
+	// endpoints. Both providers use the same protocol.
+	siteverifyURLs = map[string]string{
+		ProviderHCaptcha:  "https://api.hcaptcha.com/siteverify",
+		ProviderTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	}
+)
+
+type (
+	// Verifier verifies captcha tokens.
+	Verifier interface {
+		// Verify checks the given token with the provider. The remote IP is
+		// optional. It returns ErrInvalidToken if the provider rejects the
+		// token and other errors if we fail to ask the provider.
+		Verify(ctx context.Context, token, remoteIP string) error
+	}
+
+	// Client is a Verifier which verifies tokens via a provider's
+	// siteverify endpoint.
+	Client struct {
+		staticSecret string
+		staticURL    string
+		staticClient *http.Client
+	}
+
+	// siteverifyResponse is the response of a siteverify endpoint.
+	siteverifyResponse struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+)
+
+// New returns a Client for the given provider which authenticates with the
+// given secret. It doesn't set a timeout, so callers should pass a context
+// with a deadline to Verify.
+func New(provider, secret string) (*Client, error) {
+	u, ok := siteverifyURLs[strings.ToLower(provider)]
+	if !ok {
+		return nil, errors.AddContext(ErrUnknownProvider, provider)
+	}
+	return NewWithURL(u, secret), nil
+}
+
+// NewWithURL returns a Client which verifies tokens via the given siteverify
+// endpoint.
+func NewWithURL(siteverifyURL, secret string) *Client {
+	return &Client{
+		staticSecret: secret,
+		staticURL:    siteverifyURL,
+		staticClient: &http.Client{},
+	}
+}
+
+// Verify checks the given token with the provider.
+func (c *Client) Verify(ctx context.Context, token, remoteIP string) error {
+	form := url.Values{}
+	form.Set("secret", c.staticSecret)
+	form.Set("response", token)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.staticURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.AddContext(err, "failed to create siteverify request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.staticClient.Do(req)
+	if err != nil {
+		return errors.AddContext(err, "failed to call siteverify")
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("siteverify responded with status %d", resp.StatusCode)
+	}
+	var sr siteverifyResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&sr)
+	if err != nil {
+		return errors.AddContext(err, "failed to parse siteverify response")
+	}
+	if !sr.Success {
+		return errors.AddContext(ErrInvalidToken, strings.Join(sr.ErrorCodes, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestClientVerify ensures that Client sends the token to the siteverify
+// endpoint and tells rejected tokens apart from failures to reach the
+// provider.
+func TestClientVerify(t *testing.T) {
+	const secret = "secret"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("secret") != secret {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.FormValue("response") {
+		case "valid":
+			if r.FormValue("remoteip") != "1.2.3.4" {
+				t.Errorf("Expected remote IP '1.2.3.4', got '%s'", r.FormValue("remoteip"))
+			}
+			_ = json.NewEncoder(w).Encode(siteverifyResponse{Success: true})
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			_ = json.NewEncoder(w).Encode(siteverifyResponse{Success: true})
+		case "garbage":
+			_, _ = w.Write([]byte("not json"))
+		default:
+			_ = json.NewEncoder(w).Encode(siteverifyResponse{ErrorCodes: []string{"invalid-input-response"}})
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c := NewWithURL(srv.URL, secret)
+	if err := c.Verify(ctx, "valid", "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(ctx, "invalid", ""); !errors.Contains(err, ErrInvalidToken) {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidToken, err)
+	}
+	// Failures to get an answer from the provider are not ErrInvalidToken.
+	ctxTimeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := c.Verify(ctxTimeout, "slow", ""); err == nil || errors.Contains(err, ErrInvalidToken) {
+		t.Fatalf("Expected a timeout, got '%v'", err)
+	}
+	if err := c.Verify(ctx, "garbage", ""); err == nil || errors.Contains(err, ErrInvalidToken) {
+		t.Fatalf("Expected a parsing error, got '%v'", err)
+	}
+	if err := NewWithURL(srv.URL, "wrong").Verify(ctx, "valid", ""); err == nil || errors.Contains(err, ErrInvalidToken) {
+		t.Fatalf("Expected a status error, got '%v'", err)
+	}
+
+	// We know both providers.
+	for _, p := range []string{ProviderHCaptcha, ProviderTurnstile, "HCaptcha"} {
+		if _, err := New(p, secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := New("recaptcha", secret); !errors.Contains(err, ErrUnknownProvider) {
+		t.Fatalf("Expected '%v', got '%v'", ErrUnknownProvider, err)
+	}
+}
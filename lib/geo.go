@@ -0,0 +1,353 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+var (
+	// ErrInvalidMMDB is returned when a file is not a valid MaxMind DB.
+	ErrInvalidMMDB = errors.New("invalid MaxMind DB file")
+
+	// mmdbMetadataMarker precedes the metadata section of a MaxMind DB file.
+	mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+)
+
+const (
+	// mmdbDataSeparatorSize is the size of the zero-filled gap between the
+	// search tree and the data section of a MaxMind DB file.
+	mmdbDataSeparatorSize = 16
+	// mmdbMaxDepth limits how deep we follow nested values and pointers, so a
+	// malformed file can't send us into an endless loop.
+	mmdbMaxDepth = 32
+)
+
+// MaxMind DB data types, see
+// https://maxmind.github.io/MaxMind-DB/#output-data-section
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+type (
+	// GeoResolver resolves the country an IP address belongs to.
+	GeoResolver interface {
+		// Country returns the ISO 3166-1 alpha-2 code of the country the
+		// given IP belongs to. It returns an empty string if the country is
+		// not known.
+		Country(ip net.IP) (string, error)
+	}
+
+	// NoGeoResolver is a GeoResolver which doesn't know the country of any
+	// IP. We use it when no geolocation database is configured.
+	NoGeoResolver struct{}
+
+	// MMDBGeoResolver is a GeoResolver backed by a MaxMind DB file, such as
+	// GeoLite2-Country or GeoIP2-City. It keeps the whole file in memory.
+	MMDBGeoResolver struct {
+		staticData       []byte
+		staticDataOffset int
+		staticIPv4Start  uint
+		staticIPVersion  uint
+		staticNodeCount  uint
+		staticRecordSize uint
+	}
+
+	// mmdbDecoder decodes values from a section of a MaxMind DB file.
+	// Pointers are relative to the start of the section.
+	mmdbDecoder struct {
+		buf []byte
+	}
+)
+
+// Country returns an empty string for all IPs.
+func (NoGeoResolver) Country(_ net.IP) (string, error) {
+	return "", nil
+}
+
+// NewMMDBGeoResolver loads the MaxMind DB file at the given path.
+func NewMMDBGeoResolver(path string) (*MMDBGeoResolver, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to read geolocation database")
+	}
+	return NewMMDBGeoResolverFromBytes(b)
+}
+
+// NewMMDBGeoResolverFromBytes parses the given MaxMind DB file contents.
+func NewMMDBGeoResolverFromBytes(b []byte) (*MMDBGeoResolver, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.AddContext(ErrInvalidMMDB, "metadata not found")
+	}
+	md := mmdbDecoder{buf: b[i+len(mmdbMetadataMarker):]}
+	v, _, err := md.decode(0, 0)
+	if err != nil {
+		return nil, errors.Compose(ErrInvalidMMDB, err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.AddContext(ErrInvalidMMDB, "invalid metadata")
+	}
+	nodeCount, ok1 := meta["node_count"].(uint64)
+	recordSize, ok2 := meta["record_size"].(uint64)
+	ipVersion, ok3 := meta["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, errors.AddContext(ErrInvalidMMDB, "missing metadata fields")
+	}
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, errors.AddContext(ErrInvalidMMDB, fmt.Sprintf("unsupported record size %d", recordSize))
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, errors.AddContext(ErrInvalidMMDB, fmt.Sprintf("unsupported IP version %d", ipVersion))
+	}
+	// Each node takes at least six bytes, so checking the node count first
+	// also keeps the tree size from overflowing.
+	treeSize := nodeCount * recordSize / 4
+	if nodeCount > uint64(i) || treeSize+mmdbDataSeparatorSize > uint64(i) {
+		return nil, errors.AddContext(ErrInvalidMMDB, "search tree exceeds the file")
+	}
+	r := &MMDBGeoResolver{
+		staticData:       b[:i],
+		staticDataOffset: int(treeSize) + mmdbDataSeparatorSize,
+		staticIPVersion:  uint(ipVersion),
+		staticNodeCount:  uint(nodeCount),
+		staticRecordSize: uint(recordSize),
+	}
+	// IPv4 addresses live under ::/96 in IPv6 databases, so we find that
+	// node once.
+	if r.staticIPVersion == 6 {
+		for depth := 0; depth < 96 && r.staticIPv4Start < r.staticNodeCount; depth++ {
+			r.staticIPv4Start = r.record(r.staticIPv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Country returns the ISO code of the country the given IP belongs to. We
+// prefer the country in which the IP is located and fall back to the one in
+// which its block is registered.
+func (r *MMDBGeoResolver) Country(ip net.IP) (string, error) {
+	rec, err := r.lookup(ip)
+	if err != nil || rec == nil {
+		return "", err
+	}
+	for _, field := range []string{"country", "registered_country"} {
+		c, _ := rec[field].(map[string]interface{})
+		if code, ok := c["iso_code"].(string); ok && code != "" {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// lookup returns the data record of the given IP, or nil if the database
+// doesn't have one.
+func (r *MMDBGeoResolver) lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	bits := net.IP(nil)
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		node = r.staticIPv4Start
+	} else if r.staticIPVersion == 6 && len(ip) == net.IPv6len {
+		bits = ip
+	} else {
+		return nil, fmt.Errorf("invalid IP '%v'", ip)
+	}
+	for i := 0; i < len(bits)*8 && node < r.staticNodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.staticNodeCount {
+		return nil, nil
+	}
+	if node < r.staticNodeCount {
+		return nil, errors.AddContext(ErrInvalidMMDB, "search tree is too deep")
+	}
+	offset := int(node-r.staticNodeCount) - mmdbDataSeparatorSize
+	d := mmdbDecoder{buf: r.staticData[r.staticDataOffset:]}
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, errors.Compose(ErrInvalidMMDB, err)
+	}
+	rec, _ := v.(map[string]interface{})
+	return rec, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the given node.
+func (r *MMDBGeoResolver) record(node, bit uint) uint {
+	b := r.staticData[node*r.staticRecordSize/4:]
+	switch r.staticRecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decode decodes the value at the given offset. It returns the value and the
+// offset right after it.
+func (d mmdbDecoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data is nested too deeply")
+	}
+	if offset < 0 || offset >= len(d.buf) {
+		return nil, 0, errors.New("offset out of bounds")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == mmdbTypePointer {
+		return d.decodePointer(ctrl, offset, depth)
+	}
+	if typ == mmdbTypeExtended {
+		if offset >= len(d.buf) {
+			return nil, 0, errors.New("offset out of bounds")
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+	size := int(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d.buf) {
+			return nil, 0, errors.New("offset out of bounds")
+		}
+		v := 0
+		for _, c := range d.buf[offset : offset+n] {
+			v = v<<8 | int(c)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	// Each map entry and array element takes at least one byte, so we don't
+	// preallocate more than the rest of the buffer could hold. This keeps a
+	// malformed size from allocating gigabytes.
+	capacity := size
+	if rest := len(d.buf) - offset; capacity > rest {
+		capacity = rest
+	}
+	switch typ {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, capacity)
+		for i := 0; i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[key], offset, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, 0, capacity)
+		for i := 0; i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > len(d.buf) {
+		return nil, 0, errors.New("value exceeds the data section")
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+	switch typ {
+	case mmdbTypeString:
+		return string(b), offset, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case mmdbTypeInt32:
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int32(v), offset, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+// decodePointer follows the pointer with the given control byte whose
+// payload starts at the given offset. It returns the value it points to and
+// the offset right after the pointer itself.
+func (d mmdbDecoder) decodePointer(ctrl byte, offset, depth int) (interface{}, int, error) {
+	n := int(ctrl>>3)&0x3 + 1
+	if offset+n > len(d.buf) {
+		return nil, 0, errors.New("offset out of bounds")
+	}
+	b := d.buf[offset : offset+n]
+	var p int
+	switch n {
+	case 1:
+		p = int(ctrl&0x7)<<8 | int(b[0])
+	case 2:
+		p = (int(ctrl&0x7)<<16 | int(b[0])<<8 | int(b[1])) + 2048
+	case 3:
+		p = (int(ctrl&0x7)<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+	default:
+		p = int(binary.BigEndian.Uint32(b))
+	}
+	v, _, err := d.decode(p, depth+1)
+	return v, offset + n, err
+}
@@ -0,0 +1,535 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestMMDBGeoResolver ensures that MMDBGeoResolver finds the countries of IPs
+// in a small MaxMind DB file with the following networks:
+//
+//	0.0.0.0/1   DE
+//	128.0.0.0/2 US, as a registered country
+//	192.0.0.0/2 no data
+func TestMMDBGeoResolver(t *testing.T) {
+	str := func(s string) []byte {
+		return append([]byte{mmdbTypeString<<5 | byte(len(s))}, s...)
+	}
+	mp := func(n int) []byte {
+		return []byte{mmdbTypeMap<<5 | byte(n)}
+	}
+	u16 := func(v uint16) []byte {
+		return []byte{mmdbTypeUint16<<5 | 2, byte(v >> 8), byte(v)}
+	}
+	// Data section. The second record refers to the first one's key via a
+	// pointer.
+	var data []byte
+	recDE := len(data)
+	data = append(data, mp(1)...)
+	data = append(data, str("country")...)
+	data = append(data, mp(1)...)
+	isoKey := len(data)
+	data = append(data, str("iso_code")...)
+	data = append(data, str("DE")...)
+	recUS := len(data)
+	data = append(data, mp(1)...)
+	data = append(data, str("registered_country")...)
+	data = append(data, mp(1)...)
+	data = append(data, mmdbTypePointer<<5, byte(isoKey))
+	data = append(data, str("US")...)
+
+	// Search tree with 24-bit records.
+	const nodeCount = 2
+	rec := func(v int) []byte {
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	dataPtr := func(offset int) int {
+		return nodeCount + mmdbDataSeparatorSize + offset
+	}
+	var b []byte
+	b = append(b, rec(dataPtr(recDE))...)
+	b = append(b, rec(1)...)
+	b = append(b, rec(dataPtr(recUS))...)
+	b = append(b, rec(nodeCount)...)
+	b = append(b, make([]byte, mmdbDataSeparatorSize)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	b = append(b, mp(3)...)
+	b = append(b, str("node_count")...)
+	b = append(b, u16(nodeCount)...)
+	b = append(b, str("record_size")...)
+	b = append(b, u16(24)...)
+	b = append(b, str("ip_version")...)
+	b = append(b, u16(4)...)
+
+	r, err := NewMMDBGeoResolverFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"1.2.3.4":         "DE",
+		"127.255.255.255": "DE",
+		"128.0.0.1":       "US",
+		"191.1.1.1":       "US",
+		"192.168.0.1":     "",
+		"255.255.255.255": "",
+	}
+	for ip, expected := range tests {
+		c, err := r.Country(net.ParseIP(ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != expected {
+			t.Fatalf("Expected '%s' for %s, got '%s'", expected, ip, c)
+		}
+	}
+	// IPv4 databases don't know about IPv6 addresses.
+	_, err = r.Country(net.ParseIP("2001:db8::1"))
+	if err == nil {
+		t.Fatal("Expected an error for an IPv6 address.")
+	}
+
+	// Files without metadata are rejected.
+	_, err = NewMMDBGeoResolverFromBytes(bytes.Repeat([]byte{0}, 100))
+	if err == nil {
+		t.Fatal("Expected an error for an invalid file.")
+	}
+}
+
+// mmdbUint128 marks a byte slice which the test encoder stores as a uint128
+// instead of as bytes.
+type mmdbUint128 []byte
+
+// mmdbEncode encodes the given value as described by the MaxMind DB spec.
+func mmdbEncode(t *testing.T, v interface{}) []byte {
+	uintBytes := func(v uint64) []byte {
+		var b []byte
+		for ; v > 0; v >>= 8 {
+			b = append([]byte{byte(v)}, b...)
+		}
+		return b
+	}
+	var typ, size int
+	var payload []byte
+	switch v := v.(type) {
+	case string:
+		typ, payload = mmdbTypeString, []byte(v)
+	case []byte:
+		typ, payload = mmdbTypeBytes, v
+	case mmdbUint128:
+		typ, payload = mmdbTypeUint128, v
+	case uint16:
+		typ, payload = mmdbTypeUint16, uintBytes(uint64(v))
+	case uint32:
+		typ, payload = mmdbTypeUint32, uintBytes(uint64(v))
+	case uint64:
+		typ, payload = mmdbTypeUint64, uintBytes(v)
+	case int32:
+		typ, payload = mmdbTypeInt32, uintBytes(uint64(uint32(v)))
+	case float64:
+		typ, payload = mmdbTypeDouble, make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, math.Float64bits(v))
+	case float32:
+		typ, payload = mmdbTypeFloat, make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, math.Float32bits(v))
+	case bool:
+		typ = mmdbTypeBool
+		if v {
+			size = 1
+		}
+	case map[string]interface{}:
+		typ, size = mmdbTypeMap, len(v)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			payload = append(payload, mmdbEncode(t, k)...)
+			payload = append(payload, mmdbEncode(t, v[k])...)
+		}
+	case []interface{}:
+		typ, size = mmdbTypeArray, len(v)
+		for _, e := range v {
+			payload = append(payload, mmdbEncode(t, e)...)
+		}
+	default:
+		t.Fatalf("Unsupported type %T", v)
+	}
+	if typ != mmdbTypeMap && typ != mmdbTypeArray && typ != mmdbTypeBool {
+		size = len(payload)
+	}
+	var b []byte
+	if typ > 7 {
+		b = []byte{0, byte(typ - 7)}
+	} else {
+		b = []byte{byte(typ << 5)}
+	}
+	switch {
+	case size < 29:
+		b[0] |= byte(size)
+	case size < 285:
+		b[0] |= 29
+		b = append(b, byte(size-29))
+	case size < 65821:
+		b[0] |= 30
+		b = append(b, byte((size-285)>>8), byte(size-285))
+	default:
+		b[0] |= 31
+		b = append(b, byte((size-65821)>>16), byte((size-65821)>>8), byte(size-65821))
+	}
+	return append(b, payload...)
+}
+
+// mmdbEncodePointer encodes a pointer to the given offset.
+func mmdbEncodePointer(p int) []byte {
+	switch {
+	case p < 2048:
+		return []byte{mmdbTypePointer<<5 | byte(p>>8)&0x7, byte(p)}
+	case p < 526336:
+		p -= 2048
+		return []byte{mmdbTypePointer<<5 | 1<<3 | byte(p>>16)&0x7, byte(p >> 8), byte(p)}
+	case p < 134744064:
+		p -= 526336
+		return []byte{mmdbTypePointer<<5 | 2<<3 | byte(p>>24)&0x7, byte(p >> 16), byte(p >> 8), byte(p)}
+	default:
+		return []byte{mmdbTypePointer<<5 | 3<<3, byte(p >> 24), byte(p >> 16), byte(p >> 8), byte(p)}
+	}
+}
+
+// buildTestMMDB builds a MaxMind DB file with the given IP version and record
+// size which maps the given networks to the given countries. The networks
+// must not overlap. IPv4 networks in IPv6 files go under ::/96.
+func buildTestMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]string) []byte {
+	// Each node has two records. A record is either the index of another
+	// node, -1 for no data, or -2-i for the data of the i-th country.
+	type node [2]int
+	nodes := []node{{-1, -1}}
+	var countries []string
+	for cidr, country := range networks {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		bits := []byte(ip.To16())
+		if ip4 := ip.To4(); ip4 != nil {
+			bits = ip4
+			if ipVersion == 6 {
+				bits = append(make([]byte, 12), ip4...)
+				ones += 96
+			}
+		}
+		countries = append(countries, country)
+		n := 0
+		for i := 0; i < ones; i++ {
+			bit := int(bits[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[n][bit] = -1 - len(countries)
+				break
+			}
+			if nodes[n][bit] < 0 {
+				nodes = append(nodes, node{-1, -1})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+	var data []byte
+	offsets := make([]int, len(countries))
+	for i, c := range countries {
+		offsets[i] = len(data)
+		data = append(data, mmdbEncode(t, map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": c},
+		})...)
+	}
+	nodeCount := len(nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r >= 0:
+			return uint32(r)
+		case r == -1:
+			return uint32(nodeCount)
+		default:
+			return uint32(nodeCount + mmdbDataSeparatorSize + offsets[-2-r])
+		}
+	}
+	var b []byte
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>20)&0xF0|byte(r>>24)&0x0F, byte(r>>16), byte(r>>8), byte(r))
+		default:
+			b = append(b, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	b = append(b, make([]byte, mmdbDataSeparatorSize)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	b = append(b, mmdbEncode(t, map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test",
+		"languages":     []interface{}{"en"},
+	})...)
+	return b
+}
+
+// TestMMDBGeoResolverFormats ensures that MMDBGeoResolver reads IPv4 and IPv6
+// files with all supported record sizes.
+func TestMMDBGeoResolverFormats(t *testing.T) {
+	networks := map[string]string{
+		"1.0.0.0/8":      "AU",
+		"2.3.0.0/16":     "FR",
+		"81.2.69.160/27": "GB",
+	}
+	tests := map[string]string{
+		"1.0.0.1":       "AU",
+		"1.255.255.255": "AU",
+		"2.3.4.5":       "FR",
+		"2.4.0.0":       "",
+		"81.2.69.161":   "GB",
+		"81.2.69.192":   "",
+		"8.8.8.8":       "",
+	}
+	for _, ipVersion := range []int{4, 6} {
+		nets := networks
+		if ipVersion == 6 {
+			nets = map[string]string{"2001:db8::/32": "NL"}
+			for k, v := range networks {
+				nets[k] = v
+			}
+		}
+		for _, recordSize := range []int{24, 28, 32} {
+			r, err := NewMMDBGeoResolverFromBytes(buildTestMMDB(t, ipVersion, recordSize, nets))
+			if err != nil {
+				t.Fatalf("IPv%d, %d bit records: %v", ipVersion, recordSize, err)
+			}
+			for ip, expected := range tests {
+				c, err := r.Country(net.ParseIP(ip))
+				if err != nil || c != expected {
+					t.Fatalf("IPv%d, %d bit records: expected '%s' for %s, got '%s' and %v", ipVersion, recordSize, expected, ip, c, err)
+				}
+			}
+			v6 := map[string]string{"2001:db8::1": "", "2001:db9::1": ""}
+			if ipVersion == 6 {
+				v6["2001:db8::1"] = "NL"
+			}
+			for ip, expected := range v6 {
+				c, err := r.Country(net.ParseIP(ip))
+				if ipVersion == 4 {
+					if err == nil {
+						t.Fatalf("Expected an error for %s in an IPv4 file.", ip)
+					}
+					continue
+				}
+				if err != nil || c != expected {
+					t.Fatalf("IPv%d, %d bit records: expected '%s' for %s, got '%s' and %v", ipVersion, recordSize, expected, ip, c, err)
+				}
+			}
+		}
+	}
+}
+
+// TestMMDBGeoResolverRecord ensures that record reads the records of all
+// supported sizes, including the high bits of 28 bit records.
+func TestMMDBGeoResolverRecord(t *testing.T) {
+	tests := []struct {
+		recordSize  uint
+		node        []byte
+		left, right uint
+	}{
+		{recordSize: 24, node: []byte{0xAB, 0xCD, 0xEF, 0x12, 0x34, 0x56}, left: 0xABCDEF, right: 0x123456},
+		{recordSize: 28, node: []byte{0xBC, 0xDE, 0xF1, 0xA2, 0x34, 0x56, 0x78}, left: 0xABCDEF1, right: 0x2345678},
+		{recordSize: 32, node: []byte{0xDE, 0xAD, 0xBE, 0xEF, 0x01, 0x02, 0x03, 0x04}, left: 0xDEADBEEF, right: 0x01020304},
+	}
+	for _, tt := range tests {
+		// Put the node second, so we also check the node offsets.
+		data := append(make([]byte, len(tt.node)), tt.node...)
+		r := &MMDBGeoResolver{staticData: data, staticRecordSize: tt.recordSize, staticNodeCount: 2}
+		if l := r.record(1, 0); l != tt.left {
+			t.Fatalf("%d bit records: expected left record %x, got %x", tt.recordSize, tt.left, l)
+		}
+		if rr := r.record(1, 1); rr != tt.right {
+			t.Fatalf("%d bit records: expected right record %x, got %x", tt.recordSize, tt.right, rr)
+		}
+	}
+}
+
+// TestMMDBDecoder ensures that mmdbDecoder decodes all supported data types,
+// long values and pointers of all sizes.
+func TestMMDBDecoder(t *testing.T) {
+	values := []interface{}{
+		"",
+		"short",
+		strings.Repeat("a", 28),
+		strings.Repeat("b", 29),
+		strings.Repeat("c", 300),
+		strings.Repeat("d", 70000),
+		[]byte{1, 2, 3},
+		uint16(0),
+		uint16(0xFFFF),
+		uint32(0xDEADBEEF),
+		uint64(0xFFFFFFFFFFFFFFFF),
+		int32(-5),
+		int32(1 << 30),
+		float64(3.25),
+		float32(-1.5),
+		true,
+		false,
+		[]interface{}{"a", uint16(1), []interface{}{}},
+		map[string]interface{}{
+			"nested": map[string]interface{}{"names": map[string]interface{}{"en": "Germany", "de": "Deutschland"}},
+			"list":   []interface{}{uint32(1), uint32(2)},
+		},
+	}
+	expected := func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case uint16:
+			return uint64(v)
+		case uint32:
+			return uint64(v)
+		case []interface{}:
+			out := make([]interface{}, 0, len(v))
+			for _, e := range v {
+				out = append(out, e)
+			}
+			return out
+		}
+		return v
+	}
+	var normalise func(v interface{}) interface{}
+	normalise = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case []interface{}:
+			out := make([]interface{}, 0, len(v))
+			for _, e := range v {
+				out = append(out, normalise(expected(e)))
+			}
+			return out
+		case map[string]interface{}:
+			out := make(map[string]interface{}, len(v))
+			for k, e := range v {
+				out[k] = normalise(expected(e))
+			}
+			return out
+		}
+		return expected(v)
+	}
+	for _, v := range values {
+		b := mmdbEncode(t, v)
+		d := mmdbDecoder{buf: b}
+		got, next, err := d.decode(0, 0)
+		if err != nil {
+			t.Fatalf("Failed to decode %T: %v", v, err)
+		}
+		if next != len(b) {
+			t.Fatalf("Expected %T to end at %d, got %d", v, len(b), next)
+		}
+		if !reflect.DeepEqual(got, normalise(v)) {
+			t.Fatalf("Expected %v, got %v", normalise(v), got)
+		}
+	}
+	// Uint128 values are returned as bytes.
+	b := mmdbEncode(t, mmdbUint128{0xFF, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+	got, _, err := mmdbDecoder{buf: b}.decode(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := got.([]byte); !ok || len(u) != 16 || u[0] != 0xFF || u[15] != 1 {
+		t.Fatalf("Unexpected uint128 %v", got)
+	}
+
+	// Pointers of all sizes resolve to the value they point to. Decoding
+	// continues right after the pointer.
+	for _, target := range []int{100, 3000, 600000} {
+		p := mmdbEncodePointer(target)
+		buf := make([]byte, target)
+		copy(buf, p)
+		buf = append(buf, mmdbEncode(t, "target")...)
+		got, next, err := mmdbDecoder{buf: buf}.decode(0, 0)
+		if err != nil {
+			t.Fatalf("Failed to follow a pointer to %d: %v", target, err)
+		}
+		if got != "target" || next != len(p) {
+			t.Fatalf("Expected 'target' and %d for a pointer to %d, got '%v' and %d", len(p), target, got, next)
+		}
+	}
+}
+
+// TestMMDBMalformed ensures that we reject malformed files and values with an
+// error instead of panicking or allocating huge amounts of memory.
+func TestMMDBMalformed(t *testing.T) {
+	valid := buildTestMMDB(t, 6, 28, map[string]string{"1.0.0.0/8": "AU", "2001:db8::/32": "NL"})
+	withMeta := func(meta map[string]interface{}) []byte {
+		i := bytes.LastIndex(valid, mmdbMetadataMarker)
+		b := append([]byte(nil), valid[:i+len(mmdbMetadataMarker)]...)
+		return append(b, mmdbEncode(t, meta)...)
+	}
+	files := map[string][]byte{
+		"empty":            {},
+		"no metadata":      bytes.Repeat([]byte{0}, 100),
+		"metadata not map": append(append([]byte(nil), mmdbMetadataMarker...), mmdbEncode(t, "x")...),
+		"missing fields":   withMeta(map[string]interface{}{"node_count": uint32(1)}),
+		"record size":      withMeta(map[string]interface{}{"node_count": uint32(1), "record_size": uint16(20), "ip_version": uint16(6)}),
+		"ip version":       withMeta(map[string]interface{}{"node_count": uint32(1), "record_size": uint16(24), "ip_version": uint16(5)}),
+		"tree too large":   withMeta(map[string]interface{}{"node_count": uint32(1 << 20), "record_size": uint16(24), "ip_version": uint16(6)}),
+		"tree overflow":    withMeta(map[string]interface{}{"node_count": uint64(1 << 62), "record_size": uint16(32), "ip_version": uint16(6)}),
+		"truncated":        valid[:len(valid)-1],
+	}
+	for name, b := range files {
+		_, err := NewMMDBGeoResolverFromBytes(b)
+		if !errors.Contains(err, ErrInvalidMMDB) {
+			t.Fatalf("%s: expected '%v', got '%v'", name, ErrInvalidMMDB, err)
+		}
+	}
+
+	values := map[string][]byte{
+		"pointer loop":     mmdbEncodePointer(0),
+		"pointer oob":      mmdbEncodePointer(1000),
+		"truncated string": mmdbEncode(t, "abc")[:2],
+		"truncated size":   {mmdbTypeString<<5 | 30, 1},
+		"map key":          append([]byte{mmdbTypeMap<<5 | 1}, mmdbEncode(t, uint16(1))...),
+		"huge map":         {mmdbTypeMap<<5 | 31, 0xFF, 0xFF, 0xFF},
+		"huge array":       {31, mmdbTypeArray - 7, 0xFF, 0xFF, 0xFF},
+		"double size":      {mmdbTypeDouble<<5 | 4, 0, 0, 0, 0},
+		"float size":       {8, mmdbTypeFloat - 7, 0, 0, 0, 0, 0, 0, 0, 0},
+		"unknown type":     {0, mmdbTypeEndMarker - 7},
+		"missing extended": {0},
+	}
+	for name, b := range values {
+		_, _, err := mmdbDecoder{buf: b}.decode(0, 0)
+		if err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+
+	// Corrupting any single byte of a valid file might give us wrong
+	// countries or errors but must not make us panic.
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("8.8.8.8"), net.ParseIP("2001:db8::1"), net.ParseIP("::1")}
+	for i := range valid {
+		for _, flip := range []byte{0x01, 0x80, 0xFF} {
+			b := append([]byte(nil), valid...)
+			b[i] ^= flip
+			r, err := NewMMDBGeoResolverFromBytes(b)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				_, _ = r.Country(ip)
+			}
+		}
+	}
+}
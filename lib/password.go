@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+var (
+	// MinPasswordLength is the minimum number of characters we require in a
+	// new password. This value is configurable via the
+	// ACCOUNTS_MIN_PASSWORD_LENGTH environment variable.
+	MinPasswordLength = 8
+	// RejectCommonPasswords defines whether we reject new passwords which are
+	// among the most commonly used ones. This value is configurable via the
+	// ACCOUNTS_REJECT_COMMON_PASSWORDS environment variable.
+	RejectCommonPasswords = true
+
+	// ErrPasswordTooShort is returned when a new password is shorter than
+	// MinPasswordLength.
+	ErrPasswordTooShort = errors.New("password is too short")
+	// ErrPasswordMatchesEmail is returned when a new password is the same as
+	// the local part of the user's email address.
+	ErrPasswordMatchesEmail = errors.New("password must not be the same as the email address")
+	// ErrPasswordTooCommon is returned when a new password is among the most
+	// commonly used ones.
+	ErrPasswordTooCommon = errors.New("password is too common")
+
+	// commonPasswords holds some of the most commonly used passwords. They
+	// are the first ones an attacker would try. We compare them without
+	// regard to case.
+	commonPasswords = map[string]struct{}{
+		"000000":      {},
+		"111111":      {},
+		"123123":      {},
+		"1234":        {},
+		"12345":       {},
+		"123456":      {},
+		"1234567":     {},
+		"12345678":    {},
+		"123456789":   {},
+		"1234567890":  {},
+		"123qwe":      {},
+		"1q2w3e4r":    {},
+		"1qaz2wsx":    {},
+		"654321":      {},
+		"666666":      {},
+		"7777777":     {},
+		"87654321":    {},
+		"88888888":    {},
+		"987654321":   {},
+		"aa123456":    {},
+		"abc123":      {},
+		"abcd1234":    {},
+		"admin":       {},
+		"admin123":    {},
+		"baseball":    {},
+		"dragon":      {},
+		"football":    {},
+		"iloveyou":    {},
+		"letmein":     {},
+		"monkey":      {},
+		"password":    {},
+		"password1":   {},
+		"password123": {},
+		"passw0rd":    {},
+		"princess":    {},
+		"qazwsx":      {},
+		"qwerty":      {},
+		"qwerty123":   {},
+		"qwertyuiop":  {},
+		"qwer1234":    {},
+		"skynet":      {},
+		"skynet123":   {},
+		"starwars":    {},
+		"sunshine":    {},
+		"superman":    {},
+		"trustno1":    {},
+		"welcome":     {},
+		"welcome1":    {},
+		"whatever":    {},
+		"zaq12wsx":    {},
+	}
+)
+
+// ValidatePassword ensures that the given password is acceptable as a new
+// password of the user with the given email address. It only applies when a
+// password is set or changed, so existing passwords keep working for logins.
+func ValidatePassword(pw, email string) error {
+	if utf8.RuneCountInString(pw) < MinPasswordLength {
+		return errors.AddContext(ErrPasswordTooShort, fmt.Sprintf("the minimum length is %d characters", MinPasswordLength))
+	}
+	if i := strings.LastIndex(email, "@"); i > 0 && strings.EqualFold(pw, email[:i]) {
+		return ErrPasswordMatchesEmail
+	}
+	if RejectCommonPasswords {
+		if _, common := commonPasswords[strings.ToLower(pw)]; common {
+			return ErrPasswordTooCommon
+		}
+	}
+	return nil
+}
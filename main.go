@@ -4,16 +4,23 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/build"
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/SkynetLabs/skynet-accounts/janitor"
 	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/SkynetLabs/skynet-accounts/lib"
+	"github.com/SkynetLabs/skynet-accounts/lib/captcha"
 	"github.com/SkynetLabs/skynet-accounts/metafetcher"
 	"github.com/joho/godotenv"
 	"github.com/stripe/stripe-go/v72"
@@ -27,8 +34,15 @@ const (
 	// envAccountsJWKSFile holds the name of the environment variable which
 	// holds the path to the JWKS file we need to use. Optional.
 	envAccountsJWKSFile = "ACCOUNTS_JWKS_FILE"
+	// envJWTSigningKID holds the name of the environment variable which
+	// selects the key in the JWKS we sign new JWTs with. Optional.
+	envJWTSigningKID = "ACCOUNTS_JWT_SIGNING_KID"
 	// envJWTTTL holds the name of the environment variable for JWT TTL.
 	envJWTTTL = "ACCOUNTS_JWT_TTL"
+	// envJWTMaxSessionAge holds the name of the environment variable which
+	// sets for how many seconds after the login a session can be kept alive
+	// by refreshing its JWT.
+	envJWTMaxSessionAge = "ACCOUNTS_JWT_MAX_SESSION_AGE"
 	// envDBHost holds the name of the environment variable for DB host.
 	envDBHost = "SKYNET_DB_HOST"
 	// envDBPort holds the name of the environment variable for DB port.
@@ -42,9 +56,24 @@ const (
 	envEmailFrom = "ACCOUNTS_EMAIL_FROM"
 	// envEmailURI holds the name of the environment variable for email URI.
 	envEmailURI = "ACCOUNTS_EMAIL_URI"
+	// envEmailTemplatesDir holds the name of the environment variable which
+	// points to a directory with email templates that override the
+	// compiled-in ones.
+	envEmailTemplatesDir = "ACCOUNTS_EMAIL_TEMPLATES_DIR"
+	// envEmailBatchSize holds the name of the environment variable which sets
+	// the largest number of emails we send in a single scan of the DB.
+	envEmailBatchSize = "ACCOUNTS_EMAIL_BATCH_SIZE"
+	// envEmailMaxPerMinute holds the name of the environment variable which
+	// sets the largest number of emails each server sends per minute. Zero
+	// means no limit.
+	envEmailMaxPerMinute = "ACCOUNTS_EMAIL_MAX_PER_MINUTE"
 	// envLogLevel holds the name of the environment variable which defines the
 	// desired log level.
 	envLogLevel = "SKYNET_ACCOUNTS_LOG_LEVEL"
+	// envLogFormat holds the name of the environment variable which defines
+	// the format of the log lines. Supported values are `text` (default) and
+	// `json`.
+	envLogFormat = "SKYNET_ACCOUNTS_LOG_FORMAT"
 	// envPortal holds the name of the environment variable for the portal to
 	// use to fetch skylinks and sign JWT tokens.
 	envPortal = "PORTAL_DOMAIN"
@@ -64,23 +93,211 @@ const (
 	// reaches that limit they can always delete some API keys in order to make
 	// space for new ones.
 	envMaxNumAPIKeysPerUser = "ACCOUNTS_MAX_NUM_API_KEYS_PER_USER" // #nosec
+	// envMaxNumPubKeysPerUser hold the name of the environment variable which
+	// sets the limit for number of pubkeys a single user can attach to their
+	// account.
+	envMaxNumPubKeysPerUser = "ACCOUNTS_MAX_NUM_PUBKEYS_PER_USER"
+	// envMaxNumSkylinksPerAPIKey holds the name of the environment variable
+	// which sets the limit for the number of skylinks a single public API key
+	// can cover.
+	envMaxNumSkylinksPerAPIKey = "ACCOUNTS_MAX_NUM_SKYLINKS_PER_API_KEY"
+	// envMaxRecoveryTokens holds the name of the environment variable which
+	// sets the limit for the number of outstanding account recovery tokens a
+	// single user can have.
+	envMaxRecoveryTokens = "ACCOUNTS_MAX_RECOVERY_TOKENS" // #nosec
+	// envChangefeedSecret holds the name of the environment variable which
+	// holds the shared secret consumers of the changefeed need to present.
+	envChangefeedSecret = "ACCOUNTS_CHANGEFEED_SECRET" // #nosec
+	// envAdminAPIKey holds the name of the environment variable which holds
+	// the API key callers of the admin endpoints need to present.
+	envAdminAPIKey = "ACCOUNTS_ADMIN_APIKEY" // #nosec
+	// envLoginRateLimit holds the name of the environment variable which sets
+	// the number of login attempts allowed per IP and per email address per
+	// minute. Zero disables the limit.
+	envLoginRateLimit = "ACCOUNTS_LOGIN_RATE_LIMIT"
+	// envRegisterRateLimit holds the name of the environment variable which
+	// sets the number of registration attempts allowed per IP per minute.
+	// Zero disables the limit.
+	envRegisterRateLimit = "ACCOUNTS_REGISTER_RATE_LIMIT"
+	// envRecoverRateLimit holds the name of the environment variable which
+	// sets the number of account recovery requests allowed per IP per
+	// minute. Zero disables the limit.
+	envRecoverRateLimit = "ACCOUNTS_RECOVER_RATE_LIMIT"
+	// envAvailabilityRateLimit holds the name of the environment variable
+	// which sets the number of email and pubkey availability checks allowed
+	// per IP per minute. Zero disables the limit.
+	envAvailabilityRateLimit = "ACCOUNTS_AVAILABILITY_RATE_LIMIT"
+	// envOrgInviteRateLimit holds the name of the environment variable which
+	// sets the number of organization invites allowed per IP and per user
+	// per minute. Zero disables the limit.
+	envOrgInviteRateLimit = "ACCOUNTS_ORG_INVITE_RATE_LIMIT"
+	// envAnonHourlyUploadLimit holds the name of the environment variable
+	// which sets the number of anonymous uploads we track per IP per hour.
+	// Zero disables the limit.
+	envAnonHourlyUploadLimit = "ACCOUNTS_ANON_HOURLY_UPLOAD_LIMIT"
+	// envAnonHourlyDownloadLimit holds the name of the environment variable
+	// which sets the number of anonymous downloads we track per IP per hour.
+	// Zero disables the limit.
+	envAnonHourlyDownloadLimit = "ACCOUNTS_ANON_HOURLY_DOWNLOAD_LIMIT"
+	// envAvailabilityCheckEnabled holds the name of the environment variable
+	// which controls whether we serve GET /register/availability.
+	envAvailabilityCheckEnabled = "ACCOUNTS_AVAILABILITY_CHECK_ENABLED"
+	// envUserDeleteGraceHours holds the name of the environment variable
+	// which sets the number of hours we keep deleted accounts around before
+	// purging them.
+	envUserDeleteGraceHours = "ACCOUNTS_USER_DELETE_GRACE_HOURS"
+	// envQuotaWebhookURL holds the name of the environment variable which
+	// holds the URL we notify whenever a user exceeds their quota or goes
+	// back under it.
+	envQuotaWebhookURL = "ACCOUNTS_QUOTA_WEBHOOK_URL"
+	// envQuotaWebhookSecret holds the name of the environment variable which
+	// holds the shared secret we use for signing the quota webhooks.
+	envQuotaWebhookSecret = "ACCOUNTS_QUOTA_WEBHOOK_SECRET" // #nosec
+	// envUploadRequestIDWindowHours holds the name of the environment
+	// variable which sets the number of hours during which we treat uploads
+	// with a repeated request ID as duplicates.
+	envUploadRequestIDWindowHours = "ACCOUNTS_UPLOAD_REQUEST_ID_WINDOW_HOURS"
+	// envMaxPaymentFailures holds the name of the environment variable which
+	// sets the number of consecutive failed payments after which we downgrade
+	// a user to the free tier.
+	envMaxPaymentFailures = "ACCOUNTS_MAX_PAYMENT_FAILURES"
+	// envMetafetcherSweepMinutes holds the name of the environment variable
+	// which sets how often, in minutes, we sweep the DB for skylinks whose
+	// size we still don't know.
+	envMetafetcherSweepMinutes = "ACCOUNTS_METAFETCHER_SWEEP_MINUTES"
+	// envCSVExportMaxRows holds the name of the environment variable which
+	// sets the maximum number of rows we include in a CSV export.
+	envCSVExportMaxRows = "ACCOUNTS_CSV_EXPORT_MAX_ROWS"
+	// envLoginLockoutThreshold holds the name of the environment variable
+	// which sets the number of consecutive failed logins after which we lock
+	// the user's account.
+	envLoginLockoutThreshold = "ACCOUNTS_LOGIN_LOCKOUT_THRESHOLD"
+	// envLoginLockoutMinutes holds the name of the environment variable which
+	// sets for how many minutes we lock the user's account.
+	envLoginLockoutMinutes = "ACCOUNTS_LOGIN_LOCKOUT_MINUTES"
+	// envMinPasswordLength holds the name of the environment variable which
+	// sets the minimum length of new passwords.
+	envMinPasswordLength = "ACCOUNTS_MIN_PASSWORD_LENGTH"
+	// envRejectCommonPasswords holds the name of the environment variable
+	// which defines whether we reject commonly used passwords.
+	envRejectCommonPasswords = "ACCOUNTS_REJECT_COMMON_PASSWORDS"
+	// envDefaultPageSize holds the name of the environment variable which
+	// sets the number of records paginated endpoints return by default.
+	envDefaultPageSize = "ACCOUNTS_DEFAULT_PAGE_SIZE"
+	// envShutdownTimeoutSeconds holds the name of the environment variable
+	// which sets how long, in seconds, we wait for in-flight work to finish
+	// when shutting down.
+	envShutdownTimeoutSeconds = "ACCOUNTS_SHUTDOWN_TIMEOUT_SECONDS"
+	// envAdminStatsCacheMinutes holds the name of the environment variable
+	// which sets for how many minutes we cache the portal stats served to
+	// admins.
+	envAdminStatsCacheMinutes = "ACCOUNTS_ADMIN_STATS_CACHE_MINUTES"
+	// envTrackRequireValidIP holds the name of the environment variable which
+	// defines whether we reject tracked uploads without a valid `ip`.
+	envTrackRequireValidIP = "ACCOUNTS_TRACK_REQUIRE_VALID_IP"
+	// envQuotaSweepMinutes holds the name of the environment variable which
+	// sets how often, in minutes, we recheck the quotas of the users who
+	// exceed them.
+	envQuotaSweepMinutes = "ACCOUNTS_QUOTA_SWEEP_MINUTES"
+	// envQuotaSweepDryRun holds the name of the environment variable which
+	// makes the quota sweeps only log the changes they would make.
+	envQuotaSweepDryRun = "ACCOUNTS_QUOTA_SWEEP_DRY_RUN"
+	// envStorageQuotaTolerancePercent holds the name of the environment
+	// variable which sets by how many percent of their storage quota users can
+	// exceed it before we refuse to track their uploads.
+	envStorageQuotaTolerancePercent = "ACCOUNTS_STORAGE_QUOTA_TOLERANCE_PERCENT"
+	// envRequestTimeoutSeconds holds the name of the environment variable
+	// which sets how long, in seconds, we let a request run before we give up
+	// on it.
+	envRequestTimeoutSeconds = "ACCOUNTS_REQUEST_TIMEOUT_SECONDS"
+	// envCORSAllowedOrigins holds the name of the environment variable which
+	// lists, comma-separated, the origins from which browsers can call the
+	// API.
+	envCORSAllowedOrigins = "ACCOUNTS_CORS_ALLOWED_ORIGINS"
+	// envGeoIPDB holds the name of the environment variable which holds the
+	// path to the MaxMind DB file we use for finding the country of an IP.
+	envGeoIPDB = "ACCOUNTS_GEOIP_DB"
+	// envDownloadWindowMinutes holds the name of the environment variable
+	// which sets for how many minutes we keep adding the bytes of repeated
+	// downloads of a skylink to the same download record.
+	envDownloadWindowMinutes = "ACCOUNTS_DOWNLOAD_WINDOW_MINUTES"
+	// envCaptchaProvider holds the name of the environment variable which
+	// selects the captcha provider, `hcaptcha` or `turnstile`.
+	envCaptchaProvider = "ACCOUNTS_CAPTCHA_PROVIDER"
+	// envCaptchaSecret holds the name of the environment variable which holds
+	// the secret we use for verifying captcha tokens with the provider.
+	envCaptchaSecret = "ACCOUNTS_CAPTCHA_SECRET" // #nosec
+	// envCaptchaFailOpen holds the name of the environment variable which
+	// defines whether we accept requests when we fail to reach the captcha
+	// provider.
+	envCaptchaFailOpen = "ACCOUNTS_CAPTCHA_FAIL_OPEN"
+
+	// defaultShutdownTimeoutSeconds is how long we wait for in-flight work to
+	// finish when shutting down, unless configured otherwise.
+	defaultShutdownTimeoutSeconds = 30
+	// defaultRequestTimeoutSeconds is how long we let a request run before we
+	// give up on it, unless configured otherwise.
+	defaultRequestTimeoutSeconds = 30
 )
 
 type (
 	// ServiceConfig represents all configuration values we expect to receive
 	// via environment variables or config files.
 	ServiceConfig struct {
-		DBCreds               database.DBCredentials
-		PortalName            string
-		PortalAddressAccounts string
-		Promoter              string
-		ServerLockID          string
-		StripeKey             string
-		JWKSFile              string
-		JWTTTL                int
-		EmailURI              string
-		EmailFrom             string
-		MaxAPIKeys            int
+		DBCreds                    database.DBCredentials
+		PortalName                 string
+		PortalAddressAccounts      string
+		Promoter                   string
+		ServerLockID               string
+		StripeKey                  string
+		JWKSFile                   string
+		JWTSigningKID              string
+		JWTTTL                     int
+		JWTMaxSessionAge           int
+		EmailURI                   string
+		EmailFrom                  string
+		EmailTemplatesDir          string
+		EmailBatchSize             int64
+		EmailMaxPerMinute          int
+		MaxAPIKeys                 int
+		MaxPubKeys                 int
+		MaxAPIKeySkylinks          int
+		MaxRecoveryTokens          int
+		ChangefeedSecret           string
+		AdminAPIKey                string
+		LoginRateLimit             int
+		RegisterRateLimit          int
+		RecoverRateLimit           int
+		AvailabilityRateLimit      int
+		OrgInviteRateLimit         int
+		AnonHourlyUploadLimit      int
+		AnonHourlyDownloadLimit    int
+		AvailabilityCheckEnabled   bool
+		UserDeleteGraceHours       int
+		QuotaWebhookURL            string
+		QuotaWebhookSecret         string
+		UploadRequestIDWindowHours int
+		MaxPaymentFailures         int
+		MetafetcherSweepMinutes    int
+		CSVExportMaxRows           int
+		LoginLockoutThreshold      int
+		LoginLockoutMinutes        int
+		MinPasswordLength          int
+		RejectCommonPasswords      bool
+		ShutdownTimeoutSeconds     int
+		RequestTimeoutSeconds      int
+		DefaultPageSize            int
+		AdminStatsCacheMinutes     int
+		TrackRequireValidIP        bool
+		QuotaSweepMinutes          int
+		QuotaSweepDryRun           bool
+		StorageQuotaTolerance      int64
+		CORSAllowedOrigins         []string
+		GeoIPDB                    string
+		DownloadWindowMinutes      int
+		CaptchaProvider            string
+		CaptchaSecret              string
+		CaptchaFailOpen            bool
 	}
 )
 
@@ -119,6 +336,15 @@ func logLevel() logrus.Level {
 	return logrus.InfoLevel
 }
 
+// logFormatter returns the desired log formatter. JSON logs are easier to
+// ingest and correlate with the logs of other services.
+func logFormatter() logrus.Formatter {
+	if strings.EqualFold(os.Getenv(envLogFormat), "json") {
+		return &logrus.JSONFormatter{}
+	}
+	return &logrus.TextFormatter{}
+}
+
 // parseConfiguration is responsible for reading and validating all environment
 // variables we support - both required and optional ones. It also defers to the
 // default values when certain config values are not provided. If in the future
@@ -170,6 +396,7 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 	} else {
 		config.JWKSFile = jwt.AccountsJWKSFile
 	}
+	config.JWTSigningKID = os.Getenv(envJWTSigningKID)
 	// Parse the optional env var that controls the TTL of the JWTs we generate.
 	if jwtTTLStr := os.Getenv(envJWTTTL); jwtTTLStr != "" {
 		jwtTTL, err := strconv.Atoi(jwtTTLStr)
@@ -184,6 +411,7 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 		// The environment doesn't specify a value, use the default.
 		config.JWTTTL = jwt.TTL
 	}
+	config.JWTMaxSessionAge = parseIntEnv(envJWTMaxSessionAge, jwt.MaxSessionAge, 1)
 
 	// Fetch configuration data for sending emails.
 	config.EmailURI = os.Getenv(envEmailURI)
@@ -197,8 +425,9 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 			return ServiceConfig{}, email.ErrInvalidEmailConfiguration
 		}
 		// Set the FROM address to outgoing emails. This can be overridden by
-		// the ACCOUNTS_EMAIL_FROM optional environment variable.
-		if uri.User != nil {
+		// the ACCOUNTS_EMAIL_FROM optional environment variable. The user of
+		// an HTTP API URI is the API key, so we never use it as an address.
+		if uri.User != nil && uri.Scheme != "https" {
 			config.EmailFrom = uri.User.Username()
 		}
 		if emailFrom := os.Getenv(envEmailFrom); emailFrom != "" {
@@ -208,34 +437,144 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 		if config.EmailFrom == "" {
 			config.EmailFrom = email.From
 		}
+		// The templates dir is optional, we fall back to the compiled-in
+		// templates for every template it doesn't override.
+		config.EmailTemplatesDir = os.Getenv(envEmailTemplatesDir)
 	}
+	// Fetch the batch size and rate limit of the email sender.
+	config.EmailBatchSize = int64(parseIntEnv(envEmailBatchSize, int(email.BatchSize), 1))
+	config.EmailMaxPerMinute = parseIntEnv(envEmailMaxPerMinute, email.MaxPerMinute, 0)
 	// Fetch the configuration for maximum number of API keys allowed per user.
-	if maxAPIKeysStr, exists := os.LookupEnv(envMaxNumAPIKeysPerUser); exists {
-		maxAPIKeys, err := strconv.Atoi(maxAPIKeysStr)
-		if err != nil {
-			log.Printf("Warning: Failed to parse %s env var. Error: %s", envMaxNumAPIKeysPerUser, err.Error())
-		}
-		if maxAPIKeys > 0 {
-			config.MaxAPIKeys = maxAPIKeys
-		} else {
-			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envMaxNumAPIKeysPerUser, database.MaxNumAPIKeysPerUser)
-			config.MaxAPIKeys = database.MaxNumAPIKeysPerUser
+	config.MaxAPIKeys = parseIntEnv(envMaxNumAPIKeysPerUser, database.MaxNumAPIKeysPerUser, 1)
+	// Fetch the configuration for maximum number of pubkeys allowed per user.
+	config.MaxPubKeys = parseIntEnv(envMaxNumPubKeysPerUser, database.MaxNumPubKeysPerUser, 1)
+	// Fetch the maximum number of skylinks a public API key can cover.
+	config.MaxAPIKeySkylinks = parseIntEnv(envMaxNumSkylinksPerAPIKey, database.MaxNumSkylinksPerAPIKey, 1)
+	// Fetch the maximum number of outstanding recovery tokens per user.
+	config.MaxRecoveryTokens = parseIntEnv(envMaxRecoveryTokens, database.MaxRecoveryTokensPerUser, 1)
+	// The changefeed is disabled unless a secret is set.
+	config.ChangefeedSecret = os.Getenv(envChangefeedSecret)
+	// The admin endpoints are disabled unless an admin API key is set.
+	config.AdminAPIKey = os.Getenv(envAdminAPIKey)
+	// Fetch the rate limits of the authentication endpoints.
+	config.LoginRateLimit = parseRateLimit(envLoginRateLimit, api.LoginRateLimit)
+	config.RegisterRateLimit = parseRateLimit(envRegisterRateLimit, api.RegisterRateLimit)
+	config.RecoverRateLimit = parseRateLimit(envRecoverRateLimit, api.RecoverRateLimit)
+	config.AvailabilityRateLimit = parseRateLimit(envAvailabilityRateLimit, api.AvailabilityRateLimit)
+	config.OrgInviteRateLimit = parseRateLimit(envOrgInviteRateLimit, api.OrgInviteRateLimit)
+	// Fetch the hourly limits of the anonymous track calls.
+	config.AnonHourlyUploadLimit = parseRateLimit(envAnonHourlyUploadLimit, api.AnonymousHourlyUploadLimit)
+	config.AnonHourlyDownloadLimit = parseRateLimit(envAnonHourlyDownloadLimit, api.AnonymousHourlyDownloadLimit)
+	// Fetch whether callers can check the availability of emails and pubkeys.
+	config.AvailabilityCheckEnabled = parseBoolEnv(envAvailabilityCheckEnabled, api.AvailabilityCheckEnabled)
+	// The quota webhook is disabled unless a URL is set.
+	config.QuotaWebhookURL = os.Getenv(envQuotaWebhookURL)
+	config.QuotaWebhookSecret = os.Getenv(envQuotaWebhookSecret)
+	if config.QuotaWebhookURL != "" && config.QuotaWebhookSecret == "" {
+		log.Printf("Warning: %s is set but %s is not. The quota webhooks will not be signed securely.", envQuotaWebhookURL, envQuotaWebhookSecret)
+	}
+	// Fetch the grace period of deleted accounts.
+	config.UserDeleteGraceHours = parseIntEnv(envUserDeleteGraceHours, int(database.UserDeleteGracePeriod/time.Hour), 0)
+	// Fetch the window during which we deduplicate uploads by request ID.
+	config.UploadRequestIDWindowHours = parseIntEnv(envUploadRequestIDWindowHours, int(database.UploadRequestIDWindow/time.Hour), 0)
+	// Fetch the number of failed payments after which we downgrade users.
+	config.MaxPaymentFailures = parseIntEnv(envMaxPaymentFailures, api.MaxPaymentFailures, 0)
+	// Fetch the interval of the metafetcher's sweeps.
+	config.MetafetcherSweepMinutes = parseIntEnv(envMetafetcherSweepMinutes, int(metafetcher.SweepInterval/time.Minute), 0)
+	// Fetch the maximum number of rows in a CSV export.
+	config.CSVExportMaxRows = parseIntEnv(envCSVExportMaxRows, api.CSVExportMaxRows, 1)
+	// Fetch the number of failed logins after which we lock accounts.
+	config.LoginLockoutThreshold = parseIntEnv(envLoginLockoutThreshold, api.LoginLockoutThreshold, 0)
+	// Fetch the duration of account lockouts.
+	config.LoginLockoutMinutes = parseIntEnv(envLoginLockoutMinutes, int(api.LoginLockoutDuration/time.Minute), 1)
+	// Fetch the minimum length of new passwords.
+	config.MinPasswordLength = parseIntEnv(envMinPasswordLength, lib.MinPasswordLength, 1)
+	// Fetch whether we reject commonly used passwords.
+	config.RejectCommonPasswords = parseBoolEnv(envRejectCommonPasswords, lib.RejectCommonPasswords)
+	// Fetch the default page size of paginated endpoints.
+	config.DefaultPageSize = parseIntEnv(envDefaultPageSize, api.DefaultPageSizeSmall, 1)
+	if config.DefaultPageSize > api.MaxPageSize {
+		log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envDefaultPageSize, api.DefaultPageSizeSmall)
+		config.DefaultPageSize = api.DefaultPageSizeSmall
+	}
+	// Fetch how long we cache the portal stats.
+	config.AdminStatsCacheMinutes = parseIntEnv(envAdminStatsCacheMinutes, int(api.AdminStatsCacheTTL/time.Minute), 1)
+	// Fetch whether tracked uploads need to come with a valid IP.
+	config.TrackRequireValidIP = parseBoolEnv(envTrackRequireValidIP, api.TrackRequireValidIP)
+	// Fetch the interval of the quota sweeps.
+	config.QuotaSweepMinutes = parseIntEnv(envQuotaSweepMinutes, int(api.QuotaSweepInterval/time.Minute), 0)
+	config.QuotaSweepDryRun = parseBoolEnv(envQuotaSweepDryRun, api.QuotaSweepDryRun)
+	// Fetch the tolerance of the storage quota reservations.
+	config.StorageQuotaTolerance = int64(parseIntEnv(envStorageQuotaTolerancePercent, int(api.StorageQuotaTolerancePercent), 0))
+	// Fetch how long we wait for in-flight work when shutting down.
+	config.ShutdownTimeoutSeconds = parseIntEnv(envShutdownTimeoutSeconds, defaultShutdownTimeoutSeconds, 1)
+	// Fetch how long we let a request run.
+	config.RequestTimeoutSeconds = parseIntEnv(envRequestTimeoutSeconds, defaultRequestTimeoutSeconds, 1)
+	// Fetch the origins from which browsers can call the API.
+	for _, origin := range strings.Split(os.Getenv(envCORSAllowedOrigins), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			config.CORSAllowedOrigins = append(config.CORSAllowedOrigins, origin)
 		}
-	} else {
-		// The environment doesn't specify a value, use the default.
-		config.MaxAPIKeys = database.MaxNumAPIKeysPerUser
 	}
+	// Uploads are not tagged with their country unless a DB file is set.
+	config.GeoIPDB = os.Getenv(envGeoIPDB)
+	// Fetch the window during which we coalesce repeated downloads.
+	config.DownloadWindowMinutes = parseIntEnv(envDownloadWindowMinutes, int(database.DownloadUpdateWindow/time.Minute), 0)
+	// Captcha verification is disabled unless both a provider and a secret
+	// are set.
+	config.CaptchaProvider = os.Getenv(envCaptchaProvider)
+	config.CaptchaSecret = os.Getenv(envCaptchaSecret)
+	config.CaptchaFailOpen = parseBoolEnv(envCaptchaFailOpen, api.CaptchaFailOpen)
 
 	return config, nil
 }
 
+// parseRateLimit reads a rate limit from the given environment variable. It
+// falls back to the given default when the variable is not set or invalid.
+func parseRateLimit(envVar string, def int) int {
+	return parseIntEnv(envVar, def, 0)
+}
+
+// parseIntEnv reads an integer from the given environment variable. It falls
+// back to the given default when the variable is not set, is not an integer or
+// is less than min.
+func parseIntEnv(envVar string, def, min int) int {
+	valStr, exists := os.LookupEnv(envVar)
+	if !exists {
+		return def
+	}
+	val, err := strconv.Atoi(valStr)
+	if err != nil || val < min {
+		log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envVar, def)
+		return def
+	}
+	return val
+}
+
+// parseBoolEnv reads a boolean from the given environment variable. It falls
+// back to the given default when the variable is not set or invalid.
+func parseBoolEnv(envVar string, def bool) bool {
+	valStr, exists := os.LookupEnv(envVar)
+	if !exists {
+		return def
+	}
+	val, err := strconv.ParseBool(valStr)
+	if err != nil {
+		log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %t is used.", envVar, def)
+		return def
+	}
+	return val
+}
+
 func main() {
 	// Initialise the global context and logger. These will be used throughout
 	// the service. Once the context is closed, all background threads will
 	// wind themselves down.
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	logger := logrus.New()
 	logger.SetLevel(logLevel())
+	logger.SetFormatter(logFormatter())
 
 	// Load the environment variables from the .env file.
 	_ = godotenv.Load()
@@ -250,9 +589,47 @@ func main() {
 	email.ServerLockID = config.ServerLockID
 	stripe.Key = config.StripeKey
 	jwt.AccountsJWKSFile = config.JWKSFile
+	jwt.SigningKeyID = config.JWTSigningKID
 	jwt.TTL = config.JWTTTL
+	jwt.MaxSessionAge = config.JWTMaxSessionAge
 	email.From = config.EmailFrom
+	email.BatchSize = config.EmailBatchSize
+	email.MaxPerMinute = config.EmailMaxPerMinute
 	database.MaxNumAPIKeysPerUser = config.MaxAPIKeys
+	database.MaxNumPubKeysPerUser = config.MaxPubKeys
+	database.MaxNumSkylinksPerAPIKey = config.MaxAPIKeySkylinks
+	database.MaxRecoveryTokensPerUser = config.MaxRecoveryTokens
+	api.ChangefeedSecret = config.ChangefeedSecret
+	api.AdminAPIKey = config.AdminAPIKey
+	api.LoginRateLimit = config.LoginRateLimit
+	api.RegisterRateLimit = config.RegisterRateLimit
+	api.RecoverRateLimit = config.RecoverRateLimit
+	api.AvailabilityRateLimit = config.AvailabilityRateLimit
+	api.OrgInviteRateLimit = config.OrgInviteRateLimit
+	api.AnonymousHourlyUploadLimit = config.AnonHourlyUploadLimit
+	api.AnonymousHourlyDownloadLimit = config.AnonHourlyDownloadLimit
+	api.AvailabilityCheckEnabled = config.AvailabilityCheckEnabled
+	database.UserDeleteGracePeriod = time.Duration(config.UserDeleteGraceHours) * time.Hour
+	api.QuotaWebhookURL = config.QuotaWebhookURL
+	api.QuotaWebhookSecret = config.QuotaWebhookSecret
+	database.UploadRequestIDWindow = time.Duration(config.UploadRequestIDWindowHours) * time.Hour
+	database.DownloadUpdateWindow = time.Duration(config.DownloadWindowMinutes) * time.Minute
+	api.CaptchaFailOpen = config.CaptchaFailOpen
+	api.MaxPaymentFailures = config.MaxPaymentFailures
+	metafetcher.SweepInterval = time.Duration(config.MetafetcherSweepMinutes) * time.Minute
+	api.CSVExportMaxRows = config.CSVExportMaxRows
+	api.LoginLockoutThreshold = config.LoginLockoutThreshold
+	api.LoginLockoutDuration = time.Duration(config.LoginLockoutMinutes) * time.Minute
+	lib.MinPasswordLength = config.MinPasswordLength
+	lib.RejectCommonPasswords = config.RejectCommonPasswords
+	api.DefaultPageSizeSmall = config.DefaultPageSize
+	api.AdminStatsCacheTTL = time.Duration(config.AdminStatsCacheMinutes) * time.Minute
+	api.TrackRequireValidIP = config.TrackRequireValidIP
+	api.QuotaSweepInterval = time.Duration(config.QuotaSweepMinutes) * time.Minute
+	api.QuotaSweepDryRun = config.QuotaSweepDryRun
+	api.StorageQuotaTolerancePercent = config.StorageQuotaTolerance
+	api.RequestTimeout = time.Duration(config.RequestTimeoutSeconds) * time.Second
+	api.CORSAllowedOrigins = config.CORSAllowedOrigins
 
 	// Set up key components:
 
@@ -261,26 +638,132 @@ func main() {
 	if err != nil {
 		log.Fatal(errors.AddContext(err, fmt.Sprintf("failed to load JWKS file from %s", jwt.AccountsJWKSFile)))
 	}
+	// Reload the JWKS on SIGHUP, so we can add and retire keys without a
+	// restart.
+	go threadedReloadKeySet(ctx, logger)
+	// Load the geolocation DB we use for tagging uploads with their country.
+	// Geolocation is optional, so we don't refuse to start without it.
+	if config.GeoIPDB != "" {
+		gr, err := lib.NewMMDBGeoResolver(config.GeoIPDB)
+		if err != nil {
+			logger.Warnln(errors.AddContext(err, fmt.Sprintf("failed to load geolocation DB from %s, geolocation is disabled", config.GeoIPDB)))
+		} else {
+			api.GeoResolver = gr
+		}
+	}
+	// Set up the captcha verification of registrations and recoveries.
+	if config.CaptchaProvider != "" && config.CaptchaSecret != "" {
+		cv, err := captcha.New(config.CaptchaProvider, config.CaptchaSecret)
+		if err != nil {
+			log.Fatal(errors.AddContext(err, "failed to set up captcha verification"))
+		}
+		api.CaptchaVerifier = cv
+	} else if config.CaptchaProvider != "" || config.CaptchaSecret != "" {
+		log.Printf("Warning: Captcha verification is disabled because only one of %s and %s is set.", envCaptchaProvider, envCaptchaSecret)
+	}
 	// Connect to the database.
 	db, err := database.New(ctx, config.DBCreds, logger)
 	if err != nil {
 		log.Fatal(errors.AddContext(err, "failed to connect to the DB"))
 	}
-	mailer := email.NewMailer(db)
+	// Load the tier limits overrides and keep them up to date.
+	err = db.StartTierLimitsRefresher(ctx)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to load the tier limits"))
+	}
+	// Prune expired challenges and unconfirmed user updates.
+	db.StartMaintenance(ctx)
+	mailer, err := email.NewCustomMailer(db, config.EmailTemplatesDir)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to load the email templates"))
+	}
 	// Start the mail sender background thread.
 	sender, err := email.NewSender(ctx, db, logger, &skymodules.SkynetDependencies{}, config.EmailURI)
 	if err != nil {
 		log.Fatal(errors.AddContext(err, "failed to create an email sender"))
 	}
 	sender.Start()
+	// Start the janitor which purges deleted accounts after their grace period.
+	janitor.NewJanitor(ctx, db, logger).Start()
 	// The meta fetcher will fetch metadata for all skylinks. This is needed, so
 	// we can determine their size.
 	mf := metafetcher.New(ctx, db, logger)
+	mf.StartSweeper()
 	// Start the HTTP server.
-	server, err := api.New(db, mf, logger, mailer, config.Promoter)
+	server, err := api.New(db, mf, logger, mailer, &sender, config.Promoter)
 	if err != nil {
 		log.Fatal(errors.AddContext(err, "failed to build the API"))
 	}
+	// Keep the anonymous usage counters across restarts.
+	err = server.StartAnonUsagePersister(ctx)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to load the anonymous usage"))
+	}
+	// Recheck the quotas of the users who exceed them, in case their usage
+	// dropped without them uploading or unpinning anything.
+	server.StartQuotaSweeper(ctx, config.ServerLockID)
 	log.Printf("Starting Accounts.\nGitRevision: %v (built %v)\n", build.GitRevision, build.BuildTime)
-	logger.Fatal(server.ListenAndServe(3000))
+	go func() {
+		err := server.ListenAndServe(3000)
+		if !errors.Contains(err, http.ErrServerClosed) {
+			logger.Fatal(err)
+		}
+	}()
+
+	// Wait for a signal to shut down.
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-sigCtx.Done()
+	logger.Info("Shutting down.")
+	timeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+	defer shutdownCancel()
+	shutdown(shutdownCtx, cancel, server, mf, sender, db, logger)
+}
+
+// threadedReloadKeySet reloads the JWKS each time we receive a SIGHUP, until
+// the given context is closed. We keep using the current JWKS if the new one
+// is invalid.
+func threadedReloadKeySet(ctx context.Context, logger *logrus.Logger) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+		}
+		err := jwt.ReloadAccountsKeySet()
+		if err != nil {
+			logger.Warnln("Failed to reload the JWKS, keeping the current one:", err)
+			continue
+		}
+		logger.Infof("Reloaded the JWKS from %s.", jwt.AccountsJWKSFile)
+	}
+}
+
+// shutdown gracefully winds down the service. It stops accepting requests and
+// waits for the in-flight ones, for the metafetcher's queue, and for the
+// email batch being sent. Only then it cancels the global context, because
+// the background workers stop processing as soon as it's closed. Whatever is
+// not done by the time ctx expires is abandoned.
+func shutdown(ctx context.Context, cancel context.CancelFunc, server *api.API, mf *metafetcher.MetaFetcher, sender email.Sender, db *database.DB, logger *logrus.Logger) {
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Warnln(errors.AddContext(err, "failed to shut down the HTTP server gracefully"))
+	}
+	err = mf.Drain(ctx)
+	if err != nil {
+		logger.Warnln(errors.AddContext(err, "failed to drain the metafetcher"))
+	}
+	err = sender.Stop(ctx)
+	if err != nil {
+		logger.Warnln(errors.AddContext(err, "failed to stop the email sender"))
+	}
+	cancel()
+	err = db.Disconnect(ctx)
+	if err != nil {
+		logger.Warnln(errors.AddContext(err, "failed to disconnect from the DB"))
+	}
 }
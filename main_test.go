@@ -31,6 +31,7 @@ func TestParseConfiguration(t *testing.T) {
 			envEmailURI,
 			envEmailFrom,
 			envMaxNumAPIKeysPerUser,
+			envMaxNumPubKeysPerUser,
 		}
 		values := make(map[string]string)
 		for _, k := range keys {
@@ -202,6 +203,9 @@ func TestParseConfiguration(t *testing.T) {
 	if config.MaxAPIKeys != database.MaxNumAPIKeysPerUser {
 		t.Fatalf("Expected %d, got %d", database.MaxNumAPIKeysPerUser, config.MaxAPIKeys)
 	}
+	if config.MaxPubKeys != database.MaxNumPubKeysPerUser {
+		t.Fatalf("Expected %d, got %d", database.MaxNumPubKeysPerUser, config.MaxPubKeys)
+	}
 
 	// Set alternative config values and test their outcomes.
 
@@ -216,6 +220,11 @@ func TestParseConfiguration(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	maxPubKeys := 7
+	err = os.Setenv(envMaxNumPubKeysPerUser, strconv.Itoa(maxPubKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	config, err = parseConfiguration(logger)
 	if err != nil {
@@ -227,6 +236,9 @@ func TestParseConfiguration(t *testing.T) {
 	if config.MaxAPIKeys != maxKeys {
 		t.Fatalf("Expected %d, got %d", maxKeys, config.MaxAPIKeys)
 	}
+	if config.MaxPubKeys != maxPubKeys {
+		t.Fatalf("Expected %d, got %d", maxPubKeys, config.MaxPubKeys)
+	}
 }
 
 // TestLoadDBCredentials ensures that we validate that all required environment
@@ -328,3 +340,43 @@ func TestLoadDBCredentials(t *testing.T) {
 		)
 	}
 }
+
+// TestParseRateLimit ensures that we properly parse rate limits and fall back
+// to the default on invalid values.
+func TestParseRateLimit(t *testing.T) {
+	envVar := "ACCOUNTS_TEST_RATE_LIMIT"
+	defer func() {
+		if err := os.Unsetenv(envVar); err != nil {
+			t.Error(err)
+		}
+	}()
+	tests := []struct {
+		value    *string
+		expected int
+	}{
+		{nil, 10},
+		{strPtr("5"), 5},
+		{strPtr("0"), 0},
+		{strPtr("-1"), 10},
+		{strPtr("many"), 10},
+	}
+	for _, tt := range tests {
+		var err error
+		if tt.value == nil {
+			err = os.Unsetenv(envVar)
+		} else {
+			err = os.Setenv(envVar, *tt.value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit := parseRateLimit(envVar, 10); limit != tt.expected {
+			t.Fatalf("Expected %d, got %d", tt.expected, limit)
+		}
+	}
+}
+
+// strPtr returns a pointer to the given string.
+func strPtr(s string) *string {
+	return &s
+}
@@ -6,42 +6,124 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// maxAttempts defines the maximum number of attempts we are going to make to
-// process a message.
-const maxAttempts = 3
+const (
+	// sweepBatchSize is the maximum number of skylinks a single sweep queues.
+	sweepBatchSize = 100
+	// backoffBase is how long we wait before retrying a skylink whose
+	// metadata we failed to fetch for the first time. Each consecutive
+	// failure doubles the wait, up to backoffMax.
+	backoffBase = time.Minute
+	// backoffMax is the longest we wait before retrying a skylink.
+	backoffMax = 24 * time.Hour
+	// drainPollInterval is how often Drain checks whether the queue is empty.
+	drainPollInterval = 50 * time.Millisecond
+)
 
-// Message is the format we use to tell the MetaFetcher to download
-// the metadata for a given skylink and then add its size to the used space of
-// a given user.
-type Message struct {
-	SkylinkID primitive.ObjectID
-	Attempts  uint8
-}
+var (
+	// SweepInterval defines how often we sweep the DB for skylinks whose size
+	// we still don't know. Sweeping is disabled when it's zero. This value is
+	// configurable via the ACCOUNTS_METAFETCHER_SWEEP_MINUTES environment
+	// variable.
+	SweepInterval = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  time.Second,
+			Standard: 10 * time.Minute,
+		},
+	).(time.Duration)
+	// SweepMinAge defines how old a skylink needs to be before a sweep picks
+	// it up. This gives the initial fetch triggered by the tracking
+	// endpoints a chance to finish first.
+	SweepMinAge = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  time.Second,
+			Standard: 10 * time.Minute,
+		},
+	).(time.Duration)
+)
 
-// MetaFetcher is a background task that listens for messages on its queue and
-// then processes them.
-type MetaFetcher struct {
-	Queue  chan Message
-	db     *database.DB
-	logger *logrus.Logger
-}
+type (
+	// Message is the format we use to tell the MetaFetcher to download
+	// the metadata for a given skylink and then add its size to the used space of
+	// a given user.
+	Message struct {
+		SkylinkID primitive.ObjectID
+	}
+
+	// Metadata is the part of a skyfile's metadata we care about.
+	Metadata struct {
+		Filename string `json:"filename"`
+		Length   int64  `json:"length"`
+	}
+
+	// Fetcher fetches the metadata of skylinks.
+	Fetcher interface {
+		FetchMetadata(ctx context.Context, skylink string) (Metadata, error)
+	}
+
+	// SizeResolvedFunc is called after the MetaFetcher learns the size of a
+	// skylink whose size was unknown until then.
+	SizeResolvedFunc func(ctx context.Context, skylinkID primitive.ObjectID, size int64)
+
+	// MetaFetcher is a background task that listens for messages on its queue
+	// and then processes them. It also periodically sweeps the DB for skylinks
+	// whose size we still don't know, so a temporary outage doesn't leave them
+	// at zero forever.
+	MetaFetcher struct {
+		Queue   chan Message
+		ctx     context.Context
+		db      *database.DB
+		fetcher Fetcher
+		logger  *logrus.Logger
+
+		// pending holds the IDs of the skylinks which are queued or being
+		// processed. We use it to avoid processing the same skylink more
+		// than once at a time.
+		pending map[primitive.ObjectID]struct{}
+		// running is true while the queue watcher is processing the queue.
+		running bool
+		// sizeResolved is called after we learn a skylink's size.
+		sizeResolved SizeResolvedFunc
+		mu           sync.Mutex
+	}
+
+	// skydFetcher fetches the metadata of skylinks from the local skyd.
+	skydFetcher struct{}
+)
 
 // New returns a new MetaFetcher instance and starts its internal queue watcher.
 func New(ctx context.Context, db *database.DB, logger *logrus.Logger) *MetaFetcher {
+	return NewCustom(ctx, db, logger, skydFetcher{})
+}
+
+// NewCustom returns a new MetaFetcher instance which uses the given Fetcher
+// and starts its internal queue watcher.
+func NewCustom(ctx context.Context, db *database.DB, logger *logrus.Logger, fetcher Fetcher) *MetaFetcher {
 	if logger == nil {
 		logger = logrus.New()
 	}
 	mf := MetaFetcher{
-		Queue:  make(chan Message, 1000),
-		db:     db,
-		logger: logger,
+		Queue:   make(chan Message, 1000),
+		ctx:     ctx,
+		db:      db,
+		fetcher: fetcher,
+		logger:  logger,
+		pending: make(map[primitive.ObjectID]struct{}),
+		// The queue watcher is considered running from the moment we start
+		// it, so health checks don't report it as dead in the meantime.
+		running: true,
 	}
 
 	go mf.threadedStartQueueWatcher(ctx)
@@ -49,9 +131,73 @@ func New(ctx context.Context, db *database.DB, logger *logrus.Logger) *MetaFetch
 	return &mf
 }
 
+// Enqueue queues the given message, unless we're already processing its
+// skylink. It doesn't block. It returns true if it queued the message.
+func (mf *MetaFetcher) Enqueue(m Message) bool {
+	mf.mu.Lock()
+	if _, exists := mf.pending[m.SkylinkID]; exists {
+		mf.mu.Unlock()
+		return false
+	}
+	mf.pending[m.SkylinkID] = struct{}{}
+	mf.mu.Unlock()
+	go func() { mf.Queue <- m }()
+	return true
+}
+
+// SetSizeResolvedFunc sets the function we call after we learn the size of a
+// skylink, so the users who uploaded it can have their quotas rechecked.
+func (mf *MetaFetcher) SetSizeResolvedFunc(f SizeResolvedFunc) {
+	mf.mu.Lock()
+	mf.sizeResolved = f
+	mf.mu.Unlock()
+}
+
+// StartSweeper periodically sweeps the DB for skylinks whose size we still
+// don't know and queues them for processing.
+func (mf *MetaFetcher) StartSweeper() {
+	if SweepInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-mf.ctx.Done():
+				return
+			case <-time.After(SweepInterval):
+				n, err := mf.Sweep()
+				if err != nil {
+					mf.logger.Warningln(errors.AddContext(err, "failed to sweep skylinks with unknown size"))
+				}
+				if n > 0 {
+					mf.logger.Debugf("Queued %d skylinks with unknown size.", n)
+				}
+			}
+		}
+	}()
+}
+
+// Sweep queues a batch of skylinks whose size we still don't know and which
+// are due for another attempt. It returns the number of queued skylinks.
+func (mf *MetaFetcher) Sweep() (int, error) {
+	createdBefore := time.Now().UTC().Add(-SweepMinAge)
+	sls, err := mf.db.SkylinksMissingSize(mf.ctx, createdBefore, sweepBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, sl := range sls {
+		if mf.Enqueue(Message{SkylinkID: sl.ID}) {
+			n++
+		}
+	}
+	return n, nil
+}
+
 // threadedStartQueueWatcher starts a loop over the Queue that processes each
 // incoming message in a separate goroutine.
 func (mf *MetaFetcher) threadedStartQueueWatcher(ctx context.Context) {
+	defer mf.setRunning(false)
 	for m := range mf.Queue {
 		select {
 		case <-ctx.Done():
@@ -65,20 +211,62 @@ func (mf *MetaFetcher) threadedStartQueueWatcher(ctx context.Context) {
 	}
 }
 
+// Drain blocks until all queued messages have been processed or until the
+// given context expires. The MetaFetcher's own context needs to stay open
+// until then, otherwise it stops processing the queue.
+func (mf *MetaFetcher) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		mf.mu.Lock()
+		pending := len(mf.pending)
+		mf.mu.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.AddContext(ctx.Err(), fmt.Sprintf("failed to drain the queue, %d skylinks remain", pending))
+		case <-ticker.C:
+		}
+	}
+}
+
+// QueueLen returns the number of messages waiting in the queue.
+func (mf *MetaFetcher) QueueLen() int {
+	return len(mf.Queue)
+}
+
+// Running returns true while the queue watcher is processing the queue.
+func (mf *MetaFetcher) Running() bool {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	return mf.running
+}
+
+// setRunning updates the running status of the queue watcher.
+func (mf *MetaFetcher) setRunning(running bool) {
+	mf.mu.Lock()
+	mf.running = running
+	mf.mu.Unlock()
+}
+
+// managedDone marks the given skylink as no longer being processed.
+func (mf *MetaFetcher) managedDone(id primitive.ObjectID) {
+	mf.mu.Lock()
+	delete(mf.pending, id)
+	mf.mu.Unlock()
+}
+
 // processMessage tries to download the metadata for the given skylink and
-// update the skylink's record in the database. If it fails to download it will
-// put the message back in the queue and retry it later a maximum of maxAttempts
-// times.
+// update the skylink's record in the database. If it fails to download it
+// records the failure on the skylink, so a later sweep can retry it once its
+// backoff expires.
 func (mf *MetaFetcher) processMessage(ctx context.Context, m Message) {
+	defer mf.managedDone(m.SkylinkID)
 	sl, err := mf.db.SkylinkByID(ctx, m.SkylinkID)
 	if err != nil {
-		logrus.Tracef("Failed to fetch skylink from DB. Skylink ID: %v, error: %v", m.SkylinkID, err)
-		if m.Attempts >= maxAttempts {
-			mf.logger.Debugf("Message exceeded its maximum number of attempts, dropping: %v. Last error: %v.", m, err)
-			return
-		}
-		m.Attempts++
-		go func() { mf.Queue <- m }()
+		mf.logger.Tracef("Failed to fetch skylink from DB. Skylink ID: %v, error: %v", m.SkylinkID, err)
 		return
 	}
 	// Check if we have already fetched the size of this skylink and skip the
@@ -86,52 +274,25 @@ func (mf *MetaFetcher) processMessage(ctx context.Context, m Message) {
 	if sl.Size != 0 {
 		return
 	}
-	// Make a HEAD request directly to the local `sia` container. We do that, so
-	// we don't get rate-limited by nginx in case we need to make many requests.
-	metaURL, err := url.Parse(fmt.Sprintf("http://sia:9980/skynet/metadata/%s", sl.Skylink))
+	meta, err := mf.fetcher.FetchMetadata(ctx, sl.Skylink)
 	if err != nil {
-		mf.logger.Debugf("Error while forming skylink URL for skylink %s. Error: %v", sl.Skylink, err)
-		return
-	}
-	req := http.Request{
-		Method: http.MethodGet,
-		URL:    metaURL,
-		Header: http.Header{"User-Agent": []string{"Sia-Agent"}},
-	}
-	client := http.Client{}
-	res, err := client.Do(&req)
-	if err == nil {
-		defer res.Body.Close()
-	}
-	if err != nil || res.StatusCode > 399 {
-		var statusCode int
-		if res != nil {
-			statusCode = res.StatusCode
-		}
-		mf.logger.Tracef("Failed to fetch metadata. Skylink: %s, status: %v, error: %v", sl.Skylink, statusCode, err)
-		if m.Attempts >= maxAttempts {
-			mf.logger.Debugf("Message exceeded its maximum number of attempts, dropping: %v. Last error: %v.", m, err)
-			return
-		}
-		m.Attempts++
-		go func() { mf.Queue <- m }()
-		return
-	}
-	var meta struct {
-		Filename string `json:"filename"`
-		Length   int64  `json:"length"`
-	}
-	err = json.NewDecoder(res.Body).Decode(&meta)
-	if err != nil {
-		mf.logger.Debugf("Failed to parse skyfile metadata: %s", err)
+		mf.logger.Tracef("Failed to fetch metadata. Skylink: %s, error: %v", sl.Skylink, err)
+		mf.managedFetchFailed(ctx, sl)
 		return
 	}
 	mf.logger.Tracef("Successfully fetched metdata for skylink %v %s: %v", sl.ID, sl.Skylink, meta)
+	if meta.Length == 0 {
+		// We can't tell an empty skyfile from one whose size we don't know,
+		// so we back off in order to avoid fetching it on every sweep.
+		mf.managedFetchFailed(ctx, sl)
+	}
 	err = mf.db.SkylinkUpdate(ctx, m.SkylinkID, meta.Filename, meta.Length)
 	if err != nil {
 		mf.logger.Debugf("Failed to update skyfile metadata: %s", err)
 		// We don't return here because we want to perform the next operations
 		// regardless of the success of the current one.
+	} else if meta.Length > 0 {
+		mf.managedSizeResolved(ctx, m.SkylinkID, meta.Length)
 	}
 	err = mf.db.SkylinkDownloadsUpdate(ctx, m.SkylinkID, meta.Length)
 	if err != nil {
@@ -141,3 +302,66 @@ func (mf *MetaFetcher) processMessage(ctx context.Context, m Message) {
 	}
 	mf.logger.Tracef("Successfully updated skylink %v.", m.SkylinkID)
 }
+
+// managedSizeResolved calls the SizeResolvedFunc, if one is set.
+func (mf *MetaFetcher) managedSizeResolved(ctx context.Context, id primitive.ObjectID, size int64) {
+	mf.mu.Lock()
+	f := mf.sizeResolved
+	mf.mu.Unlock()
+	if f != nil {
+		f(ctx, id, size)
+	}
+}
+
+// managedFetchFailed records a failed attempt to fetch the skylink's metadata
+// and schedules the next one.
+func (mf *MetaFetcher) managedFetchFailed(ctx context.Context, sl *database.Skylink) {
+	next := time.Now().UTC().Add(backoff(sl.MetaAttempts + 1))
+	err := mf.db.SkylinkMetaFetchFailed(ctx, sl.ID, next)
+	if err != nil {
+		mf.logger.Debugf("Failed to record a failed metadata fetch for skylink %s: %s", sl.Skylink, err)
+	}
+}
+
+// backoff returns how long we wait before retrying a skylink after the given
+// number of failed attempts.
+func backoff(attempts int) time.Duration {
+	d := backoffBase
+	for i := 1; i < attempts && d < backoffMax; i++ {
+		d *= 2
+	}
+	if d > backoffMax {
+		d = backoffMax
+	}
+	return d
+}
+
+// FetchMetadata fetches the metadata of the given skylink from the local skyd.
+func (skydFetcher) FetchMetadata(ctx context.Context, skylink string) (Metadata, error) {
+	// Make a request directly to the local `sia` container. We do that, so we
+	// don't get rate-limited by nginx in case we need to make many requests.
+	metaURL, err := url.Parse(fmt.Sprintf("http://sia:9980/skynet/metadata/%s", skylink))
+	if err != nil {
+		return Metadata{}, errors.AddContext(err, "failed to form skylink URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metaURL.String(), nil)
+	if err != nil {
+		return Metadata{}, err
+	}
+	req.Header.Set("User-Agent", "Sia-Agent")
+	client := http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode > 399 {
+		return Metadata{}, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var meta Metadata
+	err = json.NewDecoder(res.Body).Decode(&meta)
+	if err != nil {
+		return Metadata{}, errors.AddContext(err, "failed to parse skyfile metadata")
+	}
+	return meta, nil
+}
@@ -0,0 +1,59 @@
+package metafetcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestBackoff ensures that the backoff doubles with each failed attempt and
+// never exceeds backoffMax.
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 0, expected: backoffBase},
+		{attempts: 1, expected: backoffBase},
+		{attempts: 2, expected: 2 * backoffBase},
+		{attempts: 3, expected: 4 * backoffBase},
+		{attempts: 11, expected: 1024 * backoffBase},
+		{attempts: 12, expected: backoffMax},
+		{attempts: 1000, expected: backoffMax},
+	}
+	for _, tt := range tests {
+		if d := backoff(tt.attempts); d != tt.expected {
+			t.Errorf("Expected %v after %d attempts, got %v", tt.expected, tt.attempts, d)
+		}
+	}
+}
+
+// TestDrain ensures that Drain waits for the pending skylinks to be processed
+// and gives up once its context expires.
+func TestDrain(t *testing.T) {
+	mf := &MetaFetcher{pending: make(map[primitive.ObjectID]struct{})}
+	// Nothing is pending.
+	if err := mf.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// A skylink is pending and it doesn't get processed in time.
+	id := primitive.NewObjectID()
+	mf.pending[id] = struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*drainPollInterval)
+	defer cancel()
+	if err := mf.Drain(ctx); err == nil {
+		t.Fatal("Expected an error.")
+	}
+	// The skylink gets processed while we wait.
+	go func() {
+		time.Sleep(drainPollInterval)
+		mf.managedDone(id)
+	}()
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second)
+	defer cancel2()
+	if err := mf.Drain(ctx2); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,387 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+This package exposes service metrics in the Prometheus text exposition format.
+
+We only need a handful of counters, gauges, and histograms, so instead of
+pulling in the Prometheus client library we implement the small subset of it we
+need. All metrics are registered with DefaultRegistry, which is what the
+`/metrics` endpoint serves.
+*/
+
+var (
+	// DefaultBuckets are the default histogram buckets, in seconds. They are
+	// tailored to measure the latency of network requests.
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// DefaultRegistry holds all metrics exposed by the service.
+	DefaultRegistry = NewRegistry()
+
+	// HTTPRequests counts the HTTP requests we've served by route, method,
+	// and status code.
+	HTTPRequests = DefaultRegistry.NewCounterVec("accounts_http_requests_total", "Number of HTTP requests by route, method, and status code.", "route", "method", "status")
+	// HTTPRequestDuration tracks the time it took to serve HTTP requests by
+	// route and method.
+	HTTPRequestDuration = DefaultRegistry.NewHistogramVec("accounts_http_request_duration_seconds", "Duration of HTTP requests by route and method.", DefaultBuckets, "route", "method")
+	// Logins counts login attempts by their result, which is either
+	// LoginSuccess or LoginFailure.
+	Logins = DefaultRegistry.NewCounterVec("accounts_logins_total", "Number of login attempts by result.", "result")
+	// EmailsQueued counts the email messages queued for sending.
+	EmailsQueued = DefaultRegistry.NewCounterVec("accounts_emails_queued_total", "Number of email messages queued for sending.")
+	// EmailsSent counts the email messages sent by the email sender by
+	// result, which is either EmailSent or EmailFailed.
+	EmailsSent = DefaultRegistry.NewCounterVec("accounts_emails_sent_total", "Number of email messages the sender tried to send by result.", "result")
+	// MetafetcherQueueDepth is the number of messages waiting in the
+	// metafetcher's queue.
+	MetafetcherQueueDepth = DefaultRegistry.NewGauge("accounts_metafetcher_queue_depth", "Number of messages waiting in the metafetcher queue.")
+	// MongoPingDuration tracks the latency of pinging the database.
+	MongoPingDuration = DefaultRegistry.NewHistogramVec("accounts_mongo_ping_duration_seconds", "Latency of database pings.", DefaultBuckets)
+	// TrackInvalidIPs counts the tracked uploads without a valid `ip`
+	// parameter by reason, which is either TrackIPMissing or TrackIPInvalid.
+	TrackInvalidIPs = DefaultRegistry.NewCounterVec("accounts_track_invalid_ip_total", "Number of tracked uploads without a valid ip parameter by reason.", "reason")
+)
+
+const (
+	// LoginSuccess is the result label of a successful login.
+	LoginSuccess = "success"
+	// LoginFailure is the result label of a failed login.
+	LoginFailure = "failure"
+	// EmailSent is the result label of a successfully sent email.
+	EmailSent = "sent"
+	// EmailFailed is the result label of an email we failed to send.
+	EmailFailed = "failed"
+	// TrackIPMissing is the reason label of a tracked upload without an IP.
+	TrackIPMissing = "missing"
+	// TrackIPInvalid is the reason label of a tracked upload with an invalid
+	// IP.
+	TrackIPInvalid = "invalid"
+)
+
+type (
+	// Registry holds a set of metrics and knows how to write them out in the
+	// Prometheus text format.
+	Registry struct {
+		metrics []metric
+		mu      sync.Mutex
+	}
+	// metric is implemented by all metric types.
+	metric interface {
+		write(w io.Writer) error
+	}
+
+	// CounterVec is a set of counters which share a name and are partitioned
+	// by the values of their labels.
+	CounterVec struct {
+		staticName   string
+		staticHelp   string
+		staticLabels []string
+		values       map[string]*series
+		mu           sync.Mutex
+	}
+	// Gauge is a single value which can go up and down.
+	Gauge struct {
+		staticName string
+		staticHelp string
+		value      float64
+		mu         sync.Mutex
+	}
+	// HistogramVec is a set of histograms which share a name and buckets and
+	// are partitioned by the values of their labels.
+	HistogramVec struct {
+		staticName    string
+		staticHelp    string
+		staticLabels  []string
+		staticBuckets []float64
+		values        map[string]*series
+		mu            sync.Mutex
+	}
+	// series holds the values of a single combination of label values.
+	series struct {
+		labelValues []string
+		// value is the value of a counter or the sum of a histogram.
+		value float64
+		// count and buckets are only used by histograms. Each bucket counts
+		// the observations which are less than or equal to its upper bound.
+		count   uint64
+		buckets []uint64
+	}
+)
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounterVec creates a new CounterVec and registers it.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		staticName:   name,
+		staticHelp:   help,
+		staticLabels: labels,
+		values:       make(map[string]*series),
+	}
+	// Metrics without labels have a single series which we report even
+	// before it gets its first update.
+	if len(labels) == 0 {
+		seriesFor(c.values, labels, nil, 0)
+	}
+	r.register(c)
+	return c
+}
+
+// NewGauge creates a new Gauge and registers it.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{
+		staticName: name,
+		staticHelp: help,
+	}
+	r.register(g)
+	return g
+}
+
+// NewHistogramVec creates a new HistogramVec and registers it. The buckets
+// need to be sorted in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		staticName:    name,
+		staticHelp:    help,
+		staticLabels:  labels,
+		staticBuckets: buckets,
+		values:        make(map[string]*series),
+	}
+	if len(labels) == 0 {
+		seriesFor(h.values, labels, nil, len(buckets))
+	}
+	r.register(h)
+	return h
+}
+
+// WriteText writes all registered metrics to w in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// register adds a metric to the registry.
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Add adds the given value to the counter with the given label values. The
+// value needs to be non-negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := seriesFor(c.values, c.staticLabels, labelValues, 0)
+	s.value += v
+}
+
+// Inc increments the counter with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the current value of the counter with the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, exists := c.values[seriesKey(labelValues)]
+	if !exists {
+		return 0
+	}
+	return s.value
+}
+
+// write implements the metric interface.
+func (c *CounterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.staticName, escapeHelp(c.staticHelp), c.staticName)
+	if err != nil {
+		return err
+	}
+	for _, s := range sortedSeries(c.values) {
+		_, err = fmt.Fprintf(w, "%s%s %s\n", c.staticName, formatLabels(c.staticLabels, s.labelValues, "", ""), formatFloat(s.value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = v
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+// write implements the metric interface.
+func (g *Gauge) write(w io.Writer) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.staticName, escapeHelp(g.staticHelp), g.staticName, g.staticName, formatFloat(g.value))
+	return err
+}
+
+// Observe adds a single observation to the histogram with the given label
+// values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := seriesFor(h.values, h.staticLabels, labelValues, len(h.staticBuckets))
+	s.value += v
+	s.count++
+	for i, upperBound := range h.staticBuckets {
+		if v <= upperBound {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Count returns the number of observations made by the histogram with the
+// given label values.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, exists := h.values[seriesKey(labelValues)]
+	if !exists {
+		return 0
+	}
+	return s.count
+}
+
+// write implements the metric interface.
+func (h *HistogramVec) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.staticName, escapeHelp(h.staticHelp), h.staticName)
+	if err != nil {
+		return err
+	}
+	for _, s := range sortedSeries(h.values) {
+		for i, upperBound := range h.staticBuckets {
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", h.staticName, formatLabels(h.staticLabels, s.labelValues, "le", formatFloat(upperBound)), s.buckets[i])
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", h.staticName, formatLabels(h.staticLabels, s.labelValues, "le", "+Inf"), s.count)
+		if err != nil {
+			return err
+		}
+		labels := formatLabels(h.staticLabels, s.labelValues, "", "")
+		_, err = fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.staticName, labels, formatFloat(s.value), h.staticName, labels, s.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seriesFor returns the series with the given label values, creating it if
+// it doesn't exist. Missing label values are treated as empty strings and
+// extra ones are dropped. The caller needs to hold the metric's lock.
+func seriesFor(values map[string]*series, labels, labelValues []string, numBuckets int) *series {
+	lv := make([]string, len(labels))
+	copy(lv, labelValues)
+	key := seriesKey(lv)
+	s, exists := values[key]
+	if !exists {
+		s = &series{
+			labelValues: lv,
+			buckets:     make([]uint64, numBuckets),
+		}
+		values[key] = s
+	}
+	return s
+}
+
+// seriesKey builds a map key from the given label values.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// sortedSeries returns the series in a stable order, so the output doesn't
+// change between scrapes.
+func sortedSeries(values map[string]*series) []*series {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ss := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		ss = append(ss, values[k])
+	}
+	return ss
+}
+
+// formatLabels formats the given labels and their values, along with an
+// optional extra label, e.g. `{route="/user",le="0.5"}`.
+func formatLabels(labels, labelValues []string, extraLabel, extraValue string) string {
+	if len(labels) == 0 && extraLabel == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)+1)
+	for i, l := range labels {
+		pairs = append(pairs, l+`="`+escapeLabelValue(labelValues[i])+`"`)
+	}
+	if extraLabel != "" {
+		pairs = append(pairs, extraLabel+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a float the way Prometheus expects it.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// escapeHelp escapes backslashes and new lines in help texts.
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// escapeLabelValue escapes backslashes, double quotes, and new lines in label
+// values.
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestRegistryWriteTo ensures that the registry writes its metrics in the
+// Prometheus text format.
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Number of requests.", "route", "status")
+	g := r.NewGauge("test_queue_depth", "Queue depth.")
+	r.NewCounterVec("test_unlabeled_total", "Unlabeled counter.")
+	h := r.NewHistogramVec("test_duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+
+	c.Inc("/user", "200")
+	c.Inc("/user", "200")
+	c.Add(3, `/a"b`, "500")
+	c.Add(-1, "/user", "200")
+	g.Set(7)
+	h.Observe(0.05, "/user")
+	h.Observe(0.5, "/user")
+	h.Observe(5, "/user")
+
+	if v := c.Value("/user", "200"); v != 2 {
+		t.Fatalf("Expected 2, got %v", v)
+	}
+	if v := c.Value("/missing", "200"); v != 0 {
+		t.Fatalf("Expected 0, got %v", v)
+	}
+	if n := h.Count("/user"); n != 3 {
+		t.Fatalf("Expected 3 observations, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	err := r.WriteText(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"# HELP test_requests_total Number of requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="/a\"b",status="500"} 3`,
+		`test_requests_total{route="/user",status="200"} 2`,
+		"# TYPE test_queue_depth gauge",
+		"test_queue_depth 7",
+		"test_unlabeled_total 0",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{route="/user",le="0.1"} 1`,
+		`test_duration_seconds_bucket{route="/user",le="1"} 2`,
+		`test_duration_seconds_bucket{route="/user",le="+Inf"} 3`,
+		`test_duration_seconds_sum{route="/user"} 5.55`,
+		`test_duration_seconds_count{route="/user"} 3`,
+	}
+	out := buf.String()
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected line '%s' in output:\n%s", line, out)
+		}
+	}
+	// Series should be sorted, so the output is stable.
+	if strings.Index(out, `route="/a\"b"`) > strings.Index(out, `route="/user",status`) {
+		t.Errorf("Expected sorted series, got:\n%s", out)
+	}
+}
@@ -0,0 +1,130 @@
+package accountsadmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/accountsadmin"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestUserInfo ensures that `user info` finds users by email and by sub and
+// describes them as JSON.
+func TestUserInfo(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := dbName + "_" + strings.ReplaceAll(time.Now().Format("150405.000000"), ".", "")
+	email := types.NewEmail(prefix + "@siasky.net")
+	u, err := db.UserCreate(ctx, email, "", prefix+"_sub", database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	admin := accountsadmin.New(db, &out)
+
+	// userInfo runs `user info` and parses its output.
+	userInfo := func(args ...string) accountsadmin.UserInfo {
+		out.Reset()
+		err := admin.Run(ctx, append([]string{"user", "info"}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info accountsadmin.UserInfo
+		err = json.Unmarshal(out.Bytes(), &info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	for _, id := range []string{u.Sub, strings.ToUpper(email.String())} {
+		info := userInfo(id)
+		if info.ID != u.ID.Hex() || info.Sub != u.Sub || info.Email != email || info.Tier != database.TierPremium5 || info.DeletedAt != nil {
+			t.Fatalf("Unexpected user info %+v", info)
+		}
+	}
+	// The output is a single line unless we ask for pretty output.
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Fatalf("Expected a single line, got %d", lines)
+	}
+	info := userInfo(u.Sub, "--pretty")
+	if lines := strings.Count(out.String(), "\n"); lines < 2 || info.Sub != u.Sub {
+		t.Fatalf("Expected indented output, got '%s'", out.String())
+	}
+
+	// Unknown users result in ErrUserNotFound.
+	err = admin.Run(ctx, []string{"user", "info", prefix + "_nobody"})
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrUserNotFound, err)
+	}
+}
+
+// TestUserSetTier ensures that `user set-tier` changes the user's tier and
+// rejects invalid tiers.
+func TestUserSetTier(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := dbName + "_" + strings.ReplaceAll(time.Now().Format("150405.000000"), ".", "")
+	u, err := db.UserCreate(ctx, types.NewEmail(prefix+"@siasky.net"), "", prefix+"_sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	admin := accountsadmin.New(db, &out)
+
+	err = admin.Run(ctx, []string{"user", "set-tier", u.Sub, strconv.Itoa(database.TierPremium20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info accountsadmin.UserInfo
+	err = json.Unmarshal(out.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Tier != database.TierPremium20 {
+		t.Fatalf("Expected tier %d in the output, got %d", database.TierPremium20, info.Tier)
+	}
+	u, err = db.UserBySub(ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Tier != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, u.Tier)
+	}
+
+	// Invalid tiers don't change anything.
+	for _, tier := range []string{"x", strconv.Itoa(database.TierAnonymous), strconv.Itoa(database.TierMaxReserved)} {
+		err = admin.Run(ctx, []string{"user", "set-tier", u.Sub, tier})
+		if err == nil {
+			t.Fatalf("Expected an error for tier '%s'", tier)
+		}
+	}
+	u, err = db.UserBySub(ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Tier != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, u.Tier)
+	}
+}
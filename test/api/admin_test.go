@@ -0,0 +1,1228 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testAdminCohorts ensures that adminCohortsGET validates its input and
+// caches its results.
+func testAdminCohorts(t *testing.T, at *test.AccountsTester) {
+	// Invalid number of weeks.
+	for _, weeks := range []int{0, -1, database.CohortWeeksMax + 1} {
+		_, s, err := at.AdminCohortsGET(weeks)
+		if err == nil || s != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %d weeks, got %d and %v", http.StatusBadRequest, weeks, s, err)
+		}
+	}
+	cm, s, err := at.AdminCohortsGET(8)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if cm.Weeks != 8 || len(cm.Cohorts) != 8 {
+		t.Fatalf("Expected 8 weeks and 8 cohorts, got %d and %d", cm.Weeks, len(cm.Cohorts))
+	}
+	// Expect the second call to be served from the cache.
+	cm2, s, err := at.AdminCohortsGET(8)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if !cm2.GeneratedAt.Equal(cm.GeneratedAt) {
+		t.Fatalf("Expected a cached report generated at %v, got one generated at %v", cm.GeneratedAt, cm2.GeneratedAt)
+	}
+}
+
+// testAdminUserTier ensures that adminUserTierPOST requires the admin API key,
+// validates the tier, and invalidates the cached tier of the user.
+func testAdminUserTier(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+
+	adminKey := "admin api key"
+	// The admin endpoints are disabled when there is no admin API key.
+	_, s, err := at.AdminUserTierPOST("", u.Sub, database.TierPremium20)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	// Wrong key.
+	_, s, err = at.AdminUserTierPOST("wrong key", u.Sub, database.TierPremium20)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	// A user's credentials are not admin credentials.
+	at.SetCookie(c)
+	_, s, err = at.AdminUserTierPOST("", u.Sub, database.TierPremium20)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	// Invalid tiers.
+	for _, tier := range []int{database.TierAnonymous, database.TierMaxReserved, -1} {
+		_, s, err = at.AdminUserTierPOST(adminKey, u.Sub, tier)
+		if err == nil || s != http.StatusBadRequest {
+			t.Fatalf("Expected %d for tier %d, got %d and %v", http.StatusBadRequest, tier, s, err)
+		}
+	}
+	// Non-existent user.
+	_, s, err = at.AdminUserTierPOST(adminKey, "this user does not exist", database.TierPremium20)
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+
+	// Populate the tier cache.
+	ul, _, err := at.UserLimits("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+	// Set the tier.
+	ug, s, err := at.AdminUserTierPOST(adminKey, u.Sub, database.TierPremium20)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if ug.Tier != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, ug.Tier)
+	}
+	u2, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.Tier != database.TierPremium20 {
+		t.Fatalf("Expected tier %d in the DB, got %d", database.TierPremium20, u2.Tier)
+	}
+	// The cached tier should have been invalidated.
+	ul, _, err = at.UserLimits("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, ul.TierID)
+	}
+}
+
+// testAdminUserTrial ensures that adminUserTrialPOST grants the user a trial
+// tier which raises their limits while it lasts and that their limits revert
+// to their paid tier once it lapses.
+func testAdminUserTrial(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	until := time.Now().UTC().Add(time.Hour).Truncate(time.Millisecond)
+	// Wrong key.
+	_, s, err := at.AdminUserTrialPOST("wrong key", u.Sub, database.TierPremium5, until)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	// Invalid tiers.
+	for _, tier := range []int{database.TierAnonymous, database.TierFree, database.TierMaxReserved} {
+		_, s, err = at.AdminUserTrialPOST(adminKey, u.Sub, tier, until)
+		if err == nil || s != http.StatusBadRequest {
+			t.Fatalf("Expected %d for tier %d, got %d and %v", http.StatusBadRequest, tier, s, err)
+		}
+	}
+	// A trial which has already ended.
+	_, s, err = at.AdminUserTrialPOST(adminKey, u.Sub, database.TierPremium5, time.Now().UTC().Add(-time.Hour))
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Non-existent user.
+	_, s, err = at.AdminUserTrialPOST(adminKey, "nosuchsub", database.TierPremium5, until)
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+
+	// Populate the tier cache.
+	at.SetCookie(c)
+	ul, _, err := at.UserLimits("", nil)
+	if err != nil || ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d and %v", database.TierFree, ul.TierID, err)
+	}
+	// Grant the trial.
+	ug, s, err := at.AdminUserTrialPOST(adminKey, u.Sub, database.TierPremium5, until)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if ug.Tier != database.TierFree || ug.TrialTier != database.TierPremium5 || !ug.TrialUntil.Equal(until) {
+		t.Fatalf("Unexpected tier %d, trial tier %d, and trial end %s", ug.Tier, ug.TrialTier, ug.TrialUntil)
+	}
+	// The user sees their trial.
+	ug, _, err = at.UserGET()
+	if err != nil || ug.TrialTier != database.TierPremium5 || !ug.TrialUntil.Equal(until) {
+		t.Fatalf("Unexpected trial tier %d and trial end %s, error %v", ug.TrialTier, ug.TrialUntil, err)
+	}
+	// The cached tier should have been invalidated and the user should get
+	// the limits of the trial tier.
+	ul, _, err = at.UserLimits("", nil)
+	if err != nil || ul.TierID != database.TierPremium5 {
+		t.Fatalf("Expected tier %d, got %d and %v", database.TierPremium5, ul.TierID, err)
+	}
+
+	// Expire the trial.
+	u2, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2.TrialUntil = time.Now().UTC().Add(-time.Minute).Truncate(time.Millisecond)
+	err = at.DB.UserSave(at.Ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use a new API key, so we don't hit the tier cache. The limits should
+	// revert to those of the paid tier.
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.ClearCredentials()
+	at.SetAPIKey(ak.Key.String())
+	ul, _, err = at.UserLimits("", nil)
+	if err != nil || ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d and %v", database.TierFree, ul.TierID, err)
+	}
+}
+
+// testAdminUserFlags ensures that admins can suspend and unsuspend users and
+// leave notes on their accounts, and that suspended users can't log in or use
+// their JWTs and API keys.
+func testAdminUserFlags(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	sk, pk := crypto.GenerateKeyPair()
+	if err = at.DB.UserPubKeyAdd(at.Ctx, *u.User, pk[:]); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := test.ExtractCookie(r)
+	at.SetCookie(c)
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Populate the tier cache.
+	ul, _, err := at.UserLimits("", nil)
+	if err != nil || ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d and %v", database.TierFree, ul.TierID, err)
+	}
+
+	// loginPubKey logs the user in with their public key.
+	loginPubKey := func() (int, error) {
+		ch, _, err := at.LoginPubKeyGET(pk[:])
+		if err != nil {
+			return 0, err
+		}
+		chBytes, err := hex.DecodeString(ch.Challenge)
+		if err != nil {
+			return 0, err
+		}
+		response := append(chBytes, append([]byte(database.ChallengeTypeLogin), []byte(database.PortalName)...)...)
+		r, _, err := at.LoginPubKeyPOST(response, ed25519.Sign(sk[:], response), "")
+		return r.StatusCode, err
+	}
+	// checkAccess makes sure that all authentication methods return the
+	// given status.
+	checkAccess := func(expectedStatus int) {
+		at.ClearCredentials()
+		r, _, err := at.LoginCredentialsPOST(email.String(), password)
+		if r.StatusCode != expectedStatus {
+			t.Fatalf("Credentials login: expected %d, got %d and %v", expectedStatus, r.StatusCode, err)
+		}
+		s, err := loginPubKey()
+		if s != expectedStatus {
+			t.Fatalf("Challenge login: expected %d, got %d and %v", expectedStatus, s, err)
+		}
+		at.SetCookie(c)
+		_, s, err = at.UserGET()
+		if s != expectedStatus {
+			t.Fatalf("Token auth: expected %d, got %d and %v", expectedStatus, s, err)
+		}
+		if expectedStatus == http.StatusForbidden && test.ErrorCode(err.Error()) != api.ErrCodeAccountSuspended {
+			t.Fatalf("Expected error code '%s', got %v", api.ErrCodeAccountSuspended, err)
+		}
+		at.ClearCredentials()
+		at.SetAPIKey(ak.Key.String())
+		_, s, err = at.UserUploadsGET(nil)
+		if s != expectedStatus {
+			t.Fatalf("API key auth: expected %d, got %d and %v", expectedStatus, s, err)
+		}
+		at.ClearCredentials()
+	}
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	suspend, unsuspend := true, false
+	// Wrong key.
+	_, s, err := at.AdminUserFlagsPUT("wrong key", "", u.Sub, api.AdminUserFlagsPUT{Suspended: &suspend})
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	// Nothing to update.
+	_, s, err = at.AdminUserFlagsPUT(adminKey, "", u.Sub, api.AdminUserFlagsPUT{AddNote: "  "})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Non-existent user.
+	_, s, err = at.AdminUserFlagsPUT(adminKey, "", "nosuchsub", api.AdminUserFlagsPUT{Suspended: &suspend})
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+
+	// Suspend the user.
+	fl, s, err := at.AdminUserFlagsPUT(adminKey, "alice", u.Sub, api.AdminUserFlagsPUT{Suspended: &suspend, AddNote: "suspected abuse"})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if !fl.Suspended || len(fl.AdminNotes) != 1 || !strings.HasSuffix(fl.AdminNotes[0], " [alice] suspected abuse") {
+		t.Fatalf("Unexpected flags %+v", fl)
+	}
+	checkAccess(http.StatusForbidden)
+	// The cached tier should have been invalidated and the user should get
+	// the anonymous limits.
+	at.SetCookie(c)
+	ul, _, err = at.UserLimits("", nil)
+	if err != nil || ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d and %v", database.TierAnonymous, ul.TierID, err)
+	}
+
+	// Unsuspend the user. Notes accumulate and default to the generic admin
+	// identity.
+	fl, s, err = at.AdminUserFlagsPUT(adminKey, "", u.Sub, api.AdminUserFlagsPUT{Suspended: &unsuspend, AddNote: "refund issued"})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if fl.Suspended || len(fl.AdminNotes) != 2 || !strings.HasSuffix(fl.AdminNotes[1], " [admin] refund issued") {
+		t.Fatalf("Unexpected flags %+v", fl)
+	}
+	checkAccess(http.StatusOK)
+	at.SetCookie(c)
+	ul, _, err = at.UserLimits("", nil)
+	if err != nil || ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d and %v", database.TierFree, ul.TierID, err)
+	}
+	// A note alone leaves the flag unchanged.
+	fl, _, err = at.AdminUserFlagsPUT(adminKey, "bob", u.Sub, api.AdminUserFlagsPUT{AddNote: "all good"})
+	if err != nil || fl.Suspended || len(fl.AdminNotes) != 3 {
+		t.Fatalf("Unexpected flags %+v, error %v", fl, err)
+	}
+	u2, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.Suspended || len(u2.AdminNotes) != 3 {
+		t.Fatalf("Unexpected suspended flag %t and notes %v", u2.Suspended, u2.AdminNotes)
+	}
+	// The user never sees the notes.
+	var ug map[string]interface{}
+	_, err = at.Request(http.MethodGet, "/user", nil, nil, nil, &ug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := ug["adminNotes"]; exists {
+		t.Fatalf("Expected no admin notes, got %+v", ug)
+	}
+}
+
+// testAdminLimits ensures that tier limits overrides from the database are
+// reflected by the limits endpoints and that adminLimitsPUT validates and
+// applies its input.
+func testAdminLimits(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	// Restore the default limits when we're done.
+	defer func() {
+		err = at.DB.TierLimitsOverrideSet(at.Ctx, database.TierFree, database.TierLimitsOverride{})
+		if err == nil {
+			err = at.DB.RefreshTierLimits(at.Ctx)
+		}
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to restore the tier limits in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defaults := database.UserLimits[database.TierFree]
+
+	// Override the free tier's storage and upload speed in the DB.
+	storage := 3 * defaults.Storage
+	upload := 2 * defaults.UploadBandwidth
+	o := database.TierLimitsOverride{Storage: &storage, UploadBandwidth: &upload}
+	err = at.DB.TierLimitsOverrideSet(at.Ctx, database.TierFree, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The override should not be visible before a refresh.
+	ul, _, err := at.UserLimits("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.UploadBandwidth != defaults.UploadBandwidth {
+		t.Fatalf("Expected upload bandwidth %d, got %d", defaults.UploadBandwidth, ul.UploadBandwidth)
+	}
+	err = at.DB.RefreshTierLimits(at.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul, _, err = at.UserLimits("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.UploadBandwidth != upload {
+		t.Fatalf("Expected upload bandwidth %d, got %d", upload, ul.UploadBandwidth)
+	}
+	if ul.DownloadBandwidth != defaults.DownloadBandwidth {
+		t.Fatalf("Expected download bandwidth %d, got %d", defaults.DownloadBandwidth, ul.DownloadBandwidth)
+	}
+	if l := database.LimitsForTier(database.TierFree); l.Storage != storage {
+		t.Fatalf("Expected storage %d, got %d", storage, l.Storage)
+	}
+	lg, _, err := at.LimitsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lg.UserLimits) != database.TierMaxReserved {
+		t.Fatalf("Expected %d tiers, got %d", database.TierMaxReserved, len(lg.UserLimits))
+	}
+	if lg.UserLimits[database.TierFree].Storage != storage {
+		t.Fatalf("Expected storage %d, got %d", storage, lg.UserLimits[database.TierFree].Storage)
+	}
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	// A user's credentials are not admin credentials.
+	_, s, err := at.AdminLimitsPUT("", database.TierFree, o)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	// Invalid tiers.
+	for _, tier := range []int{database.TierMaxReserved, -1} {
+		_, s, err = at.AdminLimitsPUT(adminKey, tier, o)
+		if err == nil || s != http.StatusBadRequest {
+			t.Fatalf("Expected %d for tier %d, got %d and %v", http.StatusBadRequest, tier, s, err)
+		}
+	}
+	// Invalid values.
+	negative := int64(-1)
+	_, s, err = at.AdminLimitsPUT(adminKey, database.TierFree, database.TierLimitsOverride{Storage: &negative})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Override the limits via the admin endpoint. The change should take
+	// effect immediately.
+	maxUploadSize := defaults.MaxUploadSize / 2
+	tl, s, err := at.AdminLimitsPUT(adminKey, database.TierFree, database.TierLimitsOverride{MaxUploadSize: &maxUploadSize})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	// The new override replaces the previous one.
+	if tl.MaxUploadSize != maxUploadSize || tl.Storage != defaults.Storage {
+		t.Fatalf("Unexpected limits %+v", tl)
+	}
+	ul, _, err = at.UserLimits("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.MaxUploadSize != maxUploadSize || ul.UploadBandwidth != defaults.UploadBandwidth {
+		t.Fatalf("Unexpected limits %+v", ul)
+	}
+	// An empty override restores the defaults.
+	tl, s, err = at.AdminLimitsPUT(adminKey, database.TierFree, database.TierLimitsOverride{})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if tl.MaxUploadSize != defaults.MaxUploadSize || tl.Storage != defaults.Storage {
+		t.Fatalf("Unexpected limits %+v", tl)
+	}
+}
+
+// testAdminSkylinkBlock ensures that admins can block and unblock skylinks,
+// that we refuse to track uploads and downloads of blocked skylinks and that
+// blocked skylinks only get anonymous limits, even with a covering API key.
+func testAdminSkylinkBlock(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	sl := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	at.SetCookie(c)
+	// Create a public API key which covers the skylink.
+	pak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Public: true, Skylinks: []string{sl}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	// Only admins can block skylinks.
+	_, s, err := at.AdminSkylinkBlockPOST("wrong key", sl)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	_, s, err = at.AdminSkylinkBlockPOST(adminKey, "not a skylink")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Block the skylinks.
+	bsl, s, err := at.AdminSkylinkBlockPOST(adminKey, sl)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if !bsl.Blocked || bsl.BlockedAt.IsZero() {
+		t.Fatalf("Expected the skylink to be blocked, got %+v", bsl)
+	}
+	_, s, err = at.AdminSkylinkBlockPOST(adminKey, sl2)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	// Both skylinks should be listed, most recently blocked first.
+	bl, s, err := at.AdminSkylinksBlockedGET(adminKey, 0, 1)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if bl.Count < 2 || len(bl.Items) != 1 || !bl.HasMore || bl.Items[0].Skylink != sl2 {
+		t.Fatalf("Unexpected list of blocked skylinks %+v", bl)
+	}
+
+	// We refuse to track uploads and downloads of blocked skylinks.
+	s, err = at.TrackUpload(sl, "")
+	if err == nil || s != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnavailableForLegalReasons, s, err)
+	}
+	s, err = at.TrackDownload(sl, 100)
+	if err == nil || s != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnavailableForLegalReasons, s, err)
+	}
+	// The API key doesn't give the blocked skylink better limits.
+	at.ClearCredentials()
+	ul, _, err := at.UserLimitsSkylink(sl, "byte", pak.Key.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.DownloadBandwidth != database.UserLimits[database.TierAnonymous].DownloadBandwidth {
+		t.Fatalf("Expected to get download bandwidth of %d, got %d", database.UserLimits[database.TierAnonymous].DownloadBandwidth, ul.DownloadBandwidth)
+	}
+
+	// Unblock the skylink.
+	s, err = at.AdminSkylinkBlockDELETE(adminKey, sl)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	at.SetCookie(c)
+	s, err = at.TrackUpload(sl, "")
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	at.ClearCredentials()
+	ul, _, err = at.UserLimitsSkylink(sl, "byte", pak.Key.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.DownloadBandwidth != database.UserLimits[database.TierFree].DownloadBandwidth {
+		t.Fatalf("Expected to get download bandwidth of %d, got %d", database.UserLimits[database.TierFree].DownloadBandwidth, ul.DownloadBandwidth)
+	}
+	// The unblocked skylink is no longer listed.
+	bl, _, err = at.AdminSkylinksBlockedGET(adminKey, 0, api.DefaultPageSizeLarge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bl.Items {
+		if b.Skylink == sl {
+			t.Fatal("Expected the skylink to be unblocked.")
+		}
+	}
+	// Clean up the other block.
+	s, err = at.AdminSkylinkBlockDELETE(adminKey, sl2)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+}
+
+// testAdminActivityByIP ensures that admins can list the uploads and downloads
+// made from a given IP.
+func testAdminActivityByIP(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	at.SetCookie(c)
+
+	// Use random IPs, so other tests don't interfere with the counts.
+	ip1 := fmt.Sprintf("10.%d.%d.%d", fastrand.Intn(256), fastrand.Intn(256), fastrand.Intn(256))
+	ip2 := fmt.Sprintf("fd00::%x:%x", fastrand.Intn(65536), fastrand.Intn(65536))
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	sl3 := test.RandomSkylink()
+	start := time.Now().UTC().Add(-time.Second)
+	for _, tu := range []struct{ sl, ip string }{{sl1, ip1}, {sl2, ip1}, {sl3, ip2}} {
+		if s, err := at.TrackUpload(tu.sl, tu.ip); err != nil || s != http.StatusNoContent {
+			t.Fatal(s, err)
+		}
+	}
+	if s, err := at.TrackDownloadFromIP(sl3, 100, ip1); err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	// Only admins can list activity by IP and they need to give a valid IP.
+	_, s, err := at.AdminUploadsByIPGET("wrong key", ip1, time.Time{})
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	_, s, err = at.AdminUploadsByIPGET(adminKey, "not an ip", time.Time{})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+
+	// The first IP uploaded two skylinks, most recent first.
+	ups, s, err := at.AdminUploadsByIPGET(adminKey, ip1, time.Time{})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if ups.Count != 2 || len(ups.Items) != 2 || ups.HasMore {
+		t.Fatalf("Expected two uploads, got %+v", ups)
+	}
+	if ups.Items[0].Skylink != sl2 || ups.Items[1].Skylink != sl1 {
+		t.Fatalf("Unexpected uploads %+v", ups.Items)
+	}
+	for _, up := range ups.Items {
+		if up.Sub != u.Sub || up.Timestamp.Before(start) {
+			t.Fatalf("Unexpected upload %+v", up)
+		}
+	}
+	// The second IP uploaded one skylink.
+	ups, _, err = at.AdminUploadsByIPGET(adminKey, ip2, time.Time{})
+	if err != nil || ups.Count != 1 || len(ups.Items) != 1 || ups.Items[0].Skylink != sl3 {
+		t.Fatalf("Expected one upload of %s, got %+v and %v", sl3, ups, err)
+	}
+	// Nothing was uploaded from either IP in the future.
+	ups, _, err = at.AdminUploadsByIPGET(adminKey, ip1, time.Now().UTC().Add(time.Hour))
+	if err != nil || ups.Count != 0 || len(ups.Items) != 0 {
+		t.Fatalf("Expected no uploads, got %+v and %v", ups, err)
+	}
+
+	// Only the first IP downloaded anything.
+	downs, s, err := at.AdminDownloadsByIPGET(adminKey, ip1, start)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if downs.Count != 1 || len(downs.Items) != 1 {
+		t.Fatalf("Expected one download, got %+v", downs)
+	}
+	if d := downs.Items[0]; d.Skylink != sl3 || d.Sub != u.Sub || d.Bytes != 100 {
+		t.Fatalf("Unexpected download %+v", d)
+	}
+	downs, _, err = at.AdminDownloadsByIPGET(adminKey, ip2, start)
+	if err != nil || downs.Count != 0 || len(downs.Items) != 0 {
+		t.Fatalf("Expected no downloads, got %+v and %v", downs, err)
+	}
+}
+
+// stubGeoResolver is a lib.GeoResolver which maps fixed IPs to countries.
+type stubGeoResolver map[string]string
+
+// Country returns the country of the given IP, if we know it.
+func (r stubGeoResolver) Country(ip net.IP) (string, error) {
+	return r[ip.String()], nil
+}
+
+// testAdminUploadsByCountry ensures that tracked uploads get tagged with the
+// country of their IP and that admins can see the number of uploads per
+// country.
+func testAdminUploadsByCountry(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	at.SetCookie(c)
+
+	// We use user-assigned country codes, so uploads made by other tests
+	// can't interfere with the counts.
+	ipXA1 := fmt.Sprintf("10.%d.%d.%d", fastrand.Intn(256), fastrand.Intn(256), fastrand.Intn(256))
+	ipXA2 := fmt.Sprintf("fd00::%x:%x", fastrand.Intn(65536), fastrand.Intn(65536))
+	ipXB := fmt.Sprintf("172.16.%d.%d", fastrand.Intn(256), fastrand.Intn(256))
+	ipUnknown := "192.0.2.1"
+	oldResolver := api.GeoResolver
+	api.GeoResolver = stubGeoResolver{
+		net.ParseIP(ipXA1).String(): "XA",
+		net.ParseIP(ipXA2).String(): "XA",
+		net.ParseIP(ipXB).String():  "XB",
+	}
+	defer func() { api.GeoResolver = oldResolver }()
+
+	start := time.Now().UTC().Add(-time.Second)
+	for _, ip := range []string{ipXA1, ipXA2, ipXB, ipUnknown, ""} {
+		if s, err := at.TrackUpload(test.RandomSkylink(), ip); err != nil || s != http.StatusNoContent {
+			t.Fatal(s, err)
+		}
+	}
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	// Only admins can see the stats and they need to give a valid time.
+	_, s, err := at.AdminUploadsByCountryGET("wrong key", start)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	r, err := at.Request(http.MethodGet, "/admin/stats/uploads-by-country", url.Values{"since": {"yesterday"}}, nil, map[string]string{api.AdminAPIKeyHeader: adminKey}, nil)
+	if err == nil || r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, r.StatusCode, err)
+	}
+
+	// The uploads get tagged in the background, so we might need to wait.
+	// Both the unknown and the missing IP count as unknown countries.
+	var stats api.AdminUploadsByCountryGET
+	err = build.Retry(50, 100*time.Millisecond, func() error {
+		stats, s, err = at.AdminUploadsByCountryGET(adminKey, start)
+		if err != nil || s != http.StatusOK {
+			return fmt.Errorf("unexpected response %d %v", s, err)
+		}
+		counts := make(map[string]int64)
+		for _, cc := range stats.Countries {
+			counts[cc.Country] = cc.Count
+		}
+		if counts["XA"] != 2 || counts["XB"] != 1 || counts[database.UnknownCountry] < 2 {
+			return fmt.Errorf("unexpected counts %+v", stats.Countries)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The most active countries come first.
+	for i := 1; i < len(stats.Countries); i++ {
+		if stats.Countries[i].Count > stats.Countries[i-1].Count {
+			t.Fatalf("Expected countries sorted by count, got %+v", stats.Countries)
+		}
+	}
+	// Nothing was uploaded in the future.
+	stats, _, err = at.AdminUploadsByCountryGET(adminKey, time.Now().UTC().Add(time.Hour))
+	if err != nil || len(stats.Countries) != 0 {
+		t.Fatalf("Expected no uploads, got %+v and %v", stats, err)
+	}
+}
+
+// testAdminSkylinkStats ensures that admins can see the aggregate download
+// stats of a skylink, including anonymous downloads, and that anonymous
+// downloads don't count towards any user's stats.
+func testAdminSkylinkStats(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	at.SetCookie(c)
+
+	sl := test.RandomSkylink()
+	start := time.Now().UTC().Add(-time.Second)
+	if s, err := at.TrackDownload(sl, 100); err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	// Download the skylink twice without credentials. These downloads come
+	// from the same IP within the update window, so we track them as one.
+	at.ClearCredentials()
+	for i := 0; i < 2; i++ {
+		if s, err := at.TrackDownload(sl, 300); err != nil || s != http.StatusNoContent {
+			t.Fatal(s, err)
+		}
+	}
+	// The user's stats only include their own download.
+	at.SetCookie(c)
+	us, _, err := at.UserStats("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if us.NumDownloads != 1 || us.DownloadsSize != 100 {
+		t.Fatalf("Expected one download of 100 bytes, got %+v", us)
+	}
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	// Only admins can see skylink stats and they need to give a valid skylink.
+	_, s, err := at.AdminSkylinkStatsGET("wrong key", sl)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	_, s, err = at.AdminSkylinkStatsGET(adminKey, "INVALID_SKYLINK")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// The skylink's stats include the anonymous downloads.
+	stats, s, err := at.AdminSkylinkStatsGET(adminKey, sl)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if stats.Skylink != sl || stats.Downloads != 2 || stats.BytesServed != 700 || stats.AnonDownloads != 1 || stats.AnonBytesServed != 600 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	if stats.LastDownloadedAt.Before(start) {
+		t.Fatalf("Unexpected last download time %v", stats.LastDownloadedAt)
+	}
+	// A skylink nobody has downloaded has no stats.
+	sl2 := test.RandomSkylink()
+	stats, _, err = at.AdminSkylinkStatsGET(adminKey, sl2)
+	if err != nil || stats.Skylink != sl2 || stats.Downloads != 0 || stats.BytesServed != 0 {
+		t.Fatalf("Expected no downloads, got %+v and %v", stats, err)
+	}
+}
+
+// testAdminSkylinkPurge ensures that admins can purge a skylink together with
+// all uploads and downloads of it, across users.
+func testAdminSkylinkPurge(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u1, c1, err := test.CreateUserAndLogin(at, name+"_1")
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u1.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	u2, c2, err := test.CreateUserAndLogin(at, name+"_2")
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u2.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// Both users upload and download the skylink. The first one also uploads
+	// another skylink, which we won't purge.
+	sl := test.RandomSkylink()
+	other := test.RandomSkylink()
+	for _, c := range []*http.Cookie{c1, c2} {
+		at.SetCookie(c)
+		if s, err := at.TrackUpload(sl, ""); err != nil || s != http.StatusNoContent {
+			t.Fatal(s, err)
+		}
+		if s, err := at.TrackDownload(sl, 100); err != nil || s != http.StatusNoContent {
+			t.Fatal(s, err)
+		}
+	}
+	at.SetCookie(c1)
+	if s, err := at.TrackUpload(other, ""); err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	// Only admins can purge skylinks and they need to give a valid one.
+	_, s, err := at.AdminSkylinkDELETE("wrong key", sl)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	_, s, err = at.AdminSkylinkDELETE(adminKey, "INVALID_SKYLINK")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	_, s, err = at.AdminSkylinkDELETE(adminKey, test.RandomSkylink())
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+	res, s, err := at.AdminSkylinkDELETE(adminKey, sl)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if res.Skylink != sl || res.Uploads != 2 || res.Downloads != 2 {
+		t.Fatalf("Unexpected purge result %+v", res)
+	}
+
+	// The users' stats no longer include the skylink.
+	for i, c := range []*http.Cookie{c1, c2} {
+		at.SetCookie(c)
+		us, _, err := at.UserStats("", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedUploads := int64(0)
+		if i == 0 {
+			expectedUploads = 1
+		}
+		if us.NumUploads != expectedUploads || us.NumDownloads != 0 {
+			t.Fatalf("Expected %d uploads and no downloads, got %+v", expectedUploads, us)
+		}
+	}
+	// There is nothing left to purge and the skylink has no stats.
+	res, s, err = at.AdminSkylinkDELETE(adminKey, sl)
+	if err != nil || s != http.StatusOK || res.Uploads != 0 || res.Downloads != 0 {
+		t.Fatalf("Expected an empty purge, got %+v, %d and %v", res, s, err)
+	}
+	stats, _, err := at.AdminSkylinkStatsGET(adminKey, sl)
+	if err != nil || stats.Downloads != 0 {
+		t.Fatalf("Expected no downloads, got %+v and %v", stats, err)
+	}
+
+	// Purging a blocked skylink keeps it blocked.
+	_, s, err = at.AdminSkylinkBlockPOST(adminKey, other)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if _, s, err = at.AdminSkylinkDELETE(adminKey, other); err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	blocked, err := at.DB.SkylinkBlocked(at.Ctx, other)
+	if err != nil || !blocked {
+		t.Fatalf("Expected the skylink to stay blocked, got %t and %v", blocked, err)
+	}
+	s, err = at.TrackUpload(other, "")
+	if err == nil || s != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnavailableForLegalReasons, s, err)
+	}
+}
+
+// testAdminConfig ensures that operators can disable features at runtime via
+// the admin config endpoints and that changes made directly in the DB are
+// picked up once the cached values expire.
+func testAdminConfig(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	key := database.ConfValAPIKeyCreationDisabled
+	// Make sure the feature is enabled again when we're done.
+	defer func() {
+		err = at.DB.WriteConfigValue(at.Ctx, key, database.ConfValFalse)
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to restore the configuration in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Unknown keys and invalid values are rejected.
+	_, s, err := at.AdminConfigGET(adminKey, "no_such_key")
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+	_, s, err = at.AdminConfigPUT(adminKey, key, "yes")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Only admins can change the configuration.
+	_, s, err = at.AdminConfigPUT("wrong key", key, database.ConfValTrue)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+
+	// Disable the creation of API keys.
+	cv, s, err := at.AdminConfigPUT(adminKey, key, database.ConfValTrue)
+	if err != nil || s != http.StatusOK || cv.Value != database.ConfValTrue {
+		t.Fatalf("Expected %d and '%s', got %d, '%s' and %v", http.StatusOK, database.ConfValTrue, s, cv.Value, err)
+	}
+	cv, _, err = at.AdminConfigGET(adminKey, key)
+	if err != nil || cv.Key != key || cv.Value != database.ConfValTrue {
+		t.Fatalf("Expected '%s', got %+v and %v", database.ConfValTrue, cv, err)
+	}
+	_, s, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err == nil || s != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusServiceUnavailable, s, err)
+	}
+	if code := test.ErrorCode(err.Error()); code != api.ErrCodeFeatureDisabled {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeFeatureDisabled, code)
+	}
+	// Enable it again.
+	_, s, err = at.AdminConfigPUT(adminKey, key, database.ConfValFalse)
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+	_, s, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+
+	// Disable it directly in the DB, bypassing the cache. Expect the change
+	// to take effect once the cached value expires.
+	err = at.DB.WriteConfigValue(at.Ctx, key, database.ConfValTrue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(20, 100*time.Millisecond, func() error {
+		_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{})
+		if s != http.StatusServiceUnavailable {
+			return fmt.Errorf("expected %d, got %d", http.StatusServiceUnavailable, s)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRegistrationsDisabled ensures that disabling registrations rejects all
+// endpoints which register users or recover their accounts, as well as
+// password changes, and that enabling them again lifts the restriction.
+func testRegistrationsDisabled(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	password := name + "_pass"
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	defer at.ClearCredentials()
+	key := database.ConfValRegistrationsDisabled
+	// Make sure registrations are enabled again when we're done.
+	defer func() {
+		err = at.DB.WriteConfigValue(at.Ctx, key, database.ConfValFalse)
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to restore the configuration in defer"))
+		}
+	}()
+	_, pk := crypto.GenerateKeyPair()
+	// statuses returns the status of each affected endpoint.
+	statuses := func() map[string]int {
+		st := make(map[string]int)
+		_, st["GET /register"], _ = at.RegisterGET(pk[:])
+		_, st["POST /register"], _ = at.RegisterPOST(nil, nil, "")
+		r, _, _ := at.UserPOST("", "")
+		st["POST /user"] = r.StatusCode
+		_, st["PUT /user"], _ = at.UserPUT("", password+"_new", "")
+		st["POST /user/recover/request"], _ = at.UserRecoverRequestPOST("")
+		st["POST /user/recover"], _ = at.UserRecoverPOST("", "", "")
+		return st
+	}
+
+	// Disable registrations directly in the DB and force a refresh by waiting
+	// for the cached value to expire.
+	err = at.DB.WriteConfigValue(at.Ctx, key, database.ConfValTrue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(20, 100*time.Millisecond, func() error {
+		for ep, s := range statuses() {
+			if s != http.StatusNotImplemented {
+				return fmt.Errorf("expected %d for %s, got %d", http.StatusNotImplemented, ep, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enable them again. Expect the endpoints to process the requests, which
+	// fail for other reasons, except for the password change.
+	err = at.DB.WriteConfigValue(at.Ctx, key, database.ConfValFalse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(20, 100*time.Millisecond, func() error {
+		for ep, s := range statuses() {
+			if s == http.StatusNotImplemented {
+				return fmt.Errorf("expected %s to not return %d", ep, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = at.LoginCredentialsPOST(email.String(), password+"_new")
+	if err != nil {
+		t.Fatal("Expected the password change to go through.", err)
+	}
+}
+
+// testAdminStats ensures that `GET /admin/stats` reports the portal's users,
+// uploads and downloads, and that it caches its result.
+func testAdminStats(t *testing.T, at *test.AccountsTester) {
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+
+	// Only admins can see the portal stats.
+	_, s, err := at.AdminStatsGET("wrong key")
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+
+	// Get the stats before we add any data, bypassing the cache.
+	before, err := at.DB.PortalStats(at.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create two users. One of them uploads and downloads a skylink.
+	name := test.DBNameForTest(t.Name())
+	for i := 0; i < 2; i++ {
+		u, _, err := test.CreateUserAndLogin(at, fmt.Sprintf("%s_%d", name, i))
+		if err != nil {
+			t.Fatal("Failed to create a user and log in:", err)
+		}
+		defer func() {
+			if err = u.Delete(at.Ctx); err != nil {
+				t.Error(errors.AddContext(err, "failed to delete user in defer"))
+			}
+		}()
+		if i > 0 {
+			continue
+		}
+		sl, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *sl, 300, primitive.ObjectID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	at.ClearCredentials()
+
+	stats, s, err := at.AdminStatsGET(adminKey)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if stats.Users != before.Users+2 || stats.UsersByTier[database.TierFree] != before.UsersByTier[database.TierFree]+2 {
+		t.Fatalf("Expected two more free users than %+v, got %+v", before, stats)
+	}
+	if stats.NewUsers24h != before.NewUsers24h+2 || stats.NewUsers7d != before.NewUsers7d+2 || stats.NewUsers30d != before.NewUsers30d+2 {
+		t.Fatalf("Expected two more new users than %+v, got %+v", before, stats)
+	}
+	if stats.QuotaExceededUsers != before.QuotaExceededUsers {
+		t.Fatalf("Expected %d users over quota, got %d", before.QuotaExceededUsers, stats.QuotaExceededUsers)
+	}
+	if stats.Uploads != before.Uploads+1 || stats.UploadsSize != before.UploadsSize+1000 {
+		t.Fatalf("Expected one more upload of 1000 bytes than %+v, got %+v", before, stats)
+	}
+	if stats.Downloads != before.Downloads+1 || stats.DownloadsSize != before.DownloadsSize+300 {
+		t.Fatalf("Expected one more download of 300 bytes than %+v, got %+v", before, stats)
+	}
+	if stats.GeneratedAt.Before(before.GeneratedAt) {
+		t.Fatalf("Expected the stats to be generated after %v, got %v", before.GeneratedAt, stats.GeneratedAt)
+	}
+
+	// Add another user. We get the cached stats, so we don't see them.
+	u, _, err := test.CreateUserAndLogin(at, name+"_new")
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.ClearCredentials()
+	cached, s, err := at.AdminStatsGET(adminKey)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if !cached.GeneratedAt.Equal(stats.GeneratedAt) || cached.Users != stats.Users {
+		t.Fatalf("Expected the cached stats %+v, got %+v", stats, cached)
+	}
+}
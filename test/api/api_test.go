@@ -3,8 +3,11 @@ package api
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -12,12 +15,16 @@ import (
 
 	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/SkynetLabs/skynet-accounts/lib"
 	"github.com/SkynetLabs/skynet-accounts/test"
 	"github.com/SkynetLabs/skynet-accounts/test/dependencies"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.sia.tech/siad/build"
 
 	"gitlab.com/NebulousLabs/errors"
@@ -119,6 +126,26 @@ func TestUserTierCache(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// The limits tell the user why their speeds dropped. The skylink's size
+	// only counts once towards the storage, even though we tracked it twice.
+	storage := database.UserLimits[database.TierPremium20].Storage
+	expectedQuota := database.QuotaUsage{
+		StorageUsed:  storage + 1,
+		StorageLimit: storage,
+		UploadsCount: 2,
+		UploadsLimit: int64(database.UserLimits[database.TierPremium20].MaxNumberUploads),
+	}
+	if !ul.QuotaExceeded || ul.Quota == nil || *ul.Quota != expectedQuota {
+		t.Fatalf("Expected quota %+v, got %t and %+v", expectedQuota, ul.QuotaExceeded, ul.Quota)
+	}
+	// So does GET /user.
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ug.QuotaExceeded || ug.QuotaUsage == nil || *ug.QuotaUsage != expectedQuota {
+		t.Fatalf("Expected quota %+v, got %t and %+v", expectedQuota, ug.QuotaExceeded, ug.QuotaUsage)
+	}
 	// Delete the uploaded file, so the user's quota recovers.
 	// This call should invalidate the tier cache.
 	_, err = at.UploadsDELETE(sl.Skylink)
@@ -137,11 +164,489 @@ func TestUserTierCache(t *testing.T) {
 		if ul.TierName != database.UserLimits[database.TierPremium20].TierName {
 			return fmt.Errorf("expected tier name '%s', got '%s'", database.UserLimits[database.TierPremium20].TierName, ul.TierName)
 		}
+		if ul.QuotaExceeded || ul.Quota != nil {
+			return fmt.Errorf("expected no quota details, got %t and %+v", ul.QuotaExceeded, ul.Quota)
+		}
 		return nil
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	ug, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.QuotaExceeded || ug.QuotaUsage != nil {
+		t.Fatalf("Expected no quota details, got %t and %+v", ug.QuotaExceeded, ug.QuotaUsage)
+	}
+}
+
+// TestUserTierCacheQuotaAcrossInstances ensures that a change in the user's
+// QuotaExceeded flag made by one accounts instance is reflected by another
+// instance sharing the same DB, even though the latter has the user cached.
+func TestUserTierCacheQuotaAcrossInstances(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	dbName := test.DBNameForTest(t.Name())
+	at, err := test.NewAccountsTester(dbName, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errClose := at.Close(); errClose != nil {
+			t.Error(errors.AddContext(errClose, "failed to close account tester"))
+		}
+	}()
+	// The second instance shares the DB with the tester's instance.
+	instanceB, err := api.New(at.DB, nil, test.NewDiscardLogger(), nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	u.Tier = database.TierPremium20
+	err = at.DB.UserSave(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := test.ExtractCookie(r)
+	// Logging in updates the user, so we need a fresh copy before saving.
+	u.User, err = at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// limitsB fetches the user's limits from the second instance.
+	limitsB := func() (api.UserLimitsGET, error) {
+		req := httptest.NewRequest(http.MethodGet, "/user/limits?unit=byte", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		instanceB.ServeHTTP(rec, req)
+		var ul api.UserLimitsGET
+		err := json.NewDecoder(rec.Body).Decode(&ul)
+		return ul, err
+	}
+	// expectUploadBandwidth retries until the second instance reports the
+	// given upload bandwidth and fails if that takes too long.
+	expectUploadBandwidth := func(bw int) {
+		start := time.Now()
+		err := build.Retry(30, 100*time.Millisecond, func() error {
+			ul, err := limitsB()
+			if err != nil {
+				return err
+			}
+			if ul.UploadBandwidth != bw {
+				return fmt.Errorf("expected upload bandwidth %d, got %d", bw, ul.UploadBandwidth)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The testing quota TTL is 500ms, so we allow for a generous margin.
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("Expected the flag change to be picked up within 2s, took %v", elapsed)
+		}
+	}
+
+	// Populate the second instance's cache.
+	expectUploadBandwidth(database.UserLimits[database.TierPremium20].UploadBandwidth)
+	// Raise the flag in the DB, the same way another instance's
+	// checkUserQuotas would do it.
+	u.QuotaExceeded = true
+	err = at.DB.UserSave(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUploadBandwidth(database.UserLimits[database.TierAnonymous].UploadBandwidth)
+	// Lower the flag and expect the second instance to follow.
+	u.QuotaExceeded = false
+	err = at.DB.UserSave(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUploadBandwidth(database.UserLimits[database.TierPremium20].UploadBandwidth)
+}
+
+// TestQuotaSweep ensures that the quota sweep clears the QuotaExceeded flag of
+// users who no longer exceed their quota and invalidates their cache entries,
+// and that a dry run doesn't change anything.
+func TestQuotaSweep(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	dbName := test.DBNameForTest(t.Name())
+	at, err := test.NewAccountsTester(dbName, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errClose := at.Close(); errClose != nil {
+			t.Error(errors.AddContext(errClose, "failed to close account tester"))
+		}
+	}()
+	// We use a separate instance, so we can call its sweep directly.
+	server, err := api.New(at.DB, nil, test.NewDiscardLogger(), nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	// Flag a user without any uploads, e.g. one whose files were purged.
+	u.Tier = database.TierPremium20
+	u.QuotaExceeded = true
+	err = at.DB.UserSave(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := test.ExtractCookie(r)
+	uploadBandwidth := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/user/limits?unit=byte", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		var ul api.UserLimitsGET
+		err := json.NewDecoder(rec.Body).Decode(&ul)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ul.UploadBandwidth
+	}
+	// Populate the cache with the flag raised.
+	if bw := uploadBandwidth(); bw != database.UserLimits[database.TierAnonymous].UploadBandwidth {
+		t.Fatalf("Expected upload bandwidth %d, got %d", database.UserLimits[database.TierAnonymous].UploadBandwidth, bw)
+	}
+
+	// A dry run reports the change without making it.
+	checked, changed, err := server.SweepQuotas(at.Ctx, email.ServerLockID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked < 1 || changed < 1 {
+		t.Fatalf("Expected at least one checked and changed user, got %d and %d", checked, changed)
+	}
+	qe, err := at.DB.UserQuotaExceeded(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !qe {
+		t.Fatal("Expected the dry run to keep the flag raised.")
+	}
+
+	// A real sweep clears the flag and the cache, so the user's limits
+	// recover right away, rather than after the cached flag goes stale.
+	_, _, err = server.SweepQuotas(at.Ctx, email.ServerLockID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bw := uploadBandwidth(); bw != database.UserLimits[database.TierPremium20].UploadBandwidth {
+		t.Fatalf("Expected upload bandwidth %d, got %d", database.UserLimits[database.TierPremium20].UploadBandwidth, bw)
+	}
+	qe, err = at.DB.UserQuotaExceeded(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qe {
+		t.Fatal("Expected the sweep to clear the flag.")
+	}
+
+	// The sweep does nothing while another instance holds the lock.
+	ok, err := at.DB.LockAcquire(at.Ctx, "quota_sweep", "another instance", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Failed to acquire the lock: %t, %v", ok, err)
+	}
+	checked, _, err = server.SweepQuotas(at.Ctx, email.ServerLockID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 0 {
+		t.Fatalf("Expected no checked users, got %d", checked)
+	}
+	err = at.DB.LockRelease(at.Ctx, "quota_sweep", "another instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLoginRateLimit ensures that we rate limit login attempts and that the
+// limit resets after a while.
+func TestLoginRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	dbName := test.DBNameForTest(t.Name())
+	// Use the production dependencies, so rate limiting is enabled.
+	at, err := test.NewAccountsTester(dbName, "", &lib.ProductionDependencies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errClose := at.Close(); errClose != nil {
+			t.Error(errors.AddContext(errClose, "failed to close account tester"))
+		}
+	}()
+
+	emailAddr := types.NewEmail(dbName + "@siasky.net").String()
+	// Hammer the login endpoint until we get rate limited. The bucket refills
+	// gradually, so we might get a few more attempts than the limit.
+	var r *http.Response
+	attempts := 0
+	for ; attempts < 2*api.LoginRateLimit; attempts++ {
+		r, _, err = at.LoginCredentialsPOST(emailAddr, "wrong password")
+		if r.StatusCode == http.StatusTooManyRequests {
+			break
+		}
+		if r.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, r.StatusCode, err)
+		}
+	}
+	if r.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected to get rate limited after %d attempts.", attempts)
+	}
+	if attempts < api.LoginRateLimit {
+		t.Fatalf("Expected at least %d attempts before getting rate limited, got %d", api.LoginRateLimit, attempts)
+	}
+	retryAfter, err := strconv.Atoi(r.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 1 {
+		t.Fatalf("Expected a valid Retry-After header, got '%s'", r.Header.Get("Retry-After"))
+	}
+	// Wait for the limit to reset and try again.
+	time.Sleep(time.Duration(retryAfter) * time.Second)
+	r, _, err = at.LoginCredentialsPOST(emailAddr, "wrong password")
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d after the limit reset, got %d and %v", http.StatusUnauthorized, r.StatusCode, err)
+	}
+}
+
+// TestAnonymousTrackLimit ensures that we limit the number of anonymous
+// uploads we track per IP per hour and that authenticated callers are not
+// affected by the limit.
+func TestAnonymousTrackLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	// The limit is read when the API is created.
+	oldLimit := api.AnonymousHourlyUploadLimit
+	api.AnonymousHourlyUploadLimit = 3
+	defer func() { api.AnonymousHourlyUploadLimit = oldLimit }()
+	dbName := test.DBNameForTest(t.Name())
+	// Use the production dependencies, so the limit is enforced.
+	at, err := test.NewAccountsTester(dbName, "", &lib.ProductionDependencies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errClose := at.Close(); errClose != nil {
+			t.Error(errors.AddContext(errClose, "failed to close account tester"))
+		}
+	}()
+
+	limits, _, err := at.LimitsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.AnonymousHourlyUploadLimit != 3 {
+		t.Fatalf("Expected an anonymous upload limit of 3, got %d", limits.AnonymousHourlyUploadLimit)
+	}
+	ip := "1.2.3.4"
+	for i := 0; i < api.AnonymousHourlyUploadLimit; i++ {
+		status, err := at.TrackUpload(test.RandomSkylink(), ip)
+		if err != nil || status != http.StatusNoContent {
+			t.Fatalf("Expected %d, got %d and %v", http.StatusNoContent, status, err)
+		}
+	}
+	status, _ := at.TrackUpload(test.RandomSkylink(), ip)
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d, got %d", http.StatusTooManyRequests, status)
+	}
+	// Other IPs are not affected.
+	status, err = at.TrackUpload(test.RandomSkylink(), "5.6.7.8")
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNoContent, status, err)
+	}
+	// Authenticated callers bypass the limit.
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+	status, err = at.TrackUpload(test.RandomSkylink(), ip)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNoContent, status, err)
+	}
+}
+
+// TestHealthFullDBDown ensures that GET /health/full reports a degraded
+// service with a 503 when the DB connection is closed.
+func TestHealthFullDBDown(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAPI, err := api.New(db, nil, test.NewDiscardLogger(), nil, nil, "")
+	if err != nil {
+		t.Fatal("Failed to instantiate API.", err)
+	}
+	// Close the DB connection.
+	err = db.Disconnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/health/full", nil)
+	testAPI.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	var h api.HealthFullGET
+	err = json.Unmarshal(w.Body.Bytes(), &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Healthy || h.DB.Healthy || h.DB.Details == "" {
+		t.Fatalf("Expected an unhealthy DB, got %+v", h)
+	}
+	// This API runs neither an email sender nor a metafetcher.
+	if h.EmailSender.Healthy || h.MetaFetcher.Healthy {
+		t.Fatalf("Expected unhealthy background workers, got %+v", h)
+	}
+}
+
+// TestGracefulShutdown ensures that shutting down the server lets the
+// in-flight requests complete and refuses new ones.
+func TestGracefulShutdown(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	dbName := test.DBNameForTest(t.Name())
+	// This dependency makes `GET /limits` respond slowly.
+	at, err := test.NewAccountsTester(dbName, "", &test.DependencyLimitsDelay{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errClose := at.Close(); errClose != nil {
+			t.Error(errors.AddContext(errClose, "failed to close account tester"))
+		}
+	}()
+
+	// Issue a slow request.
+	type result struct {
+		status int
+		err    error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		_, s, err := at.LimitsGET()
+		resCh <- result{status: s, err: err}
+	}()
+	// Give the request time to reach the server and then shut it down.
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = at.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown waits for the request, so we expect it to complete rather
+	// than to have its connection reset.
+	select {
+	case res := <-resCh:
+		if res.err != nil || res.status != http.StatusOK {
+			t.Fatalf("Expected %d, got %d and %v", http.StatusOK, res.status, res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to have completed.")
+	}
+	// New requests are refused.
+	_, _, err = at.HealthGet()
+	if err == nil {
+		t.Fatal("Expected the server to refuse new requests.")
+	}
+}
+
+// TestRequestTimeout ensures that requests which run past the configured
+// timeout get a 504 within that time, even when the DB query is slow.
+func TestRequestTimeout(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	dbName := test.DBNameForTest(t.Name())
+	// This dependency makes the uploads aggregation stall until its context
+	// expires.
+	at, err := test.NewAccountsTester(dbName, "", &test.DependencyUploadsAggregationDelay{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errClose := at.Close(); errClose != nil {
+			t.Error(errors.AddContext(errClose, "failed to close account tester"))
+		}
+	}()
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+
+	timeout := time.Second
+	defer func(old time.Duration) { api.RequestTimeout = old }(api.RequestTimeout)
+	api.RequestTimeout = timeout
+
+	start := time.Now()
+	_, s, err := at.UserUploadsGET(nil)
+	if s != http.StatusGatewayTimeout || err == nil || !strings.Contains(err.Error(), api.ErrCodeRequestTimeout) {
+		t.Fatalf("Expected %d with code '%s', got %d and %v", http.StatusGatewayTimeout, api.ErrCodeRequestTimeout, s, err)
+	}
+	// We allow some leeway for the rest of the request's work.
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Fatalf("Expected a response within %v, got one after %v", timeout, elapsed)
+	}
 }
 
 // TestWithDBSession is a test suite that covers WithDBSession.
@@ -154,6 +659,7 @@ func TestWithDBSession(t *testing.T) {
 		"general":                               testWithDBSessionGeneral,
 		"retry WriteConflict with goroutines":   testWithDBSessionRetryOnWriteConflictGoroutines,
 		"retry WriteConflict repeated failures": testWithDBSessionRetryOnWriteConflictRepeatedFailures,
+		"emails queued with user updates":       testWithDBSessionEmailsQueuedWithUserUpdates,
 	}
 
 	for name, tt := range tests {
@@ -172,7 +678,7 @@ func testWithDBSessionGeneral(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	testAPI, err := api.New(db, nil, &logrus.Logger{}, nil, "")
+	testAPI, err := api.New(db, nil, &logrus.Logger{}, nil, nil, "")
 	if err != nil {
 		t.Fatal("Failed to instantiate API.", err)
 	}
@@ -301,7 +807,7 @@ func testWithDBSessionRetryOnWriteConflictGoroutines(t *testing.T) {
 	// Ensure WithDBSession works with requests without bodies.
 	// This is a regression test. It panics with a nil pointer if we cannot
 	// properly handle requests with nil bodies.
-	testAPI, err := api.New(at.DB, nil, at.Logger, nil, "")
+	testAPI, err := api.New(at.DB, nil, at.Logger, nil, nil, "")
 	if err != nil {
 		t.Fatal("Failed to instantiate API.", err)
 	}
@@ -405,3 +911,113 @@ func testWithDBSessionRetryOnWriteConflictRepeatedFailures(t *testing.T) {
 		t.Fatalf("Expected to log in successfully, got %d '%v'", r.StatusCode, err)
 	}
 }
+
+// testWithDBSessionEmailsQueuedWithUserUpdates ensures that the user updates
+// which issue a token and the emails which deliver that token are committed or
+// aborted together.
+func testWithDBSessionEmailsQueuedWithUserUpdates(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	dbName := test.DBNameForTest(t.Name())
+	dep := dependencies.NewDependencyEmailCreateWriteConflictN()
+	at, err := test.NewAccountsTester(dbName, "", dep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errClose := at.Close(); errClose != nil {
+			t.Error(errors.AddContext(errClose, "failed to close account tester"))
+		}
+	}()
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	// countEmails returns the number of emails with the given subject queued
+	// for the given address.
+	countEmails := func(to types.Email, subject string) int {
+		filter := bson.M{"to": to.String(), "subject": subject}
+		_, msgs, err := at.DB.FindEmails(at.Ctx, filter, &options.FindOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(msgs)
+	}
+	const confirmSubject = "Please verify your email address"
+	const recoverSubject = "Recover access to your account"
+
+	// Change the user's email while queueing emails fails more times than we
+	// retry. Expect the change to be rolled back.
+	at.SetCookie(c)
+	newEmail := types.NewEmail(test.DBNameForTest(t.Name()) + "_new@siasky.net")
+	dep.SetFailures(api.DBTxnRetryCount + 1)
+	_, _, err = at.UserPUT(newEmail.String(), "", "")
+	if err == nil || !strings.Contains(err.Error(), dependencies.DependencyMongoWriteConflictNMessage) {
+		t.Fatalf("Expected a '%s' error, got '%v'", dependencies.DependencyMongoWriteConflictNMessage, err)
+	}
+	du, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if du.PendingEmail != "" || du.PendingEmailToken != "" {
+		t.Fatalf("Expected no pending email change, got '%s'", du.PendingEmail)
+	}
+	if n := countEmails(newEmail, confirmSubject); n != 0 {
+		t.Fatalf("Expected no confirmation emails, got %d", n)
+	}
+	// Try again. Expect both the change and the email to be committed.
+	_, _, err = at.UserPUT(newEmail.String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	du, err = at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if du.PendingEmail != newEmail || du.PendingEmailToken == "" {
+		t.Fatalf("Expected a pending email change to '%s', got '%s'", newEmail, du.PendingEmail)
+	}
+	if n := countEmails(newEmail, confirmSubject); n != 1 {
+		t.Fatalf("Expected one confirmation email, got %d", n)
+	}
+
+	// Request an account recovery while queueing emails fails more times than
+	// we retry. Expect no recovery token to be issued.
+	at.ClearCredentials()
+	dep.SetFailures(api.DBTxnRetryCount + 1)
+	status, err := at.UserRecoverRequestPOST(du.Email.String())
+	if err == nil || status != http.StatusInternalServerError {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusInternalServerError, status, err)
+	}
+	tokens, err := at.DB.RecoveryTokensByUser(at.Ctx, *du)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatal("Expected no recovery token.")
+	}
+	if n := countEmails(du.Email, recoverSubject); n != 0 {
+		t.Fatalf("Expected no recovery emails, got %d", n)
+	}
+	// Try again. Expect both the token and the email to be committed.
+	_, err = at.UserRecoverRequestPOST(du.Email.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err = at.DB.RecoveryTokensByUser(at.Ctx, *du)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Fatal("Expected a recovery token.")
+	}
+	if n := countEmails(du.Email, recoverSubject); n != 1 {
+		t.Fatalf("Expected one recovery email, got %d", n)
+	}
+}
@@ -1,15 +1,23 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"github.com/SkynetLabs/skynet-accounts/test"
 	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.sia.tech/siad/modules"
 )
 
@@ -29,7 +37,7 @@ func testPrivateAPIKeysFlow(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err, string(body))
 	}
-	if len(aks) > 0 {
+	if len(aks.Items) > 0 {
 		t.Fatalf("Expected an empty list of API keys, got %+v.", aks)
 	}
 
@@ -57,16 +65,16 @@ func testPrivateAPIKeysFlow(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err, string(body))
 	}
-	if len(aks) != 2 {
+	if len(aks.Items) != 2 {
 		t.Fatalf("Expected two API keys, got %+v.", aks)
 	}
-	if ak1.ID.Hex() != aks[0].ID.Hex() && ak1.ID.Hex() != aks[1].ID.Hex() {
+	if ak1.ID.Hex() != aks.Items[0].ID.Hex() && ak1.ID.Hex() != aks.Items[1].ID.Hex() {
 		t.Fatalf("Missing key '%s'! Set: %+v", ak1.ID.Hex(), aks)
 	}
-	if ak2.ID.Hex() != aks[0].ID.Hex() && ak2.ID.Hex() != aks[1].ID.Hex() {
+	if ak2.ID.Hex() != aks.Items[0].ID.Hex() && ak2.ID.Hex() != aks.Items[1].ID.Hex() {
 		t.Fatalf("Missing key '%s'! Set: %+v", ak2.ID.Hex(), aks)
 	}
-	if aks[0].Name != "one" && aks[1].Name != "one" {
+	if aks.Items[0].Name != "one" && aks.Items[1].Name != "one" {
 		t.Fatalf("Expected one of the two keys to be named 'one', got %+v", aks)
 	}
 
@@ -80,10 +88,10 @@ func testPrivateAPIKeysFlow(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err, string(body))
 	}
-	if len(aks) != 1 {
+	if len(aks.Items) != 1 {
 		t.Fatalf("Expected one API key, got %+v.", aks)
 	}
-	if ak2.ID.Hex() != aks[0].ID.Hex() {
+	if ak2.ID.Hex() != aks.Items[0].ID.Hex() {
 		t.Fatalf("Missing key '%s'! Set: %+v", ak2.ID.Hex(), aks)
 	}
 
@@ -155,7 +163,7 @@ func testPublicAPIKeysFlow(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(aks) > 0 {
+	if len(aks.Items) > 0 {
 		t.Fatalf("Expected an empty list of API keys, got %+v.", aks)
 	}
 	// Create a public API key.
@@ -172,11 +180,11 @@ func testPublicAPIKeysFlow(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(aks) != 1 {
-		t.Fatalf("Expected one API key, got %d.", len(aks))
+	if len(aks.Items) != 1 {
+		t.Fatalf("Expected one API key, got %d.", len(aks.Items))
 	}
-	if aks[0].Skylinks[0] != sl1 {
-		t.Fatal("Unexpected skylinks list", aks[0].Skylinks)
+	if aks.Items[0].Skylinks[0] != sl1 {
+		t.Fatal("Unexpected skylinks list", aks.Items[0].Skylinks)
 	}
 	// Update a public API key. Expect to go from sl1 to sl2.
 	s, err = at.UserAPIKeysPUT(akr.ID, api.APIKeyPUT{Skylinks: []string{sl2}})
@@ -189,27 +197,30 @@ func testPublicAPIKeysFlow(t *testing.T, at *test.AccountsTester) {
 		t.Fatal(err, string(body))
 	}
 	if akr1.Skylinks[0] != sl2 {
-		t.Fatal("Unexpected skylinks list", aks[0].Skylinks)
+		t.Fatal("Unexpected skylinks list", aks.Items[0].Skylinks)
 	}
 	// Patch a public API key. Expect to go from sl2 to sl1.
 	akPatch := api.APIKeyPATCH{
 		Add:    []string{sl1},
 		Remove: []string{sl2},
 	}
-	s, err = at.UserAPIKeysPATCH(akr.ID, akPatch)
-	if err != nil {
-		t.Fatal(err)
+	patched, s, err := at.UserAPIKeysPATCH(akr.ID, akPatch)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if len(patched.Skylinks) != 1 || patched.Skylinks[0] != sl1 {
+		t.Fatal("Unexpected skylinks list", patched.Skylinks)
 	}
 	// List and verify the change.
 	aks, _, err = at.UserAPIKeysLIST()
 	if err != nil {
 		t.Fatal(err, string(body))
 	}
-	if len(aks) != 1 {
-		t.Fatalf("Expected one API key, got %d.", len(aks))
+	if len(aks.Items) != 1 {
+		t.Fatalf("Expected one API key, got %d.", len(aks.Items))
 	}
-	if aks[0].Skylinks[0] != sl1 {
-		t.Fatal("Unexpected skylinks list", aks[0].Skylinks)
+	if aks.Items[0].Skylinks[0] != sl1 {
+		t.Fatal("Unexpected skylinks list", aks.Items[0].Skylinks)
 	}
 	// Delete a public API key.
 	status, err := at.UserAPIKeysDELETE(akr.ID)
@@ -221,8 +232,8 @@ func testPublicAPIKeysFlow(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err, string(body))
 	}
-	if len(aks) != 0 {
-		t.Fatalf("Expected no API keys, got %d.", len(aks))
+	if len(aks.Items) != 0 {
+		t.Fatalf("Expected no API keys, got %d.", len(aks.Items))
 	}
 	// Delete the same key again. Expect a 404.
 	status, err = at.UserAPIKeysDELETE(akr.ID)
@@ -315,6 +326,99 @@ func testPublicAPIKeysUsage(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testUserLimitsBatch ensures that the batch limits endpoint resolves the
+// limits of each skylink separately, based on the API key's coverage.
+func testUserLimitsBatch(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	at.SetCookie(c)
+	// Create three uploads and a public API key which covers two of them.
+	var sls []string
+	for i := 0; i < 3; i++ {
+		sl, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, int64(fastrand.Intn(int(modules.SectorSize/2))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sls = append(sls, sl.Skylink)
+	}
+	pak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Public: true, Skylinks: sls[:2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.ClearCredentials()
+
+	invalid := "not a skylink"
+	headers := map[string]string{api.APIKeyHeader: pak.Key.String()}
+	ul, s, err := at.UserLimitsBatchPOST(append(sls, invalid), "byte", headers)
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+	if len(ul) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(ul))
+	}
+	expected := []int{database.TierFree, database.TierFree, database.TierAnonymous}
+	for i, sl := range sls {
+		e, ok := ul[sl]
+		if !ok || e.UserLimitsGET == nil || e.Error != "" {
+			t.Fatalf("Unexpected entry for skylink %d: %+v", i, e)
+		}
+		if e.TierID != expected[i] || e.DownloadBandwidth != database.UserLimits[expected[i]].DownloadBandwidth {
+			t.Fatalf("Expected tier %d for skylink %d, got %+v", expected[i], i, e.UserLimitsGET)
+		}
+	}
+	if e := ul[invalid]; e.UserLimitsGET != nil || e.Error != database.ErrInvalidSkylink.Error() {
+		t.Fatalf("Expected an error for the invalid skylink, got %+v", e)
+	}
+	// The second call is served from the cache and yields the same results.
+	ul2, _, err := at.UserLimitsBatchPOST(sls, "byte", headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sl := range sls {
+		if ul2[sl].TierID != expected[i] {
+			t.Fatalf("Expected tier %d for skylink %d, got %d", expected[i], i, ul2[sl].TierID)
+		}
+	}
+	// Blocked skylinks get the anonymous limits, even if the API key covers
+	// them.
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	if _, s, err = at.AdminSkylinkBlockPOST(adminKey, sls[0]); err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	ul2, _, err = at.UserLimitsBatchPOST(sls, "byte", headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul2[sls[0]].TierID != database.TierAnonymous || ul2[sls[1]].TierID != database.TierFree {
+		t.Fatalf("Expected tiers %d and %d, got %+v", database.TierAnonymous, database.TierFree, ul2)
+	}
+	// Without an API key all skylinks get the anonymous limits.
+	ul, _, err = at.UserLimitsBatchPOST(sls, "byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sl := range sls {
+		if ul[sl].TierID != database.TierAnonymous {
+			t.Fatalf("Expected tier %d for skylink %d, got %d", database.TierAnonymous, i, ul[sl].TierID)
+		}
+	}
+	// Too many skylinks.
+	_, s, err = at.UserLimitsBatchPOST(make([]string, api.MaxBatchLimitsSkylinks+1), "byte", headers)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+}
+
 // testPublicAPIKeysUsage makes sure that we can use public API keys to make
 // GET requests to covered skylinks and that we cannot use them for other
 // requests.
@@ -349,7 +453,6 @@ func testAPIKeysAcceptance(t *testing.T, at *test.AccountsTester) {
 		{verb: http.MethodDelete, endpoint: "/user/pubkey/somePubKey"},
 		{verb: http.MethodGet, endpoint: "/user/pubkey/register"},
 		{verb: http.MethodPost, endpoint: "/user/pubkey/register"},
-		{verb: http.MethodGet, endpoint: "/user/uploads"},
 		{verb: http.MethodDelete, endpoint: "/user/uploads/someSkylink"},
 		{verb: http.MethodGet, endpoint: "/user/downloads"},
 		{verb: http.MethodPost, endpoint: "/user/reconfirm"},
@@ -378,6 +481,7 @@ func testAPIKeysAcceptance(t *testing.T, at *test.AccountsTester) {
 		{verb: http.MethodPut, endpoint: "/user/apikeys/someId"},
 		{verb: http.MethodPatch, endpoint: "/user/apikeys/someId"},
 		{verb: http.MethodDelete, endpoint: "/user/apikeys/someId"},
+		{verb: http.MethodGet, endpoint: "/user/uploads"},
 	}
 
 	for _, tt := range tests {
@@ -387,3 +491,762 @@ func testAPIKeysAcceptance(t *testing.T, at *test.AccountsTester) {
 		}
 	}
 }
+
+// testAPIKeysScope makes sure that read-only API keys can be used for reading
+// data but not for modifying it.
+func testAPIKeysScope(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	// Create a test user.
+	email := types.NewEmail(name + "@siasky.net")
+	r, _, err := at.UserPOST(email.String(), name+"_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	u, err := at.DB.UserByEmail(at.Ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(at.Ctx, at.DB, *u, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Try to create an API key with an invalid scope.
+	_, status, err := at.UserAPIKeysPOST(api.APIKeyPOST{Scope: "write"})
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	// Create a private API key without specifying a scope. Expect it to have
+	// full access.
+	fullAK, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fullAK.Scope != database.APIKeyScopeFull {
+		t.Fatalf("Expected scope '%s', got '%s'", database.APIKeyScopeFull, fullAK.Scope)
+	}
+	// Create a read-only API key.
+	readAK, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Scope: database.APIKeyScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readAK.Scope != database.APIKeyScopeRead {
+		t.Fatalf("Expected scope '%s', got '%s'", database.APIKeyScopeRead, readAK.Scope)
+	}
+	// Make sure the scope is reported when listing the keys.
+	akr, _, err := at.UserAPIKeysGET(readAK.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr.Scope != database.APIKeyScopeRead {
+		t.Fatalf("Expected scope '%s', got '%s'", database.APIKeyScopeRead, akr.Scope)
+	}
+
+	// Use the read-only key to list the user's uploads.
+	at.SetAPIKey(readAK.Key.String())
+	ups, status, err := at.UserUploadsGET(nil)
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+	if len(ups.Items) != 1 {
+		t.Fatalf("Expected one upload, got %d", len(ups.Items))
+	}
+	// Make sure we can't use it to modify the user.
+	_, status, err = at.UserPUT("", "", name+"_stripe_id")
+	if err == nil || status != http.StatusForbidden || !strings.Contains(err.Error(), api.ErrAPIKeyReadOnly.Error()) {
+		t.Fatalf("Expected error '%s' with status %d, got '%v' with status %d", api.ErrAPIKeyReadOnly, http.StatusForbidden, err, status)
+	}
+	// Make sure we can't use it to create new API keys.
+	_, status, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err == nil || status != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d and error %v", http.StatusForbidden, status, err)
+	}
+	// Make sure we can't use it to delete API keys.
+	status, err = at.UserAPIKeysDELETE(fullAK.ID)
+	if err == nil || status != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d and error %v", http.StatusForbidden, status, err)
+	}
+
+	// The full access key should still be able to create new API keys.
+	at.SetAPIKey(fullAK.Key.String())
+	_, _, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testAPIKeysExpiry ensures that expired API keys stop working and that their
+// expiration dates can be changed.
+func testAPIKeysExpiry(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Try to create an API key which has already expired.
+	past := time.Now().Add(-time.Minute)
+	_, status, err := at.UserAPIKeysPOST(api.APIKeyPOST{ExpiresAt: &past})
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	// Create an API key which expires in a second.
+	expiresAt := time.Now().Add(time.Second)
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ak.ExpiresAt == nil || ak.Expired {
+		t.Fatalf("Unexpected expiration %v, expired %t", ak.ExpiresAt, ak.Expired)
+	}
+	headers := map[string]string{api.APIKeyHeader: ak.Key.String()}
+	// Use it.
+	at.ClearCredentials()
+	at.SetAPIKey(ak.Key.String())
+	_, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, _, err := at.UserLimits("byte", headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl.Sub != u.Sub {
+		t.Fatalf("Expected user sub '%s', got '%s'", u.Sub, tl.Sub)
+	}
+	// Wait for it to expire and make sure it stops working.
+	time.Sleep(time.Until(expiresAt) + 100*time.Millisecond)
+	_, status, err = at.UserGET()
+	if err == nil || status != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusUnauthorized, status, err)
+	}
+	at.ClearCredentials()
+	tl, _, err = at.UserLimits("byte", headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, tl.TierID)
+	}
+	// Its owner still sees it.
+	at.SetCookie(c)
+	akr, _, err := at.UserAPIKeysGET(ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !akr.Expired {
+		t.Fatal("Expected the API key to be marked as expired.")
+	}
+	// Extend it via PATCH.
+	future := time.Now().Add(time.Hour)
+	_, _, err = at.UserAPIKeysPATCH(ak.ID, api.APIKeyPATCH{ExpiresAt: &future, RemoveExpiry: true})
+	if err == nil {
+		t.Fatal("Expected to fail to both set and remove the expiration date.")
+	}
+	_, _, err = at.UserAPIKeysPATCH(ak.ID, api.APIKeyPATCH{ExpiresAt: &future})
+	if err != nil {
+		t.Fatal(err)
+	}
+	akr, _, err = at.UserAPIKeysGET(ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr.Expired || akr.ExpiresAt == nil || !akr.ExpiresAt.Equal(future.Truncate(time.Millisecond)) {
+		t.Fatalf("Unexpected expiration %v, expired %t", akr.ExpiresAt, akr.Expired)
+	}
+	at.ClearCredentials()
+	at.SetAPIKey(ak.Key.String())
+	if _, _, err = at.UserGET(); err != nil {
+		t.Fatal(err)
+	}
+	// Clear the expiration date via PUT.
+	at.ClearCredentials()
+	at.SetCookie(c)
+	_, err = at.UserAPIKeysPUT(ak.ID, api.APIKeyPUT{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	akr, _, err = at.UserAPIKeysGET(ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr.Expired || akr.ExpiresAt != nil {
+		t.Fatalf("Unexpected expiration %v, expired %t", akr.ExpiresAt, akr.Expired)
+	}
+	// Private API keys can't get skylinks via PUT.
+	_, err = at.UserAPIKeysPUT(ak.ID, api.APIKeyPUT{Skylinks: []string{test.RandomSkylink()}})
+	if err == nil {
+		t.Fatal("Expected to fail to set skylinks on a private API key.")
+	}
+}
+
+// testPublicAPIKeysTiers ensures that only users on the configured tiers can
+// create public API keys and that the keys of users who were downgraded to a
+// tier which is not allowed are marked as grandfathered.
+func testPublicAPIKeysTiers(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	sl := "AQAh2vxStoSJ_M9tWcTgqebUWerCAbpMfn9xxa9E29UOuw"
+	publicAKPOST := api.APIKeyPOST{
+		Public:   true,
+		Skylinks: []string{sl},
+	}
+
+	// Allow only paid tiers to create public API keys. Make sure we clean up
+	// after ourselves, so we don't affect other tests.
+	paidTiers := fmt.Sprintf("%d,%d,%d", database.TierPremium5, database.TierPremium20, database.TierPremium80)
+	err := at.DB.WriteConfigValue(at.Ctx, database.ConfValPublicAPIKeyTiers, paidTiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err = at.DB.WriteConfigValue(at.Ctx, database.ConfValPublicAPIKeyTiers, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	gfBefore, _, err := at.APIKeysGrandfatheredGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a free user and try to create a public API key. Expect this to
+	// fail with a 403. Creating a private API key should still work.
+	free, c, err := test.CreateUserAndLogin(at, name+"_free")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = free.Delete(at.Ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	at.SetCookie(c)
+	_, s, err := at.UserAPIKeysPOST(publicAKPOST)
+	if err == nil || s != http.StatusForbidden || !strings.Contains(err.Error(), api.ErrTierNotAllowed.Error()) {
+		t.Fatalf("Expected error '%s' and status %d, got '%v' and %d", api.ErrTierNotAllowed, http.StatusForbidden, err, s)
+	}
+	_, _, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A trial of a paid tier counts the same as the paid tier itself.
+	err = at.DB.UserSetTrial(at.Ctx, free.User, database.TierPremium5, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = at.UserAPIKeysPOST(publicAKPOST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key isn't grandfathered while the trial lasts.
+	gf, _, err := at.APIKeysGrandfatheredGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gf.Count != gfBefore.Count {
+		t.Fatalf("Expected %d grandfathered keys, got %d", gfBefore.Count, gf.Count)
+	}
+
+	// Create a paid user and create a public API key. Expect this to succeed.
+	paid, c, err := test.CreateUserAndLogin(at, name+"_paid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = paid.Delete(at.Ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	err = at.DB.UserSetTier(at.Ctx, paid.User, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	akr, _, err := at.UserAPIKeysPOST(publicAKPOST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aks, _, err := at.UserAPIKeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aks.Items) != 1 || aks.Items[0].ID.Hex() != akr.ID.Hex() || aks.Items[0].Grandfathered {
+		t.Fatalf("Expected a single non-grandfathered key, got %+v", aks)
+	}
+
+	// Downgrade the paid user to the free tier. Expect their public API key to
+	// be marked as grandfathered and counted in the report.
+	err = at.DB.UserSetTier(at.Ctx, paid.User, database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aks, _, err = at.UserAPIKeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aks.Items) != 1 || !aks.Items[0].Grandfathered {
+		t.Fatalf("Expected a single grandfathered key, got %+v", aks)
+	}
+	ak, _, err := at.UserAPIKeysGET(akr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ak.Grandfathered {
+		t.Fatal("Expected the key to be grandfathered.")
+	}
+	gf, _, err = at.APIKeysGrandfatheredGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gf.Count != gfBefore.Count+1 {
+		t.Fatalf("Expected %d grandfathered keys, got %d", gfBefore.Count+1, gf.Count)
+	}
+	// The grandfathered key should continue to work.
+	at.SetAPIKey(akr.Key.String())
+	ul, _, err := at.UserLimitsSkylink(sl, "byte", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.Sub != paid.Sub {
+		t.Fatalf("Expected the limits of user '%s', got '%s'", paid.Sub, ul.Sub)
+	}
+}
+
+// testAPIKeyUsageStats ensures that uploads and downloads are attributed to
+// the API key which was used to track them.
+func testAPIKeyUsageStats(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	r, _, err := at.UserPOST(email.String(), name+"_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := test.ExtractCookie(r)
+	at.SetCookie(c)
+	ak1, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Name: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak2, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Name: "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys without any usage report zeros.
+	usage, _, err := at.UserAPIKeysUsageGET(ak1.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Uploads.Count != 0 || usage.Downloads.Count != 0 {
+		t.Fatalf("Expected no usage, got %+v", usage)
+	}
+
+	// Track two uploads and a download with the first key.
+	at.SetAPIKey(ak1.Key.String())
+	for i := 0; i < 2; i++ {
+		_, err = at.TrackUpload(test.RandomSkylink(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	downloadSize := int64(1 << 20)
+	_, err = at.TrackDownload(test.RandomSkylink(), downloadSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Track a single upload with the second key.
+	at.SetAPIKey(ak2.Key.String())
+	_, err = at.TrackUpload(test.RandomSkylink(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Track an upload and a download with the cookie. Those shouldn't be
+	// attributed to any key.
+	at.SetCookie(c)
+	_, err = at.TrackUpload(test.RandomSkylink(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.TrackDownload(test.RandomSkylink(), downloadSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, _, err = at.UserAPIKeysUsageGET(ak1.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Uploads.Count != 2 {
+		t.Fatalf("Expected 2 uploads, got %d", usage.Uploads.Count)
+	}
+	if usage.Downloads.Count != 1 {
+		t.Fatalf("Expected 1 download, got %d", usage.Downloads.Count)
+	}
+	if usage.Downloads.Bandwidth != skynet.BandwidthDownloadCost(downloadSize) {
+		t.Fatalf("Expected download bandwidth %d, got %d", skynet.BandwidthDownloadCost(downloadSize), usage.Downloads.Bandwidth)
+	}
+	usage, _, err = at.UserAPIKeysUsageGET(ak2.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Uploads.Count != 1 || usage.Downloads.Count != 0 {
+		t.Fatalf("Expected 1 upload and no downloads, got %+v", usage)
+	}
+	// The usage of a key can be checked with the key itself.
+	at.SetAPIKey(ak2.Key.String())
+	_, _, err = at.UserAPIKeysUsageGET(ak2.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid and non-existent keys.
+	at.SetCookie(c)
+	_, status, err := at.UserAPIKeysUsageGET(primitive.ObjectID{})
+	if err == nil || status != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d and error %v", http.StatusNotFound, status, err)
+	}
+	_, status, err = at.UserAPIKeysUsageGET(primitive.NewObjectID())
+	if err == nil || status != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d and error %v", http.StatusNotFound, status, err)
+	}
+}
+
+// testAPIKeysRotate ensures that rotating an API key replaces its secret while
+// keeping its ID and its covered skylinks, and that the old secret stops
+// working immediately.
+func testAPIKeysRotate(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	sl := test.RandomSkylink()
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Public: true, Skylinks: []string{sl}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use the key, so its limits get cached.
+	at.ClearCredentials()
+	freeBW := database.UserLimits[database.TierFree].DownloadBandwidth
+	anonBW := database.UserLimits[database.TierAnonymous].DownloadBandwidth
+	ul, _, err := at.UserLimitsSkylink(sl, "byte", ak.Key.String(), nil)
+	if err != nil || ul.DownloadBandwidth != freeBW {
+		t.Fatalf("Expected download bandwidth of %d, got %+v and %v", freeBW, ul, err)
+	}
+
+	// Only the owner can rotate an API key.
+	at.SetCookie(c)
+	_, s, err := at.UserAPIKeysRotatePOST(primitive.NewObjectID())
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+	rotated, s, err := at.UserAPIKeysRotatePOST(ak.ID)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if rotated.ID != ak.ID || !rotated.Public || !reflect.DeepEqual(rotated.Skylinks, ak.Skylinks) {
+		t.Fatalf("Expected the same API key, got %+v", rotated)
+	}
+	if rotated.Key == ak.Key || !rotated.Key.IsValid() {
+		t.Fatalf("Expected a new valid secret, got '%s'", rotated.Key)
+	}
+	if rotated.RotatedAt == nil || rotated.RotatedAt.Before(ak.CreatedAt) {
+		t.Fatalf("Unexpected rotation time %v", rotated.RotatedAt)
+	}
+
+	// The old secret no longer grants the user's limits, the new one does.
+	at.ClearCredentials()
+	ul, _, err = at.UserLimitsSkylink(sl, "byte", ak.Key.String(), nil)
+	if err != nil || ul.DownloadBandwidth != anonBW {
+		t.Fatalf("Expected download bandwidth of %d, got %+v and %v", anonBW, ul, err)
+	}
+	ul, _, err = at.UserLimitsSkylink(sl, "byte", rotated.Key.String(), nil)
+	if err != nil || ul.DownloadBandwidth != freeBW {
+		t.Fatalf("Expected download bandwidth of %d, got %+v and %v", freeBW, ul, err)
+	}
+	// Fetching the API key shows the rotation but not the secret.
+	at.SetCookie(c)
+	akGET, _, err := at.UserAPIKeysGET(ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akGET.ID != ak.ID || !reflect.DeepEqual(akGET.Skylinks, ak.Skylinks) || akGET.RotatedAt == nil {
+		t.Fatalf("Unexpected API key %+v", akGET)
+	}
+}
+
+// testAPIKeysPatch ensures that concurrent patches of a public API key's
+// skylinks are merged, that removed skylinks stop being covered immediately,
+// and that the number of covered skylinks is limited.
+func testAPIKeysPatch(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	sl1, sl2, sl3 := test.RandomSkylink(), test.RandomSkylink(), test.RandomSkylink()
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Public: true, Skylinks: []string{sl1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use the key, so its limits get cached.
+	at.ClearCredentials()
+	freeBW := database.UserLimits[database.TierFree].DownloadBandwidth
+	anonBW := database.UserLimits[database.TierAnonymous].DownloadBandwidth
+	ul, _, err := at.UserLimitsSkylink(sl1, "byte", ak.Key.String(), nil)
+	if err != nil || ul.DownloadBandwidth != freeBW {
+		t.Fatalf("Expected download bandwidth of %d, got %+v and %v", freeBW, ul, err)
+	}
+
+	// Add two skylinks concurrently. Both need to end up in the list.
+	at.SetCookie(c)
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, sl := range []string{sl2, sl3} {
+		wg.Add(1)
+		go func(i int, sl string) {
+			defer wg.Done()
+			_, _, errs[i] = at.UserAPIKeysPATCH(ak.ID, api.APIKeyPATCH{Add: []string{sl}})
+		}(i, sl)
+	}
+	wg.Wait()
+	if err = errors.Compose(errs...); err != nil {
+		t.Fatal(err)
+	}
+	akr, _, err := at.UserAPIKeysGET(ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(akr.Skylinks) != 3 || akr.Skylinks[0] != sl1 {
+		t.Fatalf("Expected three skylinks, starting with '%s', got %v", sl1, akr.Skylinks)
+	}
+	if !(akr.Skylinks[1] == sl2 && akr.Skylinks[2] == sl3) && !(akr.Skylinks[1] == sl3 && akr.Skylinks[2] == sl2) {
+		t.Fatalf("Expected skylinks '%s' and '%s' to be added, got %v", sl2, sl3, akr.Skylinks)
+	}
+
+	// Remove a skylink. We get the resulting list and the key stops covering
+	// the skylink right away.
+	patched, s, err := at.UserAPIKeysPATCH(ak.ID, api.APIKeyPATCH{Remove: []string{sl1}})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if len(patched.Skylinks) != 2 || patched.Skylinks[0] == sl1 || patched.Skylinks[1] == sl1 {
+		t.Fatalf("Expected two skylinks without '%s', got %v", sl1, patched.Skylinks)
+	}
+	at.ClearCredentials()
+	ul, _, err = at.UserLimitsSkylink(sl1, "byte", ak.Key.String(), nil)
+	if err != nil || ul.DownloadBandwidth != anonBW {
+		t.Fatalf("Expected download bandwidth of %d, got %+v and %v", anonBW, ul, err)
+	}
+
+	// Replacing the list with a PUT also stops covering the dropped skylinks
+	// right away.
+	ul, _, err = at.UserLimitsSkylink(sl2, "byte", ak.Key.String(), nil)
+	if err != nil || ul.DownloadBandwidth != freeBW {
+		t.Fatalf("Expected download bandwidth of %d, got %+v and %v", freeBW, ul, err)
+	}
+	at.SetCookie(c)
+	_, err = at.UserAPIKeysPUT(ak.ID, api.APIKeyPUT{Skylinks: []string{sl3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.ClearCredentials()
+	ul, _, err = at.UserLimitsSkylink(sl2, "byte", ak.Key.String(), nil)
+	if err != nil || ul.DownloadBandwidth != anonBW {
+		t.Fatalf("Expected download bandwidth of %d, got %+v and %v", anonBW, ul, err)
+	}
+	// Restore the list.
+	at.SetCookie(c)
+	_, err = at.UserAPIKeysPUT(ak.ID, api.APIKeyPUT{Skylinks: []string{sl3, sl2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid skylinks and patches which exceed the limit are rejected.
+	_, s, err = at.UserAPIKeysPATCH(ak.ID, api.APIKeyPATCH{Add: []string{"INVALID_SKYLINK"}})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	maxSkylinks := database.MaxNumSkylinksPerAPIKey
+	database.MaxNumSkylinksPerAPIKey = 2
+	defer func() { database.MaxNumSkylinksPerAPIKey = maxSkylinks }()
+	_, s, err = at.UserAPIKeysPATCH(ak.ID, api.APIKeyPATCH{Add: []string{sl1}})
+	if err == nil || s != http.StatusBadRequest || !strings.Contains(err.Error(), database.ErrMaxNumSkylinksExceeded.Error()) {
+		t.Fatalf("Expected %d '%s', got %d and %v", http.StatusBadRequest, database.ErrMaxNumSkylinksExceeded, s, err)
+	}
+	// Swapping a skylink doesn't grow the list, so it's fine.
+	patched, _, err = at.UserAPIKeysPATCH(ak.ID, api.APIKeyPATCH{Add: []string{sl1}, Remove: []string{sl2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(patched.Skylinks, []string{sl3, sl1}) {
+		t.Fatalf("Expected skylinks %v, got %v", []string{sl3, sl1}, patched.Skylinks)
+	}
+}
+
+// testAPIKeysLimit ensures that users can't exceed the maximum number of API
+// keys, even when they create them concurrently, and that we tell them the
+// limit and how many keys they have.
+func testAPIKeysLimit(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	limit := 5
+	oldLimit := database.MaxNumAPIKeysPerUser
+	database.MaxNumAPIKeysPerUser = limit
+	defer func() { database.MaxNumAPIKeysPerUser = oldLimit }()
+
+	// Create twice as many keys as allowed, concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 2*limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _ = at.UserAPIKeysPOST(api.APIKeyPOST{})
+		}()
+	}
+	wg.Wait()
+	aks, _, err := at.UserAPIKeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aks.Limit != limit || aks.Current != len(aks.Items) || aks.Current > limit {
+		t.Fatalf("Expected at most %d keys, got %d with a limit of %d", limit, aks.Current, aks.Limit)
+	}
+	// Some of the concurrent requests might have run out of retries, so we
+	// fill up the remaining slots.
+	for i := aks.Current; i < limit; i++ {
+		_, _, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Creating one more key fails with a structured error.
+	_, s, err := at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err == nil || s != http.StatusConflict {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusConflict, s, err)
+	}
+	var ale api.APIKeyLimitError
+	errStr := err.Error()
+	err = json.NewDecoder(strings.NewReader(errStr[strings.Index(errStr, "{"):])).Decode(&ale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ale.Code != api.ErrCodeAPIKeyLimitReached || ale.Limit != limit || ale.Current != limit {
+		t.Fatalf("Unexpected error %+v", ale)
+	}
+}
+
+// testAPIKeysRequireConfirmedEmail ensures that users can't create API keys
+// until they confirm their email address while the portal requires that, and
+// that GET /user reports the restriction.
+func testAPIKeysRequireConfirmedEmail(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	key := database.ConfValAPIKeysRequireConfirmedEmail
+	// Make sure we lift the requirement when we're done.
+	defer func() {
+		_, _, err = at.AdminConfigPUT(adminKey, key, database.ConfValFalse)
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to restore the configuration in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Without the requirement, unconfirmed users can create API keys.
+	ak, s, err := at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.Restrictions == nil || len(ug.Restrictions) != 0 {
+		t.Fatalf("Expected no restrictions, got %v", ug.Restrictions)
+	}
+
+	// Require a confirmed email.
+	_, s, err = at.AdminConfigPUT(adminKey, key, database.ConfValTrue)
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+	_, s, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err == nil || s != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusForbidden, s, err)
+	}
+	if code := test.ErrorCode(err.Error()); code != api.ErrCodeEmailNotConfirmed {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeEmailNotConfirmed, code)
+	}
+	ug, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(ug.Restrictions, api.RestrictionAPIKeysRequireConfirmedEmail) {
+		t.Fatalf("Expected restriction '%s', got %v", api.RestrictionAPIKeysRequireConfirmedEmail, ug.Restrictions)
+	}
+	// The existing API key keeps working.
+	at.SetAPIKey(ak.Key.String())
+	_, s, err = at.UserUploadsGET(nil)
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+
+	// Confirm the email and try again.
+	at.SetCookie(c)
+	s, err = at.UserConfirmGET(u.EmailConfirmationToken)
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+	_, s, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+	ug, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ug.Restrictions) != 0 {
+		t.Fatalf("Expected no restrictions, got %v", ug.Restrictions)
+	}
+}
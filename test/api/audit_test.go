@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/build"
+)
+
+// testAuditLog ensures that we record security-relevant events on the user's
+// account and that both the user and the operators can list them.
+func testAuditLog(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	password := name + "_pass"
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	// Log in and change the user's email.
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	newEmail := types.NewEmail(name + "_new@siasky.net")
+	_, s, err := at.UserPUT(newEmail.String(), "", "")
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+
+	// The entries are written in the background, so we might need to wait
+	// for them. Signing up doesn't count as a login.
+	var al api.AuditLogGET
+	err = build.Retry(20, 100*time.Millisecond, func() error {
+		al, _, err = at.UserAuditGET(nil)
+		if err != nil {
+			return err
+		}
+		if al.Count != 2 || len(al.Items) != 2 {
+			return fmt.Errorf("expected 2 entries, got %d", al.Count)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The most recent entry comes first.
+	if al.Items[0].Action != database.AuditActionEmailChange || al.Items[1].Action != database.AuditActionLogin {
+		t.Fatalf("Unexpected actions '%s' and '%s'", al.Items[0].Action, al.Items[1].Action)
+	}
+	if al.Items[0].Metadata["oldEmail"] != email.String() || al.Items[0].Metadata["newEmail"] != newEmail.String() {
+		t.Fatalf("Unexpected metadata %+v", al.Items[0].Metadata)
+	}
+	for _, e := range al.Items {
+		if e.IP == "" || e.CreatedAt.IsZero() {
+			t.Fatalf("Unexpected entry %+v", e)
+		}
+	}
+	// Fetch the second page.
+	al, _, err = at.UserAuditGET(map[string][]string{"offset": {"1"}, "pageSize": {"1"}})
+	if err != nil || len(al.Items) != 1 || al.Items[0].Action != database.AuditActionLogin || al.HasMore {
+		t.Fatalf("Unexpected page %+v and %v", al, err)
+	}
+
+	// The operators can see the same entries.
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	at.ClearCredentials()
+	al, s, err = at.AdminUserAuditGET(adminKey, u.Sub)
+	if err != nil || s != http.StatusOK || al.Count != 2 {
+		t.Fatalf("Expected %d and 2 entries, got %d, %+v and %v", http.StatusOK, s, al, err)
+	}
+	_, s, err = at.AdminUserAuditGET(adminKey, "nosuchsub")
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+	_, s, err = at.AdminUserAuditGET("wrong key", u.Sub)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+}
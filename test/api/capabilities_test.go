@@ -0,0 +1,113 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/build"
+)
+
+// testUserCapabilities ensures that GET /user/capabilities reports what the
+// caller's credential gives access to, for cookie users, private and public
+// API keys, and anonymous callers.
+func testUserCapabilities(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	du, err := at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmed := du.EmailConfirmationToken == ""
+
+	// capabilities fetches the capabilities of the current credential.
+	capabilities := func() api.UserCapabilitiesGET {
+		caps, status, err := at.UserCapabilitiesGET()
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Expected %d, got %d '%v'", http.StatusOK, status, err)
+		}
+		return caps
+	}
+
+	// A cookie user can do everything the configuration allows.
+	at.SetCookie(c)
+	caps := capabilities()
+	if !caps.CanManageAccount || !caps.CanTrack || !caps.CanChangePassword || caps.EmailConfirmed != confirmed {
+		t.Fatalf("Unexpected capabilities of a cookie user %+v", caps)
+	}
+
+	// A private API key can't manage the account but it can use the routes
+	// which accept API keys.
+	ak, err := at.DB.APIKeyCreate(at.Ctx, *u.User, "", false, nil, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetAPIKey(ak.Key.String())
+	caps = capabilities()
+	if caps.CanManageAccount || caps.CanChangePassword || !caps.CanTrack || caps.EmailConfirmed != confirmed {
+		t.Fatalf("Unexpected capabilities of a private API key %+v", caps)
+	}
+	// A read-only API key can't use any of the routes which modify data.
+	rak, err := at.DB.APIKeyCreate(at.Ctx, *u.User, "", false, nil, database.APIKeyScopeRead, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetAPIKey(rak.Key.String())
+	caps = capabilities()
+	if caps != (api.UserCapabilitiesGET{EmailConfirmed: confirmed}) {
+		t.Fatalf("Unexpected capabilities of a read-only API key %+v", caps)
+	}
+
+	// Public API keys and anonymous callers get all capabilities set to false.
+	pak, err := at.DB.APIKeyCreate(at.Ctx, *u.User, "", true, []string{test.RandomSkylink()}, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetAPIKey(pak.Key.String())
+	caps = capabilities()
+	if caps != (api.UserCapabilitiesGET{}) {
+		t.Fatalf("Unexpected capabilities of a public API key %+v", caps)
+	}
+	at.ClearCredentials()
+	caps = capabilities()
+	if caps != (api.UserCapabilitiesGET{}) {
+		t.Fatalf("Unexpected capabilities of an anonymous caller %+v", caps)
+	}
+
+	// Disabling registrations also disables password changes.
+	key := database.ConfValRegistrationsDisabled
+	defer func() {
+		err = at.DB.WriteConfigValue(at.Ctx, key, database.ConfValFalse)
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to restore the configuration in defer"))
+		}
+	}()
+	err = at.DB.WriteConfigValue(at.Ctx, key, database.ConfValTrue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	err = build.Retry(20, 100*time.Millisecond, func() error {
+		caps = capabilities()
+		if caps.CanChangePassword || !caps.CanManageAccount {
+			return fmt.Errorf("unexpected capabilities %+v", caps)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
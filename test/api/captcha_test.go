@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/lib/captcha"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+)
+
+// stubVerifier is a captcha.Verifier which accepts the "pass" token, waits for
+// the context to expire on the "timeout" token and rejects all others.
+type stubVerifier struct{}
+
+// Verify implements captcha.Verifier.
+func (stubVerifier) Verify(ctx context.Context, token, _ string) error {
+	switch token {
+	case "pass":
+		return nil
+	case "timeout":
+		<-ctx.Done()
+		return ctx.Err()
+	default:
+		return captcha.ErrInvalidToken
+	}
+}
+
+// testCaptcha ensures that registrations and account recovery requests are
+// only accepted with a valid captcha token when captcha verification is
+// enabled.
+func testCaptcha(t *testing.T, at *test.AccountsTester) {
+	oldVerifier, oldFailOpen, oldTimeout := api.CaptchaVerifier, api.CaptchaFailOpen, api.CaptchaTimeout
+	api.CaptchaVerifier = stubVerifier{}
+	api.CaptchaTimeout = 100 * time.Millisecond
+	defer func() {
+		api.CaptchaVerifier, api.CaptchaFailOpen, api.CaptchaTimeout = oldVerifier, oldFailOpen, oldTimeout
+	}()
+	at.ClearCredentials()
+	name := test.DBNameForTest(t.Name())
+
+	// post sends the given body with the given captcha token to the endpoint
+	// and returns the status and error code of the response.
+	post := func(endpoint string, body map[string]string, token string) (int, string) {
+		payload := map[string]string{"captchaToken": token}
+		for k, v := range body {
+			payload[k] = v
+		}
+		b, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := at.Request(http.MethodPost, endpoint, nil, b, nil, nil)
+		if err != nil {
+			return r.StatusCode, test.ErrorCode(err.Error())
+		}
+		return r.StatusCode, ""
+	}
+	// We only care whether these requests fail because of the captcha, not
+	// whether they succeed. The challenge response is well-formed, so it
+	// passes the checks which come before the captcha verification.
+	endpoints := map[string]map[string]string{
+		"/user": {"email": "", "password": ""},
+		"/register": {
+			"response":  hex.EncodeToString(make([]byte, database.ChallengeSize)),
+			"signature": hex.EncodeToString(make([]byte, database.ChallengeSignatureSize)),
+		},
+		"/user/recover/request": {"email": name + "@siasky.net"},
+	}
+	tests := []struct {
+		token    string
+		failOpen bool
+		rejected bool
+	}{
+		{token: "pass", rejected: false},
+		{token: "fail", rejected: true},
+		{token: "", rejected: true},
+		{token: "timeout", failOpen: false, rejected: true},
+		{token: "timeout", failOpen: true, rejected: false},
+	}
+	for endpoint, body := range endpoints {
+		for _, tt := range tests {
+			api.CaptchaFailOpen = tt.failOpen
+			status, code := post(endpoint, body, tt.token)
+			rejected := status == http.StatusBadRequest && code == api.ErrCodeCaptchaFailed
+			if rejected != tt.rejected {
+				t.Fatalf("%s with token '%s' and fail-open %t: expected rejected %t, got status %d and code '%s'", endpoint, tt.token, tt.failOpen, tt.rejected, status, code)
+			}
+		}
+	}
+
+	// A valid token lets the user register.
+	api.CaptchaFailOpen = false
+	status, code := post("/user", map[string]string{"email": name + "@siasky.net", "password": name + "_pass"}, "pass")
+	if status != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and code '%s'", http.StatusOK, status, code)
+	}
+	u, err := at.DB.UserByEmail(at.Ctx, types.NewEmail(name+"@siasky.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = at.DB.UserDelete(at.Ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.ClearCredentials()
+}
@@ -6,8 +6,11 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/jwt"
 	"github.com/SkynetLabs/skynet-accounts/test"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"gitlab.com/NebulousLabs/errors"
@@ -71,6 +74,179 @@ func testRegistration(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testRegistrationWithoutEmail ensures that users can register with only a
+// pubkey, log in with it and add an email later.
+func testRegistrationWithoutEmail(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	sk, pkk := crypto.GenerateKeyPair()
+	var pk = database.PubKey(pkk[:])
+	defer at.ClearCredentials()
+
+	// Register without an email. Expect the user to not have one.
+	ch, _, err := at.RegisterGET(pk)
+	if err != nil {
+		t.Fatal("Failed to get a challenge:", err)
+	}
+	chBytes, err := hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response := append(chBytes, append([]byte(database.ChallengeTypeRegister), []byte(database.PortalName)...)...)
+	sig := ed25519.Sign(sk[:], response)
+	u, status, err := at.RegisterPOST(response, sig, "")
+	if err != nil {
+		t.Fatalf("Failed to register. Status %d, error '%s'", status, err)
+	}
+	if u.Email != "" || u.HasEmail || u.EmailConfirmed {
+		t.Fatalf("Expected a user without an email, got %+v", u)
+	}
+	du, err := at.DB.UserByPubKey(at.Ctx, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = at.DB.UserDelete(at.Ctx, du); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	if du.EmailConfirmationToken != "" {
+		t.Fatal("Expected no email confirmation token.")
+	}
+
+	// Log in via challenge-response.
+	ch, _, err = at.LoginPubKeyGET(pk)
+	if err != nil {
+		t.Fatal("Failed to get a challenge:", err)
+	}
+	chBytes, err = hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response = append(chBytes, append([]byte(database.ChallengeTypeLogin), []byte(database.PortalName)...)...)
+	sig = ed25519.Sign(sk[:], response)
+	r, b, err := at.LoginPubKeyPOST(response, sig, "")
+	if err != nil {
+		t.Fatalf("Failed to login. Status %d, body '%s', error '%s'", r.StatusCode, string(b), err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	u, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Sub != du.Sub || u.HasEmail || u.EmailConfirmed {
+		t.Fatalf("Unexpected user %+v", u)
+	}
+
+	// Setting a password without an email fails.
+	_, status, err = at.UserPUT("", name+"_pass", "")
+	if status != http.StatusBadRequest || err == nil || !strings.Contains(err.Error(), database.ErrPasswordWithoutEmail.Error()) {
+		t.Fatalf("Expected %d '%s', got %d '%v'", http.StatusBadRequest, database.ErrPasswordWithoutEmail, status, err)
+	}
+
+	// Add an email. It stays pending until the user confirms it.
+	emailStr := types.NewEmail(name + "@siasky.net")
+	u, _, err = at.UserPUT(emailStr.String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.HasEmail || u.PendingEmail != emailStr {
+		t.Fatalf("Expected a pending email '%s', got %+v", emailStr, u)
+	}
+	du, err = at.DB.UserByPubKey(at.Ctx, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.UserConfirmGET(du.PendingEmailToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != emailStr || !u.HasEmail || !u.EmailConfirmed {
+		t.Fatalf("Expected a confirmed email '%s', got %+v", emailStr, u)
+	}
+}
+
+// testRegisterAvailability ensures that GET /register/availability tells us
+// whether an email and a pubkey are already registered.
+func testRegisterAvailability(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	sk, pk := crypto.GenerateKeyPair()
+	emailStr := types.NewEmail(name + "@siasky.net")
+
+	// We need at least one of the parameters and they need to be valid.
+	_, status, err := at.RegisterAvailabilityGET("", nil)
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	_, status, err = at.RegisterAvailabilityGET("not an email", nil)
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	_, status, err = at.RegisterAvailabilityGET("", fastrand.Bytes(10))
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	// Both the email and the pubkey should be available.
+	av, status, err := at.RegisterAvailabilityGET(emailStr.String(), pk[:])
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+	if av.EmailAvailable == nil || !*av.EmailAvailable || av.PubKeyAvailable == nil || !*av.PubKeyAvailable {
+		t.Fatalf("Expected both to be available, got %+v", av)
+	}
+	// Only ask about the email.
+	av, _, err = at.RegisterAvailabilityGET(emailStr.String(), nil)
+	if err != nil || av.EmailAvailable == nil || av.PubKeyAvailable != nil {
+		t.Fatalf("Expected only the email flag, got %+v and error %v", av, err)
+	}
+
+	// Register a user with this email and pubkey.
+	ch, _, err := at.RegisterGET(pk[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chBytes, err := hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response := append(chBytes, append([]byte(database.ChallengeTypeRegister), []byte(database.PortalName)...)...)
+	sig := ed25519.Sign(sk[:], response)
+	_, status, err = at.RegisterPOST(response, sig, emailStr.String())
+	if err != nil {
+		t.Fatalf("Failed to register. Status %d, error '%s'", status, err)
+	}
+	defer func() {
+		u, err := at.DB.UserByPubKey(at.Ctx, pk[:])
+		if err == nil {
+			err = at.DB.UserDelete(at.Ctx, u)
+		}
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	// Neither the email nor the pubkey should be available anymore.
+	av, status, err = at.RegisterAvailabilityGET(emailStr.String(), pk[:])
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+	if av.EmailAvailable == nil || *av.EmailAvailable || av.PubKeyAvailable == nil || *av.PubKeyAvailable {
+		t.Fatalf("Expected neither to be available, got %+v", av)
+	}
+
+	// Disable the availability checks.
+	api.AvailabilityCheckEnabled = false
+	defer func() {
+		api.AvailabilityCheckEnabled = true
+	}()
+	_, status, err = at.RegisterAvailabilityGET(emailStr.String(), pk[:])
+	if err == nil || status != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusNotFound, status, err)
+	}
+}
+
 // testLogin validates the login challenge-response flow.
 func testLogin(t *testing.T, at *test.AccountsTester) {
 	// Use the test's name as an email-compatible identifier.
@@ -136,6 +312,150 @@ func testLogin(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testLoginTTL ensures that the challenge-response login respects the JWT TTL
+// requested by the caller.
+func testLoginTTL(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	sk, pkk := crypto.GenerateKeyPair()
+	var pk = database.PubKey(pkk[:])
+
+	// Register a user with a pubkey.
+	ch, _, err := at.RegisterGET(pk)
+	if err != nil {
+		t.Fatal("Failed to get a challenge:", err)
+	}
+	chBytes, err := hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response := append(chBytes, append([]byte(database.ChallengeTypeRegister), []byte(database.PortalName)...)...)
+	sig := ed25519.Sign(sk[:], response)
+	_, status, err := at.RegisterPOST(response, sig, types.NewEmail(name+"@siasky.net").String())
+	if err != nil {
+		t.Fatalf("Failed to validate the response. Status %d, error '%s'", status, err)
+	}
+
+	// Solve a login challenge.
+	ch, _, err = at.LoginPubKeyGET(pk)
+	if err != nil {
+		t.Fatal("Failed to get a challenge:", err)
+	}
+	chBytes, err = hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response = append(chBytes, append([]byte(database.ChallengeTypeLogin), []byte(database.PortalName)...)...)
+	sig = ed25519.Sign(sk[:], response)
+	// Request a TTL which is too high.
+	_, _, err = at.LoginPubKeyPOSTWithTTL(response, sig, jwt.TTL+1)
+	if err == nil || !strings.Contains(err.Error(), "jwt ttl value is too high") {
+		t.Fatalf("Expected error 'jwt ttl value is too high', got '%v'", err)
+	}
+	// Request a TTL of 60 seconds.
+	ttl := 60
+	r, b, err := at.LoginPubKeyPOSTWithTTL(response, sig, ttl)
+	if err != nil {
+		t.Fatalf("Failed to login. Status %d, body '%s', error '%s'", r.StatusCode, string(b), err)
+	}
+	c := test.ExtractCookie(r)
+	if c == nil {
+		t.Fatal("Expected a cookie.")
+	}
+	// Make sure the TTL of the cookie is correct. 2 seconds tolerance.
+	if c.MaxAge > ttl || c.MaxAge < ttl-2 {
+		t.Fatalf("Expected maxAge %d, got %d", ttl, c.MaxAge)
+	}
+	// Make sure the token expires at the same time.
+	tk, err := jwt.ValidateToken(r.Header.Get("Skynet-Token"))
+	if err != nil {
+		t.Fatal("Missing or invalid token. Error:", err)
+	}
+	expiresIn := time.Until(tk.Expiration())
+	if expiresIn > time.Duration(ttl)*time.Second || expiresIn < time.Duration(ttl-2)*time.Second {
+		t.Fatalf("Expected the token to expire in %ds, got %v", ttl, expiresIn)
+	}
+}
+
+// testChallengeExpiration ensures that challenges report their expiration and
+// that responses to expired challenges are rejected with 410 Gone.
+func testChallengeExpiration(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	sk, pkk := crypto.GenerateKeyPair()
+	var pk = database.PubKey(pkk[:])
+	emailStr := types.NewEmail(name + "@siasky.net")
+	expectedErr := `"code":"` + api.ErrCodeChallengeExpired + `"`
+
+	// Request a registration challenge and make sure it tells us how long we
+	// have to respond.
+	ch, _, err := at.RegisterGET(pk)
+	if err != nil {
+		t.Fatal("Failed to get a challenge:", err)
+	}
+	if ch.TTLSeconds <= 0 || ch.TTLSeconds > 600 {
+		t.Fatalf("Expected a TTL between 0 and 600 seconds, got %d", ch.TTLSeconds)
+	}
+	if until := time.Until(ch.ExpiresAt); until <= 0 || until > 10*time.Minute {
+		t.Fatalf("Unexpected expiration time %v", ch.ExpiresAt)
+	}
+	// Fast-forward the challenge's expiration and respond to it.
+	err = at.DB.ChallengeSetExpiration(at.Ctx, ch.Challenge, time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chBytes, err := hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response := append(chBytes, append([]byte(database.ChallengeTypeRegister), []byte(database.PortalName)...)...)
+	_, status, err := at.RegisterPOST(response, ed25519.Sign(sk[:], response), emailStr.String())
+	if err == nil || status != http.StatusGone || !strings.Contains(err.Error(), expectedErr) {
+		t.Fatalf("Expected %d and '%s', got %d and '%v'", http.StatusGone, expectedErr, status, err)
+	}
+
+	// Register with a fresh challenge.
+	ch, _, err = at.RegisterGET(pk)
+	if err != nil {
+		t.Fatal("Failed to get a challenge:", err)
+	}
+	chBytes, err = hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response = append(chBytes, append([]byte(database.ChallengeTypeRegister), []byte(database.PortalName)...)...)
+	_, status, err = at.RegisterPOST(response, ed25519.Sign(sk[:], response), emailStr.String())
+	if err != nil {
+		t.Fatalf("Failed to register. Status %d, error '%s'", status, err)
+	}
+
+	// Do the same for a login challenge.
+	ch, _, err = at.LoginPubKeyGET(pk)
+	if err != nil {
+		t.Fatal("Failed to get a challenge:", err)
+	}
+	if ch.TTLSeconds <= 0 || ch.ExpiresAt.IsZero() {
+		t.Fatalf("Expected the challenge's expiration, got %+v", ch)
+	}
+	err = at.DB.ChallengeSetExpiration(at.Ctx, ch.Challenge, time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chBytes, err = hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response = append(chBytes, append([]byte(database.ChallengeTypeLogin), []byte(database.PortalName)...)...)
+	r, b, err := at.LoginPubKeyPOST(response, ed25519.Sign(sk[:], response), emailStr.String())
+	if err == nil || r.StatusCode != http.StatusGone || !strings.Contains(string(b), expectedErr) {
+		t.Fatalf("Expected %d and '%s', got %d, '%s' and '%v'", http.StatusGone, expectedErr, r.StatusCode, string(b), err)
+	}
+	// An unknown challenge is still reported as unauthorized.
+	fastrand.Read(response[:database.ChallengeSize])
+	r, _, err = at.LoginPubKeyPOST(response, ed25519.Sign(sk[:], response), emailStr.String())
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and '%v'", http.StatusUnauthorized, r.StatusCode, err)
+	}
+}
+
 // testUserAddPubKey tests the ability of update user's pubKey.
 func testUserAddPubKey(t *testing.T, at *test.AccountsTester) {
 	name := test.DBNameForTest(t.Name())
@@ -240,6 +560,92 @@ func testUserAddPubKey(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testUserPubKeyLimit ensures that users can't attach more than the maximum
+// allowed number of pubkeys to their accounts.
+func testUserPubKeyLimit(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// requestChallenge requests a pubkey registration challenge for a new
+	// pubkey and returns the signed response.
+	requestChallenge := func() ([]byte, []byte, int, error) {
+		sk, pk := crypto.GenerateKeyPair()
+		ch, status, err := at.UserPubkeyRegisterGET(hex.EncodeToString(pk[:]))
+		if err != nil {
+			return nil, nil, status, err
+		}
+		chBytes, err := hex.DecodeString(ch.Challenge)
+		if err != nil {
+			t.Fatal("Invalid challenge:", err)
+		}
+		response := append(chBytes, append([]byte(database.ChallengeTypeUpdate), []byte(database.PortalName)...)...)
+		return response, ed25519.Sign(sk[:], response), status, nil
+	}
+
+	// Fill the user up to one pubkey short of the limit.
+	for i := 0; i < database.MaxNumPubKeysPerUser-1; i++ {
+		_, pk := crypto.GenerateKeyPair()
+		if err = at.DB.UserPubKeyAdd(at.Ctx, *u.User, pk[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	features, _, err := at.UserFeaturesGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !features.CanAddPubKey {
+		t.Fatal("Expected the user to be able to add a pubkey.")
+	}
+	// Request two challenges while the user is still under the limit.
+	resp1, sig1, _, err := requestChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2, sig2, _, err := requestChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Solving the first one should reach the limit.
+	_, _, err = at.UserPubkeyRegisterPOST(resp1, sig1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Solving the second one should fail.
+	_, status, err := at.UserPubkeyRegisterPOST(resp2, sig2)
+	if status != http.StatusBadRequest || err == nil || !strings.Contains(err.Error(), database.ErrPubKeyLimitReached.Error()) {
+		t.Fatalf("Expected %d '%s', got %d '%v'", http.StatusBadRequest, database.ErrPubKeyLimitReached, status, err)
+	}
+	u2, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u2.PubKeys) != database.MaxNumPubKeysPerUser {
+		t.Fatalf("Expected %d pubkeys, got %d", database.MaxNumPubKeysPerUser, len(u2.PubKeys))
+	}
+	// Now the user is at the limit, so we don't even issue a challenge.
+	_, _, status, err = requestChallenge()
+	if status != http.StatusBadRequest || err == nil || !strings.Contains(err.Error(), database.ErrPubKeyLimitReached.Error()) {
+		t.Fatalf("Expected %d '%s', got %d '%v'", http.StatusBadRequest, database.ErrPubKeyLimitReached, status, err)
+	}
+	features, _, err = at.UserFeaturesGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features.CanAddPubKey {
+		t.Fatal("Expected the user to not be able to add a pubkey.")
+	}
+}
+
 // testUserDeletePubKey ensures that users can delete pubkeys from their
 // accounts.
 func testUserDeletePubKey(t *testing.T, at *test.AccountsTester) {
@@ -322,3 +728,109 @@ func testUserDeletePubKey(t *testing.T, at *test.AccountsTester) {
 		t.Fatalf("Expected to fail with 400. Status %d, error '%s'", status, err)
 	}
 }
+
+// testUserPubKeysList ensures that users can list their pubkeys along with
+// their metadata.
+func testUserPubKeysList(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// No keys.
+	pks, status, err := at.UserPubkeysLIST()
+	if err != nil || status != http.StatusOK {
+		t.Fatal(status, err)
+	}
+	if len(pks) != 0 {
+		t.Fatalf("Expected no pubkeys, got %d", len(pks))
+	}
+
+	// One key.
+	sk1, pk1 := crypto.GenerateKeyPair()
+	if err = at.DB.UserPubKeyAdd(at.Ctx, *u.User, pk1[:]); err != nil {
+		t.Fatal(err)
+	}
+	pks, _, err = at.UserPubkeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pks) != 1 || pks[0].Key != hex.EncodeToString(pk1[:]) {
+		t.Fatalf("Unexpected pubkeys %+v", pks)
+	}
+	if pks[0].AddedAt == nil || pks[0].LastUsedAt != nil {
+		t.Fatalf("Expected addedAt to be set and lastUsedAt to be null, got %+v", pks[0])
+	}
+	// Adding the same key again should not duplicate its metadata.
+	if err = at.DB.UserPubKeyAdd(at.Ctx, *u.User, pk1[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Multiple keys.
+	_, pk2 := crypto.GenerateKeyPair()
+	if err = at.DB.UserPubKeyAdd(at.Ctx, *u.User, pk2[:]); err != nil {
+		t.Fatal(err)
+	}
+	pks, _, err = at.UserPubkeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pks) != 2 {
+		t.Fatalf("Expected 2 pubkeys, got %d", len(pks))
+	}
+	u1, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u1.PubKeysMeta) != 2 {
+		t.Fatalf("Expected metadata for 2 pubkeys, got %d", len(u1.PubKeysMeta))
+	}
+
+	// Log in with the first key and make sure its last used time is set.
+	ch, _, err := at.LoginPubKeyGET(pk1[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chBytes, err := hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	response := append(chBytes, append([]byte(database.ChallengeTypeLogin), []byte(database.PortalName)...)...)
+	r, b, err := at.LoginPubKeyPOST(response, ed25519.Sign(sk1[:], response), u.Email.String())
+	if err != nil {
+		t.Fatalf("Failed to login. Status %d, body '%s', error '%s'", r.StatusCode, string(b), err)
+	}
+	pks, _, err = at.UserPubkeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range pks {
+		if pk.Key == hex.EncodeToString(pk1[:]) && pk.LastUsedAt == nil {
+			t.Fatal("Expected lastUsedAt to be set for the key used to log in.")
+		}
+		if pk.Key == hex.EncodeToString(pk2[:]) && pk.LastUsedAt != nil {
+			t.Fatal("Expected lastUsedAt to be null for the unused key.")
+		}
+	}
+
+	// Deleting a key removes it from the list.
+	status, err = at.UserPubkeyDELETE(pk2[:])
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal(status, err)
+	}
+	pks, _, err = at.UserPubkeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pks) != 1 || pks[0].Key != hex.EncodeToString(pk1[:]) {
+		t.Fatalf("Unexpected pubkeys %+v", pks)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// testChangefeed ensures that the changefeed requires the shared secret and
+// reports user changes.
+func testChangefeed(t *testing.T, at *test.AccountsTester) {
+	secret := "changefeed secret"
+	// The changefeed is disabled when there is no secret.
+	_, s, err := at.ChangesGET("", "")
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	api.ChangefeedSecret = secret
+	defer func() { api.ChangefeedSecret = "" }()
+	_, s, err = at.ChangesGET("wrong secret", "")
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	_, s, err = at.ChangesGET(secret, "invalid cursor")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Skip over all events created by other tests.
+	var cursor string
+	for {
+		ch, _, err := at.ChangesGET(secret, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ch.Events) == 0 {
+			break
+		}
+		cursor = ch.Cursor
+	}
+
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	err = at.DB.UserSetTier(at.Ctx, u.User, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+	_, err = at.UserDELETE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user_deleted event is only recorded once the user is purged.
+	_, err = at.DB.UserPurgeDeleted(at.Ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _, err := at.ChangesGET(secret, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.Events) != 2 {
+		t.Fatalf("Expected 2 events, got %+v", ch.Events)
+	}
+	if ch.Events[0].Type != database.ChangeEventTierChanged || ch.Events[0].Sub != u.Sub || *ch.Events[0].Tier != database.TierPremium5 {
+		t.Fatalf("Unexpected event %+v", ch.Events[0])
+	}
+	if ch.Events[1].Type != database.ChangeEventUserDeleted || ch.Events[1].Sub != u.Sub {
+		t.Fatalf("Unexpected event %+v", ch.Events[1])
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// testUserEmailPreferences ensures that users can change their email
+// preferences and that the unsubscribe links opt them out of a category
+// without logging in.
+func testUserEmailPreferences(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	emailAddr := types.NewEmail(name + "@siasky.net")
+	password := name + "_pass"
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	defer at.ClearCredentials()
+
+	// New users get the default preferences.
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.EmailPreferences == nil || *ug.EmailPreferences != database.DefaultEmailPreferences {
+		t.Fatalf("Expected the default preferences, got %+v", ug.EmailPreferences)
+	}
+
+	// An empty request is rejected.
+	_, status, _ := at.UserPreferencesPUT(api.UserPreferencesPUT{})
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, status)
+	}
+	// Opt into marketing emails. The rest stays the same.
+	yes := true
+	ug, _, err = at.UserPreferencesPUT(api.UserPreferencesPUT{Marketing: &yes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := database.EmailPreferences{Security: true, Product: true, Marketing: true}
+	if ug.EmailPreferences == nil || *ug.EmailPreferences != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, ug.EmailPreferences)
+	}
+	// The change is persisted.
+	du, err := at.DB.UserBySub(at.Ctx, ug.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if du.EmailPrefs() != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, du.EmailPrefs())
+	}
+
+	// Unsubscribe from product emails without logging in.
+	at.ClearCredentials()
+	token, err := email.UnsubscribeToken(ug.Sub, database.EmailCategoryProduct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs, _, err := at.EmailUnsubscribeGET(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Product = false
+	if prefs != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, prefs)
+	}
+	du, err = at.DB.UserBySub(at.Ctx, ug.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if du.EmailPrefs() != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, du.EmailPrefs())
+	}
+	// Invalid tokens and tokens of unknown users are rejected.
+	for _, sub := range []string{"", "no such sub"} {
+		tk := "invalid"
+		if sub != "" {
+			tk, err = email.UnsubscribeToken(sub, database.EmailCategoryProduct)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, status, _ = at.EmailUnsubscribeGET(tk)
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected %d, got %d", http.StatusBadRequest, status)
+		}
+	}
+}
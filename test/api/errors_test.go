@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// testErrorCodes ensures that error responses carry machine-readable codes
+// while keeping their messages unchanged.
+func testErrorCodes(t *testing.T, at *test.AccountsTester) {
+	u1, c1, err := test.CreateUserAndLogin(at, t.Name()+"1")
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u1.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	u2, _, err := test.CreateUserAndLogin(at, t.Name()+"2")
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u2.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// Log in with the wrong password.
+	at.ClearCredentials()
+	r, b, err := at.LoginCredentialsPOST(u1.Email.String(), "wrong password")
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, r.StatusCode, err)
+	}
+	if code := test.ErrorCode(string(b)); code != api.ErrCodeInvalidCredentials {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeInvalidCredentials, code)
+	}
+	if !strings.Contains(string(b), api.ErrInvalidCredentials.Error()) {
+		t.Fatalf("Expected message '%s', got '%s'", api.ErrInvalidCredentials, string(b))
+	}
+
+	// Try to take another user's email address.
+	at.SetCookie(c1)
+	_, s, err := at.UserPUT(u2.Email.String(), "", "")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	if code := test.ErrorCode(err.Error()); code != api.ErrCodeEmailInUse {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeEmailInUse, code)
+	}
+	if !strings.Contains(err.Error(), "this email is already in use") {
+		t.Fatalf("Expected message '%s', got '%s'", api.ErrEmailInUse, err)
+	}
+
+	// Track an upload of an invalid skylink.
+	s, err = at.TrackUpload("notaskylink", "")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	if code := test.ErrorCode(err.Error()); code != api.ErrCodeInvalidSkylink {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeInvalidSkylink, code)
+	}
+
+	// Errors without a specific code are reported as internal.
+	_, s, err = at.UserUploadsGET(map[string][]string{"format": {"xml"}})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	if code := test.ErrorCode(err.Error()); code != api.ErrCodeInternal {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeInternal, code)
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testUserCSVExport ensures that users can export their uploads and downloads
+// as CSV.
+func testUserCSVExport(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Invalid format.
+	params := url.Values{}
+	params.Set("format", "xml")
+	_, s, err := at.UserUploadsGET(params)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// CSV exports can't be grouped.
+	params = url.Values{}
+	params.Set("groupBy", "skylink")
+	_, _, s, err = at.UserDownloadsCSV(params)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+
+	// An empty export only has the header row.
+	records, h, _, err := at.UserUploadsCSV(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || strings.Join(records[0], ",") != "skylink,name,size,timestamp,unpinned" {
+		t.Fatalf("Unexpected records %v", records)
+	}
+	if !strings.HasPrefix(h.Get("Content-Type"), "text/csv") {
+		t.Fatalf("Unexpected content type '%s'", h.Get("Content-Type"))
+	}
+	if cd := h.Get("Content-Disposition"); !strings.Contains(cd, "uploads-"+u.Sub+"-") || !strings.Contains(cd, ".csv") {
+		t.Fatalf("Unexpected content disposition '%s'", cd)
+	}
+
+	// Create three uploads and unpin the first one.
+	sizes := []int64{1000, 2000, 3000}
+	skylinks := make(map[string]int64)
+	var unpinned string
+	for i, size := range sizes {
+		sl, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skylinks[sl.Skylink] = size
+		if i == 0 {
+			if _, err = at.DB.UnpinUploads(at.Ctx, *sl, *u.User); err != nil {
+				t.Fatal(err)
+			}
+			unpinned = sl.Skylink
+		}
+	}
+	// The JSON response doesn't include the unpinned upload.
+	ups, _, err := at.UserUploadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ups.Count != 2 {
+		t.Fatalf("Expected 2 uploads, got %d", ups.Count)
+	}
+	// The CSV export includes all uploads.
+	records, _, _, err = at.UserUploadsCSV(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Expected a header and 3 rows, got %v", records)
+	}
+	for _, r := range records[1:] {
+		size, ok := skylinks[r[0]]
+		if !ok {
+			t.Fatalf("Unexpected skylink in row %v", r)
+		}
+		if r[2] != strconv.FormatInt(size, 10) {
+			t.Fatalf("Expected size %d, got row %v", size, r)
+		}
+		if r[3] == "" {
+			t.Fatalf("Expected a timestamp, got row %v", r)
+		}
+		if expected := strconv.FormatBool(r[0] == unpinned); r[4] != expected {
+			t.Fatalf("Expected unpinned to be %s, got row %v", expected, r)
+		}
+	}
+	// Filters and sorting apply to the export.
+	params = url.Values{}
+	params.Set("minSize", "2000")
+	params.Set("orderBy", "size")
+	params.Set("orderDirection", "asc")
+	records, _, _, err = at.UserUploadsCSV(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][2] != "2000" || records[2][2] != "3000" {
+		t.Fatalf("Unexpected records %v", records)
+	}
+	// The number of rows is capped.
+	maxRows := api.CSVExportMaxRows
+	api.CSVExportMaxRows = 2
+	records, _, _, err = at.UserUploadsCSV(nil)
+	api.CSVExportMaxRows = maxRows
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected a header and 2 rows, got %v", records)
+	}
+
+	// Download a skylink twice, once in full and once partially.
+	sl, err := at.DB.Skylink(at.Ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = at.DB.SkylinkUpdate(at.Ctx, sl.ID, "file.txt", 500); err != nil {
+		t.Fatal(err)
+	}
+	for _, bytes := range []int64{0, 100} {
+		if _, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *sl, bytes, primitive.ObjectID{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, h, _, err = at.UserDownloadsCSV(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != "skylink,name,bytes,createdAt" {
+		t.Fatalf("Unexpected records %v", records)
+	}
+	if cd := h.Get("Content-Disposition"); !strings.Contains(cd, "downloads-"+u.Sub+"-") {
+		t.Fatalf("Unexpected content disposition '%s'", cd)
+	}
+	// Full downloads count the skylink's size.
+	bytesServed := make(map[string]bool)
+	for _, r := range records[1:] {
+		if r[0] != sl.Skylink || r[1] != "file.txt" || r[3] == "" {
+			t.Fatalf("Unexpected row %v", r)
+		}
+		bytesServed[r[2]] = true
+	}
+	if !bytesServed["100"] || !bytesServed["500"] {
+		t.Fatalf("Unexpected records %v", records)
+	}
+}
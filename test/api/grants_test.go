@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// testSkylinkGrants ensures that skylink access grants can be issued, give
+// their holders the granting user's limits, expire, and get revoked when the
+// user rotates their grant secret.
+func testSkylinkGrants(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	err = at.DB.UserSetTier(at.Ctx, u.User, database.TierPremium20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	sl, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 128*skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user can't share a skylink they haven't uploaded.
+	otherSl := test.RandomSkylink()
+	_, s, err := at.UploadsSharePOST(otherSl, 0)
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+	// The TTL needs to be within bounds.
+	_, s, err = at.UploadsSharePOST(sl.Skylink, 8*24*3600)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Share the skylink for a day.
+	share, s, err := at.UploadsSharePOST(sl.Skylink, 0)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if share.Grant == "" || share.ExpiresAt.Before(time.Now().UTC().Add(23*time.Hour)) {
+		t.Fatalf("Unexpected share response %+v", share)
+	}
+
+	// Anyone holding the grant gets the user's limits for this skylink.
+	at.ClearCredentials()
+	ul, _, err := at.UserLimitsSkylinkGrant(sl.Skylink, "byte", share.Grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierPremium20 || ul.Sub != u.Sub {
+		t.Fatalf("Expected tier %d and sub '%s', got %d and '%s'", database.TierPremium20, u.Sub, ul.TierID, ul.Sub)
+	}
+	// But not for other skylinks.
+	ul, _, err = at.UserLimitsSkylinkGrant(otherSl, "byte", share.Grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, ul.TierID)
+	}
+	// Downloads made with the grant are attributed to the granting user.
+	_, err = at.TrackDownloadGrant(sl.Skylink, 200, share.Grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	stats, _, err := at.UserStats("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumDownloads != 1 {
+		t.Fatalf("Expected 1 download, got %d", stats.NumDownloads)
+	}
+
+	// Grants expire.
+	shortShare, _, err := at.UploadsSharePOST(sl.Skylink, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	at.ClearCredentials()
+	ul, _, err = at.UserLimitsSkylinkGrant(sl.Skylink, "byte", shortShare.Grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, ul.TierID)
+	}
+
+	// Rotating the grant secret revokes all outstanding grants.
+	at.SetCookie(c)
+	_, err = at.UserGrantsRotatePOST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.ClearCredentials()
+	ul, _, err = at.UserLimitsSkylinkGrant(sl.Skylink, "byte", share.Grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, ul.TierID)
+	}
+	s, err = at.TrackDownloadGrant(sl.Skylink, 200, share.Grant)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusUnauthorized, s, err)
+	}
+	// New grants work with the new secret.
+	at.SetCookie(c)
+	share, _, err = at.UploadsSharePOST(sl.Skylink, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.ClearCredentials()
+	ul, _, err = at.UserLimitsSkylinkGrant(sl.Skylink, "byte", share.Grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, ul.TierID)
+	}
+}
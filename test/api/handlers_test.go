@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -22,6 +23,7 @@ import (
 	"gitlab.com/NebulousLabs/fastrand"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.sia.tech/siad/build"
 	"go.sia.tech/siad/crypto"
@@ -60,26 +62,99 @@ func TestHandlers(t *testing.T) {
 	// Specify subtests to run
 	tests := []subtest{
 		{name: "Health", test: testHandlerHealthGET},
+		{name: "HealthFull", test: testHandlerHealthFullGET},
+		{name: "Metrics", test: testMetrics},
+		{name: "PublicHEAD", test: testPublicEndpointsHEAD},
+		{name: "PageSize", test: testPageSize},
 		{name: "UserCreate", test: testHandlerUserPOST},
+		{name: "EmailNormalization", test: testEmailNormalization},
 		{name: "LoginLogout", test: testHandlerLoginPOST},
+		{name: "LoginLockout", test: testLoginLockout},
+		{name: "PasswordPolicy", test: testPasswordPolicy},
 		{name: "UserEdit", test: testUserPUT},
+		{name: "UserName", test: testUserName},
+		{name: "UserLocale", test: testUserLocale},
+		{name: "RequestBodyLimit", test: testRequestBodyLimit},
+		{name: "UserSubscription", test: testUserSubscription},
+		{name: "UserEmailChange", test: testUserEmailChange},
 		{name: "UserAddPubKey", test: testUserAddPubKey},
 		{name: "DeletePubKey", test: testUserDeletePubKey},
+		{name: "UserPubKeyLimit", test: testUserPubKeyLimit},
+		{name: "UserPubKeysList", test: testUserPubKeysList},
 		{name: "UserDelete", test: testUserDELETE},
+		{name: "UserUndelete", test: testUserUndeletePOST},
+		{name: "UserSessions", test: testUserSessions},
+		{name: "TokenRefresh", test: testTokenRefresh},
+		{name: "UserEmailPreferences", test: testUserEmailPreferences},
+		{name: "UserAuditLog", test: testAuditLog},
 		{name: "UserLimits", test: testUserLimits},
+		{name: "UserLimitsPubKey", test: testUserLimitsPubKey},
 		{name: "UserDeleteUploads", test: testUserUploadsDELETE},
+		{name: "UserBulkDeleteUploads", test: testUserUploadsBulkDeletePOST},
+		{name: "UserUploadsRepin", test: testUserUploadsRepin},
+		{name: "UserDownloadsSummary", test: testUserDownloadsSummary},
+		{name: "UserDownloadsDelete", test: testUserDownloadsDELETE},
+		{name: "UserUploadsSortAndPaging", test: testUserUploadsSortAndPaging},
+		{name: "UserUploadsFilter", test: testUserUploadsFilter},
 		{name: "UserConfirmReconfirmEmail", test: testUserConfirmReconfirmEmailGET},
 		{name: "UserAccountRecovery", test: testUserAccountRecovery},
+		{name: "UserAccountRecoveryTokens", test: testUserAccountRecoveryTokens},
+		{name: "UserCapabilities", test: testUserCapabilities},
 		{name: "StandardTrackingFlow", test: testTrackingAndStats},
 		{name: "StandardUserFlow", test: testUserFlow},
 		{name: "Challenge-Response/Registration", test: testRegistration},
+		{name: "Challenge-Response/RegistrationWithoutEmail", test: testRegistrationWithoutEmail},
+		{name: "RegisterAvailability", test: testRegisterAvailability},
 		{name: "Challenge-Response/Login", test: testLogin},
+		{name: "Challenge-Response/LoginTTL", test: testLoginTTL},
+		{name: "Challenge-Response/Expiration", test: testChallengeExpiration},
 		{name: "PrivateAPIKeysFlow", test: testPrivateAPIKeysFlow},
 		{name: "PrivateAPIKeysUsage", test: testPrivateAPIKeysUsage},
 		{name: "PublicAPIKeysFlow", test: testPublicAPIKeysFlow},
 		{name: "PublicAPIKeysUsage", test: testPublicAPIKeysUsage},
+		{name: "UserLimitsBatch", test: testUserLimitsBatch},
 		{name: "APIKeysAcceptance", test: testAPIKeysAcceptance},
+		{name: "APIKeysScope", test: testAPIKeysScope},
+		{name: "APIKeysExpiry", test: testAPIKeysExpiry},
+		{name: "APIKeysRotate", test: testAPIKeysRotate},
+		{name: "APIKeysPatch", test: testAPIKeysPatch},
+		{name: "APIKeysLimit", test: testAPIKeysLimit},
+		{name: "APIKeysRequireConfirmedEmail", test: testAPIKeysRequireConfirmedEmail},
+		{name: "APIKeyUsageStats", test: testAPIKeyUsageStats},
+		{name: "PublicAPIKeysTiers", test: testPublicAPIKeysTiers},
+		{name: "AdminCohorts", test: testAdminCohorts},
+		{name: "AdminUserTier", test: testAdminUserTier},
+		{name: "AdminUserTrial", test: testAdminUserTrial},
+		{name: "AdminUserFlags", test: testAdminUserFlags},
+		{name: "AdminLimits", test: testAdminLimits},
+		{name: "AdminSkylinkBlock", test: testAdminSkylinkBlock},
+		{name: "AdminActivityByIP", test: testAdminActivityByIP},
+		{name: "AdminUploadsByCountry", test: testAdminUploadsByCountry},
+		{name: "AdminSkylinkStats", test: testAdminSkylinkStats},
+		{name: "AdminSkylinkPurge", test: testAdminSkylinkPurge},
+		{name: "AdminStats", test: testAdminStats},
+		{name: "AdminConfig", test: testAdminConfig},
+		{name: "Organizations", test: testOrganizations},
+		{name: "RegistrationsDisabled", test: testRegistrationsDisabled},
+		{name: "Captcha", test: testCaptcha},
+		{name: "SkylinkGrants", test: testSkylinkGrants},
+		{name: "Changefeed", test: testChangefeed},
 		{name: "UploadInfo", test: testUploadInfo},
+		{name: "TrackUploadRequestID", test: testTrackUploadRequestID},
+		{name: "TrackUploadIP", test: testTrackUploadIP},
+		{name: "TrackUploadQuotaReservation", test: testTrackUploadQuotaReservation},
+		{name: "SkylinkSizeResolvedQuota", test: testSkylinkSizeResolvedQuota},
+		{name: "StripeInvoiceWebhook", test: testStripeInvoiceWebhook},
+		{name: "StripeCheckoutTierCache", test: testStripeCheckoutTierCache},
+		{name: "StripePaymentsEnabled", test: testStripePaymentsEnabled},
+		{name: "TwoFactor", test: testTwoFactor},
+		{name: "UserStatsHistory", test: testUserStatsHistory},
+		{name: "UserStatsTop", test: testUserStatsTop},
+		{name: "UserETag", test: testUserETag},
+		{name: "UserRegistryEvents", test: testUserRegistryEvents},
+		{name: "UserCSVExport", test: testUserCSVExport},
+		{name: "UserMerge", test: testUserMerge},
+		{name: "ErrorCodes", test: testErrorCodes},
 	}
 
 	// Run subtests
@@ -90,6 +165,40 @@ func TestHandlers(t *testing.T) {
 	}
 }
 
+// testHandlerHealthFullGET tests the /health/full handler against a fully
+// functional tester.
+func testHandlerHealthFullGET(t *testing.T, at *test.AccountsTester) {
+	// The email sender might not have completed its first scan, yet.
+	var h api.HealthFullGET
+	err := build.Retry(10, 100*time.Millisecond, func() error {
+		var status int
+		var err error
+		h, status, err = at.HealthFullGET()
+		if err != nil || status != http.StatusOK {
+			return fmt.Errorf("expected %d, got %d '%v'", http.StatusOK, status, err)
+		}
+		if !h.EmailSender.Healthy {
+			return fmt.Errorf("expected a healthy email sender, got %+v", h.EmailSender)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Healthy || !h.DB.Healthy || !h.MetaFetcher.Healthy || !h.Schema.Healthy || !h.Stripe.Healthy {
+		t.Fatalf("Expected a healthy report, got %+v", h)
+	}
+	if !strings.HasPrefix(h.DB.Details, "ping took ") {
+		t.Fatalf("Unexpected DB details '%s'", h.DB.Details)
+	}
+	if h.MetaFetcher.Details != "0 messages in queue" {
+		t.Fatalf("Unexpected metafetcher details '%s'", h.MetaFetcher.Details)
+	}
+	if h.Stripe.Details != api.StripeMode() {
+		t.Fatalf("Expected Stripe mode '%s', got '%s'", api.StripeMode(), h.Stripe.Details)
+	}
+}
+
 // testHandlerHealthGET tests the /health handler.
 func testHandlerHealthGET(t *testing.T, at *test.AccountsTester) {
 	status, _, err := at.HealthGet()
@@ -164,6 +273,52 @@ func testHandlerUserPOST(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testEmailNormalization ensures that we treat emails which only differ by
+// capitalization or surrounding whitespace as the same email.
+func testEmailNormalization(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	emailStr := "Foo_" + name + "@X.com"
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	_, b, err := at.UserPOST(emailStr, password)
+	if err != nil {
+		t.Fatalf("User creation failed. Error: '%s'. Body: '%s' ", err, string(b))
+	}
+	u, err := at.DB.UserByEmail(at.Ctx, types.NewEmail(emailStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = at.DB.UserDelete(at.Ctx, u); err != nil {
+			t.Errorf("Error while cleaning up user: %s", err.Error())
+		}
+	}()
+	// We disable gocritic here, so it doesn't suggest to use strings.EqualFold().
+	//nolint:gocritic
+	if string(u.Email) != strings.ToLower(emailStr) {
+		t.Fatalf("Expected the email to be '%s', got '%s'", strings.ToLower(emailStr), u.Email)
+	}
+	// The same email with a different capitalization is taken.
+	for _, e := range []string{strings.ToLower(emailStr), " " + strings.ToUpper(emailStr) + " "} {
+		_, b, err = at.UserPOST(e, password)
+		if err == nil || !strings.Contains(err.Error(), badRequest) {
+			t.Fatalf("Expected user creation with '%s' to fail with '%s', got '%s'. Body: '%s'", e, badRequest, err, string(b))
+		}
+	}
+	// Addresses with a display name are not bare addresses.
+	_, b, err = at.UserPOST("Foo <"+strings.ToLower(emailStr)+">", password)
+	if err == nil || !strings.Contains(err.Error(), badRequest) {
+		t.Fatalf("Expected user creation to fail with '%s', got '%s'. Body: '%s'", badRequest, err, string(b))
+	}
+	// The user can log in with any capitalization.
+	for _, e := range []string{strings.ToUpper(emailStr), " " + emailStr + " "} {
+		_, b, err = at.LoginCredentialsPOST(e, password)
+		if err != nil {
+			t.Fatalf("Login with '%s' failed. Error: '%s'. Body: '%s'", e, err, string(b))
+		}
+	}
+	at.ClearCredentials()
+}
+
 // testHandlerLoginPOST tests the /login endpoint.
 func testHandlerLoginPOST(t *testing.T, at *test.AccountsTester) {
 	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
@@ -182,6 +337,10 @@ func testHandlerLoginPOST(t *testing.T, at *test.AccountsTester) {
 			t.Error(errors.AddContext(err, "failed to delete user in defer"))
 		}
 	}()
+	// Make sure the user has never logged in.
+	if !u.LastLoginAt.IsZero() {
+		t.Fatalf("Expected the last login time to be zero, got %v", u.LastLoginAt)
+	}
 	// Try to log in with an existing user but set a very long TTL.
 	_, _, err = at.LoginCredentialsPOSTWithTTL(emailAddr.String(), password, jwt.TTL+1)
 	if err == nil || !strings.Contains(err.Error(), "jwt ttl value is too high") {
@@ -220,6 +379,10 @@ func testHandlerLoginPOST(t *testing.T, at *test.AccountsTester) {
 	if err != nil || u1.Email != emailAddr {
 		t.Fatal("Expected to be able to fetch the user with this cookie.")
 	}
+	// Make sure the login was recorded.
+	if u1.LastLoginAt.IsZero() || time.Since(u1.LastLoginAt) > time.Minute {
+		t.Fatalf("Expected the last login time to be recent, got %v", u1.LastLoginAt)
+	}
 	// test /logout while we're here.
 	r, b, err := at.LogoutPOST()
 	if err != nil {
@@ -250,6 +413,74 @@ func testHandlerLoginPOST(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testLoginLockout ensures that too many consecutive failed logins with a
+// password lock the user's account and that a successful login resets the
+// count of failures.
+func testLoginLockout(t *testing.T, at *test.AccountsTester) {
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	threshold := 3
+	oldThreshold := api.LoginLockoutThreshold
+	api.LoginLockoutThreshold = threshold
+	defer func() {
+		api.LoginLockoutThreshold = oldThreshold
+	}()
+
+	// failLogins fails to log in the given number of times.
+	failLogins := func(n int) {
+		for i := 0; i < n; i++ {
+			r, _, err := at.LoginCredentialsPOST(emailAddr.String(), "bad password")
+			if err == nil || r.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("Expected %d, got %d and error %v", http.StatusUnauthorized, r.StatusCode, err)
+			}
+		}
+	}
+	// A successful login resets the count of failures.
+	failLogins(threshold - 1)
+	_, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failLogins(threshold - 1)
+	_, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reaching the threshold locks the account, even for the correct
+	// password.
+	failLogins(threshold)
+	r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err == nil || r.StatusCode != http.StatusLocked {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusLocked, r.StatusCode, err)
+	}
+	du, err := at.DB.UserByEmail(at.Ctx, emailAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !du.Locked() {
+		t.Fatalf("Expected the user to be locked, got %v", du.LockedUntil)
+	}
+	// Clear the lockout and make sure the user can log in again.
+	du.LockedUntil = time.Time{}
+	err = at.DB.UserSave(at.Ctx, du)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil || test.ExtractCookie(r) == nil {
+		t.Fatal("Expected to log in after the lockout was cleared.", err)
+	}
+}
+
 // testUserPUT tests the PUT /user endpoint.
 func testUserPUT(t *testing.T, at *test.AccountsTester) {
 	name := test.DBNameForTest(t.Name())
@@ -327,22 +558,28 @@ func testUserPUT(t *testing.T, at *test.AccountsTester) {
 
 	// Update the user's email.
 	emailAddr := types.NewEmail(name + "_new@siasky.net")
-	_, status, err = at.UserPUT(emailAddr.String(), "", "")
+	uPending, status, err := at.UserPUT(emailAddr.String(), "", "")
 	if err != nil || status != http.StatusOK {
 		t.Fatal(status, err)
 	}
-	// Fetch the user from the DB because we want to be sure that their email
-	// is marked as unconfirmed which is not reflected in the JSON
+	if uPending.Email != u.Email || uPending.PendingEmail != emailAddr {
+		t.Fatalf("Expected email %s and pending email %s, got %s and %s", u.Email, emailAddr, uPending.Email, uPending.PendingEmail)
+	}
+	// Fetch the user from the DB because we want to be sure that their new
+	// email is waiting for a confirmation which is not reflected in the JSON
 	// representation of the object.
-	u3, err := at.DB.UserByEmail(at.Ctx, emailAddr)
+	u3, err := at.DB.UserByID(at.Ctx, u.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if u3.Email != emailAddr {
-		t.Fatalf("Expected the user to have email %s, got %s", emailAddr, u3.Email)
+	if u3.Email != u.Email {
+		t.Fatalf("Expected the user to keep email %s, got %s", u.Email, u3.Email)
 	}
-	if u3.EmailConfirmationToken == "" {
-		t.Fatalf("Expected the user to have a non-empty confirmation token, got '%s'", u3.EmailConfirmationToken)
+	if u3.PendingEmail != emailAddr {
+		t.Fatalf("Expected the user to have pending email %s, got %s", emailAddr, u3.PendingEmail)
+	}
+	if u3.PendingEmailToken == "" {
+		t.Fatal("Expected the user to have a non-empty pending email token.")
 	}
 	// Expect to find a confirmation email queued for sending.
 	filer := bson.M{"to": emailAddr.String()}
@@ -360,9 +597,18 @@ func testUserPUT(t *testing.T, at *test.AccountsTester) {
 	if err != nil || status != http.StatusOK {
 		t.Fatal(status, err)
 	}
+	// Confirm the change, so the mixed-case email becomes the user's email.
+	u4, err := at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.UserConfirmGET(u4.PendingEmailToken)
+	if err != nil {
+		t.Fatal(err)
+	}
 	// Fetch the user by the mixed-case email. Expect this to succeed because we
 	// cast the email to lowercase in the UserPUT handler.
-	u4, err := at.DB.UserByEmail(at.Ctx, types.NewEmail(emailStr))
+	u4, err = at.DB.UserByEmail(at.Ctx, types.NewEmail(emailStr))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -375,6 +621,275 @@ func testUserPUT(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testUserName ensures that the user can set their display name and that we
+// include it in the JWTs we issue for them.
+func testUserName(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	emailAddr := types.NewEmail(name + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	// The user has no name, yet.
+	tk, err := jwt.ValidateToken(r.Header.Get("Skynet-Token"))
+	if err != nil || jwt.TokenName(tk) != "" {
+		t.Fatalf("Expected a valid token without a name, got %v", err)
+	}
+	// Invalid names are rejected.
+	_, s, err := at.UserNamePUT(strings.Repeat("a", api.MaxUserNameLength+1))
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	_, s, err = at.UserNamePUT("Jane\nDoe")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// Set the name.
+	displayName := "Jane Doe"
+	ug, s, err := at.UserNamePUT(" " + displayName + " ")
+	if err != nil || s != http.StatusOK || ug.Name != displayName {
+		t.Fatalf("Expected %d and name '%s', got %d, '%s' and %v", http.StatusOK, displayName, s, ug.Name, err)
+	}
+	// Log in again and make sure the token carries the name.
+	r, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err = jwt.ValidateToken(r.Header.Get("Skynet-Token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := jwt.TokenName(tk); n != displayName {
+		t.Fatalf("Expected name '%s' in the token, got '%s'", displayName, n)
+	}
+	// Clear the name.
+	ug, _, err = at.UserNamePUT("")
+	if err != nil || ug.Name != "" {
+		t.Fatalf("Expected no name, got '%s' and %v", ug.Name, err)
+	}
+}
+
+// testUserLocale ensures that the user can set the locale of their emails.
+func testUserLocale(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Invalid locales are rejected.
+	for _, l := range []string{"german", "de_DE", "../de"} {
+		_, s, err := at.UserLocalePUT(l)
+		if err == nil || s != http.StatusBadRequest {
+			t.Fatalf("Expected %d for locale '%s', got %d and %v", http.StatusBadRequest, l, s, err)
+		}
+	}
+	// Set the locale. We store it in lower case.
+	ug, s, err := at.UserLocalePUT(" pt-BR ")
+	if err != nil || s != http.StatusOK || ug.Locale != "pt-br" {
+		t.Fatalf("Expected %d and locale 'pt-br', got %d, '%s' and %v", http.StatusOK, s, ug.Locale, err)
+	}
+	ug, _, err = at.UserGET()
+	if err != nil || ug.Locale != "pt-br" {
+		t.Fatalf("Expected locale 'pt-br', got '%s' and %v", ug.Locale, err)
+	}
+	// Clear the locale.
+	ug, _, err = at.UserLocalePUT("")
+	if err != nil || ug.Locale != "" {
+		t.Fatalf("Expected no locale, got '%s' and %v", ug.Locale, err)
+	}
+}
+
+// testRequestBodyLimit ensures that we reject request bodies which exceed the
+// limit of their route with a 413.
+func testRequestBodyLimit(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	emailAddr := types.NewEmail(name + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	// The password alone exceeds the limit of these routes.
+	oversized := strings.Repeat("a", int(api.LimitBodySizeSmall)+1)
+
+	r, b, err := at.UserPOST(emailAddr.String(), oversized)
+	if err == nil || r.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusRequestEntityTooLarge, r.StatusCode, err)
+	}
+	if code := test.ErrorCode(string(b)); code != api.ErrCodeRequestBodyTooLarge {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeRequestBodyTooLarge, code)
+	}
+	// Normal-sized bodies still work.
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	r, b, err = at.LoginCredentialsPOST(emailAddr.String(), oversized)
+	if err == nil || r.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusRequestEntityTooLarge, r.StatusCode, err)
+	}
+	if code := test.ErrorCode(string(b)); code != api.ErrCodeRequestBodyTooLarge {
+		t.Fatalf("Expected code '%s', got '%s'", api.ErrCodeRequestBodyTooLarge, code)
+	}
+	r, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil || r.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNoContent, r.StatusCode, err)
+	}
+}
+
+// testUserEmailChange ensures that changing the user's email only takes effect
+// once the new address is confirmed.
+func testUserEmailChange(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	oldEmail := types.NewEmail(name + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	r, _, err := at.UserPOST(oldEmail.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := test.ExtractCookie(r)
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+	u, err := at.DB.UserByEmail(at.Ctx, oldEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = at.DB.UserDelete(at.Ctx, u); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	// pendingToken fetches the user's current pending email token.
+	pendingToken := func() string {
+		uu, err := at.DB.UserByID(at.Ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uu.PendingEmailToken
+	}
+
+	// Request an email change. Expect the old address to keep working until
+	// the new one is confirmed.
+	newEmail := types.NewEmail(name + "_new@siasky.net")
+	_, _, err = at.UserPUT(newEmail.String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = at.LoginCredentialsPOST(oldEmail.String(), password)
+	if err != nil {
+		t.Fatal("Expected to be able to log in with the old email.", err)
+	}
+	_, _, err = at.LoginCredentialsPOST(newEmail.String(), password)
+	if err == nil || !strings.Contains(err.Error(), unauthorized) {
+		t.Fatalf("Expected '%s' when logging in with the pending email, got '%v'", unauthorized, err)
+	}
+	// Confirm the change.
+	_, err = at.UserConfirmGET(pendingToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.Email != newEmail || ug.PendingEmail != "" || !ug.EmailConfirmed {
+		t.Fatalf("Expected confirmed email %s and no pending email, got %+v", newEmail, ug)
+	}
+	_, _, err = at.LoginCredentialsPOST(newEmail.String(), password)
+	if err != nil {
+		t.Fatal("Expected to be able to log in with the new email.", err)
+	}
+	_, _, err = at.LoginCredentialsPOST(oldEmail.String(), password)
+	if err == nil || !strings.Contains(err.Error(), unauthorized) {
+		t.Fatalf("Expected '%s' when logging in with the old email, got '%v'", unauthorized, err)
+	}
+
+	// Request two changes in a row. Expect the second one to invalidate the
+	// token of the first.
+	_, _, err = at.UserPUT(name+"_first@siasky.net", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstToken := pendingToken()
+	secondEmail := types.NewEmail(name + "_second@siasky.net")
+	_, _, err = at.UserPUT(secondEmail.String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := at.UserConfirmGET(firstToken)
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d and error '%v'", http.StatusBadRequest, status, err)
+	}
+	_, err = at.UserConfirmGET(pendingToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uu, err := at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uu.Email != secondEmail {
+		t.Fatalf("Expected email %s, got %s", secondEmail, uu.Email)
+	}
+
+	// Request a change and let another user register with the pending address
+	// before we confirm it. Expect the confirmation to fail with a conflict.
+	takenEmail := types.NewEmail(name + "_taken@siasky.net")
+	_, _, err = at.UserPUT(takenEmail.String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := pendingToken()
+	_, _, err = at.UserPOST(takenEmail.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := at.DB.UserByEmail(at.Ctx, takenEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = at.DB.UserDelete(at.Ctx, other); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	status, err = at.UserConfirmGET(token)
+	if err == nil || status != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d and error '%v'", http.StatusConflict, status, err)
+	}
+	uu, err = at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uu.Email != secondEmail {
+		t.Fatalf("Expected the email to remain %s, got %s", secondEmail, uu.Email)
+	}
+}
+
 // testUserDELETE tests the DELETE /user endpoint.
 func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	u, c, err := test.CreateUserAndLogin(at, t.Name())
@@ -388,7 +903,24 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	if err != nil || status != http.StatusNoContent {
 		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
 	}
-	// Make sure the use doesn't exist anymore.
+	// Make sure the user is only marked as deleted.
+	du, err := at.DB.UserByEmail(at.Ctx, u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !du.Deleted() {
+		t.Fatal("Expected the user to be marked as deleted.")
+	}
+	// Make sure the user can't use their cookie anymore.
+	_, status, _ = at.UserGET()
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, status)
+	}
+	// Purge the user and make sure they don't exist anymore.
+	_, err = at.DB.UserPurgeDeleted(at.Ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
 	_, err = at.DB.UserByEmail(at.Ctx, u.Email)
 	if !errors.Contains(err, database.ErrUserNotFound) {
 		t.Fatalf("Expected error '%s', got '%s'.", database.ErrUserNotFound, err)
@@ -403,15 +935,15 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.DownloadCreate(at.Ctx, *u.User, *sl, 128)
+	_, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *sl, 128, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.RegistryWriteCreate(at.Ctx, *u.User)
+	_, err = at.DB.RegistryWriteCreate(at.Ctx, *u.User, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.RegistryReadCreate(at.Ctx, *u.User)
+	_, err = at.DB.RegistryReadCreate(at.Ctx, *u.User, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -428,6 +960,10 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	if err != nil || status != http.StatusNoContent {
 		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
 	}
+	_, err = at.DB.UserPurgeDeleted(at.Ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
 	// Make sure the user doesn't exist anymore.
 	_, err = at.DB.UserByEmail(at.Ctx, u.Email)
 	if !errors.Contains(err, database.ErrUserNotFound) {
@@ -449,27 +985,136 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
-// testUserLimits tests the /user/limits endpoint.
-func testUserLimits(t *testing.T, at *test.AccountsTester) {
-	u, c, err := test.CreateUserAndLogin(at, t.Name())
+// testUserUndeletePOST ensures that a deleted user can't log in and that they
+// can restore their account with a recovery token.
+func testUserUndeletePOST(t *testing.T, at *test.AccountsTester) {
+	email := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, email, password)
 	if err != nil {
-		t.Fatal("Failed to create a user and log in:", err)
+		t.Fatal(err)
 	}
 	defer func() {
 		if err = u.Delete(at.Ctx); err != nil {
 			t.Error(errors.AddContext(err, "failed to delete user in defer"))
 		}
 	}()
-	at.SetCookie(c)
-	defer at.ClearCredentials()
-
-	// Create an API key for this user.
-	akr, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{})
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Call /user/limits with a cookie. Expect FreeTier response.
+	at.SetCookie(test.ExtractCookie(r))
+	defer at.ClearCredentials()
+	// Delete the user.
+	status, err := at.UserDELETE()
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
+	}
+	// Make sure the user can't log in with their correct credentials.
+	at.ClearCredentials()
+	r, _, _ = at.LoginCredentialsPOST(email.String(), password)
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+	// Try to undelete without a token and with an invalid one.
+	r, _ = at.UserUndeletePOST("")
+	if r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+	r, _ = at.UserUndeletePOST(hex.EncodeToString(fastrand.Bytes(16)))
+	if r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+	// Request a recovery token. Deleted users can still get one.
+	_, err = at.UserRecoverRequestPOST(email.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	du, err := at.DB.UserByEmail(at.Ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := test.LatestRecoveryToken(at.Ctx, at.DB, *du)
+	if err != nil {
+		t.Fatal("Expected a recovery token.", err)
+	}
+	// The token can't be used for resetting the password of a deleted user.
+	status, _ = at.UserRecoverPOST(token, password, password)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, status)
+	}
+	// Restore the account. This logs the user in.
+	r, err = at.UserUndeletePOST(token)
+	if err != nil || r.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, r.StatusCode, err)
+	}
+	c := test.ExtractCookie(r)
+	if c == nil {
+		t.Fatal("Expected a cookie.")
+	}
+	at.SetCookie(c)
+	_, status, err = at.UserGET()
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusOK, status, err)
+	}
+	// The user can log in again and the token is spent.
+	at.ClearCredentials()
+	r, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil || r.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, r.StatusCode, err)
+	}
+	r, _ = at.UserUndeletePOST(token)
+	if r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+	// Delete the user again. The spent token can't restore the account.
+	err = at.DB.UserSoftDelete(at.Ctx, du)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ = at.UserUndeletePOST(token)
+	if r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+	// Let the grace period pass.
+	_, err = at.UserRecoverRequestPOST(email.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = test.LatestRecoveryToken(at.Ctx, at.DB, *du)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gp := database.UserDeleteGracePeriod
+	database.UserDeleteGracePeriod = 0
+	defer func() { database.UserDeleteGracePeriod = gp }()
+	r, _ = at.UserUndeletePOST(token)
+	if r.StatusCode != http.StatusGone {
+		t.Fatalf("Expected %d, got %d", http.StatusGone, r.StatusCode)
+	}
+}
+
+// testUserLimits tests the /user/limits endpoint.
+func testUserLimits(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Create an API key for this user.
+	akr, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Call /user/limits with a cookie. Expect FreeTier response.
 	tl, _, err := at.UserLimits("byte", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -596,21 +1241,460 @@ func testUserLimits(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if tlBytes.UploadBandwidth*8 != tl.UploadBandwidth || tlBytes.DownloadBandwidth*8 != tl.DownloadBandwidth {
-		t.Fatalf("Invalid values in bytes. Values in bps: %+v, values in Bps: %+v", tl, tlBytes)
+	if tlBytes.UploadBandwidth*8 != tl.UploadBandwidth || tlBytes.DownloadBandwidth*8 != tl.DownloadBandwidth {
+		t.Fatalf("Invalid values in bytes. Values in bps: %+v, values in Bps: %+v", tl, tlBytes)
+	}
+	// Ensure we're not case-sensitive.
+	tlBytes2, _, err := at.UserLimits("ByTe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlBytes2.UploadBandwidth != tlBytes.UploadBandwidth || tlBytes2.DownloadBandwidth != tlBytes.DownloadBandwidth {
+		t.Fatalf("Got different values for different capitalizations of 'byte'.\nValues for 'byte': %+v, values for 'ByTe': %+v", tlBytes, tlBytes2)
+	}
+}
+
+// testUserLimitsPubKey ensures that GET /user/pubkeys/:pubKey/limits returns
+// the tier limits of the pubkey's owner without revealing anything about their
+// usage, and the anonymous limits for unknown pubkeys.
+func testUserLimitsPubKey(t *testing.T, at *test.AccountsTester) {
+	u, _, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.ClearCredentials()
+	_, pk := crypto.GenerateKeyPair()
+	u.Tier = database.TierPremium20
+	u.PubKeys = append(u.PubKeys, pk[:])
+	// The user's quota doesn't affect the limits we report by pubkey.
+	u.QuotaExceeded = true
+	err = at.DB.UserSave(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkStr := database.PubKey(pk[:]).String()
+
+	// A known pubkey gets its owner's tier limits. We call it twice, so the
+	// second call is served from the cache.
+	for i := 0; i < 2; i++ {
+		ul, s, err := at.UserLimitsPubKey(pkStr, "byte")
+		if err != nil || s != http.StatusOK {
+			t.Fatal(s, err)
+		}
+		if ul.TierID != database.TierPremium20 || ul.TierName != database.UserLimits[database.TierPremium20].TierName {
+			t.Fatalf("Expected tier %d, got %d ('%s')", database.TierPremium20, ul.TierID, ul.TierName)
+		}
+		if ul.UploadBandwidth != database.UserLimits[database.TierPremium20].UploadBandwidth {
+			t.Fatalf("Expected upload bandwidth %d, got %d", database.UserLimits[database.TierPremium20].UploadBandwidth, ul.UploadBandwidth)
+		}
+	}
+	// The response only holds the tier data.
+	var fields map[string]interface{}
+	_, err = at.Request(http.MethodGet, "/user/pubkeys/"+pkStr+"/limits", nil, nil, nil, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"sub", "quotaExceeded", "quota"} {
+		if _, exists := fields[f]; exists {
+			t.Fatalf("Expected no '%s' in the response, got %v", f, fields)
+		}
+	}
+	// An unknown pubkey gets the anonymous limits.
+	_, pkUnknown := crypto.GenerateKeyPair()
+	ul, s, err := at.UserLimitsPubKey(database.PubKey(pkUnknown[:]).String(), "byte")
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected the anonymous limits, got %+v", ul)
+	}
+	// A malformed pubkey is an error.
+	_, s, err = at.UserLimitsPubKey("notapubkey", "byte")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+}
+
+// testUserUploadsDELETE tests the DELETE /user/uploads/:skylink endpoint.
+func testUserUploadsDELETE(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Create an upload.
+	skylink, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 128%skynet.KiB)
+	// Make sure it shows up for this user.
+	ups, _, err := at.UserUploadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// We expect to have a single upload, and we expect it to be of this skylink.
+	if len(ups.Items) != 1 || ups.Items[0].Skylink != skylink.Skylink {
+		t.Fatalf("Expected to have a single upload of %s, got %+v", skylink.Skylink, ups)
+	}
+	// Try to delete the upload without passing a JWT cookie.
+	at.ClearCredentials()
+	_, err = at.UploadsDELETE(skylink.Skylink)
+	if err == nil || !strings.Contains(err.Error(), unauthorized) {
+		t.Fatalf("Expected error %s, got %s", unauthorized, err)
+	}
+	at.SetCookie(c)
+	// Delete it.
+	_, err = at.UploadsDELETE(skylink.Skylink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure it's gone.
+	ups, _, err = at.UserUploadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// We expect to have no uploads.
+	if len(ups.Items) != 0 {
+		t.Fatalf("Expected to have a no uploads, got %+v", ups)
+	}
+}
+
+// testUserUploadsRepin tests listing unpinned uploads and the
+// POST /user/uploads/:skylink/repin endpoint.
+func testUserUploadsRepin(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Only allow a single upload, so repinning puts the user over quota.
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	maxNumUploads := 1
+	_, _, err = at.AdminLimitsPUT(adminKey, database.TierFree, database.TierLimitsOverride{MaxNumberUploads: &maxNumUploads})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _, err = at.AdminLimitsPUT(adminKey, database.TierFree, database.TierLimitsOverride{})
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to reset the limits in defer"))
+		}
+	}()
+
+	sl1, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 128*skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(at.Ctx, at.DB, *u.User, 256*skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _, err := at.UserStats("", nil)
+	if err != nil || stats.NumUploads != 2 || stats.TotalUploadsSize != 384*skynet.KiB {
+		t.Fatalf("Unexpected stats %+v, error %v", stats, err)
+	}
+
+	// Unpin the first upload.
+	if _, err = at.UploadsDELETE(sl1.Skylink); err != nil {
+		t.Fatal(err)
+	}
+	ups, _, err := at.UserUploadsGET(nil)
+	if err != nil || len(ups.Items) != 1 || ups.Items[0].Skylink == sl1.Skylink {
+		t.Fatalf("Expected only the pinned upload, got %+v and %v", ups, err)
+	}
+	ups, _, err = at.UserUploadsGET(url.Values{"includeUnpinned": []string{"true"}})
+	if err != nil || len(ups.Items) != 2 {
+		t.Fatalf("Expected both uploads, got %+v and %v", ups, err)
+	}
+	for _, up := range ups.Items {
+		unpinned := up.Skylink == sl1.Skylink
+		if up.Unpinned != unpinned || (up.UnpinnedAt != nil) != unpinned {
+			t.Fatalf("Unexpected unpinned state of upload %+v", up)
+		}
+	}
+	_, s, err := at.UserUploadsGET(url.Values{"includeUnpinned": []string{"maybe"}})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	stats, _, err = at.UserStats("", nil)
+	if err != nil || stats.NumUploads != 1 || stats.TotalUploadsSize != 256*skynet.KiB {
+		t.Fatalf("Unexpected stats %+v, error %v", stats, err)
+	}
+
+	// Invalid and unknown skylinks.
+	s, err = at.UploadsRepinPOST("not a skylink")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	s, err = at.UploadsRepinPOST(test.RandomSkylink())
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+	// Purged skylinks can't be repinned.
+	sl3, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 64*skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = at.UploadsDELETE(sl3.Skylink); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = at.DB.SkylinkPurge(at.Ctx, sl3.Skylink); err != nil {
+		t.Fatal(err)
+	}
+	s, err = at.UploadsRepinPOST(sl3.Skylink)
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+
+	// Repin the first upload.
+	s, err = at.UploadsRepinPOST(sl1.Skylink)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	ups, _, err = at.UserUploadsGET(url.Values{"includeUnpinned": []string{"true"}})
+	if err != nil || len(ups.Items) != 2 {
+		t.Fatalf("Expected both uploads, got %+v and %v", ups, err)
+	}
+	for _, up := range ups.Items {
+		if up.Unpinned || up.UnpinnedAt != nil {
+			t.Fatalf("Expected upload %+v to be pinned", up)
+		}
+	}
+	stats, _, err = at.UserStats("", nil)
+	if err != nil || stats.NumUploads != 2 || stats.TotalUploadsSize != 384*skynet.KiB {
+		t.Fatalf("Unexpected stats %+v, error %v", stats, err)
+	}
+	// The user is over quota now.
+	err = build.Retry(20, 100*time.Millisecond, func() error {
+		u2, err := at.DB.UserBySub(at.Ctx, u.Sub)
+		if err != nil {
+			return err
+		}
+		if !u2.QuotaExceeded {
+			return errors.New("expected the user to exceed their quota")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Repinning is idempotent.
+	s, err = at.UploadsRepinPOST(sl1.Skylink)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	// Repinning is refused when the upload doesn't fit in the storage quota.
+	if _, err = at.UploadsDELETE(sl1.Skylink); err != nil {
+		t.Fatal(err)
+	}
+	storage := int64(64 * skynet.KiB)
+	_, _, err = at.AdminLimitsPUT(adminKey, database.TierFree, database.TierLimitsOverride{MaxNumberUploads: &maxNumUploads, Storage: &storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = at.UploadsRepinPOST(sl1.Skylink)
+	if err == nil || s != http.StatusTooManyRequests || test.ErrorCode(err.Error()) != api.ErrCodeQuotaExceeded {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusTooManyRequests, s, err)
+	}
+	stats, _, err = at.UserStats("", nil)
+	if err != nil || stats.NumUploads != 1 || stats.TotalUploadsSize != 256*skynet.KiB {
+		t.Fatalf("Unexpected stats %+v, error %v", stats, err)
+	}
+}
+
+// testUserUploadsBulkDeletePOST tests the POST /user/uploads-bulk-delete
+// endpoint.
+func testUserUploadsBulkDeletePOST(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// An empty list is a no-op.
+	resp, s, err := at.UploadsBulkDeletePOST([]string{})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if resp.Unpinned != 0 || len(resp.Invalid) != 0 || len(resp.NotFound) != 0 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	// Too many skylinks.
+	tooMany := make([]string, api.MaxBulkDeleteSkylinks+1)
+	for i := range tooMany {
+		tooMany[i] = test.RandomSkylink()
+	}
+	_, s, err = at.UploadsBulkDeletePOST(tooMany)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+
+	// Create a few uploads.
+	sl1, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 128%skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl2, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 128%skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl3, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 128%skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upload the first skylink twice.
+	_, _, err = test.RegisterTestUpload(at.Ctx, at.DB, *u.User, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Delete two of them, along with an invalid skylink and one which the
+	// user hasn't uploaded.
+	unknown := test.RandomSkylink()
+	resp, s, err = at.UploadsBulkDeletePOST([]string{sl1.Skylink, sl2.Skylink, "not a skylink", unknown})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if resp.Unpinned != 3 {
+		t.Fatalf("Expected 3 unpinned uploads, got %d", resp.Unpinned)
+	}
+	if len(resp.Invalid) != 1 || resp.Invalid[0] != "not a skylink" {
+		t.Fatalf("Unexpected invalid skylinks %v", resp.Invalid)
+	}
+	if len(resp.NotFound) != 1 || resp.NotFound[0] != unknown {
+		t.Fatalf("Unexpected not found skylinks %v", resp.NotFound)
+	}
+	// Only the third upload should remain.
+	ups, _, err := at.UserUploadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups.Items) != 1 || ups.Items[0].Skylink != sl3.Skylink {
+		t.Fatalf("Expected to have a single upload of %s, got %+v", sl3.Skylink, ups)
+	}
+	// Deleting the same skylinks again should report them as not found.
+	resp, _, err = at.UploadsBulkDeletePOST([]string{sl1.Skylink, sl2.Skylink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Unpinned != 0 || len(resp.NotFound) != 2 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+}
+
+// testUserDownloadsSummary tests GET /user/downloads?groupBy=skylink.
+func testUserDownloadsSummary(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Invalid groupBy value.
+	params := url.Values{}
+	params.Set("groupBy", "name")
+	_, s, err := at.UserDownloadsGET(params)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	// No downloads.
+	sum, _, err := at.UserDownloadsSummaryGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Count != 0 || len(sum.Items) != 0 {
+		t.Fatalf("Expected no downloads, got %+v", sum)
+	}
+
+	// Create two skylinks with known sizes.
+	sl1, err := at.DB.Skylink(at.Ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = at.DB.SkylinkUpdate(at.Ctx, sl1.ID, "one", 1000); err != nil {
+		t.Fatal(err)
+	}
+	sl2, err := at.DB.Skylink(at.Ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = at.DB.SkylinkUpdate(at.Ctx, sl2.ID, "two", 500); err != nil {
+		t.Fatal(err)
+	}
+	// Download the first skylink three times: twice in full and once
+	// partially. Download the second one once in full.
+	for _, bytes := range []int64{0, 0, 100} {
+		if _, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *sl1, bytes, primitive.ObjectID{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *sl2, 0, primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, _, err = at.UserDownloadsSummaryGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Count != 2 || len(sum.Items) != 2 {
+		t.Fatalf("Expected 2 skylinks, got %+v", sum)
 	}
-	// Ensure we're not case-sensitive.
-	tlBytes2, _, err := at.UserLimits("ByTe", nil)
+	// The most downloaded skylink comes first.
+	first, second := sum.Items[0], sum.Items[1]
+	if first.Skylink != sl1.Skylink || first.Downloads != 3 || first.BytesServed != 2100 || first.Name != "one" || first.Size != 1000 {
+		t.Fatalf("Unexpected summary of the first skylink %+v", first)
+	}
+	if second.Skylink != sl2.Skylink || second.Downloads != 1 || second.BytesServed != 500 {
+		t.Fatalf("Unexpected summary of the second skylink %+v", second)
+	}
+	if first.LastDownloadedAt.IsZero() || second.LastDownloadedAt.IsZero() {
+		t.Fatal("Expected the last download times to be set.")
+	}
+	// Pagination works on the grouped results.
+	params = url.Values{}
+	params.Set("pageSize", "1")
+	params.Set("offset", "1")
+	sum, _, err = at.UserDownloadsSummaryGET(params)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if tlBytes2.UploadBandwidth != tlBytes.UploadBandwidth || tlBytes2.DownloadBandwidth != tlBytes.DownloadBandwidth {
-		t.Fatalf("Got different values for different capitalizations of 'byte'.\nValues for 'byte': %+v, values for 'ByTe': %+v", tlBytes, tlBytes2)
+	if sum.Count != 2 || len(sum.Items) != 1 || sum.Items[0].Skylink != sl2.Skylink {
+		t.Fatalf("Unexpected page %+v", sum)
 	}
 }
 
-// testUserUploadsDELETE tests the DELETE /user/uploads/:skylink endpoint.
-func testUserUploadsDELETE(t *testing.T, at *test.AccountsTester) {
+// testUserDownloadsDELETE tests the DELETE /user/downloads endpoint.
+func testUserDownloadsDELETE(t *testing.T, at *test.AccountsTester) {
 	u, c, err := test.CreateUserAndLogin(at, t.Name())
 	if err != nil {
 		t.Fatal("Failed to create a user and log in:", err)
@@ -620,41 +1704,62 @@ func testUserUploadsDELETE(t *testing.T, at *test.AccountsTester) {
 			t.Error(errors.AddContext(err, "failed to delete user in defer"))
 		}
 	}()
-
 	at.SetCookie(c)
 	defer at.ClearCredentials()
 
-	// Create an upload.
-	skylink, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, 128%skynet.KiB)
-	// Make sure it shows up for this user.
-	ups, _, err := at.UserUploadsGET()
+	// Invalid before value.
+	params := url.Values{}
+	params.Set("before", "yesterday")
+	_, s, err := at.UserDownloadsDELETE(params)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+
+	// Create two downloads, some time apart.
+	sl, err := at.DB.Skylink(at.Ctx, test.RandomSkylink())
 	if err != nil {
 		t.Fatal(err)
 	}
-	// We expect to have a single upload, and we expect it to be of this skylink.
-	if len(ups.Items) != 1 || ups.Items[0].Skylink != skylink.Skylink {
-		t.Fatalf("Expected to have a single upload of %s, got %+v", skylink.Skylink, ups)
+	if _, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *sl, 0, primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
 	}
-	// Try to delete the upload without passing a JWT cookie.
-	at.ClearCredentials()
-	_, err = at.UploadsDELETE(skylink.Skylink)
-	if err == nil || !strings.Contains(err.Error(), unauthorized) {
-		t.Fatalf("Expected error %s, got %s", unauthorized, err)
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	if _, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *sl, 0, primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
 	}
-	at.SetCookie(c)
-	// Delete it.
-	_, err = at.UploadsDELETE(skylink.Skylink)
+
+	// Delete the downloads made before the second one.
+	params.Set("before", between.Format(time.RFC3339Nano))
+	dr, _, err := at.UserDownloadsDELETE(params)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Make sure it's gone.
-	ups, _, err = at.UserUploadsGET()
+	if dr.Deleted != 1 {
+		t.Fatalf("Expected 1 deleted download, got %d", dr.Deleted)
+	}
+	downs, _, err := at.UserDownloadsGET(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// We expect to have no uploads.
-	if len(ups.Items) != 0 {
-		t.Fatalf("Expected to have a no uploads, got %+v", ups)
+	if downs.Count != 1 || downs.Items[0].CreatedAt.Before(between) {
+		t.Fatalf("Expected only the second download to remain, got %+v", downs)
+	}
+	// Delete the rest.
+	dr, _, err = at.UserDownloadsDELETE(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dr.Deleted != 1 {
+		t.Fatalf("Expected 1 deleted download, got %d", dr.Deleted)
+	}
+	downs, _, err = at.UserDownloadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downs.Count != 0 {
+		t.Fatalf("Expected no downloads, got %+v", downs)
 	}
 }
 
@@ -721,12 +1826,12 @@ func testUserConfirmReconfirmEmailGET(t *testing.T, at *test.AccountsTester) {
 		t.Fatalf("Expected '%s', got '%s'", badRequest, err)
 	}
 	// Call the endpoint with an expired token.
-	u.EmailConfirmationTokenExpiration = time.Now().Add(-time.Hour).UTC()
-	err = at.DB.UserSave(at.Ctx, u.User)
+	u3.EmailConfirmationTokenExpiration = time.Now().Add(-time.Hour).UTC()
+	err = at.DB.UserSave(at.Ctx, u3)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.UserConfirmGET(u.EmailConfirmationToken)
+	_, err = at.UserConfirmGET(u3.EmailConfirmationToken)
 	if err == nil || !strings.Contains(err.Error(), badRequest) {
 		t.Fatalf("Expected '%s', got '%s'", badRequest, err)
 	}
@@ -856,12 +1961,12 @@ func testUserAccountRecovery(t *testing.T, at *test.AccountsTester) {
 		t.Fatal(err, string(b))
 	}
 	// Make sure the reset token is removed from the user.
-	u2, err := at.DB.UserByEmail(at.Ctx, u.Email)
+	tokens, err := at.DB.RecoveryTokensByUser(at.Ctx, *u.User)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if u2.RecoveryToken != "" {
-		t.Fatalf("Expected recovery token to be empty, got '%s'", u2.RecoveryToken)
+	if len(tokens) != 0 {
+		t.Fatalf("Expected no recovery tokens, got %v", tokens)
 	}
 	// Make extra sure we cannot sue the token again. This is only to make sure
 	// we didn't cache it anywhere or allow it to somehow linger somewhere.
@@ -922,11 +2027,12 @@ func testTrackingAndStats(t *testing.T, at *test.AccountsTester) {
 	expectedStats.RawStorageUsed += skynet.RawStorageUsed(0)
 	expectedStats.RawStorageUsedTotal += skynet.RawStorageUsed(0)
 
-	// Call trackDownload without a cookie. Expect this to fail.
+	// Call trackDownload without a cookie. We expect this to succeed but it
+	// won't count towards the user's stats.
 	at.ClearCredentials()
 	_, err = at.TrackDownload(skylink.String(), 100)
-	if err == nil {
-		t.Fatal("Expects anonymous download to fail.")
+	if err != nil {
+		t.Fatal(err)
 	}
 	at.SetCookie(c)
 	// Call trackDownload with an invalid skylink.
@@ -1052,3 +2158,423 @@ func testUserFlow(t *testing.T, at *test.AccountsTester) {
 		t.Fatalf("Expected to get %s, got %s.", unauthorized, err)
 	}
 }
+
+// testUserStatsHistory ensures userStatsHistoryGET validates and caps the
+// number of months and reports the current month's usage.
+func testUserStatsHistory(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	_, _, err = test.CreateTestUpload(at.Ctx, at.DB, *u.User, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hist, _, err := at.UserStatsHistoryGET("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != api.DefaultStatsHistoryMonths {
+		t.Fatalf("Expected %d months, got %d", api.DefaultStatsHistoryMonths, len(hist))
+	}
+	current := hist[len(hist)-1]
+	if current.NumUploads != 1 || current.BandwidthUploads != skynet.BandwidthUploadCost(1000) {
+		t.Fatalf("Expected a single upload in the current month, got %+v", current)
+	}
+	hist, _, err = at.UserStatsHistoryGET("100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != database.UserStatsHistoryMaxMonths {
+		t.Fatalf("Expected %d months, got %d", database.UserStatsHistoryMaxMonths, len(hist))
+	}
+	for _, m := range []string{"0", "-1", "six"} {
+		_, status, err := at.UserStatsHistoryGET(m)
+		if err == nil || status != http.StatusBadRequest {
+			t.Fatalf("Expected %d for '%s', got %d '%v'", http.StatusBadRequest, m, status, err)
+		}
+	}
+}
+
+// testUserStatsTop ensures that GET /user/stats reports the largest uploads
+// and the most downloaded skylinks when asked to and only then.
+func testUserStatsTop(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	var skylinks []*database.Skylink
+	for _, size := range []int64{100, 300, 200} {
+		sl, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skylinks = append(skylinks, sl)
+	}
+	// Download the first skylink twice and the second one once, but with
+	// more bytes. The download of the third one doesn't report its bytes, so
+	// it counts with the skylink's full size.
+	for _, d := range []struct {
+		sl    *database.Skylink
+		bytes int64
+	}{{skylinks[0], 10}, {skylinks[0], 10}, {skylinks[1], 50}, {skylinks[2], 0}} {
+		_, err = at.DB.DownloadCreate(at.Ctx, *u.User, "", *d.sl, d.bytes, primitive.ObjectID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, _, err := at.UserStatsTopGET("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.UserStats == nil || stats.NumUploads != 3 {
+		t.Fatalf("Expected the regular stats as well, got %+v", stats.UserStats)
+	}
+	if len(stats.TopUploads) != 2 {
+		t.Fatalf("Expected 2 top uploads, got %+v", stats.TopUploads)
+	}
+	for i, sl := range []*database.Skylink{skylinks[1], skylinks[2]} {
+		up := stats.TopUploads[i]
+		if up.Skylink != sl.Skylink || up.Size != sl.Size || up.RawStorage != skynet.RawStorageUsed(sl.Size) {
+			t.Fatalf("Expected top upload %d to be %s, got %+v", i, sl.Skylink, up)
+		}
+	}
+	expectedDownloads := []database.UserStatsTopDownload{
+		{Skylink: skylinks[2].Skylink, Count: 1, Bytes: 200},
+		{Skylink: skylinks[1].Skylink, Count: 1, Bytes: 50},
+	}
+	if !reflect.DeepEqual(stats.TopDownloads, expectedDownloads) {
+		t.Fatalf("Expected top downloads %+v, got %+v", expectedDownloads, stats.TopDownloads)
+	}
+
+	// We cap the number of top skylinks and reject invalid ones.
+	stats, _, err = at.UserStatsTopGET("1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.TopUploads) != 3 || len(stats.TopDownloads) != 3 {
+		t.Fatalf("Expected all skylinks, got %+v and %+v", stats.TopUploads, stats.TopDownloads)
+	}
+	for _, top := range []string{"0", "-1", "ten"} {
+		_, status, err := at.UserStatsTopGET(top)
+		if err == nil || status != http.StatusBadRequest {
+			t.Fatalf("Expected %d for '%s', got %d '%v'", http.StatusBadRequest, top, status, err)
+		}
+	}
+
+	// Without `top` the response doesn't change.
+	var obj map[string]interface{}
+	_, err = at.Request(http.MethodGet, "/user/stats", nil, nil, nil, &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := obj["topUploads"]; exists {
+		t.Fatalf("Expected no top uploads, got %v", obj)
+	}
+}
+
+// testUserETag ensures that GET /user and GET /user/limits respond with 304
+// when the caller already has the current version of the response and with a
+// fresh 200 once the user's tier changes.
+func testUserETag(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+
+	// get performs a GET request against the given endpoint with the given
+	// If-None-Match header and returns the status and the ETag.
+	get := func(endpoint, ifNoneMatch string) (int, string) {
+		headers := map[string]string{}
+		if ifNoneMatch != "" {
+			headers["If-None-Match"] = ifNoneMatch
+		}
+		var obj interface{}
+		r, err := at.Request(http.MethodGet, endpoint, nil, nil, headers, &obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode == http.StatusNotModified && obj != nil {
+			t.Fatalf("Expected no body with %d, got %v", http.StatusNotModified, obj)
+		}
+		return r.StatusCode, r.Header.Get("ETag")
+	}
+
+	endpoints := []string{"/user", "/user/limits"}
+	etags := make(map[string]string)
+	for _, ep := range endpoints {
+		status, etag := get(ep, "")
+		if status != http.StatusOK || etag == "" {
+			t.Fatalf("%s: expected %d with an ETag, got %d and '%s'", ep, http.StatusOK, status, etag)
+		}
+		// Replay the request with the ETag.
+		status, etag2 := get(ep, etag)
+		if status != http.StatusNotModified || etag2 != etag {
+			t.Fatalf("%s: expected %d with ETag '%s', got %d and '%s'", ep, http.StatusNotModified, etag, status, etag2)
+		}
+		// A different ETag gets a full response.
+		status, _ = get(ep, `W/"something else"`)
+		if status != http.StatusOK {
+			t.Fatalf("%s: expected %d, got %d", ep, http.StatusOK, status)
+		}
+		etags[ep] = etag
+	}
+
+	// Change the user's tier and expect fresh responses.
+	_, s, err := at.AdminUserTierPOST(adminKey, u.Sub, database.TierPremium20)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	for _, ep := range endpoints {
+		status, etag := get(ep, etags[ep])
+		if status != http.StatusOK || etag == etags[ep] {
+			t.Fatalf("%s: expected %d with a new ETag, got %d and '%s'", ep, http.StatusOK, status, etag)
+		}
+	}
+}
+
+// testUserRegistryEvents ensures that users can page through their registry
+// reads and writes.
+func testUserRegistryEvents(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// The user has no registry events yet.
+	rr, _, err := at.UserRegistryReadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Count != 0 || len(rr.Items) != 0 {
+		t.Fatalf("Expected no registry reads, got %+v", rr)
+	}
+	// Create some registry events.
+	var lastRead *database.RegistryRead
+	for i := 0; i < 5; i++ {
+		lastRead, err = at.DB.RegistryReadCreate(at.Ctx, *u.User, primitive.ObjectID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		_, err = at.DB.RegistryWriteCreate(at.Ctx, *u.User, primitive.ObjectID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Page through the reads.
+	params := url.Values{}
+	params.Set("pageSize", "2")
+	rr, _, err = at.UserRegistryReadsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Count != 5 || len(rr.Items) != 2 || rr.PageSize != 2 {
+		t.Fatalf("Expected 2 out of 5 registry reads, got %+v", rr)
+	}
+	if rr.Items[0].ID != lastRead.ID {
+		t.Fatalf("Expected the most recent read '%s' first, got '%s'", lastRead.ID.Hex(), rr.Items[0].ID.Hex())
+	}
+	for _, r := range rr.Items {
+		if r.UserID != u.ID || r.Timestamp.IsZero() {
+			t.Fatalf("Unexpected registry read %+v", r)
+		}
+	}
+	params.Set("offset", "4")
+	rr, _, err = at.UserRegistryReadsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Count != 5 || len(rr.Items) != 1 || rr.Offset != 4 {
+		t.Fatalf("Expected the last registry read, got %+v", rr)
+	}
+	params.Set("offset", "5")
+	rr, _, err = at.UserRegistryReadsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Count != 5 || len(rr.Items) != 0 {
+		t.Fatalf("Expected no registry reads past the end, got %+v", rr)
+	}
+	// Get all writes with the default page size.
+	rw, _, err := at.UserRegistryWritesGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw.Count != 3 || len(rw.Items) != 3 || rw.PageSize != api.DefaultPageSizeSmall {
+		t.Fatalf("Expected 3 registry writes, got %+v", rw)
+	}
+	// Invalid paging parameters.
+	params = url.Values{}
+	params.Set("pageSize", "-1")
+	_, s, err := at.UserRegistryWritesGET(params)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+}
+
+// testPublicEndpointsHEAD ensures that the public endpoints support HEAD
+// requests and that they allow CDNs to cache their responses.
+func testPublicEndpointsHEAD(t *testing.T, at *test.AccountsTester) {
+	for _, endpoint := range []string{"/limits", "/.well-known/jwks.json"} {
+		rHead, b, err := at.Head(endpoint)
+		if err != nil || rHead.StatusCode != http.StatusOK {
+			t.Fatalf("Expected %d on HEAD %s, got %d and %v", http.StatusOK, endpoint, rHead.StatusCode, err)
+		}
+		if len(b) != 0 {
+			t.Fatalf("Expected an empty body on HEAD %s, got '%s'", endpoint, string(b))
+		}
+		rGet, err := at.Request(http.MethodGet, endpoint, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := rGet.Header.Get("Cache-Control")
+		if !strings.HasPrefix(cc, "public, max-age=") {
+			t.Fatalf("Unexpected Cache-Control header on GET %s: '%s'", endpoint, cc)
+		}
+		for _, h := range []string{"Cache-Control", "Content-Type"} {
+			if rHead.Header.Get(h) != rGet.Header.Get(h) {
+				t.Fatalf("Expected the same %s on GET and HEAD %s, got '%s' and '%s'", h, endpoint, rGet.Header.Get(h), rHead.Header.Get(h))
+			}
+		}
+	}
+}
+
+// testUserSubscription ensures that GET /user returns the user's subscription
+// from our records and that asking for a refresh is a no-op when Stripe is not
+// configured.
+func testUserSubscription(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// The user doesn't have a subscription, yet.
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.Subscription != nil {
+		t.Fatalf("Expected no subscription, got %+v", ug.Subscription)
+	}
+	// Give the user a subscription.
+	u.Tier = database.TierPremium5
+	u.StripeID = "cus_" + name
+	u.SubscriptionStatus = "active"
+	u.SubscribedUntil = time.Now().UTC().Add(24 * time.Hour).Truncate(time.Millisecond)
+	u.SubscriptionCancelAt = u.SubscribedUntil
+	u.SubscriptionCancelAtPeriodEnd = true
+	err = at.DB.UserSave(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect to get the subscription, with and without a refresh. Stripe is
+	// not configured, so the refresh doesn't change anything.
+	for _, params := range []url.Values{nil, {"refresh": {"true"}}} {
+		var ug api.UserGET
+		_, err = at.Request(http.MethodGet, "/user", params, nil, nil, &ug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := ug.Subscription
+		if sub == nil {
+			t.Fatal("Expected a subscription.")
+		}
+		if sub.Status != u.SubscriptionStatus || sub.TierID != u.Tier || sub.TierName != database.LimitsForTier(u.Tier).TierName {
+			t.Fatalf("Unexpected subscription %+v", sub)
+		}
+		if !sub.CurrentPeriodEnd.Equal(u.SubscribedUntil) || !sub.CancelAt.Equal(u.SubscriptionCancelAt) || !sub.CancelAtPeriodEnd {
+			t.Fatalf("Unexpected subscription %+v", sub)
+		}
+	}
+}
+
+// testPageSize ensures that the paginated endpoints reject page sizes outside
+// of the allowed range and that GET /limits tells clients what that range is.
+func testPageSize(t *testing.T, at *test.AccountsTester) {
+	lg, _, err := at.LimitsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lg.DefaultPageSize != api.DefaultPageSizeSmall || lg.MaxPageSize != api.MaxPageSize {
+		t.Fatalf("Expected default page size %d and max page size %d, got %d and %d", api.DefaultPageSizeSmall, api.MaxPageSize, lg.DefaultPageSize, lg.MaxPageSize)
+	}
+
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	tests := []struct {
+		pageSize int
+		expected int
+		status   int
+	}{
+		{pageSize: 0, expected: api.DefaultPageSizeSmall, status: http.StatusOK},
+		{pageSize: api.MaxPageSize, expected: api.MaxPageSize, status: http.StatusOK},
+		{pageSize: api.MaxPageSize + 1, status: http.StatusBadRequest},
+		{pageSize: -1, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		params := url.Values{"pageSize": {strconv.Itoa(tt.pageSize)}}
+		ups, s, err := at.UserUploadsGET(params)
+		if s != tt.status {
+			t.Fatalf("Expected %d for page size %d, got %d and %v", tt.status, tt.pageSize, s, err)
+		}
+		if tt.status == http.StatusOK && ups.PageSize != tt.expected {
+			t.Fatalf("Expected page size %d, got %d", tt.expected, ups.PageSize)
+		}
+	}
+}
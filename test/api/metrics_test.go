@@ -0,0 +1,75 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// testMetrics ensures that GET /metrics reports the requests we make.
+func testMetrics(t *testing.T, at *test.AccountsTester) {
+	healthSeries := `accounts_http_requests_total{route="/health",method="GET",status="200"}`
+	loginFailureSeries := `accounts_logins_total{result="failure"}`
+	pingSeries := `accounts_mongo_ping_duration_seconds_count`
+
+	before, status, err := at.MetricsGET()
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+	// Make a few requests which should be reflected in the metrics.
+	for i := 0; i < 2; i++ {
+		_, _, err = at.HealthGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = at.LoginCredentialsPOST(test.DBNameForTest(t.Name())+"@siasky.net", "wrong password")
+	if err == nil {
+		t.Fatal("Expected the login to fail.")
+	}
+	after, status, err := at.MetricsGET()
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+
+	if d := metricValue(after, healthSeries) - metricValue(before, healthSeries); d != 2 {
+		t.Fatalf("Expected %s to increase by 2, got %v", healthSeries, d)
+	}
+	if d := metricValue(after, loginFailureSeries) - metricValue(before, loginFailureSeries); d != 1 {
+		t.Fatalf("Expected %s to increase by 1, got %v", loginFailureSeries, d)
+	}
+	// Both the health checks and the scrape itself ping the database.
+	if d := metricValue(after, pingSeries) - metricValue(before, pingSeries); d < 3 {
+		t.Fatalf("Expected %s to increase by at least 3, got %v", pingSeries, d)
+	}
+	// Make sure the scrape itself was counted under its route and not under
+	// its path.
+	if metricValue(after, `accounts_http_requests_total{route="/metrics",method="GET",status="200"}`) == 0 {
+		t.Fatal("Expected the /metrics requests to be counted.")
+	}
+	if !strings.Contains(after, "# TYPE accounts_metafetcher_queue_depth gauge") {
+		t.Fatal("Expected the metafetcher queue depth to be reported.")
+	}
+}
+
+// metricValue returns the value of the given series from the Prometheus text
+// output or zero if the series is not there.
+func metricValue(body, series string) float64 {
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, series+" ") {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+		if err != nil {
+			return 0
+		}
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/build"
+)
+
+// testOrganizations ensures that users can create an organization, invite
+// others to it, and remove them again, and that all members share the
+// organization's tier and pooled quota.
+func testOrganizations(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	owner, cOwner, err := test.CreateUserAndLogin(at, name+"_owner")
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	member, cMember, err := test.CreateUserAndLogin(at, name+"_member")
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		for _, u := range []*test.User{member, owner} {
+			if err = u.Delete(at.Ctx); err != nil {
+				t.Error(errors.AddContext(err, "failed to delete user in defer"))
+			}
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// Create an organization.
+	at.SetCookie(cOwner)
+	_, s, err := at.OrgPOST(" ")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	org, s, err := at.OrgPOST("team")
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if org.Name != "team" || org.Tier != database.TierFree || len(org.Members) != 1 || !org.Members[0].Owner {
+		t.Fatalf("Unexpected organization %+v", org)
+	}
+	orgID := org.ID.Hex()
+	_, s, err = at.OrgPOST("another team")
+	if err == nil || s != http.StatusConflict {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusConflict, s, err)
+	}
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.OrgID != orgID {
+		t.Fatalf("Expected organization %s, got '%s'", orgID, ug.OrgID)
+	}
+
+	// Invite the member. We take the token from the DB instead of the email.
+	s, err = at.OrgInvitesPOST(orgID, member.Email)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	dbOrg, err := at.DB.OrgByID(at.Ctx, org.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbOrg.Invites) != 1 || dbOrg.Invites[0].Email != member.Email {
+		t.Fatalf("Expected one invite for %s, got %+v", member.Email, dbOrg.Invites)
+	}
+	at.SetCookie(cMember)
+	// The organization is invisible to non-members.
+	_, s, err = at.OrgGET(orgID)
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+	_, s, err = at.OrgInvitesAcceptGET("invalid token")
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	_, s, err = at.OrgInvitesAcceptGET(dbOrg.Invites[0].Token)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	org, s, err = at.OrgGET(orgID)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if len(org.Members) != 2 {
+		t.Fatalf("Expected 2 members, got %d", len(org.Members))
+	}
+	// Only the owner can manage the organization.
+	s, err = at.OrgInvitesPOST(orgID, "someone@siasky.net")
+	if err == nil || s != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusForbidden, s, err)
+	}
+	s, err = at.OrgMemberDELETE(orgID, owner.Sub)
+	if err == nil || s != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusForbidden, s, err)
+	}
+
+	// Organizations can only have a limited number of outstanding invites.
+	// Inviting the same address again replaces its invite.
+	oldMaxInvites := database.MaxOrgInvites
+	database.MaxOrgInvites = 1
+	defer func() { database.MaxOrgInvites = oldMaxInvites }()
+	at.SetCookie(cOwner)
+	if s, err = at.OrgInvitesPOST(orgID, "first@siasky.net"); err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	s, err = at.OrgInvitesPOST(orgID, "second@siasky.net")
+	if err == nil || s != http.StatusBadRequest || test.ErrorCode(err.Error()) != api.ErrCodeOrgInviteLimitReached {
+		t.Fatalf("Expected %d with code '%s', got %d and %v", http.StatusBadRequest, api.ErrCodeOrgInviteLimitReached, s, err)
+	}
+	if s, err = at.OrgInvitesPOST(orgID, "first@siasky.net"); err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	at.SetCookie(cMember)
+
+	// The admin sets the organization's tier. It applies to all members.
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	_, s, err = at.AdminOrgTierPOST(adminKey, orgID, database.TierPremium20)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	ul, _, err := at.UserLimits("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, ul.TierID)
+	}
+
+	// Each member uses a little over half of the organization's storage, so
+	// together they exceed it.
+	size := database.LimitsForTier(database.TierPremium20).Storage/2 + 1
+	for _, u := range []*test.User{owner, member} {
+		_, _, err = test.CreateTestUpload(at.Ctx, at.DB, *u.User, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Setting the tier again rechecks the pooled quota.
+	_, s, err = at.AdminOrgTierPOST(adminKey, orgID, database.TierPremium20)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	err = build.Retry(10, 200*time.Millisecond, func() error {
+		ul, _, err = at.UserLimits("byte", nil)
+		if err != nil {
+			return err
+		}
+		if ul.UploadBandwidth != database.UserLimits[database.TierAnonymous].UploadBandwidth {
+			return fmt.Errorf("expected upload bandwidth %d, got %d", database.UserLimits[database.TierAnonymous].UploadBandwidth, ul.UploadBandwidth)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, s, err := at.OrgUsageGET(orgID)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	if !usage.QuotaExceeded || usage.NumUploads != 2 || usage.UploadsSize != 2*size || len(usage.Members) != 2 {
+		t.Fatalf("Unexpected usage %+v", usage)
+	}
+
+	// The owner removes the member. They can't remove themselves.
+	at.SetCookie(cOwner)
+	s, err = at.OrgMemberDELETE(orgID, owner.Sub)
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+	}
+	s, err = at.OrgMemberDELETE(orgID, member.Sub)
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+	at.SetCookie(cMember)
+	ul, _, err = at.UserLimits("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+	_, s, err = at.OrgGET(orgID)
+	if err == nil || s != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNotFound, s, err)
+	}
+}
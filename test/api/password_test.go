@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testPasswordPolicy ensures that we reject unacceptable new passwords when
+// creating a user, updating them, and recovering their account.
+func testPasswordPolicy(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	defer at.ClearCredentials()
+
+	// Try to create a user with unacceptable passwords.
+	tests := []struct {
+		password string
+		code     string
+	}{
+		{password: "short", code: api.ErrCodePasswordTooShort},
+		{password: name, code: api.ErrCodePasswordMatchesEmail},
+		{password: "Password123", code: api.ErrCodePasswordTooCommon},
+	}
+	for _, tt := range tests {
+		r, b, err := at.UserPOST(email.String(), tt.password)
+		if err == nil || r.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, r.StatusCode, err)
+		}
+		if code := test.ErrorCode(string(b)); code != tt.code {
+			t.Fatalf("Expected code '%s', got '%s'", tt.code, code)
+		}
+	}
+	// Create the user with an acceptable password.
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+
+	// Try to change the password to unacceptable ones.
+	for _, tt := range tests {
+		_, s, err := at.UserPUT("", tt.password, "")
+		if err == nil || s != http.StatusBadRequest {
+			t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+		}
+		if code := test.ErrorCode(err.Error()); code != tt.code {
+			t.Fatalf("Expected code '%s', got '%s'", tt.code, code)
+		}
+	}
+	// Change the password to an acceptable one.
+	password = hex.EncodeToString(fastrand.Bytes(16))
+	_, s, err := at.UserPUT("", password, "")
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusOK, s, err)
+	}
+
+	// Request a recovery token.
+	at.ClearCredentials()
+	_, err = at.UserRecoverRequestPOST(email.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ru, err := at.DB.UserByEmail(at.Ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := test.LatestRecoveryToken(at.Ctx, at.DB, *ru)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Try to recover the account with unacceptable passwords.
+	for _, tt := range tests {
+		s, err = at.UserRecoverPOST(token, tt.password, tt.password)
+		if err == nil || s != http.StatusBadRequest {
+			t.Fatalf("Expected %d, got %d and %v", http.StatusBadRequest, s, err)
+		}
+		if code := test.ErrorCode(err.Error()); code != tt.code {
+			t.Fatalf("Expected code '%s', got '%s'", tt.code, code)
+		}
+	}
+	// Recover the account with an acceptable password.
+	password = hex.EncodeToString(fastrand.Bytes(16))
+	s, err = at.UserRecoverPOST(token, password, password)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d and %v", http.StatusNoContent, s, err)
+	}
+	// Make sure the new password works.
+	_, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testUserAccountRecoveryTokens ensures that users can have several
+// outstanding recovery tokens, that using one of them invalidates the rest and
+// that expired tokens are rejected the same way as invalid ones. It also
+// ensures that we still accept tokens issued before we stored them in their
+// own collection.
+func testUserAccountRecoveryTokens(t *testing.T, at *test.AccountsTester) {
+	u, _, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.ClearCredentials()
+	password := hex.EncodeToString(fastrand.Bytes(16))
+
+	// expectInvalid ensures that the given token is rejected the same way as
+	// a token which never existed.
+	expectInvalid := func(token string) {
+		t.Helper()
+		status, err := at.UserRecoverPOST(token, password, password)
+		if status != http.StatusBadRequest || err == nil {
+			t.Fatalf("Expected %d, got %d '%v'", http.StatusBadRequest, status, err)
+		}
+		_, errRandom := at.UserRecoverPOST(hex.EncodeToString(fastrand.Bytes(16)), password, password)
+		if errRandom == nil || err.Error() != errRandom.Error() {
+			t.Fatalf("Expected the same error as for a nonexistent token, got '%v' and '%v'", err, errRandom)
+		}
+	}
+
+	// Request a recovery twice. Both tokens are valid.
+	_, err = at.UserRecoverRequestPOST(u.Email.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := test.LatestRecoveryToken(at.Ctx, at.DB, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.UserRecoverRequestPOST(u.Email.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := test.LatestRecoveryToken(at.Ctx, at.DB, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("Expected a new token.")
+	}
+	tokens, err := at.DB.RecoveryTokensByUser(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("Expected 2 tokens, got %d", len(tokens))
+	}
+	// Use the first token. The second one no longer works.
+	status, err := at.UserRecoverPOST(first, password, password)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	expectInvalid(first)
+	expectInvalid(second)
+
+	// Requesting more tokens than allowed invalidates the oldest ones.
+	maxTokens := database.MaxRecoveryTokensPerUser
+	database.MaxRecoveryTokensPerUser = 2
+	defer func() { database.MaxRecoveryTokensPerUser = maxTokens }()
+	var issued []string
+	for i := 0; i < 3; i++ {
+		_, err = at.UserRecoverRequestPOST(u.Email.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tk, err := test.LatestRecoveryToken(at.Ctx, at.DB, *u.User)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issued = append(issued, tk)
+	}
+	tokens, err = at.DB.RecoveryTokensByUser(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("Expected 2 tokens, got %d", len(tokens))
+	}
+	expectInvalid(issued[0])
+	status, err = at.UserRecoverPOST(issued[1], password, password)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	expectInvalid(issued[2])
+
+	// Expired tokens don't work.
+	ttl := database.RecoveryTokenTTL
+	database.RecoveryTokenTTL = 0
+	defer func() { database.RecoveryTokenTTL = ttl }()
+	rt, err := at.DB.RecoveryTokenCreate(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectInvalid(rt.Token)
+	database.RecoveryTokenTTL = ttl
+
+	// Tokens stored on the user record still work, once.
+	du, err := at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	du.RecoveryToken = hex.EncodeToString(fastrand.Bytes(16))
+	err = at.DB.UserSave(at.Ctx, du)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = at.UserRecoverPOST(du.RecoveryToken, password, password)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	expectInvalid(du.RecoveryToken)
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// testUserSessions ensures that users can list and revoke their sessions and
+// that revoked sessions stop working immediately.
+func testUserSessions(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	password := name + "_pass"
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	// Log in twice.
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := test.ExtractCookie(r)
+	r, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := test.ExtractCookie(r)
+	if c1 == nil || c2 == nil {
+		t.Fatal("Expected two cookies.")
+	}
+	// Find the jti of the second session. The user has one more session from
+	// signing up.
+	at.SetCookie(c2)
+	sessions, _, err := at.UserSessionsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %d", len(sessions))
+	}
+	var jti2 string
+	for _, s := range sessions {
+		if s.Current {
+			jti2 = s.JTI
+		}
+		if s.JTI == "" || s.CreatedAt.IsZero() || s.ExpiresAt.IsZero() || s.IP == "" {
+			t.Fatalf("Unexpected session %+v", s)
+		}
+	}
+	if jti2 == "" {
+		t.Fatal("Expected to find the current session.")
+	}
+	// Revoke the second session using the first one.
+	at.SetCookie(c1)
+	status, err := at.UserSessionDELETE(jti2)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	// Revoking it again fails.
+	status, _ = at.UserSessionDELETE(jti2)
+	if status != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, status)
+	}
+	// The first cookie still works, the second one doesn't.
+	_, status, err = at.UserGET()
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusOK, status, err)
+	}
+	at.SetCookie(c2)
+	_, status, _ = at.UserGET()
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, status)
+	}
+	// The revoked session can't be exchanged for a new cookie.
+	r, err = at.Request(http.MethodPost, "/login", nil, nil, nil, nil)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusUnauthorized, r.StatusCode, err)
+	}
+	// The revoked session doesn't get the user's limits.
+	ul, _, err := at.UserLimits("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, ul.TierID)
+	}
+	// The revoked session is no longer listed.
+	at.SetCookie(c1)
+	sessions, _, err = at.UserSessionsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.JTI == jti2 {
+			t.Fatal("Expected the revoked session to not be listed.")
+		}
+	}
+	// Revoke all sessions. This includes the current one.
+	status, err = at.UserSessionsDELETE()
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	_, status, _ = at.UserGET()
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, status)
+	}
+	// Logging in again works.
+	r, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	_, status, err = at.UserGET()
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusOK, status, err)
+	}
+}
+
+// testTokenRefresh ensures that users can refresh their JWTs, that the new
+// JWTs keep the TTL and session of the old ones, up to the maximum session
+// age, and that expired and revoked JWTs can't be refreshed.
+func testTokenRefresh(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	password := name + "_pass"
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	oldMaxAge := jwt.MaxSessionAge
+	defer func() {
+		jwt.MaxSessionAge = oldMaxAge
+	}()
+
+	// Refreshing without a JWT fails.
+	at.ClearCredentials()
+	r, _, _ := at.TokenRefreshPOST()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+
+	// Log in with a TTL of 100 seconds.
+	ttl := 100
+	r, _, err = at.LoginCredentialsPOSTWithTTL(email.String(), password, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := jwt.ValidateToken(r.Header.Get("Skynet-Token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	// The refreshed JWT keeps the session and the TTL.
+	jwt.MaxSessionAge = 3600
+	r, b, err := at.TokenRefreshPOST()
+	if err != nil || r.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%s' '%v'", http.StatusNoContent, r.StatusCode, string(b), err)
+	}
+	c := test.ExtractCookie(r)
+	if c == nil {
+		t.Fatal("Expected a cookie.")
+	}
+	ntk, err := jwt.ValidateToken(r.Header.Get("Skynet-Token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ntk.JwtID() != tk.JwtID() {
+		t.Fatalf("Expected jti %s, got %s", tk.JwtID(), ntk.JwtID())
+	}
+	if d := ntk.Expiration().Sub(ntk.IssuedAt()); d != time.Duration(ttl)*time.Second {
+		t.Fatalf("Expected a TTL of %ds, got %v", ttl, d)
+	}
+	// The refreshed JWT works.
+	at.SetCookie(c)
+	_, status, err := at.UserGET()
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusOK, status, err)
+	}
+	// The refreshed JWT never outlives the maximum session age.
+	maxAge := 50
+	jwt.MaxSessionAge = maxAge
+	r, b, err = at.TokenRefreshPOST()
+	if err != nil || r.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%s' '%v'", http.StatusNoContent, r.StatusCode, string(b), err)
+	}
+	ntk, err = jwt.ValidateToken(r.Header.Get("Skynet-Token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := tk.IssuedAt().Add(time.Duration(maxAge) * time.Second); ntk.Expiration().After(limit) {
+		t.Fatalf("Expected the JWT to expire no later than %v, got %v", limit, ntk.Expiration())
+	}
+	// Once the session has reached its maximum age, we can't refresh it.
+	jwt.MaxSessionAge = 1
+	time.Sleep(2 * time.Second)
+	r, _, _ = at.TokenRefreshPOST()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+	jwt.MaxSessionAge = 3600
+
+	// Refreshing an expired JWT fails.
+	r, _, err = at.LoginCredentialsPOSTWithTTL(email.String(), password, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	time.Sleep(2 * time.Second)
+	r, _, _ = at.TokenRefreshPOST()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+
+	// Refreshing a revoked JWT fails.
+	r, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	status, err = at.UserSessionsDELETE()
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	r, _, _ = at.TokenRefreshPOST()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+}
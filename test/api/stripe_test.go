@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -11,8 +13,12 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/test"
 	"github.com/SkynetLabs/skynet-accounts/test/fixtures"
+	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/joho/godotenv"
 	"github.com/stripe/stripe-go/v72"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/h2non/gock.v1"
 )
 
@@ -58,6 +64,7 @@ func TestStripe(t *testing.T) {
 		"get prices":    testStripePricesGET,
 		"post checkout": testStripeCheckoutPOST,
 		"get checkout":  testStripeCheckoutIDGET,
+		"api keys":      testStripeAPIKeys,
 	}
 
 	at, err := test.NewAccountsTester(t.Name(), "", nil)
@@ -164,6 +171,86 @@ func testStripeCheckoutPOST(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testStripeAPIKeys ensures that private API keys with full scope can be used
+// to start billing and checkout sessions, while read-only and public API keys
+// cannot.
+func testStripeAPIKeys(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	r, _, err := at.UserPOST(name+"@siasky.net", name+"pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	fullKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Scope: database.APIKeyScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Public: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Get a valid test price id.
+	var price string
+	for pid := range api.StripePrices() {
+		price = pid
+		break
+	}
+
+	at.SetFollowRedirects(false)
+
+	// Public API keys are rejected.
+	at.SetAPIKey(pubKey.Key.String())
+	_, s, err := at.StripeBillingGET()
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusUnauthorized, s, err)
+	}
+	_, s, err = at.StripeCheckoutPOST(price)
+	if err == nil || s != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusUnauthorized, s, err)
+	}
+	// Read-only API keys cannot open the billing portal or check out.
+	at.SetAPIKey(readKey.Key.String())
+	_, s, err = at.StripeBillingGET()
+	if err == nil || s != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusForbidden, s, err)
+	}
+	_, s, err = at.StripeCheckoutPOST(price)
+	if err == nil || s != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusForbidden, s, err)
+	}
+	// Private API keys with full scope work just like the cookie. The first
+	// request registers a Stripe customer for the user.
+	at.SetAPIKey(fullKey.Key.String())
+	sessID, s, err := at.StripeCheckoutPOST(price)
+	if err != nil || s != http.StatusOK || sessID == "" {
+		t.Fatalf("Expected %d and a session ID, got %d '%s' '%v'", http.StatusOK, s, sessID, err)
+	}
+	u, err := at.DB.UserByEmail(at.Ctx, types.NewEmail(name+"@siasky.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.StripeID == "" {
+		t.Fatal("Expected the user to have a Stripe customer.")
+	}
+	h, s, err := at.StripeBillingGET()
+	if err != nil || s != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected %d and no error, got %d '%v'", http.StatusTemporaryRedirect, s, err)
+	}
+	expectedRedirectPrefix := "https://billing.stripe.com/"
+	if !strings.HasPrefix(h.Get("Location"), expectedRedirectPrefix) {
+		t.Fatalf("Expected a redirect link with prefix '%s', got '%s'", expectedRedirectPrefix, h.Get("Location"))
+	}
+	// An invalid price fails the same way it does with a cookie.
+	_, s, err = at.StripeCheckoutPOST("price_invalid")
+	if err == nil || s != http.StatusInternalServerError {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusInternalServerError, s, err)
+	}
+}
+
 // testStripeCheckoutIDGET ensures that we can get the info for a checkout
 // session and act on it, i.e. promote the user, if needed.
 func testStripeCheckoutIDGET(t *testing.T, at *test.AccountsTester) {
@@ -299,3 +386,219 @@ func testStripePricesGET(t *testing.T, at *test.AccountsTester) {
 		t.Fatalf("Expected test prices %+v, got %+v", testPrices, ps)
 	}
 }
+
+// testStripeInvoiceWebhook ensures that we email users whose payments fail,
+// downgrade them after MaxPaymentFailures consecutive failures, and reset the
+// count on a successful payment.
+func testStripeInvoiceWebhook(t *testing.T, at *test.AccountsTester) {
+	// The webhook requires Stripe to be configured. We don't call Stripe when
+	// processing invoices, so a fake key suffices.
+	if stripe.Key == "" {
+		stripe.Key = "sk_test_FAKE_TEST_KEY"
+		defer func() { stripe.Key = "" }()
+	}
+	secret := "whsec_" + hex.EncodeToString(fastrand.Bytes(16))
+	oldSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	err := os.Setenv("STRIPE_WEBHOOK_SECRET", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Setenv("STRIPE_WEBHOOK_SECRET", oldSecret) }()
+	oldMax := api.MaxPaymentFailures
+	api.MaxPaymentFailures = 2
+	defer func() { api.MaxPaymentFailures = oldMax }()
+
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+	customerID := "cus_" + hex.EncodeToString(fastrand.Bytes(8))
+	_, _, err = at.UserPUT("", "", customerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = at.DB.UserSetTier(at.Ctx, u.User, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// invoiceEvent returns a serialised invoice event of the given type for
+	// our test customer.
+	invoiceEvent := func(eventType string) []byte {
+		return []byte(fmt.Sprintf(`{"id":"evt_%s","object":"event","type":"%s","data":{"object":{"id":"in_%s","object":"invoice","customer":"%s"}}}`,
+			hex.EncodeToString(fastrand.Bytes(8)), eventType, hex.EncodeToString(fastrand.Bytes(8)), customerID))
+	}
+	// checkUser verifies the user's failure count and tier.
+	checkUser := func(failures, tier int) {
+		du, err := at.DB.UserByID(at.Ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if du.PaymentFailures != failures || du.Tier != tier {
+			t.Fatalf("Expected %d failures and tier %d, got %d and %d", failures, tier, du.PaymentFailures, du.Tier)
+		}
+	}
+	// countEmails returns the number of payment failure emails sent to the
+	// user.
+	countEmails := func() int {
+		filter := bson.M{"to": u.Email, "subject": "Your payment failed"}
+		_, msgs, err := at.DB.FindEmails(at.Ctx, filter, &options.FindOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(msgs)
+	}
+
+	// An event with an invalid signature is rejected.
+	status, err := at.StripeWebhookPOST(invoiceEvent("invoice.payment_failed"), "wrong secret")
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusBadRequest, status, err)
+	}
+	checkUser(0, database.TierPremium5)
+
+	// The first failure sends an email but doesn't downgrade the user. Stripe
+	// might deliver the same event again, which changes nothing.
+	failed := invoiceEvent("invoice.payment_failed")
+	for i := 0; i < 2; i++ {
+		status, err = at.StripeWebhookPOST(failed, secret)
+		if err != nil || status != http.StatusNoContent {
+			t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+		}
+		checkUser(1, database.TierPremium5)
+		if n := countEmails(); n != 1 {
+			t.Fatalf("Expected %d email, got %d", 1, n)
+		}
+	}
+	// A successful payment resets the count.
+	status, err = at.StripeWebhookPOST(invoiceEvent("invoice.payment_succeeded"), secret)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	checkUser(0, database.TierPremium5)
+	// Two consecutive failures downgrade the user.
+	for i := 0; i < 2; i++ {
+		status, err = at.StripeWebhookPOST(invoiceEvent("invoice.payment_failed"), secret)
+		if err != nil || status != http.StatusNoContent {
+			t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+		}
+	}
+	checkUser(2, database.TierFree)
+	if n := countEmails(); n != 3 {
+		t.Fatalf("Expected %d emails, got %d", 3, n)
+	}
+	// The user's limits reflect the downgrade.
+	ul, _, err := at.UserLimits("byte", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+}
+
+// testStripePaymentsEnabled ensures that GET /limits reports whether the
+// portal accepts payments and that the Stripe endpoints respond with a 501
+// when it doesn't.
+func testStripePaymentsEnabled(t *testing.T, at *test.AccountsTester) {
+	// We can only check the disabled state when no other test has set a
+	// Stripe key.
+	if stripe.Key == "" {
+		lg, _, err := at.LimitsGET()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lg.Payments.Enabled || lg.Payments.Provider != "" || lg.Payments.TestMode {
+			t.Fatalf("Expected payments to be disabled, got %+v", lg.Payments)
+		}
+		_, s, err := at.StripePricesGET()
+		if err == nil || s != http.StatusNotImplemented || !strings.Contains(err.Error(), api.ErrStripeNotConfigured.Error()) {
+			t.Fatalf("Expected %d and '%s', got %d '%v'", http.StatusNotImplemented, api.ErrStripeNotConfigured, s, err)
+		}
+		r, err := at.Request(http.MethodPost, "/stripe/webhook", nil, []byte("{}"), nil, nil)
+		if err == nil || r.StatusCode != http.StatusNotImplemented {
+			t.Fatalf("Expected %d, got %d '%v'", http.StatusNotImplemented, r.StatusCode, err)
+		}
+		stripe.Key = "sk_test_FAKE_TEST_KEY"
+		defer func() { stripe.Key = "" }()
+	}
+	lg, _, err := at.LimitsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := api.PaymentsGET{Enabled: true, Provider: string(api.PromoterStripe), TestMode: api.StripeTestMode()}
+	if lg.Payments != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, lg.Payments)
+	}
+}
+
+// testStripeCheckoutTierCache ensures that a user who gets promoted via the
+// checkout path immediately gets their new tier's limits when authenticating
+// with an API key, even if their old limits were cached under that key.
+func testStripeCheckoutTierCache(t *testing.T, at *test.AccountsTester) {
+	// We mock all calls to Stripe, so a fake key suffices.
+	if stripe.Key == "" {
+		stripe.Key = "sk_test_FAKE_TEST_KEY"
+		defer func() { stripe.Key = "" }()
+	}
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+	_, _, err = at.UserPUT("", "", fixtureStripeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get the user's limits via the API key, so they get cached under it.
+	at.SetAPIKey(ak.Key.String())
+	ul, _, err := at.UserLimits("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+
+	// Promote the user via the checkout path.
+	defer gock.Off()
+	// We need to enable networking in order to allow the Tester to call our
+	// own API.
+	gock.EnableNetworking()
+	gock.New("https://api.stripe.com").
+		Get("/v1/checkout/sessions/" + fixtureSessionIDWithSub20).
+		Reply(http.StatusOK).
+		Body(strings.NewReader(fixtures.StripeCheckoutSessionWithSubTier20))
+	at.SetCookie(c)
+	_, status, err := at.StripeCheckoutIDGET(fixtureSessionIDWithSub20)
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+
+	// Expect the new tier to be reported via the API key right away.
+	at.SetAPIKey(ak.Key.String())
+	ul, _, err = at.UserLimits("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, ul.TierID)
+	}
+}
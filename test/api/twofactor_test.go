@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/totp"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// testTwoFactor ensures that users can set up and enable 2FA, that logging in
+// with credentials then requires a valid TOTP or recovery code, and that
+// users can disable 2FA again.
+func testTwoFactor(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	password := name + "_pass"
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+
+	// Enabling 2FA before setting it up should fail.
+	_, status, err := at.UserTwoFactorEnablePOST("123456")
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	// Set up 2FA.
+	setup, status, err := at.UserTwoFactorSetupPOST()
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+	if setup.Secret == "" || setup.URL == "" {
+		t.Fatalf("Unexpected setup response %+v", setup)
+	}
+	// The secret must be stored encrypted.
+	du, err := at.DB.UserByEmail(at.Ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if du.TwoFactorEnabled || du.TwoFactorSecret == "" || du.TwoFactorSecret == setup.Secret {
+		t.Fatalf("Unexpected 2FA state %t '%s'", du.TwoFactorEnabled, du.TwoFactorSecret)
+	}
+	// Try to enable 2FA with a wrong code.
+	code, err := totp.Code(setup.Secret, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, status, err = at.UserTwoFactorEnablePOST(code)
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	// Enable 2FA with a valid code.
+	code, err = totp.Code(setup.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enable, status, err := at.UserTwoFactorEnablePOST(code)
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+	if len(enable.RecoveryCodes) != database.TwoFactorRecoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", database.TwoFactorRecoveryCodeCount, len(enable.RecoveryCodes))
+	}
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ug.TwoFactorEnabled {
+		t.Fatal("Expected 2FA to be enabled.")
+	}
+	// Setting up 2FA again should fail now.
+	_, status, err = at.UserTwoFactorSetupPOST()
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	at.ClearCredentials()
+
+	// login logs in with credentials, expects to be asked for a TOTP code and
+	// returns the two-factor login token.
+	login := func() string {
+		r, b, err := at.LoginCredentialsPOST(email.String(), password)
+		if err == nil || r.StatusCode != http.StatusConflict {
+			t.Fatalf("Expected %d, got %d and error %v", http.StatusConflict, r.StatusCode, err)
+		}
+		if test.ExtractCookie(r) != nil {
+			t.Fatal("Did not expect a cookie before providing a TOTP code.")
+		}
+		var resp api.LoginTwoFactorRequired
+		err = json.Unmarshal(b, &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != api.ErrCodeTwoFactorRequired || resp.Token == "" {
+			t.Fatalf("Unexpected response %+v", resp)
+		}
+		return resp.Token
+	}
+
+	// Completing the login with a wrong code should fail.
+	token := login()
+	wrongCode, err := totp.Code(setup.Secret, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = at.LoginTwoFactorPOST(token, wrongCode)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusUnauthorized, r.StatusCode, err)
+	}
+	// The code we used for enabling 2FA can't be used again.
+	r, err = at.LoginTwoFactorPOST(token, code)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusUnauthorized, r.StatusCode, err)
+	}
+	// An invalid token should fail, even with a valid code.
+	code, err = totp.Code(setup.Secret, time.Now().Add(totp.Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = at.LoginTwoFactorPOST(token+"x", code)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusUnauthorized, r.StatusCode, err)
+	}
+	// Complete the login with a valid code.
+	r, err = at.LoginTwoFactorPOST(token, code)
+	if err != nil || r.StatusCode != http.StatusNoContent {
+		t.Fatal(err, r.StatusCode)
+	}
+	c := test.ExtractCookie(r)
+	if c == nil {
+		t.Fatal("Expected a cookie.")
+	}
+	at.SetCookie(c)
+	_, status, err = at.UserGET()
+	if err != nil || status != http.StatusOK {
+		t.Fatal(err, status)
+	}
+	at.ClearCredentials()
+
+	// Log in with a recovery code. Each recovery code works only once.
+	token = login()
+	r, err = at.LoginTwoFactorPOST(token, enable.RecoveryCodes[0])
+	if err != nil || test.ExtractCookie(r) == nil {
+		t.Fatal("Expected to log in with a recovery code.", err, r.StatusCode)
+	}
+	r, err = at.LoginTwoFactorPOST(login(), enable.RecoveryCodes[0])
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusUnauthorized, r.StatusCode, err)
+	}
+
+	// Disable 2FA. This requires a valid code.
+	r, err = at.LoginTwoFactorPOST(login(), enable.RecoveryCodes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	status, err = at.UserTwoFactorDisablePOST(wrongCode)
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and error %v", http.StatusBadRequest, status, err)
+	}
+	status, err = at.UserTwoFactorDisablePOST(enable.RecoveryCodes[2])
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal(err, status)
+	}
+	at.ClearCredentials()
+	// Logging in with credentials works without a code again.
+	r, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil || test.ExtractCookie(r) == nil {
+		t.Fatal("Expected to log in without a code.", err)
+	}
+	du, err = at.DB.UserByEmail(at.Ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if du.TwoFactorEnabled || du.TwoFactorSecret != "" || len(du.TwoFactorRecoveryCodes) != 0 {
+		t.Fatalf("Expected 2FA to be fully disabled, got %+v", du)
+	}
+}
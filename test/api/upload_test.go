@@ -2,19 +2,26 @@ package api
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/metafetcher"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"github.com/SkynetLabs/skynet-accounts/test"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/build"
 )
 
 // testUploadInfo ensures uploadInfoGET works as expected.
@@ -51,20 +58,22 @@ func testUploadInfo(t *testing.T, at *test.AccountsTester) {
 	}
 
 	// Try an invalid skylink.
-	_, sc, err := at.UploadInfo("this is not a skylink")
+	_, sc, err := at.UploadInfo("this is not a skylink", nil)
 	if err == nil || sc != http.StatusBadRequest {
 		t.Fatalf("Expected an error and status 400, got '%s' and %d", err, sc)
 	}
 	// Try a valid skylink that's not in the DB.
-	ups, sc, err := at.UploadInfo(test.RandomSkylink())
+	info, sc, err := at.UploadInfo(test.RandomSkylink(), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	ups := info.Items
 	if sc != http.StatusOK || len(ups) > 0 {
 		t.Fatalf("Expected 200OK and zero uploads, got %d and %d uploads.", sc, len(ups))
 	}
 	// Try a valid skylink that's already in the DB.
-	ups, sc, err = at.UploadInfo(sl.Skylink)
+	info, sc, err = at.UploadInfo(sl.Skylink, nil)
+	ups = info.Items
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -78,7 +87,8 @@ func testUploadInfo(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ups, sc, err = at.UploadInfo(sl.Skylink)
+	info, sc, err = at.UploadInfo(sl.Skylink, nil)
+	ups = info.Items
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,8 +101,20 @@ func testUploadInfo(t *testing.T, at *test.AccountsTester) {
 	if !ups[0].UserID.IsZero() {
 		t.Fatalf("Unexpected uploader: %+v", ups)
 	}
-	if ups[0].UploaderIP != ip {
-		t.Fatalf("Expected uploader IP '%s', got '%s'", ip, ups[0].UploaderIP)
+	if ups[0].UploaderIP != "" {
+		t.Fatalf("Expected no uploader IP, got '%s'", ups[0].UploaderIP)
+	}
+	// Admins get to see the uploader's IP.
+	adminKey := "admin api key"
+	api.AdminAPIKey = adminKey
+	defer func() { api.AdminAPIKey = "" }()
+	var adminInfo api.UploadInfoGET
+	_, err = at.Request(http.MethodGet, "/uploadinfo/"+sl.Skylink, nil, nil, map[string]string{api.AdminAPIKeyHeader: adminKey}, &adminInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adminInfo.Items) != 1 || adminInfo.Items[0].UploaderIP != ip {
+		t.Fatalf("Expected uploader IP '%s', got %+v", ip, adminInfo.Items)
 	}
 
 	// Create a non-anon upload for sl.
@@ -101,7 +123,8 @@ func testUploadInfo(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ups, sc, err = at.UploadInfo(sl.Skylink)
+	info, sc, err = at.UploadInfo(sl.Skylink, nil)
+	ups = info.Items
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,7 +145,8 @@ func testUploadInfo(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ups, sc, err = at.UploadInfo(sl.Skylink)
+	info, sc, err = at.UploadInfo(sl.Skylink, nil)
+	ups = info.Items
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,7 +160,8 @@ func testUploadInfo(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ups, sc, err = at.UploadInfo(sl.Skylink)
+	info, sc, err = at.UploadInfo(sl.Skylink, nil)
+	ups = info.Items
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -157,13 +182,51 @@ func testUploadInfo(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ups, sc, err = at.UploadInfo(sl.Skylink)
+	info, sc, err = at.UploadInfo(sl.Skylink, nil)
+	ups = info.Items
 	if err != nil {
 		t.Fatal(err)
 	}
 	if sc != http.StatusOK || len(ups) != 5 {
 		t.Fatalf("Expected 200OK and %d uploads, got %d and %d uploads.", 5, sc, len(ups))
 	}
+	// The summary counts both users, but only the first one still pins the
+	// skylink.
+	sum := info.Summary
+	if sum.DistinctUploaders != 2 || sum.TotalUploads != 5 || sum.StillPinnedCount != 1 {
+		t.Fatalf("Unexpected summary %+v", sum)
+	}
+	if sum.FirstUploadedAt == nil || sum.LastUploadedAt == nil || sum.FirstUploadedAt.After(*sum.LastUploadedAt) {
+		t.Fatalf("Unexpected upload times in summary %+v", sum)
+	}
+	for _, up := range ups {
+		if up.Unpinned != (up.UserID == u2.ID) {
+			t.Fatalf("Expected only the uploads of the second user to be unpinned, got %+v", up)
+		}
+		if up.UserID == u.ID && up.Sub != u.Sub {
+			t.Fatalf("Expected sub '%s', got '%s'", u.Sub, up.Sub)
+		}
+	}
+	// Leave out the unpinned uploads.
+	params := url.Values{}
+	params.Set("includeUnpinned", "false")
+	info, sc, err = at.UploadInfo(sl.Skylink, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc != http.StatusOK || len(info.Items) != 4 || info.Summary.TotalUploads != 5 {
+		t.Fatalf("Expected 200OK and %d uploads, got %d and %+v", 4, sc, info)
+	}
+	for _, up := range info.Items {
+		if up.Unpinned {
+			t.Fatalf("Expected no unpinned uploads, got %+v", up)
+		}
+	}
+	params.Set("includeUnpinned", "maybe")
+	_, sc, err = at.UploadInfo(sl.Skylink, params)
+	if err == nil || sc != http.StatusBadRequest {
+		t.Fatalf("Expected an error and status 400, got '%v' and %d", err, sc)
+	}
 }
 
 // TestUploadedSkylinks ensures UploadsByPeriod returns the correct uploads.
@@ -314,3 +377,545 @@ func changeUploadTime(ctx context.Context, db *database.DB, uploadID primitive.O
 func daysAgo(n int) time.Time {
 	return time.Now().UTC().Add(time.Duration(n) * -24 * time.Hour)
 }
+
+// testUserUploadsSortAndPaging ensures GET /user/uploads sorts uploads as
+// requested and correctly reports whether there are more pages.
+func testUserUploadsSortAndPaging(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Create uploads of different sizes, largest first, so sorting by size
+	// ascending yields the reverse of the default order.
+	sizes := []int64{5000, 3000, 1000}
+	for _, size := range sizes {
+		_, _, err = test.CreateTestUpload(at.Ctx, at.DB, *u.User, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Sort by size ascending.
+	params := url.Values{}
+	params.Set("orderBy", database.UploadsOrderBySize)
+	params.Set("orderDirection", database.SortDirectionAsc)
+	ups, _, err := at.UserUploadsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups.Items) != len(sizes) {
+		t.Fatalf("Expected %d uploads, got %d", len(sizes), len(ups.Items))
+	}
+	for i := 1; i < len(ups.Items); i++ {
+		if ups.Items[i-1].Size > ups.Items[i].Size {
+			t.Fatalf("Expected uploads sorted by size ascending, got %d before %d", ups.Items[i-1].Size, ups.Items[i].Size)
+		}
+	}
+	if ups.HasMore {
+		t.Fatal("Expected hasMore to be false when all uploads fit on one page.")
+	}
+
+	// Page through the uploads one at a time.
+	params.Set("pageSize", "1")
+	params.Set("offset", "1")
+	ups, _, err = at.UserUploadsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups.Items) != 1 || ups.Items[0].Size != 3000 || !ups.HasMore {
+		t.Fatalf("Unexpected page %+v", ups)
+	}
+	params.Set("offset", "2")
+	ups, _, err = at.UserUploadsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups.Items) != 1 || ups.Items[0].Size != 5000 || ups.HasMore {
+		t.Fatalf("Unexpected last page %+v", ups)
+	}
+
+	// Invalid sort field and direction.
+	params = url.Values{}
+	params.Set("orderBy", "skylink")
+	_, status, err := at.UserUploadsGET(params)
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusBadRequest, status, err)
+	}
+	params = url.Values{}
+	params.Set("orderDirection", "sideways")
+	_, status, err = at.UserUploadsGET(params)
+	if err == nil || status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusBadRequest, status, err)
+	}
+}
+
+// testUserUploadsFilter ensures that userUploadsGET filters uploads by name,
+// date, and size.
+func testUserUploadsFilter(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, name)
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	start := time.Now().UTC().Add(-time.Minute)
+	files := []struct {
+		name string
+		size int64
+	}{
+		{"Holiday Photos.zip", 1000},
+		{"holiday-video.mp4", 5000},
+		{"report.pdf", 3000},
+	}
+	for _, f := range files {
+		sl, err := at.DB.Skylink(at.Ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = at.DB.SkylinkUpdate(at.Ctx, sl.ID, f.name, f.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = test.RegisterTestUpload(at.Ctx, at.DB, *u.User, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		params   map[string]string
+		expected []string
+	}{
+		{map[string]string{}, []string{"Holiday Photos.zip", "holiday-video.mp4", "report.pdf"}},
+		{map[string]string{"name": "HOLIDAY"}, []string{"Holiday Photos.zip", "holiday-video.mp4"}},
+		{map[string]string{"name": "hoto."}, []string{}},
+		{map[string]string{"name": "("}, []string{}},
+		{map[string]string{"minSize": "2000"}, []string{"holiday-video.mp4", "report.pdf"}},
+		{map[string]string{"maxSize": "3000"}, []string{"Holiday Photos.zip", "report.pdf"}},
+		{map[string]string{"minSize": "2000", "maxSize": "4000"}, []string{"report.pdf"}},
+		{map[string]string{"minSize": "0"}, []string{"Holiday Photos.zip", "holiday-video.mp4", "report.pdf"}},
+		{map[string]string{"maxSize": "0"}, []string{}},
+		{map[string]string{"name": "holiday", "minSize": "2000"}, []string{"holiday-video.mp4"}},
+		{map[string]string{"from": start.Format(time.RFC3339)}, []string{"Holiday Photos.zip", "holiday-video.mp4", "report.pdf"}},
+		{map[string]string{"to": start.Format(time.RFC3339)}, []string{}},
+		{map[string]string{"from": start.Add(time.Hour).Format(time.RFC3339)}, []string{}},
+		{map[string]string{"name": "pdf", "from": start.Format(time.RFC3339), "to": start.Add(time.Hour).Format(time.RFC3339)}, []string{"report.pdf"}},
+	}
+	for _, tt := range tests {
+		params := url.Values{}
+		for k, v := range tt.params {
+			params.Set(k, v)
+		}
+		ups, _, err := at.UserUploadsGET(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(ups.Items))
+		for _, up := range ups.Items {
+			names = append(names, up.Name)
+		}
+		if len(names) != len(tt.expected) || ups.Count != int64(len(tt.expected)) {
+			t.Fatalf("Expected %v for %v, got %v with count %d", tt.expected, tt.params, names, ups.Count)
+		}
+		for _, n := range tt.expected {
+			if !test.Contains(names, n) {
+				t.Fatalf("Expected %v for %v, got %v", tt.expected, tt.params, names)
+			}
+		}
+	}
+
+	// Filtering works together with paging.
+	params := url.Values{}
+	params.Set("name", "holiday")
+	params.Set("pageSize", "1")
+	ups, _, err := at.UserUploadsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups.Items) != 1 || ups.Count != 2 || !ups.HasMore {
+		t.Fatalf("Unexpected page %+v", ups)
+	}
+
+	// Malformed filters.
+	invalid := []map[string]string{
+		{"from": "yesterday"},
+		{"to": "2022-13-01T00:00:00Z"},
+		{"minSize": "big"},
+		{"maxSize": "-1"},
+		{"minSize": "2000", "maxSize": "1000"},
+		{"minSize": "1", "maxSize": "0"},
+		{"from": start.Add(time.Hour).Format(time.RFC3339), "to": start.Format(time.RFC3339)},
+	}
+	for _, ps := range invalid {
+		params = url.Values{}
+		for k, v := range ps {
+			params.Set(k, v)
+		}
+		_, status, err := at.UserUploadsGET(params)
+		if err == nil || status != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %v, got %d '%v'", http.StatusBadRequest, ps, status, err)
+		}
+	}
+}
+
+// testTrackUploadRequestID ensures that retrying a trackUploadPOST call with
+// the same request ID doesn't track the upload twice.
+func testTrackUploadRequestID(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	sl := test.RandomSkylink()
+	reqID := hex.EncodeToString(fastrand.Bytes(16))
+	status, err := at.TrackUploadWithRequestID(sl, "", reqID)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	// Retry the request. We expect it to succeed without tracking a new
+	// upload.
+	status, err = at.TrackUploadWithRequestID(sl, "", reqID)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusOK, status, err)
+	}
+	stats, err := at.DB.UserStats(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploads != 1 {
+		t.Fatalf("Expected %d upload, got %d", 1, stats.NumUploads)
+	}
+	// The same request ID passed as a form value should be detected as well.
+	form := url.Values{}
+	form.Set("requestId", reqID)
+	r, err := at.Request(http.MethodPost, "/track/upload/"+sl, form, nil, nil, nil)
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusOK, r.StatusCode, err)
+	}
+	// A different request ID results in a new upload.
+	status, err = at.TrackUploadWithRequestID(sl, "", reqID+"2")
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	stats, err = at.DB.UserStats(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploads != 2 {
+		t.Fatalf("Expected %d uploads, got %d", 2, stats.NumUploads)
+	}
+}
+
+// testTrackUploadIP ensures that tracked uploads normalize their IPs, count
+// the ones without a valid IP, and reject those when we require a valid IP.
+func testTrackUploadIP(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	missingSeries := `accounts_track_invalid_ip_total{reason="missing"}`
+	invalidSeries := `accounts_track_invalid_ip_total{reason="invalid"}`
+	before, _, err := at.MetricsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// By default, we track uploads without a valid IP.
+	for _, ip := range []string{"", "not an ip"} {
+		status, err := at.TrackUpload(test.RandomSkylink(), ip)
+		if err != nil || status != http.StatusNoContent {
+			t.Fatalf("Expected %d for IP '%s', got %d '%v'", http.StatusNoContent, ip, status, err)
+		}
+	}
+	after, _, err := at.MetricsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := metricValue(after, missingSeries) - metricValue(before, missingSeries); d != 1 {
+		t.Fatalf("Expected %s to increase by 1, got %v", missingSeries, d)
+	}
+	if d := metricValue(after, invalidSeries) - metricValue(before, invalidSeries); d != 1 {
+		t.Fatalf("Expected %s to increase by 1, got %v", invalidSeries, d)
+	}
+	// IPv4-mapped IPv6 addresses are stored as IPv4 addresses.
+	b := fastrand.Bytes(3)
+	ip := fmt.Sprintf("10.%d.%d.%d", b[0], b[1], b[2])
+	status, err := at.TrackUpload(test.RandomSkylink(), "::ffff:"+ip)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	_, n, err := at.DB.UploadsByIP(at.Ctx, ip, time.Time{}, 0, 10)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 upload from %s, got %d and %v", ip, n, err)
+	}
+
+	// Require a valid IP.
+	api.TrackRequireValidIP = true
+	defer func() { api.TrackRequireValidIP = false }()
+	for _, ip := range []string{"", "not an ip"} {
+		status, err = at.TrackUpload(test.RandomSkylink(), ip)
+		if err == nil || status != http.StatusBadRequest || !strings.Contains(err.Error(), api.ErrInvalidTrackIP.Error()) {
+			t.Fatalf("Expected %d and '%s' for IP '%s', got %d '%v'", http.StatusBadRequest, api.ErrInvalidTrackIP, ip, status, err)
+		}
+	}
+	status, err = at.TrackUpload(test.RandomSkylink(), ip)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+}
+
+// testTrackUploadQuotaReservation ensures that concurrent uploads can't take
+// the user further past their storage quota than the configured tolerance.
+func testTrackUploadQuotaReservation(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	// Restore the default limits when we're done.
+	defer func() {
+		err = at.DB.TierLimitsOverrideSet(at.Ctx, database.TierFree, database.TierLimitsOverride{})
+		if err == nil {
+			err = at.DB.RefreshTierLimits(at.Ctx)
+		}
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to restore the tier limits in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Give the free tier a tiny storage quota.
+	size := int64(skynet.MiB)
+	storage := 10 * size
+	err = at.DB.TierLimitsOverrideSet(at.Ctx, database.TierFree, database.TierLimitsOverride{Storage: &storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = at.DB.RefreshTierLimits(at.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := storage + storage*api.StorageQuotaTolerancePercent/100
+
+	// Fire off many more uploads than fit, concurrently.
+	n := 30
+	skylinks := make([]string, n)
+	for i := range skylinks {
+		skylinks[i] = test.RandomSkylink()
+		sl, err := at.DB.Skylink(at.Ctx, skylinks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = at.DB.SkylinkUpdate(at.Ctx, sl.ID, "file", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var accepted, rejected int64
+	var acceptedSkylink string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, sl := range skylinks {
+		wg.Add(1)
+		go func(sl string) {
+			defer wg.Done()
+			status, err := at.TrackUpload(sl, "")
+			mu.Lock()
+			defer mu.Unlock()
+			if status == http.StatusNoContent {
+				accepted++
+				acceptedSkylink = sl
+			} else if status == http.StatusTooManyRequests && err != nil && test.ErrorCode(err.Error()) == api.ErrCodeQuotaExceeded {
+				rejected++
+			} else {
+				t.Errorf("Unexpected response %d '%v'", status, err)
+			}
+		}(sl)
+	}
+	wg.Wait()
+	if accepted == 0 || rejected == 0 {
+		t.Fatalf("Expected some uploads to be accepted and some rejected, got %d and %d", accepted, rejected)
+	}
+	if accepted*size > limit {
+		t.Fatalf("Expected at most %d bytes to be accepted, got %d", limit, accepted*size)
+	}
+	upStats, err := at.DB.UserStatsUpload(at.Ctx, u.ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upStats.SizeTotal != accepted*size {
+		t.Fatalf("Expected %d bytes tracked, got %d", accepted*size, upStats.SizeTotal)
+	}
+
+	// Skylinks whose size we don't know yet count as the estimate, so they
+	// can't be used for sneaking past the quota either.
+	oldEstimate := api.UnknownSkylinkSizeEstimate
+	api.UnknownSkylinkSizeEstimate = size
+	defer func() { api.UnknownSkylinkSizeEstimate = oldEstimate }()
+	status, err := at.TrackUpload(test.RandomSkylink(), "")
+	if status != http.StatusTooManyRequests || err == nil || test.ErrorCode(err.Error()) != api.ErrCodeQuotaExceeded {
+		t.Fatalf("Expected %d with code '%s', got %d '%v'", http.StatusTooManyRequests, api.ErrCodeQuotaExceeded, status, err)
+	}
+	// Make room for one more upload and track one of unknown size.
+	status, err = at.UploadsDELETE(acceptedSkylink)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	su, err := at.DB.StorageUsageByUser(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = at.TrackUpload(test.RandomSkylink(), "")
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusNoContent, status, err)
+	}
+	su2, err := at.DB.StorageUsageByUser(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if su2.Storage != su.Storage+size {
+		t.Fatalf("Expected the estimate of %d bytes to be reserved, got %d", size, su2.Storage-su.Storage)
+	}
+}
+
+// testSkylinkSizeResolvedQuota ensures that the quota of users who uploaded a
+// skylink before we knew its size is rechecked once the metafetcher learns it.
+func testSkylinkSizeResolvedQuota(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	// Restore the default limits when we're done.
+	defer func() {
+		err = at.DB.TierLimitsOverrideSet(at.Ctx, database.TierFree, database.TierLimitsOverride{})
+		if err == nil {
+			err = at.DB.RefreshTierLimits(at.Ctx)
+		}
+		if err != nil {
+			t.Error(errors.AddContext(err, "failed to restore the tier limits in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// Give the free tier a tiny storage quota and bring the user close to it.
+	storage := int64(10 * skynet.MiB)
+	err = at.DB.TierLimitsOverrideSet(at.Ctx, database.TierFree, database.TierLimitsOverride{Storage: &storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = at.DB.RefreshTierLimits(at.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(at.Ctx, at.DB, *u.User, storage-skynet.MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upload a skylink whose size we don't know yet. The metafetcher fails to
+	// fetch its metadata, so its size stays at zero and the user stays within
+	// their quota.
+	sl, err := at.DB.Skylink(at.Ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.TrackUpload(sl.Skylink, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(at.Ctx, 5*time.Second)
+	defer cancel()
+	err = at.MetaFetcher.Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err = at.DB.SkylinkByID(at.Ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.Size != 0 || !sl.SizeResolvedAt.IsZero() {
+		t.Fatalf("Expected an unknown size, got %d resolved at %v", sl.Size, sl.SizeResolvedAt)
+	}
+	u2, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.QuotaExceeded {
+		t.Fatal("Expected the user to be within their quota.")
+	}
+
+	// The metafetcher learns that the skylink is huge. Expect the user to
+	// exceed their quota without doing anything else.
+	at.Fetcher.SetMetadata(sl.Skylink, metafetcher.Metadata{Filename: "huge.bin", Length: storage})
+	if !at.MetaFetcher.Enqueue(metafetcher.Message{SkylinkID: sl.ID}) {
+		t.Fatal("Expected the skylink to be queued.")
+	}
+	err = build.Retry(50, 100*time.Millisecond, func() error {
+		u2, err := at.DB.UserBySub(at.Ctx, u.Sub)
+		if err != nil {
+			return err
+		}
+		if !u2.QuotaExceeded {
+			return errors.New("expected the user to exceed their quota")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err = at.DB.SkylinkByID(at.Ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.Size != storage || sl.SizeResolvedAt.IsZero() {
+		t.Fatalf("Expected size %d with a resolution time, got %d resolved at %v", storage, sl.Size, sl.SizeResolvedAt)
+	}
+	// The estimate we counted for the skylink has been replaced by its size.
+	su, err := at.DB.StorageUsageByUser(at.Ctx, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 2*storage - skynet.MiB; su.Storage != expected {
+		t.Fatalf("Expected a storage usage of %d, got %d", expected, su.Storage)
+	}
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testUserMerge ensures that users can merge a pubkey account into their
+// email account, that all data moves over and that they can log in with both
+// identities afterwards. It also ensures that we refuse to merge two accounts
+// which both have a Stripe customer.
+func testUserMerge(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// Create a pubkey-only user on a higher tier, with some data.
+	sk, pkk := crypto.GenerateKeyPair()
+	pk := database.PubKey(pkk[:])
+	src, err := at.DB.UserCreatePK(at.Ctx, "", "", name+"_src_sub", pk, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// The merge deletes this user, so we only clean up on failure.
+		if err = at.DB.UserDelete(at.Ctx, src); err != nil && !errors.Contains(err, database.ErrUserNotFound) {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	sl, _, err := test.CreateTestUpload(at.Ctx, at.DB, *src, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.DB.DownloadCreate(at.Ctx, *src, "", *sl, 100, primitive.ObjectID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.DB.RegistryWriteCreate(at.Ctx, *src, primitive.ObjectID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, err := at.DB.APIKeyCreate(at.Ctx, *src, "", false, nil, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signedChallenge requests a login challenge for the pubkey and signs it.
+	signedChallenge := func() (response, sig []byte) {
+		ch, _, err := at.LoginPubKeyGET(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chBytes, err := hex.DecodeString(ch.Challenge)
+		if err != nil {
+			t.Fatal("Invalid challenge:", err)
+		}
+		response = append(chBytes, append([]byte(database.ChallengeTypeLogin), []byte(database.PortalName)...)...)
+		return response, ed25519.Sign(sk[:], response)
+	}
+
+	// Merging requires a valid signature.
+	at.SetCookie(c)
+	response, _ := signedChallenge()
+	_, status, err := at.UserMergePOST(map[string]string{
+		"response":  hex.EncodeToString(response),
+		"signature": hex.EncodeToString(ed25519.Sign(sk[:], []byte("not the response"))),
+	})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d '%v'", http.StatusUnauthorized, status, err)
+	}
+	// Merging requires a login.
+	response, sig := signedChallenge()
+	proof := map[string]string{
+		"response":  hex.EncodeToString(response),
+		"signature": hex.EncodeToString(sig),
+	}
+	at.ClearCredentials()
+	_, status, _ = at.UserMergePOST(proof)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, status)
+	}
+
+	// Merge the pubkey account into the email account.
+	at.SetCookie(c)
+	response, sig = signedChallenge()
+	ug, status, err := at.UserMergePOST(map[string]string{
+		"response":  hex.EncodeToString(response),
+		"signature": hex.EncodeToString(sig),
+	})
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Failed to merge. Status %d, error '%v'", status, err)
+	}
+	if ug.Sub != u.Sub || ug.Tier != database.TierPremium5 {
+		t.Fatalf("Unexpected merged user %+v", ug)
+	}
+	if !ug.CreatedAt.Equal(u.CreatedAt) && !ug.CreatedAt.Equal(src.CreatedAt) {
+		t.Fatalf("Expected the earlier creation time, got %v", ug.CreatedAt)
+	}
+
+	// The pubkey account is gone and its data belongs to the email account.
+	_, err = at.DB.UserByID(at.Ctx, src.ID)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrUserNotFound, err)
+	}
+	ups, _, err := at.UserUploadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ups.Count != 1 || ups.Items[0].Skylink != sl.Skylink {
+		t.Fatalf("Expected the merged upload, got %+v", ups)
+	}
+	downs, _, err := at.UserDownloadsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downs.Count != 1 {
+		t.Fatalf("Expected the merged download, got %+v", downs)
+	}
+	akr, err := at.DB.APIKeyGet(at.Ctx, ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr.UserID != u.ID {
+		t.Fatalf("Expected the API key to belong to %s, got %s", u.ID.Hex(), akr.UserID.Hex())
+	}
+
+	// The user can log in with the pubkey and ends up in the merged account.
+	at.ClearCredentials()
+	response, sig = signedChallenge()
+	r, b, err := at.LoginPubKeyPOST(response, sig, "")
+	if err != nil {
+		t.Fatalf("Failed to login. Status %d, body '%s', error '%s'", r.StatusCode, string(b), err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	ug, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.Sub != u.Sub || ug.Email != u.Email {
+		t.Fatalf("Expected to log into the merged account, got %+v", ug)
+	}
+
+	// Accounts which both have a Stripe customer can't be merged.
+	password := name + "_pass"
+	emailAddr := types.NewEmail(name + "_stripe@siasky.net")
+	u2, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u2.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	err = at.DB.UserSetStripeID(at.Ctx, u.User, name+"_cus_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = at.DB.UserSetStripeID(at.Ctx, u2.User, name+"_cus_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	_, status, err = at.UserMergePOST(map[string]string{"email": emailAddr.String(), "password": password})
+	if status != http.StatusConflict || err == nil || test.ErrorCode(err.Error()) != api.ErrCodeMergeConflict {
+		t.Fatalf("Expected %d with code '%s', got %d '%v'", http.StatusConflict, api.ErrCodeMergeConflict, status, err)
+	}
+	_, err = at.DB.UserByID(at.Ctx, u2.ID)
+	if err != nil {
+		t.Fatal("Expected the other account to still exist, got", err)
+	}
+}
@@ -2,10 +2,15 @@ package database
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // TestAPIKeys ensures the DB operations with API keys work as expected.
@@ -27,25 +32,33 @@ func TestAPIKeys(t *testing.T) {
 	sl2 := test.RandomSkylink()
 
 	// Create a private API key.
-	akr1, err := db.APIKeyCreate(ctx, *u, "keyname", false, nil)
+	akr1, err := db.APIKeyCreate(ctx, *u, "keyname", false, nil, "", time.Time{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if akr1.Name != "keyname" {
 		t.Fatal("Unexpected name.")
 	}
+	if akr1.Scope != database.APIKeyScopeFull {
+		t.Fatalf("Expected scope '%s', got '%s'", database.APIKeyScopeFull, akr1.Scope)
+	}
+	// Create a private API key with an invalid scope. Expect to fail.
+	_, err = db.APIKeyCreate(ctx, *u, "", false, nil, "write", time.Time{})
+	if !errors.Contains(err, database.ErrInvalidAPIKeyScope) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrInvalidAPIKeyScope, err)
+	}
 	// Create a private API key with skylinks. Expect to fail.
-	_, err = db.APIKeyCreate(ctx, *u, "", false, []string{sl1})
+	_, err = db.APIKeyCreate(ctx, *u, "", false, []string{sl1}, "", time.Time{})
 	if err == nil {
 		t.Fatal("Managed to create a private API key with skylinks.")
 	}
 	// Create a public API key
-	akr2, err := db.APIKeyCreate(ctx, *u, "", true, []string{sl1})
+	akr2, err := db.APIKeyCreate(ctx, *u, "", true, []string{sl1}, "", time.Time{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Create a public API key without any skylinks.
-	akr3, err := db.APIKeyCreate(ctx, *u, "", true, nil)
+	akr3, err := db.APIKeyCreate(ctx, *u, "", true, nil, "", time.Time{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,7 +104,7 @@ func TestAPIKeys(t *testing.T) {
 	if err == nil {
 		t.Fatal("Expected to be unable to update general API key.")
 	}
-	err = db.APIKeyPatch(ctx, *u, akr1.ID, []string{sl1}, nil)
+	_, err = db.APIKeyPatch(ctx, *u, akr1.ID, []string{sl1}, nil)
 	if err == nil {
 		t.Fatal("Expected to be unable to patch general API key.")
 	}
@@ -109,7 +122,7 @@ func TestAPIKeys(t *testing.T) {
 		t.Fatal("Expected the API to cover both skylinks.")
 	}
 	// Patch a public API key.
-	err = db.APIKeyPatch(ctx, *u, akr2.ID, nil, []string{sl2})
+	_, err = db.APIKeyPatch(ctx, *u, akr2.ID, nil, []string{sl2})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -153,3 +166,171 @@ func TestAPIKeys(t *testing.T) {
 		}
 	}
 }
+
+// TestAPIKeysExpiry ensures that expired API keys behave like nonexistent ones
+// and that their expiration dates can be changed.
+func TestAPIKeysExpiry(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	// Create an API key which has already expired. Expect to fail.
+	_, err = db.APIKeyCreate(ctx, *u, "", false, nil, "", time.Now().Add(-time.Second))
+	if !errors.Contains(err, database.ErrInvalidAPIKeyExpiry) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrInvalidAPIKeyExpiry, err)
+	}
+	// Create an API key which expires soon.
+	akr, err := db.APIKeyCreate(ctx, *u, "", false, nil, "", time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr.ExpiresAt.IsZero() || akr.Expired() {
+		t.Fatalf("Unexpected expiration date %v", akr.ExpiresAt)
+	}
+	if _, err = db.APIKeyByKey(ctx, akr.Key.String()); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for it to expire.
+	time.Sleep(time.Second)
+	_, err = db.APIKeyByKey(ctx, akr.Key.String())
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected error '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+	// Its owner can still see it.
+	akr1, err := db.APIKeyGet(ctx, akr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !akr1.Expired() {
+		t.Fatal("Expected the API key to be expired.")
+	}
+	// Expiration dates need to be in the future.
+	err = db.APIKeySetExpiry(ctx, *u, akr.ID, time.Now().Add(-time.Hour))
+	if !errors.Contains(err, database.ErrInvalidAPIKeyExpiry) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrInvalidAPIKeyExpiry, err)
+	}
+	// Extend the API key.
+	err = db.APIKeySetExpiry(ctx, *u, akr.ID, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.APIKeyByKey(ctx, akr.Key.String()); err != nil {
+		t.Fatal(err)
+	}
+	// Remove its expiration date.
+	err = db.APIKeySetExpiry(ctx, *u, akr.ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	akr1, err = db.APIKeyByKey(ctx, akr.Key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !akr1.ExpiresAt.IsZero() {
+		t.Fatalf("Expected no expiration date, got %v", akr1.ExpiresAt)
+	}
+	// Other users can't change it.
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	err = db.APIKeySetExpiry(ctx, *u2, akr.ID, time.Now().Add(time.Hour))
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected error '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+}
+
+// TestAPIKeyPatch ensures that concurrent patches of a public API key are
+// merged and that patches can't push the key over the skylinks limit.
+func TestAPIKeyPatch(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	akr, err := db.APIKeyCreate(ctx, *u, "", true, nil, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add skylinks concurrently, along with some duplicates.
+	n := 10
+	skylinks := make([]string, n)
+	for i := range skylinks {
+		skylinks[i] = test.RandomSkylink()
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range skylinks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.APIKeyPatch(ctx, *u, akr.ID, []string{skylinks[i], skylinks[0]}, nil)
+		}(i)
+	}
+	wg.Wait()
+	if err = errors.Compose(errs...); err != nil {
+		t.Fatal(err)
+	}
+	akr2, err := db.APIKeyGet(ctx, akr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(akr2.Skylinks) != n {
+		t.Fatalf("Expected %d skylinks, got %v", n, akr2.Skylinks)
+	}
+	for _, sl := range skylinks {
+		if !akr2.CoversSkylink(sl) {
+			t.Fatalf("Expected skylink '%s' to be covered.", sl)
+		}
+	}
+
+	// Skylinks which are both added and removed end up removed.
+	sl := test.RandomSkylink()
+	patched, err := db.APIKeyPatch(ctx, *u, akr.ID, []string{sl, skylinks[1]}, []string{sl, skylinks[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patched.Skylinks) != n-1 || patched.CoversSkylink(sl) || patched.CoversSkylink(skylinks[0]) {
+		t.Fatalf("Unexpected skylinks %v", patched.Skylinks)
+	}
+
+	// Patches which exceed the limit fail and don't change the key.
+	maxSkylinks := database.MaxNumSkylinksPerAPIKey
+	database.MaxNumSkylinksPerAPIKey = n - 1
+	defer func() { database.MaxNumSkylinksPerAPIKey = maxSkylinks }()
+	_, err = db.APIKeyPatch(ctx, *u, akr.ID, []string{sl}, nil)
+	if !errors.Contains(err, database.ErrMaxNumSkylinksExceeded) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrMaxNumSkylinksExceeded, err)
+	}
+	akr2, err = db.APIKeyGet(ctx, akr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(akr2.Skylinks) != n-1 || akr2.CoversSkylink(sl) {
+		t.Fatalf("Unexpected skylinks %v", akr2.Skylinks)
+	}
+	// Patching a key which doesn't exist or isn't public fails.
+	_, err = db.APIKeyPatch(ctx, *u, primitive.NewObjectID(), []string{sl}, nil)
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected error '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+}
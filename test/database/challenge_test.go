@@ -177,3 +177,154 @@ func TestUnconfirmedUserUpdate(t *testing.T) {
 		t.Fatalf("Expected '%s', got '%s'.", mongo.ErrNoDocuments, err)
 	}
 }
+
+// TestPruneExpired ensures that PruneExpired removes the challenges and
+// unconfirmed user updates which expired long enough ago and keeps the rest.
+func TestPruneExpired(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, pk := crypto.GenerateKeyPair()
+
+	// Create a fresh and an expired challenge, each with an unconfirmed
+	// user update.
+	fresh, err := db.NewChallenge(ctx, pk[:], database.ChallengeTypeRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := db.NewChallenge(ctx, pk[:], database.ChallengeTypeRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	err = db.ChallengeSetExpiration(ctx, expired.Challenge, expiredAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uu := range []*database.UnconfirmedUserUpdate{
+		{Sub: dbName + "_fresh", ChallengeID: fresh.ID, ExpiresAt: fresh.ExpiresAt},
+		{Sub: dbName + "_expired", ChallengeID: expired.ID, ExpiresAt: expiredAt},
+	} {
+		err = db.StoreUnconfirmedUserUpdate(ctx, uu)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	challenges, updates, err := db.PruneExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenges < 1 || updates < 1 {
+		t.Fatalf("Expected at least one pruned challenge and update, got %d and %d", challenges, updates)
+	}
+	// The expired challenge and its update are gone.
+	_, err = db.FetchUnconfirmedUserUpdate(ctx, expired.ID)
+	if err != mongo.ErrNoDocuments {
+		t.Fatalf("Expected '%s', got '%v'.", mongo.ErrNoDocuments, err)
+	}
+	solve := func(ch *database.Challenge) error {
+		chBytes, err := hex.DecodeString(ch.Challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := append(chBytes, append([]byte(database.ChallengeTypeRegister), []byte(database.PortalName)...)...)
+		chr := database.ChallengeResponse{
+			Response:  response,
+			Signature: ed25519.Sign(sk[:], response),
+		}
+		_, _, err = db.ValidateChallengeResponse(ctx, chr, database.ChallengeTypeRegister)
+		return err
+	}
+	if err = solve(expired); err == nil || !strings.Contains(err.Error(), database.ErrChallengeNotFound.Error()) {
+		t.Fatalf("Expected '%s', got '%v'.", database.ErrChallengeNotFound, err)
+	}
+	// The fresh challenge and its update survive.
+	_, err = db.FetchUnconfirmedUserUpdate(ctx, fresh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = solve(fresh); err != nil {
+		t.Fatal(err)
+	}
+	// A challenge can only be used once.
+	if err = solve(fresh); err == nil {
+		t.Fatal("Expected an error when reusing a challenge.")
+	}
+}
+
+// TestNewChallengeCap ensures that a single pubkey can't accumulate more than
+// a handful of outstanding challenges and that the challenges we hand out
+// after reaching the limit still validate.
+func TestNewChallengeCap(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, pk := crypto.GenerateKeyPair()
+
+	// Request 10 login challenges.
+	var ch *database.Challenge
+	for i := 0; i < 10; i++ {
+		ch, err = db.NewChallenge(ctx, pk[:], database.ChallengeTypeLogin)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := db.ChallengeCount(ctx, pk[:], database.ChallengeTypeLogin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 5 {
+		t.Fatalf("Expected at most 5 challenges, got %d", n)
+	}
+	if ch.RetryAfter.IsZero() {
+		t.Fatal("Expected a retry hint with a reused challenge.")
+	}
+	// The last challenge still validates.
+	chBytes, err := hex.DecodeString(ch.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := append(chBytes, append([]byte(database.ChallengeTypeLogin), []byte(database.PortalName)...)...)
+	chr := database.ChallengeResponse{
+		Response:  response,
+		Signature: ed25519.Sign(sk[:], response),
+	}
+	_, _, err = db.ValidateChallengeResponse(ctx, chr, database.ChallengeTypeLogin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update challenges are never shared, so each request gets a new one and
+	// the oldest ones are deleted.
+	seen := make(map[string]struct{})
+	for i := 0; i < 10; i++ {
+		ch, err = db.NewChallenge(ctx, pk[:], database.ChallengeTypeUpdate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := seen[ch.Challenge]; exists {
+			t.Fatal("Expected a new update challenge.")
+		}
+		seen[ch.Challenge] = struct{}{}
+	}
+	n, err = db.ChallengeCount(ctx, pk[:], database.ChallengeTypeUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 5 {
+		t.Fatalf("Expected at most 5 challenges, got %d", n)
+	}
+}
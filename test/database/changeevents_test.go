@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// TestChangeEvents ensures that user mutations are recorded in the change
+// events log in order and that consumers can resume from a cursor.
+func TestChangeEvents(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Perform a sequence of mutations.
+	sub := string(fastrand.Bytes(test.UserSubLen))
+	u, err := db.UserCreate(ctx, "email@example.com", "", sub, database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserSetTier(ctx, u, database.TierPremium20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Setting the same tier again is not a change.
+	err = db.UserSetTier(ctx, u, database.TierPremium20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.RecordQuotaExceededChange(ctx, u.Sub, true)
+	ak, err := db.APIKeyCreate(ctx, *u, "key", false, nil, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.APIKeyDelete(ctx, *u, ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserDelete(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Add an event which is older than the retention window. We don't expect
+	// to see it.
+	err = db.ChangeEventCreate(ctx, &database.ChangeEvent{
+		Type:      database.ChangeEventUserDeleted,
+		Sub:       "old sub",
+		CreatedAt: time.Now().UTC().Add(-database.ChangeEventsRetention - time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the feed in batches of two.
+	events1, cursor, err := db.ChangeEventsSince(ctx, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events2, cursor, err := db.ChangeEventsSince(ctx, cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events3, cursor, err := db.ChangeEventsSince(ctx, cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events1) != 2 || len(events2) != 2 || len(events3) != 0 {
+		t.Fatalf("Expected batches of 2, 2 and 0 events, got %d, %d and %d", len(events1), len(events2), len(events3))
+	}
+	events := append(events1, events2...)
+	expectedTypes := []string{
+		database.ChangeEventTierChanged,
+		database.ChangeEventQuotaExceededChanged,
+		database.ChangeEventAPIKeyRevoked,
+		database.ChangeEventUserDeleted,
+	}
+	for i, ev := range events {
+		if ev.Type != expectedTypes[i] || ev.Sub != u.Sub {
+			t.Fatalf("Expected event %d to be '%s' for sub '%s', got %+v", i, expectedTypes[i], u.Sub, ev)
+		}
+		// The events are numbered without gaps.
+		if i > 0 && ev.Seq != events[i-1].Seq+1 {
+			t.Fatalf("Expected event %d to have sequence number %d, got %d", i, events[i-1].Seq+1, ev.Seq)
+		}
+	}
+	if events[0].Tier == nil || *events[0].Tier != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %v", database.TierPremium20, events[0].Tier)
+	}
+	if events[1].QuotaExceeded == nil || !*events[1].QuotaExceeded {
+		t.Fatalf("Expected quota exceeded to be true, got %v", events[1].QuotaExceeded)
+	}
+	if events[2].APIKeyID != ak.ID.Hex() {
+		t.Fatalf("Expected API key id '%s', got '%s'", ak.ID.Hex(), events[2].APIKeyID)
+	}
+	// An empty batch doesn't move the cursor.
+	_, cursor2, err := db.ChangeEventsSince(ctx, cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor2 != cursor {
+		t.Fatalf("Expected cursor '%s', got '%s'", cursor, cursor2)
+	}
+	// New events are picked up from the cursor.
+	db.RecordTierChange(ctx, "another sub", database.TierPremium5)
+	events4, _, err := db.ChangeEventsSince(ctx, cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events4) != 1 || events4[0].Sub != "another sub" {
+		t.Fatalf("Expected a single event for 'another sub', got %+v", events4)
+	}
+	// Invalid cursors are rejected.
+	_, _, err = db.ChangeEventsSince(ctx, "not a cursor", 2)
+	if !errors.Contains(err, database.ErrInvalidCursor) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidCursor, err)
+	}
+}
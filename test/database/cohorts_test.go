@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestCohorts ensures that Cohorts correctly calculates the retention of each
+// cohort and suppresses the cohorts which are too small.
+func TestCohorts(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// createCohort creates n users who signed up the given number of weeks
+	// ago.
+	createCohort := func(name string, n int, weeksAgo int) []*database.User {
+		users := make([]*database.User, 0, n)
+		for i := 0; i < n; i++ {
+			email := types.NewEmail(fmt.Sprintf("%s_%d@siasky.net", name, i))
+			sub := string(fastrand.Bytes(test.UserSubLen))
+			u, err := db.UserCreate(ctx, email, "", sub, database.TierFree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.CreatedAt = u.CreatedAt.Add(-time.Duration(weeksAgo) * 7 * 24 * time.Hour)
+			if err = db.UserSave(ctx, u); err != nil {
+				t.Fatal(err)
+			}
+			users = append(users, u)
+		}
+		return users
+	}
+	// Cohort A signed up two weeks ago and half of its users are uploading
+	// this week.
+	cohortA := createCohort("a", 6, 2)
+	for _, u := range cohortA[:3] {
+		if _, _, err = test.CreateTestUpload(ctx, db, *u, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Cohort B signed up last week and two of its users are using the
+	// registry this week. One of them uses it more than once, which should
+	// not affect the result.
+	cohortB := createCohort("b", 5, 1)
+	if _, err = db.RegistryReadCreate(ctx, *cohortB[0], primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.RegistryWriteCreate(ctx, *cohortB[0], primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.RegistryWriteCreate(ctx, *cohortB[1], primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
+	}
+	// Cohort C signed up this week and is too small to be reported.
+	cohortC := createCohort("c", database.CohortPrivacyThreshold-1, 0)
+	if _, err = db.RegistryReadCreate(ctx, *cohortC[0], primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := db.Cohorts(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Weeks != 3 || len(cm.Cohorts) != 3 {
+		t.Fatalf("Expected 3 weeks and 3 cohorts, got %d and %d", cm.Weeks, len(cm.Cohorts))
+	}
+	for i := 1; i < len(cm.Cohorts); i++ {
+		if d := cm.Cohorts[i].WeekStart.Sub(cm.Cohorts[i-1].WeekStart); d != 7*24*time.Hour {
+			t.Fatalf("Expected cohorts to be a week apart, got %v", d)
+		}
+	}
+	// checkRetention compares a cohort's retention to the expected values,
+	// where a negative value means we expect nil.
+	checkRetention := func(c database.Cohort, expected []float64) {
+		if len(c.Retention) != len(expected) {
+			t.Fatalf("Expected %d retention values, got %d", len(expected), len(c.Retention))
+		}
+		for i, e := range expected {
+			r := c.Retention[i]
+			if e < 0 && r != nil {
+				t.Fatalf("Expected retention for week %d to be nil, got %f", i+1, *r)
+			}
+			if e >= 0 && (r == nil || *r != e) {
+				t.Fatalf("Expected retention for week %d to be %f, got %v", i+1, e, r)
+			}
+		}
+	}
+	a := cm.Cohorts[0]
+	if a.Suppressed || a.Size != len(cohortA) {
+		t.Fatalf("Expected cohort A to have size %d and not be suppressed, got %+v", len(cohortA), a)
+	}
+	checkRetention(a, []float64{0, 0.5, -1})
+	b := cm.Cohorts[1]
+	if b.Suppressed || b.Size != len(cohortB) {
+		t.Fatalf("Expected cohort B to have size %d and not be suppressed, got %+v", len(cohortB), b)
+	}
+	checkRetention(b, []float64{0.4, -1, -1})
+	c := cm.Cohorts[2]
+	if !c.Suppressed || c.Size != 0 || c.Retention != nil {
+		t.Fatalf("Expected cohort C to be suppressed, got %+v", c)
+	}
+
+	// Invalid numbers of weeks are rejected.
+	if _, err = db.Cohorts(ctx, 0); err == nil {
+		t.Fatal("Expected an error for 0 weeks.")
+	}
+	if _, err = db.Cohorts(ctx, database.CohortWeeksMax+1); err == nil {
+		t.Fatal("Expected an error for too many weeks.")
+	}
+}
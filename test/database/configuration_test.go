@@ -57,4 +57,9 @@ func TestConfiguration(t *testing.T) {
 	if value != val2 {
 		t.Fatalf("Expected value '%s', got '%s'", val, value)
 	}
+	// Write the same value again. This should not fail.
+	err = db.WriteConfigValue(ctx, key, val2)
+	if err != nil {
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestDownloadCreateCoalesce ensures that DownloadCreate adds the bytes of
+// repeated downloads within the DownloadUpdateWindow to a single download
+// record and creates a new record once the window has passed.
+func TestDownloadCreateCoalesce(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	window := database.DownloadUpdateWindow
+	defer func() {
+		database.DownloadUpdateWindow = window
+	}()
+	database.DownloadUpdateWindow = time.Second
+
+	u, err := db.UserCreate(ctx, types.NewEmail(dbName+"@siasky.net"), "", dbName+"_sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, _, err := test.CreateTestUpload(ctx, db, *u, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkDownloads ensures that the user has the expected download records
+	// and number of downloads.
+	checkDownloads := func(expectedBytes ...uint64) {
+		downloads, total, err := db.DownloadsByUser(ctx, *u, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != len(expectedBytes) {
+			t.Fatalf("Expected %d download records, got %d", len(expectedBytes), total)
+		}
+		// The most recent downloads come first.
+		for i, b := range expectedBytes {
+			if downloads[len(expectedBytes)-1-i].Size != b {
+				t.Fatalf("Expected download %d to have %d bytes, got %d", i, b, downloads[len(expectedBytes)-1-i].Size)
+			}
+		}
+		stats, err := db.UserStats(ctx, *u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.NumDownloads != int64(len(expectedBytes)) {
+			t.Fatalf("Expected %d downloads, got %d", len(expectedBytes), stats.NumDownloads)
+		}
+	}
+
+	// Five partial downloads within the window make a single download.
+	for i := 0; i < 5; i++ {
+		_, err = db.DownloadCreate(ctx, *u, "1.2.3.4", *sl, 100, primitive.ObjectID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDownloads(500)
+	// Once the window passes, we record a new download.
+	time.Sleep(database.DownloadUpdateWindow + 100*time.Millisecond)
+	_, err = db.DownloadCreate(ctx, *u, "1.2.3.4", *sl, 100, primitive.ObjectID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloads(500, 100)
+
+	// Disabling the window records each download separately.
+	database.DownloadUpdateWindow = 0
+	_, err = db.DownloadCreate(ctx, *u, "1.2.3.4", *sl, 100, primitive.ObjectID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloads(500, 100, 100)
+}
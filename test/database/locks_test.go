@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// TestLocks ensures that only one server can hold a lock at a time, that the
+// holder can extend it, and that others can take over once it expires.
+func TestLocks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := t.Name()
+
+	ok, err := db.LockAcquire(ctx, name, "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Expected 'a' to acquire the lock, got %t, %v", ok, err)
+	}
+	ok, err = db.LockAcquire(ctx, name, "b", time.Minute)
+	if err != nil || ok {
+		t.Fatalf("Expected 'b' to fail to acquire the lock, got %t, %v", ok, err)
+	}
+	// The holder can extend the lock.
+	ok, err = db.LockAcquire(ctx, name, "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Expected 'a' to extend the lock, got %t, %v", ok, err)
+	}
+	// Releasing someone else's lock does nothing.
+	err = db.LockRelease(ctx, name, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = db.LockAcquire(ctx, name, "b", time.Minute)
+	if err != nil || ok {
+		t.Fatalf("Expected 'b' to fail to acquire the lock, got %t, %v", ok, err)
+	}
+	err = db.LockRelease(ctx, name, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once released, anyone can acquire the lock. We acquire it with a
+	// negative TTL, so it's already expired.
+	ok, err = db.LockAcquire(ctx, name, "b", -time.Second)
+	if err != nil || !ok {
+		t.Fatalf("Expected 'b' to acquire the lock, got %t, %v", ok, err)
+	}
+	// An expired lock can be taken over.
+	ok, err = db.LockAcquire(ctx, name, "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Expected 'a' to take over the expired lock, got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestOrganizations ensures that users can create organizations, invite
+// others to join them, and leave them, and that members take on the
+// organization's tier.
+func TestOrganizations(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"owner@siasky.net"), "pass", t.Name()+"owner", database.TierPremium20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memberEmail := types.NewEmail(t.Name() + "member@siasky.net")
+	member, err := db.UserCreate(ctx, memberEmail, "pass", t.Name()+"member", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, u := range []*database.User{owner, member} {
+			// The test deletes the owner itself.
+			if err := db.UserDelete(ctx, u); err != nil && !errors.Contains(err, database.ErrUserNotFound) {
+				t.Error(err)
+			}
+		}
+	}()
+
+	org, err := db.OrgCreate(ctx, owner, "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !owner.InOrg() || owner.OrgID != org.ID || owner.EffectiveTier() != database.TierFree {
+		t.Fatalf("Expected the owner to be on the organization's free tier, got %+v", owner)
+	}
+	// A user can't create a second organization.
+	_, err = db.OrgCreate(ctx, owner, "another team")
+	if !errors.Contains(err, database.ErrUserInOrg) {
+		t.Fatalf("Expected %v, got %v", database.ErrUserInOrg, err)
+	}
+	err = db.OrgSetTier(ctx, org, database.TierPremium80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invite the member. Inviting them again replaces the first invite.
+	tk1, err := db.OrgInviteCreate(ctx, org, memberEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk2, err := db.OrgInviteCreate(ctx, org, memberEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.OrgInviteAccept(ctx, tk1)
+	if !errors.Contains(err, database.ErrInvalidToken) {
+		t.Fatalf("Expected %v, got %v", database.ErrInvalidToken, err)
+	}
+	_, u, err := db.OrgInviteAccept(ctx, tk2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != member.ID || u.OrgID != org.ID || u.EffectiveTier() != database.TierPremium80 {
+		t.Fatalf("Expected the member to be on the organization's tier, got %+v", u)
+	}
+	// The invite can only be used once.
+	_, _, err = db.OrgInviteAccept(ctx, tk2)
+	if !errors.Contains(err, database.ErrInvalidToken) {
+		t.Fatalf("Expected %v, got %v", database.ErrInvalidToken, err)
+	}
+	members, err := db.OrgMembers(ctx, org.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 members, got %d", len(members))
+	}
+	// Quota changes apply to all members.
+	usage := &database.QuotaUsage{StorageUsed: 2, StorageLimit: 1, UploadsCount: 1, UploadsLimit: 10}
+	err = db.OrgSetQuotaExceeded(ctx, org, true, usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserByID(ctx, member.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.QuotaExceeded || u.QuotaUsage == nil || *u.QuotaUsage != *usage {
+		t.Fatalf("Expected the member's quota to be exceeded by %+v, got %+v", usage, u.QuotaUsage)
+	}
+
+	// Remove the member. Their own tier applies again.
+	err = db.OrgMemberRemove(ctx, org, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserByID(ctx, member.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.InOrg() || u.EffectiveTier() != database.TierFree {
+		t.Fatalf("Expected the member to have left the organization, got %+v", u)
+	}
+	err = db.OrgMemberRemove(ctx, org, u)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected %v, got %v", database.ErrUserNotFound, err)
+	}
+
+	// Deleting the owner deletes the organization.
+	err = db.UserDelete(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.OrgByID(ctx, org.ID)
+	if !errors.Contains(err, database.ErrOrgNotFound) {
+		t.Fatalf("Expected %v, got %v", database.ErrOrgNotFound, err)
+	}
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestPortalStats ensures that PortalStats correctly counts the portal's
+// users, uploads and downloads.
+func TestPortalStats(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.PortalStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create users who signed up at different times and on different tiers.
+	users := make([]*database.User, 0, 4)
+	for i, age := range []time.Duration{time.Hour, 3 * 24 * time.Hour, 10 * 24 * time.Hour, 40 * 24 * time.Hour} {
+		email := types.NewEmail(fmt.Sprintf("%s_%d@siasky.net", dbName, i))
+		sub := string(fastrand.Bytes(test.UserSubLen))
+		tier := database.TierFree
+		if i%2 == 1 {
+			tier = database.TierPremium5
+		}
+		u, err := db.UserCreate(ctx, email, "", sub, tier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.CreatedAt = u.CreatedAt.Add(-age)
+		u.QuotaExceeded = i == 0
+		if err = db.UserSave(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	// The first user uploads the same skylink twice and downloads it. The
+	// second one uploads a skylink we don't know the size of.
+	sl, _, err := test.CreateTestUpload(ctx, db, *users[0], 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = test.RegisterTestUpload(ctx, db, *users[0], sl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.DownloadCreate(ctx, *users[0], "", *sl, 300, primitive.ObjectID{}); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = test.RegisterTestUpload(ctx, db, *users[1], unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := db.PortalStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.Users != before.Users+4 {
+		t.Fatalf("Expected %d users, got %d", before.Users+4, ps.Users)
+	}
+	for _, tier := range []int{database.TierFree, database.TierPremium5} {
+		if ps.UsersByTier[tier] != before.UsersByTier[tier]+2 {
+			t.Fatalf("Expected %d users on tier %d, got %d", before.UsersByTier[tier]+2, tier, ps.UsersByTier[tier])
+		}
+	}
+	if ps.NewUsers24h != before.NewUsers24h+1 || ps.NewUsers7d != before.NewUsers7d+2 || ps.NewUsers30d != before.NewUsers30d+3 {
+		t.Fatalf("Expected 1, 2 and 3 more new users than %+v, got %+v", before, ps)
+	}
+	if ps.QuotaExceededUsers != before.QuotaExceededUsers+1 {
+		t.Fatalf("Expected %d users over quota, got %d", before.QuotaExceededUsers+1, ps.QuotaExceededUsers)
+	}
+	if ps.Uploads != before.Uploads+3 || ps.UploadsSize != before.UploadsSize+2000 {
+		t.Fatalf("Expected 3 more uploads of 2000 bytes than %+v, got %+v", before, ps)
+	}
+	if ps.Downloads != before.Downloads+1 || ps.DownloadsSize != before.DownloadsSize+300 {
+		t.Fatalf("Expected one more download of 300 bytes than %+v, got %+v", before, ps)
+	}
+
+	// Deleted users aren't counted.
+	if err = db.UserSoftDelete(ctx, users[0]); err != nil {
+		t.Fatal(err)
+	}
+	ps, err = db.PortalStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.Users != before.Users+3 || ps.UsersByTier[database.TierFree] != before.UsersByTier[database.TierFree]+1 {
+		t.Fatalf("Expected 3 more users and 1 more free user than %+v, got %+v", before, ps)
+	}
+	if ps.NewUsers24h != before.NewUsers24h || ps.NewUsers7d != before.NewUsers7d+1 || ps.NewUsers30d != before.NewUsers30d+2 {
+		t.Fatalf("Expected 0, 1 and 2 more new users than %+v, got %+v", before, ps)
+	}
+	if ps.QuotaExceededUsers != before.QuotaExceededUsers {
+		t.Fatalf("Expected %d users over quota, got %d", before.QuotaExceededUsers, ps.QuotaExceededUsers)
+	}
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestSchema ensures that we create all indexes declared in the schema, that
+// we can do that repeatedly, and that we tolerate indexes which only differ
+// from the declared ones by name.
+func TestSchema(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.SanitizeName(test.DBNameForTest(t.Name()))
+	creds := test.DBTestCredentials()
+	connStr := fmt.Sprintf("mongodb://%s:%s@%s:%s/", url.QueryEscape(creds.User), url.QueryEscape(creds.Password), creds.Host, creds.Port)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Disconnect(ctx) }()
+	mdb := client.Database(dbName)
+	err = mdb.Drop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create an index which matches a declared one under a legacy name.
+	_, err = mdb.Collection("uploads").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"skylink_id": 1},
+		Options: options.Index().SetName("legacy_skylink_id"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect twice, to make sure ensuring the schema is idempotent.
+	for i := 0; i < 2; i++ {
+		db, err := database.NewCustomDB(ctx, dbName, creds, test.NewDiscardLogger(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = db.Disconnect(ctx)
+	}
+
+	// Make sure all declared indexes exist.
+	for collName, models := range database.Schema {
+		specs, err := mdb.Collection(collName).Indexes().ListSpecifications(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]struct{}, len(specs))
+		for _, spec := range specs {
+			names[spec.Name] = struct{}{}
+		}
+		for _, m := range models {
+			name := *m.Options.Name
+			if collName == "uploads" && name == "skylink_id" {
+				name = "legacy_skylink_id"
+			}
+			if _, exists := names[name]; !exists {
+				t.Fatalf("Expected index '%s' on collection '%s', got %v", name, collName, names)
+			}
+		}
+	}
+	db, err := database.NewCustomDB(ctx, dbName, creds, test.NewDiscardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Disconnect(ctx) }()
+	divs, err := db.SchemaDivergences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divs) > 0 {
+		t.Fatalf("Expected no divergences, got %+v", divs)
+	}
+
+	// Add an index we don't know about and drop one we need.
+	_, err = mdb.Collection("emails").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"to": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mdb.Collection("emails").Indexes().DropOne(ctx, "sent_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	divs, err = db.SchemaDivergences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]database.IndexDivergence{
+		"emails": {Missing: []string{"sent_at"}, Extra: []string{"to_1"}},
+	}
+	if !reflect.DeepEqual(divs, expected) {
+		t.Fatalf("Expected divergences %+v, got %+v", expected, divs)
+	}
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestStorageUsage ensures that storage reservations respect the limit, that
+// released reservations free up their storage, and that reconciliations skip
+// counters which changed since their snapshot.
+func TestStorageUsage(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), "pass", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.UserDelete(ctx, u); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Users without a counter get a zero one.
+	su, err := db.StorageUsageByUser(ctx, *u)
+	if err != nil || su.ID != u.ID || su.Storage != 0 {
+		t.Fatalf("Expected an empty counter, got %+v and %v", su, err)
+	}
+	// Reserve up to the limit.
+	limit := int64(100)
+	for i := 0; i < 2; i++ {
+		err = db.StorageReserve(ctx, *u, 50, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.StorageReservationDone(ctx, *u, 50, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.StorageReserve(ctx, *u, 1, limit)
+	if !errors.Contains(err, database.ErrStorageQuotaExceeded) {
+		t.Fatalf("Expected %v, got %v", database.ErrStorageQuotaExceeded, err)
+	}
+	// Unpinning frees up storage. Released reservations don't use any.
+	err = db.StorageUsageAdd(ctx, *u, -50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.StorageReserve(ctx, *u, 50, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.StorageReservationDone(ctx, *u, 50, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su, err = db.StorageUsageByUser(ctx, *u)
+	if err != nil || su.Storage != 50 || su.Pending != 0 {
+		t.Fatalf("Expected 50 bytes without pending reservations, got %+v and %v", su, err)
+	}
+
+	// Reconciliations skip counters with reservations in flight.
+	err = db.StorageReserve(ctx, *u, 10, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := db.StorageUsageByUser(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := db.StorageUsageReconcile(ctx, snapshot, 0)
+	if err != nil || ok {
+		t.Fatalf("Expected the reconciliation to be skipped, got %t and %v", ok, err)
+	}
+	err = db.StorageReservationDone(ctx, *u, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// They also skip counters which changed since the snapshot.
+	snapshot, err = db.StorageUsageByUser(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.StorageUsageAdd(ctx, *u, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = db.StorageUsageReconcile(ctx, snapshot, 0)
+	if err != nil || ok {
+		t.Fatalf("Expected the reconciliation to be skipped, got %t and %v", ok, err)
+	}
+	// Otherwise, they set the counter.
+	snapshot, err = db.StorageUsageByUser(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = db.StorageUsageReconcile(ctx, snapshot, 42)
+	if err != nil || !ok {
+		t.Fatalf("Expected the reconciliation to succeed, got %t and %v", ok, err)
+	}
+	su, err = db.StorageUsageByUser(ctx, *u)
+	if err != nil || su.Storage != 42 || su.ReconciledAt.IsZero() {
+		t.Fatalf("Expected a reconciled counter of 42 bytes, got %+v and %v", su, err)
+	}
+}
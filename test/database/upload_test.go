@@ -2,12 +2,18 @@ package database
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // TestUploadsByUser ensures UploadsByUser returns the correct uploads,
@@ -49,7 +55,7 @@ func TestUploadsByUser(t *testing.T) {
 		Bandwidth:      skynet.BandwidthUploadCost(testUploadSize),
 	}
 	// Fetch the user's uploads.
-	ups, n, err := db.UploadsByUser(ctx, *u, 0, database.DefaultPageSize)
+	ups, n, err := db.UploadsByUser(ctx, *u, database.UploadsFilter{}, database.DefaultUploadsSort, 0, database.DefaultPageSize)
 	if err != nil {
 		t.Fatal("Failed to fetch uploads by user.", err)
 	}
@@ -146,7 +152,8 @@ func TestUploadsByUser(t *testing.T) {
 }
 
 // TestUnpinUploads ensures UnpinUploads unpins all uploads of this
-// skylink by this user without affecting uploads by other users.
+// skylink by this user without affecting uploads by other users and that
+// RepinUploads undoes it.
 func TestUnpinUploads(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -205,7 +212,7 @@ func TestUnpinUploads(t *testing.T) {
 		t.Fatalf("Expected to unpin 2 files, unpinned %d.", unpinned)
 	}
 	// Fetch the first user's uploads.
-	_, n, err := db.UploadsByUser(ctx, *u1, 0, database.DefaultPageSize)
+	_, n, err := db.UploadsByUser(ctx, *u1, database.UploadsFilter{}, database.DefaultUploadsSort, 0, database.DefaultPageSize)
 	if err != nil {
 		t.Fatal("Failed to fetch uploads by user1.", err)
 	}
@@ -231,7 +238,7 @@ func TestUnpinUploads(t *testing.T) {
 			expectedUploadBandwidth, expectedUploadBandwidth/skynet.MiB, stats.BandwidthUploadsTotal, stats.BandwidthUploadsTotal/skynet.MiB)
 	}
 	// Fetch the second user's uploads.
-	_, n, err = db.UploadsByUser(ctx, *u2, 0, database.DefaultPageSize)
+	_, n, err = db.UploadsByUser(ctx, *u2, database.UploadsFilter{}, database.DefaultUploadsSort, 0, database.DefaultPageSize)
 	if err != nil {
 		t.Fatal("Failed to fetch uploads by user2.", err)
 	}
@@ -257,6 +264,47 @@ func TestUnpinUploads(t *testing.T) {
 		t.Fatalf("Expected upload bandwidth used of %d (%d MiB), got %d (%d MiB).",
 			expectedUploadBandwidth, expectedUploadBandwidth/skynet.MiB, stats.BandwidthUploads, stats.BandwidthUploads/skynet.MiB)
 	}
+
+	// The first user's unpinned uploads are only listed on demand.
+	ups, n, err := db.UploadsByUser(ctx, *u1, database.UploadsFilter{IncludeUnpinned: true}, database.DefaultUploadsSort, 0, database.DefaultPageSize)
+	if err != nil {
+		t.Fatal("Failed to fetch uploads by user1.", err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected to have exactly %d upload(s), got %d.", 2, n)
+	}
+	for _, up := range ups {
+		if !up.Unpinned || up.UnpinnedAt == nil {
+			t.Fatalf("Expected upload %+v to be unpinned.", up)
+		}
+	}
+	// Repin them.
+	repinned, err := db.RepinUploads(ctx, *sl, *u1)
+	if err != nil {
+		t.Fatal("Failed to repin.", err)
+	}
+	if repinned != 2 {
+		t.Fatalf("Expected to repin 2 files, repinned %d.", repinned)
+	}
+	ups, n, err = db.UploadsByUser(ctx, *u1, database.UploadsFilter{}, database.DefaultUploadsSort, 0, database.DefaultPageSize)
+	if err != nil {
+		t.Fatal("Failed to fetch uploads by user1.", err)
+	}
+	if n != 2 || ups[0].Unpinned || ups[0].UnpinnedAt != nil {
+		t.Fatalf("Expected 2 pinned uploads, got %d: %+v", n, ups)
+	}
+	stats, err = db.UserStats(ctx, *u1)
+	if err != nil {
+		t.Fatal("Failed to fetch user1.", err)
+	}
+	if stats.TotalUploadsSize != testUploadSize {
+		t.Fatalf("Expected total upload size of %d, got %d.", testUploadSize, stats.TotalUploadsSize)
+	}
+	// Repinning again is a no-op.
+	repinned, err = db.RepinUploads(ctx, *sl, *u1)
+	if err != nil || repinned != 0 {
+		t.Fatalf("Expected to repin no files, repinned %d and got %v.", repinned, err)
+	}
 }
 
 // TestUploadCreateAnon ensures that UploadCreate can create anonymous uploads.
@@ -277,7 +325,7 @@ func TestUploadCreateAnon(t *testing.T) {
 	}
 	// Register an anonymous upload.
 	ip := "1.0.2.233"
-	up, err := db.UploadCreate(ctx, database.AnonUser, ip, *skylink)
+	up, err := db.UploadCreate(ctx, database.AnonUser, ip, *skylink, primitive.ObjectID{}, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -288,7 +336,7 @@ func TestUploadCreateAnon(t *testing.T) {
 		t.Fatalf("Expected UploaderIP '%s', got '%s'", ip, up.UploaderIP)
 	}
 	// Register an anonymous upload without an UploaderIP address.
-	up, err = db.UploadCreate(ctx, database.AnonUser, "", *skylink)
+	up, err = db.UploadCreate(ctx, database.AnonUser, "", *skylink, primitive.ObjectID{}, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -299,3 +347,189 @@ func TestUploadCreateAnon(t *testing.T) {
 		t.Fatalf("Expected empty UploaderIP, got '%s'", up.UploaderIP)
 	}
 }
+
+// TestUploadCreateDedup ensures that UploadCreate doesn't track duplicate
+// uploads.
+func TestUploadCreateDedup(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := string(fastrand.Bytes(test.UserSubLen))
+	u, err := db.UserCreate(ctx, "user@example.com", "", sub, database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skylink, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Track the same upload twice with the same request ID.
+	up1, err := db.UploadCreate(ctx, *u, "", *skylink, primitive.ObjectID{}, "req1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up2, err := db.UploadCreate(ctx, *u, "", *skylink, primitive.ObjectID{}, "req1")
+	if !errors.Contains(err, database.ErrDuplicateUpload) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrDuplicateUpload, err)
+	}
+	if up2.ID != up1.ID {
+		t.Fatalf("Expected the existing upload %s, got %s", up1.ID.Hex(), up2.ID.Hex())
+	}
+	// The same request ID by another user is not a duplicate.
+	_, err = db.UploadCreate(ctx, database.AnonUser, "", *skylink, primitive.ObjectID{}, "req1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploads != 1 {
+		t.Fatalf("Expected %d upload, got %d", 1, stats.NumUploads)
+	}
+
+	// Enable the skylink deduplication window and track an upload without a
+	// request ID twice.
+	oldWindow := database.UploadSkylinkDedupWindow
+	database.UploadSkylinkDedupWindow = time.Minute
+	defer func() { database.UploadSkylinkDedupWindow = oldWindow }()
+	skylink2, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	up1, err = db.UploadCreate(ctx, *u, "", *skylink2, primitive.ObjectID{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up2, err = db.UploadCreate(ctx, *u, "", *skylink2, primitive.ObjectID{}, "")
+	if !errors.Contains(err, database.ErrDuplicateUpload) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrDuplicateUpload, err)
+	}
+	if up2.ID != up1.ID {
+		t.Fatalf("Expected the existing upload %s, got %s", up1.ID.Hex(), up2.ID.Hex())
+	}
+	stats, err = db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploads != 2 {
+		t.Fatalf("Expected %d uploads, got %d", 2, stats.NumUploads)
+	}
+
+	// Concurrent uploads of the same skylink are only tracked once. We use a
+	// long window, so the requests don't straddle two buckets.
+	database.UploadSkylinkDedupWindow = time.Hour
+	skylink3, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.UploadCreate(ctx, *u, "", *skylink3, primitive.ObjectID{}, "")
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, err = range errs {
+		if err == nil {
+			created++
+		} else if !errors.Contains(err, database.ErrDuplicateUpload) {
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected %d upload to be created, got %d", 1, created)
+	}
+	stats, err = db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploads != 3 {
+		t.Fatalf("Expected %d uploads, got %d", 3, stats.NumUploads)
+	}
+}
+
+// TestUsersWithPinnedSkylink ensures that UsersWithPinnedSkylink pages
+// through the users who have a pinned upload of a skylink.
+func TestUsersWithPinnedSkylink(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skylink, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three users upload the skylink, the first one twice. Anonymous uploads
+	// and unpinned uploads don't count.
+	var users []*database.User
+	for i := 0; i < 4; i++ {
+		sub := string(fastrand.Bytes(test.UserSubLen))
+		u, err := db.UserCreate(ctx, types.NewEmail(fmt.Sprintf("user%d@example.com", i)), "", sub, database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = test.RegisterTestUpload(ctx, db, *u, skylink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	_, _, err = test.RegisterTestUpload(ctx, db, *users[0], skylink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.RegisterTestUpload(ctx, db, database.AnonUser, skylink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UnpinUploads(ctx, *skylink, *users[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Page through them, two at a time.
+	page1, err := db.UsersWithPinnedSkylink(ctx, skylink.ID, primitive.ObjectID{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page1) != 2 {
+		t.Fatalf("Expected 2 users, got %d", len(page1))
+	}
+	page2, err := db.UsersWithPinnedSkylink(ctx, skylink.ID, page1[1], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page2) != 1 {
+		t.Fatalf("Expected 1 user, got %d", len(page2))
+	}
+	found := make(map[primitive.ObjectID]bool)
+	for _, id := range append(page1, page2...) {
+		found[id] = true
+	}
+	for i, u := range users[:3] {
+		if !found[u.ID] {
+			t.Fatalf("Expected to find user %d", i)
+		}
+	}
+	// Invalid arguments are rejected.
+	_, err = db.UsersWithPinnedSkylink(ctx, primitive.ObjectID{}, primitive.ObjectID{}, 2)
+	if !errors.Contains(err, database.ErrInvalidSkylink) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidSkylink, err)
+	}
+}
@@ -3,11 +3,15 @@ package database
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/lib"
@@ -16,6 +20,7 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.sia.tech/siad/crypto"
 )
@@ -67,6 +72,74 @@ func TestUserByEmail(t *testing.T) {
 	}
 }
 
+// TestUserEmailCaseInsensitive ensures that we find users by their email
+// regardless of its capitalization and that the unique index doesn't allow two
+// users whose emails only differ by capitalization.
+func TestUserEmailCaseInsensitive(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := types.NewEmail(dbName + "@siasky.net")
+	u, err := db.UserCreate(ctx, email, "", dbName+"_sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		if err := db.UserDelete(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}(u)
+	// Store the email with mixed case, as older versions of the service might
+	// have done, and make sure we still find the user.
+	u.Email = types.Email(strings.ToUpper(string(email)))
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByEmail(ctx, email)
+	if err != nil || u2.ID != u.ID {
+		t.Fatalf("Expected to find user %s, got %+v and %v", u.ID.Hex(), u2, err)
+	}
+	// Another user can't take the email, not even by bypassing our checks.
+	_, err = db.UserCreate(ctx, email, "", dbName+"_other", database.TierFree)
+	if !errors.Contains(err, database.ErrUserAlreadyExists) {
+		t.Fatalf("Expected error %v, got %v", database.ErrUserAlreadyExists, err)
+	}
+	other, err := db.UserCreate(ctx, types.NewEmail(dbName+"_other@siasky.net"), "", dbName+"_other", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		if err := db.UserDelete(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}(other)
+	other.Email = email
+	err = db.UserSave(ctx, other)
+	if !errors.Contains(err, database.ErrUserAlreadyExists) {
+		t.Fatalf("Expected error %v, got %v", database.ErrUserAlreadyExists, err)
+	}
+	// Users without an email don't collide with each other.
+	for i := 0; i < 2; i++ {
+		nu, err := db.UserCreate(ctx, "", "", fmt.Sprintf("%s_noemail_%d", dbName, i), database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func(user *database.User) {
+			if err := db.UserDelete(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+		}(nu)
+	}
+}
+
 // TestUserByID ensures UserByID works as expected.
 func TestUserByID(t *testing.T) {
 	if testing.Short() {
@@ -275,8 +348,20 @@ func TestUserConfirmEmail(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed to create a test user:", err)
 	}
+	// confirm looks up the user by the given token and confirms their email.
+	confirm := func(token string) (*database.User, error) {
+		u, err := db.UserByConfirmationToken(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		err = db.UserApplyEmailConfirmation(ctx, u, token)
+		if err != nil {
+			return nil, err
+		}
+		return u, db.UserSave(ctx, u)
+	}
 	// Confirm the email.
-	_, err = db.UserConfirmEmail(ctx, u.EmailConfirmationToken)
+	u, err = confirm(u.EmailConfirmationToken)
 	if err != nil {
 		t.Fatal("Failed to confirm email:", err)
 	}
@@ -293,7 +378,7 @@ func TestUserConfirmEmail(t *testing.T) {
 	}
 	// Try to confirm the email, expecting to get an error because the token has
 	// expired.
-	_, err = db.UserConfirmEmail(ctx, u.EmailConfirmationToken)
+	_, err = confirm(u.EmailConfirmationToken)
 	if !errors.Contains(err, database.ErrInvalidToken) {
 		t.Fatalf("Expected error '%s', got '%s'\n", database.ErrInvalidToken.Error(), err.Error())
 	}
@@ -475,6 +560,168 @@ func TestUserSave(t *testing.T) {
 	}
 }
 
+// TestUserSaveStale ensures that UserSave refuses to overwrite changes it
+// hasn't seen and that no change is lost when the caller retries with fresh
+// data.
+func TestUserSaveStale(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), "", t.Name()+"_sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remove the user's version, so they look like a user who was saved
+	// before we started versioning users.
+	creds := test.DBTestCredentials()
+	connStr := fmt.Sprintf("mongodb://%s:%s@%s:%s/", url.QueryEscape(creds.User), url.QueryEscape(creds.Password), creds.Host, creds.Port)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Disconnect(ctx) }()
+	users := client.Database(test.SanitizeName(dbName)).Collection("users")
+	_, err = users.UpdateOne(ctx, bson.M{"_id": u.ID}, bson.M{"$unset": bson.M{"version": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch two copies of the same user and change each of them.
+	u1, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.Version != 0 {
+		t.Fatalf("Expected version 0 for a legacy user, got %d", u1.Version)
+	}
+	u1.Name = "name"
+	u2.Locale = "de"
+	// The first save upgrades the legacy document.
+	err = db.UserSave(ctx, u1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.Version != 1 {
+		t.Fatalf("Expected version 1, got %d", u1.Version)
+	}
+	// The second one is based on a stale copy.
+	err = db.UserSave(ctx, u2)
+	if !errors.Contains(err, database.ErrStaleDocument) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrStaleDocument, err)
+	}
+	// Retry with fresh data.
+	u2, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2.Locale = "de"
+	err = db.UserSave(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure that both changes made it.
+	u3, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u3.Name != "name" || u3.Locale != "de" {
+		t.Fatalf("Expected name 'name' and locale 'de', got '%s' and '%s'", u3.Name, u3.Locale)
+	}
+	if u3.Version != 2 {
+		t.Fatalf("Expected version 2, got %d", u3.Version)
+	}
+	// The copy we saved first is now stale as well.
+	u1.Name = "other"
+	err = db.UserSave(ctx, u1)
+	if !errors.Contains(err, database.ErrStaleDocument) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrStaleDocument, err)
+	}
+}
+
+// TestUserTargetedUpdatesBumpVersion ensures that the targeted updates of a
+// user make stale copies of the user fail to save, so they can't overwrite
+// the updated fields.
+func TestUserTargetedUpdatesBumpVersion(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), "", t.Name()+"_sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pk := crypto.GenerateKeyPair()
+	updates := map[string]func(u *database.User) error{
+		"UserSetTier": func(u *database.User) error {
+			return db.UserSetTier(ctx, u, database.TierPremium5)
+		},
+		"UserSetTrial": func(u *database.User) error {
+			return db.UserSetTrial(ctx, u, database.TierPremium20, time.Now().Add(time.Hour))
+		},
+		"UserRotateGrantSecret": func(u *database.User) error {
+			return db.UserRotateGrantSecret(ctx, u)
+		},
+		"UserRecordPaymentFailure": func(u *database.User) error {
+			return db.UserRecordPaymentFailure(ctx, u, "evt_"+t.Name())
+		},
+		"UserPubKeyAdd": func(u *database.User) error {
+			return db.UserPubKeyAdd(ctx, *u, pk[:])
+		},
+		"UserTwoFactorUseStep": func(u *database.User) error {
+			return db.UserTwoFactorUseStep(ctx, u, time.Now().Unix())
+		},
+	}
+	for name, update := range updates {
+		stale, err := db.UserByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fresh, err := db.UserByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = update(fresh)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		stale.Name = name
+		err = db.UserSave(ctx, stale)
+		if !errors.Contains(err, database.ErrStaleDocument) {
+			t.Fatalf("%s: expected '%v', got '%v'", name, database.ErrStaleDocument, err)
+		}
+	}
+	// Updates which mirror the change on the given copy of the user keep that
+	// copy fresh.
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserSetTier(ctx, u, database.TierPremium80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Name = "name"
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TestUserSetStripeID ensures that UserSetStripeID works as expected.
 func TestUserSetStripeID(t *testing.T) {
 	if testing.Short() {
@@ -644,6 +891,49 @@ func TestUserSetTier(t *testing.T) {
 	}
 }
 
+// TestUserSetLastLogin ensures that UserSetLastLogin works as expected.
+func TestUserSetLastLogin(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		err = db.UserDelete(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(u)
+	if !u.LastLoginAt.IsZero() {
+		t.Fatalf("Expected zero last login time, got %v", u.LastLoginAt)
+	}
+	err = db.UserSetLastLogin(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.LastLoginAt.IsZero() || !u2.LastLoginAt.Equal(u.LastLoginAt) {
+		t.Fatalf("Expected last login time %v, got %v", u.LastLoginAt, u2.LastLoginAt)
+	}
+	// Set the last login of a non-existent user. Expect this to fail.
+	uNon := &database.User{ID: primitive.NewObjectID()}
+	err = db.UserSetLastLogin(ctx, uNon)
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+}
+
 // TestUserStats ensures we report accurate statistics for users.
 func TestUserStats(t *testing.T) {
 	if testing.Short() {
@@ -721,7 +1011,7 @@ func TestUserStats(t *testing.T) {
 
 	// Register a small download.
 	smallDownload := int64(1 + fastrand.Intn(4*skynet.MiB))
-	_, err = db.DownloadCreate(ctx, *u, *skylinkSmall, smallDownload)
+	_, err = db.DownloadCreate(ctx, *u, "", *skylinkSmall, smallDownload, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal("Failed to download.", err)
 	}
@@ -749,7 +1039,7 @@ func TestUserStats(t *testing.T) {
 	}
 	// Register a big download.
 	bigDownload := int64(100*skynet.MiB + fastrand.Intn(4*skynet.MiB))
-	_, err = db.DownloadCreate(ctx, *u, *skylinkBig, bigDownload)
+	_, err = db.DownloadCreate(ctx, *u, "", *skylinkBig, bigDownload, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal("Failed to download.", err)
 	}
@@ -769,7 +1059,7 @@ func TestUserStats(t *testing.T) {
 	}
 
 	// Register a registry read.
-	_, err = db.RegistryReadCreate(ctx, *u)
+	_, err = db.RegistryReadCreate(ctx, *u, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal("Failed to register a registry read.", err)
 	}
@@ -788,7 +1078,7 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegReads, stats.BandwidthRegReads/skynet.MiB)
 	}
 	// Register a registry read.
-	_, err = db.RegistryReadCreate(ctx, *u)
+	_, err = db.RegistryReadCreate(ctx, *u, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal("Failed to register a registry read.", err)
 	}
@@ -808,7 +1098,7 @@ func TestUserStats(t *testing.T) {
 	}
 
 	// Register a registry write.
-	_, err = db.RegistryWriteCreate(ctx, *u)
+	_, err = db.RegistryWriteCreate(ctx, *u, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal("Failed to register a registry write.", err)
 	}
@@ -827,7 +1117,7 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegWrites, stats.BandwidthRegWrites/skynet.MiB)
 	}
 	// Register a registry write.
-	_, err = db.RegistryWriteCreate(ctx, *u)
+	_, err = db.RegistryWriteCreate(ctx, *u, primitive.ObjectID{})
 	if err != nil {
 		t.Fatal("Failed to register a registry write.", err)
 	}
@@ -846,3 +1136,171 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegWrites, stats.BandwidthRegWrites/skynet.MiB)
 	}
 }
+
+// TestUserStatsHistory ensures we attribute usage to the right billing month.
+func TestUserStatsHistory(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := string(fastrand.Bytes(test.UserSubLen))
+	u, err := db.UserCreate(ctx, "user@example.com", "", sub, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Anchor the user's billing months on the 15th, so they don't match the
+	// calendar months.
+	u.SubscribedUntil = time.Date(2030, 1, 15, 0, 0, 0, 0, time.UTC)
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch the boundaries of the last three billing months.
+	hist, err := db.UserStatsHistory(ctx, *u, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 3 {
+		t.Fatalf("Expected %d months, got %d", 3, len(hist))
+	}
+	for i, m := range hist {
+		if m.PeriodStart.Day() != 15 || m.NumUploads != 0 || m.RawStorageUsed != 0 {
+			t.Fatalf("Unexpected month %d: %+v", i, m)
+		}
+		if i > 0 && !hist[i-1].PeriodEnd.Equal(m.PeriodStart) {
+			t.Fatalf("Expected month %d to start when month %d ends, got %+v and %+v", i, i-1, m, hist[i-1])
+		}
+	}
+
+	// Create uploads and move them into the past. The oldest month gets one
+	// upload, the middle one gets two, one of which is right before the next
+	// month starts, and the current month gets one.
+	size := int64(5 * skynet.MiB)
+	timestamps := []time.Time{
+		hist[0].PeriodStart.Add(time.Hour),
+		hist[1].PeriodStart.Add(time.Hour),
+		hist[2].PeriodStart.Add(-time.Second),
+		time.Now().UTC().Add(-time.Second),
+	}
+	for _, ts := range timestamps {
+		_, upID, err := test.CreateTestUpload(ctx, db, *u, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UpdateUpload(ctx, upID, bson.M{"$set": bson.M{"timestamp": ts}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Register a registry read in the current month.
+	_, err = db.RegistryReadCreate(ctx, *u, primitive.ObjectID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hist, err = db.UserStatsHistory(ctx, *u, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUploads := []int64{1, 2, 1}
+	for i, m := range hist {
+		if m.NumUploads != expectedUploads[i] {
+			t.Fatalf("Expected %d uploads in month %d, got %d", expectedUploads[i], i, m.NumUploads)
+		}
+		expectedBW := expectedUploads[i] * skynet.BandwidthUploadCost(size)
+		if m.BandwidthUploads != expectedBW {
+			t.Fatalf("Expected upload bandwidth %d in month %d, got %d", expectedBW, i, m.BandwidthUploads)
+		}
+	}
+	// The storage snapshot is cumulative.
+	storage := skynet.RawStorageUsed(size)
+	expectedStorage := []int64{storage, 3 * storage, 4 * storage}
+	for i, m := range hist {
+		if m.RawStorageUsed != expectedStorage[i] {
+			t.Fatalf("Expected storage %d in month %d, got %d", expectedStorage[i], i, m.RawStorageUsed)
+		}
+	}
+	if hist[2].NumRegReads != 1 || hist[2].BandwidthRegReads != skynet.CostBandwidthRegistryRead || hist[1].NumRegReads != 0 {
+		t.Fatalf("Expected a single registry read in the current month, got %+v", hist)
+	}
+	// The current month matches what UserStats reports.
+	stats, err := db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploads != hist[2].NumUploads || stats.BandwidthUploads != hist[2].BandwidthUploads {
+		t.Fatalf("Expected the current month to match the stats, got %+v and %+v", hist[2], stats)
+	}
+
+	// Invalid number of months.
+	_, err = db.UserStatsHistory(ctx, *u, 0)
+	if err == nil {
+		t.Fatal("Expected an error for zero months.")
+	}
+	_, err = db.UserStatsHistory(ctx, *u, database.UserStatsHistoryMaxMonths+1)
+	if err == nil {
+		t.Fatal("Expected an error for too many months.")
+	}
+}
+
+// TestUsersWithQuotaExceeded ensures that UsersWithQuotaExceeded pages through
+// the users whose QuotaExceeded flag is set.
+func TestUsersWithQuotaExceeded(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three out of four users are over quota.
+	var users []*database.User
+	for i := 0; i < 4; i++ {
+		sub := string(fastrand.Bytes(test.UserSubLen))
+		u, err := db.UserCreate(ctx, types.NewEmail(fmt.Sprintf("%s_%d@siasky.net", dbName, i)), "", sub, database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.QuotaExceeded = i != 3
+		if err = db.UserSave(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	// Page through them, two at a time.
+	page1, err := db.UsersWithQuotaExceeded(ctx, primitive.ObjectID{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page1) != 2 {
+		t.Fatalf("Expected 2 users, got %d", len(page1))
+	}
+	page2, err := db.UsersWithQuotaExceeded(ctx, page1[1].ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page2) != 1 {
+		t.Fatalf("Expected 1 user, got %d", len(page2))
+	}
+	found := make(map[primitive.ObjectID]bool)
+	for _, u := range append(page1, page2...) {
+		found[u.ID] = true
+	}
+	for i, u := range users[:3] {
+		if !found[u.ID] {
+			t.Fatalf("Expected to find user %d", i)
+		}
+	}
+	// Invalid limits are rejected.
+	if _, err = db.UsersWithQuotaExceeded(ctx, primitive.ObjectID{}, 0); err == nil {
+		t.Fatal("Expected an error for a zero limit.")
+	}
+}
@@ -1,6 +1,9 @@
 package test
 
-import "gitlab.com/SkynetLabs/skyd/skymodules"
+import (
+	"github.com/SkynetLabs/skynet-accounts/lib"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
 
 // DependencySkipSendingEmails is a test dependency that causes the email sender
 // not to send the emails and to directly return a success instead.
@@ -12,3 +15,39 @@ type DependencySkipSendingEmails struct {
 func (d *DependencySkipSendingEmails) Disrupt(s string) bool {
 	return s == "SkipSendingEmails"
 }
+
+// DependencySkipRateLimiting is a test dependency that disables the rate
+// limiting of the authentication endpoints, so tests can log in as often as
+// they need to.
+type DependencySkipRateLimiting struct {
+	lib.ProductionDependencies
+}
+
+// Disrupt will check for a specific disrupt and respond accordingly.
+func (d *DependencySkipRateLimiting) Disrupt(s string) bool {
+	return s == "DependencySkipRateLimiting"
+}
+
+// DependencyLimitsDelay is a test dependency that causes the `GET /limits`
+// endpoint to respond slowly, so we can shut down the server while a request
+// is in flight.
+type DependencyLimitsDelay struct {
+	DependencySkipRateLimiting
+}
+
+// Disrupt will check for a specific disrupt and respond accordingly.
+func (d *DependencyLimitsDelay) Disrupt(s string) bool {
+	return s == "DependencyLimitsDelay" || d.DependencySkipRateLimiting.Disrupt(s)
+}
+
+// DependencyUploadsAggregationDelay is a test dependency that causes the
+// uploads aggregation to stall until its context expires, so we can test how
+// requests time out.
+type DependencyUploadsAggregationDelay struct {
+	DependencySkipRateLimiting
+}
+
+// Disrupt will check for a specific disrupt and respond accordingly.
+func (d *DependencyUploadsAggregationDelay) Disrupt(s string) bool {
+	return s == "DependencyUploadsAggregationDelay" || d.DependencySkipRateLimiting.Disrupt(s)
+}
@@ -22,6 +22,13 @@ type (
 	// DependencyUserPutMongoDelay causes the `PUT /user` endpoint to add a delay before
 	// writing to Mongo.
 	DependencyUserPutMongoDelay struct{}
+	// DependencyEmailCreateWriteConflictN causes queueing emails to fail with
+	// a WriteConflict the given number of times in a row. It doesn't cause
+	// any failures until it's told how many to cause.
+	DependencyEmailCreateWriteConflictN struct {
+		remainingFailures uint
+		mu                sync.Mutex
+	}
 )
 
 // Disrupt causes the `PUT /user` endpoint to add a delay before writing to
@@ -54,3 +61,30 @@ func (d *DependencyUserPutMongoDelay) Disrupt(s string) bool {
 func NewDependencyUserPutMongoDelay() lib.Dependencies {
 	return &DependencyMongoWriteConflictN{}
 }
+
+// Disrupt causes queueing emails to fail with a WriteConflict.
+func (d *DependencyEmailCreateWriteConflictN) Disrupt(s string) bool {
+	if s != "DependencyEmailCreateWriteConflictN" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.remainingFailures == 0 {
+		return false
+	}
+	d.remainingFailures--
+	return true
+}
+
+// SetFailures sets the number of times in a row queueing emails will fail.
+func (d *DependencyEmailCreateWriteConflictN) SetFailures(n uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remainingFailures = n
+}
+
+// NewDependencyEmailCreateWriteConflictN returns a new
+// DependencyEmailCreateWriteConflictN.
+func NewDependencyEmailCreateWriteConflictN() *DependencyEmailCreateWriteConflictN {
+	return &DependencyEmailCreateWriteConflictN{}
+}
@@ -0,0 +1,178 @@
+package email
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestMailerCustomTemplates ensures that the Mailer uses the email templates
+// from its templates directory and picks the translation matching the user's
+// locale.
+func TestMailerCustomTemplates(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	templates := map[string]string{
+		"confirm_email.html":    `{{define "subject"}}Custom confirmation{{end}}Custom: {{.ConfirmEndpoint}}?token={{.Token}}`,
+		"confirm_email.de.html": `{{define "subject"}}Bitte bestätigen{{end}}Deutsch: {{.ConfirmEndpoint}}?token={{.Token}}`,
+	}
+	for name, content := range templates {
+		err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mailer, err := email.NewCustomMailer(db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A missing templates directory is fine.
+	_, err = email.NewCustomMailer(db, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a German user.
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	u, err := db.UserCreate(ctx, to, "", string(fastrand.Bytes(test.UserSubLen)), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Locale = "de"
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserBySub(ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Locale != "de" {
+		t.Fatalf("Expected locale 'de', got '%s'", u.Locale)
+	}
+
+	// The user gets the German version of the custom template.
+	err = mailer.SendAddressConfirmationEmail(ctx, u.Email, t.Name(), u.Locale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A user without a translation gets the English version.
+	toEn := types.NewEmail(t.Name() + "_en@siasky.net")
+	err = mailer.SendAddressConfirmationEmail(ctx, toEn, t.Name(), "fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		to      types.Email
+		subject string
+		body    string
+	}{
+		{to: to, subject: "Bitte bestätigen", body: "Deutsch: " + email.PortalAddressAccounts + "/user/confirm?token=" + t.Name()},
+		{to: toEn, subject: "Custom confirmation", body: "Custom: " + email.PortalAddressAccounts + "/user/confirm?token=" + t.Name()},
+	}
+	for _, tt := range tests {
+		_, emails, err := db.FindEmails(ctx, bson.M{"to": tt.to}, &options.FindOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(emails) != 1 {
+			t.Fatalf("Expected 1 email to %s, got %d", tt.to, len(emails))
+		}
+		if emails[0].Subject != tt.subject || !strings.Contains(emails[0].Body, tt.body) {
+			t.Fatalf("Expected an email with subject '%s' and body '%s', got %+v", tt.subject, tt.body, emails[0])
+		}
+	}
+}
+
+// TestMailerEmailPreferences ensures that the Mailer suppresses the emails
+// whose recipients opted out of their category, that the Sender skips them,
+// and that it always sends transactional emails.
+func TestMailerEmailPreferences(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	mailer := email.NewMailer(db)
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	u, err := db.UserCreate(ctx, to, "", string(fastrand.Bytes(test.UserSubLen)), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opt out of product emails.
+	u.EmailPreferences = &database.EmailPreferences{Security: true}
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err1 := mailer.SendQuotaExceededEmail(ctx, to, "")
+	err2 := mailer.SendAccountLockedEmail(ctx, to, time.Now(), "")
+	err3 := mailer.SendAddressConfirmationEmail(ctx, to, t.Name(), "")
+	if err = errors.Compose(err1, err2, err3); err != nil {
+		t.Fatal(err)
+	}
+	_, emails, err := db.FindEmails(ctx, bson.M{"to": to}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 3 {
+		t.Fatalf("Expected 3 emails, got %d", len(emails))
+	}
+	suppressed := map[database.EmailCategory]bool{
+		database.EmailCategoryProduct:       true,
+		database.EmailCategorySecurity:      false,
+		database.EmailCategoryTransactional: false,
+	}
+	for _, m := range emails {
+		if expected, exists := suppressed[m.Category]; !exists || m.Suppressed != expected {
+			t.Fatalf("Expected the %s email to be suppressed: %t, got %t", m.Category, expected, m.Suppressed)
+		}
+		// Only the emails users can opt out of have an unsubscribe link.
+		if m.Category.Optional() != strings.Contains(m.Body, email.PortalAddressAccounts+"/email/unsubscribe?token=") {
+			t.Fatalf("Unexpected unsubscribe link in the %s email", m.Category)
+		}
+	}
+
+	// The Sender only picks up the emails which aren't suppressed.
+	sender, err := email.NewSender(ctx, db, test.NewDiscardLogger(), &test.DependencySkipSendingEmails{}, test.FauxEmailURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	success, failure := sender.ScanAndSend(t.Name())
+	if success != 2 || failure != 0 {
+		t.Fatalf("Expected to send 2 emails, sent %d and failed %d", success, failure)
+	}
+}
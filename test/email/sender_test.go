@@ -2,8 +2,12 @@ package email
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -13,6 +17,8 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/test"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.sia.tech/siad/build"
@@ -49,7 +55,7 @@ func TestSender(t *testing.T) {
 	// Send an email.
 	to := types.NewEmail(t.Name() + "@siasky.net")
 	token := t.Name()
-	err = mailer.SendAddressConfirmationEmail(ctx, to, token)
+	err = mailer.SendAddressConfirmationEmail(ctx, to, token, "")
 	if err != nil {
 		t.Fatal(err, "Failed to queue message for sending.")
 	}
@@ -120,7 +126,7 @@ func TestContendingSenders(t *testing.T) {
 		for i := 0; i < n; i++ {
 			// We'll use the target email address as token because it doesn't
 			// matter what we use.
-			err1 := m.SendAddressConfirmationEmail(ctx, targetAddr, targetAddr.String())
+			err1 := m.SendAddressConfirmationEmail(ctx, targetAddr, targetAddr.String(), "")
 			if err1 != nil {
 				t.Error("Failed to send email.", err1)
 				return
@@ -173,3 +179,200 @@ func TestContendingSenders(t *testing.T) {
 		t.Fatalf("Expected %d messages to be sent, got %d.", numMsgs, count)
 	}
 }
+
+// TestSenderHTTPDeliverer ensures that the Sender can deliver a confirmation
+// email through the HTTP backend and that the messages the email API rejects
+// stay in the DB to be retried.
+func TestSenderHTTPDeliverer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	// The email API rejects the first request and accepts the rest.
+	var mu sync.Mutex
+	var requests int
+	var received []map[string]string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 || req.Header.Get("Authorization") != "Bearer apikey" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var m map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, m)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	d, err := email.NewHTTPDeliverer(strings.Replace(ts.URL, "https://", "https://apikey@", 1)+"/send", ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := email.NewSenderWithDeliverer(ctx, db, test.NewDiscardLogger(), &skymodules.SkynetDependencies{}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer := email.NewMailer(db)
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	err = mailer.SendAddressConfirmationEmail(ctx, to, t.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt fails and the message remains unsent.
+	sent, failed := sender.ScanAndSend(t.Name())
+	if sent != 0 || failed != 1 {
+		t.Fatalf("Expected 0 sent and 1 failed, got %d and %d", sent, failed)
+	}
+	filterTo := bson.M{"to": to}
+	_, emails, err := db.FindEmails(ctx, filterTo, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].FailedAttempts != 1 || !emails[0].SentAt.IsZero() {
+		t.Fatalf("Unexpected emails %+v", emails)
+	}
+	// The second attempt succeeds.
+	sent, failed = sender.ScanAndSend(t.Name())
+	if sent != 1 || failed != 0 {
+		t.Fatalf("Expected 1 sent and 0 failed, got %d and %d", sent, failed)
+	}
+	_, emails, err = db.FindEmails(ctx, filterTo, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].SentAt.IsZero() {
+		t.Fatalf("Unexpected emails %+v", emails)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0]["to"] != to.String() || received[0]["subject"] != emails[0].Subject || received[0]["bodyMime"] != "text/html" {
+		t.Fatalf("Unexpected messages received by the email API: %+v", received)
+	}
+}
+
+// TestSenderFauxDeliverer ensures that the Sender retries the messages which
+// its Deliverer fails to deliver.
+func TestSenderFauxDeliverer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	d := &test.FauxDeliverer{}
+	d.SetErr(errors.New("delivery failed"))
+	sender, err := email.NewSenderWithDeliverer(ctx, db, test.NewDiscardLogger(), &skymodules.SkynetDependencies{}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	err = email.NewMailer(db).SendRecoverAccountEmail(ctx, to, t.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, failed := sender.ScanAndSend(t.Name())
+	if sent != 0 || failed != 1 || len(d.Messages()) != 0 {
+		t.Fatalf("Expected 0 sent and 1 failed, got %d and %d", sent, failed)
+	}
+	d.SetErr(nil)
+	sent, failed = sender.ScanAndSend(t.Name())
+	if sent != 1 || failed != 0 {
+		t.Fatalf("Expected 1 sent and 0 failed, got %d and %d", sent, failed)
+	}
+	msgs := d.Messages()
+	if len(msgs) != 1 || msgs[0].To != to.String() {
+		t.Fatalf("Unexpected messages %+v", msgs)
+	}
+}
+
+// TestSenderMaxPerMinute ensures that the Sender doesn't send more messages
+// per minute than allowed and that the rest of them stay in the DB.
+func TestSenderMaxPerMinute(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	defer func(old int) { email.MaxPerMinute = old }(email.MaxPerMinute)
+	email.MaxPerMinute = 3
+	d := &test.FauxDeliverer{}
+	sender, err := email.NewSenderWithDeliverer(ctx, db, test.NewDiscardLogger(), &skymodules.SkynetDependencies{}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	mailer := email.NewMailer(db)
+	for i := 0; i < 10; i++ {
+		err = mailer.SendRecoverAccountEmail(ctx, to, t.Name(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent, failed := sender.ScanAndSend(t.Name())
+	if sent != 3 || failed != 0 || len(d.Messages()) != 3 {
+		t.Fatalf("Expected 3 sent and 0 failed, got %d and %d", sent, failed)
+	}
+	_, emails, err := db.FindEmails(ctx, bson.M{"to": to, "sent_at": nil}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 7 {
+		t.Fatalf("Expected 7 queued emails, got %d", len(emails))
+	}
+	for _, e := range emails {
+		if e.LockedBy != "" {
+			t.Fatalf("Expected queued emails to be unlocked, got one locked by '%s'", e.LockedBy)
+		}
+	}
+	// We've used up this minute's budget.
+	sent, failed = sender.ScanAndSend(t.Name())
+	if sent != 0 || failed != 0 {
+		t.Fatalf("Expected 0 sent and 0 failed, got %d and %d", sent, failed)
+	}
+}
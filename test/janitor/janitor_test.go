@@ -0,0 +1,111 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/janitor"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/build"
+)
+
+// TestJanitor ensures that the janitor purges deleted users and their data
+// once their grace period passes and leaves everyone else alone.
+func TestJanitor(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shorten the grace period.
+	gp := database.UserDeleteGracePeriod
+	database.UserDeleteGracePeriod = time.Second
+	defer func() { database.UserDeleteGracePeriod = gp }()
+
+	// Create three users: one active, one recently deleted, and one deleted
+	// long enough ago to be purged.
+	active, err := db.UserCreate(ctx, "", "", t.Name()+"_active", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, err := db.UserCreate(ctx, "", "", t.Name()+"_recent", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := db.UserCreate(ctx, "", "", t.Name()+"_expired", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the expired user some data.
+	sl, _, err := test.CreateTestUpload(ctx, db, *expired, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *expired, "", *sl, 128, primitive.ObjectID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserSoftDelete(ctx, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the expired user's grace period passes before the recent
+	// user gets deleted.
+	time.Sleep(database.UserDeleteGracePeriod)
+	err = db.UserSoftDelete(ctx, recent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := janitor.NewJanitor(ctx, db, logrus.New())
+	j.Start()
+	err = build.Retry(10, 200*time.Millisecond, func() error {
+		_, err = db.UserBySub(ctx, expired.Sub)
+		if !errors.Contains(err, database.ErrUserNotFound) {
+			return fmt.Errorf("expected the expired user to be purged, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the expired user's data is gone.
+	stats, err := db.UserStats(ctx, *expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploads != 0 || stats.NumDownloads != 0 {
+		t.Fatalf("Expected no uploads and downloads, got %d and %d", stats.NumUploads, stats.NumDownloads)
+	}
+	// Make sure the other users are still there.
+	_, err = db.UserBySub(ctx, active.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserBySub(ctx, recent.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once the recent user's grace period passes, they get purged as well.
+	// The janitor might beat us to it, so we don't check the returned count.
+	time.Sleep(database.UserDeleteGracePeriod)
+	_, err = j.PurgeDeletedUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserBySub(ctx, recent.Sub)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error '%s', got '%v'", database.ErrUserNotFound, err)
+	}
+}
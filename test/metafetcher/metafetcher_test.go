@@ -0,0 +1,171 @@
+package metafetcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/metafetcher"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/sirupsen/logrus"
+	"go.sia.tech/siad/build"
+)
+
+// stubFetcher is a metafetcher.Fetcher which returns canned metadata, or an
+// error when it's set to fail. It blocks until it's released.
+type stubFetcher struct {
+	calls   int
+	fail    bool
+	meta    metafetcher.Metadata
+	release chan struct{}
+	mu      sync.Mutex
+}
+
+// FetchMetadata implements metafetcher.Fetcher.
+func (f *stubFetcher) FetchMetadata(_ context.Context, _ string) (metafetcher.Metadata, error) {
+	<-f.release
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail {
+		return metafetcher.Metadata{}, errors.New("portal unreachable")
+	}
+	return f.meta, nil
+}
+
+// Calls returns the number of calls to FetchMetadata.
+func (f *stubFetcher) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// TestSweep ensures that the metafetcher's sweeps retry skylinks whose size we
+// don't know, back off after failures and don't queue skylinks which are
+// already being processed.
+func TestSweep(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := test.NewDatabase(ctx, test.DBNameForTest(t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubFetcher{
+		fail:    true,
+		meta:    metafetcher.Metadata{Filename: "file.txt", Length: 123},
+		release: make(chan struct{}),
+	}
+	mf := metafetcher.NewCustom(ctx, db, logrus.New(), stub)
+
+	// Create a skylink with an unknown size and one with a known size.
+	sl, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sized, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SkylinkUpdate(ctx, sized.ID, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The skylinks are too new to be swept.
+	minAge := metafetcher.SweepMinAge
+	defer func() { metafetcher.SweepMinAge = minAge }()
+	metafetcher.SweepMinAge = time.Hour
+	n, err := mf.Sweep()
+	if err != nil || n != 0 {
+		t.Fatalf("Expected to queue no skylinks, queued %d. Error: %v", n, err)
+	}
+	// Skylink IDs have a one second resolution.
+	metafetcher.SweepMinAge = 0
+	time.Sleep(time.Second)
+
+	// Expect the sweep to queue only the skylink with unknown size.
+	n, err = mf.Sweep()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected to queue one skylink, queued %d. Error: %v", n, err)
+	}
+	// The skylink is being processed, so we shouldn't queue it again.
+	if mf.Enqueue(metafetcher.Message{SkylinkID: sl.ID}) {
+		t.Fatal("Expected a skylink which is being processed not to be queued.")
+	}
+	n, err = mf.Sweep()
+	if err != nil || n != 0 {
+		t.Fatalf("Expected to queue no skylinks, queued %d. Error: %v", n, err)
+	}
+	// Let the fetch fail and expect the failure to be recorded.
+	close(stub.release)
+	err = build.Retry(100, 50*time.Millisecond, func() error {
+		s, err := db.SkylinkByID(ctx, sl.ID)
+		if err != nil {
+			return err
+		}
+		if s.MetaAttempts != 1 {
+			return errors.New("failure not recorded yet")
+		}
+		if !s.MetaNextAttempt.After(time.Now().UTC()) {
+			return errors.New("expected the next attempt to be in the future")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.Calls() != 1 {
+		t.Fatalf("Expected one fetch, got %d", stub.Calls())
+	}
+	// The skylink is backing off, so the next sweep should skip it.
+	err = build.Retry(100, 50*time.Millisecond, func() error {
+		n, err = mf.Sweep()
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			return errors.New("expected the skylink to be backing off")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expire the backoff and let the fetch succeed.
+	err = db.SkylinkMetaFetchFailed(ctx, sl.ID, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.mu.Lock()
+	stub.fail = false
+	stub.mu.Unlock()
+	n, err = mf.Sweep()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected to queue one skylink, queued %d. Error: %v", n, err)
+	}
+	var s *database.Skylink
+	err = build.Retry(100, 50*time.Millisecond, func() error {
+		s, err = db.SkylinkByID(ctx, sl.ID)
+		if err != nil {
+			return err
+		}
+		if s.Size != stub.meta.Length {
+			return errors.New("size not updated yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is left to sweep.
+	n, err = mf.Sweep()
+	if err != nil || n != 0 {
+		t.Fatalf("Expected to queue no skylinks, queued %d. Error: %v", n, err)
+	}
+}
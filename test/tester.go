@@ -3,6 +3,7 @@ package test
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
@@ -21,7 +23,9 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/jwt"
 	"github.com/SkynetLabs/skynet-accounts/lib"
 	"github.com/SkynetLabs/skynet-accounts/metafetcher"
+	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72/webhook"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.sia.tech/siad/build"
@@ -50,11 +54,46 @@ type (
 		Cookie          *http.Cookie
 		Token           string
 		FollowRedirects bool
+		// Fetcher serves the skylink metadata of the tester's MetaFetcher.
+		Fetcher     *StubFetcher
+		MetaFetcher *metafetcher.MetaFetcher
 
 		cancel context.CancelFunc
+		server *api.API
+	}
+
+	// StubFetcher is a metafetcher.Fetcher which returns the metadata set via
+	// SetMetadata and fails for all other skylinks, the same way the real one
+	// does when skyd is not reachable.
+	StubFetcher struct {
+		meta map[string]metafetcher.Metadata
+		mu   sync.Mutex
 	}
 )
 
+// NewStubFetcher returns a new StubFetcher which doesn't know any metadata.
+func NewStubFetcher() *StubFetcher {
+	return &StubFetcher{meta: make(map[string]metafetcher.Metadata)}
+}
+
+// FetchMetadata implements metafetcher.Fetcher.
+func (f *StubFetcher) FetchMetadata(_ context.Context, skylink string) (metafetcher.Metadata, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	meta, ok := f.meta[skylink]
+	if !ok {
+		return metafetcher.Metadata{}, errors.New("metadata not found")
+	}
+	return meta, nil
+}
+
+// SetMetadata sets the metadata the fetcher returns for the given skylink.
+func (f *StubFetcher) SetMetadata(skylink string, meta metafetcher.Metadata) {
+	f.mu.Lock()
+	f.meta[skylink] = meta
+	f.mu.Unlock()
+}
+
 // ExtractCookie is a helper method which extracts the login cookie from a
 // response, so we can use it with future requests while testing.
 func ExtractCookie(r *http.Response) *http.Cookie {
@@ -79,9 +118,11 @@ func NewDatabaseWithDeps(ctx context.Context, dbName string, deps lib.Dependenci
 // NewAccountsTester creates and starts a new AccountsTester service.
 // Use the Close method for a graceful shutdown.
 func NewAccountsTester(dbName string, promoter api.Promoter, deps lib.Dependencies) (*AccountsTester, error) {
-	// Make sure we have valid dependencies.
+	// Make sure we have valid dependencies. Unless the caller asks for
+	// something else, we disable rate limiting, so tests can log in as often
+	// as they need to.
 	if deps == nil {
-		deps = &lib.ProductionDependencies{}
+		deps = &DependencySkipRateLimiting{}
 	}
 	if promoter == "" {
 		promoter = api.PromoterStripe
@@ -112,11 +153,13 @@ func NewAccountsTester(dbName string, promoter api.Promoter, deps lib.Dependenci
 
 	ctxWithCancel, cancel := context.WithCancel(ctx)
 	// The meta fetcher will fetch metadata for all skylinks. This is needed, so
-	// we can determine their size.
-	mf := metafetcher.New(ctxWithCancel, db, logger)
+	// we can determine their size. There is no skyd to fetch it from, so tests
+	// set the metadata they need on the stub.
+	fetcher := NewStubFetcher()
+	mf := metafetcher.NewCustom(ctxWithCancel, db, logger, fetcher)
 
 	// The server API encapsulates all the modules together.
-	server, err := api.NewCustom(db, mf, logger, email.NewMailer(db), promoter, deps)
+	server, err := api.NewCustom(db, mf, logger, email.NewMailer(db), &sender, promoter, deps)
 	if err != nil {
 		cancel()
 		return nil, errors.AddContext(err, "failed to build the API")
@@ -124,18 +167,17 @@ func NewAccountsTester(dbName string, promoter api.Promoter, deps lib.Dependenci
 
 	// Start the HTTP server in a goroutine and gracefully stop it once the
 	// cancel function is called and the context is closed.
-	srv := &http.Server{
-		Addr:    ":" + testPortalPort,
-		Handler: server,
+	port, err := strconv.Atoi(testPortalPort)
+	if err != nil {
+		cancel()
+		return nil, errors.AddContext(err, "invalid test port")
 	}
 	go func() {
-		_ = srv.ListenAndServe()
+		_ = server.ListenAndServe(port)
 	}()
 	go func() {
-		select {
-		case <-ctxWithCancel.Done():
-			_ = srv.Shutdown(context.TODO())
-		}
+		<-ctxWithCancel.Done()
+		_ = server.Shutdown(context.TODO())
 	}()
 
 	at := &AccountsTester{
@@ -143,7 +185,10 @@ func NewAccountsTester(dbName string, promoter api.Promoter, deps lib.Dependenci
 		DB:              db,
 		FollowRedirects: true,
 		Logger:          logger,
+		Fetcher:         fetcher,
+		MetaFetcher:     mf,
 		cancel:          cancel,
+		server:          server,
 	}
 	// Wait for the accounts tester to be fully ready.
 	err = build.Retry(50, time.Millisecond, func() error {
@@ -197,6 +242,12 @@ func (at *AccountsTester) Close() error {
 	return nil
 }
 
+// Shutdown gracefully shuts down the tester's HTTP server, waiting for the
+// in-flight requests to complete. Close still needs to be called afterwards.
+func (at *AccountsTester) Shutdown(ctx context.Context) error {
+	return at.server.Shutdown(ctx)
+}
+
 // SetAPIKey ensures that all subsequent requests are going to use the given
 // API key for authentication.
 func (at *AccountsTester) SetAPIKey(ak string) {
@@ -273,6 +324,7 @@ func (at *AccountsTester) Request(method string, endpoint string, queryParams ur
 	acceptedResponseCodes := map[int]bool{
 		http.StatusOK:                true,
 		http.StatusNoContent:         true,
+		http.StatusNotModified:       true,
 		http.StatusTemporaryRedirect: true,
 		http.StatusPermanentRedirect: true,
 	}
@@ -293,6 +345,40 @@ func (at *AccountsTester) Request(method string, endpoint string, queryParams ur
 	return r, err
 }
 
+// requestCSV is a helper method which requests a CSV export from the given
+// endpoint and parses it.
+func (at *AccountsTester) requestCSV(endpoint string, params url.Values) ([][]string, http.Header, int, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("format", "csv")
+	serviceURL := testPortalAddr + ":" + testPortalPort + endpoint + "?" + params.Encode()
+	req, err := http.NewRequest(http.MethodGet, serviceURL, nil)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	r, b, err := at.executeRequest(req)
+	if err != nil {
+		return nil, r.Header, r.StatusCode, errors.AddContext(err, string(b))
+	}
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		return nil, r.Header, r.StatusCode, errors.AddContext(err, "failed to parse the body CSV")
+	}
+	return records, r.Header, r.StatusCode, nil
+}
+
+// Head performs a HEAD request to the given endpoint. It returns the
+// response's headers and body, which should be empty.
+func (at *AccountsTester) Head(endpoint string) (*http.Response, []byte, error) {
+	serviceURL := testPortalAddr + ":" + testPortalPort + endpoint
+	req, err := http.NewRequest(http.MethodHead, serviceURL, nil)
+	if err != nil {
+		return &http.Response{StatusCode: http.StatusInternalServerError}, nil, err
+	}
+	return at.executeRequest(req)
+}
+
 // executeRequest is a helper method which executes a test Request and processes
 // the response by extracting the body from it and handling non-OK status codes.
 //
@@ -343,6 +429,24 @@ func (at *AccountsTester) HealthGet() (api.HealthGET, int, error) {
 	return resp, r.StatusCode, err
 }
 
+// HealthFullGET performs `GET /health/full`
+func (at *AccountsTester) HealthFullGET() (api.HealthFullGET, int, error) {
+	var resp api.HealthFullGET
+	r, err := at.Request(http.MethodGet, "/health/full", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// MetricsGET performs `GET /metrics` and returns the raw response body.
+func (at *AccountsTester) MetricsGET() (string, int, error) {
+	serviceURL := testPortalAddr + ":" + testPortalPort + "/metrics"
+	req, err := http.NewRequest(http.MethodGet, serviceURL, nil)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	r, b, err := at.executeRequest(req)
+	return string(b), r.StatusCode, err
+}
+
 /*** Login and logout helpers ***/
 
 // LoginCredentialsPOST logs the user in and returns a response.
@@ -399,11 +503,51 @@ func (at *AccountsTester) LoginPubKeyPOST(response, signature []byte, emailStr s
 	return at.post("/login", nil, bodyParams)
 }
 
+// LoginPubKeyPOSTWithTTL performs `POST /login` with a custom JWT TTL.
+//
+// NOTE: The Body of the returned response is already read and closed.
+func (at *AccountsTester) LoginPubKeyPOSTWithTTL(response, signature []byte, ttl int) (*http.Response, []byte, error) {
+	body := struct {
+		Response  string `json:"response"`
+		Signature string `json:"signature"`
+		TTL       int    `json:"ttl"`
+	}{
+		hex.EncodeToString(response),
+		hex.EncodeToString(signature),
+		ttl,
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := at.Request(http.MethodPost, "/login", nil, b, nil, nil)
+	if err != nil {
+		return r, nil, err
+	}
+	return processResponse(r)
+}
+
+// LoginTwoFactorPOST performs `POST /login/2fa`
+//
+// NOTE: The Body of the returned response is already read and closed.
+func (at *AccountsTester) LoginTwoFactorPOST(token, code string) (*http.Response, error) {
+	b, err := json.Marshal(api.LoginTwoFactorPOST{Token: token, Code: code})
+	if err != nil {
+		return &http.Response{}, err
+	}
+	return at.Request(http.MethodPost, "/login/2fa", nil, b, nil, nil)
+}
+
 // LogoutPOST performs `POST /logout`
 func (at *AccountsTester) LogoutPOST() (*http.Response, []byte, error) {
 	return at.post("/logout", nil, nil)
 }
 
+// TokenRefreshPOST performs `POST /token/refresh`
+func (at *AccountsTester) TokenRefreshPOST() (*http.Response, []byte, error) {
+	return at.post("/token/refresh", nil, nil)
+}
+
 /*** Registration helpers ***/
 
 // RegisterGET performs `GET /register`
@@ -438,6 +582,20 @@ func (at *AccountsTester) RegisterPOST(response, signature []byte, email string)
 	return result, r.StatusCode, nil
 }
 
+// RegisterAvailabilityGET performs `GET /register/availability`
+func (at *AccountsTester) RegisterAvailabilityGET(email string, pk database.PubKey) (api.RegisterAvailabilityGET, int, error) {
+	query := url.Values{}
+	if email != "" {
+		query.Set("email", email)
+	}
+	if pk != nil {
+		query.Set("pubKey", hex.EncodeToString(pk[:]))
+	}
+	var resp api.RegisterAvailabilityGET
+	r, err := at.Request(http.MethodGet, "/register/availability", query, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 /*** Track helpers ***/
 
 // TrackDownload performs a `POST /track/download/:skylink` Request.
@@ -448,6 +606,16 @@ func (at *AccountsTester) TrackDownload(skylink string, bytes int64) (int, error
 	return r.StatusCode, err
 }
 
+// TrackDownloadFromIP performs a `POST /track/download/:skylink` Request on
+// behalf of a caller with the given IP.
+func (at *AccountsTester) TrackDownloadFromIP(skylink string, bytes int64, ip string) (int, error) {
+	form := url.Values{}
+	form.Set("bytes", fmt.Sprint(bytes))
+	form.Set("ip", ip)
+	r, err := at.Request(http.MethodPost, "/track/download/"+skylink, form, nil, nil, nil)
+	return r.StatusCode, err
+}
+
 // TrackUpload performs a `POST /track/upload/:skylink` Request.
 func (at *AccountsTester) TrackUpload(skylink string, ip string) (int, error) {
 	form := url.Values{}
@@ -456,6 +624,16 @@ func (at *AccountsTester) TrackUpload(skylink string, ip string) (int, error) {
 	return r.StatusCode, err
 }
 
+// TrackUploadWithRequestID performs a `POST /track/upload/:skylink` Request
+// with the given request ID.
+func (at *AccountsTester) TrackUploadWithRequestID(skylink, ip, requestID string) (int, error) {
+	form := url.Values{}
+	form.Set("ip", ip)
+	headers := map[string]string{api.RequestIDHeader: requestID}
+	r, err := at.Request(http.MethodPost, "/track/upload/"+skylink, form, nil, headers, nil)
+	return r.StatusCode, err
+}
+
 // TrackRegistryRead performs a `POST /track/registry/read` Request.
 func (at *AccountsTester) TrackRegistryRead() (int, error) {
 	r, err := at.Request(http.MethodPost, "/track/registry/read", nil, nil, nil, nil)
@@ -476,6 +654,61 @@ func (at *AccountsTester) UserDELETE() (int, error) {
 	return r.StatusCode, err
 }
 
+// UserSessionsGET performs `GET /user/sessions`
+func (at *AccountsTester) UserSessionsGET() ([]api.SessionGET, int, error) {
+	var resp []api.SessionGET
+	r, err := at.Request(http.MethodGet, "/user/sessions", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// UserSessionDELETE performs `DELETE /user/sessions/:jti`
+func (at *AccountsTester) UserSessionDELETE(jti string) (int, error) {
+	r, err := at.Request(http.MethodDelete, "/user/sessions/"+jti, nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+// UserSessionsDELETE performs `DELETE /user/sessions`
+func (at *AccountsTester) UserSessionsDELETE() (int, error) {
+	r, err := at.Request(http.MethodDelete, "/user/sessions", nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+// UserTwoFactorSetupPOST performs `POST /user/2fa/setup`
+func (at *AccountsTester) UserTwoFactorSetupPOST() (api.TwoFactorSetupPOST, int, error) {
+	var resp api.TwoFactorSetupPOST
+	r, err := at.Request(http.MethodPost, "/user/2fa/setup", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// UserTwoFactorEnablePOST performs `POST /user/2fa/enable`
+func (at *AccountsTester) UserTwoFactorEnablePOST(code string) (api.TwoFactorEnablePOST, int, error) {
+	b, err := json.Marshal(api.TwoFactorCodePOST{Code: code})
+	if err != nil {
+		return api.TwoFactorEnablePOST{}, 0, err
+	}
+	var resp api.TwoFactorEnablePOST
+	r, err := at.Request(http.MethodPost, "/user/2fa/enable", nil, b, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// UserTwoFactorDisablePOST performs `POST /user/2fa/disable`
+func (at *AccountsTester) UserTwoFactorDisablePOST(code string) (int, error) {
+	b, err := json.Marshal(api.TwoFactorCodePOST{Code: code})
+	if err != nil {
+		return 0, err
+	}
+	r, err := at.Request(http.MethodPost, "/user/2fa/disable", nil, b, nil, nil)
+	return r.StatusCode, err
+}
+
+// UserUndeletePOST performs `POST /user/undelete`
+func (at *AccountsTester) UserUndeletePOST(tk string) (*http.Response, error) {
+	body := url.Values{}
+	body.Set("token", tk)
+	r, _, err := at.post("/user/undelete", nil, body)
+	return r, err
+}
+
 // UserGET performs `GET /user`
 //
 // NOTE: The Body of the returned response is already read and closed.
@@ -520,15 +753,126 @@ func (at *AccountsTester) UserPUT(email, password, stipeID string) (api.UserGET,
 	return resp, r.StatusCode, err
 }
 
+// UserMergePOST performs `POST /user/merge` with the given proof of control
+// of the other account, i.e. either its email and password or a response to
+// a login challenge.
+func (at *AccountsTester) UserMergePOST(proof map[string]string) (api.UserGET, int, error) {
+	b, err := json.Marshal(proof)
+	if err != nil {
+		return api.UserGET{}, http.StatusBadRequest, err
+	}
+	var resp api.UserGET
+	r, err := at.Request(http.MethodPost, "/user/merge", nil, b, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// UserPreferencesPUT performs `PUT /user/preferences`
+func (at *AccountsTester) UserPreferencesPUT(body api.UserPreferencesPUT) (api.UserGET, int, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return api.UserGET{}, http.StatusBadRequest, err
+	}
+	var resp api.UserGET
+	r, err := at.Request(http.MethodPut, "/user/preferences", nil, b, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// EmailUnsubscribeGET performs `GET /email/unsubscribe`
+func (at *AccountsTester) EmailUnsubscribeGET(token string) (database.EmailPreferences, int, error) {
+	var resp database.EmailPreferences
+	r, err := at.Request(http.MethodGet, "/email/unsubscribe", url.Values{"token": []string{token}}, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// UserNamePUT performs `PUT /user`, setting the user's display name.
+func (at *AccountsTester) UserNamePUT(name string) (api.UserGET, int, error) {
+	b, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return api.UserGET{}, http.StatusBadRequest, err
+	}
+	var resp api.UserGET
+	r, err := at.Request(http.MethodPut, "/user", nil, b, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// UserLocalePUT performs `PUT /user`, setting the user's locale.
+func (at *AccountsTester) UserLocalePUT(locale string) (api.UserGET, int, error) {
+	b, err := json.Marshal(map[string]string{"locale": locale})
+	if err != nil {
+		return api.UserGET{}, http.StatusBadRequest, err
+	}
+	var resp api.UserGET
+	r, err := at.Request(http.MethodPut, "/user", nil, b, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // UserReconfirmPOST performs `POST /user/reconfirm`
 func (at *AccountsTester) UserReconfirmPOST() (*http.Response, []byte, error) {
 	return at.post("/user/reconfirm", nil, nil)
 }
 
 // UserUploadsGET performs `GET /user/uploads`
-func (at *AccountsTester) UserUploadsGET() (api.UploadsGET, int, error) {
+func (at *AccountsTester) UserUploadsGET(params url.Values) (api.UploadsGET, int, error) {
 	var result api.UploadsGET
-	r, err := at.Request(http.MethodGet, "/user/uploads", nil, nil, nil, &result)
+	r, err := at.Request(http.MethodGet, "/user/uploads", params, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserDownloadsGET performs `GET /user/downloads`
+func (at *AccountsTester) UserDownloadsGET(params url.Values) (api.DownloadsGET, int, error) {
+	var result api.DownloadsGET
+	r, err := at.Request(http.MethodGet, "/user/downloads", params, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserDownloadsSummaryGET performs `GET /user/downloads?groupBy=skylink`
+func (at *AccountsTester) UserDownloadsSummaryGET(params url.Values) (api.DownloadsSummaryGET, int, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("groupBy", "skylink")
+	var result api.DownloadsSummaryGET
+	r, err := at.Request(http.MethodGet, "/user/downloads", params, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserDownloadsDELETE performs `DELETE /user/downloads`
+func (at *AccountsTester) UserDownloadsDELETE(params url.Values) (api.DownloadsDELETE, int, error) {
+	var result api.DownloadsDELETE
+	r, err := at.Request(http.MethodDelete, "/user/downloads", params, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserUploadsCSV performs `GET /user/uploads?format=csv` and parses the
+// returned CSV file. The first record is the header row.
+func (at *AccountsTester) UserUploadsCSV(params url.Values) ([][]string, http.Header, int, error) {
+	return at.requestCSV("/user/uploads", params)
+}
+
+// UserDownloadsCSV performs `GET /user/downloads?format=csv` and parses the
+// returned CSV file. The first record is the header row.
+func (at *AccountsTester) UserDownloadsCSV(params url.Values) ([][]string, http.Header, int, error) {
+	return at.requestCSV("/user/downloads", params)
+}
+
+// UserRegistryReadsGET performs `GET /user/registry/reads`
+func (at *AccountsTester) UserRegistryReadsGET(params url.Values) (api.RegistryReadsGET, int, error) {
+	var result api.RegistryReadsGET
+	r, err := at.Request(http.MethodGet, "/user/registry/reads", params, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserRegistryWritesGET performs `GET /user/registry/writes`
+func (at *AccountsTester) UserRegistryWritesGET(params url.Values) (api.RegistryWritesGET, int, error) {
+	var result api.RegistryWritesGET
+	r, err := at.Request(http.MethodGet, "/user/registry/writes", params, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserAuditGET performs `GET /user/audit`
+func (at *AccountsTester) UserAuditGET(params url.Values) (api.AuditLogGET, int, error) {
+	var result api.AuditLogGET
+	r, err := at.Request(http.MethodGet, "/user/audit", params, nil, nil, &result)
 	return result, r.StatusCode, err
 }
 
@@ -547,9 +891,16 @@ func (at *AccountsTester) UserAPIKeysGET(id primitive.ObjectID) (api.APIKeyRespo
 	return result, r.StatusCode, err
 }
 
+// UserAPIKeysUsageGET performs a `GET /user/apikeys/:id/usage` Request.
+func (at *AccountsTester) UserAPIKeysUsageGET(id primitive.ObjectID) (database.APIKeyUsage, int, error) {
+	var result database.APIKeyUsage
+	r, err := at.Request(http.MethodGet, "/user/apikeys/"+id.Hex()+"/usage", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
 // UserAPIKeysLIST performs a `GET /user/apikeys` Request.
-func (at *AccountsTester) UserAPIKeysLIST() ([]api.APIKeyResponse, int, error) {
-	result := make([]api.APIKeyResponse, 0)
+func (at *AccountsTester) UserAPIKeysLIST() (api.APIKeysGET, int, error) {
+	var result api.APIKeysGET
 	r, err := at.Request(http.MethodGet, "/user/apikeys", nil, nil, nil, &result)
 	return result, r.StatusCode, err
 }
@@ -565,6 +916,13 @@ func (at *AccountsTester) UserAPIKeysPOST(body api.APIKeyPOST) (api.APIKeyRespon
 	return result, r.StatusCode, err
 }
 
+// UserAPIKeysRotatePOST performs a `POST /user/apikeys/:id/rotate` Request.
+func (at *AccountsTester) UserAPIKeysRotatePOST(akID primitive.ObjectID) (api.APIKeyResponseWithKey, int, error) {
+	var result api.APIKeyResponseWithKey
+	r, err := at.Request(http.MethodPost, "/user/apikeys/"+akID.Hex()+"/rotate", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
 // UserAPIKeysPUT performs a `PUT /user/apikeys` Request.
 func (at *AccountsTester) UserAPIKeysPUT(akID primitive.ObjectID, body api.APIKeyPUT) (int, error) {
 	b, err := json.Marshal(body)
@@ -576,17 +934,288 @@ func (at *AccountsTester) UserAPIKeysPUT(akID primitive.ObjectID, body api.APIKe
 }
 
 // UserAPIKeysPATCH performs a `PATCH /user/apikeys` Request.
-func (at *AccountsTester) UserAPIKeysPATCH(akID primitive.ObjectID, body api.APIKeyPATCH) (int, error) {
+func (at *AccountsTester) UserAPIKeysPATCH(akID primitive.ObjectID, body api.APIKeyPATCH) (api.APIKeyResponse, int, error) {
 	b, err := json.Marshal(body)
+	if err != nil {
+		return api.APIKeyResponse{}, http.StatusBadRequest, err
+	}
+	var result api.APIKeyResponse
+	r, err := at.Request(http.MethodPatch, "/user/apikeys/"+akID.Hex(), nil, b, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// APIKeysGrandfatheredGET performs a `GET /apikeys/grandfathered` Request.
+func (at *AccountsTester) APIKeysGrandfatheredGET() (api.APIKeysGrandfatheredGET, int, error) {
+	var result api.APIKeysGrandfatheredGET
+	r, err := at.Request(http.MethodGet, "/apikeys/grandfathered", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminCohortsGET performs a `GET /admin/cohorts` Request.
+func (at *AccountsTester) AdminCohortsGET(weeks int) (database.CohortMatrix, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("weeks", strconv.Itoa(weeks))
+	var result database.CohortMatrix
+	r, err := at.Request(http.MethodGet, "/admin/cohorts", queryParams, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// ChangesGET performs a `GET /internal/changes` Request.
+func (at *AccountsTester) ChangesGET(secret, since string) (api.ChangesGET, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("since", since)
+	headers := map[string]string{api.ChangefeedSecretHeader: secret}
+	var result api.ChangesGET
+	r, err := at.Request(http.MethodGet, "/internal/changes", queryParams, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+/*** Organization helpers ***/
+
+// OrgPOST performs a `POST /org` Request.
+func (at *AccountsTester) OrgPOST(name string) (api.OrgGET, int, error) {
+	b, err := json.Marshal(api.OrgPOST{Name: name})
+	if err != nil {
+		return api.OrgGET{}, http.StatusBadRequest, err
+	}
+	var result api.OrgGET
+	r, err := at.Request(http.MethodPost, "/org", nil, b, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// OrgGET performs a `GET /org/:id` Request.
+func (at *AccountsTester) OrgGET(id string) (api.OrgGET, int, error) {
+	var result api.OrgGET
+	r, err := at.Request(http.MethodGet, "/org/"+id, nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// OrgUsageGET performs a `GET /org/:id/usage` Request.
+func (at *AccountsTester) OrgUsageGET(id string) (api.OrgUsageGET, int, error) {
+	var result api.OrgUsageGET
+	r, err := at.Request(http.MethodGet, "/org/"+id+"/usage", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// OrgInvitesPOST performs a `POST /org/:id/invites` Request.
+func (at *AccountsTester) OrgInvitesPOST(id string, email types.Email) (int, error) {
+	b, err := json.Marshal(api.OrgInvitePOST{Email: email})
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
-	r, err := at.Request(http.MethodPatch, "/user/apikeys/"+akID.Hex(), nil, b, nil, nil)
+	r, err := at.Request(http.MethodPost, "/org/"+id+"/invites", nil, b, nil, nil)
+	return r.StatusCode, err
+}
+
+// OrgInvitesAcceptGET performs a `GET /org-invites/accept` Request.
+func (at *AccountsTester) OrgInvitesAcceptGET(token string) (api.OrgGET, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("token", token)
+	var result api.OrgGET
+	r, err := at.Request(http.MethodGet, "/org-invites/accept", queryParams, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// OrgMemberDELETE performs a `DELETE /org/:id/members/:sub` Request.
+func (at *AccountsTester) OrgMemberDELETE(id, sub string) (int, error) {
+	r, err := at.Request(http.MethodDelete, "/org/"+id+"/members/"+sub, nil, nil, nil, nil)
 	return r.StatusCode, err
 }
 
+/*** Admin helpers ***/
+
+// AdminUserTierPOST performs a `POST /admin/user/:sub/tier` Request.
+func (at *AccountsTester) AdminUserTierPOST(adminKey, sub string, tier int) (api.UserGET, int, error) {
+	b, err := json.Marshal(api.AdminUserTierPOST{Tier: tier})
+	if err != nil {
+		return api.UserGET{}, http.StatusBadRequest, err
+	}
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result api.UserGET
+	r, err := at.Request(http.MethodPost, "/admin/user/"+sub+"/tier", nil, b, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminUserTrialPOST performs a `POST /admin/user/:sub/trial` Request.
+func (at *AccountsTester) AdminUserTrialPOST(adminKey, sub string, tier int, until time.Time) (api.UserGET, int, error) {
+	b, err := json.Marshal(api.AdminUserTrialPOST{Tier: tier, Until: until})
+	if err != nil {
+		return api.UserGET{}, http.StatusBadRequest, err
+	}
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result api.UserGET
+	r, err := at.Request(http.MethodPost, "/admin/user/"+sub+"/trial", nil, b, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminOrgTierPOST performs a `POST /admin/org/:id/tier` Request.
+func (at *AccountsTester) AdminOrgTierPOST(adminKey, id string, tier int) (database.Organization, int, error) {
+	b, err := json.Marshal(api.AdminOrgTierPOST{Tier: tier})
+	if err != nil {
+		return database.Organization{}, http.StatusBadRequest, err
+	}
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result database.Organization
+	r, err := at.Request(http.MethodPost, "/admin/org/"+id+"/tier", nil, b, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminUserFlagsPUT performs a `PUT /admin/user/:sub/flags` Request on behalf
+// of the given admin.
+func (at *AccountsTester) AdminUserFlagsPUT(adminKey, adminName, sub string, body api.AdminUserFlagsPUT) (api.AdminUserFlagsGET, int, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return api.AdminUserFlagsGET{}, http.StatusBadRequest, err
+	}
+	headers := map[string]string{
+		api.AdminAPIKeyHeader: adminKey,
+		api.AdminNameHeader:   adminName,
+	}
+	var result api.AdminUserFlagsGET
+	r, err := at.Request(http.MethodPut, "/admin/user/"+sub+"/flags", nil, b, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminLimitsPUT performs a `PUT /admin/limits/:tier` Request.
+func (at *AccountsTester) AdminLimitsPUT(adminKey string, tier int, o database.TierLimitsOverride) (api.TierLimitsPublic, int, error) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return api.TierLimitsPublic{}, http.StatusBadRequest, err
+	}
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result api.TierLimitsPublic
+	r, err := at.Request(http.MethodPut, "/admin/limits/"+strconv.Itoa(tier), nil, b, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminSkylinkBlockPOST performs a `POST /admin/skylink/:skylink/block`
+// Request.
+func (at *AccountsTester) AdminSkylinkBlockPOST(adminKey, skylink string) (database.Skylink, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result database.Skylink
+	r, err := at.Request(http.MethodPost, "/admin/skylink/"+skylink+"/block", nil, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminSkylinkBlockDELETE performs a `DELETE /admin/skylink/:skylink/block`
+// Request.
+func (at *AccountsTester) AdminSkylinkBlockDELETE(adminKey, skylink string) (int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	r, err := at.Request(http.MethodDelete, "/admin/skylink/"+skylink+"/block", nil, nil, headers, nil)
+	return r.StatusCode, err
+}
+
+// AdminSkylinkDELETE performs a `DELETE /admin/skylink/:skylink` Request.
+func (at *AccountsTester) AdminSkylinkDELETE(adminKey, skylink string) (database.SkylinkPurgeResult, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result database.SkylinkPurgeResult
+	r, err := at.Request(http.MethodDelete, "/admin/skylink/"+skylink, nil, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminSkylinksBlockedGET performs a `GET /admin/skylinks/blocked` Request.
+func (at *AccountsTester) AdminSkylinksBlockedGET(adminKey string, offset, pageSize int) (api.AdminSkylinksBlockedGET, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	params := url.Values{}
+	params.Set("offset", strconv.Itoa(offset))
+	params.Set("pageSize", strconv.Itoa(pageSize))
+	var result api.AdminSkylinksBlockedGET
+	r, err := at.Request(http.MethodGet, "/admin/skylinks/blocked", params, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminSkylinkStatsGET performs a `GET /admin/skylink/:skylink/stats` Request.
+func (at *AccountsTester) AdminSkylinkStatsGET(adminKey, skylink string) (database.SkylinkStats, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result database.SkylinkStats
+	r, err := at.Request(http.MethodGet, "/admin/skylink/"+skylink+"/stats", nil, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminStatsGET performs a `GET /admin/stats` Request.
+func (at *AccountsTester) AdminStatsGET(adminKey string) (database.PortalStats, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result database.PortalStats
+	r, err := at.Request(http.MethodGet, "/admin/stats", nil, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminUploadsByCountryGET performs a `GET /admin/stats/uploads-by-country`
+// Request.
+func (at *AccountsTester) AdminUploadsByCountryGET(adminKey string, since time.Time) (api.AdminUploadsByCountryGET, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	params := url.Values{}
+	if !since.IsZero() {
+		params.Set("since", since.Format(time.RFC3339))
+	}
+	var result api.AdminUploadsByCountryGET
+	r, err := at.Request(http.MethodGet, "/admin/stats/uploads-by-country", params, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminUploadsByIPGET performs a `GET /admin/uploads/by-ip` Request.
+func (at *AccountsTester) AdminUploadsByIPGET(adminKey, ip string, since time.Time) (api.AdminUploadsByIPGET, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	params := url.Values{}
+	params.Set("ip", ip)
+	if !since.IsZero() {
+		params.Set("since", since.Format(time.RFC3339))
+	}
+	var result api.AdminUploadsByIPGET
+	r, err := at.Request(http.MethodGet, "/admin/uploads/by-ip", params, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminDownloadsByIPGET performs a `GET /admin/downloads/by-ip` Request.
+func (at *AccountsTester) AdminDownloadsByIPGET(adminKey, ip string, since time.Time) (api.AdminDownloadsByIPGET, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	params := url.Values{}
+	params.Set("ip", ip)
+	if !since.IsZero() {
+		params.Set("since", since.Format(time.RFC3339))
+	}
+	var result api.AdminDownloadsByIPGET
+	r, err := at.Request(http.MethodGet, "/admin/downloads/by-ip", params, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminUserAuditGET performs a `GET /admin/user/:sub/audit` Request.
+func (at *AccountsTester) AdminUserAuditGET(adminKey, sub string) (api.AuditLogGET, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result api.AuditLogGET
+	r, err := at.Request(http.MethodGet, "/admin/user/"+sub+"/audit", nil, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminConfigGET performs a `GET /admin/config/:key` Request.
+func (at *AccountsTester) AdminConfigGET(adminKey, key string) (database.ConfVal, int, error) {
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result database.ConfVal
+	r, err := at.Request(http.MethodGet, "/admin/config/"+key, nil, nil, headers, &result)
+	return result, r.StatusCode, err
+}
+
+// AdminConfigPUT performs a `PUT /admin/config/:key` Request.
+func (at *AccountsTester) AdminConfigPUT(adminKey, key, value string) (database.ConfVal, int, error) {
+	b, err := json.Marshal(api.AdminConfigPUT{Value: value})
+	if err != nil {
+		return database.ConfVal{}, http.StatusBadRequest, err
+	}
+	headers := map[string]string{api.AdminAPIKeyHeader: adminKey}
+	var result database.ConfVal
+	r, err := at.Request(http.MethodPut, "/admin/config/"+key, nil, b, headers, &result)
+	return result, r.StatusCode, err
+}
+
 /*** User limits helpers ***/
 
+// LimitsGET performs a `GET /limits` Request.
+func (at *AccountsTester) LimitsGET() (api.LimitsGET, int, error) {
+	var resp api.LimitsGET
+	r, err := at.Request(http.MethodGet, "/limits", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // UserLimits performs a `GET /user/limits` Request.
 func (at *AccountsTester) UserLimits(unit string, headers map[string]string) (api.UserLimitsGET, int, error) {
 	queryParams := url.Values{}
@@ -596,6 +1225,15 @@ func (at *AccountsTester) UserLimits(unit string, headers map[string]string) (ap
 	return resp, r.StatusCode, err
 }
 
+// UserLimitsPubKey performs a `GET /user/pubkeys/:pubKey/limits` Request.
+func (at *AccountsTester) UserLimitsPubKey(pk string, unit string) (api.UserLimitsPubKeyGET, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("unit", unit)
+	var resp api.UserLimitsPubKeyGET
+	r, err := at.Request(http.MethodGet, "/user/pubkeys/"+pk+"/limits", queryParams, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // UserLimitsSkylink performs a `GET /user/limits/:skylink` Request.
 func (at *AccountsTester) UserLimitsSkylink(sl string, unit, apikey string, headers map[string]string) (api.UserLimitsGET, int, error) {
 	queryParams := url.Values{}
@@ -609,6 +1247,19 @@ func (at *AccountsTester) UserLimitsSkylink(sl string, unit, apikey string, head
 	return resp, r.StatusCode, err
 }
 
+// UserLimitsBatchPOST performs a `POST /user/limits/batch` request.
+func (at *AccountsTester) UserLimitsBatchPOST(skylinks []string, unit string, headers map[string]string) (api.UserLimitsBatchPOST, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("unit", unit)
+	b, err := json.Marshal(skylinks)
+	if err != nil {
+		return nil, 0, err
+	}
+	var resp api.UserLimitsBatchPOST
+	r, err := at.Request(http.MethodPost, "/user/limits/batch", queryParams, b, headers, &resp)
+	return resp, r.StatusCode, err
+}
+
 /*** User pubkeys helpers ***/
 
 // UserPubkeyDELETE performs `DELETE /user/pubkey/:pubKey`
@@ -617,6 +1268,13 @@ func (at *AccountsTester) UserPubkeyDELETE(pk database.PubKey) (int, error) {
 	return r.StatusCode, err
 }
 
+// UserPubkeysLIST performs `GET /user/pubkeys`
+func (at *AccountsTester) UserPubkeysLIST() ([]api.UserPubKeyGET, int, error) {
+	var result []api.UserPubKeyGET
+	r, err := at.Request(http.MethodGet, "/user/pubkeys", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
 // UserPubkeyRegisterGET performs a `GET /user/pubkey/register` Request.
 func (at *AccountsTester) UserPubkeyRegisterGET(pubKey string) (api.ChallengePublic, int, error) {
 	query := url.Values{}
@@ -626,6 +1284,20 @@ func (at *AccountsTester) UserPubkeyRegisterGET(pubKey string) (api.ChallengePub
 	return result, r.StatusCode, err
 }
 
+// UserFeaturesGET performs a `GET /user/features` Request.
+func (at *AccountsTester) UserFeaturesGET() (api.UserFeaturesGET, int, error) {
+	var result api.UserFeaturesGET
+	r, err := at.Request(http.MethodGet, "/user/features", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserCapabilitiesGET performs a `GET /user/capabilities` request.
+func (at *AccountsTester) UserCapabilitiesGET() (api.UserCapabilitiesGET, int, error) {
+	var result api.UserCapabilitiesGET
+	r, err := at.Request(http.MethodGet, "/user/capabilities", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
 // UserPubkeyRegisterPOST performs a `POST /user/pubkey/register` Request.
 func (at *AccountsTester) UserPubkeyRegisterPOST(response, signature []byte) (api.UserGET, int, error) {
 	body := database.ChallengeResponseRequest{
@@ -681,6 +1353,61 @@ func (at *AccountsTester) UploadsDELETE(skylink string) (int, error) {
 	return r.StatusCode, err
 }
 
+// UploadsRepinPOST performs `POST /user/uploads/:skylink/repin`
+func (at *AccountsTester) UploadsRepinPOST(skylink string) (int, error) {
+	r, err := at.Request(http.MethodPost, "/user/uploads/"+skylink+"/repin", nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+// UploadsBulkDeletePOST performs `POST /user/uploads-bulk-delete`
+func (at *AccountsTester) UploadsBulkDeletePOST(skylinks []string) (api.UserUploadsBulkDeleteResponse, int, error) {
+	b, err := json.Marshal(skylinks)
+	if err != nil {
+		return api.UserUploadsBulkDeleteResponse{}, http.StatusBadRequest, err
+	}
+	var result api.UserUploadsBulkDeleteResponse
+	r, err := at.Request(http.MethodPost, "/user/uploads-bulk-delete", nil, b, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UploadsSharePOST performs `POST /user/uploads/:skylink/share`
+func (at *AccountsTester) UploadsSharePOST(skylink string, ttl int64) (api.UserUploadsShareResponse, int, error) {
+	b, err := json.Marshal(api.UserUploadsSharePOST{TTL: ttl})
+	if err != nil {
+		return api.UserUploadsShareResponse{}, http.StatusBadRequest, err
+	}
+	var result api.UserUploadsShareResponse
+	r, err := at.Request(http.MethodPost, "/user/uploads/"+skylink+"/share", nil, b, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserGrantsRotatePOST performs `POST /user/grants/rotate`
+func (at *AccountsTester) UserGrantsRotatePOST() (int, error) {
+	r, err := at.Request(http.MethodPost, "/user/grants/rotate", nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+// UserLimitsSkylinkGrant performs a `GET /user/limits/:skylink` Request using
+// a skylink access grant.
+func (at *AccountsTester) UserLimitsSkylinkGrant(sl, unit, grant string) (api.UserLimitsGET, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("unit", unit)
+	queryParams.Set("grant", grant)
+	var resp api.UserLimitsGET
+	r, err := at.Request(http.MethodGet, "/user/limits/"+sl, queryParams, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// TrackDownloadGrant performs a `POST /track/download/:skylink` Request using
+// a skylink access grant.
+func (at *AccountsTester) TrackDownloadGrant(skylink string, bytes int64, grant string) (int, error) {
+	form := url.Values{}
+	form.Set("bytes", fmt.Sprint(bytes))
+	form.Set("grant", grant)
+	r, err := at.Request(http.MethodPost, "/track/download/"+skylink, form, nil, nil, nil)
+	return r.StatusCode, err
+}
+
 /*** Various user helpers ***/
 
 // UserStats performs a `GET /user/stats` Request.
@@ -692,15 +1419,36 @@ func (at *AccountsTester) UserStats(unit string, headers map[string]string) (dat
 	return resp, r.StatusCode, err
 }
 
+// UserStatsTopGET performs a `GET /user/stats` request with the given number
+// of top skylinks.
+func (at *AccountsTester) UserStatsTopGET(top string) (api.UserStatsGET, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("top", top)
+	var resp api.UserStatsGET
+	r, err := at.Request(http.MethodGet, "/user/stats", queryParams, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// UserStatsHistoryGET performs a `GET /user/stats/history` request.
+func (at *AccountsTester) UserStatsHistoryGET(months string) ([]database.UserStatsMonth, int, error) {
+	queryParams := url.Values{}
+	if months != "" {
+		queryParams.Set("months", months)
+	}
+	var resp []database.UserStatsMonth
+	r, err := at.Request(http.MethodGet, "/user/stats/history", queryParams, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // UploadInfo performs a `GET /uploadinfo/:skylink` request.
-func (at *AccountsTester) UploadInfo(sl string) ([]api.UploadInfo, int, error) {
+func (at *AccountsTester) UploadInfo(sl string, params url.Values) (api.UploadInfoGET, int, error) {
 	if !database.ValidSkylink(sl) {
-		return nil, http.StatusBadRequest, database.ErrInvalidSkylink
+		return api.UploadInfoGET{}, http.StatusBadRequest, database.ErrInvalidSkylink
 	}
-	var resp []api.UploadInfo
-	r, err := at.Request(http.MethodGet, "/uploadinfo/"+sl, nil, nil, nil, &resp)
+	var resp api.UploadInfoGET
+	r, err := at.Request(http.MethodGet, "/uploadinfo/"+sl, params, nil, nil, &resp)
 	if err != nil {
-		return nil, r.StatusCode, err
+		return api.UploadInfoGET{}, r.StatusCode, err
 	}
 	return resp, r.StatusCode, nil
 }
@@ -785,6 +1533,18 @@ func (at *AccountsTester) StripePricesGET() ([]api.StripePrice, int, error) {
 	return resp, r.StatusCode, nil
 }
 
+// StripeWebhookPOST performs a `POST /stripe/webhook` with the given event,
+// signed with the given webhook secret.
+func (at *AccountsTester) StripeWebhookPOST(event []byte, secret string) (int, error) {
+	now := time.Now()
+	sig := hex.EncodeToString(webhook.ComputeSignature(now, event, secret))
+	headers := map[string]string{
+		"Stripe-Signature": fmt.Sprintf("t=%d,v1=%s", now.Unix(), sig),
+	}
+	r, err := at.Request(http.MethodPost, "/stripe/webhook", nil, event, headers, nil)
+	return r.StatusCode, err
+}
+
 /*** Promoter helpers ***/
 
 // PromoterSetTierPOST performs a `POST /promoter/settier/:sub`
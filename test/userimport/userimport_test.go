@@ -0,0 +1,137 @@
+package userimport
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/hash"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/SkynetLabs/skynet-accounts/userimport"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// importFixture is an import file with new, existing, duplicate and malformed
+// records. PREFIX is replaced with a value unique to the test run, so we can
+// reuse the test DB, and HASH with a valid argon2id hash.
+const importFixture = `{"email":"PREFIX_new@siasky.net","passwordHash":"HASH","passwordHashAlgorithm":"argon2id","sub":"PREFIX_new","tier":2,"createdAt":"2021-06-01T10:00:00Z","stripeCustomerId":"cus_PREFIX"}
+{"email":"PREFIX_existing@siasky.net","sub":"PREFIX_existing","tier":3}
+{"email":"PREFIX_other@siasky.net","sub":"PREFIX_new","tier":1}
+{"email":"PREFIX_new@siasky.net","sub":"PREFIX_other","tier":1}
+{"email":"PREFIX_taken@siasky.net","sub":"PREFIX_thief","tier":1}
+{"email":"PREFIX_malformed@siasky.net","sub":
+{"email":"PREFIX_nosub@siasky.net","tier":1}
+{"email":"PREFIX_badtier@siasky.net","sub":"PREFIX_badtier","tier":99}
+{"email":"PREFIX_bcrypt@siasky.net","passwordHash":"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy","passwordHashAlgorithm":"bcrypt","sub":"PREFIX_bcrypt","tier":1}
+
+{"sub":"PREFIX_noemail","tier":1}
+{"email":"PREFIX_taken@siasky.net","sub":"PREFIX_taken","tier":1}
+`
+
+// TestImport ensures that the importer creates new users, updates existing
+// ones, skips duplicates and counts malformed records, and that a dry run
+// doesn't change the database.
+func TestImport(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := dbName + "_" + strings.ReplaceAll(time.Now().Format("150405.000000"), ".", "")
+	// Create the users which already exist in the database.
+	existing, err := db.UserCreate(ctx, types.NewEmail(prefix+"_existing@siasky.net"), "", prefix+"_existing", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserCreate(ctx, types.NewEmail(prefix+"_taken@siasky.net"), "", prefix+"_taken", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwHash, err := hash.Generate("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.ReplaceAll(importFixture, "PREFIX", prefix)
+	content = strings.ReplaceAll(content, "HASH", string(pwHash))
+	path := filepath.Join(t.TempDir(), "users.jsonl")
+	err = os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runImport := func(dryRun bool) userimport.Report {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		// Use a small chunk size, so we process the file in several chunks.
+		report, err := userimport.New(db, test.NewDiscardLogger(), dryRun, 3).Import(ctx, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	// A dry run reports what would happen without changing anything.
+	expected := userimport.Report{DryRun: true, Created: 1, Updated: 1, Skipped: 4, Errors: 5}
+	if r := runImport(true); r != expected {
+		t.Fatalf("Expected report %+v, got %+v", expected, r)
+	}
+	_, err = db.UserBySub(ctx, prefix+"_new")
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected %v, got %v", database.ErrUserNotFound, err)
+	}
+	u, err := db.UserBySub(ctx, existing.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Tier != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, u.Tier)
+	}
+
+	// Import the users.
+	expected.DryRun = false
+	if r := runImport(false); r != expected {
+		t.Fatalf("Expected report %+v, got %+v", expected, r)
+	}
+	u, err = db.UserBySub(ctx, prefix+"_new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	if u.Email != types.NewEmail(prefix+"_new@siasky.net") || u.Tier != database.TierPremium5 ||
+		!u.CreatedAt.Equal(createdAt) || u.StripeID != "cus_"+prefix {
+		t.Fatalf("Unexpected imported user %+v", u)
+	}
+	if err = hash.Compare("password", []byte(u.PasswordHash)); err != nil {
+		t.Fatal("Expected the imported password hash to work, got", err)
+	}
+	u, err = db.UserBySub(ctx, existing.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Tier != database.TierPremium20 {
+		t.Fatalf("Expected tier %d, got %d", database.TierPremium20, u.Tier)
+	}
+	for _, sub := range []string{"_thief", "_noemail", "_other"} {
+		_, err = db.UserBySub(ctx, prefix+sub)
+		if !errors.Contains(err, database.ErrUserNotFound) {
+			t.Fatalf("Expected %v for sub %s, got %v", database.ErrUserNotFound, sub, err)
+		}
+	}
+
+	// Importing the same file again doesn't change anything.
+	expected = userimport.Report{Skipped: 6, Errors: 5}
+	if r := runImport(false); r != expected {
+		t.Fatalf("Expected report %+v, got %+v", expected, r)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/types"
@@ -29,6 +31,14 @@ const (
 )
 
 type (
+	// FauxDeliverer is an email.Deliverer which records the messages it's
+	// given instead of sending them. It fails all deliveries while its error
+	// is set via SetErr.
+	FauxDeliverer struct {
+		err      error
+		messages []database.EmailMessage
+		mu       sync.Mutex
+	}
 	// ResponseWriter is a testing ResponseWriter implementation.
 	ResponseWriter struct {
 		Buffer bytes.Buffer
@@ -42,6 +52,31 @@ type (
 	}
 )
 
+// Deliver implementation.
+func (d *FauxDeliverer) Deliver(_ context.Context, msg database.EmailMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.messages = append(d.messages, msg)
+	return nil
+}
+
+// Messages returns the messages delivered so far.
+func (d *FauxDeliverer) Messages() []database.EmailMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]database.EmailMessage{}, d.messages...)
+}
+
+// SetErr sets the error with which the FauxDeliverer fails deliveries.
+func (d *FauxDeliverer) SetErr(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+}
+
 // Header implementation.
 func (w *ResponseWriter) Header() http.Header {
 	return http.Header{}
@@ -72,6 +107,25 @@ func Contains(haystack []string, needle string) bool {
 	return false
 }
 
+// ErrorCode extracts the machine-readable error code from an error response.
+// It accepts both raw response bodies and the errors returned by the tester,
+// which embed the response body.
+func ErrorCode(s string) string {
+	i := strings.Index(s, "{")
+	if i < 0 {
+		return ""
+	}
+	var resp struct {
+		Code string `json:"code"`
+	}
+	// The decoder stops at the end of the JSON object, so we can ignore
+	// anything which follows it.
+	if err := json.NewDecoder(strings.NewReader(s[i:])).Decode(&resp); err != nil {
+		return ""
+	}
+	return resp.Code
+}
+
 // CreateUser is a helper method which simplifies the creation of test users
 func CreateUser(at *AccountsTester, emailAddr types.Email, password string) (*User, error) {
 	// Create a user.
@@ -109,6 +163,12 @@ func CreateUserAndLogin(at *AccountsTester, name string) (*User, *http.Cookie, e
 	if c == nil {
 		return nil, nil, err
 	}
+	// Logging in updates the user, so we refetch them in order to avoid
+	// stale saves.
+	u.User, err = at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "failed to refetch user from the DB")
+	}
 	return u, c, nil
 }
 
@@ -137,6 +197,19 @@ func CreateTestUpload(ctx context.Context, db *database.DB, user database.User,
 	return RegisterTestUpload(ctx, db, user, skylink)
 }
 
+// LatestRecoveryToken returns the newest valid recovery token of the given
+// user.
+func LatestRecoveryToken(ctx context.Context, db *database.DB, user database.User) (string, error) {
+	tokens, err := db.RecoveryTokensByUser(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) == 0 {
+		return "", errors.New("no recovery token")
+	}
+	return tokens[0].Token, nil
+}
+
 // DBNameForTest sanitizes the input string, so it can be used as an email or
 // sub.
 func DBNameForTest(s string) string {
@@ -164,7 +237,7 @@ func RandomSkylink() string {
 // RegisterTestUpload registers an upload of the given skylink by the given user.
 // Returns the skylink, the upload's id and error.
 func RegisterTestUpload(ctx context.Context, db *database.DB, user database.User, skylink *database.Skylink) (*database.Skylink, primitive.ObjectID, error) {
-	up, err := db.UploadCreate(ctx, user, "", *skylink)
+	up, err := db.UploadCreate(ctx, user, "", *skylink, primitive.ObjectID{}, "")
 	if err != nil {
 		return nil, primitive.ObjectID{}, errors.AddContext(err, "failed to register an upload")
 	}
@@ -0,0 +1,123 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505: TOTP is defined over HMAC-SHA1
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+const (
+	// Digits is the number of digits in each code.
+	Digits = 6
+	// Period is the number of seconds for which each code is valid.
+	Period = 30
+	// Skew is the number of periods before and after the current one whose
+	// codes we also accept. This accounts for clock drift and for the time it
+	// takes the user to type the code.
+	Skew = 1
+	// secretSize is the size of the generated secrets in bytes. RFC 4226
+	// recommends 160 bits.
+	secretSize = 20
+)
+
+var (
+	// ErrInvalidSecret is returned when the given secret is not a valid
+	// base32-encoded string.
+	ErrInvalidSecret = errors.New("invalid TOTP secret")
+
+	// encoding is the encoding authenticator apps expect secrets in.
+	encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// GenerateSecret returns a new random base32-encoded secret.
+func GenerateSecret() string {
+	return encoding.EncodeToString(fastrand.Bytes(secretSize))
+}
+
+// Code returns the code for the given secret at the given time.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, step(t)), nil
+}
+
+// Validate checks whether the given code is valid for the given secret at the
+// given time. On success it returns the time step the code belongs to, so
+// callers can reject codes which have already been used.
+func Validate(secret, c string, t time.Time) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(c) != Digits {
+		return 0, false
+	}
+	current := step(t)
+	for s := current - Skew; s <= current+Skew; s++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, s)), []byte(c)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// URL returns an otpauth URL for the given secret, which authenticator apps
+// can import, usually in the form of a QR code.
+//
+// See https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func URL(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(Period))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// code calculates the HOTP value of the given key and counter, as described
+// in RFC 4226.
+func code(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
+
+// decodeSecret decodes the given base32-encoded secret. It ignores case,
+// spaces and padding, since users often copy secrets by hand.
+func decodeSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := encoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// step returns the TOTP time step of the given time.
+func step(t time.Time) int64 {
+	return t.Unix() / Period
+}
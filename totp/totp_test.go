@@ -0,0 +1,101 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCode ensures that Code produces the values given in the test vectors of
+// RFC 6238. The RFC uses 8 digits, so we compare their last 6.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+	for _, tt := range tests {
+		c, err := Code(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != tt.code {
+			t.Fatalf("Expected code '%s' at %d, got '%s'", tt.code, tt.unix, c)
+		}
+	}
+	// Secrets are case and space insensitive.
+	c, err := Code(strings.ToLower(secret[:4])+" "+secret[4:], time.Unix(59, 0))
+	if err != nil || c != "287082" {
+		t.Fatalf("Expected code '%s', got '%s' and error %v", "287082", c, err)
+	}
+	// Invalid secrets are rejected.
+	_, err = Code("not base32!", time.Now())
+	if err != ErrInvalidSecret {
+		t.Fatalf("Expected error '%v', got '%v'", ErrInvalidSecret, err)
+	}
+}
+
+// TestValidate ensures that Validate accepts codes from the current period
+// and the ones next to it and rejects everything else.
+func TestValidate(t *testing.T) {
+	secret := GenerateSecret()
+	now := time.Now()
+	for _, offset := range []int{-Period, 0, Period} {
+		c, err := Code(secret, now.Add(time.Duration(offset)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, ok := Validate(secret, c, now)
+		if !ok {
+			t.Fatalf("Expected code with offset %d to be valid.", offset)
+		}
+		if s != step(now)+int64(offset/Period) {
+			t.Fatalf("Expected step %d, got %d", step(now)+int64(offset/Period), s)
+		}
+	}
+	// Codes outside the allowed skew are rejected.
+	c, err := Code(secret, now.Add(3*Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, c, now); ok {
+		t.Fatal("Expected a code from the future to be rejected.")
+	}
+	// Malformed codes are rejected.
+	for _, c := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(secret, c, now); ok {
+			t.Fatalf("Expected code '%s' to be rejected.", c)
+		}
+	}
+	// Codes for a different secret are rejected. There is a one in a million
+	// chance of collision per period, so we check all three.
+	other := GenerateSecret()
+	c, err = Code(other, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, _ := Code(secret, now.Add(-Period*time.Second))
+	c2, _ := Code(secret, now)
+	c3, _ := Code(secret, now.Add(Period*time.Second))
+	if c != c1 && c != c2 && c != c3 {
+		if _, ok := Validate(secret, c, now); ok {
+			t.Fatal("Expected a code for a different secret to be rejected.")
+		}
+	}
+}
+
+// TestURL ensures that URL produces a well-formed otpauth URL.
+func TestURL(t *testing.T) {
+	u := URL("siasky.net", "user@siasky.net", "ABCDEF")
+	expected := "otpauth://totp/siasky.net:user@siasky.net?algorithm=SHA1&digits=6&issuer=siasky.net&period=30&secret=ABCDEF"
+	if u != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, u)
+	}
+}
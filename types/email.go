@@ -11,9 +11,17 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
+	"net/mail"
 	"strings"
 )
 
+var (
+	// ErrInvalidEmail is returned when an email address is not a valid bare
+	// address, e.g. because it's malformed or has a display name.
+	ErrInvalidEmail = errors.New("invalid email provided")
+)
+
 type (
 	// Email is a string type with some extra rules about its casing (it always
 	// gets converted to lowercase). All subsystems working with emails should
@@ -26,6 +34,19 @@ func NewEmail(s string) Email {
 	return Email(strings.ToLower(s))
 }
 
+// NormalizeEmail is the single place where we turn user input into an Email.
+// It trims the surrounding whitespace and lower-cases the address. It returns
+// ErrInvalidEmail if the result is not a bare address, i.e. if parsing it
+// yields anything other than the address itself.
+func NormalizeEmail(s string) (Email, error) {
+	e := NewEmail(strings.TrimSpace(s))
+	parsed, err := mail.ParseAddress(string(e))
+	if err != nil || parsed.Address != string(e) {
+		return "", ErrInvalidEmail
+	}
+	return e, nil
+}
+
 // MarshalJSON defines a custom marshaller for this type.
 func (e Email) MarshalJSON() ([]byte, error) {
 	return json.Marshal(e.String())
@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -49,3 +50,33 @@ func TestEmail_UnmarshalJSON(t *testing.T) {
 		t.Fatalf("Expected to get a lowercase version of '%s', i.e. '%s' but got '%s'", e, strings.ToLower(string(e)), e)
 	}
 }
+
+// TestNormalizeEmail ensures that NormalizeEmail trims and lower-cases valid
+// addresses and rejects everything that isn't a bare address.
+func TestNormalizeEmail(t *testing.T) {
+	valid := map[string]Email{
+		"user@siasky.net":       "user@siasky.net",
+		"  Foo@X.com\t":         "foo@x.com",
+		"First.Last+tag@Sub.io": "first.last+tag@sub.io",
+	}
+	for in, expected := range valid {
+		e, err := NormalizeEmail(in)
+		if err != nil || e != expected {
+			t.Fatalf("Expected '%s' for '%s', got '%s' and %v", expected, in, e, err)
+		}
+	}
+	invalid := []string{
+		"",
+		"   ",
+		"no-at-sign",
+		"Foo <foo@x.com>",
+		"<foo@x.com>",
+		"foo@x.com, bar@x.com",
+		"foo @x.com",
+	}
+	for _, in := range invalid {
+		if _, err := NormalizeEmail(in); !errors.Is(err, ErrInvalidEmail) {
+			t.Fatalf("Expected %v for '%s', got %v", ErrInvalidEmail, in, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Package userimport imports users from other authentication systems. It reads
+// a newline-delimited JSON file with one user per line and creates or updates
+// the users in our database.
+package userimport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/hash"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// DefaultChunkSize is the default number of lines we process between two
+	// progress reports.
+	DefaultChunkSize = 1000
+	// HashAlgorithmArgon2id is the only password hash algorithm we support
+	// because it's the only one we can verify passwords against.
+	HashAlgorithmArgon2id = "argon2id"
+	// maxLineSize is the longest line we accept in an import file.
+	maxLineSize = 64 * 1024
+)
+
+type (
+	// Record describes a single user in an import file. The email, sub and
+	// tier are required. The password hash and its algorithm, the creation
+	// time and the Stripe customer ID are optional.
+	Record struct {
+		Email                 types.Email `json:"email"`
+		PasswordHash          string      `json:"passwordHash"`
+		PasswordHashAlgorithm string      `json:"passwordHashAlgorithm"`
+		Sub                   string      `json:"sub"`
+		Tier                  int         `json:"tier"`
+		CreatedAt             time.Time   `json:"createdAt"`
+		StripeID              string      `json:"stripeCustomerId"`
+	}
+
+	// Report summarizes the outcome of an import. Skipped counts the records
+	// which duplicate an earlier record in the file, the ones whose email
+	// belongs to another user and the ones which don't change their user.
+	// Errors counts the records which we failed to parse or validate.
+	Report struct {
+		DryRun  bool `json:"dryRun"`
+		Created int  `json:"created"`
+		Updated int  `json:"updated"`
+		Skipped int  `json:"skipped"`
+		Errors  int  `json:"errors"`
+	}
+
+	// Importer imports users into the database.
+	Importer struct {
+		staticChunkSize int
+		staticDB        *database.DB
+		staticDryRun    bool
+		staticLogger    *logrus.Logger
+	}
+
+	// importState holds the progress of an import. We remember the subs and
+	// emails we've seen, so we can skip duplicate records within the file.
+	importState struct {
+		report     Report
+		processed  int
+		seenSubs   map[string]struct{}
+		seenEmails map[types.Email]struct{}
+	}
+
+	// line is a single line of an import file.
+	line struct {
+		num  int
+		data []byte
+	}
+)
+
+// New returns a new Importer. A dry-run importer validates the records and
+// reports what it would do without writing anything to the database.
+func New(db *database.DB, logger *logrus.Logger, dryRun bool, chunkSize int) *Importer {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &Importer{
+		staticChunkSize: chunkSize,
+		staticDB:        db,
+		staticDryRun:    dryRun,
+		staticLogger:    logger,
+	}
+}
+
+// Import reads users from the given newline-delimited JSON stream and imports
+// them. It processes the stream in chunks, so it never holds more than one
+// chunk of lines in memory, and logs its progress after each chunk. Invalid
+// records are logged and counted as errors. Import only returns an error when
+// it fails to read the stream or to access the database, in which case the
+// report covers the lines processed so far.
+func (imp *Importer) Import(ctx context.Context, r io.Reader) (Report, error) {
+	st := &importState{
+		report:     Report{DryRun: imp.staticDryRun},
+		seenSubs:   make(map[string]struct{}),
+		seenEmails: make(map[types.Email]struct{}),
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineSize)
+	chunk := make([]line, 0, imp.staticChunkSize)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		// The scanner reuses its buffer, so we need to copy the line.
+		chunk = append(chunk, line{num: lineNum, data: append([]byte(nil), scanner.Bytes()...)})
+		if len(chunk) < imp.staticChunkSize {
+			continue
+		}
+		err := imp.managedImportChunk(ctx, chunk, st)
+		if err != nil {
+			return st.report, err
+		}
+		chunk = chunk[:0]
+	}
+	if err := scanner.Err(); err != nil {
+		return st.report, errors.AddContext(err, "failed to read the import file")
+	}
+	if len(chunk) > 0 {
+		err := imp.managedImportChunk(ctx, chunk, st)
+		if err != nil {
+			return st.report, err
+		}
+	}
+	return st.report, nil
+}
+
+// managedImportChunk imports the users on the given lines and logs the
+// progress of the import.
+func (imp *Importer) managedImportChunk(ctx context.Context, chunk []line, st *importState) error {
+	for _, l := range chunk {
+		err := imp.managedImportLine(ctx, l, st)
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("failed to import line %d", l.num))
+		}
+	}
+	st.processed += len(chunk)
+	imp.staticLogger.Infof("Processed %d lines: %d created, %d updated, %d skipped, %d errors",
+		st.processed, st.report.Created, st.report.Updated, st.report.Skipped, st.report.Errors)
+	return nil
+}
+
+// managedImportLine imports the user on the given line and updates the report
+// accordingly. It only returns an error if it fails to access the database.
+func (imp *Importer) managedImportLine(ctx context.Context, l line, st *importState) error {
+	if len(bytes.TrimSpace(l.data)) == 0 {
+		return nil
+	}
+	var rec Record
+	err := json.Unmarshal(l.data, &rec)
+	if err == nil {
+		err = rec.validate()
+	}
+	if err != nil {
+		imp.staticLogger.Warnf("Invalid record on line %d: %s", l.num, err)
+		st.report.Errors++
+		return nil
+	}
+	_, dupSub := st.seenSubs[rec.Sub]
+	_, dupEmail := st.seenEmails[rec.Email]
+	if dupSub || dupEmail {
+		imp.staticLogger.Debugf("Skipping duplicate record on line %d", l.num)
+		st.report.Skipped++
+		return nil
+	}
+	st.seenSubs[rec.Sub] = struct{}{}
+	st.seenEmails[rec.Email] = struct{}{}
+
+	// Make sure the email doesn't belong to another user.
+	eu, err := imp.staticDB.UserByEmail(ctx, rec.Email)
+	if err != nil && !errors.Contains(err, database.ErrUserNotFound) {
+		return err
+	}
+	if err == nil && eu.Sub != rec.Sub {
+		imp.staticLogger.Debugf("Skipping record on line %d, its email belongs to another user", l.num)
+		st.report.Skipped++
+		return nil
+	}
+	u, err := imp.staticDB.UserBySub(ctx, rec.Sub)
+	if errors.Contains(err, database.ErrUserNotFound) {
+		if !imp.staticDryRun {
+			u, err = imp.staticDB.UserCreate(ctx, rec.Email, "", rec.Sub, rec.Tier)
+			if err != nil {
+				return errors.AddContext(err, "failed to create user")
+			}
+			rec.apply(u)
+			err = imp.staticDB.UserSave(ctx, u)
+			if err != nil {
+				return errors.AddContext(err, "failed to save user")
+			}
+		}
+		st.report.Created++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !rec.apply(u) {
+		st.report.Skipped++
+		return nil
+	}
+	if !imp.staticDryRun {
+		err = imp.staticDB.UserSave(ctx, u)
+		if err != nil {
+			return errors.AddContext(err, "failed to save user")
+		}
+	}
+	st.report.Updated++
+	return nil
+}
+
+// apply copies the record's values to the given user. We only overwrite the
+// optional fields when the record has a value for them. It returns whether
+// the user changed.
+func (rec Record) apply(u *database.User) bool {
+	changed := false
+	if rec.Email != u.Email {
+		u.Email = rec.Email
+		changed = true
+	}
+	if rec.Tier != u.Tier {
+		u.Tier = rec.Tier
+		changed = true
+	}
+	if rec.PasswordHash != "" && rec.PasswordHash != u.PasswordHash {
+		u.PasswordHash = rec.PasswordHash
+		changed = true
+	}
+	if !rec.CreatedAt.IsZero() && !rec.CreatedAt.Equal(u.CreatedAt) {
+		u.CreatedAt = rec.CreatedAt
+		changed = true
+	}
+	if rec.StripeID != "" && rec.StripeID != u.StripeID {
+		u.StripeID = rec.StripeID
+		changed = true
+	}
+	return changed
+}
+
+// validate checks whether the record describes a user we can import. It also
+// normalizes its email and creation time, so they match what we read back
+// from the database.
+func (rec *Record) validate() error {
+	if rec.Sub == "" {
+		return errors.New("missing sub")
+	}
+	email, err := types.NormalizeEmail(rec.Email.String())
+	if err != nil {
+		return err
+	}
+	rec.Email = email
+	if rec.Tier <= database.TierAnonymous || rec.Tier >= database.TierMaxReserved {
+		return fmt.Errorf("invalid tier %d", rec.Tier)
+	}
+	if rec.PasswordHash != "" || rec.PasswordHashAlgorithm != "" {
+		if rec.PasswordHashAlgorithm != HashAlgorithmArgon2id {
+			return fmt.Errorf("unsupported password hash algorithm '%s'", rec.PasswordHashAlgorithm)
+		}
+		err := hash.Validate(hash.Argon2HashRecord(rec.PasswordHash))
+		if err != nil {
+			return errors.AddContext(err, "invalid password hash")
+		}
+	}
+	rec.CreatedAt = rec.CreatedAt.UTC().Truncate(time.Millisecond)
+	return nil
+}
@@ -0,0 +1,68 @@
+package userimport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/hash"
+)
+
+// TestRecordValidate ensures that we only accept records we can import.
+func TestRecordValidate(t *testing.T) {
+	pwHash, err := hash.Generate("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := Record{Email: "user@siasky.net", Sub: "sub", Tier: database.TierFree}
+	if err = valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+	withHash := valid
+	withHash.PasswordHash = string(pwHash)
+	withHash.PasswordHashAlgorithm = HashAlgorithmArgon2id
+	withHash.CreatedAt = time.Date(2021, 6, 1, 10, 0, 0, 123456789, time.FixedZone("CEST", 7200))
+	if err = withHash.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2021, 6, 1, 8, 0, 0, 123000000, time.UTC); withHash.CreatedAt != expected {
+		t.Fatalf("Expected creation time %v, got %v", expected, withHash.CreatedAt)
+	}
+
+	invalid := map[string]func(r *Record){
+		"missing sub":    func(r *Record) { r.Sub = "" },
+		"missing email":  func(r *Record) { r.Email = "" },
+		"invalid email":  func(r *Record) { r.Email = "not an email" },
+		"anonymous tier": func(r *Record) { r.Tier = database.TierAnonymous },
+		"unknown tier":   func(r *Record) { r.Tier = database.TierMaxReserved },
+		"missing algo":   func(r *Record) { r.PasswordHash = string(pwHash) },
+		"bcrypt":         func(r *Record) { r.PasswordHash, r.PasswordHashAlgorithm = "$2a$10$abc", "bcrypt" },
+		"invalid argon2": func(r *Record) { r.PasswordHash, r.PasswordHashAlgorithm = "$argon2id$v=19", HashAlgorithmArgon2id },
+		"algo, no hash":  func(r *Record) { r.PasswordHashAlgorithm = HashAlgorithmArgon2id },
+	}
+	for name, mutate := range invalid {
+		r := valid
+		mutate(&r)
+		if r.validate() == nil {
+			t.Fatalf("Expected an error for a record with %s", name)
+		}
+	}
+}
+
+// TestRecordApply ensures that applying a record to a user only overwrites the
+// optional fields when the record has a value for them.
+func TestRecordApply(t *testing.T) {
+	u := &database.User{Email: "user@siasky.net", Sub: "sub", Tier: database.TierFree, StripeID: "cus_1", PasswordHash: "hash"}
+	rec := Record{Email: u.Email, Sub: u.Sub, Tier: u.Tier}
+	if rec.apply(u) {
+		t.Fatal("Expected no change.")
+	}
+	if u.StripeID != "cus_1" || u.PasswordHash != "hash" {
+		t.Fatalf("Expected the optional fields to stay, got %+v", u)
+	}
+	rec.Tier = database.TierPremium5
+	rec.StripeID = "cus_2"
+	if !rec.apply(u) || u.Tier != database.TierPremium5 || u.StripeID != "cus_2" {
+		t.Fatalf("Expected the user to change, got %+v", u)
+	}
+}